@@ -0,0 +1,409 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aging implements an active-active buffering (A2) bloom filter, which remembers
+// the recently added items within a fixed memory bound.
+package aging
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// AgingBloom is the A2 filter: it keeps exactly two filters, the active one and the
+// standby one. Add adds items to the active filter, and Check checks both. Once the
+// estimated fill ratio of the active filter is above p, the next Add clears the standby
+// filter and swaps the two, so the items of the old standby filter are forgotten.
+//
+// Add skips the items already in the active filter, and adds the items found only in the
+// standby filter to the active one, so the items added again survive the next swap. The
+// filter remembers at least the items added since the last swap, and holds two filters
+// built for n items whatever the number of items added. Unlike a scalable filter, its
+// memory is bounded, at the cost of forgetting old items.
+//
+// Reference: Yoon, Aging Bloom Filter with Two Active Buffers for Dynamic Sets, IEEE TKDE
+// 2010.
+//
+// Add, Check, Count, Swaps and Stats, and their variants, are safe for concurrent use. The
+// other methods are not.
+type AgingBloom struct {
+	// h is the hash function of the filters, fnv.New64() by default
+	h hash.Hash
+
+	// hn is the name of the hash function, empty if it was set using SetHasher()
+	hn string
+
+	// p is the fill ratio of the active filter above which the filters are swapped, 0.5 by
+	// default
+	p float64
+
+	// e is the error probability of each filter, 0.001 by default
+	e float64
+
+	// n is the number of items each filter is built for
+	n uint
+
+	// active is the filter items are added to, and standby the previous active filter
+	active, standby bloom.Bloom
+
+	// swaps is the number of times the filters were swapped
+	swaps uint64
+
+	// bfc is the bloom filter constructor (New()) that returns the filters
+	bfc func(uint) bloom.Bloom
+
+	// mu guards the filters, so items can be added and checked concurrently.
+	mu sync.RWMutex
+}
+
+var _ bloom.Bloom = (*AgingBloom)(nil)
+
+// New initializes a new aging bloom filter of two filters built by ctor for n items, or by
+// standard.New if ctor is nil.
+func New(n uint, ctor func(uint) bloom.Bloom) bloom.Bloom {
+	bf := &AgingBloom{
+		h:   fnv.New64(),
+		hn:  bloom.DefaultHasher,
+		n:   n,
+		p:   0.5,
+		e:   0.001,
+		bfc: ctor,
+	}
+
+	bf.Reset()
+
+	return bf
+}
+
+// Swaps returns the number of times the active filter was swapped since the last Reset or
+// Clear.
+func (this *AgingBloom) Swaps() uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.swaps
+}
+
+// SetHasher sets the hash function of the filter and both its filters. The items already
+// added would hash to other positions, so it returns bloom.ErrNotEmpty if the filter isn't
+// empty.
+func (this *AgingBloom) SetHasher(h hash.Hash) error {
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.h = h
+	this.hn = ""
+	return this.setHashers()
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. Like SetHasher, it sets the hash function of both filters,
+// and returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *AgingBloom) SetNamedHasher(name string) error {
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.h = h
+	this.hn = name
+	return this.setHashers()
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *AgingBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+func (this *AgingBloom) setHashers() error {
+	if err := this.setHasher(this.active); err != nil {
+		return err
+	}
+	return this.setHasher(this.standby)
+}
+
+// setHasher sets the hash function of an empty filter, by name if it was set by
+// SetNamedHasher and the filter supports it. Otherwise the filter is given a clone of the
+// hash function, or shares it if it can't be cloned.
+func (this *AgingBloom) setHasher(bf bloom.Bloom) error {
+	if this.hn != "" {
+		if nh, ok := bf.(interface{ SetNamedHasher(string) error }); ok {
+			return nh.SetNamedHasher(this.hn)
+		}
+	}
+
+	if h, err := bloom.CloneHasher("", this.h); err == nil {
+		return bf.SetHasher(h)
+	}
+	return bf.SetHasher(this.h)
+}
+
+// Reset rebuilds both filters with the current parameters.
+func (this *AgingBloom) Reset() {
+	if this.h == nil {
+		this.h = fnv.New64()
+	} else {
+		this.h.Reset()
+	}
+
+	this.active = this.newFilter()
+	this.standby = this.newFilter()
+	this.swaps = 0
+}
+
+// Clear removes all the items from both filters, without allocating.
+func (this *AgingBloom) Clear() {
+	this.active.Clear()
+	this.standby.Clear()
+	this.swaps = 0
+}
+
+// SetErrorProbability sets the error probability e of each filter, and resets the filter to
+// rebuild them. It returns bloom.ErrInvalidErrorRate if e is not in (0, 1), and
+// bloom.ErrNotEmpty if items have been added, leaving the filter unchanged.
+func (this *AgingBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetFillRatio sets the fill ratio p of the active filter above which the filters are
+// swapped, and resets the filter to rebuild them. It returns bloom.ErrInvalidFillRatio if p
+// is not in (0, 1), and bloom.ErrNotEmpty if items have been added, leaving the filter
+// unchanged.
+func (this *AgingBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	this.Reset()
+	return nil
+}
+
+// EstimatedFillRatio returns the estimated fill ratio of the active filter.
+func (this *AgingBloom) EstimatedFillRatio() float64 {
+	return this.active.EstimatedFillRatio()
+}
+
+// FillRatio returns the average fill ratio of the two filters.
+func (this *AgingBloom) FillRatio() float64 {
+	return (this.active.FillRatio() + this.standby.FillRatio()) / 2
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *AgingBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns the parameters of each filter, with M set to the total number of bits of
+// both.
+func (this *AgingBloom) Params() bloom.Params {
+	params := this.active.Params()
+	params.M += this.standby.Params().M
+	return params
+}
+
+// Add adds item to the active filter, unless it's already there, swapping the filters
+// first if the estimated fill ratio of the active filter is above p. It is safe to call
+// concurrently with other Adds and Checks.
+func (this *AgingBloom) Add(item []byte) bloom.Bloom {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.active.Check(item) {
+		return this
+	}
+
+	if this.active.EstimatedFillRatio() > this.p {
+		this.standby.Clear()
+		this.active, this.standby = this.standby, this.active
+		this.swaps++
+	}
+
+	this.active.Add(item)
+	return this
+}
+
+// Check returns true if item may have been added to either filter. It is safe to call
+// concurrently with other Checks and Adds.
+func (this *AgingBloom) Check(item []byte) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.active.Check(item) || this.standby.Check(item)
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *AgingBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *AgingBloom) CheckString(s string) bool {
+	return this.Check(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Count returns the number of items in both filters. An item refreshed into the active
+// filter is counted in both.
+func (this *AgingBloom) Count() uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.active.Count() + this.standby.Count()
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the bits set, the compound 1 - (1-pa) * (1-ps) of the current false positive
+// probabilities of the two filters.
+func (this *AgingBloom) CurrentFalsePositiveRate() float64 {
+	return 1 - (1-this.active.CurrentFalsePositiveRate())*(1-this.standby.CurrentFalsePositiveRate())
+}
+
+// ApproximateCardinality estimates the number of distinct items added to the filter as the
+// sum of the estimates of the two filters. An item refreshed into the active filter is
+// counted in both.
+func (this *AgingBloom) ApproximateCardinality() uint64 {
+	return this.active.ApproximateCardinality() + this.standby.ApproximateCardinality()
+}
+
+// Clone returns a deep copy of the filter, cloning both filters. It returns an error if the
+// hasher can't be recreated, see bloom.CloneHasher.
+func (this *AgingBloom) Clone() (bloom.Bloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	bf := &AgingBloom{
+		h:     h,
+		hn:    this.hn,
+		p:     this.p,
+		e:     this.e,
+		n:     this.n,
+		swaps: this.swaps,
+		bfc:   this.bfc,
+	}
+
+	if bf.active, err = this.active.Clone(); err != nil {
+		return nil, err
+	}
+	if bf.standby, err = this.standby.Clone(); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter and its two filters. The memory
+// held by the hasher is not included.
+func (this *AgingBloom) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + this.active.MemoryUsage() + this.standby.MemoryUsage()
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *AgingBloom) String() string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return fmt.Sprintf("aging{n=%d e=%g active=%d standby=%d swaps=%d}", this.n, this.e, this.active.Count(), this.standby.Count(), this.swaps)
+}
+
+// Stats returns the statistics of the filter, with those of the standby and the active
+// filters in Generations, in that order.
+func (this *AgingBloom) Stats() bloom.Stats {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	stats := bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.active.Count() + this.standby.Count(),
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		Generations:        []bloom.Stats{this.standby.Stats(), this.active.Stats()},
+	}
+
+	t := float64(1)
+	for _, s := range stats.Generations {
+		stats.BitsSet += s.BitsSet
+		stats.FillRatio += s.FillRatio / 2
+		t *= 1 - s.FalsePositiveRate
+	}
+	stats.FalsePositiveRate = 1 - t
+
+	return stats
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *AgingBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *AgingBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func (this *AgingBloom) newFilter() bloom.Bloom {
+	var bf bloom.Bloom
+	if this.bfc == nil {
+		bf = standard.New(this.n)
+	} else {
+		bf = this.bfc(this.n)
+	}
+
+	// The filter is empty, so the setters rebuild it with the new parameters
+	this.setHasher(bf)
+	bf.SetErrorProbability(this.e)
+	bf.SetFillRatio(this.p)
+
+	return bf
+}
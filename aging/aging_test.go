@@ -0,0 +1,196 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aging
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	l := []uint{uint(len(web2)), 200000, 100000, 50000}
+	for _, s := range l {
+		fmt.Printf("\n\nTesting aging filter with size %d\n", s)
+		bf := New(s, nil)
+
+		fn, fp := 0, 0
+		for l := range web2 {
+			if !(bf.Add([]byte(web2[l])).Check([]byte(web2[l]))) {
+				fn++
+			}
+		}
+
+		for l := range web2a {
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
+		fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+		bf.PrintStats()
+
+		if fn > 0 {
+			t.Errorf("%d false negatives", fn)
+		}
+	}
+}
+
+// TestAging adds many times n items, and checks that the memory stays the same, the items
+// added since the last swap all match, the items of swaps long gone don't, and an item
+// added again before each swap is never forgotten.
+func TestAging(t *testing.T) {
+	const n = 10000
+
+	for name, ctor := range map[string]func(uint) bloom.Bloom{"standard": nil, "partitioned": partitioned.New} {
+		bf := New(n, ctor).(*AgingBloom)
+		mem := bf.MemoryUsage()
+
+		var (
+			swaps []int
+			last  uint64
+		)
+
+		for i := 0; i < 10*n; i++ {
+			bf.AddString(strconv.Itoa(i))
+
+			if s := bf.Swaps(); s != last {
+				swaps = append(swaps, i)
+				last = s
+				bf.AddString("hot")
+			}
+		}
+
+		if len(swaps) < 5 || bf.MemoryUsage() != mem {
+			t.Fatalf("%s: %d swaps, memory %d, expected more than 5 and %d", name, len(swaps), bf.MemoryUsage(), mem)
+		}
+
+		// Every item since the last swap, and the hot one
+		for i := swaps[len(swaps)-1]; i < 10*n; i++ {
+			if !bf.CheckString(strconv.Itoa(i)) {
+				t.Fatalf("%s: %d added after the last swap not found", name, i)
+			}
+		}
+		if !bf.CheckString("hot") {
+			t.Errorf("%s: refreshed item forgotten", name)
+		}
+
+		// The items before the last two swaps only match as false positives
+		fp := 0
+		for i := 0; i < swaps[len(swaps)-2]; i++ {
+			if bf.CheckString(strconv.Itoa(i)) {
+				fp++
+			}
+		}
+
+		fmt.Printf("%s: %d swaps, %d false positives of %d forgotten items, %s\n", name, len(swaps), fp, swaps[len(swaps)-2], bf)
+		if fp > swaps[len(swaps)-2]/100 {
+			t.Errorf("%s: %d of %d forgotten items found", name, fp, swaps[len(swaps)-2])
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	bf := New(1000, nil).(*AgingBloom)
+	bf.AddString("foo")
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf.Clear()
+	if bf.Count() != 0 || bf.CheckString("foo") {
+		t.Errorf("Cleared filter: %v", bf)
+	}
+
+	if !c.(*AgingBloom).CheckString("foo") {
+		t.Errorf("Clone changed by Clear: %v", c)
+	}
+
+	if err := c.SetErrorProbability(0.01); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected bloom.ErrNotEmpty, got %v", err)
+	}
+
+	if stats := bf.Stats(); len(stats.Generations) != 2 {
+		t.Errorf("%d filters in the stats, expected 2", len(stats.Generations))
+	}
+}
+
+// TestConcurrent adds and checks items from several goroutines, swapping the filters
+// along the way. Run it with -race.
+func TestConcurrent(t *testing.T) {
+	bf := New(1000, nil).(*AgingBloom)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				bf.AddString(strconv.Itoa(w*5000 + i))
+				bf.CheckString(strconv.Itoa(i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if bf.Swaps() == 0 {
+		t.Errorf("Expected the filters to be swapped")
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package attenuated implements an attenuated bloom filter, an array of filters summarizing
+// the items reachable through a neighbor in a network by their distance in hops.
+package attenuated
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// AttenuatedBloom is an array of d standard filters with the same parameters. Level i holds
+// the items i hops away: a node keeps one per neighbor, whose level 0 holds the items of the
+// neighbor, level 1 those of its neighbors, and so on. Check returns the shallowest level
+// matching an item, so queries are routed to the neighbor the item is closest through.
+//
+// A node advertises to a neighbor its own items at level 0, and the filters of its other
+// neighbors attenuated by one level, so that the items i hops away from them are i+1 hops
+// away from it. Propagate merges a filter attenuated that way, and Shift attenuates a filter
+// in place.
+//
+// Reference: Rhea and Kubiatowicz, Probabilistic Location and Routing, INFOCOM 2002.
+type AttenuatedBloom struct {
+	// levels holds the filter of each level, nearest first
+	levels []*standard.StandardBloom
+}
+
+// New initializes a new attenuated bloom filter of depth levels, each a standard filter for
+// n items. depth is at least 1.
+func New(n uint, depth int) *AttenuatedBloom {
+	return newAttenuated(depth, func() bloom.Bloom { return standard.New(n) })
+}
+
+// NewWithEstimates initializes a new attenuated bloom filter of depth levels, each a
+// standard filter for n items with a false positive probability of fpRate.
+func NewWithEstimates(n uint, depth int, fpRate float64) *AttenuatedBloom {
+	return newAttenuated(depth, func() bloom.Bloom { return standard.NewWithEstimates(n, fpRate) })
+}
+
+func newAttenuated(depth int, ctor func() bloom.Bloom) *AttenuatedBloom {
+	if depth < 1 {
+		depth = 1
+	}
+
+	bf := &AttenuatedBloom{levels: make([]*standard.StandardBloom, depth)}
+	for i := range bf.levels {
+		bf.levels[i] = ctor().(*standard.StandardBloom)
+	}
+
+	return bf
+}
+
+// Depth returns the number of levels.
+func (this *AttenuatedBloom) Depth() int {
+	return len(this.levels)
+}
+
+// Level returns the filter of level i, which must be in [0, Depth()). Its items can be
+// changed directly, but its parameters and hasher must stay those of the other levels.
+func (this *AttenuatedBloom) Level(i int) *standard.StandardBloom {
+	return this.levels[i]
+}
+
+// Add adds item at level, the number of hops it is away. level must be in [0, Depth()).
+func (this *AttenuatedBloom) Add(level int, item []byte) *AttenuatedBloom {
+	this.levels[level].Add(item)
+	return this
+}
+
+// AddString is the same as Add(level, []byte(s)), without copying s.
+func (this *AttenuatedBloom) AddString(level int, s string) *AttenuatedBloom {
+	this.levels[level].AddString(s)
+	return this
+}
+
+// Check returns the shallowest level item may have been added at, and true, or -1 and false
+// if it isn't found at any level. A false positive at a level shallower than the true one
+// makes the item look closer than it is.
+func (this *AttenuatedBloom) Check(item []byte) (level int, ok bool) {
+	for i, bf := range this.levels {
+		if bf.Check(item) {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *AttenuatedBloom) CheckString(s string) (level int, ok bool) {
+	return this.Check(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Shift attenuates the filter by one level: the items of level i move to level i+1, the
+// items of the deepest level are dropped, and level 0 is empty. It doesn't allocate.
+func (this *AttenuatedBloom) Shift() {
+	last := this.levels[len(this.levels)-1]
+	last.Clear()
+	copy(this.levels[1:], this.levels)
+	this.levels[0] = last
+}
+
+// Merge adds the items of each level of other to the same level of the filter. Both filters
+// must have the same depth, and their levels must be Compatible, see
+// standard.StandardBloom.Compatible. Otherwise Merge returns an error wrapping
+// bloom.ErrIncompatible and leaves the filter unchanged.
+func (this *AttenuatedBloom) Merge(other *AttenuatedBloom) error {
+	if err := this.compatible(other); err != nil {
+		return err
+	}
+
+	for i := range this.levels {
+		this.levels[i].Union(other.levels[i])
+	}
+
+	return nil
+}
+
+// Propagate adds the items of other attenuated by one level: the items of level i of other
+// are added to level i+1 of the filter, and those of its deepest level are dropped. It is
+// the same as merging a shifted copy of other, without copying or changing it. Like Merge,
+// it returns an error wrapping bloom.ErrIncompatible if the filters aren't compatible, and
+// leaves the filter unchanged.
+func (this *AttenuatedBloom) Propagate(other *AttenuatedBloom) error {
+	if err := this.compatible(other); err != nil {
+		return err
+	}
+
+	for i := len(this.levels) - 1; i > 0; i-- {
+		this.levels[i].Union(other.levels[i-1])
+	}
+
+	return nil
+}
+
+// compatible checks that every level of other can be merged into the same level of the
+// filter, so that Merge and Propagate change nothing if one can't.
+func (this *AttenuatedBloom) compatible(other *AttenuatedBloom) error {
+	if len(this.levels) != len(other.levels) {
+		return fmt.Errorf("%w: depths %d and %d", bloom.ErrIncompatible, len(this.levels), len(other.levels))
+	}
+
+	for i := range this.levels {
+		if err := this.levels[i].Compatible(other.levels[i]); err != nil {
+			return fmt.Errorf("level %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Reset removes all the items from every level.
+func (this *AttenuatedBloom) Reset() {
+	for _, bf := range this.levels {
+		bf.Clear()
+	}
+}
+
+// Clone returns a deep copy of the filter, cloning each level. It returns an error if the
+// hasher can't be recreated, see bloom.CloneHasher.
+func (this *AttenuatedBloom) Clone() (*AttenuatedBloom, error) {
+	bf := &AttenuatedBloom{levels: make([]*standard.StandardBloom, len(this.levels))}
+
+	for i := range this.levels {
+		c, err := this.levels[i].Clone()
+		if err != nil {
+			return nil, err
+		}
+		bf.levels[i] = c.(*standard.StandardBloom)
+	}
+
+	return bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter and all its levels. The memory
+// held by the hashers is not included.
+func (this *AttenuatedBloom) MemoryUsage() uint64 {
+	t := uint64(unsafe.Sizeof(*this)) + uint64(cap(this.levels))*uint64(unsafe.Sizeof(this.levels[0]))
+	for _, bf := range this.levels {
+		t += bf.MemoryUsage()
+	}
+	return t
+}
+
+// String implements fmt.Stringer with a one line summary of the filter, with the count of
+// each level.
+func (this *AttenuatedBloom) String() string {
+	counts := make([]uint64, len(this.levels))
+	for i, bf := range this.levels {
+		counts[i] = bf.Count()
+	}
+	return fmt.Sprintf("attenuated{depth=%d m=%d counts=%v}", len(this.levels), this.levels[0].M(), counts)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attenuated
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+// TestRouting builds the filter a node keeps for its neighbor at the head of a line of 5
+// nodes, each holding a fifth of the words, by propagating the filter of each node to the
+// previous one. The words of the first 3 nodes are found at their distance or closer, the
+// ones further away only as false positives.
+func TestRouting(t *testing.T) {
+	const nodes, depth = 5, 3
+
+	size := (len(web2) + nodes - 1) / nodes
+	part := func(i int) []string {
+		return web2[i*size : min((i+1)*size, len(web2))]
+	}
+
+	var adv *AttenuatedBloom
+	for i := nodes - 1; i >= 0; i-- {
+		bf := New(uint(size), depth)
+		for _, w := range part(i) {
+			bf.AddString(0, w)
+		}
+
+		if adv != nil {
+			if err := bf.Propagate(adv); err != nil {
+				t.Fatal(err)
+			}
+		}
+		adv = bf
+	}
+
+	fmt.Println(adv)
+
+	for i := 0; i < nodes; i++ {
+		levels := make([]int, depth)
+		missing := 0
+		for _, w := range part(i) {
+			if l, ok := adv.CheckString(w); ok {
+				levels[l]++
+			} else {
+				missing++
+			}
+		}
+
+		fmt.Printf("Node %d: found at levels %v, %d not found\n", i, levels, missing)
+
+		if i < depth {
+			if missing > 0 || levels[i] < len(part(i))*99/100 {
+				t.Errorf("Node %d: found at levels %v, %d not found, expected all at level %d", i, levels, missing, i)
+			}
+			for l := i + 1; l < depth; l++ {
+				if levels[l] > 0 {
+					t.Errorf("Node %d: %d found at level %d, further than the node", i, levels[l], l)
+				}
+			}
+		} else if missing < len(part(i))*99/100 {
+			t.Errorf("Node %d: %d of %d found, expected them beyond the depth", i, len(part(i))-missing, len(part(i)))
+		}
+	}
+
+	fp := 0
+	for _, w := range web2a {
+		if _, ok := adv.CheckString(w); ok {
+			fp++
+		}
+	}
+
+	fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+}
+
+func TestShift(t *testing.T) {
+	bf := New(1000, 3)
+	bf.AddString(0, "foo").AddString(1, "bar").AddString(2, "baz")
+
+	// Propagating into an empty filter is the same as shifting
+	p := New(1000, 3)
+	if err := p.Propagate(bf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf.Shift()
+
+	for _, f := range []*AttenuatedBloom{bf, p} {
+		if l, ok := f.CheckString("foo"); !ok || l != 1 {
+			t.Errorf("%v: foo at level %d, %t, expected 1", f, l, ok)
+		}
+		if l, ok := f.CheckString("bar"); !ok || l != 2 {
+			t.Errorf("%v: bar at level %d, %t, expected 2", f, l, ok)
+		}
+		if _, ok := f.CheckString("baz"); ok {
+			t.Errorf("%v: baz found beyond the depth", f)
+		}
+		if f.Level(0).Count() != 0 {
+			t.Errorf("%v: expected level 0 to be empty", f)
+		}
+	}
+
+	bf.AddString(0, "qux")
+	if err := bf.Merge(p); err != nil {
+		t.Fatal(err)
+	}
+	if l, ok := bf.CheckString("qux"); !ok || l != 0 {
+		t.Errorf("qux at level %d, %t, expected 0", l, ok)
+	}
+}
+
+func TestIncompatible(t *testing.T) {
+	bf := New(1000, 3)
+	bf.AddString(0, "foo")
+
+	if err := bf.Merge(New(1000, 2)); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different depth, got %v", err)
+	}
+
+	if err := bf.Propagate(New(2000, 3)); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different size, got %v", err)
+	}
+
+	// Nothing is merged if only the deepest level is incompatible
+	other := New(1000, 3)
+	other.AddString(0, "bar")
+	other.Level(2).SetNamedHasher("fnv64a")
+	if err := bf.Merge(other); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different hasher, got %v", err)
+	}
+
+	if _, ok := bf.CheckString("bar"); ok || bf.Level(0).Count() != 1 {
+		t.Errorf("Filter changed by a failed Merge: %v", bf)
+	}
+}
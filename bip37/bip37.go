@@ -0,0 +1,295 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bip37 implements the bloom filter of BIP 37, as sent by SPV clients in the
+// Bitcoin filterload message.
+//
+// The filter is sized and hashed as specified by the protocol rather than as in the
+// standard package: the i-th bit position of an item is the 32-bit murmur3 of the item,
+// seeded with i*0xfba4c795 + tweak, modulo the number of bits. Bits are numbered from the
+// least significant bit of the first byte. Since the hash function is fixed, Filter does
+// not implement bloom.Bloom.
+package bip37
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/spaolacci/murmur3"
+)
+
+const (
+	// MaxFilterSize is the largest filter, in bytes, accepted by the protocol.
+	MaxFilterSize = 36000
+
+	// MaxHashFuncs is the largest number of hash functions accepted by the protocol.
+	MaxHashFuncs = 50
+
+	// seedMul is multiplied by the hash function index to derive its seed.
+	seedMul = 0xfba4c795
+)
+
+// Flags control how a node updates the filter when it matches a transaction.
+const (
+	UpdateNone         uint8 = 0
+	UpdateAll          uint8 = 1
+	UpdateP2PubKeyOnly uint8 = 2
+)
+
+// ErrTooLarge is returned by Deserialize for filters exceeding MaxFilterSize or
+// MaxHashFuncs, which nodes reject.
+var ErrTooLarge = errors.New("bip37: filter exceeds protocol limits")
+
+type Filter struct {
+	// data is the bit array, with bit i in bit i%8 of byte i/8
+	data []byte
+
+	// k is the number of hash functions
+	k uint32
+
+	// tweak is added to the seed of every hash function
+	tweak uint32
+
+	// flags is one of the Update* constants
+	flags uint8
+
+	// c is the number of items added, since the last Reset or New
+	c uint
+}
+
+// New returns a filter sized for elements items with a false positive rate of fpRate,
+// capped at MaxFilterSize bytes and MaxHashFuncs hash functions, as computed by Bitcoin
+// Core. The flags are set to UpdateNone.
+func New(elements uint, fpRate float64, tweak uint32) *Filter {
+	if elements == 0 {
+		elements = 1
+	}
+
+	m := math.Min(-1/(math.Ln2*math.Ln2)*float64(elements)*math.Log(fpRate), MaxFilterSize*8)
+	size := uint(m) / 8
+	k := math.Min(float64(size*8)/float64(elements)*math.Ln2, MaxHashFuncs)
+
+	return &Filter{
+		data:  make([]byte, size),
+		k:     uint32(k),
+		tweak: tweak,
+	}
+}
+
+// Deserialize parses a filter in the encoding of the filterload message. It returns
+// ErrTooLarge for filters that nodes would reject.
+func Deserialize(b []byte) (*Filter, error) {
+	size, n, err := readCompactSize(b)
+	if err != nil {
+		return nil, err
+	}
+	b = b[n:]
+
+	if size > MaxFilterSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLarge, size)
+	}
+
+	if uint64(len(b)) != size+9 {
+		return nil, fmt.Errorf("bip37: got %d bytes for a %d byte filter, want %d", len(b), size, size+9)
+	}
+
+	this := &Filter{
+		data:  append([]byte(nil), b[:size]...),
+		k:     binary.LittleEndian.Uint32(b[size:]),
+		tweak: binary.LittleEndian.Uint32(b[size+4:]),
+		flags: b[size+8],
+	}
+
+	if this.k > MaxHashFuncs {
+		return nil, fmt.Errorf("%w: %d hash functions", ErrTooLarge, this.k)
+	}
+
+	return this, nil
+}
+
+// Serialize returns the filter in the encoding of the filterload message: the bit array
+// as a length prefixed byte vector, followed by the number of hash functions, the tweak
+// and the flags.
+func (this *Filter) Serialize() []byte {
+	b := appendCompactSize(make([]byte, 0, len(this.data)+18), uint64(len(this.data)))
+	b = append(b, this.data...)
+	b = binary.LittleEndian.AppendUint32(b, this.k)
+	b = binary.LittleEndian.AppendUint32(b, this.tweak)
+	return append(b, this.flags)
+}
+
+func (this *Filter) Add(item []byte) *Filter {
+	if len(this.data) == 0 {
+		return this
+	}
+
+	for i := uint32(0); i < this.k; i++ {
+		v := this.hash(i, item)
+		this.data[v>>3] |= 1 << (v & 7)
+	}
+
+	this.c++
+	return this
+}
+
+// Check reports whether item may be in the filter. Like Bitcoin Core, an empty filter
+// matches everything.
+func (this *Filter) Check(item []byte) bool {
+	if len(this.data) == 0 {
+		return true
+	}
+
+	for i := uint32(0); i < this.k; i++ {
+		v := this.hash(i, item)
+		if this.data[v>>3]&(1<<(v&7)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (this *Filter) Count() uint {
+	return this.c
+}
+
+func (this *Filter) Reset() {
+	for i := range this.data {
+		this.data[i] = 0
+	}
+	this.c = 0
+}
+
+func (this *Filter) HashFuncs() uint32 {
+	return this.k
+}
+
+func (this *Filter) Tweak() uint32 {
+	return this.tweak
+}
+
+func (this *Filter) Flags() uint8 {
+	return this.flags
+}
+
+func (this *Filter) SetFlags(flags uint8) {
+	this.flags = flags
+}
+
+func (this *Filter) FillRatio() float64 {
+	if len(this.data) == 0 {
+		return 0
+	}
+
+	c := 0
+	for _, v := range this.data {
+		for ; v != 0; v &= v - 1 {
+			c++
+		}
+	}
+
+	return float64(c) / float64(len(this.data)*8)
+}
+
+func (this *Filter) EstimatedFillRatio() float64 {
+	if len(this.data) == 0 {
+		return 0
+	}
+
+	return 1 - math.Exp(-float64(this.c)*float64(this.k)/float64(len(this.data)*8))
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *Filter) WriteStats(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "m = %d, k = %d, tweak = %d, flags = %d\n", len(this.data)*8, this.k, this.tweak, this.flags)
+	fmt.Fprintln(&buf, "Total items:", this.c)
+	fmt.Fprintf(&buf, "Fill ratio: %.1f%%\n", this.FillRatio()*100)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use WriteStats to write them elsewhere.
+func (this *Filter) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+// hash returns the bit position of item for the i-th hash function.
+func (this *Filter) hash(i uint32, item []byte) uint32 {
+	return murmur3.Sum32WithSeed(item, i*seedMul+this.tweak) % uint32(len(this.data)*8)
+}
+
+// appendCompactSize appends v in Bitcoin's variable length integer encoding.
+func appendCompactSize(b []byte, v uint64) []byte {
+	switch {
+	case v < 0xfd:
+		return append(b, byte(v))
+	case v <= math.MaxUint16:
+		return binary.LittleEndian.AppendUint16(append(b, 0xfd), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.LittleEndian.AppendUint32(append(b, 0xfe), uint32(v))
+	}
+	return binary.LittleEndian.AppendUint64(append(b, 0xff), v)
+}
+
+// readCompactSize reads a variable length integer from b, rejecting non-canonical
+// encodings as Bitcoin Core does, and returns it with the number of bytes read.
+func readCompactSize(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("bip37: missing filter length")
+	}
+
+	var (
+		v   uint64
+		n   int
+		min uint64
+	)
+
+	switch b[0] {
+	case 0xfd:
+		n, min = 3, 0xfd
+	case 0xfe:
+		n, min = 5, 0x10000
+	case 0xff:
+		n, min = 9, 0x100000000
+	default:
+		return uint64(b[0]), 1, nil
+	}
+
+	if len(b) < n {
+		return 0, 0, fmt.Errorf("bip37: truncated filter length")
+	}
+
+	switch n {
+	case 3:
+		v = uint64(binary.LittleEndian.Uint16(b[1:]))
+	case 5:
+		v = uint64(binary.LittleEndian.Uint32(b[1:]))
+	case 9:
+		v = binary.LittleEndian.Uint64(b[1:])
+	}
+
+	if v < min {
+		return 0, 0, fmt.Errorf("bip37: non-canonical filter length")
+	}
+
+	return v, n, nil
+}
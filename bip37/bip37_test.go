@@ -0,0 +1,155 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bip37
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spaolacci/murmur3"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestMurmur3 checks the hash vectors of Bitcoin Core's hash_tests.cpp.
+func TestMurmur3(t *testing.T) {
+	tests := []struct {
+		want, seed uint32
+		data       string
+	}{
+		{0x00000000, 0x00000000, ""},
+		{0x6a396f08, 0xfba4c795, ""},
+		{0x81f16f39, 0xffffffff, ""},
+		{0x514e28b7, 0x00000000, "00"},
+		{0xea3f0b17, 0xfba4c795, "00"},
+		{0xfd6cf10d, 0x00000000, "ff"},
+		{0x16c6b7ab, 0x00000000, "0011"},
+		{0x8eb51c3d, 0x00000000, "001122"},
+		{0xb4471bf8, 0x00000000, "00112233"},
+		{0xe2301fa8, 0x00000000, "0011223344"},
+		{0xfc2e4a15, 0x00000000, "001122334455"},
+		{0xb074502c, 0x00000000, "00112233445566"},
+		{0x8034d2a0, 0x00000000, "0011223344556677"},
+		{0xb4698def, 0x00000000, "001122334455667788"},
+	}
+
+	for _, tt := range tests {
+		if got := murmur3.Sum32WithSeed(mustDecode(t, tt.data), tt.seed); got != tt.want {
+			t.Errorf("murmur3(%#x, %q) = %#x, want %#x", tt.seed, tt.data, got, tt.want)
+		}
+	}
+}
+
+// TestSerialize checks the filter vectors of Bitcoin Core's bloom_tests.cpp.
+func TestSerialize(t *testing.T) {
+	tests := []struct {
+		tweak uint32
+		want  string
+	}{
+		{0, "03614e9b050000000000000001"},
+		{2147483649, "03ce4299050000000100008001"},
+	}
+
+	for _, tt := range tests {
+		f := New(3, 0.01, tt.tweak)
+		f.SetFlags(UpdateAll)
+
+		f.Add(mustDecode(t, "99108ad8ed9bb6274d3980bab5a85c048f0950c8"))
+		if !f.Check(mustDecode(t, "99108ad8ed9bb6274d3980bab5a85c048f0950c8")) {
+			t.Fatalf("tweak %d: item not found after Add", tt.tweak)
+		}
+
+		// One bit different from the item added
+		if f.Check(mustDecode(t, "19108ad8ed9bb6274d3980bab5a85c048f0950c8")) {
+			t.Fatalf("tweak %d: unexpected match", tt.tweak)
+		}
+
+		f.Add(mustDecode(t, "b5a2c786d9ef4658287ced5914b37a1b4aa32eee"))
+		f.Add(mustDecode(t, "b9300670b4c5366e95b2699e8b18bc75e5f729c5"))
+
+		b := f.Serialize()
+		if !bytes.Equal(b, mustDecode(t, tt.want)) {
+			t.Fatalf("tweak %d: serialized %x, want %s", tt.tweak, b, tt.want)
+		}
+
+		var buf bytes.Buffer
+		want := fmt.Sprintf("m = 24, k = 5, tweak = %d, flags = 1\nTotal items: 3\n", tt.tweak)
+		if err := f.WriteStats(&buf); err != nil || !strings.HasPrefix(buf.String(), want) {
+			t.Errorf("tweak %d: Expected the stats to start with %q, got %q, %v", tt.tweak, want, buf.String(), err)
+		}
+
+		f2, err := Deserialize(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f2.HashFuncs() != f.HashFuncs() || f2.Tweak() != tt.tweak || f2.Flags() != UpdateAll {
+			t.Fatalf("tweak %d: got k = %d, tweak = %d, flags = %d after Deserialize", tt.tweak, f2.HashFuncs(), f2.Tweak(), f2.Flags())
+		}
+
+		if !f2.Check(mustDecode(t, "b9300670b4c5366e95b2699e8b18bc75e5f729c5")) {
+			t.Fatalf("tweak %d: item not found after Deserialize", tt.tweak)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	f := New(1000000, 0.0001, 0)
+	if len(f.Serialize()) != 3+MaxFilterSize+9 || f.HashFuncs() > MaxHashFuncs {
+		t.Fatalf("filter of %d bytes with k = %d exceeds limits", len(f.Serialize())-12, f.HashFuncs())
+	}
+
+	f = New(1, 1e-30, 0)
+	if f.HashFuncs() != MaxHashFuncs {
+		t.Fatalf("k = %d, want %d", f.HashFuncs(), MaxHashFuncs)
+	}
+
+	big := appendCompactSize(nil, MaxFilterSize+1)
+	big = append(big, make([]byte, MaxFilterSize+1+9)...)
+	if _, err := Deserialize(big); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Deserialize of %d byte filter returned %v, want ErrTooLarge", MaxFilterSize+1, err)
+	}
+
+	b := New(3, 0.01, 0).Serialize()
+	b[len(b)-9] = MaxHashFuncs + 1
+	if _, err := Deserialize(b); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Deserialize with k = %d returned %v, want ErrTooLarge", MaxHashFuncs+1, err)
+	}
+
+	for _, s := range []string{"", "03614e9b05", "fd0300614e9b050000000000000001", "03614e9b05000000000000000100"} {
+		if _, err := Deserialize(mustDecode(t, s)); err == nil {
+			t.Fatalf("Deserialize(%s) succeeded", s)
+		}
+	}
+
+	// An empty filter matches everything and ignores Add.
+	e, err := Deserialize(mustDecode(t, "00000000000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Add([]byte("foo")).Check([]byte("bar")) {
+		t.Fatalf("empty filter doesn't match")
+	}
+}
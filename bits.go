@@ -0,0 +1,307 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// Encoding selects how the bit arrays of a filter are serialized.
+type Encoding uint8
+
+const (
+	// EncodingAuto writes sparse bit arrays if the fill ratio of the filter is below
+	// SparseFillRatio, and dense bit arrays otherwise.
+	EncodingAuto Encoding = iota
+
+	// EncodingDense writes every word of the bit arrays.
+	EncodingDense
+
+	// EncodingSparse writes only the positions of the set bits.
+	EncodingSparse
+)
+
+// SparseFillRatio is the fill ratio below which EncodingAuto selects EncodingSparse. Each
+// set bit costs one to a few bytes in the sparse encoding, against m/8 bytes for the whole
+// dense bit array, so sparse is smaller up to a fill ratio of roughly 1/16.
+const SparseFillRatio = 0.05
+
+// WriteOptions controls how a filter is serialized. A nil *WriteOptions is the same as
+// the zero value.
+type WriteOptions struct {
+	// Encoding selects dense or sparse bit arrays. It defaults to EncodingAuto.
+	Encoding Encoding
+
+	// Compression selects the codec applied to the body of the filter. It defaults to
+	// CompressionNone.
+	Compression Compression
+}
+
+// Sparse reports whether bit arrays should be written sparsely for a filter with the
+// given fill ratio.
+func (this *WriteOptions) Sparse(fill float64) bool {
+	if this == nil || this.Encoding == EncodingAuto {
+		return fill < SparseFillRatio
+	}
+	return this.Encoding == EncodingSparse
+}
+
+// Flags returns the header flags for a filter with the given fill ratio.
+func (this *WriteOptions) Flags(fill float64) uint16 {
+	var flags uint16
+	if this.Sparse(fill) {
+		flags |= FlagSparse
+	}
+	if this != nil && this.Compression == CompressionGzip {
+		flags |= FlagGzip
+	}
+	return flags
+}
+
+// Encoder is implemented by filters that can be serialized with options. WriteTo is the
+// same as Encode with nil options.
+type Encoder interface {
+	Encode(w io.Writer, opts *WriteOptions) (int64, error)
+}
+
+// chunkSize is the size of the buffer used to write and read bit arrays, so serializing a
+// filter never needs a second copy of its bit array.
+const chunkSize = 1 << 20
+
+// WriteBits writes the first m bits held in words to w. Dense bit arrays are written as
+// big endian words. Sparse bit arrays are written as the number of set bits followed by
+// their positions, each as the uvarint encoded gap from the previous one. The bits are
+// written in chunks of at most 1 MiB, and WriteBits returns at the first write error.
+func WriteBits(w io.Writer, words []uint64, m uint, sparse bool) (int64, error) {
+	nw := int((m + 63) / 64)
+
+	// Words missing from words are written as zeros.
+	word := func(i int) uint64 {
+		if i < len(words) {
+			return words[i]
+		}
+		return 0
+	}
+
+	var total int64
+	flush := func(buf []byte) ([]byte, error) {
+		n, err := w.Write(buf)
+		total += int64(n)
+		return buf[:0], err
+	}
+
+	if !sparse {
+		buf := make([]byte, 0, min(nw*8, chunkSize))
+		for i := 0; i < nw; i++ {
+			buf = binary.BigEndian.AppendUint64(buf, word(i))
+			if len(buf) == cap(buf) {
+				var err error
+				if buf, err = flush(buf); err != nil {
+					return total, err
+				}
+			}
+		}
+
+		if len(buf) > 0 {
+			_, err := flush(buf)
+			return total, err
+		}
+		return total, nil
+	}
+
+	c := 0
+	for i := 0; i < nw; i++ {
+		c += bits.OnesCount64(word(i))
+	}
+
+	buf := binary.AppendUvarint(make([]byte, 0, min(c+binary.MaxVarintLen64, chunkSize)), uint64(c))
+	prev := uint64(0)
+	for i := 0; i < nw; i++ {
+		for v := word(i); v != 0; v &= v - 1 {
+			pos := uint64(i)*64 + uint64(bits.TrailingZeros64(v))
+			buf = binary.AppendUvarint(buf, pos-prev)
+			prev = pos
+		}
+
+		if len(buf) >= chunkSize-64*binary.MaxVarintLen64 {
+			var err error
+			if buf, err = flush(buf); err != nil {
+				return total, err
+			}
+		}
+	}
+
+	_, err := flush(buf)
+	return total, err
+}
+
+// ReadBits reads m bits written by WriteBits from r into words, which must be zeroed and
+// hold at least m bits. It consumes exactly the bytes written by WriteBits.
+func ReadBits(r io.Reader, words []uint64, m uint, sparse bool) (int64, error) {
+	nw := int((m + 63) / 64)
+	if len(words) < nw {
+		return 0, fmt.Errorf("bloom: need %d words for %d bits, got %d", nw, m, len(words))
+	}
+
+	if !sparse {
+		var total int64
+
+		buf := make([]byte, min(nw*8, chunkSize))
+		for i := 0; i < nw; {
+			l := min((nw-i)*8, len(buf))
+			n, err := io.ReadFull(r, buf[:l])
+			total += int64(n)
+			if err != nil {
+				return total, fmt.Errorf("bloom: bit array too short, need %d bytes for m = %d, got %d", nw*8, m, total)
+			}
+
+			for j := 0; j < l; j, i = j+8, i+1 {
+				words[i] = binary.BigEndian.Uint64(buf[j:])
+			}
+		}
+
+		return total, nil
+	}
+
+	return readSparse(r, m, func(pos uint64) {
+		words[pos>>6] |= 1 << (pos & 63)
+	})
+}
+
+// readSparse reads the positions of a sparse bit array of m bits written by WriteBits
+// from r, calling set with each of them.
+func readSparse(r io.Reader, m uint, set func(pos uint64)) (int64, error) {
+	br := &byteReader{r: r}
+
+	c, err := binary.ReadUvarint(br)
+	if err != nil {
+		return br.n, fmt.Errorf("bloom: reading sparse bit count: %v", err)
+	}
+
+	if c > uint64(m) {
+		return br.n, fmt.Errorf("bloom: %d set bits in a bit array of %d bits", c, m)
+	}
+
+	pos := uint64(0)
+	for i := uint64(0); i < c; i++ {
+		d, err := binary.ReadUvarint(br)
+		if err != nil {
+			return br.n, fmt.Errorf("bloom: reading sparse bit %d of %d: %v", i, c, err)
+		}
+
+		if i > 0 && d == 0 {
+			return br.n, fmt.Errorf("bloom: duplicate sparse bit position %d", pos)
+		}
+
+		pos += d
+		if pos >= uint64(m) {
+			return br.n, fmt.Errorf("bloom: sparse bit position %d out of range for m = %d", pos, m)
+		}
+
+		set(pos)
+	}
+
+	return br.n, nil
+}
+
+// MaxUnsizedBits is the largest bit array CheckBits accepts when the size of the bit
+// array isn't bounded by the input, 2^32 - 1 bits, or 512 MiB. A sparse bit array of any size
+// may be written in a few bytes, and a compressed one may inflate to any size.
+var MaxUnsizedBits uint = math.MaxUint32
+
+// CheckBits returns an error if r can't hold the m bits of a bit array written by
+// WriteBits, so decoders can check m, read from a header, before allocating the bit array
+// and reading it with ReadBits. A dense bit array needs m/8 bytes, which are checked against
+// the bytes left in r if r has a Len method, as bytes.Reader, or is a regular file. Bit
+// arrays of other sizes than that, sparse or read from other readers, are checked against
+// MaxUnsizedBits.
+func CheckBits(r io.Reader, m uint, sparse bool) error {
+	if !sparse {
+		if l, ok := remaining(r); ok {
+			if uint64(m/8) > uint64(l) {
+				return fmt.Errorf("bloom: bit array too short, need %d bytes for m = %d, got %d", m/8, m, l)
+			}
+			return nil
+		}
+	}
+
+	if m > MaxUnsizedBits {
+		return fmt.Errorf("bloom: bit array of %d bits, more than %d", m, MaxUnsizedBits)
+	}
+	return nil
+}
+
+// remaining returns the number of bytes left in r, if r tells.
+func remaining(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case *BodyReader:
+		if r.z != nil {
+			return 0, false
+		}
+		return remaining(r.r.r)
+
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false
+		}
+
+		off, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return fi.Size() - off, true
+	}
+
+	return 0, false
+}
+
+// byteReader reads one byte at a time from r, so that decoding uvarints or compressed
+// streams never consumes bytes past the end of the bit array.
+type byteReader struct {
+	r   io.Reader
+	buf [1]byte
+	n   int64
+}
+
+func (this *byteReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += int64(n)
+	return n, err
+}
+
+func (this *byteReader) ReadByte() (byte, error) {
+	if br, ok := this.r.(io.ByteReader); ok {
+		b, err := br.ReadByte()
+		if err == nil {
+			this.n++
+		}
+		return b, err
+	}
+
+	if _, err := io.ReadFull(this.r, this.buf[:]); err != nil {
+		return 0, err
+	}
+	this.n++
+	return this.buf[0], nil
+}
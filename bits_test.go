@@ -0,0 +1,142 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failingWriter fails once more than n bytes have been written.
+type failingWriter struct {
+	n, writes int
+}
+
+func (this *failingWriter) Write(p []byte) (int, error) {
+	this.writes++
+	if len(p) > this.n {
+		return 0, errors.New("disk full")
+	}
+	this.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteBitsChunks(t *testing.T) {
+	m := uint(3*chunkSize*8 + 100)
+	words := make([]uint64, (m+63)/64)
+	for i := range words {
+		words[i] = uint64(i) * 0x9e3779b97f4a7c15
+	}
+	words[len(words)-1] &= 1<<(m%64) - 1
+
+	for _, sparse := range []bool{false, true} {
+		var buf bytes.Buffer
+		n, err := WriteBits(&buf, words, m, sparse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int64(buf.Len()) {
+			t.Fatalf("sparse = %t: WriteBits returned %d, wrote %d bytes", sparse, n, buf.Len())
+		}
+
+		got := make([]uint64, len(words))
+		if n, err := ReadBits(bytes.NewReader(buf.Bytes()), got, m, sparse); err != nil || n != int64(buf.Len()) {
+			t.Fatalf("sparse = %t: ReadBits returned %d, %v", sparse, n, err)
+		}
+
+		for i := range words {
+			if got[i] != words[i] {
+				t.Fatalf("sparse = %t: word %d is %x, want %x", sparse, i, got[i], words[i])
+			}
+		}
+
+		// A write error stops WriteBits at the chunk that failed.
+		fw := &failingWriter{n: chunkSize}
+		if _, err := WriteBits(fw, words, m, sparse); err == nil || fw.writes != 2 {
+			t.Fatalf("sparse = %t: WriteBits returned %v after %d writes, want an error after 2", sparse, err, fw.writes)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := WriteBits(ContextWriter(ctx, &bytes.Buffer{}), words, m, false); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WriteBits returned %v, want context.Canceled", err)
+	}
+}
+
+func TestCheckBits(t *testing.T) {
+	m := uint(3*chunkSize*8 + 100)
+	words := make([]uint64, (m+63)/64)
+
+	var buf bytes.Buffer
+	if _, err := WriteBits(&buf, words, m, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckBits(bytes.NewReader(buf.Bytes()), m, false); err != nil {
+		t.Errorf("Expected no error for a dense bit array of %d bits, got %v", m, err)
+	}
+
+	if err := CheckBits(bytes.NewReader(buf.Bytes()[:m/8-1]), m, false); err == nil {
+		t.Errorf("Expected an error for a truncated dense bit array")
+	}
+
+	// A header claiming more bits than there are fails rather than allocating them
+	if err := CheckBits(bytes.NewReader(make([]byte, 200)), 1<<40, false); err == nil {
+		t.Errorf("Expected an error for a dense bit array of 2^40 bits in 200 bytes")
+	}
+
+	path := filepath.Join(t.TempDir(), "bits")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(8, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckBits(f, m, false); err == nil {
+		t.Errorf("Expected an error for a dense bit array 8 bytes short in a file")
+	}
+
+	if err := CheckBits(f, m-64, false); err != nil {
+		t.Errorf("Expected no error for a dense bit array in the rest of a file, got %v", err)
+	}
+
+	// Sparse bit arrays, and readers of unknown size, are limited to MaxUnsizedBits
+	if err := CheckBits(bytes.NewReader([]byte{0}), MaxUnsizedBits, true); err != nil {
+		t.Errorf("Expected no error for a sparse bit array of MaxUnsizedBits, got %v", err)
+	}
+
+	if err := CheckBits(bytes.NewReader([]byte{0}), MaxUnsizedBits+1, true); err == nil {
+		t.Errorf("Expected an error for a sparse bit array of more than MaxUnsizedBits")
+	}
+
+	if err := CheckBits(io.MultiReader(bytes.NewReader(buf.Bytes())), MaxUnsizedBits+1, false); err == nil {
+		t.Errorf("Expected an error for a dense bit array of more than MaxUnsizedBits from an unsized reader")
+	}
+}
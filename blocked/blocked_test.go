@@ -0,0 +1,264 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blocked
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	l := []uint{uint(len(web2)), 200000, 100000, 50000}
+	for _, s := range l {
+		fmt.Printf("\n\nTesting blocked filter with size %d\n", s)
+		bf := New(s).(*BlockedBloom)
+
+		fn, fp := 0, 0
+		for l := range web2 {
+			if !(bf.Add([]byte(web2[l])).Check([]byte(web2[l]))) {
+				fn++
+			}
+		}
+
+		for l := range web2a {
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
+		fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+		fmt.Printf("Expected false positives: %.4f%%, from the bits set: %.4f%%\n", bf.ExpectedFalsePositiveRate()*100, bf.CurrentFalsePositiveRate()*100)
+		bf.PrintStats()
+
+		if fn > 0 {
+			t.Errorf("%d false negatives", fn)
+		}
+	}
+}
+
+// TestFalsePositiveRate measures the false positive rate of filters at capacity, and compares
+// it with the rate of a standard filter of the same m and k, and the rate predicted for the
+// blocked filter.
+func TestFalsePositiveRate(t *testing.T) {
+	const n, checks = 100000, 1000000
+
+	for _, e := range []float64{0.01, 0.001, 0.0001} {
+		bf := NewWithEstimates(n, e).(*BlockedBloom)
+		sf := standard.NewWithEstimates(n, e)
+
+		for i := uint64(0); i < n; i++ {
+			bf.AddUint64(i)
+			sf.(*standard.StandardBloom).AddUint64(i)
+		}
+
+		bfp, sfp := 0, 0
+		for i := uint64(n); i < n+checks; i++ {
+			if bf.CheckUint64(i) {
+				bfp++
+			}
+			if sf.(*standard.StandardBloom).CheckUint64(i) {
+				sfp++
+			}
+		}
+
+		measured, expected := float64(bfp)/checks, bf.ExpectedFalsePositiveRate()
+		fmt.Printf("e = %g: standard %.4f%%, blocked %.4f%% (expected %.4f%%, %.2fx standard)\n",
+			e, float64(sfp)/checks*100, measured*100, expected*100, measured/(float64(sfp)/checks))
+
+		// The blocked filter is worse than e, and the prediction is accurate
+		if expected <= e || math.Abs(measured-expected) > 0.2*expected {
+			t.Errorf("e = %g: measured %f, expected %f", e, measured, expected)
+		}
+
+		if rate := bf.CurrentFalsePositiveRate(); math.Abs(rate-expected) > 0.2*expected {
+			t.Errorf("e = %g: rate from the bits set %f, expected %f", e, rate, expected)
+		}
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	for n := uint(1); n < 100; n++ {
+		words := alignedWords(n * blockWords)
+		if uintptr(unsafe.Pointer(&words[0]))%64 != 0 || uint(len(words)) != n*blockWords {
+			t.Fatalf("%d blocks not aligned: %p, %d words", n, &words[0], len(words))
+		}
+	}
+
+	bf := New(1000).(*BlockedBloom)
+	if bf.M()%BlockBits != 0 || uint(len(bf.words)) != bf.M()/64 {
+		t.Errorf("m = %d, %d words, expected whole blocks", bf.M(), len(bf.words))
+	}
+}
+
+func TestSerialization(t *testing.T) {
+	bf := New(uint(len(web2))).(*BlockedBloom)
+	if err := bf.SetNamedHasher("fnv64a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	for _, opts := range []*bloom.WriteOptions{nil, {Compression: bloom.CompressionGzip}} {
+		var buf bytes.Buffer
+		if _, err := bf.Encode(&buf, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		bf2, err := bloom.Load(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bf2.Params() != bf.Params() || bf2.Count() != bf.Count() || bf2.(*BlockedBloom).HasherName() != "fnv64a" {
+			t.Errorf("Decoded %v, expected %v", bf2, bf)
+		}
+
+		for _, w := range web2 {
+			if !bf2.(*BlockedBloom).CheckString(w) {
+				t.Fatalf("Expected to find %q in the decoded filter", w)
+			}
+		}
+
+		if uintptr(unsafe.Pointer(&bf2.(*BlockedBloom).words[0]))%64 != 0 {
+			t.Errorf("Decoded bit array is not aligned")
+		}
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := new(BlockedBloom).UnmarshalBinary(append(data, 0)); err == nil {
+		t.Errorf("Expected an error decoding trailing data")
+	}
+}
+
+func TestClone(t *testing.T) {
+	bf := New(1000).(*BlockedBloom)
+	bf.AddString("foo")
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf.AddString("bar")
+
+	if cb := c.(*BlockedBloom); !cb.CheckString("foo") || cb.CheckString("bar") || cb.Count() != 1 {
+		t.Errorf("Expected the clone to hold foo only")
+	}
+}
+
+// BenchmarkCheckLarge checks the items of filters much larger than the CPU caches, each of
+// them touching k cache lines of the standard filter and one of the blocked filter.
+func BenchmarkCheckLarge(b *testing.B) {
+	const n, added = 1 << 25, 1 << 20
+
+	ctors := []struct {
+		name string
+		ctor func(uint) bloom.Bloom
+	}{
+		{"standard", standard.New},
+		{"blocked", New},
+	}
+
+	for _, c := range ctors {
+		b.Run(c.name, func(b *testing.B) {
+			bf := c.ctor(n).(interface {
+				bloom.Bloom
+				AddUint64(uint64) bloom.Bloom
+				CheckUint64(uint64) bool
+			})
+
+			for i := uint64(0); i < added; i++ {
+				bf.AddUint64(i * 0x9e3779b97f4a7c15)
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				bf.CheckUint64(uint64(i%added) * 0x9e3779b97f4a7c15)
+			}
+			b.ReportMetric(float64(bf.MemoryUsage())/(1<<20), "MiB")
+		})
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	bf := New(uint(len(web2))).(*BlockedBloom)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddString(web2[i%len(web2)])
+	}
+}
+
+func TestAllocs(t *testing.T) {
+	bf := New(1000).(*BlockedBloom)
+	allocs := testing.AllocsPerRun(1000, func() {
+		bf.AddString("hello")
+		bf.CheckString("world")
+	})
+
+	if allocs != 0 {
+		t.Errorf("%f allocations per AddString and CheckString, expected 0", allocs)
+	}
+}
@@ -15,31 +15,208 @@
 package bloom
 
 import (
+	"errors"
 	"hash"
+	"io"
 	"math"
+	"math/bits"
+)
+
+var (
+	// ErrInvalidCapacity is returned when the number of items a filter is built for is 0.
+	ErrInvalidCapacity = errors.New("bloom: capacity must be greater than 0")
+
+	// ErrInvalidErrorRate is returned when an error probability is not in (0, 1).
+	ErrInvalidErrorRate = errors.New("bloom: error probability must be between 0 and 1")
+
+	// ErrInvalidFillRatio is returned when a fill ratio is not in (0, 1).
+	ErrInvalidFillRatio = errors.New("bloom: fill ratio must be between 0 and 1")
+
+	// ErrInvalidHashCount is returned when a number of hash values is not in [1, MaxHashCount].
+	ErrInvalidHashCount = errors.New("bloom: number of hash values must be between 1 and 64")
+
+	// ErrTooLarge is returned when the number of bits of a filter doesn't fit in a uint.
+	ErrTooLarge = errors.New("bloom: filter too large")
+
+	// ErrNotEmpty is returned when changing a parameter of a filter that already holds items,
+	// which would require rebuilding it from the items.
+	ErrNotEmpty = errors.New("bloom: filter is not empty")
+
+	// ErrIncompatible is returned when combining filters built with different parameters
+	// or hashers.
+	ErrIncompatible = errors.New("bloom: incompatible filters")
 )
 
 type Bloom interface {
 	Add(key []byte) Bloom
 	Check(key []byte) bool
-	Count() uint
+	Count() uint64
 	PrintStats()
-	SetHasher(hash.Hash)
+	Stats() Stats
+	WriteStats(w io.Writer) error
+	SetHasher(hash.Hash) error
 	Reset()
+	Clear()
 	FillRatio() float64
 	EstimatedFillRatio() float64
-	SetErrorProbability(e float64)
+	SetErrorProbability(e float64) error
+	SetFillRatio(p float64) error
+	Params() Params
+	Clone() (Bloom, error)
+	ApproximateCardinality() uint64
+	CurrentFalsePositiveRate() float64
+	MemoryUsage() uint64
+}
+
+// Introspector is implemented by filters that report the parameters in use and the name
+// of their hasher. The values are the same as in Params. HasherName is empty if the hash
+// function was set with SetHasher rather than by name.
+type Introspector interface {
+	K() uint
+	M() uint
+	S() uint
+	HasherName() string
+}
+
+// Params holds the parameters of a filter: the number of bits m, the number of hash
+// functions k, the size of each partition s, the number of items n the filter was built
+// for, the fill ratio p and the error probability e. Parameters that don't apply to a
+// filter, such as S for the standard filter, are 0.
+//
+// K is derived from E with K, unless PinnedK is set: K was then set by the user, and P is
+// derived from K and E with P, so M still gives the error probability E.
+type Params struct {
+	M, K, S, N uint
+	P, E       float64
+	PinnedK    bool
+}
+
+// Validate checks the parameters a filter is built with: n items, a fill ratio p and an
+// error probability e. With any of them out of range, K and M return meaningless values.
+// It also returns ErrTooLarge if the number of bits doesn't fit in a uint.
+func Validate(n uint, p, e float64) error {
+	if n == 0 {
+		return ErrInvalidCapacity
+	}
+
+	if err := ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if err := ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	_, err := CheckedM(n, p, e)
+	return err
+}
+
+// ValidateFillRatio returns ErrInvalidFillRatio if p is not in (0, 1).
+func ValidateFillRatio(p float64) error {
+	if !(p > 0 && p < 1) {
+		return ErrInvalidFillRatio
+	}
+	return nil
+}
+
+// ValidateErrorRate returns ErrInvalidErrorRate if e is not in (0, 1).
+func ValidateErrorRate(e float64) error {
+	if !(e > 0 && e < 1) {
+		return ErrInvalidErrorRate
+	}
+	return nil
 }
 
 func K(e float64) uint {
 	return uint(math.Ceil(math.Log2(1 / e)))
 }
 
+// MaxHashCount is the largest number of hash values accepted by ValidateHashCount. K
+// returns at most 64 for e down to 2^-64.
+const MaxHashCount = 64
+
+// ValidateHashCount returns ErrInvalidHashCount if k is not in [1, MaxHashCount].
+func ValidateHashCount(k uint) error {
+	if k == 0 || k > MaxHashCount {
+		return ErrInvalidHashCount
+	}
+	return nil
+}
+
+// P returns the fill ratio at which a filter with k hash values has the error probability
+// e, e^(1/k), as an item is a false positive if its k bits are set. M(n, P(k, e), e) is
+// then the number of bits giving e with k hash values rather than K(e).
+func P(k uint, e float64) float64 {
+	return math.Pow(e, 1/float64(k))
+}
+
+// M returns the number of bits of a filter for n items with a fill ratio p and an error
+// probability e. It returns math.MaxUint if the number of bits doesn't fit in a uint, see
+// CheckedM.
 func M(n uint, p, e float64) uint {
+	m, _ := CheckedM(n, p, e)
+	return m
+}
+
+// CheckedM is the same as M, but returns ErrTooLarge along with math.MaxUint if the number
+// of bits doesn't fit in a uint, which happens for large n on 32-bit platforms.
+func CheckedM(n uint, p, e float64) (uint, error) {
 	// m =~ n / ((log(p)*log(1-p))/abs(log e))
-	return uint(math.Ceil(float64(n) / ((math.Log(p) * math.Log(1-p)) / math.Abs(math.Log(e)))))
+	m := math.Ceil(float64(n) / ((math.Log(p) * math.Log(1-p)) / math.Abs(math.Log(e))))
+
+	// float64(math.MaxUint) rounds up to a power of 2, so any m below it converts exactly
+	if !(m < float64(math.MaxUint)) {
+		return math.MaxUint, ErrTooLarge
+	}
+
+	return uint(m), nil
 }
 
 func S(m, k uint) uint {
 	return uint(math.Ceil(float64(m) / float64(k)))
 }
+
+// PowerOfTwo returns the smallest power of two not below m, or m if there is none in a
+// uint. A filter of PowerOfTwo(m) bits maps its positions to its bits with a mask rather
+// than a division, see DigestPositions.
+func PowerOfTwo(m uint) uint {
+	if m <= 1 || m > 1<<(bits.UintSize-1) {
+		return max(m, 1)
+	}
+	return 1 << bits.Len(m-1)
+}
+
+// NextPrime returns the smallest prime not below n, found by trial division, which takes
+// about sqrt(n) divisions per candidate and is meant for the sizes of filters. It returns 0
+// if there is none in a uint.
+func NextPrime(n uint) uint {
+	if n <= 2 {
+		return 2
+	}
+
+	for n |= 1; n >= 3; n += 2 {
+		if isPrime(n) {
+			return n
+		}
+	}
+	return 0
+}
+
+// isPrime reports whether the odd number n > 2 is prime.
+func isPrime(n uint) bool {
+	for d := uint(3); d <= n/d; d += 2 {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Results returns out resliced to n results if it can hold them, or a new slice of n
+// results otherwise. It is used by the CheckMany methods of the filters.
+func Results(out []bool, n int) []bool {
+	if cap(out) < n {
+		return make([]bool, n)
+	}
+	return out[:n]
+}
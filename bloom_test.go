@@ -0,0 +1,771 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"hash/fnv"
+	"hash/maphash"
+	"math"
+	"testing"
+
+	"github.com/spaolacci/murmur3"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		n    uint
+		p, e float64
+		err  error
+	}{
+		{1000, 0.5, 0.001, nil},
+		{0, 0.5, 0.001, ErrInvalidCapacity},
+		{1000, 0, 0.001, ErrInvalidFillRatio},
+		{1000, 1, 0.001, ErrInvalidFillRatio},
+		{1000, -0.5, 0.001, ErrInvalidFillRatio},
+		{1000, 0.5, 0, ErrInvalidErrorRate},
+		{1000, 0.5, 1, ErrInvalidErrorRate},
+		{1000, 0.5, -0.1, ErrInvalidErrorRate},
+		{1000, 0.5, math.NaN(), ErrInvalidErrorRate},
+		{1000, math.NaN(), 0.001, ErrInvalidFillRatio},
+	}
+
+	for _, tt := range tests {
+		if err := Validate(tt.n, tt.p, tt.e); err != tt.err {
+			t.Errorf("Validate(%d, %v, %v) = %v, expected %v", tt.n, tt.p, tt.e, err, tt.err)
+		}
+	}
+}
+
+func TestP(t *testing.T) {
+	for _, k := range []uint{1, 4, 10, MaxHashCount} {
+		if p := P(k, 0.001); math.Abs(math.Pow(p, float64(k))-0.001) > 1e-12 {
+			t.Errorf("k = %d: expected p^k = 0.001, got %g", k, math.Pow(p, float64(k)))
+		}
+	}
+
+	for k, err := range map[uint]error{0: ErrInvalidHashCount, 1: nil, MaxHashCount: nil, MaxHashCount + 1: ErrInvalidHashCount} {
+		if got := ValidateHashCount(k); got != err {
+			t.Errorf("ValidateHashCount(%d) = %v, expected %v", k, got, err)
+		}
+	}
+}
+
+func TestCheckedM(t *testing.T) {
+	if m, err := CheckedM(1000, 0.5, 0.001); err != nil || m != M(1000, 0.5, 0.001) {
+		t.Errorf("Expected %d bits, got %d and %v", M(1000, 0.5, 0.001), m, err)
+	}
+
+	// About 48 bits per item, for more items than fit in a uint
+	if m, err := CheckedM(math.MaxUint, 0.5, 1e-10); err != ErrTooLarge || m != math.MaxUint {
+		t.Errorf("Expected ErrTooLarge, got %d and %v", m, err)
+	}
+
+	if m := M(math.MaxUint/8, 0.5, 1e-10); m != math.MaxUint {
+		t.Errorf("Expected M to clamp to %d, got %d", uint(math.MaxUint), m)
+	}
+
+	if err := Validate(math.MaxUint, 0.5, 1e-10); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge from Validate, got %v", err)
+	}
+}
+
+func TestSum64(t *testing.T) {
+	hashers := map[string]hash.Hash{
+		"fnv64":     fnv.New64(),
+		"fnv64a":    fnv.New64a(),
+		"crc64-iso": crc64.New(crc64.MakeTable(crc64.ISO)),
+		"md5":       md5.New(),
+		"sha1":      sha1.New(),
+		"crc32":     crc32.NewIEEE(),
+	}
+
+	var buf [64]byte
+	for name, h := range hashers {
+		h.Reset()
+		h.Write([]byte("hello"))
+
+		// The same value as reading the digest, unless it is shorter than 8 bytes
+		if d := h.Sum(nil); len(d) >= 8 {
+			if v, expected := Sum64(h, buf[:0]), binary.BigEndian.Uint64(d); v != expected {
+				t.Errorf("%s: Sum64 = %#x, expected %#x", name, v, expected)
+			}
+		} else if v := Sum64(h, buf[:0]); uint32(v) == 0 || v>>32 == 0 {
+			t.Errorf("%s: Sum64 = %#x, expected both halves to be set", name, v)
+		}
+
+		// Hash64 hashers don't need the buffer, so don't allocate even without it
+		if _, ok := h.(hash.Hash64); ok {
+			if allocs := testing.AllocsPerRun(100, func() { Sum64(h, nil) }); allocs != 0 {
+				t.Errorf("%s: %f allocations per Sum64, expected 0", name, allocs)
+			}
+		}
+
+		if allocs := testing.AllocsPerRun(100, func() { Sum64(h, buf[:0]) }); allocs != 0 {
+			t.Errorf("%s: %f allocations per Sum64 with a buffer, expected 0", name, allocs)
+		}
+	}
+}
+
+func TestDigestPositions(t *testing.T) {
+	h := md5.New()
+	h.Write([]byte("hello"))
+	d := h.Sum(nil)
+
+	var buf [64]byte
+	bs := make([]uint, 7)
+	m := uint(1000003)
+
+	// The first 4 positions are the 4 chunks of the digest, and the others are derived from
+	// the first 8 bytes, as all of them are without wide
+	v := DigestPositions(h, buf[:0], bs, m, FlagWideDigest)
+	a, b := uint(uint32(v)), uint(v>>32)
+	for i, p := range bs {
+		expected := (a + b*uint(i)) % m
+		if i < 4 {
+			expected = uint(binary.BigEndian.Uint32(d[4*i:])) % m
+		}
+
+		if p != expected {
+			t.Errorf("Position %d = %d, expected %d", i, p, expected)
+		}
+	}
+
+	narrow := make([]uint, 7)
+	DigestPositions(h, buf[:0], narrow, m, 0)
+	for i, p := range narrow {
+		if expected := (a + b*uint(i)) % m; p != expected {
+			t.Errorf("Position %d = %d without wide, expected %d", i, p, expected)
+		}
+	}
+
+	// Hashers of 8 bytes give the same positions either way
+	f := fnv.New64()
+	f.Write([]byte("hello"))
+	DigestPositions(f, buf[:0], bs, m, FlagWideDigest)
+	DigestPositions(f, buf[:0], narrow, m, 0)
+	for i := range bs {
+		if bs[i] != narrow[i] {
+			t.Fatalf("Position %d = %d with wide, expected %d", i, bs[i], narrow[i])
+		}
+	}
+}
+
+func TestDigestPositionsSum128(t *testing.T) {
+	h := murmur3.New128()
+	h.Write([]byte("hello"))
+	x, y := h.Sum128()
+
+	var buf [64]byte
+	bs := make([]uint, 12)
+	m := uint(1000003)
+
+	// Enhanced double hashing of the two halves
+	if v := DigestPositions(h, buf[:0], bs, m, DigestFlags&^FlagFastRange); v != x {
+		t.Errorf("DigestPositions returned %#x, expected %#x", v, x)
+	}
+
+	for i, p := range bs {
+		if expected := uint(x % uint64(m)); p != expected {
+			t.Errorf("Position %d = %d, expected %d", i, p, expected)
+		}
+		x += y
+		y += uint64(i)
+	}
+
+	if f := DigestFlagsOf(h, 1000, DigestFlags&^FlagFastRange); f != FlagSum128 {
+		t.Errorf("DigestFlagsOf = %#x, expected FlagSum128", f)
+	}
+
+	// Without FlagSum128, the digest is read as any 16 byte digest
+	if f := DigestFlagsOf(h, 1000, FlagWideDigest); f != FlagWideDigest {
+		t.Errorf("DigestFlagsOf = %#x, expected FlagWideDigest", f)
+	}
+
+	if f := DigestFlagsOf(md5.New(), 1000, DigestFlags&^(FlagFastRange|FlagEnhanced)); f != FlagWideDigest {
+		t.Errorf("DigestFlagsOf(md5) = %#x, expected FlagWideDigest", f)
+	}
+}
+
+func TestDigestPositionsWideIndex(t *testing.T) {
+	m := ^uint(0)>>24 + 1
+	if uint64(m) <= math.MaxUint32 {
+		t.Skip("uint has 32 bits")
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte("hello"))
+	v := h.Sum64()
+
+	var buf [64]byte
+	bs := make([]uint, 32)
+
+	// 64-bit a and b, with b mixed from a for an 8 byte digest
+	DigestPositions(h, buf[:0], bs, m, DigestFlags&^(FlagFastRange|FlagEnhanced))
+	a, b := v, splitmix64(v)
+	high := 0
+	for i, p := range bs {
+		if expected := uint((a + b*uint64(i)) % uint64(m)); p != expected {
+			t.Errorf("Position %d = %d, expected %d", i, p, expected)
+		}
+		if uint64(p) > math.MaxUint32 {
+			high++
+		}
+	}
+
+	// With 32-bit a and b, the positions are below 32 * 2^32, of 2^40
+	narrow := make([]uint, len(bs))
+	DigestPositions(h, buf[:0], narrow, m, FlagWideDigest|FlagSum128)
+	for i, p := range narrow {
+		if uint64(p) >= uint64(len(bs))<<32 {
+			t.Errorf("Position %d = %d without wide index, expected below %d", i, p, uint64(len(bs))<<32)
+		}
+	}
+
+	fmt.Printf("%d of %d positions above 2^32 with wide index\n", high, len(bs))
+	if high < len(bs)*3/4 {
+		t.Errorf("%d of %d positions above 2^32, expected most", high, len(bs))
+	}
+
+	// b is the second half of a 16 byte digest
+	d := md5.New()
+	d.Write([]byte("hello"))
+	sum := d.Sum(nil)
+	DigestPositions(d, buf[:0], bs, m, FlagWideIndex)
+	a, b = binary.BigEndian.Uint64(sum), binary.BigEndian.Uint64(sum[8:])
+	for i, p := range bs {
+		if expected := uint((a + b*uint64(i)) % uint64(m)); p != expected {
+			t.Errorf("Position %d = %d for md5, expected %d", i, p, expected)
+		}
+	}
+
+	if f := DigestFlagsOf(h, m, DigestFlags&^(FlagFastRange|FlagEnhanced)); f != FlagWideIndex {
+		t.Errorf("DigestFlagsOf = %#x, expected FlagWideIndex", f)
+	}
+
+	if f := DigestFlagsOf(h, math.MaxUint32, DigestFlags&^(FlagFastRange|FlagEnhanced)); f != 0 {
+		t.Errorf("DigestFlagsOf(2^32 - 1 bits) = %#x, expected 0", f)
+	}
+
+	if f := DigestFlagsOf(d, m, DigestFlags&^(FlagFastRange|FlagEnhanced)); f != FlagWideDigest|FlagWideIndex {
+		t.Errorf("DigestFlagsOf(md5) = %#x, expected FlagWideDigest|FlagWideIndex", f)
+	}
+}
+
+func TestFastRange(t *testing.T) {
+	m := uint(1000003)
+	if p := FastRange(0, m); p != 0 {
+		t.Errorf("FastRange(0) = %d, expected 0", p)
+	}
+	if p := FastRange(math.MaxUint64, m); p != m-1 {
+		t.Errorf("FastRange(2^64 - 1) = %d, expected %d", p, m-1)
+	}
+
+	// Values spread evenly over 2^64 spread evenly over m
+	var buckets [10]int
+	for i := uint64(0); i < 100000; i++ {
+		buckets[FastRange(splitmix64(i), m)*10/m]++
+	}
+	for i, c := range buckets {
+		if c < 9500 || c > 10500 {
+			t.Errorf("%d values in bucket %d, expected about 10000", c, i)
+		}
+	}
+
+	// 32-bit a and b from the mixed 8 bytes, taken modulo 2^32
+	h := fnv.New64()
+	h.Write([]byte("hello"))
+	x := splitmix64(h.Sum64())
+	a, b := uint32(x), uint32(x>>32)
+
+	var buf [64]byte
+	bs := make([]uint, 12)
+	DigestPositions(h, buf[:0], bs, m, DigestFlags&^FlagEnhanced)
+	for i, p := range bs {
+		if expected := uint(uint64(a+b*uint32(i)) * uint64(m) >> 32); p != expected {
+			t.Errorf("Position %d = %d, expected %d", i, p, expected)
+		}
+	}
+
+	if f := DigestFlagsOf(h, m, DigestFlags&^FlagEnhanced); f != FlagFastRange {
+		t.Errorf("DigestFlagsOf = %#x, expected FlagFastRange", f)
+	}
+}
+
+func TestEnhanced(t *testing.T) {
+	h := fnv.New64()
+	h.Write([]byte("hello"))
+	v := h.Sum64()
+	a, b := uint(uint32(v)), uint(uint32(v>>32))
+
+	var buf [64]byte
+	bs := make([]uint, 20)
+	m := uint(1000003)
+
+	// The increments of the positions grow by 1, 2, 3...
+	DigestPositions(h, buf[:0], bs, m, FlagEnhanced)
+	t3 := uint(0)
+	for i, p := range bs {
+		if expected := (a + b*uint(i) + t3) % m; p != expected {
+			t.Errorf("Position %d = %d, expected %d", i, p, expected)
+		}
+		t3 += uint(i) * (uint(i) - 1) / 2
+	}
+
+	if f := DigestFlagsOf(h, m, DigestFlags); f != FlagFastRange|FlagEnhanced {
+		t.Errorf("DigestFlagsOf = %#x, expected FlagFastRange|FlagEnhanced", f)
+	}
+
+	// Sum128 is enhanced already
+	if f := DigestFlagsOf(murmur3.New128(), m, DigestFlags); f != FlagFastRange|FlagSum128 {
+		t.Errorf("DigestFlagsOf(murmur3-128) = %#x, expected FlagFastRange|FlagSum128", f)
+	}
+
+	// With m a power of two and b a multiple of m / 4, the positions of plain double
+	// hashing take 4 values at most, and those of the enhanced one don't repeat as soon
+	for _, tt := range []struct {
+		flags    uint16
+		distinct int
+	}{
+		{0, 4},
+		{FlagEnhanced, 20},
+	} {
+		f := &fixedHash{v: 7 | uint64(1<<18)<<32}
+		DigestPositions(f, buf[:0], bs, 1<<20, tt.flags)
+
+		seen := map[uint]bool{}
+		for _, p := range bs {
+			seen[p] = true
+		}
+
+		if len(seen) != tt.distinct {
+			t.Errorf("Flags %#x: %d distinct positions of %d, expected %d", tt.flags, len(seen), len(bs), tt.distinct)
+		}
+	}
+}
+
+// fixedHash is a 64-bit hash returning v whatever is written to it.
+type fixedHash struct {
+	v uint64
+}
+
+func (this *fixedHash) Write(p []byte) (int, error) { return len(p), nil }
+func (this *fixedHash) Sum(b []byte) []byte         { return binary.BigEndian.AppendUint64(b, this.v) }
+func (this *fixedHash) Reset()                      {}
+func (this *fixedHash) Size() int                   { return 8 }
+func (this *fixedHash) BlockSize() int              { return 1 }
+func (this *fixedHash) Sum64() uint64               { return this.v }
+
+func TestNextPrime(t *testing.T) {
+	tests := []struct{ n, p uint }{
+		{0, 2}, {2, 2}, {3, 3}, {4, 5}, {9, 11}, {25, 29}, {1438, 1439}, {1440, 1447},
+		{7919, 7919}, {7920, 7927}, {1 << 31, 2147483659},
+	}
+
+	for _, tt := range tests {
+		if p := NextPrime(tt.n); p != tt.p {
+			t.Errorf("NextPrime(%d) = %d, expected %d", tt.n, p, tt.p)
+		}
+	}
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	tests := []struct{ m, p uint }{
+		{0, 1}, {1, 1}, {2, 2}, {3, 4}, {1000, 1024}, {1024, 1024}, {1025, 2048},
+		{math.MaxUint, math.MaxUint},
+	}
+
+	for _, tt := range tests {
+		if p := PowerOfTwo(tt.m); p != tt.p {
+			t.Errorf("PowerOfTwo(%d) = %d, expected %d", tt.m, p, tt.p)
+		}
+	}
+
+	// The mask and the shift give the same values as the modulo and the multiply-shift
+	for _, m := range []uint{1, 2, 1 << 10, 1 << 31, ^uint(0)>>24 + 1} {
+		for i := uint64(0); i < 1000; i++ {
+			x := splitmix64(i)
+			if r := reduce(x, m, false); r != uint(x%uint64(m)) {
+				t.Fatalf("reduce(%#x, %d) = %d, expected %d", x, m, r, x%uint64(m))
+			}
+			if r := reduce(x, m, true); r != FastRange(x, m) {
+				t.Fatalf("reduce(%#x, %d, fast) = %d, expected %d", x, m, r, FastRange(x, m))
+			}
+		}
+	}
+}
+
+func TestXXHash(t *testing.T) {
+	tests := []struct {
+		s string
+		v uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+
+	for _, test := range tests {
+		if v, _ := XXHash([]byte(test.s)); v != test.v {
+			t.Errorf("XXHash(%q) = %#x, expected %#x", test.s, v, test.v)
+		}
+	}
+}
+
+func TestXXHash64(t *testing.T) {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	h := NewXXHash64(0)
+	if v := Sum64(h, nil); v != 0xef46db3751d8e999 {
+		t.Errorf("Sum64 of nothing = %#x, expected 0xef46db3751d8e999", v)
+	}
+
+	// Written in pieces of any size, the hash is the one of the whole input
+	for _, seed := range []uint64{0, 42} {
+		h := NewXXHash64(seed)
+		for n := 0; n <= len(data); n += 13 {
+			for _, step := range []int{1, 5, 31, 32, 33, 100} {
+				h.Reset()
+				for b := data[:n]; len(b) > 0; {
+					c := min(step, len(b))
+					h.Write(b[:c])
+					b = b[c:]
+				}
+
+				if v, expected := h.Sum64(), xxh64(data[:n], seed); v != expected {
+					t.Fatalf("Seed %d, %d bytes in steps of %d: Sum64 = %#x, expected %#x", seed, n, step, v, expected)
+				}
+			}
+		}
+	}
+
+	named, err := NewHasher(FastHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	named.Write([]byte("Nobody inspects the spammish repetition"))
+	if v := Sum64(named, nil); v != 0xfbcea83c8a378bf1 {
+		t.Errorf("%s = %#x, expected 0xfbcea83c8a378bf1", FastHasher, v)
+	}
+
+	c, err := named.(hash.Cloner).Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := c.(hash.Hash64).Sum64(); v != 0xfbcea83c8a378bf1 {
+		t.Errorf("Clone = %#x, expected 0xfbcea83c8a378bf1", v)
+	}
+}
+
+func TestHashFunc(t *testing.T) {
+	item := []byte("hello")
+
+	for _, name := range []string{FNV1aFunc, Murmur3Func, XXHashFunc} {
+		h, err := NewHasher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f := HashFuncOf(h)
+		if f == nil {
+			t.Fatalf("%s: HashFuncOf returned nil", name)
+		}
+
+		a, b := f(item)
+		if a == b {
+			t.Errorf("%s: expected two different values, got %#x twice", name, a)
+		}
+
+		// The hash.Hash reads the first value of the bytes written to it
+		h.Write(item[:2])
+		h.Write(item[2:])
+		if v := Sum64(h, nil); v != a {
+			t.Errorf("%s: Sum64 = %#x, expected %#x", name, v, a)
+		}
+
+		// Locate and Positions agree, with the expected positions
+		bs, expected := make([]uint, 5), make([]uint, 5)
+		h.(Locator).Locate(item, bs, 1000)
+		f.Positions(item, expected, 1000)
+		for i := range bs {
+			if bs[i] != expected[i] || bs[i] != uint((a+b*uint64(i))%1000) {
+				t.Errorf("%s: position %d is %d, expected %d", name, i, bs[i], expected[i])
+			}
+		}
+
+		if c, err := CloneHasher("", h); err != nil || HashFuncOf(c) == nil {
+			t.Errorf("%s: CloneHasher returned %v, %v", name, c, err)
+		}
+
+		if allocs := testing.AllocsPerRun(100, func() { f.Positions(item, bs, 1000) }); allocs != 0 {
+			t.Errorf("%s: %f allocations per Positions, expected 0", name, allocs)
+		}
+	}
+}
+
+func TestFromHash(t *testing.T) {
+	item := []byte("hello")
+
+	f := FromHash("fnv64a", fnv.New64a())
+	h := fnv.New64a()
+	h.Write(item)
+	if a, b := f(item); a != h.Sum64() || b == a {
+		t.Errorf("FromHash(fnv64a) = %#x, %#x, expected %#x first", a, b, h.Sum64())
+	}
+
+	// A wrapped Hasher is unwrapped
+	if g := FromHash("", Hasher(XXHash).Hash()); g == nil {
+		t.Error("FromHash returned nil")
+	} else if a, _ := g(item); a != xxh64(item, 0) {
+		t.Errorf("FromHash(XXHash) = %#x, expected %#x", a, xxh64(item, 0))
+	}
+}
+
+func TestSeededHash(t *testing.T) {
+	item := []byte("hello")
+
+	if a, _ := SeededHash(0)(item); a != xxh64(item, 0) {
+		t.Errorf("SeededHash(0) = %#x, expected XXHash %#x", a, xxh64(item, 0))
+	}
+
+	a1, _ := SeededHash(1)(item)
+	a2, _ := SeededHash(2)(item)
+	if a1 == a2 {
+		t.Errorf("Seeds 1 and 2 both hash to %#x", a1)
+	}
+
+	// The seed is recovered from the name, and NewHasher recreates the hasher
+	seed := RandomSeed()
+	name := SeededHasherName(seed)
+	if s, ok := SeedOf(name); !ok || s != seed {
+		t.Errorf("SeedOf(%q) = %#x, %t, expected %#x", name, s, ok, seed)
+	}
+
+	h, err := NewHasher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := SeededHash(seed)(item)
+	h.Write(item)
+	if v := Sum64(h, nil); v != a {
+		t.Errorf("NewHasher(%q) hashes to %#x, expected %#x", name, v, a)
+	}
+
+	prefix := SeededHasherFamily + ":"
+	for _, bad := range []string{"", "fnv64", prefix, prefix + "12", prefix + "zzzzzzzzzzzzzzzz", "md5:0000000000000001"} {
+		if _, ok := SeedOf(bad); ok {
+			t.Errorf("SeedOf(%q) returned a seed", bad)
+		}
+	}
+
+	for _, bad := range []string{prefix + "zz", prefix + "12", "unknown:00"} {
+		if _, err := NewHasher(bad); !errors.Is(err, ErrUnknownHasher) {
+			t.Errorf("NewHasher(%q): expected ErrUnknownHasher, got %v", bad, err)
+		}
+	}
+}
+
+func TestMaphash(t *testing.T) {
+	item := []byte("hello")
+	s1, s2 := maphash.MakeSeed(), maphash.MakeSeed()
+
+	a1, b1 := Maphash(s1)(item)
+	if a, b := Maphash(s1)(item); a != a1 || b != b1 {
+		t.Errorf("Maphash isn't deterministic: %#x, %#x and %#x, %#x", a1, b1, a, b)
+	}
+
+	if a2, _ := Maphash(s2)(item); a2 == a1 {
+		t.Errorf("Two seeds both hash to %#x", a1)
+	}
+}
+
+func TestHasherFamily(t *testing.T) {
+	RegisterHasherFamily("test-fnv-prefix", func(params []byte) (hash.Hash, error) {
+		if len(params) == 0 {
+			return nil, errors.New("empty prefix")
+		}
+		h := fnv.New64a()
+		h.Write(params)
+		return h, nil
+	})
+
+	name := FamilyHasherName("test-fnv-prefix", []byte{0xca, 0xfe})
+	if name != "test-fnv-prefix:cafe" {
+		t.Errorf("FamilyHasherName = %q", name)
+	}
+
+	if family, params, ok := ParseHasherName(name); !ok || family != "test-fnv-prefix" || string(params) != "\xca\xfe" {
+		t.Errorf("ParseHasherName(%q) = %q, %x, %t", name, family, params, ok)
+	}
+
+	h, err := NewHasher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := fnv.New64a()
+	expected.Write([]byte{0xca, 0xfe, 'x'})
+	h.Write([]byte("x"))
+	if Sum64(h, nil) != expected.Sum64() {
+		t.Errorf("The hasher of %q doesn't hash with its parameters", name)
+	}
+
+	for _, bad := range []string{"test-fnv-prefix:", "test-fnv-prefix:zz", "other-family:cafe"} {
+		if _, err := NewHasher(bad); !errors.Is(err, ErrUnknownHasher) {
+			t.Errorf("NewHasher(%q): expected ErrUnknownHasher, got %v", bad, err)
+		}
+	}
+}
+
+func TestSipHash(t *testing.T) {
+	// The test vectors of the SipHash paper, with the key 00 01 ... 0f and the messages
+	// 00 01 ... of 0 to 15 bytes
+	var key [16]byte
+	msg := make([]byte, 16)
+	for i := range key {
+		key[i] = byte(i)
+		msg[i] = byte(i)
+	}
+
+	tests := map[int]uint64{0: 0x726fdb47dd0e0e31, 15: 0xa129ca6149be45e5}
+	for n, expected := range tests {
+		if v, _ := SipHash(key)(msg[:n]); v != expected {
+			t.Errorf("SipHash of %d bytes = %#x, expected %#x", n, v, expected)
+		}
+	}
+
+	h, err := NewHasher(SipHashName(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Write(msg[:15])
+	if v := Sum64(h, nil); v != tests[15] {
+		t.Errorf("NewHasher(SipHashName) hashes to %#x, expected %#x", v, tests[15])
+	}
+
+	if k1, k2 := NewSipHashKey(), NewSipHashKey(); k1 == k2 {
+		t.Errorf("NewSipHashKey returned %x twice", k1)
+	}
+
+	if _, err := NewHasher(FamilyHasherName(SipHashFamily, key[:8])); !errors.Is(err, ErrUnknownHasher) {
+		t.Errorf("Expected ErrUnknownHasher for a short key, got %v", err)
+	}
+}
+
+// maskedHash is a 64-bit hash returning the hash of h with the bits of mask cleared.
+type maskedHash struct {
+	hash.Hash64
+	mask uint64
+}
+
+func (this *maskedHash) Sum(b []byte) []byte { return binary.BigEndian.AppendUint64(b, this.Sum64()) }
+func (this *maskedHash) Sum64() uint64       { return this.Hash64.Sum64() &^ this.mask }
+
+func TestEvaluateHasher(t *testing.T) {
+	keys := make([][]byte, 20000)
+	for i := range keys {
+		keys[i] = fmt.Appendf(nil, "key-%d", i)
+	}
+
+	const m, k = 191701, 7
+
+	good := []struct {
+		name string
+		h    hash.Hash
+	}{
+		{DefaultHasher, fnv.New64()},
+		{"fnv64a", fnv.New64a()},
+		{"murmur3-64", murmur3.New64()},
+		{"murmur3-128", murmur3.New128()},
+		{FastHasher, NewXXHash64(0)},
+	}
+
+	for _, tt := range good {
+		r := EvaluateHasher(tt.h, keys, m, k)
+		if r.Verdict != HasherPass {
+			t.Errorf("%s: Verdict = %s, expected pass: %v", tt.name, r.Verdict, r.Warnings)
+		}
+		if r.Buckets != maxCheckBuckets || r.Keys != len(keys) {
+			t.Errorf("%s: %d buckets and %d keys, expected %d and %d", tt.name, r.Buckets, r.Keys, maxCheckBuckets, len(keys))
+		}
+	}
+
+	// The low 52 bits are constant, so the keys have 4096 digests at most, and the mixing
+	// of FlagFastRange cannot spread them
+	r := EvaluateHasher(&maskedHash{murmur3.New64(), 1<<52 - 1}, keys, m, k)
+	if r.Verdict != HasherWarn || r.Deviation < checkDeviations || r.PairCollisions < len(keys)-4096 {
+		t.Errorf("Constant low bits: Verdict = %s, deviation %.1f and %d pair collisions, expected warn",
+			r.Verdict, r.Deviation, r.PairCollisions)
+	}
+
+	// The positions are even, as fnv64 is mixed, but most keys have the digest of another
+	r = EvaluateHasher(&maskedHash{fnv.New64(), ^uint64(0xff)}, keys, m, k)
+	if r.Verdict != HasherWarn || r.DigestCollisions < len(keys)-256 {
+		t.Errorf("8 bits: Verdict = %s, %d collisions, expected warn", r.Verdict, r.DigestCollisions)
+	}
+
+	r = EvaluateHasher(&fixedHash{42}, keys, m, k)
+	if r.Verdict != HasherWarn || len(r.Warnings) != 3 {
+		t.Errorf("Fixed hash: Verdict = %s, expected warn with 3 warnings: %v", r.Verdict, r.Warnings)
+	}
+}
+
+// BenchmarkHashers compares the hashers on keys of 8, 64 and 1024 bytes, hashed the way the
+// filters do, with Reset, Write and Sum64.
+func BenchmarkHashers(b *testing.B) {
+	hashers := []struct {
+		name string
+		h    hash.Hash
+	}{
+		{DefaultHasher, fnv.New64()},
+		{"fnv64a", fnv.New64a()},
+		{"murmur3-64", murmur3.New64()},
+		{"murmur3-128", murmur3.New128()},
+		{FastHasher, NewXXHash64(0)},
+	}
+
+	var sum [64]byte
+	for _, size := range []int{8, 64, 1024} {
+		key := make([]byte, size)
+		for i := range key {
+			key[i] = byte(i)
+		}
+
+		for _, hh := range hashers {
+			b.Run(fmt.Sprintf("%d/%s", size, hh.name), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					hh.h.Reset()
+					hh.h.Write(key)
+					Sum64(hh.h, sum[:0])
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bloompb converts filters to and from the BloomFilter protobuf message defined in
+// bloom.proto.
+//
+// The Go types mirror the messages and encode to the same protobuf wire format, without
+// depending on a protobuf runtime. Programs using generated code can compile bloom.proto
+// for their language and exchange the bytes of Marshal and Unmarshal.
+package bloompb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/zhenjl/bloom"
+	_ "github.com/zhenjl/bloom/partitioned"
+	_ "github.com/zhenjl/bloom/scalable"
+	_ "github.com/zhenjl/bloom/standard"
+)
+
+type Kind int32
+
+const (
+	KindUnspecified Kind = 0
+	KindStandard    Kind = Kind(bloom.KindStandard)
+	KindPartitioned Kind = Kind(bloom.KindPartitioned)
+	KindScalable    Kind = Kind(bloom.KindScalable)
+)
+
+// Params mirrors the Params message.
+type Params struct {
+	M, K, S, N, C        uint64
+	P, E, R              float64
+	Growth, GrowthPolicy uint64
+	Dedup                bool
+}
+
+// BloomFilter mirrors the BloomFilter message.
+type BloomFilter struct {
+	Kind       Kind
+	Params     *Params
+	Hasher     string
+	Payload    []byte
+	Layers     []*BloomFilter
+	WideDigest bool
+	Sum128     bool
+	WideIndex  bool
+	FastRange  bool
+	Enhanced   bool
+	PowerOfTwo bool
+	PinnedK    bool
+}
+
+// ToProto returns the message for bf, which must be one of the filters of this module.
+func ToProto(bf bloom.Bloom) (*BloomFilter, error) {
+	enc, ok := bf.(bloom.Encoder)
+	if !ok {
+		return nil, fmt.Errorf("bloompb: cannot convert filter of type %T", bf)
+	}
+
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		return nil, err
+	}
+
+	return readFilter(bytes.NewReader(buf.Bytes()))
+}
+
+// FromProto returns the filter described by pb. It returns an error wrapping
+// bloom.ErrUnsupportedFormat for unknown kinds, and an error if the payload length
+// doesn't match the parameters.
+func FromProto(pb *BloomFilter) (bloom.Bloom, error) {
+	var buf bytes.Buffer
+	if err := writeFilter(&buf, pb); err != nil {
+		return nil, err
+	}
+
+	return bloom.Load(&buf)
+}
+
+// readFilter reads a dense serialized filter from r.
+func readFilter(r *bytes.Reader) (*BloomFilter, error) {
+	h := &bloom.Header{}
+	if _, err := h.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	pb := &BloomFilter{
+		Kind:       Kind(h.Kind),
+		Hasher:     h.Hasher,
+		Params:     &Params{M: h.M, K: h.K, S: h.S, N: h.N, C: h.C, P: h.P, E: h.E},
+		WideDigest: h.Flags&bloom.FlagWideDigest != 0,
+		Sum128:     h.Flags&bloom.FlagSum128 != 0,
+		WideIndex:  h.Flags&bloom.FlagWideIndex != 0,
+		FastRange:  h.Flags&bloom.FlagFastRange != 0,
+		Enhanced:   h.Flags&bloom.FlagEnhanced != 0,
+		PowerOfTwo: h.Flags&bloom.FlagPowerOfTwo != 0,
+		PinnedK:    h.Flags&bloom.FlagPinnedHashCount != 0,
+	}
+
+	switch h.Kind {
+	case bloom.KindStandard:
+		pb.Payload = make([]byte, words(h.M)*8)
+		if _, err := r.Read(pb.Payload); err != nil && len(pb.Payload) > 0 {
+			return nil, err
+		}
+
+	case bloom.KindPartitioned:
+		l := words(h.S) * 8
+		pb.Payload = make([]byte, h.K*l)
+		for i := uint64(0); i < h.K; i++ {
+			if _, err := r.Seek(8, 1); err != nil {
+				return nil, err
+			}
+			if _, err := r.Read(pb.Payload[i*l : (i+1)*l]); err != nil && l > 0 {
+				return nil, err
+			}
+		}
+
+	case bloom.KindScalable:
+		b := make([]byte, 16, 32)
+		if h.Flags&bloom.FlagScalableGrowth != 0 {
+			b = b[:32]
+		}
+		if _, err := r.Read(b); err != nil {
+			return nil, err
+		}
+		pb.Params.R = math.Float64frombits(binary.BigEndian.Uint64(b[0:8]))
+
+		if len(b) == 32 {
+			pb.Params.Growth = binary.BigEndian.Uint64(b[16:24])
+			pb.Params.GrowthPolicy, pb.Params.Dedup = uint64(b[24]), b[25] != 0
+		}
+
+		for i := binary.BigEndian.Uint64(b[8:16]); i > 0; i-- {
+			l, err := readFilter(r)
+			if err != nil {
+				return nil, err
+			}
+			pb.Layers = append(pb.Layers, l)
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: %s", bloom.ErrUnsupportedFormat, h.Kind)
+	}
+
+	return pb, nil
+}
+
+// writeFilter writes pb as a dense serialized filter to buf, after validating it.
+func writeFilter(buf *bytes.Buffer, pb *BloomFilter) error {
+	if pb == nil || pb.Params == nil {
+		return errors.New("bloompb: missing filter or params")
+	}
+
+	p := pb.Params
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.Kind(pb.Kind),
+		Hasher:  pb.Hasher,
+		M:       p.M,
+		K:       p.K,
+		S:       p.S,
+		N:       p.N,
+		C:       p.C,
+		P:       p.P,
+		E:       p.E,
+	}
+
+	if pb.WideDigest {
+		h.Flags |= bloom.FlagWideDigest
+	}
+
+	if pb.Sum128 {
+		h.Flags |= bloom.FlagSum128
+	}
+
+	if pb.WideIndex {
+		h.Flags |= bloom.FlagWideIndex
+	}
+
+	if pb.FastRange {
+		h.Flags |= bloom.FlagFastRange
+	}
+
+	if pb.Enhanced {
+		h.Flags |= bloom.FlagEnhanced
+	}
+
+	if pb.PowerOfTwo {
+		h.Flags |= bloom.FlagPowerOfTwo
+	}
+
+	if pb.PinnedK {
+		h.Flags |= bloom.FlagPinnedHashCount
+	}
+
+	switch pb.Kind {
+	case KindStandard:
+		if uint64(len(pb.Payload)) != words(p.M)*8 {
+			return fmt.Errorf("bloompb: payload of %d bytes for m = %d, want %d", len(pb.Payload), p.M, words(p.M)*8)
+		}
+
+		if _, err := h.WriteTo(buf); err != nil {
+			return err
+		}
+		buf.Write(pb.Payload)
+
+	case KindPartitioned:
+		l := words(p.S) * 8
+		if l == 0 || uint64(len(pb.Payload))%l != 0 || uint64(len(pb.Payload))/l != p.K {
+			return fmt.Errorf("bloompb: payload of %d bytes for k = %d, s = %d, want %d", len(pb.Payload), p.K, p.S, p.K*l)
+		}
+
+		if _, err := h.WriteTo(buf); err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < p.K; i++ {
+			binary.Write(buf, binary.BigEndian, p.S)
+			buf.Write(pb.Payload[i*l : (i+1)*l])
+		}
+
+	case KindScalable:
+		if len(pb.Payload) != 0 {
+			return fmt.Errorf("bloompb: scalable filter with a payload of %d bytes", len(pb.Payload))
+		}
+
+		// Filters without a growth factor are written as before the growth settings
+		b := make([]byte, 16, 32)
+		if p.Growth != 0 {
+			if p.GrowthPolicy > math.MaxUint8 {
+				return fmt.Errorf("bloompb: invalid growth policy %d", p.GrowthPolicy)
+			}
+
+			h.Flags |= bloom.FlagScalableGrowth
+			b = b[:32]
+			binary.BigEndian.PutUint64(b[16:24], p.Growth)
+			b[24] = byte(p.GrowthPolicy)
+			if p.Dedup {
+				b[25] = 1
+			}
+		}
+
+		if _, err := h.WriteTo(buf); err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint64(b[0:8], math.Float64bits(p.R))
+		binary.BigEndian.PutUint64(b[8:16], uint64(len(pb.Layers)))
+		buf.Write(b)
+
+		for i, l := range pb.Layers {
+			if err := writeFilter(buf, l); err != nil {
+				return fmt.Errorf("bloompb: layer %d: %w", i, err)
+			}
+		}
+
+	default:
+		return fmt.Errorf("%w: kind %d", bloom.ErrUnsupportedFormat, pb.Kind)
+	}
+
+	return nil
+}
+
+// words returns the number of 64-bit words holding m bits.
+func words(m uint64) uint64 {
+	return m/64 + (m%64+63)/64
+}
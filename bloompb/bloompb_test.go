@@ -0,0 +1,204 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloompb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+	"github.com/zhenjl/bloom/scalable"
+	"github.com/zhenjl/bloom/standard"
+)
+
+var (
+	web2 []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	l := uint(len(web2))
+
+	// Filters using the whole md5 digest keep their positions through WideDigest, and those
+	// using both halves of murmur3-128 through Sum128
+	sm, pm := standard.New(l).(*standard.StandardBloom), partitioned.New(l).(*partitioned.PartitionedBloom)
+	sm.SetNamedHasher("md5")
+	pm.SetNamedHasher("md5")
+	s128, p128 := standard.New(l).(*standard.StandardBloom), partitioned.New(l).(*partitioned.PartitionedBloom)
+	s128.SetNamedHasher("murmur3-128")
+	p128.SetNamedHasher("murmur3-128")
+
+	// The growth settings of scalable filters are kept as well
+	sc := scalable.New(l / 4).(*scalable.ScalableBloom)
+	sc.SetGrowthPolicy(scalable.GrowOnCount)
+	sc.SetDedupOnAdd(true)
+
+	// So are a rounded size and a pinned k
+	sp := standard.NewWithOptions(l, 0.001, standard.WithPowerOfTwoSize(), standard.WithHashCount(4))
+	pp := partitioned.NewWithOptions(l, 0.001, partitioned.WithPowerOfTwoSize(), partitioned.WithHashCount(4))
+
+	for _, bf := range []bloom.Bloom{standard.New(l), partitioned.New(l), sc, sm, pm, s128, p128, sp, pp} {
+		for i := uint(0); i < l/2; i++ {
+			bf.Add([]byte(web2[i]))
+		}
+
+		pb, err := ToProto(bf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := pb.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pb2 := &BloomFilter{}
+		if err := pb2.Unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+
+		bf2, err := FromProto(pb2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fmt.Printf("%T: %d bytes, %d layers\n", bf, len(b), len(pb2.Layers))
+
+		if md5 := bf == sm || bf == pm; pb2.WideDigest != md5 {
+			t.Fatalf("%T: WideDigest = %t, want %t", bf, pb2.WideDigest, md5)
+		}
+
+		if m128 := bf == s128 || bf == p128; pb2.Sum128 != m128 {
+			t.Fatalf("%T: Sum128 = %t, want %t", bf, pb2.Sum128, m128)
+		}
+
+		if bf2.Count() != bf.Count() {
+			t.Fatalf("%T: count is %d, want %d", bf, bf2.Count(), bf.Count())
+		}
+
+		if set := bf == sp || bf == pp; pb2.PowerOfTwo != set || pb2.PinnedK != set {
+			t.Fatalf("%T: PowerOfTwo = %t, PinnedK = %t, want %t", bf, pb2.PowerOfTwo, pb2.PinnedK, set)
+		}
+
+		if p, ok := bf.(interface{ Params() bloom.Params }); ok && bf2.(interface{ Params() bloom.Params }).Params() != p.Params() {
+			t.Fatalf("%T: params are %+v, want %+v", bf, bf2.(interface{ Params() bloom.Params }).Params(), p.Params())
+		}
+
+		if sc2, ok := bf2.(*scalable.ScalableBloom); ok && (sc2.GrowthFactor() != 2 || sc2.GrowthPolicy() != scalable.GrowOnCount || !sc2.DedupOnAdd()) {
+			t.Fatalf("Expected the growth settings to be kept, got %d, %s and %t", sc2.GrowthFactor(), sc2.GrowthPolicy(), sc2.DedupOnAdd())
+		}
+
+		for _, w := range web2 {
+			if bf2.Check([]byte(w)) != bf.Check([]byte(w)) {
+				t.Fatalf("%T: Check(%q) differs after FromProto", bf, w)
+			}
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	pb := &BloomFilter{
+		Kind:    KindStandard,
+		Params:  &Params{M: 64, K: 3, N: 10, C: 1, P: 0.5},
+		Hasher:  "fnv64",
+		Payload: []byte{0, 0, 0, 0, 0, 0, 0, 0x8c},
+	}
+
+	b, err := pb.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Encoding computed by hand from bloom.proto.
+	want := "0801" + "1211" + "0840" + "1003" + "200a" + "2801" + "31000000000000e03f" +
+		"1a05" + hex.EncodeToString([]byte("fnv64")) + "2208000000000000008c"
+	if hex.EncodeToString(b) != want {
+		t.Fatalf("Marshal = %x, want %s", b, want)
+	}
+
+	// Unknown fields are skipped.
+	b = append(b, 0x58, 0x01, 0x62, 0x01, 0xff)
+	pb2 := &BloomFilter{}
+	if err := pb2.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if pb2.Kind != pb.Kind || *pb2.Params != *pb.Params || pb2.Hasher != pb.Hasher || !bytes.Equal(pb2.Payload, pb.Payload) {
+		t.Fatalf("Unmarshal = %+v, want %+v", pb2, pb)
+	}
+
+	bf, err := FromProto(pb2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bf.Count() != 1 {
+		t.Fatalf("count is %d, want 1", bf.Count())
+	}
+
+	if err := pb2.Unmarshal(b[:len(b)-6]); err == nil {
+		t.Fatalf("Unmarshal of truncated message succeeded")
+	}
+}
+
+func TestFromProtoInvalid(t *testing.T) {
+	pb := &BloomFilter{Kind: 7, Params: &Params{M: 64, K: 3}, Payload: make([]byte, 8)}
+	if _, err := FromProto(pb); !errors.Is(err, bloom.ErrUnsupportedFormat) {
+		t.Fatalf("FromProto of unknown kind returned %v, want ErrUnsupportedFormat", err)
+	}
+
+	pb.Kind = KindStandard
+	pb.Payload = make([]byte, 16)
+	if _, err := FromProto(pb); err == nil {
+		t.Fatalf("FromProto with payload too long succeeded")
+	}
+
+	pb.Kind = KindPartitioned
+	pb.Params.S = uint64(bloom.S(64, 3))
+	if _, err := FromProto(pb); err == nil {
+		t.Fatalf("FromProto with partitioned payload too long succeeded")
+	}
+
+	pb.Payload = make([]byte, 24)
+	if _, err := FromProto(pb); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := FromProto(&BloomFilter{Kind: KindStandard}); err == nil {
+		t.Fatalf("FromProto without params succeeded")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloompb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("bloompb: truncated message")
+
+// Marshal returns the protobuf encoding of the message. Fields with zero values are
+// omitted, as in proto3.
+func (this *BloomFilter) Marshal() ([]byte, error) {
+	return this.appendTo(nil), nil
+}
+
+// Unmarshal decodes the protobuf encoding of the message, replacing its fields. Unknown
+// fields are skipped.
+func (this *BloomFilter) Unmarshal(b []byte) error {
+	*this = BloomFilter{}
+
+	return walk(b, func(num int, typ int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && typ == wireVarint:
+			this.Kind = Kind(int32(v))
+		case num == 2 && typ == wireBytes:
+			this.Params = &Params{}
+			return this.Params.Unmarshal(data)
+		case num == 3 && typ == wireBytes:
+			this.Hasher = string(data)
+		case num == 4 && typ == wireBytes:
+			this.Payload = append([]byte(nil), data...)
+		case num == 5 && typ == wireBytes:
+			l := &BloomFilter{}
+			if err := l.Unmarshal(data); err != nil {
+				return err
+			}
+			this.Layers = append(this.Layers, l)
+		case num == 6 && typ == wireVarint:
+			this.WideDigest = v != 0
+		case num == 7 && typ == wireVarint:
+			this.Sum128 = v != 0
+		case num == 8 && typ == wireVarint:
+			this.WideIndex = v != 0
+		case num == 9 && typ == wireVarint:
+			this.FastRange = v != 0
+		case num == 10 && typ == wireVarint:
+			this.Enhanced = v != 0
+		case num == 11 && typ == wireVarint:
+			this.PowerOfTwo = v != 0
+		case num == 12 && typ == wireVarint:
+			this.PinnedK = v != 0
+		}
+		return nil
+	})
+}
+
+func (this *BloomFilter) appendTo(b []byte) []byte {
+	if this.Kind != 0 {
+		b = appendVarint(b, 1, uint64(this.Kind))
+	}
+	if this.Params != nil {
+		b = appendBytes(b, 2, this.Params.appendTo(nil))
+	}
+	if this.Hasher != "" {
+		b = appendBytes(b, 3, []byte(this.Hasher))
+	}
+	if len(this.Payload) > 0 {
+		b = appendBytes(b, 4, this.Payload)
+	}
+	for _, l := range this.Layers {
+		b = appendBytes(b, 5, l.appendTo(nil))
+	}
+	if this.WideDigest {
+		b = appendVarint(b, 6, 1)
+	}
+	if this.Sum128 {
+		b = appendVarint(b, 7, 1)
+	}
+	if this.WideIndex {
+		b = appendVarint(b, 8, 1)
+	}
+	if this.FastRange {
+		b = appendVarint(b, 9, 1)
+	}
+	if this.Enhanced {
+		b = appendVarint(b, 10, 1)
+	}
+	if this.PowerOfTwo {
+		b = appendVarint(b, 11, 1)
+	}
+	if this.PinnedK {
+		b = appendVarint(b, 12, 1)
+	}
+	return b
+}
+
+// Marshal returns the protobuf encoding of the message.
+func (this *Params) Marshal() ([]byte, error) {
+	return this.appendTo(nil), nil
+}
+
+// Unmarshal decodes the protobuf encoding of the message, replacing its fields. Unknown
+// fields are skipped.
+func (this *Params) Unmarshal(b []byte) error {
+	*this = Params{}
+
+	return walk(b, func(num int, typ int, v uint64, data []byte) error {
+		switch {
+		case typ == wireVarint && num >= 1 && num <= 5:
+			*[]*uint64{&this.M, &this.K, &this.S, &this.N, &this.C}[num-1] = v
+		case typ == wireFixed64 && num >= 6 && num <= 8:
+			*[]*float64{&this.P, &this.E, &this.R}[num-6] = math.Float64frombits(v)
+		case typ == wireVarint && num >= 9 && num <= 10:
+			*[]*uint64{&this.Growth, &this.GrowthPolicy}[num-9] = v
+		case typ == wireVarint && num == 11:
+			this.Dedup = v != 0
+		}
+		return nil
+	})
+}
+
+func (this *Params) appendTo(b []byte) []byte {
+	for i, v := range []uint64{this.M, this.K, this.S, this.N, this.C} {
+		if v != 0 {
+			b = appendVarint(b, i+1, v)
+		}
+	}
+	for i, v := range []float64{this.P, this.E, this.R} {
+		if v != 0 {
+			b = binary.AppendUvarint(b, uint64(i+6)<<3|wireFixed64)
+			b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+		}
+	}
+	for i, v := range []uint64{this.Growth, this.GrowthPolicy} {
+		if v != 0 {
+			b = appendVarint(b, i+9, v)
+		}
+	}
+	if this.Dedup {
+		b = appendVarint(b, 11, 1)
+	}
+	return b
+}
+
+func appendVarint(b []byte, num int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytes(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// walk calls fn for every field of the encoded message b. v holds the value of varint
+// and fixed fields, and data the contents of length delimited fields.
+func walk(b []byte, fn func(num int, typ int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncated
+		}
+		b = b[n:]
+
+		num, typ := int(tag>>3), int(tag&7)
+		if num == 0 {
+			return fmt.Errorf("bloompb: invalid field number 0")
+		}
+
+		var (
+			v    uint64
+			data []byte
+		)
+
+		switch typ {
+		case wireVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncated
+			}
+			b = b[n:]
+
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errTruncated
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+
+		default:
+			return fmt.Errorf("bloompb: unsupported wire type %d for field %d", typ, num)
+		}
+
+		if err := fn(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
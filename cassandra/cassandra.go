@@ -0,0 +1,234 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cassandra reads the bloom filters stored in the -Filter.db component of
+// Cassandra SSTables, and answers Check the way Cassandra does.
+//
+// A -Filter.db file holds the number of hash functions and the number of 64-bit words of
+// the bit array, both as big endian int32, followed by the bit array. Cassandra hashes the
+// partition key with its own MurmurHash3 x64 128-bit implementation, which sign extends
+// the trailing bytes of keys whose length is not a multiple of 16, and derives the bit
+// positions as |(h1 + i*h0) % m| in signed 64-bit arithmetic.
+//
+// Only the murmur3 based filters of Cassandra 1.2 and later are supported.
+package cassandra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Options describe the Cassandra version that wrote the filter.
+type Options struct {
+	// RawBitset is set for filters whose bit array is written as raw bytes, as in Cassandra
+	// 4.0 and later. Otherwise every 8 bytes of the bit array are written as a big endian
+	// int64 holding them in little endian order, as in earlier versions.
+	RawBitset bool
+
+	// OldHashOrder is set for filters of SSTables written before Cassandra 3.0, which
+	// swap the two halves of the hash when deriving bit positions.
+	OldHashOrder bool
+}
+
+// Filter is a read-only bloom filter read from a -Filter.db file. It has no Add method, so
+// it does not implement bloom.Bloom.
+type Filter struct {
+	// k is the number of hash functions
+	k uint
+
+	// b is the bit array, with bit i in bit i%8 of byte i/8
+	b []byte
+
+	oldHashOrder bool
+}
+
+// ReadFilter reads a filter in the -Filter.db format from r. If opts is nil, the filter
+// is assumed to be written by Cassandra 3.x.
+func ReadFilter(r io.Reader, opts *Options) (*Filter, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("cassandra: reading filter header: %w", err)
+	}
+
+	k := int32(binary.BigEndian.Uint32(hdr[0:4]))
+	words := int32(binary.BigEndian.Uint32(hdr[4:8]))
+	if k <= 0 || words <= 0 {
+		return nil, fmt.Errorf("cassandra: invalid parameters k = %d, words = %d", k, words)
+	}
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(words)*8)); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() != int(words)*8 {
+		return nil, fmt.Errorf("cassandra: bit array too short, need %d bytes, got %d", int(words)*8, buf.Len())
+	}
+
+	b := buf.Bytes()
+	if !opts.RawBitset {
+		for i := 0; i < len(b); i += 8 {
+			binary.LittleEndian.PutUint64(b[i:], binary.BigEndian.Uint64(b[i:]))
+		}
+	}
+
+	return &Filter{
+		k:            uint(k),
+		b:            b,
+		oldHashOrder: opts.OldHashOrder,
+	}, nil
+}
+
+// Check reports whether key, the serialized partition key, may be in the filter.
+func (this *Filter) Check(key []byte) bool {
+	h0, h1 := hash3x64128(key, 0)
+
+	base, inc := h1, h0
+	if this.oldHashOrder {
+		base, inc = inc, base
+	}
+
+	m := int64(len(this.b)) * 8
+	for i := uint(0); i < this.k; i++ {
+		v := base % m
+		if v < 0 {
+			v = -v
+		}
+
+		if this.b[v>>3]&(1<<(v&7)) == 0 {
+			return false
+		}
+
+		base += inc
+	}
+
+	return true
+}
+
+func (this *Filter) FillRatio() float64 {
+	return float64(this.count()) / float64(len(this.b)*8)
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *Filter) WriteStats(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "m = %d, k = %d\n", len(this.b)*8, this.k)
+	c := this.count()
+	fmt.Fprintf(&buf, "Total bits set: %d (%.1f%%)\n", c, float32(c)/float32(len(this.b)*8)*100)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use WriteStats to write them elsewhere.
+func (this *Filter) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func (this *Filter) count() uint {
+	c := uint(0)
+	for _, v := range this.b {
+		for ; v != 0; v &= v - 1 {
+			c++
+		}
+	}
+	return c
+}
+
+// hash3x64128 is org.apache.cassandra.utils.MurmurHash.hash3_x64_128. It differs from
+// the reference MurmurHash3 only for keys with trailing bytes of 0x80 and above, which
+// are sign extended.
+func hash3x64128(key []byte, seed int64) (int64, int64) {
+	h1, h2 := uint64(seed), uint64(seed)
+	n := len(key)
+
+	for p := key; len(p) >= 16; p = p[16:] {
+		k1 := binary.LittleEndian.Uint64(p[0:8])
+		k2 := binary.LittleEndian.Uint64(p[8:16])
+
+		h1 ^= mixK1(k1)
+		h1 = rotl64(h1, 27)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		h2 ^= mixK2(k2)
+		h2 = rotl64(h2, 31)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	tail := key[n&^15:]
+
+	var k1, k2 uint64
+	for i := len(tail) - 1; i >= 8; i-- {
+		k2 ^= uint64(int64(int8(tail[i]))) << (8 * uint(i-8))
+	}
+	if len(tail) > 8 {
+		h2 ^= mixK2(k2)
+	}
+
+	for i := min(len(tail), 8) - 1; i >= 0; i-- {
+		k1 ^= uint64(int64(int8(tail[i]))) << (8 * uint(i))
+	}
+	if len(tail) > 0 {
+		h1 ^= mixK1(k1)
+	}
+
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+
+	h1 += h2
+	h2 += h1
+
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+
+	h1 += h2
+	h2 += h1
+
+	return int64(h1), int64(h2)
+}
+
+func mixK1(k uint64) uint64 {
+	k *= 0x87c37b91114253d5
+	k = rotl64(k, 31)
+	return k * 0x4cf5ad432745937f
+}
+
+func mixK2(k uint64) uint64 {
+	k *= 0x4cf5ad432745937f
+	k = rotl64(k, 33)
+	return k * 0x87c37b91114253d5
+}
+
+func rotl64(x uint64, r uint) uint64 {
+	return x<<r | x>>(64-r)
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cassandra
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// testdata/Filter.db holds 200 keys and testdata/keys.txt lists the hex encoded keys
+// checked against it, prefixed with + if the filter matches them and - otherwise, with
+// keys with bytes above 0x7f to cover the sign extension of the hash.
+//
+// The fixtures were not written by Cassandra, but by an independent model of the
+// BloomFilter and OffHeapBitSet serializer of Cassandra 3.x. They check the reader against
+// that model, and TestHash checks the hash against the reference MurmurHash3, but neither
+// checks compatibility with Cassandra itself. To do so, insert the keys marked + into a
+// table with a blob partition key, run nodetool flush, copy the -Filter.db component of
+// the SSTable to testdata/Filter.db, and record the Cassandra version here.
+func TestReadFilter(t *testing.T) {
+	data, err := os.ReadFile("testdata/Filter.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf, err := ReadFilter(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := bf.WriteStats(&buf); err != nil || !strings.HasPrefix(buf.String(), fmt.Sprintf("m = %d, k = %d\n", len(bf.b)*8, bf.k)) {
+		t.Errorf("Expected the stats to start with m and k, got %q, %v", buf.String(), err)
+	}
+
+	f, err := os.Open("testdata/keys.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, err := hex.DecodeString(line[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bf.Check(key) != (line[0] == '+') {
+			t.Fatalf("Check(%q) = %t, want %t", key, !(line[0] == '+'), line[0] == '+')
+		}
+		n++
+	}
+
+	if n != 700 {
+		t.Fatalf("checked %d keys, want 700", n)
+	}
+
+	// The same bit array written raw, as by Cassandra 4.0.
+	raw := append([]byte(nil), data...)
+	for i := 8; i < len(raw); i += 8 {
+		binary.LittleEndian.PutUint64(raw[i:], binary.BigEndian.Uint64(raw[i:]))
+	}
+
+	rbf, err := ReadFilter(bytes.NewReader(raw), &Options{RawBitset: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(rbf.b, bf.b) {
+		t.Fatalf("raw bit array differs")
+	}
+
+	if _, err := ReadFilter(bytes.NewReader(data[:len(data)-1]), nil); err == nil {
+		t.Fatalf("ReadFilter of truncated file succeeded")
+	}
+
+	if _, err := ReadFilter(bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 1}), nil); err == nil {
+		t.Fatalf("ReadFilter with k = 0 succeeded")
+	}
+}
+
+func TestHash(t *testing.T) {
+	// Without trailing bytes above 0x7f, the hash is the reference MurmurHash3.
+	for _, s := range []string{"", "a", "hello", "0123456789abcdef", "0123456789abcdefghijklmnopq"} {
+		h0, h1 := hash3x64128([]byte(s), 0)
+		r0, r1 := murmur3.Sum128([]byte(s))
+		if uint64(h0) != r0 || uint64(h1) != r1 {
+			t.Fatalf("hash(%q) = %x, %x, want %x, %x", s, h0, h1, r0, r1)
+		}
+	}
+
+	h0, h1 := hash3x64128([]byte{0xe9, 0xe9, 0xe9}, 0)
+	if h0 != -6002986500152754692 || h1 != 6959196191093012533 {
+		t.Fatalf("hash(e9e9e9) = %d, %d", h0, h1)
+	}
+}
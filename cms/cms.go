@@ -0,0 +1,474 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cms implements a count-min sketch, estimating how many times each item was added,
+// hashed the same way as the bloom filters.
+package cms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+// ErrInvalidEpsilon is returned when epsilon is not in (0, 1).
+var ErrInvalidEpsilon = errors.New("cms: epsilon must be between 0 and 1")
+
+// ErrInvalidDelta is returned when delta is not in (0, 1).
+var ErrInvalidDelta = errors.New("cms: delta must be between 0 and 1")
+
+// CountMinSketch is a count-min sketch: a table of depth rows of width counters, each item
+// having one counter in each row, selected the same way as the bits of a standard filter
+// from one hash of the item. Add adds to the counters of the item, and Estimate returns the
+// smallest of them. Other items only ever add to the counters, so the estimate is never
+// less than the count of the item, and with a width of e / epsilon and a depth of
+// ln(1 / delta), it exceeds it by more than epsilon times the total count with a
+// probability of at most delta.
+//
+// With conservative update, Add only raises the counters of an item up to its new
+// estimate, instead of adding to all of them, so the counters of other items sharing them
+// grow less. Estimates are still never less than the counts, and are much closer for
+// skewed streams, where the heavy items would otherwise inflate the estimates of all the
+// items sharing their counters. Conservative update can't be undone by subtracting, so
+// the sketch has no Remove either way.
+//
+// Counters saturate at math.MaxUint64. CountMinSketch is not safe for concurrent use,
+// except for Estimate.
+type CountMinSketch struct {
+	// h is the hash function used to select the counters
+	h hash.Hash
+
+	// hn is the name of the hash function, empty if it was set using SetHasher()
+	hn string
+
+	// hp holds the hashers used by Estimate, so it doesn't write to the sketch
+	hp *bloom.HasherPool
+
+	// epsilon and delta are the parameters the sketch was built with
+	epsilon, delta float64
+
+	// width is the number of counters of a row, and depth the number of rows
+	width, depth uint
+
+	// counters holds the rows one after the other
+	counters []uint64
+
+	// conservative is true if Add uses conservative update
+	conservative bool
+
+	// total is the sum of all the counts added
+	total uint64
+}
+
+// New initializes a new count-min sketch whose estimates exceed the counts by at most epsilon
+// times the total count, except with a probability of delta. It panics if epsilon or delta
+// aren't in (0, 1), see NewE.
+func New(epsilon, delta float64) *CountMinSketch {
+	this, err := NewE(epsilon, delta)
+	if err != nil {
+		panic(err)
+	}
+	return this
+}
+
+// NewE is the same as New, but returns ErrInvalidEpsilon or ErrInvalidDelta instead of
+// panicking.
+func NewE(epsilon, delta float64) (*CountMinSketch, error) {
+	if !(epsilon > 0 && epsilon < 1) {
+		return nil, ErrInvalidEpsilon
+	}
+
+	if !(delta > 0 && delta < 1) {
+		return nil, ErrInvalidDelta
+	}
+
+	width := uint(math.Ceil(math.E / epsilon))
+	depth := uint(math.Ceil(math.Log(1 / delta)))
+	if depth < 1 {
+		depth = 1
+	}
+
+	this := &CountMinSketch{
+		epsilon:  epsilon,
+		delta:    delta,
+		width:    width,
+		depth:    depth,
+		counters: make([]uint64, width*depth),
+	}
+	this.setHasher(fnv.New64(), bloom.DefaultHasher)
+
+	return this, nil
+}
+
+// SetHasher sets the hash function, the same way as for bloom filters. It returns
+// bloom.ErrNotEmpty if items have been added.
+func (this *CountMinSketch) SetHasher(h hash.Hash) error {
+	if this.total > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.setHasher(h, "")
+	return nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. It returns bloom.ErrNotEmpty if items have been added.
+func (this *CountMinSketch) SetNamedHasher(name string) error {
+	if this.total > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.setHasher(h, name)
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *CountMinSketch) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+func (this *CountMinSketch) setHasher(h hash.Hash, name string) {
+	this.h = h
+	this.hn = name
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+// SetConservative selects conservative update for the following Adds if on is true, and
+// the usual update otherwise. It can be changed at any time, as both keep the estimates
+// at least equal to the counts.
+func (this *CountMinSketch) SetConservative(on bool) {
+	this.conservative = on
+}
+
+// Conservative returns true if Add uses conservative update.
+func (this *CountMinSketch) Conservative() bool {
+	return this.conservative
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *CountMinSketch) HasherName() string {
+	return this.hn
+}
+
+// Width returns the number of counters of a row.
+func (this *CountMinSketch) Width() uint {
+	return this.width
+}
+
+// Depth returns the number of rows.
+func (this *CountMinSketch) Depth() uint {
+	return this.depth
+}
+
+// Epsilon returns the error of the estimates relative to the total count.
+func (this *CountMinSketch) Epsilon() float64 {
+	return this.epsilon
+}
+
+// Delta returns the probability of an estimate exceeding the error bound.
+func (this *CountMinSketch) Delta() float64 {
+	return this.delta
+}
+
+// Total returns the sum of all the counts added.
+func (this *CountMinSketch) Total() uint64 {
+	return this.total
+}
+
+// ErrorBound returns the error the estimates exceed with a probability of at most delta,
+// epsilon times the total count.
+func (this *CountMinSketch) ErrorBound() uint64 {
+	return uint64(math.Ceil(this.epsilon * float64(this.total)))
+}
+
+// Add adds count to the count of item.
+func (this *CountMinSketch) Add(item []byte, count uint64) *CountMinSketch {
+	if count == 0 {
+		return this
+	}
+
+	s := this.hp.Get()
+	defer this.hp.Put(s)
+
+	bs := s.Positions(this.depth)
+	this.locate(s, item, bs)
+	this.total = addSat(this.total, count)
+
+	if !this.conservative {
+		for r, i := range bs {
+			c := &this.counters[uint(r)*this.width+i]
+			*c = addSat(*c, count)
+		}
+		return this
+	}
+
+	v := addSat(this.min(bs), count)
+	for r, i := range bs {
+		if c := &this.counters[uint(r)*this.width+i]; *c < v {
+			*c = v
+		}
+	}
+
+	return this
+}
+
+// AddString is the same as Add([]byte(s), count), without copying s.
+func (this *CountMinSketch) AddString(s string, count uint64) *CountMinSketch {
+	return this.Add(unsafeBytes(s), count)
+}
+
+// Estimate returns the estimated count of item, never less than its count. It doesn't write
+// to the sketch, so it is safe to call concurrently with other Estimates.
+func (this *CountMinSketch) Estimate(item []byte) uint64 {
+	s := this.hp.Get()
+	defer this.hp.Put(s)
+
+	bs := s.Positions(this.depth)
+	this.locate(s, item, bs)
+	return this.min(bs)
+}
+
+// EstimateString is the same as Estimate([]byte(s)), without copying s.
+func (this *CountMinSketch) EstimateString(s string) uint64 {
+	return this.Estimate(unsafeBytes(s))
+}
+
+// min returns the smallest of the counters at bs, one per row.
+func (this *CountMinSketch) min(bs []uint) uint64 {
+	v := uint64(math.MaxUint64)
+	for r, i := range bs {
+		v = min(v, this.counters[uint(r)*this.width+i])
+	}
+	return v
+}
+
+// locate fills bs with the counter of item in each row, the same way as the standard
+// filter selects the bits of an item: with the Locator of the hasher if it has one, and
+// with the Kirsch-Mitzenmacher double hashing of the two halves of the first 8 bytes of
+// the hash otherwise.
+func (this *CountMinSketch) locate(s *bloom.Scratch, item []byte, bs []uint) {
+	if s.Loc != nil {
+		s.Loc.Locate(item, bs, this.width)
+		return
+	}
+
+	s.H.Reset()
+	s.H.Write(item)
+	v := bloom.Sum64(s.H, s.Sum[:])
+	a, b := uint32(v), uint32(v>>32)
+
+	for i := range bs {
+		bs[i] = (uint(a) + uint(b)*uint(i)) % this.width
+	}
+}
+
+// Compatible returns nil if other can be merged into the sketch: it must have the same
+// width and depth, and the same hasher. Otherwise it returns an error wrapping
+// bloom.ErrIncompatible.
+func (this *CountMinSketch) Compatible(other *CountMinSketch) error {
+	if this.width != other.width || this.depth != other.depth {
+		return fmt.Errorf("%w: width = %d, depth = %d and width = %d, depth = %d", bloom.ErrIncompatible, this.width, this.depth, other.width, other.depth)
+	}
+
+	if this.hn != other.hn || (this.hn == "" && this.h != other.h) {
+		return fmt.Errorf("%w: hashers %q and %q", bloom.ErrIncompatible, this.hn, other.hn)
+	}
+
+	return nil
+}
+
+// Merge adds the counts of other to the sketch, by adding its counters, so the estimates
+// are those of a sketch the items of both were added to. It works with conservative update
+// too, the estimates staying at least equal to the counts. If the sketches aren't
+// Compatible, it returns the error and leaves the sketch unchanged.
+func (this *CountMinSketch) Merge(other *CountMinSketch) error {
+	if err := this.Compatible(other); err != nil {
+		return err
+	}
+
+	for i, c := range other.counters {
+		this.counters[i] = addSat(this.counters[i], c)
+	}
+	this.total = addSat(this.total, other.total)
+
+	return nil
+}
+
+// Reset sets all the counts to 0.
+func (this *CountMinSketch) Reset() {
+	clear(this.counters)
+	this.total = 0
+}
+
+// Clone returns a deep copy of the sketch, with a new hasher of the same kind. It returns
+// an error if the hasher can't be recreated, see bloom.CloneHasher.
+func (this *CountMinSketch) Clone() (*CountMinSketch, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	c := *this
+	c.setHasher(h, this.hn)
+	c.counters = append([]uint64(nil), this.counters...)
+
+	return &c, nil
+}
+
+// MemoryUsage returns the number of bytes held by the sketch.
+func (this *CountMinSketch) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + 8*uint64(cap(this.counters))
+}
+
+// String implements fmt.Stringer with a one line summary of the sketch.
+func (this *CountMinSketch) String() string {
+	return fmt.Sprintf("cms{width=%d depth=%d epsilon=%g delta=%g conservative=%t total=%d}", this.width, this.depth, this.epsilon, this.delta, this.conservative, this.total)
+}
+
+// WriteTo implements io.WriterTo. It writes a bloom.Header of kind bloom.KindCMS holding the
+// width as M, the depth as K, 1 as S for conservative update and 0 otherwise, the total
+// count as C, delta as P, epsilon as E and the hasher name, followed by the counters as big
+// endian words, row by row. The hash function itself is not written, see ReadFrom.
+func (this *CountMinSketch) WriteTo(w io.Writer) (int64, error) {
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindCMS,
+		Hasher:  this.hn,
+		M:       uint64(this.width),
+		K:       uint64(this.depth),
+		C:       this.total,
+		P:       this.delta,
+		E:       this.epsilon,
+	}
+
+	if this.conservative {
+		h.S = 1
+	}
+
+	total, err := h.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+
+	buf := make([]byte, 0, 8*min(len(this.counters), 1<<17))
+	for i, c := range this.counters {
+		buf = binary.BigEndian.AppendUint64(buf, c)
+		if len(buf) == cap(buf) || i == len(this.counters)-1 {
+			n, err := w.Write(buf)
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+			buf = buf[:0]
+		}
+	}
+
+	return total, nil
+}
+
+// ReadFrom implements io.ReaderFrom. It reads a sketch written by WriteTo, consuming exactly
+// the bytes of one sketch from r. The hasher is recreated by name with bloom.NewHasher, so a
+// sketch whose hasher was set with SetHasher can't be read back, as for bloom filters.
+func (this *CountMinSketch) ReadFrom(r io.Reader) (int64, error) {
+	h := &bloom.Header{}
+	total, err := h.ReadFrom(r)
+	if err != nil {
+		return total, err
+	}
+
+	if h.Kind != bloom.KindCMS {
+		return total, fmt.Errorf("cms: cannot read %s filter", h.Kind)
+	}
+
+	if h.M == 0 || h.K == 0 || h.S > 1 || h.M > 1<<32/h.K {
+		return total, fmt.Errorf("cms: invalid parameters width = %d, depth = %d", h.M, h.K)
+	}
+
+	hf, err := bloom.NewHasher(h.Hasher)
+	if err != nil {
+		return total, err
+	}
+
+	buf := make([]byte, 8*h.M*h.K)
+	n, err := io.ReadFull(r, buf)
+	total += int64(n)
+	if err != nil {
+		return total, fmt.Errorf("cms: reading counters: %w", err)
+	}
+
+	this.width, this.depth = uint(h.M), uint(h.K)
+	this.epsilon, this.delta = h.E, h.P
+	this.conservative = h.S == 1
+	this.total = h.C
+	this.counters = make([]uint64, h.M*h.K)
+	for i := range this.counters {
+		this.counters[i] = binary.BigEndian.Uint64(buf[8*i:])
+	}
+	this.setHasher(hf, h.Hasher)
+
+	return total, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the WriteTo encoding.
+func (this *CountMinSketch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := this.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using the ReadFrom encoding. It
+// rejects truncated input, and input with trailing bytes after the counters.
+func (this *CountMinSketch) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := this.ReadFrom(r); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("cms: %d trailing bytes after counters", r.Len())
+	}
+
+	return nil
+}
+
+// addSat returns a + b, or math.MaxUint64 if it overflows.
+func addSat(a, b uint64) uint64 {
+	if s := a + b; s >= a {
+		return s
+	}
+	return math.MaxUint64
+}
+
+// unsafeBytes returns the bytes of s without copying them. Hash functions don't modify or
+// retain the data written to them, so it is safe to hash the result.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
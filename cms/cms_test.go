@@ -0,0 +1,284 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cms
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+// zipf returns a skewed stream of n words of web2, and the count of each word.
+func zipf(n int) ([]string, map[string]uint64) {
+	r := rand.New(rand.NewSource(1))
+	z := rand.NewZipf(r, 1.1, 1, uint64(len(web2)-1))
+
+	stream := make([]string, n)
+	counts := make(map[string]uint64)
+	for i := range stream {
+		w := web2[z.Uint64()]
+		stream[i] = w
+		counts[w]++
+	}
+
+	return stream, counts
+}
+
+func TestEstimate(t *testing.T) {
+	stream, counts := zipf(500000)
+
+	var errs [2]uint64
+	for i, conservative := range []bool{false, true} {
+		cms := New(0.0001, 0.01)
+		cms.SetConservative(conservative)
+
+		for _, w := range stream {
+			cms.AddString(w, 1)
+		}
+
+		if cms.Total() != uint64(len(stream)) {
+			t.Fatalf("Total = %d, expected %d", cms.Total(), len(stream))
+		}
+
+		over := 0
+		for w, c := range counts {
+			e := cms.EstimateString(w)
+			if e < c {
+				t.Fatalf("Estimate of %q = %d, less than its count %d", w, e, c)
+			}
+
+			if e-c > cms.ErrorBound() {
+				over++
+			}
+			errs[i] += e - c
+		}
+
+		fmt.Printf("%v: total error %d over %d words, %d above the bound %d\n", cms, errs[i], len(counts), over, cms.ErrorBound())
+
+		if float64(over) > 0.01*float64(len(counts)) {
+			t.Errorf("%d of %d estimates above the error bound, expected at most 1%%", over, len(counts))
+		}
+	}
+
+	if errs[1] >= errs[0] {
+		t.Errorf("Conservative update error %d, expected less than %d", errs[1], errs[0])
+	}
+}
+
+func TestAddCount(t *testing.T) {
+	cms := New(0.001, 0.001)
+	cms.AddString("hello", 10).AddString("hello", 5).AddString("world", 0)
+
+	if e := cms.EstimateString("hello"); e != 15 {
+		t.Errorf("Estimate = %d, expected 15", e)
+	}
+
+	if e := cms.EstimateString("world"); e != 0 {
+		t.Errorf("Estimate = %d, expected 0", e)
+	}
+
+	// Counters saturate instead of wrapping around
+	cms.AddString("hello", 1<<63).AddString("hello", 1<<63)
+	if e := cms.EstimateString("hello"); e != 1<<64-1 {
+		t.Errorf("Estimate = %d, expected %d", e, uint64(1<<64-1))
+	}
+}
+
+func TestMerge(t *testing.T) {
+	stream, counts := zipf(100000)
+
+	all, a, b := New(0.001, 0.01), New(0.001, 0.01), New(0.001, 0.01)
+	for i, w := range stream {
+		all.AddString(w, 1)
+		if i%2 == 0 {
+			a.AddString(w, 1)
+		} else {
+			b.AddString(w, 1)
+		}
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Total() != all.Total() {
+		t.Errorf("Total = %d, expected %d", a.Total(), all.Total())
+	}
+
+	for w := range counts {
+		if x, y := a.EstimateString(w), all.EstimateString(w); x != y {
+			t.Fatalf("Estimate of %q = %d after merging, expected %d", w, x, y)
+		}
+	}
+
+	if err := a.Merge(New(0.01, 0.01)); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Merging sketches of different widths returned %v, expected ErrIncompatible", err)
+	}
+
+	c := New(0.001, 0.01)
+	c.SetNamedHasher("fnv64a")
+	if err := a.Merge(c); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Merging sketches with different hashers returned %v, expected ErrIncompatible", err)
+	}
+}
+
+func TestSetHasher(t *testing.T) {
+	cms := New(0.01, 0.01)
+	if err := cms.SetNamedHasher("sha1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cms.SetNamedHasher("nope"); !errors.Is(err, bloom.ErrUnknownHasher) {
+		t.Errorf("SetNamedHasher returned %v, expected ErrUnknownHasher", err)
+	}
+
+	cms.AddString("hello", 1)
+	if err := cms.SetNamedHasher("md5"); err != bloom.ErrNotEmpty {
+		t.Errorf("SetNamedHasher returned %v, expected ErrNotEmpty", err)
+	}
+
+	cms.Reset()
+	if err := cms.SetNamedHasher("md5"); err != nil {
+		t.Errorf("SetNamedHasher returned %v after Reset", err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	cms := New(0.001, 0.01)
+	cms.SetNamedHasher("crc64-iso")
+	cms.SetConservative(true)
+	for _, w := range web2[:10000] {
+		cms.AddString(w, uint64(len(w)))
+	}
+
+	data, err := cms.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &bloom.Header{}
+	if _, err := h.ReadFrom(bytes.NewReader(data)); err != nil || h.Kind != bloom.KindCMS {
+		t.Fatalf("Header kind %s, error %v", h.Kind, err)
+	}
+
+	c := &CountMinSketch{}
+	if err := c.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.String() != cms.String() || c.HasherName() != "crc64-iso" {
+		t.Fatalf("Read %v with hasher %q, expected %v", c, c.HasherName(), cms)
+	}
+
+	for _, w := range web2[:20000] {
+		if x, y := c.EstimateString(w), cms.EstimateString(w); x != y {
+			t.Fatalf("Estimate of %q = %d after reading, expected %d", w, x, y)
+		}
+	}
+
+	if err := c.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("Expected an error reading a truncated sketch")
+	}
+
+	if err := c.UnmarshalBinary(append(data, 0)); err == nil {
+		t.Error("Expected an error reading trailing bytes")
+	}
+}
+
+func TestNewE(t *testing.T) {
+	for _, v := range [][2]float64{{0, 0.1}, {1, 0.1}, {0.1, 0}, {0.1, 1}} {
+		if _, err := NewE(v[0], v[1]); err == nil {
+			t.Errorf("NewE(%g, %g) returned no error", v[0], v[1])
+		}
+	}
+
+	cms := New(0.001, 0.001)
+	if cms.Width() != 2719 || cms.Depth() != 7 {
+		t.Errorf("Width = %d, depth = %d, expected 2719 and 7", cms.Width(), cms.Depth())
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	cms := New(0.0001, 0.001)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cms.AddString(web2[i%len(web2)], 1)
+	}
+}
+
+func BenchmarkAddConservative(b *testing.B) {
+	cms := New(0.0001, 0.001)
+	cms.SetConservative(true)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cms.AddString(web2[i%len(web2)], 1)
+	}
+}
+
+func BenchmarkEstimate(b *testing.B) {
+	cms := New(0.0001, 0.001)
+	for _, w := range web2 {
+		cms.AddString(w, 1)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cms.EstimateString(web2[i%len(web2)])
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression selects the codec applied to the body of a serialized filter. The header is
+// never compressed, so the parameters of a filter can be read without decompressing it.
+type Compression uint8
+
+const (
+	// CompressionNone writes the body as is.
+	CompressionNone Compression = iota
+
+	// CompressionGzip writes the body as a gzip stream, and sets FlagGzip in the header.
+	// It pays off for filters with a low fill ratio written with EncodingDense.
+	CompressionGzip
+)
+
+// BodyWriter writes the body of a serialized filter, compressing it as required by the
+// header flags. Finish must be called once the body is written.
+type BodyWriter struct {
+	w countingWriter
+	z *gzip.Writer
+}
+
+// NewBodyWriter returns a BodyWriter writing to w the body of a filter whose header has
+// the given flags.
+func NewBodyWriter(w io.Writer, flags uint16) *BodyWriter {
+	this := &BodyWriter{w: countingWriter{w: w}}
+	if flags&FlagGzip != 0 {
+		this.z = gzip.NewWriter(&this.w)
+	}
+	return this
+}
+
+func (this *BodyWriter) Write(p []byte) (int, error) {
+	if this.z != nil {
+		return this.z.Write(p)
+	}
+	return this.w.Write(p)
+}
+
+// Finish flushes the compressed stream, if any, without closing the underlying writer,
+// and returns the number of bytes written to it.
+func (this *BodyWriter) Finish() (int64, error) {
+	if this.z != nil {
+		if err := this.z.Close(); err != nil {
+			return this.w.n, err
+		}
+	}
+	return this.w.n, nil
+}
+
+// BodyReader reads the body of a serialized filter, decompressing it as required by the
+// header flags. It never reads past the end of the body, so filters can be read one
+// after the other from the same reader. Finish must be called once the body is read.
+type BodyReader struct {
+	r *byteReader
+	z *gzip.Reader
+}
+
+// NewBodyReader returns a BodyReader reading from r the body of a filter whose header
+// has the given flags.
+func NewBodyReader(r io.Reader, flags uint16) (*BodyReader, error) {
+	this := &BodyReader{r: &byteReader{r: r}}
+	if flags&FlagGzip != 0 {
+		z, err := gzip.NewReader(this.r)
+		if err != nil {
+			return nil, fmt.Errorf("bloom: reading compressed body: %w", err)
+		}
+		z.Multistream(false)
+		this.z = z
+	}
+	return this, nil
+}
+
+func (this *BodyReader) Read(p []byte) (int, error) {
+	if this.z != nil {
+		return this.z.Read(p)
+	}
+	return this.r.Read(p)
+}
+
+func (this *BodyReader) ReadByte() (byte, error) {
+	if this.z == nil {
+		return this.r.ReadByte()
+	}
+
+	var b [1]byte
+	if _, err := io.ReadFull(this.z, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Finish checks that the compressed stream, if any, ends after the body and that its
+// checksum matches, and returns the number of bytes read from the underlying reader.
+func (this *BodyReader) Finish() (int64, error) {
+	if this.z != nil {
+		var b [1]byte
+		if n, err := this.z.Read(b[:]); n != 0 || err != io.EOF {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("trailing data")
+			}
+			return this.r.n, fmt.Errorf("bloom: reading compressed body: %w", err)
+		}
+	}
+	return this.r.n, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (this *countingWriter) Write(p []byte) (int, error) {
+	n, err := this.w.Write(p)
+	this.n += int64(n)
+	return n, err
+}
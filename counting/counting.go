@@ -0,0 +1,446 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counting
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+// ErrNotAdded is returned by Remove when the item can't have been added to the filter.
+var ErrNotAdded = errors.New("counting: item was not added")
+
+// maxCount is the value a counter saturates at.
+const maxCount = math.MaxUint8
+
+// CountingBloom is a standard bloom filter that supports removing items. Each of the m bits
+// is replaced by an 8-bit counter: Add increments the k counters of an item, Remove
+// decrements them, and Check tests they are all non-zero.
+//
+// m and k are computed as for the standard filter, so for the same n and e the filter takes
+// 8 times the memory. With the optimal k, the probability that any counter reaches 16 is at
+// most m * (e * ln 2 / 16)^16, about 1.37e-15 * m (Fan et al., Summary Cache), so 4 bits per
+// counter almost always do, see PackedBloom. 8 bits leave room for items added many times.
+//
+// A counter that reaches 255 saturates: it is no longer incremented nor decremented, as its
+// count is lost, and decrementing it could later remove the bit of another item.
+type CountingBloom struct {
+	// h is the hash function used to get the list of h1..hk values
+	h hash.Hash
+
+	// hn is the name of the hash function, empty if it was set using SetHasher()
+	hn string
+
+	// loc is set if the hash function implements bloom.Locator
+	loc bloom.Locator
+
+	// hp holds the hashers used by Check, so it doesn't write to the filter.
+	hp *bloom.HasherPool
+
+	// m is the number of counters, k the number of hash values of an item, n the number of
+	// items the filter is built for, p the fill ratio and e the error probability. They
+	// have the same meaning as for the standard filter.
+	m, k, n uint
+	p, e    float64
+
+	// counters holds the m counters
+	counters []uint8
+
+	// c is the number of items added, less those removed
+	c uint64
+
+	// bs holds the list of counters to be changed/checked based on the hash values
+	bs []uint
+
+	// sum holds the digest of the last item, so hashing doesn't allocate
+	sum [64]byte
+}
+
+var (
+	_ bloom.Bloom        = (*CountingBloom)(nil)
+	_ bloom.Introspector = (*CountingBloom)(nil)
+)
+
+// New initializes a new counting bloom filter.
+// n is the number of items this bloom filter predicted to hold.
+func New(n uint) bloom.Bloom {
+	return NewWithEstimates(n, 0.001)
+}
+
+// NewWithEstimates initializes a new counting bloom filter for n items with a false
+// positive probability of fpRate. k and m are derived from fpRate with bloom.K and bloom.M.
+func NewWithEstimates(n uint, fpRate float64) bloom.Bloom {
+	bf := &CountingBloom{n: n, p: 0.5, e: fpRate}
+	bf.setHasher(fnv.New64(), bloom.DefaultHasher)
+	bf.Reset()
+	return bf
+}
+
+// SetHasher sets the hash function. It returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *CountingBloom) SetHasher(h hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.setHasher(h, "")
+	return nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. It returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *CountingBloom) SetNamedHasher(name string) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.setHasher(h, name)
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *CountingBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+// SetSeed sets the hash function to bloom.SeededHash(seed), so the positions of the items
+// depend on seed. The seed is recorded with the filter when serialized, see
+// bloom.SeededHasherName. Like SetHasher, it returns bloom.ErrNotEmpty if the filter isn't
+// empty. bloom.RandomSeed returns a random seed.
+func (this *CountingBloom) SetSeed(seed uint64) error {
+	return this.SetNamedHasher(bloom.SeededHasherName(seed))
+}
+
+// Seed returns the seed set by SetSeed, or false if the hash function isn't seeded.
+func (this *CountingBloom) Seed() (uint64, bool) {
+	return bloom.SeedOf(this.hn)
+}
+
+func (this *CountingBloom) setHasher(h hash.Hash, name string) {
+	this.h = h
+	this.hn = name
+	this.loc, _ = h.(bloom.Locator)
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+func (this *CountingBloom) Reset() {
+	this.k = bloom.K(this.e)
+	this.m = bloom.M(this.n, this.p, this.e)
+	this.counters = make([]uint8, this.m)
+	this.bs = make([]uint, this.k)
+	this.c = 0
+
+	if this.h == nil {
+		this.setHasher(fnv.New64(), "")
+	} else {
+		this.h.Reset()
+	}
+}
+
+// Clear removes all the items from the filter, keeping the parameters and the counters,
+// which are only zeroed.
+func (this *CountingBloom) Clear() {
+	clear(this.counters)
+	this.c = 0
+}
+
+// SetErrorProbability sets the error probability e, and resets the filter to recompute k
+// and m from it. It returns bloom.ErrNotEmpty if items have been added.
+func (this *CountingBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetFillRatio sets the fill ratio p, and resets the filter to recompute m from it. It
+// returns bloom.ErrNotEmpty if items have been added.
+func (this *CountingBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	this.Reset()
+	return nil
+}
+
+// K returns the number of hash values of each item.
+func (this *CountingBloom) K() uint {
+	return this.k
+}
+
+// M returns the number of counters of the filter.
+func (this *CountingBloom) M() uint {
+	return this.m
+}
+
+// S returns 0, as the counting filter has no partitions.
+func (this *CountingBloom) S() uint {
+	return 0
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *CountingBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns the parameters of the filter, M being the number of counters.
+func (this *CountingBloom) Params() bloom.Params {
+	return bloom.Params{M: this.m, K: this.k, N: this.n, P: this.p, E: this.e}
+}
+
+func (this *CountingBloom) Add(item []byte) bloom.Bloom {
+	this.bits(item)
+	for _, v := range this.bs {
+		if this.counters[v] < maxCount {
+			this.counters[v]++
+		}
+	}
+	this.c++
+	return this
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *CountingBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafeBytes(s))
+}
+
+// Remove removes an item added with Add, decrementing its counters. If a counter of item
+// is already zero, item can't have been added, and Remove returns ErrNotAdded, leaving the
+// filter unchanged. Otherwise removing an item that wasn't added is not detected, and
+// removes the bits of the items sharing its counters: they may then no longer be found.
+func (this *CountingBloom) Remove(item []byte) error {
+	this.bits(item)
+	for i, v := range this.bs {
+		switch this.counters[v] {
+		case maxCount:
+		case 0:
+			// Undo the decrements, so the filter is unchanged
+			for _, u := range this.bs[:i] {
+				if this.counters[u] < maxCount {
+					this.counters[u]++
+				}
+			}
+			return ErrNotAdded
+		default:
+			this.counters[v]--
+		}
+	}
+
+	// Count can't go below 0, even after removing items that weren't added
+	if this.c > 0 {
+		this.c--
+	}
+	return nil
+}
+
+// RemoveString is the same as Remove([]byte(s)), without copying s.
+func (this *CountingBloom) RemoveString(s string) error {
+	return this.Remove(unsafeBytes(s))
+}
+
+// Check returns true if item may have been added to the filter, and not removed since. It
+// doesn't write to the filter, so it is safe to call concurrently with other Checks.
+func (this *CountingBloom) Check(item []byte) bool {
+	s := this.hp.Get()
+	defer this.hp.Put(s)
+
+	bs := s.Positions(this.k)
+	bits(s.H, s.Loc, item, bs, this.m, s.Sum[:0])
+	for _, v := range bs {
+		if this.counters[v] == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *CountingBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// Count returns the number of items added, less those removed.
+func (this *CountingBloom) Count() uint64 {
+	return this.c
+}
+
+// Counter returns the value of counter i.
+func (this *CountingBloom) Counter(i uint) uint8 {
+	return this.counters[i]
+}
+
+// SaturationCount returns the number of counters that reached 255, and are no longer
+// incremented nor decremented.
+func (this *CountingBloom) SaturationCount() uint {
+	var x uint
+	for _, v := range this.counters {
+		if v == maxCount {
+			x++
+		}
+	}
+	return x
+}
+
+// set returns the number of non-zero counters.
+func (this *CountingBloom) set() uint {
+	var x uint
+	for _, v := range this.counters {
+		if v != 0 {
+			x++
+		}
+	}
+	return x
+}
+
+// FillRatio returns the fraction of non-zero counters.
+func (this *CountingBloom) FillRatio() float64 {
+	return float64(this.set()) / float64(this.m)
+}
+
+func (this *CountingBloom) EstimatedFillRatio() float64 {
+	return 1 - math.Exp((-float64(this.c)*float64(this.k))/float64(this.m))
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the fraction of non-zero counters.
+func (this *CountingBloom) CurrentFalsePositiveRate() float64 {
+	return math.Pow(this.FillRatio(), float64(this.k))
+}
+
+// ApproximateCardinality estimates the number of distinct items in the filter from the
+// number of non-zero counters, the same way as the standard filter.
+func (this *CountingBloom) ApproximateCardinality() uint64 {
+	x := this.set()
+	if x >= this.m {
+		return this.c
+	}
+	return uint64(math.Round(-float64(this.m) / float64(this.k) * math.Log(1-float64(x)/float64(this.m))))
+}
+
+// Clone returns a deep copy of the filter, with a new hasher of the same kind. It returns
+// an error if the hasher can't be recreated, see bloom.CloneHasher.
+func (this *CountingBloom) Clone() (bloom.Bloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := *this
+	bf.setHasher(h, this.hn)
+	bf.counters = append([]uint8(nil), this.counters...)
+	bf.bs = make([]uint, len(this.bs))
+
+	return &bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter: the counters, the buffer used
+// to hash items, and the filter itself.
+func (this *CountingBloom) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + uint64(cap(this.counters)) + 8*uint64(cap(this.bs))
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *CountingBloom) String() string {
+	return fmt.Sprintf("counting{n=%d m=%d k=%d e=%g count=%d fill=%.2f}", this.n, this.m, this.k, this.e, this.c, this.EstimatedFillRatio())
+}
+
+// Stats returns the statistics of the filter. BitsSet is the number of non-zero counters, and
+// Saturated the SaturationCount.
+func (this *CountingBloom) Stats() bloom.Stats {
+	x := this.set()
+
+	return bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.c,
+		BitsSet:            x,
+		FillRatio:          float64(x) / float64(this.m),
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		FalsePositiveRate:  math.Pow(float64(x)/float64(this.m), float64(this.k)),
+		Saturated:          this.SaturationCount(),
+	}
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *CountingBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *CountingBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func (this *CountingBloom) bits(item []byte) {
+	bits(this.h, this.loc, item, this.bs, this.m, this.sum[:0])
+}
+
+// bits fills bs with the counter positions for item in a filter of m counters, the same way
+// as a new standard filter does for bits.
+func bits(h hash.Hash, loc bloom.Locator, item []byte, bs []uint, m uint, sum []byte) {
+	if loc != nil {
+		loc.Locate(item, bs, m)
+		return
+	}
+
+	h.Reset()
+	h.Write(item)
+	bloom.DigestPositions(h, sum, bs, m, bloom.FlagWideDigest)
+}
+
+// unsafeBytes returns the bytes of s without copying them. Hash functions don't modify or
+// retain the data written to them, so it is safe to pass the result to bits.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
@@ -0,0 +1,371 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counting
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	l := []uint{uint(len(web2)), 200000, 100000, 50000}
+	for _, s := range l {
+		fmt.Printf("\n\nTesting counting filter with size %d\n", s)
+		bf := New(s).(*CountingBloom)
+
+		fn, fp := 0, 0
+		for l := range web2 {
+			if !(bf.Add([]byte(web2[l])).Check([]byte(web2[l]))) {
+				fn++
+			}
+		}
+
+		for l := range web2a {
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
+		fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+		bf.PrintStats()
+
+		if fn > 0 {
+			t.Errorf("%d false negatives", fn)
+		}
+	}
+}
+
+// remover is implemented by both counting filters.
+type remover interface {
+	bloom.Bloom
+	AddString(s string) bloom.Bloom
+	CheckString(s string) bool
+	RemoveString(s string) error
+	SaturationCount() uint
+}
+
+var ctors = map[string]func(uint) bloom.Bloom{
+	"bytes":   New,
+	"nibbles": NewPacked,
+}
+
+func TestRemove(t *testing.T) {
+	for name, ctor := range ctors {
+		testRemove(t, name, ctor(uint(len(web2))).(remover))
+	}
+}
+
+func testRemove(t *testing.T, name string, bf remover) {
+	half := len(web2) / 2
+
+	for i := 0; i < 3; i++ {
+		for _, w := range web2 {
+			bf.AddString(w)
+		}
+
+		for _, w := range web2[:half] {
+			if err := bf.RemoveString(w); err != nil {
+				t.Fatalf("%s: Removing %q: %v", name, w, err)
+			}
+		}
+
+		if bf.Count() != uint64(len(web2)-half) {
+			t.Fatalf("%s: Count = %d, expected %d", name, bf.Count(), len(web2)-half)
+		}
+
+		// The items not removed are all found
+		for _, w := range web2[half:] {
+			if !bf.CheckString(w) {
+				t.Fatalf("%s: Expected to find %q", name, w)
+			}
+		}
+
+		// The removed items are only found as false positives
+		fp := 0
+		for _, w := range web2[:half] {
+			if bf.CheckString(w) {
+				fp++
+			}
+		}
+
+		fmt.Printf("%s: cycle %d: %d of %d removed items found (%.4f%%)\n", name, i, fp, half, float32(fp)/float32(half)*100)
+		if rate := float64(fp) / float64(half); rate > 0.005 {
+			t.Errorf("%s: cycle %d: %d removed items found, rate %f", name, i, fp, rate)
+		}
+
+		for _, w := range web2[half:] {
+			if err := bf.RemoveString(w); err != nil {
+				t.Fatalf("%s: Removing %q: %v", name, w, err)
+			}
+		}
+
+		if bf.Count() != 0 || bf.FillRatio() != 0 {
+			t.Fatalf("%s: cycle %d: expected an empty filter, got count %d, fill ratio %f", name, i, bf.Count(), bf.FillRatio())
+		}
+	}
+}
+
+func TestRemoveNotAdded(t *testing.T) {
+	bf := New(1000).(*CountingBloom)
+
+	if err := bf.RemoveString("foo"); err != ErrNotAdded {
+		t.Errorf("Expected ErrNotAdded, got %v", err)
+	}
+
+	bf.AddString("foo")
+	for _, w := range web2[:1000] {
+		if w == "foo" || bf.CheckString(w) {
+			continue
+		}
+
+		// The filter is left unchanged
+		if err := bf.RemoveString(w); err != ErrNotAdded {
+			t.Errorf("Removing %q: expected ErrNotAdded, got %v", w, err)
+		}
+
+		if !bf.CheckString("foo") || bf.Count() != 1 {
+			t.Fatalf("Removing %q changed the filter", w)
+		}
+	}
+
+	if err := bf.RemoveString("foo"); err != nil || bf.CheckString("foo") {
+		t.Errorf("Expected foo to be removed, got %v", err)
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	bf := New(1000).(*CountingBloom)
+
+	for i := 0; i < 300; i++ {
+		bf.AddString("foo")
+	}
+
+	bf.bits([]byte("foo"))
+	for _, v := range bf.bs {
+		if bf.Counter(v) != maxCount {
+			t.Fatalf("Counter %d = %d, expected %d", v, bf.Counter(v), maxCount)
+		}
+	}
+
+	// Saturated counters are never decremented
+	for i := 0; i < 300; i++ {
+		if err := bf.RemoveString("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bf.CheckString("foo") {
+		t.Errorf("Expected to find foo after its counters saturated")
+	}
+}
+
+func TestSetters(t *testing.T) {
+	bf := New(1000).(*CountingBloom)
+	m := bf.M()
+
+	if err := bf.SetErrorProbability(0.01); err != nil || bf.M() >= m {
+		t.Errorf("SetErrorProbability: %v, m = %d, expected less than %d", err, bf.M(), m)
+	}
+
+	bf.AddString("foo")
+	if err := bf.SetErrorProbability(0.001); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected bloom.ErrNotEmpty, got %v", err)
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf.RemoveString("foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.(*CountingBloom).CheckString("foo") || c.Count() != 1 {
+		t.Errorf("Expected the clone to keep foo")
+	}
+}
+
+// TestPackedCounters checks the packed counters against the byte counters, which are never
+// saturated by the few items added.
+func TestPackedCounters(t *testing.T) {
+	bf := New(1000).(*CountingBloom)
+	pf := NewPacked(1000).(*PackedBloom)
+
+	for i, w := range web2[:2000] {
+		bf.AddString(w)
+		pf.AddString(w)
+
+		if i%3 == 0 {
+			bf.RemoveString(web2[i/2])
+			pf.RemoveString(web2[i/2])
+		}
+	}
+
+	for i := uint(0); i < bf.M(); i++ {
+		if bf.Counter(i) != pf.Counter(i) && !(pf.Counter(i) == maxNibble && bf.Counter(i) > maxNibble) {
+			t.Fatalf("Counter %d = %d, expected %d", i, pf.Counter(i), bf.Counter(i))
+		}
+	}
+
+	if bf.FillRatio() != pf.FillRatio() || bf.Count() != pf.Count() {
+		t.Errorf("Fill ratio %f, count %d, expected %f, %d", pf.FillRatio(), pf.Count(), bf.FillRatio(), bf.Count())
+	}
+}
+
+// TestPackedSaturation removes an item after its counters saturated: they stay at 15, so it
+// is still found, and the items sharing them are never lost.
+func TestPackedSaturation(t *testing.T) {
+	bf := NewPacked(1000).(*PackedBloom)
+
+	for i := 0; i < 20; i++ {
+		bf.AddString("foo")
+	}
+
+	bf.bits([]byte("foo"))
+	for _, v := range bf.bs {
+		if bf.Counter(v) != maxNibble {
+			t.Fatalf("Counter %d = %d, expected %d", v, bf.Counter(v), maxNibble)
+		}
+	}
+
+	saturated := bf.SaturationCount()
+	if saturated == 0 || saturated > bf.K() || bf.Stats().Saturated != saturated {
+		t.Fatalf("SaturationCount = %d, Stats().Saturated = %d, expected 1 to %d", saturated, bf.Stats().Saturated, bf.K())
+	}
+
+	// Neighbouring counters in the same words are not affected
+	if bf.set() != saturated {
+		t.Fatalf("%d non-zero counters, expected %d", bf.set(), saturated)
+	}
+
+	for _, w := range web2[:100] {
+		bf.AddString(w)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := bf.RemoveString("foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bf.CheckString("foo") {
+		t.Errorf("Expected to find foo after its counters saturated")
+	}
+
+	if bf.SaturationCount() != saturated {
+		t.Errorf("SaturationCount = %d, expected %d", bf.SaturationCount(), saturated)
+	}
+
+	for _, w := range web2[:100] {
+		if err := bf.RemoveString(w); err != nil {
+			t.Fatalf("Removing %q: %v", w, err)
+		}
+	}
+
+	// Only the saturated counters are left
+	if bf.set() != saturated || bf.Count() != 0 {
+		t.Errorf("%d non-zero counters, count %d, expected %d, 0", bf.set(), bf.Count(), saturated)
+	}
+}
+
+func BenchmarkAddRemove(b *testing.B) {
+	for name, ctor := range ctors {
+		b.Run(name, func(b *testing.B) {
+			bf := ctor(uint(len(web2))).(remover)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				w := web2[i%len(web2)]
+				bf.AddString(w)
+				bf.RemoveString(w)
+			}
+			b.ReportMetric(float64(bf.MemoryUsage()), "filter-bytes")
+		})
+	}
+}
+
+func BenchmarkCheck(b *testing.B) {
+	for name, ctor := range ctors {
+		b.Run(name, func(b *testing.B) {
+			bf := ctor(uint(len(web2))).(remover)
+			for _, w := range web2 {
+				bf.AddString(w)
+			}
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				bf.CheckString(web2a[i%len(web2a)])
+			}
+			b.ReportMetric(float64(bf.MemoryUsage()), "filter-bytes")
+		})
+	}
+}
+
+func TestAllocs(t *testing.T) {
+	for name, ctor := range ctors {
+		bf := ctor(1000).(remover)
+		allocs := testing.AllocsPerRun(1000, func() {
+			bf.AddString("hello")
+			bf.CheckString("hello")
+			bf.RemoveString("hello")
+		})
+
+		if allocs != 0 {
+			t.Errorf("%s: %f allocations per AddString, CheckString and RemoveString, expected 0", name, allocs)
+		}
+	}
+}
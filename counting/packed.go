@@ -0,0 +1,413 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package counting
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	mathbits "math/bits"
+	"os"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+const (
+	// maxNibble is the value a 4-bit counter saturates at.
+	maxNibble = 15
+
+	// lowNibbles has the lowest bit of each of the 16 nibbles of a word set.
+	lowNibbles = 0x1111111111111111
+)
+
+// PackedBloom is a counting filter using 4-bit counters, packed 16 to a uint64 word, so it
+// takes half the memory of CountingBloom, 4 times that of the standard filter. As explained
+// for CountingBloom, counters rarely reach 16 with the optimal k.
+//
+// A counter that reaches 15 saturates: it is no longer incremented nor decremented. The items
+// sharing it can then no longer be removed from it, so they may be found after being removed,
+// which is the same as a false positive, but removing other items never causes a false
+// negative. SaturationCount reports the number of saturated counters.
+type PackedBloom struct {
+	// h is the hash function used to get the list of h1..hk values
+	h hash.Hash
+
+	// hn is the name of the hash function, empty if it was set using SetHasher()
+	hn string
+
+	// loc is set if the hash function implements bloom.Locator
+	loc bloom.Locator
+
+	// hp holds the hashers used by Check, so it doesn't write to the filter.
+	hp *bloom.HasherPool
+
+	// m, k, n, p and e are the parameters of the filter, see CountingBloom.
+	m, k, n uint
+	p, e    float64
+
+	// words holds the m counters, counter i being the nibble i%16 of word i/16
+	words []uint64
+
+	// c is the number of items added, less those removed
+	c uint64
+
+	// bs holds the list of counters to be changed/checked based on the hash values
+	bs []uint
+
+	// sum holds the digest of the last item, so hashing doesn't allocate
+	sum [64]byte
+}
+
+var (
+	_ bloom.Bloom        = (*PackedBloom)(nil)
+	_ bloom.Introspector = (*PackedBloom)(nil)
+)
+
+// NewPacked initializes a new counting bloom filter with 4-bit counters.
+// n is the number of items this bloom filter predicted to hold.
+func NewPacked(n uint) bloom.Bloom {
+	return NewPackedWithEstimates(n, 0.001)
+}
+
+// NewPackedWithEstimates initializes a new counting bloom filter with 4-bit counters for n
+// items with a false positive probability of fpRate.
+func NewPackedWithEstimates(n uint, fpRate float64) bloom.Bloom {
+	bf := &PackedBloom{n: n, p: 0.5, e: fpRate}
+	bf.setHasher(fnv.New64(), bloom.DefaultHasher)
+	bf.Reset()
+	return bf
+}
+
+// SetHasher sets the hash function. It returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *PackedBloom) SetHasher(h hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.setHasher(h, "")
+	return nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. It returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *PackedBloom) SetNamedHasher(name string) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.setHasher(h, name)
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *PackedBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+func (this *PackedBloom) setHasher(h hash.Hash, name string) {
+	this.h = h
+	this.hn = name
+	this.loc, _ = h.(bloom.Locator)
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+func (this *PackedBloom) Reset() {
+	this.k = bloom.K(this.e)
+	this.m = bloom.M(this.n, this.p, this.e)
+	this.words = make([]uint64, (this.m+15)/16)
+	this.bs = make([]uint, this.k)
+	this.c = 0
+
+	if this.h == nil {
+		this.setHasher(fnv.New64(), "")
+	} else {
+		this.h.Reset()
+	}
+}
+
+// Clear removes all the items from the filter, keeping the parameters and the counters,
+// which are only zeroed.
+func (this *PackedBloom) Clear() {
+	clear(this.words)
+	this.c = 0
+}
+
+// SetErrorProbability sets the error probability e, and resets the filter to recompute k
+// and m from it. It returns bloom.ErrNotEmpty if items have been added.
+func (this *PackedBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetFillRatio sets the fill ratio p, and resets the filter to recompute m from it. It
+// returns bloom.ErrNotEmpty if items have been added.
+func (this *PackedBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	this.Reset()
+	return nil
+}
+
+// K returns the number of hash values of each item.
+func (this *PackedBloom) K() uint {
+	return this.k
+}
+
+// M returns the number of counters of the filter.
+func (this *PackedBloom) M() uint {
+	return this.m
+}
+
+// S returns 0, as the counting filter has no partitions.
+func (this *PackedBloom) S() uint {
+	return 0
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *PackedBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns the parameters of the filter, M being the number of counters.
+func (this *PackedBloom) Params() bloom.Params {
+	return bloom.Params{M: this.m, K: this.k, N: this.n, P: this.p, E: this.e}
+}
+
+// Counter returns the value of counter i.
+func (this *PackedBloom) Counter(i uint) uint8 {
+	return uint8(this.words[i>>4] >> ((i & 15) << 2) & maxNibble)
+}
+
+// inc increments counter i unless it is saturated.
+func (this *PackedBloom) inc(i uint) {
+	w, shift := &this.words[i>>4], (i&15)<<2
+	if *w>>shift&maxNibble != maxNibble {
+		*w += 1 << shift
+	}
+}
+
+func (this *PackedBloom) Add(item []byte) bloom.Bloom {
+	this.bits(item)
+	for _, v := range this.bs {
+		this.inc(v)
+	}
+	this.c++
+	return this
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *PackedBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafeBytes(s))
+}
+
+// Remove removes an item added with Add, decrementing its counters, except the saturated
+// ones. If a counter of item is already zero, it returns ErrNotAdded, leaving the filter
+// unchanged. See CountingBloom.Remove.
+func (this *PackedBloom) Remove(item []byte) error {
+	this.bits(item)
+	for i, v := range this.bs {
+		w, shift := &this.words[v>>4], (v&15)<<2
+		switch *w >> shift & maxNibble {
+		case maxNibble:
+		case 0:
+			// Undo the decrements, so the filter is unchanged
+			for _, u := range this.bs[:i] {
+				this.inc(u)
+			}
+			return ErrNotAdded
+		default:
+			*w -= 1 << shift
+		}
+	}
+
+	// Count can't go below 0, even after removing items that weren't added
+	if this.c > 0 {
+		this.c--
+	}
+	return nil
+}
+
+// RemoveString is the same as Remove([]byte(s)), without copying s.
+func (this *PackedBloom) RemoveString(s string) error {
+	return this.Remove(unsafeBytes(s))
+}
+
+// Check returns true if item may have been added to the filter, and not removed since. It
+// doesn't write to the filter, so it is safe to call concurrently with other Checks.
+func (this *PackedBloom) Check(item []byte) bool {
+	s := this.hp.Get()
+	defer this.hp.Put(s)
+
+	bs := s.Positions(this.k)
+	bits(s.H, s.Loc, item, bs, this.m, s.Sum[:0])
+	for _, v := range bs {
+		if this.words[v>>4]>>((v&15)<<2)&maxNibble == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *PackedBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// Count returns the number of items added, less those removed.
+func (this *PackedBloom) Count() uint64 {
+	return this.c
+}
+
+// SaturationCount returns the number of counters that reached 15, and are no longer
+// incremented nor decremented.
+func (this *PackedBloom) SaturationCount() uint {
+	var x int
+	for _, w := range this.words {
+		// The low bit of a nibble is kept if all 4 bits are set
+		x += mathbits.OnesCount64(w & (w >> 1) & (w >> 2) & (w >> 3) & lowNibbles)
+	}
+	return uint(x)
+}
+
+// set returns the number of non-zero counters.
+func (this *PackedBloom) set() uint {
+	var x int
+	for _, w := range this.words {
+		// The low bit of a nibble is kept if any of its 4 bits is set
+		x += mathbits.OnesCount64((w | w>>1 | w>>2 | w>>3) & lowNibbles)
+	}
+	return uint(x)
+}
+
+// FillRatio returns the fraction of non-zero counters.
+func (this *PackedBloom) FillRatio() float64 {
+	return float64(this.set()) / float64(this.m)
+}
+
+func (this *PackedBloom) EstimatedFillRatio() float64 {
+	return 1 - math.Exp((-float64(this.c)*float64(this.k))/float64(this.m))
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the fraction of non-zero counters.
+func (this *PackedBloom) CurrentFalsePositiveRate() float64 {
+	return math.Pow(this.FillRatio(), float64(this.k))
+}
+
+// ApproximateCardinality estimates the number of distinct items in the filter from the
+// number of non-zero counters, the same way as the standard filter.
+func (this *PackedBloom) ApproximateCardinality() uint64 {
+	x := this.set()
+	if x >= this.m {
+		return this.c
+	}
+	return uint64(math.Round(-float64(this.m) / float64(this.k) * math.Log(1-float64(x)/float64(this.m))))
+}
+
+// Clone returns a deep copy of the filter, with a new hasher of the same kind. It returns
+// an error if the hasher can't be recreated, see bloom.CloneHasher.
+func (this *PackedBloom) Clone() (bloom.Bloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := *this
+	bf.setHasher(h, this.hn)
+	bf.words = append([]uint64(nil), this.words...)
+	bf.bs = make([]uint, len(this.bs))
+
+	return &bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter: the counters, the buffer used
+// to hash items, and the filter itself.
+func (this *PackedBloom) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + 8*uint64(cap(this.words)+cap(this.bs))
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *PackedBloom) String() string {
+	return fmt.Sprintf("packed{n=%d m=%d k=%d e=%g count=%d fill=%.2f}", this.n, this.m, this.k, this.e, this.c, this.EstimatedFillRatio())
+}
+
+// Stats returns the statistics of the filter. BitsSet is the number of non-zero counters, and
+// Saturated the SaturationCount.
+func (this *PackedBloom) Stats() bloom.Stats {
+	x := this.set()
+
+	return bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.c,
+		BitsSet:            x,
+		FillRatio:          float64(x) / float64(this.m),
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		FalsePositiveRate:  math.Pow(float64(x)/float64(this.m), float64(this.k)),
+		Saturated:          this.SaturationCount(),
+	}
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *PackedBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *PackedBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func (this *PackedBloom) bits(item []byte) {
+	bits(this.h, this.loc, item, this.bs, this.m, this.sum[:0])
+}
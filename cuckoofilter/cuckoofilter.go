@@ -0,0 +1,551 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cuckoofilter implements the cuckoo filter described in "Cuckoo Filter: Practically
+// Better Than Bloom" by Fan, Andersen, Kaminsky and Mitzenmacher. Like a counting bloom
+// filter it supports deleting items, using far less memory.
+package cuckoofilter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+const (
+	// BucketSize is the number of fingerprints each bucket holds.
+	BucketSize = 4
+
+	// DefaultFingerprintBits is the fingerprint size used by New, giving a false positive
+	// rate of about 0.2% when full.
+	DefaultFingerprintBits = 12
+
+	// MinFingerprintBits and MaxFingerprintBits bound the fingerprint size.
+	MinFingerprintBits = 8
+	MaxFingerprintBits = 16
+
+	// MaxKicks is the number of fingerprints Add relocates before giving up.
+	MaxKicks = 500
+
+	// loadFactor is the fraction of the slots expected to be usable before Add fails, used
+	// to size the table. With 4 slots per bucket, it's about 95%.
+	loadFactor = 0.95
+)
+
+var (
+	// ErrFull is returned by Add when no slot could be freed for the item after MaxKicks
+	// relocations. The filter is left unchanged.
+	ErrFull = errors.New("cuckoofilter: filter is full")
+
+	// ErrInvalidFingerprintBits is returned when the fingerprint size is not between
+	// MinFingerprintBits and MaxFingerprintBits.
+	ErrInvalidFingerprintBits = errors.New("cuckoofilter: fingerprint size must be between 8 and 16 bits")
+
+	// ErrShortHash is returned when setting a hasher producing less than 8 bytes.
+	ErrShortHash = errors.New("cuckoofilter: hash must be at least 8 bytes")
+)
+
+// CuckooFilter is a cuckoo filter. Each item is stored as an f-bit fingerprint in one of two
+// buckets of 4 slots: the first derived from the hash of the item, the second from the first
+// and the fingerprint only (partial-key cuckoo hashing), so a fingerprint can be moved to its
+// other bucket to make room without knowing the item. The slots are packed in a bit array,
+// f bits each, so the filter takes about f / 0.95 bits per item, against 1.44 * log2(1/e)
+// for a standard bloom filter and 4 times that for a counting one.
+//
+// The false positive rate is at most 8 / 2^f, about 0.2% for 12-bit fingerprints.
+type CuckooFilter struct {
+	// h is the hash function used to get the bucket and fingerprint of an item. hn is its
+	// name, empty if it was set using SetHasher().
+	h  hash.Hash
+	hn string
+
+	// hp holds the hashers used by Check, so it doesn't write to the filter.
+	hp *bloom.HasherPool
+
+	// n is the number of items the filter is built for, f the fingerprint size in bits,
+	// and nb the number of buckets, a power of 2.
+	n, f, nb uint
+
+	// c is the number of items in the filter
+	c uint64
+
+	// words holds the nb * BucketSize slots, slot i being bits [i*f, (i+1)*f). An empty
+	// slot is 0, fingerprints are never 0.
+	words []uint64
+
+	// rnd is the state of the generator picking the fingerprints to relocate, and path the
+	// slots they were taken from, so a failed Add can be undone.
+	rnd  uint64
+	path []uint
+
+	// sum holds the digest of the last item, so hashing doesn't allocate
+	sum [64]byte
+}
+
+// New initializes a new cuckoo filter for n items with DefaultFingerprintBits fingerprints.
+func New(n uint) *CuckooFilter {
+	bf, _ := NewWithFingerprint(n, DefaultFingerprintBits)
+	return bf
+}
+
+// NewWithFingerprint initializes a new cuckoo filter for n items with fingerprints of f bits.
+// It returns ErrInvalidFingerprintBits if f is not between MinFingerprintBits and
+// MaxFingerprintBits.
+func NewWithFingerprint(n, f uint) (*CuckooFilter, error) {
+	if f < MinFingerprintBits || f > MaxFingerprintBits {
+		return nil, ErrInvalidFingerprintBits
+	}
+
+	this := &CuckooFilter{n: n, f: f}
+	this.setHasher(fnv.New64(), bloom.DefaultHasher)
+	this.Reset()
+	return this, nil
+}
+
+// buckets returns the number of buckets of a filter for n items, the smallest power of 2
+// holding them at a load factor of 95%.
+func buckets(n uint) uint {
+	nb := uint(math.Ceil(float64(n) / BucketSize / loadFactor))
+	if nb <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(nb-1)
+}
+
+// Reset removes all the items, reallocating the table.
+func (this *CuckooFilter) Reset() {
+	this.nb = buckets(this.n)
+	this.words = make([]uint64, (this.nb*BucketSize*this.f+63)/64)
+	this.c = 0
+	this.rnd = 0x9e3779b97f4a7c15
+}
+
+// Clear removes all the items, keeping the table, which is only zeroed.
+func (this *CuckooFilter) Clear() {
+	clear(this.words)
+	this.c = 0
+}
+
+// SetHasher sets the hash function, which must produce at least 8 bytes. It returns
+// bloom.ErrNotEmpty if the filter isn't empty.
+func (this *CuckooFilter) SetHasher(h hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	if h.Size() < 8 {
+		return ErrShortHash
+	}
+
+	this.setHasher(h, "")
+	return nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name, which is recorded when the filter is serialized. It returns
+// bloom.ErrNotEmpty if the filter isn't empty.
+func (this *CuckooFilter) SetNamedHasher(name string) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	if h.Size() < 8 {
+		return ErrShortHash
+	}
+
+	this.setHasher(h, name)
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *CuckooFilter) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+func (this *CuckooFilter) setHasher(h hash.Hash, name string) {
+	this.h = h
+	this.hn = name
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *CuckooFilter) HasherName() string {
+	return this.hn
+}
+
+// FingerprintBits returns the size of the fingerprints in bits.
+func (this *CuckooFilter) FingerprintBits() uint {
+	return this.f
+}
+
+// Buckets returns the number of buckets.
+func (this *CuckooFilter) Buckets() uint {
+	return this.nb
+}
+
+// Capacity returns n, the number of items the filter was built for.
+func (this *CuckooFilter) Capacity() uint {
+	return this.n
+}
+
+// Count returns the number of items in the filter.
+func (this *CuckooFilter) Count() uint64 {
+	return this.c
+}
+
+// LoadFactor returns the fraction of the slots in use.
+func (this *CuckooFilter) LoadFactor() float64 {
+	return float64(this.c) / float64(this.nb*BucketSize)
+}
+
+// FalsePositiveRate returns the false positive probability at the current load: a Check
+// compares the fingerprint with the 8 slots of 2 buckets, each matching one of the 2^f - 1
+// fingerprints.
+func (this *CuckooFilter) FalsePositiveRate() float64 {
+	return 1 - math.Pow(1-1/float64(uint(1)<<this.f-1), 2*BucketSize*this.LoadFactor())
+}
+
+// index hashes item to its first bucket and fingerprint. The digest is appended to sum,
+// which should have room for it.
+func (this *CuckooFilter) index(h hash.Hash, item []byte, sum []byte) (uint, uint64) {
+	h.Reset()
+	h.Write(item)
+	v := bloom.Mix64(bloom.Sum64(h, sum))
+
+	fp := v >> 32 & (1<<this.f - 1)
+	if fp == 0 {
+		fp = 1
+	}
+	return uint(v) & (this.nb - 1), fp
+}
+
+// alt returns the other bucket of fingerprint fp in bucket i. It only depends on i and fp,
+// and alt(alt(i, fp), fp) is i.
+func (this *CuckooFilter) alt(i uint, fp uint64) uint {
+	// The multiplier is the MurmurHash2 constant, as in the reference implementation
+	return (i ^ uint(fp*0x5bd1e995)) & (this.nb - 1)
+}
+
+// get returns the fingerprint in slot i.
+func (this *CuckooFilter) get(i uint) uint64 {
+	o := i * this.f
+	w, s := o>>6, o&63
+
+	v := this.words[w] >> s
+	if s+this.f > 64 {
+		v |= this.words[w+1] << (64 - s)
+	}
+	return v & (1<<this.f - 1)
+}
+
+// set sets slot i to fp.
+func (this *CuckooFilter) set(i uint, fp uint64) {
+	o := i * this.f
+	w, s := o>>6, o&63
+	mask := uint64(1)<<this.f - 1
+
+	this.words[w] = this.words[w]&^(mask<<s) | fp<<s
+	if s+this.f > 64 {
+		this.words[w+1] = this.words[w+1]&^(mask>>(64-s)) | fp>>(64-s)
+	}
+}
+
+// find returns the slot of bucket b holding fp, or -1.
+func (this *CuckooFilter) find(b uint, fp uint64) int {
+	for i := uint(0); i < BucketSize; i++ {
+		if this.get(b*BucketSize+i) == fp {
+			return int(i)
+		}
+	}
+	return -1
+}
+
+// insert puts fp in a free slot of bucket b, if any.
+func (this *CuckooFilter) insert(b uint, fp uint64) bool {
+	if i := this.find(b, 0); i >= 0 {
+		this.set(b*BucketSize+uint(i), fp)
+		return true
+	}
+	return false
+}
+
+// next returns a pseudo-random number, using xorshift64.
+func (this *CuckooFilter) next() uint64 {
+	this.rnd ^= this.rnd << 13
+	this.rnd ^= this.rnd >> 7
+	this.rnd ^= this.rnd << 17
+	return this.rnd
+}
+
+// Add adds item to the filter. If both its buckets are full, fingerprints are relocated
+// to their other bucket to make room, up to MaxKicks times. If that fails, the relocations
+// are undone and ErrFull is returned.
+//
+// An item added twice is stored twice, and must be deleted twice.
+func (this *CuckooFilter) Add(item []byte) error {
+	i1, fp := this.index(this.h, item, this.sum[:0])
+	i2 := this.alt(i1, fp)
+
+	if this.insert(i1, fp) || this.insert(i2, fp) {
+		this.c++
+		return nil
+	}
+
+	b := i1
+	if this.next()&1 == 0 {
+		b = i2
+	}
+
+	this.path = this.path[:0]
+	for k := 0; k < MaxKicks; k++ {
+		// Swap fp with a random fingerprint of b, and move that one to its other bucket
+		slot := b*BucketSize + uint(this.next()%BucketSize)
+		old := this.get(slot)
+		this.set(slot, fp)
+		this.path = append(this.path, slot)
+
+		fp, b = old, this.alt(b, old)
+		if this.insert(b, fp) {
+			this.c++
+			return nil
+		}
+	}
+
+	// Put the fingerprints back where they were, in reverse order
+	for k := len(this.path) - 1; k >= 0; k-- {
+		old := this.get(this.path[k])
+		this.set(this.path[k], fp)
+		fp = old
+	}
+
+	return ErrFull
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *CuckooFilter) AddString(s string) error {
+	return this.Add(unsafeBytes(s))
+}
+
+// Check returns true if item may be in the filter. It doesn't write to the filter, so it is
+// safe to call concurrently with other Checks, but not with Add or Delete.
+func (this *CuckooFilter) Check(item []byte) bool {
+	s := this.hp.Get()
+	i1, fp := this.index(s.H, item, s.Sum[:0])
+	this.hp.Put(s)
+
+	return this.find(i1, fp) >= 0 || this.find(this.alt(i1, fp), fp) >= 0
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *CuckooFilter) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// Delete removes one copy of item from the filter, and reports whether it was found.
+//
+// Only items that were added must be deleted. An item that wasn't added may share its
+// fingerprint and a bucket with one that was, as for a false positive of Check, and
+// deleting it then removes the fingerprint of the other item, which is no longer found.
+func (this *CuckooFilter) Delete(item []byte) bool {
+	i1, fp := this.index(this.h, item, this.sum[:0])
+
+	for _, b := range [2]uint{i1, this.alt(i1, fp)} {
+		if i := this.find(b, fp); i >= 0 {
+			this.set(b*BucketSize+uint(i), 0)
+			this.c--
+			return true
+		}
+	}
+
+	return false
+}
+
+// DeleteString is the same as Delete([]byte(s)), without copying s.
+func (this *CuckooFilter) DeleteString(s string) bool {
+	return this.Delete(unsafeBytes(s))
+}
+
+// Clone returns a deep copy of the filter, with a new hasher of the same kind. It returns
+// an error if the hasher can't be recreated, see bloom.CloneHasher.
+func (this *CuckooFilter) Clone() (*CuckooFilter, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := *this
+	bf.setHasher(h, this.hn)
+	bf.words = append([]uint64(nil), this.words...)
+	bf.path = nil
+
+	return &bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter: the table, the buffer used to
+// undo relocations, and the filter itself. The memory held by the hasher is not included.
+func (this *CuckooFilter) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + 8*uint64(cap(this.words)+cap(this.path))
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *CuckooFilter) String() string {
+	return fmt.Sprintf("cuckoo{n=%d buckets=%d f=%d count=%d load=%.2f}", this.n, this.nb, this.f, this.c, this.LoadFactor())
+}
+
+// WriteTo implements io.WriterTo. It is the same as Encode with nil options.
+func (this *CuckooFilter) WriteTo(w io.Writer) (int64, error) {
+	return this.Encode(w, nil)
+}
+
+// Encode implements bloom.Encoder. It writes a bloom.Header of kind bloom.KindCuckoo holding
+// the number of slots as M, the fingerprint size as K, n, the count and the hasher name,
+// followed by the slots, written as a bit array by bloom.WriteBits.
+//
+// bloom.Load can't read cuckoo filters, as they don't implement bloom.Bloom. Use ReadFrom.
+func (this *CuckooFilter) Encode(w io.Writer, opts *bloom.WriteOptions) (int64, error) {
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindCuckoo,
+		Hasher:  this.hn,
+		M:       uint64(this.nb * BucketSize),
+		K:       uint64(this.f),
+		N:       uint64(this.n),
+		C:       this.c,
+	}
+
+	h.Flags = opts.Flags(this.LoadFactor())
+
+	total, err := h.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+
+	bw := bloom.NewBodyWriter(w, h.Flags)
+	if _, err := bloom.WriteBits(bw, this.words, this.nb*BucketSize*this.f, h.Flags&bloom.FlagSparse != 0); err != nil {
+		n, _ := bw.Finish()
+		return total + n, err
+	}
+
+	n, err := bw.Finish()
+	return total + n, err
+}
+
+// ReadFrom implements io.ReaderFrom. It reads a filter written by WriteTo, consuming exactly
+// the bytes of one encoded filter from r. If the filter was written with a hasher set by
+// SetNamedHasher, that hasher is recreated. Otherwise the current hasher is kept, or
+// fnv.New64() is used if none is set.
+func (this *CuckooFilter) ReadFrom(r io.Reader) (int64, error) {
+	h := &bloom.Header{}
+	total, err := h.ReadFrom(r)
+	if err != nil {
+		return total, err
+	}
+
+	if h.Kind != bloom.KindCuckoo {
+		return total, fmt.Errorf("cuckoofilter: cannot read %s filter", h.Kind)
+	}
+
+	n, err := this.readBody(h, r)
+	return total + n, err
+}
+
+func (this *CuckooFilter) readBody(h *bloom.Header, r io.Reader) (int64, error) {
+	nb := uint(h.M / BucketSize)
+	if h.K < MinFingerprintBits || h.K > MaxFingerprintBits || nb == 0 || nb&(nb-1) != 0 || h.M%BucketSize != 0 {
+		return 0, fmt.Errorf("cuckoofilter: invalid parameters m = %d, k = %d", h.M, h.K)
+	}
+
+	// The table of m fingerprints of k bits must fit in a uint
+	if h.M > math.MaxUint/h.K {
+		return 0, fmt.Errorf("cuckoofilter: table of m = %d fingerprints of k = %d bits too large", h.M, h.K)
+	}
+
+	hf, err := bloom.ResolveHasher(h.Hasher, this.h)
+	if err != nil {
+		return 0, err
+	}
+
+	br, err := bloom.NewBodyReader(r, h.Flags)
+	if err != nil {
+		return 0, err
+	}
+
+	f, sparse := uint(h.K), h.Flags&bloom.FlagSparse != 0
+	if err := bloom.CheckBits(br, nb*BucketSize*f, sparse); err != nil {
+		return 0, err
+	}
+
+	words := make([]uint64, (nb*BucketSize*f+63)/64)
+	if _, err := bloom.ReadBits(br, words, nb*BucketSize*f, sparse); err != nil {
+		n, _ := br.Finish()
+		return n, err
+	}
+
+	n, err := br.Finish()
+	if err != nil {
+		return n, err
+	}
+
+	this.n, this.f, this.nb, this.c = uint(h.N), f, nb, h.C
+	this.words = words
+	this.rnd = 0x9e3779b97f4a7c15
+	this.setHasher(hf, h.Hasher)
+
+	return n, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the WriteTo encoding.
+func (this *CuckooFilter) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := this.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using the ReadFrom encoding. It
+// rejects truncated input, and input with trailing bytes after the table.
+func (this *CuckooFilter) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := this.ReadFrom(r); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("cuckoofilter: %d trailing bytes after table", r.Len())
+	}
+
+	return nil
+}
+
+// unsafeBytes returns the bytes of s without copying them. Hash functions don't modify or
+// retain the data written to them, so it is safe to hash the result.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
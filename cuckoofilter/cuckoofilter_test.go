@@ -0,0 +1,349 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cuckoofilter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestCuckooFilter(t *testing.T) {
+	for _, f := range []uint{8, 12, 16} {
+		fmt.Printf("\n\nTesting cuckoo filter with size %d, %d-bit fingerprints\n", len(web2), f)
+		bf, err := NewWithFingerprint(uint(len(web2)), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, w := range web2 {
+			if err := bf.AddString(w); err != nil {
+				t.Fatalf("%d bits: adding %q: %v", f, w, err)
+			}
+		}
+
+		fn, fp := 0, 0
+		for _, w := range web2 {
+			if !bf.CheckString(w) {
+				fn++
+			}
+		}
+
+		for _, w := range web2a {
+			if bf.CheckString(w) {
+				fp++
+			}
+		}
+
+		fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
+		fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+		fmt.Println(bf, "memory:", bf.MemoryUsage())
+
+		if fn > 0 {
+			t.Errorf("%d bits: %d false negatives", f, fn)
+		}
+
+		if rate := float64(fp) / float64(len(web2a)); rate > 2*bf.FalsePositiveRate() {
+			t.Errorf("%d bits: false positive rate %f, expected about %f", f, rate, bf.FalsePositiveRate())
+		}
+
+		if bf.Count() != uint64(len(web2)) {
+			t.Errorf("%d bits: Count = %d, expected %d", f, bf.Count(), len(web2))
+		}
+	}
+}
+
+func TestFingerprintBits(t *testing.T) {
+	for _, f := range []uint{0, 7, 17} {
+		if _, err := NewWithFingerprint(1000, f); err != ErrInvalidFingerprintBits {
+			t.Errorf("%d bits: expected ErrInvalidFingerprintBits, got %v", f, err)
+		}
+	}
+
+	if bf := New(1000); bf.FingerprintBits() != DefaultFingerprintBits || bf.Buckets() != 512 {
+		t.Errorf("Expected %d-bit fingerprints and 512 buckets, got %d and %d", DefaultFingerprintBits, bf.FingerprintBits(), bf.Buckets())
+	}
+}
+
+// TestFull fills a small filter until Add fails, which must leave all the items already
+// added in the filter.
+func TestFull(t *testing.T) {
+	bf := New(1000)
+
+	var added []string
+	for _, w := range web2 {
+		if err := bf.AddString(w); err != nil {
+			if err != ErrFull {
+				t.Fatal(err)
+			}
+			break
+		}
+		added = append(added, w)
+	}
+
+	fmt.Printf("Added %d items before the filter was full, load factor %.4f\n", len(added), bf.LoadFactor())
+	if bf.LoadFactor() < 0.9 || uint64(len(added)) != bf.Count() {
+		t.Errorf("Added %d items, count %d, load factor %f", len(added), bf.Count(), bf.LoadFactor())
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := bf.AddString(strconv.Itoa(i)); err != ErrFull && err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, w := range added {
+		if !bf.CheckString(w) {
+			t.Fatalf("Expected to find %q after the filter was full", w)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	bf := New(uint(len(web2)))
+	half := len(web2) / 2
+
+	for i := 0; i < 3; i++ {
+		for _, w := range web2 {
+			if err := bf.AddString(w); err != nil {
+				t.Fatalf("Cycle %d: adding %q: %v", i, w, err)
+			}
+		}
+
+		for _, w := range web2[:half] {
+			if !bf.DeleteString(w) {
+				t.Fatalf("Cycle %d: expected to delete %q", i, w)
+			}
+		}
+
+		for _, w := range web2[half:] {
+			if !bf.CheckString(w) {
+				t.Fatalf("Cycle %d: expected to find %q", i, w)
+			}
+		}
+
+		fp := 0
+		for _, w := range web2[:half] {
+			if bf.CheckString(w) {
+				fp++
+			}
+		}
+
+		fmt.Printf("Cycle %d: %d of %d deleted items found (%.4f%%)\n", i, fp, half, float32(fp)/float32(half)*100)
+		if rate := float64(fp) / float64(half); rate > 2*bf.FalsePositiveRate() {
+			t.Errorf("Cycle %d: %d deleted items found, rate %f", i, fp, rate)
+		}
+
+		for _, w := range web2[half:] {
+			if !bf.DeleteString(w) {
+				t.Fatalf("Cycle %d: expected to delete %q", i, w)
+			}
+		}
+
+		if bf.Count() != 0 {
+			t.Fatalf("Cycle %d: Count = %d, expected 0", i, bf.Count())
+		}
+	}
+
+	if bf.DeleteString("foo") {
+		t.Errorf("Expected not to delete foo from an empty filter")
+	}
+}
+
+// TestDeleteNotAdded shows the classic failure mode of cuckoo filters: deleting an item that
+// was never added, but is a false positive, removes the fingerprint of the item it collides
+// with.
+func TestDeleteNotAdded(t *testing.T) {
+	bf, err := NewWithFingerprint(100, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range web2[:100] {
+		if err := bf.AddString(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Find an item that wasn't added but is found, sharing its fingerprint and a bucket
+	// with an added item.
+	var ghost string
+	for _, w := range web2a {
+		if bf.CheckString(w) {
+			ghost = w
+			break
+		}
+	}
+
+	if ghost == "" {
+		t.Fatalf("Expected a false positive")
+	}
+
+	if !bf.DeleteString(ghost) {
+		t.Fatalf("Expected to delete %q, found by Check", ghost)
+	}
+
+	lost := 0
+	for _, w := range web2[:100] {
+		if !bf.CheckString(w) {
+			lost++
+		}
+	}
+
+	fmt.Printf("Deleting %q, never added, lost %d items\n", ghost, lost)
+	if lost != 1 || bf.Count() != 99 {
+		t.Errorf("Expected to lose 1 item, lost %d, count %d", lost, bf.Count())
+	}
+}
+
+func TestSerialization(t *testing.T) {
+	bf := New(uint(len(web2)))
+	if err := bf.SetNamedHasher("fnv64a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range web2[:10000] {
+		bf.AddString(w)
+	}
+
+	for _, opts := range []*bloom.WriteOptions{nil, {Compression: bloom.CompressionGzip}, {Encoding: bloom.EncodingSparse}} {
+		var buf bytes.Buffer
+		n, err := bf.Encode(&buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int64(buf.Len()) {
+			t.Errorf("Encode returned %d, wrote %d bytes", n, buf.Len())
+		}
+
+		data := buf.Bytes()
+		bf2 := &CuckooFilter{}
+		if err := bf2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if bf2.Count() != bf.Count() || bf2.Buckets() != bf.Buckets() || bf2.FingerprintBits() != bf.FingerprintBits() || bf2.HasherName() != "fnv64a" {
+			t.Errorf("Decoded %v, expected %v", bf2, bf)
+		}
+
+		for _, w := range web2[:10000] {
+			if !bf2.CheckString(w) {
+				t.Fatalf("Expected to find %q in the decoded filter", w)
+			}
+		}
+
+		if !bf2.DeleteString(web2[0]) || bf2.CheckString(web2[0]) && !bf.CheckString(web2[0]) {
+			t.Errorf("Expected to delete %q from the decoded filter", web2[0])
+		}
+
+		if _, err := bloom.Load(bytes.NewReader(data)); !errors.Is(err, bloom.ErrUnsupportedFormat) {
+			t.Errorf("Expected bloom.ErrUnsupportedFormat from bloom.Load, got %v", err)
+		}
+
+		if err := bf2.UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Errorf("Expected an error decoding truncated data")
+		}
+	}
+
+	// Headers claiming a table larger than the data, or than a uint, fail before allocating it
+	for _, h := range []bloom.Header{{M: 1 << 62, K: 12}, {M: 1 << 40, K: 12}, {M: 1 << 40, K: 12, Flags: bloom.FlagSparse}} {
+		h.Version, h.Kind = bloom.Version, bloom.KindCuckoo
+
+		var buf bytes.Buffer
+		h.WriteTo(&buf)
+		buf.Write(make([]byte, 200))
+
+		if err := (&CuckooFilter{}).UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("Expected an error decoding m = %d, k = %d", h.M, h.K)
+		}
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	bf := New(uint(b.N))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddString(web2[i%len(web2)] + strconv.Itoa(i))
+	}
+}
+
+func BenchmarkCheck(b *testing.B) {
+	bf := New(uint(len(web2)))
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.CheckString(web2a[i%len(web2a)])
+	}
+}
+
+func TestAllocs(t *testing.T) {
+	cf := New(1000)
+	allocs := testing.AllocsPerRun(1000, func() {
+		cf.AddString("hello")
+		cf.CheckString("world")
+		cf.DeleteString("hello")
+	})
+
+	if allocs != 0 {
+		t.Errorf("%f allocations per AddString, CheckString and DeleteString, expected 0", allocs)
+	}
+}
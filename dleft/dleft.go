@@ -0,0 +1,547 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dleft implements a d-left counting bloom filter, which supports removing items
+// like a counting filter in less space.
+package dleft
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+// ErrNotAdded is returned by Remove when the item isn't in the filter.
+var ErrNotAdded = errors.New("dleft: item was not added")
+
+const (
+	// D is the number of subtables, each giving an item one candidate bucket.
+	D = 4
+
+	// BucketSize is the number of cells of a bucket.
+	BucketSize = 8
+
+	// maxCount is the value a counter saturates at.
+	maxCount = math.MaxUint8
+)
+
+// multipliers are the odd multipliers of the permutations of the subtables.
+var multipliers = [D]uint64{0x9e3779b97f4a7c15, 0xc2b2ae3d27d4eb4f, 0x165667b19e3779f9, 0x27d4eb2f165667c5}
+
+// DLeftBloom is a d-left counting bloom filter. Each item is hashed to a fingerprint t in
+// [0, B * 2^r), B being the number of buckets of each of the D subtables. Subtable i
+// permutes t, and splits the result into a bucket and an r-bit remainder, which a cell
+// of the bucket stores with an 8-bit counter. An item is added to the cell holding its
+// remainder in one of its D buckets if there is one, incrementing its counter, and to an
+// empty cell of its least loaded bucket otherwise, the leftmost one on ties. Check looks
+// for the remainder in the D buckets, and Remove decrements the counter of the cell holding
+// it, emptying the cell at 0.
+//
+// Since the subtables permute t, two items sharing a cell have the same fingerprint, even
+// if the same remainder is found in other buckets for other fingerprints. With the cell
+// found before a new one is used, an item is in at most one cell, so Remove always
+// decrements the cell of the item, and never one of another item, unlike a counting
+// filter. Items are only confused if their fingerprints are the same, and then they count
+// as the same item.
+//
+// The table holds n / p cells, 3 bytes each, about 32 bits per item at the default load
+// of p = 0.75, where a counting filter with 4-bit counters takes 58 for e = 0.001. Check
+// compares the remainders of about D * BucketSize * p cells, so r is chosen for that many
+// to give a false positive probability of e, up to 16 bits.
+//
+// If all the buckets of an item are full, the item spills into a map outside of the table,
+// where it is found and removed as well. The number of items spilled is returned by
+// SpillCount and in Stats. A counter that reaches 255 saturates: it is no longer incremented
+// nor decremented, as its count is lost, and its item can't be removed.
+//
+// DLeftBloom is not safe for concurrent use, except for Check.
+type DLeftBloom struct {
+	// h is the hash function used to get the fingerprints
+	h hash.Hash
+
+	// hn is the name of the hash function, empty if it was set using SetHasher()
+	hn string
+
+	// hp holds the hashers used by Check, so it doesn't write to the filter.
+	hp *bloom.HasherPool
+
+	// n is the number of items the filter is built for, p the maximum load of the table and
+	// e the error probability.
+	n uint
+	p float64
+	e float64
+
+	// b is the number of buckets of each subtable, and r the number of bits of a remainder
+	b uint
+	r uint
+
+	// fps and counts hold the remainder and the counter of each cell, D * b * BucketSize of
+	// them, subtable by subtable. A cell is empty if its counter is 0.
+	fps    []uint16
+	counts []uint8
+
+	// offsets are the offsets of the permutations of the subtables, and mults their
+	// multipliers, coprime with b * 2^r
+	offsets, mults [D]uint64
+
+	// spill holds the count of each fingerprint that didn't fit in the table
+	spill map[uint64]uint64
+
+	// c is the number of items added, less those removed
+	c uint64
+}
+
+var (
+	_ bloom.Bloom        = (*DLeftBloom)(nil)
+	_ bloom.Introspector = (*DLeftBloom)(nil)
+)
+
+// New initializes a new d-left counting bloom filter for n items with a false positive
+// probability of e.
+func New(n uint, e float64) bloom.Bloom {
+	bf := &DLeftBloom{n: n, p: 0.75, e: e}
+	bf.setHasher(fnv.New64(), bloom.DefaultHasher)
+	bf.Reset()
+	return bf
+}
+
+// SetHasher sets the hash function. It returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *DLeftBloom) SetHasher(h hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.setHasher(h, "")
+	return nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. It returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *DLeftBloom) SetNamedHasher(name string) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.setHasher(h, name)
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *DLeftBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+func (this *DLeftBloom) setHasher(h hash.Hash, name string) {
+	this.h = h
+	this.hn = name
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+// Reset rebuilds the table for the current parameters, removing all the items.
+func (this *DLeftBloom) Reset() {
+	this.b = max(1, uint(math.Ceil(float64(this.n)/this.p/(D*BucketSize))))
+	this.r = min(16, max(4, uint(math.Ceil(math.Log2(D*BucketSize*this.p/this.e)))))
+	this.fps = make([]uint16, D*this.b*BucketSize)
+	this.counts = make([]uint8, D*this.b*BucketSize)
+	this.spill = nil
+	this.c = 0
+
+	// The permutations are affine maps modulo N = b * 2^r, with multipliers coprime with N
+	n := uint64(this.b) << this.r
+	for i, a := range multipliers {
+		a %= n
+		for a%2 == 0 || gcd(a, n) != 1 {
+			a = (a + 1) % n
+		}
+		this.mults[i] = a
+		this.offsets[i] = (a ^ uint64(i)*0x94d049bb133111eb) % n
+	}
+
+	this.h.Reset()
+}
+
+// Clear removes all the items from the filter, keeping the table, which is only zeroed.
+func (this *DLeftBloom) Clear() {
+	clear(this.counts)
+	this.spill = nil
+	this.c = 0
+}
+
+// SetErrorProbability sets the error probability e, and resets the filter to recompute the
+// size of the remainders from it. It returns bloom.ErrNotEmpty if items have been added.
+func (this *DLeftBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetFillRatio sets the maximum load p of the table, the fraction of its cells used by n
+// items, and resets the filter to resize it. It returns bloom.ErrNotEmpty if items have
+// been added.
+func (this *DLeftBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	this.Reset()
+	return nil
+}
+
+// K returns the number of subtables D, each holding one candidate bucket of an item.
+func (this *DLeftBloom) K() uint {
+	return D
+}
+
+// M returns the number of cells.
+func (this *DLeftBloom) M() uint {
+	return uint(len(this.counts))
+}
+
+// S returns the number of cells of a bucket, BucketSize.
+func (this *DLeftBloom) S() uint {
+	return BucketSize
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *DLeftBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns the parameters of the filter, M being the number of cells, K the number of
+// subtables, S the size of a bucket and P the maximum load of the table.
+func (this *DLeftBloom) Params() bloom.Params {
+	return bloom.Params{M: this.M(), K: D, S: BucketSize, N: this.n, P: this.p, E: this.e}
+}
+
+// RemainderBits returns the number of bits of the remainders stored in the cells.
+func (this *DLeftBloom) RemainderBits() uint {
+	return this.r
+}
+
+func (this *DLeftBloom) Add(item []byte) bloom.Bloom {
+	t := this.fingerprint(item)
+	this.c++
+
+	if i := this.find(t); i >= 0 {
+		if this.counts[i] < maxCount {
+			this.counts[i]++
+		}
+		return this
+	}
+
+	if this.spill[t] > 0 {
+		this.spill[t]++
+		return this
+	}
+
+	// The leftmost of the least loaded buckets
+	best, load := -1, BucketSize
+	for s := 0; s < D; s++ {
+		bucket, _ := this.locate(s, t)
+		if l := this.load(bucket); l < load {
+			best, load = s, l
+		}
+	}
+
+	if best < 0 {
+		if this.spill == nil {
+			this.spill = make(map[uint64]uint64)
+		}
+		this.spill[t]++
+		return this
+	}
+
+	bucket, rem := this.locate(best, t)
+	for i := bucket; i < bucket+BucketSize; i++ {
+		if this.counts[i] == 0 {
+			this.fps[i], this.counts[i] = rem, 1
+			break
+		}
+	}
+
+	return this
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *DLeftBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafeBytes(s))
+}
+
+// Remove removes an item added with Add, decrementing the counter of its cell. It returns
+// ErrNotAdded if the item isn't in the filter, leaving the filter unchanged. An item that
+// wasn't added is only removed if it has the fingerprint of an item that was, with a
+// probability of about e, and it is that item that is removed.
+func (this *DLeftBloom) Remove(item []byte) error {
+	t := this.fingerprint(item)
+
+	if i := this.find(t); i >= 0 {
+		if this.counts[i] < maxCount {
+			this.counts[i]--
+		}
+	} else if this.spill[t] > 0 {
+		if this.spill[t]--; this.spill[t] == 0 {
+			delete(this.spill, t)
+		}
+	} else {
+		return ErrNotAdded
+	}
+
+	if this.c > 0 {
+		this.c--
+	}
+	return nil
+}
+
+// RemoveString is the same as Remove([]byte(s)), without copying s.
+func (this *DLeftBloom) RemoveString(s string) error {
+	return this.Remove(unsafeBytes(s))
+}
+
+// Check returns true if item may have been added to the filter, and not removed since. It
+// doesn't write to the filter, so it is safe to call concurrently with other Checks.
+func (this *DLeftBloom) Check(item []byte) bool {
+	t := this.fingerprint(item)
+	return this.find(t) >= 0 || this.spill[t] > 0
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *DLeftBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// find returns the index of the cell holding the fingerprint t, or -1 if there is none.
+func (this *DLeftBloom) find(t uint64) int {
+	for s := 0; s < D; s++ {
+		bucket, rem := this.locate(s, t)
+		for i := bucket; i < bucket+BucketSize; i++ {
+			if this.counts[i] != 0 && this.fps[i] == rem {
+				return int(i)
+			}
+		}
+	}
+	return -1
+}
+
+// locate returns the index of the first cell of the bucket of t in subtable s, and the
+// remainder of t stored in the cell. The permutation of the subtable maps t to
+// (a * t + o) mod b * 2^r, whose quotient by 2^r is the bucket.
+func (this *DLeftBloom) locate(s int, t uint64) (uint, uint16) {
+	n := uint64(this.b) << this.r
+	hi, lo := bits.Mul64(this.mults[s], t)
+	v := bits.Rem64(hi, lo, n) + this.offsets[s]
+	if v >= n {
+		v -= n
+	}
+
+	bucket := uint(s)*this.b + uint(v>>this.r)
+	return bucket * BucketSize, uint16(v & (1<<this.r - 1))
+}
+
+// load returns the number of cells used in the bucket starting at cell i.
+func (this *DLeftBloom) load(i uint) int {
+	l := 0
+	for _, c := range this.counts[i : i+BucketSize] {
+		if c != 0 {
+			l++
+		}
+	}
+	return l
+}
+
+// fingerprint returns the fingerprint of item in [0, b * 2^r). The hash of item is mixed
+// with bloom.Mix64, and mapped to the range by multiplication.
+func (this *DLeftBloom) fingerprint(item []byte) uint64 {
+	s := this.hp.Get()
+	s.H.Reset()
+	s.H.Write(item)
+	h := bloom.Mix64(bloom.Sum64(s.H, s.Sum[:]))
+	this.hp.Put(s)
+
+	t, _ := bits.Mul64(h, uint64(this.b)<<this.r)
+	return t
+}
+
+// Count returns the number of items added, less those removed.
+func (this *DLeftBloom) Count() uint64 {
+	return this.c
+}
+
+// SaturationCount returns the number of cells whose counter reached 255, and is no longer
+// incremented nor decremented.
+func (this *DLeftBloom) SaturationCount() uint {
+	var x uint
+	for _, v := range this.counts {
+		if v == maxCount {
+			x++
+		}
+	}
+	return x
+}
+
+// SpillCount returns the number of distinct fingerprints stored outside of the table, as
+// all their buckets were full.
+func (this *DLeftBloom) SpillCount() uint {
+	return uint(len(this.spill))
+}
+
+// used returns the number of cells used.
+func (this *DLeftBloom) used() uint {
+	var x uint
+	for _, v := range this.counts {
+		if v != 0 {
+			x++
+		}
+	}
+	return x
+}
+
+// FillRatio returns the fraction of cells used.
+func (this *DLeftBloom) FillRatio() float64 {
+	return float64(this.used()) / float64(len(this.counts))
+}
+
+// EstimatedFillRatio returns the fraction of cells used if every item added is distinct and
+// fits in the table.
+func (this *DLeftBloom) EstimatedFillRatio() float64 {
+	return math.Min(1, float64(this.c)/float64(len(this.counts)))
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the cells used: Check compares its remainder with the cells used in D buckets, on
+// average used / b of them, each matching with a probability of 1 / 2^r. A spilled
+// fingerprint matches with a probability of 1 / (b * 2^r).
+func (this *DLeftBloom) CurrentFalsePositiveRate() float64 {
+	cells := float64(this.used()) / float64(this.b)
+	return 1 - math.Pow(1-math.Ldexp(1, -int(this.r)), cells)*math.Pow(1-1/float64(uint64(this.b)<<this.r), float64(len(this.spill)))
+}
+
+// ApproximateCardinality returns the number of distinct fingerprints in the filter, the
+// cells used and the fingerprints spilled. Unlike Count, an item added more than once is
+// only counted once, as are items with the same fingerprint.
+func (this *DLeftBloom) ApproximateCardinality() uint64 {
+	return uint64(this.used()) + uint64(len(this.spill))
+}
+
+// Clone returns a deep copy of the filter, with a new hasher of the same kind. It returns
+// an error if the hasher can't be recreated, see bloom.CloneHasher.
+func (this *DLeftBloom) Clone() (bloom.Bloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := *this
+	bf.setHasher(h, this.hn)
+	bf.fps = append([]uint16(nil), this.fps...)
+	bf.counts = append([]uint8(nil), this.counts...)
+	if this.spill != nil {
+		bf.spill = make(map[uint64]uint64, len(this.spill))
+		for t, c := range this.spill {
+			bf.spill[t] = c
+		}
+	}
+
+	return &bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter: the cells, the spilled
+// fingerprints, about 16 bytes each, and the filter itself.
+func (this *DLeftBloom) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + 2*uint64(cap(this.fps)) + uint64(cap(this.counts)) + 16*uint64(len(this.spill))
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *DLeftBloom) String() string {
+	return fmt.Sprintf("dleft{n=%d buckets=%dx%d r=%d e=%g count=%d spilled=%d}", this.n, D, this.b, this.r, this.e, this.c, len(this.spill))
+}
+
+// Stats returns the statistics of the filter. BitsSet is the number of cells used,
+// Saturated the SaturationCount and Spilled the SpillCount.
+func (this *DLeftBloom) Stats() bloom.Stats {
+	x := this.used()
+
+	return bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.c,
+		BitsSet:            x,
+		FillRatio:          float64(x) / float64(len(this.counts)),
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		FalsePositiveRate:  this.CurrentFalsePositiveRate(),
+		Saturated:          this.SaturationCount(),
+		Spilled:            this.SpillCount(),
+	}
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *DLeftBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *DLeftBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func gcd(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// unsafeBytes returns the bytes of s without copying them. Hash functions don't modify or
+// retain the data written to them, so it is safe to hash the result.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
@@ -0,0 +1,349 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dleft
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/counting"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	for _, e := range []float64{0.01, 0.001} {
+		fmt.Printf("\n\nTesting d-left filter with e = %g\n", e)
+		bf := New(uint(len(web2)), e).(*DLeftBloom)
+
+		fn, fp := 0, 0
+		for _, w := range web2 {
+			if !bf.AddString(w).(*DLeftBloom).CheckString(w) {
+				fn++
+			}
+		}
+
+		for _, w := range web2a {
+			if bf.CheckString(w) {
+				fp++
+			}
+		}
+
+		rate := float64(fp) / float64(len(web2a))
+		fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, float64(fn)/float64(len(web2))*100)
+		fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, rate*100)
+		bf.PrintStats()
+
+		if fn > 0 {
+			t.Errorf("%d false negatives", fn)
+		}
+
+		if rate > e {
+			t.Errorf("False positive rate %.4f%%, expected at most %g%%", rate*100, e*100)
+		}
+
+		if bf.SpillCount() > 0 {
+			t.Errorf("%d items spilled at a load of %.2f", bf.SpillCount(), bf.FillRatio())
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	bf := New(uint(len(web2)), 0.001).(*DLeftBloom)
+	half := len(web2) / 2
+
+	for i := 0; i < 3; i++ {
+		for _, w := range web2 {
+			bf.AddString(w)
+		}
+
+		for _, w := range web2[:half] {
+			if err := bf.RemoveString(w); err != nil {
+				t.Fatalf("Removing %q: %v", w, err)
+			}
+		}
+
+		if bf.Count() != uint64(len(web2)-half) {
+			t.Fatalf("Count = %d, expected %d", bf.Count(), len(web2)-half)
+		}
+
+		for _, w := range web2[half:] {
+			if !bf.CheckString(w) {
+				t.Fatalf("Expected to find %q", w)
+			}
+		}
+
+		for _, w := range web2[half:] {
+			if err := bf.RemoveString(w); err != nil {
+				t.Fatalf("Removing %q: %v", w, err)
+			}
+		}
+
+		if x := bf.ApproximateCardinality(); x != 0 || bf.Count() != 0 {
+			t.Fatalf("%d fingerprints and %d items left after removing all the items", x, bf.Count())
+		}
+	}
+
+	if err := bf.RemoveString("not added"); err != ErrNotAdded {
+		t.Errorf("Removing an item not added returned %v, expected ErrNotAdded", err)
+	}
+}
+
+// With 5-bit remainders, most remainders are found in many buckets for different items.
+// Removing one set of items must leave the other set whole.
+func TestDuplicateRemainders(t *testing.T) {
+	bf := New(uint(len(web2)), 0.9).(*DLeftBloom)
+	if bf.RemainderBits() != 5 {
+		t.Fatalf("RemainderBits = %d, expected 5", bf.RemainderBits())
+	}
+
+	a, b := web2[:len(web2)/2], web2[len(web2)/2:]
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	for _, w := range a {
+		if err := bf.RemoveString(w); err != nil {
+			// A word of b with the same fingerprint was removed instead, which happens
+			// with a probability of about 1 / (b * 2^r) for each pair of words
+			if bf.CheckString(w) {
+				t.Fatalf("Removing %q: %v", w, err)
+			}
+		}
+	}
+
+	for _, w := range b {
+		if !bf.CheckString(w) {
+			t.Fatalf("Expected to find %q", w)
+		}
+	}
+
+	for _, w := range b {
+		bf.RemoveString(w)
+	}
+
+	if x := bf.ApproximateCardinality(); x != 0 {
+		t.Errorf("%d fingerprints left after removing all the items", x)
+	}
+}
+
+// Two items with the same fingerprint share a cell, counted twice, while items whose
+// fingerprints only have the same remainder in some subtable use different cells.
+func TestSameFingerprint(t *testing.T) {
+	bf := New(100, 0.5).(*DLeftBloom)
+
+	seen := make(map[uint64]string)
+	var x, y string
+	for i := 0; x == ""; i++ {
+		w := fmt.Sprintf("item%d", i)
+		fp := bf.fingerprint([]byte(w))
+		if v, ok := seen[fp]; ok {
+			x, y = v, w
+		}
+		seen[fp] = w
+	}
+
+	bf.AddString(x)
+	bf.AddString(y)
+	if n := bf.ApproximateCardinality(); n != 1 {
+		t.Fatalf("ApproximateCardinality = %d, expected 1", n)
+	}
+
+	i := bf.find(bf.fingerprint([]byte(x)))
+	if bf.counts[i] != 2 {
+		t.Fatalf("Counter = %d, expected 2", bf.counts[i])
+	}
+
+	if err := bf.RemoveString(x); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bf.CheckString(y) {
+		t.Fatalf("Expected to find %q after removing %q with the same fingerprint", y, x)
+	}
+
+	if err := bf.RemoveString(y); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf.CheckString(x) || bf.CheckString(y) {
+		t.Fatalf("Found %q or %q after removing both", x, y)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	bf := New(100, 0.01).(*DLeftBloom)
+
+	for _, w := range web2[:2000] {
+		bf.AddString(w)
+	}
+
+	spilled := bf.SpillCount()
+	if spilled == 0 {
+		t.Fatalf("No item spilled with %d cells for 2000 items", bf.M())
+	}
+
+	if s := bf.Stats(); s.Spilled != spilled {
+		t.Errorf("Stats().Spilled = %d, expected %d", s.Spilled, spilled)
+	}
+
+	for _, w := range web2[:2000] {
+		if !bf.CheckString(w) {
+			t.Fatalf("Expected to find %q", w)
+		}
+	}
+
+	for _, w := range web2[:2000] {
+		if err := bf.RemoveString(w); err != nil && bf.CheckString(w) {
+			t.Fatalf("Removing %q: %v", w, err)
+		}
+	}
+
+	if bf.SpillCount() != 0 || bf.ApproximateCardinality() != 0 {
+		t.Errorf("%d spilled and %d fingerprints left after removing all the items", bf.SpillCount(), bf.ApproximateCardinality())
+	}
+}
+
+func TestSaturation(t *testing.T) {
+	bf := New(1000, 0.01).(*DLeftBloom)
+
+	for i := 0; i < 300; i++ {
+		bf.AddString("hello")
+	}
+
+	if bf.SaturationCount() != 1 || bf.Stats().Saturated != 1 {
+		t.Fatalf("SaturationCount = %d, expected 1", bf.SaturationCount())
+	}
+
+	// A saturated counter is never decremented, so the item stays
+	for i := 0; i < 300; i++ {
+		if err := bf.RemoveString("hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bf.CheckString("hello") {
+		t.Error("Expected to find a saturated item")
+	}
+}
+
+func TestSetters(t *testing.T) {
+	bf := New(1000, 0.01)
+	if err := bf.SetErrorProbability(0.001); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := bf.(*DLeftBloom).RemainderBits(); r != 15 {
+		t.Errorf("RemainderBits = %d, expected 15", r)
+	}
+
+	bf.Add([]byte("hello"))
+	if err := bf.SetFillRatio(0.5); err != bloom.ErrNotEmpty {
+		t.Errorf("SetFillRatio returned %v, expected ErrNotEmpty", err)
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf.(*DLeftBloom).RemoveString("hello")
+	if !c.Check([]byte("hello")) || bf.Check([]byte("hello")) {
+		t.Error("Clone shares its table with the filter")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	n := uint(len(web2))
+	for _, e := range []float64{0.01, 0.001} {
+		dl := New(n, e)
+		cb := counting.NewPacked(n)
+		cb.SetErrorProbability(e)
+
+		for _, w := range web2 {
+			dl.Add([]byte(w))
+			cb.Add([]byte(w))
+		}
+
+		dbits := float64(dl.MemoryUsage()*8) / float64(n)
+		cbits := float64(cb.MemoryUsage()*8) / float64(n)
+		fmt.Printf("e = %g: d-left %.1f bits/item (fp rate %.5f), counting %.1f bits/item (fp rate %.5f)\n",
+			e, dbits, dl.CurrentFalsePositiveRate(), cbits, cb.CurrentFalsePositiveRate())
+
+		if dbits >= cbits {
+			t.Errorf("d-left filter uses %.1f bits per item, more than %.1f for a counting filter", dbits, cbits)
+		}
+	}
+}
+
+func BenchmarkAddRemove(b *testing.B) {
+	bf := New(uint(len(web2)), 0.001).(*DLeftBloom)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := web2[i%len(web2)]
+		bf.AddString(w)
+		bf.RemoveString(w)
+	}
+}
+
+func BenchmarkCheck(b *testing.B) {
+	bf := New(uint(len(web2)), 0.001).(*DLeftBloom)
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bf.CheckString(web2[i%len(web2)])
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// TrailerMagic ends every file written by SaveToFile, preceded by the CRC32 (IEEE)
+// checksum of everything before it.
+const TrailerMagic = "BLMC"
+
+// ErrCorrupt is returned by LoadFromFile when the file is truncated or its checksum
+// doesn't match its contents. Errors opening or reading the file are returned as is,
+// so callers can tell a missing file (os.ErrNotExist) apart from a damaged one.
+var ErrCorrupt = errors.New("bloom: corrupt file")
+
+// SaveToFile writes bf to the file at path. bf must implement io.WriterTo, which all the
+// filters in this package do. The filter is written to a temporary file in the same
+// directory, followed by a checksum trailer, synced to disk and then renamed into place,
+// so path holds either the previous contents or the complete new filter, never a partial
+// one.
+func SaveToFile(bf Bloom, path string) (err error) {
+	wt, ok := bf.(io.WriterTo)
+	if !ok {
+		return fmt.Errorf("bloom: cannot save filter of type %T", bf)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(f)
+
+	if _, err = wt.WriteTo(io.MultiWriter(bw, crc)); err != nil {
+		return err
+	}
+
+	var trailer [8]byte
+	binary.BigEndian.PutUint32(trailer[0:4], crc.Sum32())
+	copy(trailer[4:], TrailerMagic)
+
+	if _, err = bw.Write(trailer[:]); err != nil {
+		return err
+	}
+
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename itself is durable. Not all platforms support
+	// this, so errors are ignored.
+	if d, derr := os.Open(filepath.Dir(path)); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// LoadFromFile reads a filter written by SaveToFile. It returns an error wrapping
+// ErrCorrupt if the file is truncated or fails the checksum, and the error from the
+// os package if the file cannot be read, e.g. one matching os.ErrNotExist.
+func LoadFromFile(path string) (Bloom, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := verifyTrailer(data)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(body)
+	bf, err := Load(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes after filter", ErrCorrupt, r.Len())
+	}
+
+	return bf, nil
+}
+
+// verifyTrailer checks the trailer written by SaveToFile and returns the data preceding it.
+func verifyTrailer(data []byte) ([]byte, error) {
+	if len(data) < 8 || string(data[len(data)-4:]) != TrailerMagic {
+		return nil, fmt.Errorf("%w: missing trailer, file may be truncated", ErrCorrupt)
+	}
+
+	body := data[:len(data)-8]
+	sum := binary.BigEndian.Uint32(data[len(data)-8:])
+
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+
+	return body, nil
+}
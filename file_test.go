@@ -0,0 +1,89 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/scalable"
+	"github.com/zhenjl/bloom/standard"
+)
+
+func TestSaveLoadFile(t *testing.T) {
+	dir := t.TempDir()
+
+	for i, bf := range []bloom.Bloom{standard.New(10000), scalable.New(1000)} {
+		for j := 0; j < 5000; j++ {
+			bf.Add([]byte(fmt.Sprintf("key-%d", j)))
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("filter-%d", i))
+		if err := bloom.SaveToFile(bf, path); err != nil {
+			t.Fatal(err)
+		}
+
+		bf2, err := bloom.LoadFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bf2.Count() != bf.Count() {
+			t.Errorf("%T: expected count %d, got %d", bf, bf.Count(), bf2.Count())
+		}
+
+		for j := 0; j < 5000; j++ {
+			if !bf2.Check([]byte(fmt.Sprintf("key-%d", j))) {
+				t.Fatalf("%T: false negative for key-%d after LoadFromFile", bf, j)
+			}
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Truncated file
+		if err := os.WriteFile(path, data[:len(data)-100], 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bloom.LoadFromFile(path); !errors.Is(err, bloom.ErrCorrupt) {
+			t.Errorf("%T: expected ErrCorrupt for truncated file, got %v", bf, err)
+		}
+
+		// Single bit flip in the bit array
+		data[len(data)/2] ^= 0x10
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := bloom.LoadFromFile(path); !errors.Is(err, bloom.ErrCorrupt) {
+			t.Errorf("%T: expected ErrCorrupt for flipped bit, got %v", bf, err)
+		}
+	}
+
+	if _, err := bloom.LoadFromFile(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist for missing file, got %v", err)
+	}
+
+	if m, _ := filepath.Glob(filepath.Join(dir, "*.tmp*")); len(m) != 0 {
+		t.Errorf("Expected no temporary files left behind, found %v", m)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// Kind identifies the filter implementation that produced a serialized filter.
+type Kind uint8
+
+const (
+	KindStandard    Kind = 1
+	KindPartitioned Kind = 2
+	KindScalable    Kind = 3
+	KindSharded     Kind = 4
+	KindCuckoo      Kind = 5
+	KindBlocked     Kind = 6
+	KindGCS         Kind = 7
+	KindCMS         Kind = 8
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindStandard:
+		return "standard"
+	case KindPartitioned:
+		return "partitioned"
+	case KindScalable:
+		return "scalable"
+	case KindSharded:
+		return "sharded"
+	case KindCuckoo:
+		return "cuckoo"
+	case KindBlocked:
+		return "blocked"
+	case KindGCS:
+		return "gcs"
+	case KindCMS:
+		return "cms"
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+const (
+	// Magic is written at the start of every serialized filter.
+	Magic = "BLMF"
+
+	// Version is the current version of the serialization format.
+	Version = 1
+
+	// DefaultHasher is the name of the hasher used when none is set, hash/fnv.New64().
+	DefaultHasher = "fnv64"
+)
+
+// Flags recorded in the header.
+const (
+	// FlagSparse marks a filter whose bit arrays are written with EncodingSparse.
+	FlagSparse uint16 = 1 << iota
+
+	// FlagGzip marks a filter whose body, following the header, is gzip compressed.
+	FlagGzip
+
+	// FlagWideDigest marks a filter whose positions are derived from the whole digest of a
+	// hasher wider than 8 bytes, rather than from its first 8 bytes, see DigestPositions.
+	FlagWideDigest
+
+	// FlagSum128 marks a filter whose positions are derived from the two 64-bit halves of
+	// the digest of a Hash128 hasher, see DigestPositions.
+	FlagSum128
+
+	// FlagWideIndex marks a filter of more than 2^32 bits whose positions are derived from
+	// 64-bit values rather than 32-bit ones, see DigestPositions.
+	FlagWideIndex
+
+	// FlagFastRange marks a filter whose positions are mapped to its bits by multiply-shift
+	// rather than modulo, see DigestPositions.
+	FlagFastRange
+
+	// FlagEnhanced marks a filter whose positions are derived by enhanced double hashing,
+	// see DigestPositions.
+	FlagEnhanced
+
+	// FlagPrimePartitions marks a partitioned filter whose partitions are sized to distinct
+	// primes, with the positions taken modulo the size of each partition rather than derived
+	// by DigestPositions.
+	FlagPrimePartitions
+
+	// FlagScalableGrowth marks a scalable filter whose body records its growth factor,
+	// growth policy and deduplication setting after its tightening ratio and number of
+	// layers.
+	FlagScalableGrowth
+
+	// FlagPowerOfTwo marks a standard or partitioned filter whose bits, or the bits of each
+	// of its partitions, are rounded up to a power of two, see WithPowerOfTwoSize.
+	FlagPowerOfTwo
+
+	// FlagPinnedHashCount marks a standard or partitioned filter whose number of hash
+	// functions was set with SetHashCount rather than derived from its error probability.
+	FlagPinnedHashCount
+)
+
+// DigestFlags holds the flags selecting how DigestPositions derives positions from a
+// digest. New filters derive them with all of these, and record the ones that apply to
+// their hasher and size, see DigestFlagsOf.
+const DigestFlags = FlagWideDigest | FlagSum128 | FlagWideIndex | FlagFastRange | FlagEnhanced
+
+// knownFlags holds all the flags this version can read.
+const knownFlags = FlagSparse | FlagGzip | DigestFlags | FlagPrimePartitions | FlagScalableGrowth |
+	FlagPowerOfTwo | FlagPinnedHashCount
+
+// ErrUnsupportedFormat is returned when reading a serialized filter with a bad magic,
+// an unknown version or a kind with no registered decoder.
+var ErrUnsupportedFormat = errors.New("bloom: unsupported format")
+
+// Header is written at the start of every serialized filter, regardless of its kind.
+// The parameter block holds the values the filter was built with. Parameters that
+// don't apply to a kind, such as S for the standard filter, are written as 0.
+//
+// The encoded layout, in big endian order, is:
+//
+//	magic   [4]byte
+//	version uint8
+//	kind    uint8
+//	flags   uint16
+//	hasher  uint8 length followed by the name
+//	padding zero bytes up to the next multiple of 8
+//	m, k, s, n, c uint64
+//	p, e    float64
+//
+// The header length is always a multiple of 8 bytes, so the body following it starts on
+// a word boundary if the header does. The hasher name holds the parameters of the hashers
+// of a family, such as a seed or a key, see RegisterHasherFamily.
+type Header struct {
+	Version uint8
+	Kind    Kind
+	Flags   uint16
+	Hasher  string
+
+	M, K, S, N, C uint64
+	P, E          float64
+}
+
+// WriteTo implements io.WriterTo.
+func (this *Header) WriteTo(w io.Writer) (int64, error) {
+	if len(this.Hasher) > math.MaxUint8 {
+		return 0, fmt.Errorf("bloom: hasher name %q is too long", this.Hasher)
+	}
+
+	buf := make([]byte, 0, headerLen(len(this.Hasher)))
+	buf = append(buf, Magic...)
+	buf = append(buf, this.Version, byte(this.Kind))
+	buf = binary.BigEndian.AppendUint16(buf, this.Flags)
+	buf = append(buf, byte(len(this.Hasher)))
+	buf = append(buf, this.Hasher...)
+	buf = buf[:headerLen(len(this.Hasher))-56]
+
+	for _, v := range []uint64{this.M, this.K, this.S, this.N, this.C, math.Float64bits(this.P), math.Float64bits(this.E)} {
+		buf = binary.BigEndian.AppendUint64(buf, v)
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadFrom implements io.ReaderFrom. It returns ErrUnsupportedFormat if the magic or
+// the version don't match, or if unknown flags are set.
+func (this *Header) ReadFrom(r io.Reader) (int64, error) {
+	var pre [9]byte
+	n, err := io.ReadFull(r, pre[:])
+	total := int64(n)
+	if err != nil {
+		return total, fmt.Errorf("bloom: reading header: %w", err)
+	}
+
+	if string(pre[:4]) != Magic {
+		return total, fmt.Errorf("%w: bad magic %q", ErrUnsupportedFormat, pre[:4])
+	}
+
+	if pre[4] != Version {
+		return total, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, pre[4])
+	}
+
+	rest := make([]byte, headerLen(int(pre[8]))-len(pre))
+	n, err = io.ReadFull(r, rest)
+	total += int64(n)
+	if err != nil {
+		return total, fmt.Errorf("bloom: reading header: %w", err)
+	}
+
+	this.Version = pre[4]
+	this.Kind = Kind(pre[5])
+	this.Flags = binary.BigEndian.Uint16(pre[6:8])
+
+	if this.Flags&^knownFlags != 0 {
+		return total, fmt.Errorf("%w: flags %#x", ErrUnsupportedFormat, this.Flags)
+	}
+	this.Hasher = string(rest[:pre[8]])
+
+	p := rest[len(rest)-56:]
+	this.M = binary.BigEndian.Uint64(p[0:8])
+	this.K = binary.BigEndian.Uint64(p[8:16])
+	this.S = binary.BigEndian.Uint64(p[16:24])
+	this.N = binary.BigEndian.Uint64(p[24:32])
+	this.C = binary.BigEndian.Uint64(p[32:40])
+	this.P = math.Float64frombits(binary.BigEndian.Uint64(p[40:48]))
+	this.E = math.Float64frombits(binary.BigEndian.Uint64(p[48:56]))
+
+	return total, nil
+}
+
+// headerLen returns the encoded length of a header with a hasher name of l bytes.
+func headerLen(l int) int {
+	return (9+l+7)/8*8 + 56
+}
+
+// Decoder reads the body of a serialized filter whose header has already been read.
+type Decoder func(h *Header, r io.Reader) (Bloom, error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = make(map[Kind]Decoder)
+)
+
+// RegisterDecoder makes a decoder available to Load for the given kind. It is called by
+// the filter implementations from their init functions, so a program that uses Load must
+// import the implementations it expects to read, e.g.
+//
+//	import _ "github.com/zhenjl/bloom/standard"
+func RegisterDecoder(kind Kind, dec Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[kind] = dec
+}
+
+// Load reads a serialized filter of any registered kind from r. It inspects the header
+// and dispatches to the decoder of the implementation that produced the filter.
+func Load(r io.Reader) (Bloom, error) {
+	h := &Header{}
+	if _, err := h.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	return Decode(h, r)
+}
+
+// Decode reads the body of a serialized filter whose header h has already been read
+// from r, dispatching to the decoder registered for h.Kind.
+func Decode(h *Header, r io.Reader) (Bloom, error) {
+	decodersMu.RLock()
+	dec, ok := decoders[h.Kind]
+	decodersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedFormat, h.Kind)
+	}
+
+	return dec(h, r)
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHeader(t *testing.T) {
+	h := &Header{
+		Version: Version,
+		Kind:    KindPartitioned,
+		Flags:   FlagSparse,
+		Hasher:  DefaultHasher,
+		M:       1000,
+		K:       10,
+		S:       100,
+		N:       70,
+		C:       12,
+		P:       0.5,
+		E:       0.001,
+	}
+
+	var buf bytes.Buffer
+	n, err := h.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	h2 := &Header{}
+	if _, err := h2.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if *h2 != *h {
+		t.Errorf("Expected %+v, got %+v", *h, *h2)
+	}
+}
+
+func TestLoadUnsupported(t *testing.T) {
+	var buf bytes.Buffer
+	(&Header{Version: Version, Kind: Kind(200)}).WriteTo(&buf)
+	data := buf.Bytes()
+
+	if _, err := Load(bytes.NewReader(data)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat for unknown kind, got %v", err)
+	}
+
+	data[4] = Version + 1
+	if _, err := Load(bytes.NewReader(data)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat for unknown version, got %v", err)
+	}
+
+	if _, err := Load(bytes.NewReader([]byte("not a bloom filter"))); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat for bad magic, got %v", err)
+	}
+}
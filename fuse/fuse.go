@@ -0,0 +1,440 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fuse implements binary fuse filters, static filters smaller and faster to query
+// than bloom filters, built once from a set of keys.
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+// MaxIterations is the number of seeds tried before construction gives up. A seed fails
+// with a small probability, higher for small sets, so they are practically never exhausted.
+const MaxIterations = 100
+
+var (
+	// ErrTooManyKeys is returned when building a filter from more than math.MaxUint32 keys.
+	ErrTooManyKeys = errors.New("fuse: too many keys")
+
+	// ErrConstruction is returned when no seed of MaxIterations builds the filter.
+	ErrConstruction = errors.New("fuse: construction failed")
+)
+
+// Fingerprint is the type of the fingerprints stored in a filter. A filter of b-bit
+// fingerprints has a false positive probability of 1 / 2^b.
+type Fingerprint interface {
+	~uint8 | ~uint16
+}
+
+// BinaryFuse is a 3-wise binary fuse filter. Each key is hashed to 3 slots in consecutive
+// segments of the fingerprint array, whose XOR is the fingerprint of the key. Contains reads
+// the 3 slots, so it costs at most 3 cache misses, and the array holds about 1.13 slots per
+// key for large sets, about 9 bits per key for 8-bit fingerprints where a bloom filter
+// with the same false positive probability takes 11.5.
+//
+// Reference: Graf and Lemire, Binary Fuse Filters: Fast and Smaller Than Xor Filters,
+// ACM Journal of Experimental Algorithmics, 2022.
+//
+// A filter can't be changed once built. It is safe for concurrent use.
+type BinaryFuse[T Fingerprint] struct {
+	// seed is mixed into the hash of every key, and changed when construction fails
+	seed uint64
+
+	// segmentLength is the number of slots of a segment, a power of 2, and
+	// segmentCountLength the number of slots the first slot of a key is picked from
+	segmentLength      uint32
+	segmentLengthMask  uint32
+	segmentCount       uint32
+	segmentCountLength uint32
+
+	// fingerprints holds the slots
+	fingerprints []T
+
+	// n is the number of distinct keys
+	n uint32
+}
+
+// BuildBinaryFuse8 builds a filter of keys with 8-bit fingerprints, for a false positive
+// probability of 1/256. Duplicate keys are ignored. It returns ErrTooManyKeys for more than
+// math.MaxUint32 keys, and ErrConstruction if no seed succeeds.
+func BuildBinaryFuse8(keys []uint64) (*BinaryFuse[uint8], error) {
+	return build[uint8](keys)
+}
+
+// BuildBinaryFuse16 builds a filter of keys with 16-bit fingerprints, for a false positive
+// probability of 1/65536. Like BuildBinaryFuse8, duplicate keys are ignored.
+func BuildBinaryFuse16(keys []uint64) (*BinaryFuse[uint16], error) {
+	return build[uint16](keys)
+}
+
+func build[T Fingerprint](keys []uint64) (*BinaryFuse[T], error) {
+	if uint64(len(keys)) > math.MaxUint32 {
+		return nil, ErrTooManyKeys
+	}
+
+	this := &BinaryFuse[T]{}
+	this.init(uint32(len(keys)))
+	if err := this.populate(keys, false); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// init sizes the filter for size keys. The segment length and the number of slots per key
+// are those chosen by the paper for 3-wise filters.
+func (this *BinaryFuse[T]) init(size uint32) {
+	length, factor := 4, 0.0
+	if size > 1 {
+		length = 1 << int(math.Floor(math.Log(float64(size))/math.Log(3.33)+2.25))
+		factor = math.Max(1.125, 0.875+0.25*math.Log(1000000)/math.Log(float64(size)))
+	}
+	length = min(length, 1<<18)
+
+	capacity := int(math.Round(float64(size) * factor))
+	count := max((capacity+length-1)/length-2, 1)
+
+	this.segmentLength = uint32(length)
+	this.segmentLengthMask = uint32(length - 1)
+	this.segmentCount = uint32(count)
+	this.segmentCountLength = uint32(count * length)
+	this.fingerprints = make([]T, (count+2)*length)
+}
+
+// populate fills the fingerprints so that the 3 slots of each key XOR to its fingerprint.
+// The keys are sorted by segment, roughly, and each slot counts the keys hashed to it and
+// XORs their hashes, so that the slots of a single key, which give away that key, can be
+// peeled off one after the other. If some keys remain, the seed is changed and it starts
+// over.
+//
+// A key hashed twice leaves a slot with 2 keys and a XOR of 0 if no other key shares it,
+// and the second copy is dropped. Duplicates sharing all their slots aren't detected, and
+// can never be peeled, so once a seed fails, the duplicate keys are removed, unless unique
+// is set as they were removed already, and the filter is resized for the remaining keys.
+func (this *BinaryFuse[T]) populate(keys []uint64, unique bool) error {
+	var (
+		size     = len(keys)
+		capacity = len(this.fingerprints)
+		rng      = uint64(1)
+
+		alone    = make([]uint32, capacity)
+		t2count  = make([]uint8, capacity)
+		t2hash   = make([]uint64, capacity)
+		reverseH = make([]uint8, size)
+
+		// reverseOrder holds the hashes by segment, then the order they were peeled in. The
+		// last one is a sentinel ending the search for a free entry.
+		reverseOrder = make([]uint64, size+1)
+
+		h012 [5]uint32
+	)
+
+	reverseOrder[size] = 1
+
+	blockBits := 1
+	for 1<<blockBits < this.segmentCount {
+		blockBits++
+	}
+	startPos := make([]uint, 1<<blockBits)
+
+	stacksize := 0
+	for iterations := 1; ; iterations++ {
+		if iterations > MaxIterations {
+			return ErrConstruction
+		}
+
+		this.seed = splitmix64(&rng)
+
+		for i := range startPos {
+			startPos[i] = uint((uint64(i) * uint64(size)) >> blockBits)
+		}
+
+		mask := uint64(1)<<blockBits - 1
+		for _, key := range keys {
+			hash := mixsplit(key, this.seed)
+			segment := hash >> (64 - blockBits)
+			for reverseOrder[startPos[segment]] != 0 {
+				segment = (segment + 1) & mask
+			}
+			reverseOrder[startPos[segment]] = hash
+			startPos[segment]++
+		}
+
+		overflow, duplicates := false, 0
+		for _, hash := range reverseOrder[:size] {
+			i0, i1, i2 := this.slots(hash)
+			t2count[i0] += 4
+			t2hash[i0] ^= hash
+			t2count[i1] += 4
+			t2count[i1] ^= 1
+			t2hash[i1] ^= hash
+			t2count[i2] += 4
+			t2count[i2] ^= 2
+			t2hash[i2] ^= hash
+
+			// The second copy of a hash leaves a slot with 2 keys and no hash
+			if t2hash[i0]&t2hash[i1]&t2hash[i2] == 0 {
+				if (t2hash[i0] == 0 && t2count[i0] == 8) || (t2hash[i1] == 0 && t2count[i1] == 8) || (t2hash[i2] == 0 && t2count[i2] == 8) {
+					duplicates++
+					t2count[i0] -= 4
+					t2hash[i0] ^= hash
+					t2count[i1] -= 4
+					t2count[i1] ^= 1
+					t2hash[i1] ^= hash
+					t2count[i2] -= 4
+					t2count[i2] ^= 2
+					t2hash[i2] ^= hash
+				}
+			}
+
+			// The count of keys of a slot wrapped around
+			if t2count[i0] < 4 || t2count[i1] < 4 || t2count[i2] < 4 {
+				overflow = true
+			}
+		}
+
+		if !overflow {
+			q := 0
+			for i := range t2count {
+				alone[q] = uint32(i)
+				if t2count[i]>>2 == 1 {
+					q++
+				}
+			}
+
+			stacksize = 0
+			for q > 0 {
+				q--
+				index := alone[q]
+				if t2count[index]>>2 != 1 {
+					continue
+				}
+
+				hash := t2hash[index]
+				found := t2count[index] & 3
+				reverseH[stacksize] = found
+				reverseOrder[stacksize] = hash
+				stacksize++
+
+				i0, i1, i2 := this.slots(hash)
+				h012[1], h012[2], h012[3], h012[4] = i1, i2, i0, i1
+
+				other := h012[found+1]
+				alone[q] = other
+				if t2count[other]>>2 == 2 {
+					q++
+				}
+				t2count[other] -= 4
+				t2count[other] ^= mod3(found + 1)
+				t2hash[other] ^= hash
+
+				other = h012[found+2]
+				alone[q] = other
+				if t2count[other]>>2 == 2 {
+					q++
+				}
+				t2count[other] -= 4
+				t2count[other] ^= mod3(found + 2)
+				t2hash[other] ^= hash
+			}
+
+			if stacksize+duplicates == size {
+				break
+			}
+		}
+
+		if !unique {
+			keys = slices.Clone(keys)
+			slices.Sort(keys)
+			if keys = slices.Compact(keys); len(keys) < size {
+				this.init(uint32(len(keys)))
+				return this.populate(keys, true)
+			}
+			unique = true
+		}
+
+		clear(reverseOrder[:size])
+		clear(t2count)
+		clear(t2hash)
+	}
+
+	// Assign the slots in the reverse order they were peeled in, each key setting the one
+	// slot no key assigned later uses
+	for i := stacksize - 1; i >= 0; i-- {
+		hash := reverseOrder[i]
+		i0, i1, i2 := this.slots(hash)
+		found := reverseH[i]
+		h012[0], h012[1], h012[2], h012[3], h012[4] = i0, i1, i2, i0, i1
+		this.fingerprints[h012[found]] = T(fingerprint(hash)) ^ this.fingerprints[h012[found+1]] ^ this.fingerprints[h012[found+2]]
+	}
+
+	this.n = uint32(stacksize)
+	return nil
+}
+
+// slots returns the 3 slots of a key hash, one in each of 3 consecutive segments.
+func (this *BinaryFuse[T]) slots(hash uint64) (uint32, uint32, uint32) {
+	hi, _ := bits.Mul64(hash, uint64(this.segmentCountLength))
+	h0 := uint32(hi)
+	h1 := h0 + this.segmentLength
+	h2 := h1 + this.segmentLength
+	h1 ^= uint32(hash>>18) & this.segmentLengthMask
+	h2 ^= uint32(hash) & this.segmentLengthMask
+	return h0, h1, h2
+}
+
+// Contains returns true if key may be one of the keys of the filter. It is never false for
+// them, and true for other keys with a probability of 1 / 2^b for b-bit fingerprints.
+func (this *BinaryFuse[T]) Contains(key uint64) bool {
+	hash := mixsplit(key, this.seed)
+	i0, i1, i2 := this.slots(hash)
+	return T(fingerprint(hash))^this.fingerprints[i0]^this.fingerprints[i1]^this.fingerprints[i2] == 0
+}
+
+// Len returns the number of distinct keys of the filter.
+func (this *BinaryFuse[T]) Len() int {
+	return int(this.n)
+}
+
+// FalsePositiveRate returns the probability that Contains returns true for a key that isn't
+// in the filter, 1 / 2^b for b-bit fingerprints.
+func (this *BinaryFuse[T]) FalsePositiveRate() float64 {
+	var f T
+	return math.Ldexp(1, -8*int(unsafe.Sizeof(f)))
+}
+
+// BitsPerKey returns the number of bits of the fingerprints per distinct key.
+func (this *BinaryFuse[T]) BitsPerKey() float64 {
+	var f T
+	return float64(len(this.fingerprints)) * float64(8*unsafe.Sizeof(f)) / float64(max(this.n, 1))
+}
+
+// MemoryUsage returns the number of bytes held by the filter.
+func (this *BinaryFuse[T]) MemoryUsage() uint64 {
+	var f T
+	return uint64(unsafe.Sizeof(*this)) + uint64(cap(this.fingerprints))*uint64(unsafe.Sizeof(f))
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *BinaryFuse[T]) String() string {
+	var f T
+	return fmt.Sprintf("fuse%d{n=%d slots=%d segments=%d bits/key=%.2f}", 8*unsafe.Sizeof(f), this.n, len(this.fingerprints), this.segmentCount, this.BitsPerKey())
+}
+
+// BytesFilter is a binary fuse filter of []byte keys, hashed to uint64 keys by a hasher
+// registered with bloom.RegisterHasher. Distinct keys with the same 64-bit hash are the
+// same key for the filter.
+//
+// It is safe for concurrent use.
+type BytesFilter[T Fingerprint] struct {
+	*BinaryFuse[T]
+
+	// hn is the name of the hash function, and hp holds the hashers used by Contains
+	hn string
+	hp *bloom.HasherPool
+}
+
+// BuildBinaryFuse8Bytes builds a filter of keys with 8-bit fingerprints, hashing them with
+// the hasher registered as hasher. It returns an error wrapping bloom.ErrUnknownHasher if
+// hasher isn't registered, and the errors of BuildBinaryFuse8.
+func BuildBinaryFuse8Bytes(keys [][]byte, hasher string) (*BytesFilter[uint8], error) {
+	return buildBytes[uint8](keys, hasher)
+}
+
+// BuildBinaryFuse16Bytes is the same as BuildBinaryFuse8Bytes, with 16-bit fingerprints.
+func BuildBinaryFuse16Bytes(keys [][]byte, hasher string) (*BytesFilter[uint16], error) {
+	return buildBytes[uint16](keys, hasher)
+}
+
+func buildBytes[T Fingerprint](keys [][]byte, hasher string) (*BytesFilter[T], error) {
+	h, err := bloom.NewHasher(hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &BytesFilter[T]{hn: hasher, hp: bloom.NewHasherPool(hasher, h)}
+
+	s := this.hp.Get()
+	hashes := make([]uint64, len(keys))
+	for i, key := range keys {
+		hashes[i] = hashKey(s, key)
+	}
+	this.hp.Put(s)
+
+	if this.BinaryFuse, err = build[T](hashes); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Contains returns true if key may be one of the keys of the filter.
+func (this *BytesFilter[T]) Contains(key []byte) bool {
+	s := this.hp.Get()
+	hash := hashKey(s, key)
+	this.hp.Put(s)
+	return this.BinaryFuse.Contains(hash)
+}
+
+// ContainsString is the same as Contains([]byte(s)), without copying s.
+func (this *BytesFilter[T]) ContainsString(s string) bool {
+	return this.Contains(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// HasherName returns the name of the hasher the keys are hashed with.
+func (this *BytesFilter[T]) HasherName() string {
+	return this.hn
+}
+
+// hashKey returns the first 8 bytes of the hash of key, mixed by mixsplit later on.
+func hashKey(s *bloom.Scratch, key []byte) uint64 {
+	s.H.Reset()
+	s.H.Write(key)
+	return bloom.Sum64(s.H, s.Sum[:])
+}
+
+// mixsplit mixes key with seed using bloom.Mix64.
+func mixsplit(key, seed uint64) uint64 {
+	return bloom.Mix64(key + seed)
+}
+
+// fingerprint returns the bits of a key hash stored in the slots, truncated to the size of
+// the fingerprints.
+func fingerprint(hash uint64) uint64 {
+	return hash ^ hash>>32
+}
+
+// splitmix64 returns the next seed of the sequence of state.
+func splitmix64(state *uint64) uint64 {
+	*state += 0x9e3779b97f4a7c15
+	z := *state
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
+
+func mod3(x uint8) uint8 {
+	if x > 2 {
+		x -= 3
+	}
+	return x
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/blocked"
+	"github.com/zhenjl/bloom/standard"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func keys(words []string) [][]byte {
+	keys := make([][]byte, len(words))
+	for i, w := range words {
+		keys[i] = []byte(w)
+	}
+	return keys
+}
+
+func randomKeys(n int, seed int64) []uint64 {
+	r := rand.New(rand.NewSource(seed))
+	keys := make([]uint64, n)
+	for i := range keys {
+		keys[i] = r.Uint64()
+	}
+	return keys
+}
+
+func TestBytes(t *testing.T) {
+	for _, bits := range []int{8, 16} {
+		var (
+			contains func(string) bool
+			rate     float64
+			desc     string
+		)
+
+		if bits == 8 {
+			f, err := BuildBinaryFuse8Bytes(keys(web2), bloom.DefaultHasher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contains, rate, desc = f.ContainsString, f.FalsePositiveRate(), f.String()
+		} else {
+			f, err := BuildBinaryFuse16Bytes(keys(web2), "fnv64a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			contains, rate, desc = f.ContainsString, f.FalsePositiveRate(), f.String()
+		}
+
+		fn, fp := 0, 0
+		for _, w := range web2 {
+			if !contains(w) {
+				fn++
+			}
+		}
+		for _, w := range web2a {
+			if contains(w) {
+				fp++
+			}
+		}
+
+		measured := float64(fp) / float64(len(web2a))
+		fmt.Printf("%s: %d false negatives, false positives %.4f%%, expected %.4f%%\n", desc, fn, measured*100, rate*100)
+
+		if fn > 0 {
+			t.Errorf("%d bits: %d false negatives", bits, fn)
+		}
+		if math.Abs(measured-rate) > 4*math.Sqrt(rate/float64(len(web2a)))+rate/10 {
+			t.Errorf("%d bits: false positive rate %f, expected %f", bits, measured, rate)
+		}
+	}
+}
+
+// TestSizes builds filters of 0 to a few thousand keys, where the segment length and count
+// are smallest, and checks every key is found.
+func TestSizes(t *testing.T) {
+	for n := 0; n < 5000; n += 1 + n/10 {
+		keys := randomKeys(n, int64(n))
+
+		f, err := BuildBinaryFuse8(keys)
+		if err != nil {
+			t.Fatalf("%d keys: %v", n, err)
+		}
+
+		if f.Len() != n {
+			t.Errorf("%d keys: %v", n, f)
+		}
+
+		for _, k := range keys {
+			if !f.Contains(k) {
+				t.Fatalf("%d keys: %d not found", n, k)
+			}
+		}
+	}
+}
+
+// TestDuplicates builds filters from keys repeated many times, which a single duplicate
+// hash would make impossible to peel if they weren't detected.
+func TestDuplicates(t *testing.T) {
+	unique := randomKeys(100000, 1)
+
+	keys := append([]uint64(nil), unique...)
+	keys = append(keys, unique[:50000]...)
+	keys = append(keys, unique[:1000]...)
+	for i := 0; i < 100; i++ {
+		keys = append(keys, unique[0])
+	}
+	rand.New(rand.NewSource(2)).Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	f, err := BuildBinaryFuse16(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f)
+
+	if f.Len() != len(unique) {
+		t.Errorf("%d distinct keys, expected %d", f.Len(), len(unique))
+	}
+
+	for _, k := range unique {
+		if !f.Contains(k) {
+			t.Fatalf("%d not found", k)
+		}
+	}
+}
+
+func TestBitsPerKey(t *testing.T) {
+	f8, err := BuildBinaryFuse8(randomKeys(1000000, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f16, err := BuildBinaryFuse16(randomKeys(1000000, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Println(f8, f16)
+
+	// About 1.125 slots per key, against 1.44 * b for a bloom filter
+	if f8.BitsPerKey() > 9.1 || f16.BitsPerKey() > 18.2 {
+		t.Errorf("%f and %f bits per key, expected about 9 and 18", f8.BitsPerKey(), f16.BitsPerKey())
+	}
+
+	if _, err := BuildBinaryFuse8Bytes(keys(web2[:10]), "nope"); !errors.Is(err, bloom.ErrUnknownHasher) {
+		t.Errorf("Expected bloom.ErrUnknownHasher, got %v", err)
+	}
+}
+
+// The benchmarks compare binary fuse filters with a standard and a blocked filter of the
+// same false positive probability, for a million random keys. The build benchmarks report
+// the bits per key.
+
+const benchKeys = 1000000
+
+func BenchmarkBuildFuse8(b *testing.B) {
+	keys := randomKeys(benchKeys, 4)
+	b.ResetTimer()
+
+	var f *BinaryFuse[uint8]
+	for i := 0; i < b.N; i++ {
+		f, _ = BuildBinaryFuse8(keys)
+	}
+	b.ReportMetric(f.BitsPerKey(), "bits/key")
+}
+
+func BenchmarkBuildFuse16(b *testing.B) {
+	keys := randomKeys(benchKeys, 4)
+	b.ResetTimer()
+
+	var f *BinaryFuse[uint16]
+	for i := 0; i < b.N; i++ {
+		f, _ = BuildBinaryFuse16(keys)
+	}
+	b.ReportMetric(f.BitsPerKey(), "bits/key")
+}
+
+func BenchmarkBuildStandard(b *testing.B) {
+	keys := randomKeys(benchKeys, 4)
+	b.ResetTimer()
+
+	var bf *standard.StandardBloom
+	for i := 0; i < b.N; i++ {
+		bf = standard.NewWithEstimates(benchKeys, 1.0/256).(*standard.StandardBloom)
+		for _, k := range keys {
+			bf.AddUint64(k)
+		}
+	}
+	b.ReportMetric(float64(bf.M())/benchKeys, "bits/key")
+}
+
+func BenchmarkBuildBlocked(b *testing.B) {
+	keys := randomKeys(benchKeys, 4)
+	b.ResetTimer()
+
+	var bf *blocked.BlockedBloom
+	for i := 0; i < b.N; i++ {
+		bf = blocked.NewWithEstimates(benchKeys, 1.0/256).(*blocked.BlockedBloom)
+		for _, k := range keys {
+			bf.AddUint64(k)
+		}
+	}
+	b.ReportMetric(float64(bf.M())/benchKeys, "bits/key")
+}
+
+func BenchmarkContainsFuse8(b *testing.B) {
+	f, _ := BuildBinaryFuse8(randomKeys(benchKeys, 4))
+	probes := randomKeys(benchKeys, 5)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f.Contains(probes[i%benchKeys])
+	}
+}
+
+func BenchmarkContainsFuse16(b *testing.B) {
+	f, _ := BuildBinaryFuse16(randomKeys(benchKeys, 4))
+	probes := randomKeys(benchKeys, 5)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		f.Contains(probes[i%benchKeys])
+	}
+}
+
+func BenchmarkCheckStandard(b *testing.B) {
+	bf := standard.NewWithEstimates(benchKeys, 1.0/256).(*standard.StandardBloom)
+	for _, k := range randomKeys(benchKeys, 4) {
+		bf.AddUint64(k)
+	}
+	probes := randomKeys(benchKeys, 5)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.CheckUint64(probes[i%benchKeys])
+	}
+}
+
+func BenchmarkCheckBlocked(b *testing.B) {
+	bf := blocked.NewWithEstimates(benchKeys, 1.0/256).(*blocked.BlockedBloom)
+	for _, k := range randomKeys(benchKeys, 4) {
+		bf.AddUint64(k)
+	}
+	probes := randomKeys(benchKeys, 5)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.CheckUint64(probes[i%benchKeys])
+	}
+}
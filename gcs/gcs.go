@@ -0,0 +1,425 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gcs implements Golomb-coded sets, a compact and immutable alternative to bloom
+// filters for sending sets over the network, as BIP 158 block filters do.
+package gcs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+// MaxP is the largest number of bits of the remainder of each value.
+const MaxP = 32
+
+// KeySize is the size of the random key Build generates.
+const KeySize = 16
+
+// ErrInvalidP is returned when p is not in [1, MaxP].
+var ErrInvalidP = errors.New("gcs: p must be in [1, 32]")
+
+// GCS is a Golomb-coded set: each key is hashed to a value in [0, n * 2^p) for n keys, and
+// the sorted values are written as the differences between them, each coded as its quotient
+// by 2^p in unary followed by its p low bits. The differences average 2^p, so a set takes
+// about p + 1.5 bits per key, less than the 1.44 * p bits of a bloom filter with the same
+// false positive probability of 1 / 2^p. In exchange, Match decodes the values one by one
+// until it reaches the one of its key, so it is much slower than a bloom filter, and no key
+// can be added once the set is built.
+//
+// The values are computed by a hasher fed with a key of the set before each key, so that
+// different sets have different false positives, as long as the hasher mixes the key in.
+//
+// GCS is safe for concurrent use.
+type GCS struct {
+	// n is the number of keys the set was built from, and c the number of distinct values
+	// coded, fewer if keys hash to the same value
+	n, c uint64
+
+	// p is the number of bits of the remainder of each value
+	p uint
+
+	// key is written to the hasher before each key
+	key []byte
+
+	// h is the hash function, and hn its name
+	h  hash.Hash
+	hn string
+
+	// hp holds the hashers used by Match, so it can run concurrently
+	hp *bloom.HasherPool
+
+	// data holds the coded values, and m the number of bits used
+	data []byte
+	m    uint64
+}
+
+// Build builds a set of keys with a false positive probability of 1 / 2^p, using the
+// default hasher and a random key.
+func Build(keys [][]byte, p uint) (*GCS, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return BuildWithKey(keys, p, bloom.DefaultHasher, key)
+}
+
+// BuildWithKey builds a set of keys with a false positive probability of 1 / 2^p, using the
+// hasher registered as hasher, fed with key before each key. Sets built from the same keys
+// with the same parameters are identical. It returns ErrInvalidP if p is not in [1, MaxP],
+// and an error wrapping bloom.ErrUnknownHasher if hasher isn't registered.
+func BuildWithKey(keys [][]byte, p uint, hasher string, key []byte) (*GCS, error) {
+	if p < 1 || p > MaxP {
+		return nil, ErrInvalidP
+	}
+
+	if uint64(len(keys)) > math.MaxUint64>>p {
+		return nil, fmt.Errorf("gcs: too many keys for p = %d: %d", p, len(keys))
+	}
+
+	h, err := bloom.NewHasher(hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &GCS{n: uint64(len(keys)), p: p, key: bytes.Clone(key)}
+	this.setHasher(h, hasher)
+
+	values := this.values(keys)
+	slices.Sort(values)
+	values = slices.Compact(values)
+
+	var w bitWriter
+	prev := uint64(0)
+	for _, v := range values {
+		d := v - prev
+		w.writeUnary(d >> p)
+		w.writeBits(d, p)
+		prev = v
+	}
+
+	this.c, this.data, this.m = uint64(len(values)), w.data, w.n
+
+	return this, nil
+}
+
+func (this *GCS) setHasher(h hash.Hash, name string) {
+	this.h = h
+	this.hn = name
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+// N returns the number of keys the set was built from.
+func (this *GCS) N() uint64 {
+	return this.n
+}
+
+// P returns the number of bits of the remainder of each value.
+func (this *GCS) P() uint {
+	return this.p
+}
+
+// Key returns the key written to the hasher before each key.
+func (this *GCS) Key() []byte {
+	return this.key
+}
+
+// HasherName returns the name of the hasher.
+func (this *GCS) HasherName() string {
+	return this.hn
+}
+
+// Bytes returns the coded values, without the parameters needed to decode them. It must not
+// be modified.
+func (this *GCS) Bytes() []byte {
+	return this.data
+}
+
+// FalsePositiveRate returns the probability that Match returns true for a key that isn't in
+// the set, about 1 / 2^p.
+func (this *GCS) FalsePositiveRate() float64 {
+	if this.n == 0 {
+		return 0
+	}
+	return 1 - math.Pow(1-1/float64(this.n<<this.p), float64(this.n))
+}
+
+// Match returns true if key may be in the set. It decodes the values up to the value of key,
+// so it takes time proportional to the size of the set.
+func (this *GCS) Match(key []byte) bool {
+	if this.c == 0 {
+		return false
+	}
+
+	s := this.hp.Get()
+	v := this.value(s, key)
+	this.hp.Put(s)
+
+	r := bitReader{data: this.data}
+	x := uint64(0)
+	for i := uint64(0); i < this.c; i++ {
+		x += r.readUnary()<<this.p | r.readBits(this.p)
+		if x >= v {
+			return x == v
+		}
+	}
+	return false
+}
+
+// MatchString is the same as Match([]byte(s)), without copying s.
+func (this *GCS) MatchString(s string) bool {
+	return this.Match(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// MatchAny returns true if any of keys may be in the set. It sorts the values of keys, and
+// decodes the values of the set once for all of them, so it is much faster than calling
+// Match for each key.
+func (this *GCS) MatchAny(keys [][]byte) bool {
+	if this.c == 0 || len(keys) == 0 {
+		return false
+	}
+
+	values := this.values(keys)
+	slices.Sort(values)
+
+	r := bitReader{data: this.data}
+	x := uint64(0)
+	i := 0
+	for j := uint64(0); j < this.c; j++ {
+		x += r.readUnary()<<this.p | r.readBits(this.p)
+
+		for values[i] < x {
+			if i++; i == len(values) {
+				return false
+			}
+		}
+		if values[i] == x {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns the values of keys.
+func (this *GCS) values(keys [][]byte) []uint64 {
+	s := this.hp.Get()
+	defer this.hp.Put(s)
+
+	values := make([]uint64, len(keys))
+	for i, k := range keys {
+		values[i] = this.value(s, k)
+	}
+	return values
+}
+
+// value returns the value of key in [0, n * 2^p). The hash of key is mixed with
+// bloom.Mix64, and mapped to the range by multiplication rather than modulo.
+func (this *GCS) value(s *bloom.Scratch, key []byte) uint64 {
+	s.H.Reset()
+	s.H.Write(this.key)
+	s.H.Write(key)
+	h := bloom.Mix64(bloom.Sum64(s.H, s.Sum[:]))
+
+	v, _ := bits.Mul64(h, this.n<<this.p)
+	return v
+}
+
+// MemoryUsage returns the number of bytes held by the set. The memory held by the hasher is
+// not included.
+func (this *GCS) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + uint64(cap(this.data)+cap(this.key))
+}
+
+// String implements fmt.Stringer with a one line summary of the set.
+func (this *GCS) String() string {
+	return fmt.Sprintf("gcs{n=%d p=%d bytes=%d bits/key=%.2f}", this.n, this.p, len(this.data), float64(this.m)/float64(max(this.n, 1)))
+}
+
+// WriteTo implements io.WriterTo. It writes a bloom.Header of kind bloom.KindGCS holding the
+// number of keys as N, the number of values as C, p as K, the number of bits of the coded
+// values as M, the size of the key as S and the hasher name, followed by the key and the
+// coded values.
+func (this *GCS) WriteTo(w io.Writer) (int64, error) {
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindGCS,
+		Hasher:  this.hn,
+		M:       this.m,
+		K:       uint64(this.p),
+		S:       uint64(len(this.key)),
+		N:       this.n,
+		C:       this.c,
+	}
+
+	total, err := h.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+
+	for _, b := range [][]byte{this.key, this.data} {
+		n, err := w.Write(b)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// ReadFrom implements io.ReaderFrom. It reads a set written by WriteTo, consuming exactly
+// the bytes of one set from r, and recreates its hasher by name.
+func (this *GCS) ReadFrom(r io.Reader) (int64, error) {
+	h := &bloom.Header{}
+	total, err := h.ReadFrom(r)
+	if err != nil {
+		return total, err
+	}
+
+	if h.Kind != bloom.KindGCS {
+		return total, fmt.Errorf("gcs: cannot read %s filter", h.Kind)
+	}
+
+	if h.K < 1 || h.K > MaxP || h.N > math.MaxUint64>>h.K || h.C > h.N || h.M < h.C*(h.K+1) || h.S > 1<<16 || h.M > 1<<40 {
+		return total, fmt.Errorf("gcs: invalid parameters n = %d, c = %d, p = %d, m = %d", h.N, h.C, h.K, h.M)
+	}
+
+	hf, err := bloom.NewHasher(h.Hasher)
+	if err != nil {
+		return total, err
+	}
+
+	buf := make([]byte, h.S+(h.M+7)/8)
+	n, err := io.ReadFull(r, buf)
+	total += int64(n)
+	if err != nil {
+		return total, fmt.Errorf("gcs: reading values: %w", err)
+	}
+
+	this.n, this.c, this.p, this.m = h.N, h.C, uint(h.K), h.M
+	this.key, this.data = buf[:h.S:h.S], buf[h.S:]
+	this.setHasher(hf, h.Hasher)
+
+	return total, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the WriteTo encoding.
+func (this *GCS) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := this.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using the ReadFrom encoding. It
+// rejects truncated input, and input with trailing bytes after the values.
+func (this *GCS) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := this.ReadFrom(r); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("gcs: %d trailing bytes after values", r.Len())
+	}
+
+	return nil
+}
+
+// bitWriter appends bits to data, most significant bit first. n is the number of bits
+// written.
+type bitWriter struct {
+	data []byte
+	n    uint64
+}
+
+// writeUnary writes q ones followed by a zero.
+func (this *bitWriter) writeUnary(q uint64) {
+	for ; q > 0; q-- {
+		this.writeBit(1)
+	}
+	this.writeBit(0)
+}
+
+// writeBits writes the k low bits of v, most significant first.
+func (this *bitWriter) writeBits(v uint64, k uint) {
+	for i := int(k) - 1; i >= 0; i-- {
+		this.writeBit(byte(v>>uint(i)) & 1)
+	}
+}
+
+func (this *bitWriter) writeBit(b byte) {
+	if this.n%8 == 0 {
+		this.data = append(this.data, 0)
+	}
+	this.data[len(this.data)-1] |= b << (7 - this.n%8)
+	this.n++
+}
+
+// bitReader reads the bits written by bitWriter, from the 64 bits starting at bit n, of
+// which at least 57 are valid. Reading past the end returns zeros.
+type bitReader struct {
+	data []byte
+	n    uint64
+}
+
+// readUnary reads the number of ones before the next zero.
+func (this *bitReader) readUnary() uint64 {
+	q := uint64(0)
+	for {
+		ones := uint64(bits.LeadingZeros64(^this.peek()))
+		if ones < 57 {
+			this.n += ones + 1
+			return q + ones
+		}
+		q += 56
+		this.n += 56
+	}
+}
+
+// readBits reads k bits, most significant first. k is at most MaxP.
+func (this *bitReader) readBits(k uint) uint64 {
+	if k == 0 {
+		return 0
+	}
+	v := this.peek() >> (64 - k)
+	this.n += uint64(k)
+	return v
+}
+
+// peek returns the 64 bits starting at bit n, the bits past the end being zeros.
+func (this *bitReader) peek() uint64 {
+	i := this.n / 8
+	var w uint64
+	if i+8 <= uint64(len(this.data)) {
+		w = binary.BigEndian.Uint64(this.data[i:])
+	} else if i < uint64(len(this.data)) {
+		var b [8]byte
+		copy(b[:], this.data[i:])
+		w = binary.BigEndian.Uint64(b[:])
+	}
+	return w << (this.n % 8)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func keys(words []string) [][]byte {
+	keys := make([][]byte, len(words))
+	for i, w := range words {
+		keys[i] = []byte(w)
+	}
+	return keys
+}
+
+// TestMatch builds sets of 10000 words, which Match decodes quickly enough to check them
+// all, and measures the false positive rate with as many words of web2a.
+func TestMatch(t *testing.T) {
+	const n = 10000
+
+	for _, p := range []uint{6, 10, 14} {
+		set, err := Build(keys(web2[:n]), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fn, fp := 0, 0
+		for _, w := range web2[:n] {
+			if !set.MatchString(w) {
+				fn++
+			}
+		}
+
+		for _, w := range web2a[:n] {
+			if set.MatchString(w) {
+				fp++
+			}
+		}
+
+		rate := float64(fp) / n
+		fmt.Printf("p = %d: %v, %d false negatives, false positives %.4f%%, expected %.4f%%\n", p, set, fn, rate*100, set.FalsePositiveRate()*100)
+
+		if fn > 0 {
+			t.Errorf("p = %d: %d false negatives", p, fn)
+		}
+
+		if e := set.FalsePositiveRate(); math.Abs(rate-e) > 3*math.Sqrt(e/n)+e/10 {
+			t.Errorf("p = %d: false positive rate %f, expected %f", p, rate, e)
+		}
+	}
+}
+
+// TestSize compares the size of sets of all the words with standard filters of the same
+// false positive probability.
+func TestSize(t *testing.T) {
+	for _, p := range []uint{8, 10, 16, 20} {
+		set, err := Build(keys(web2), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bf := standard.NewWithEstimates(uint(len(web2)), set.FalsePositiveRate()).(*standard.StandardBloom)
+
+		gcsBytes, bloomBytes := len(set.Bytes()), bf.M()/8
+		fmt.Printf("p = %d: gcs %d bytes (%.2f bits/key), standard %d bytes (%.2f bits/key), %.1f%% smaller\n",
+			p, gcsBytes, float64(gcsBytes*8)/float64(len(web2)), bloomBytes, float64(bloomBytes*8)/float64(len(web2)),
+			(1-float64(gcsBytes)/float64(bloomBytes))*100)
+
+		if uint(gcsBytes) >= bloomBytes || float64(gcsBytes*8)/float64(len(web2)) > float64(p)+2 {
+			t.Errorf("p = %d: gcs %d bytes, standard %d bytes", p, gcsBytes, bloomBytes)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	set, err := BuildWithKey(keys(web2), 20, bloom.DefaultHasher, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With p = 20, no word of a batch of web2a is expected to match
+	batch := keys(web2a[:1000])
+	if set.MatchAny(batch) {
+		t.Errorf("Expected no match for %d words of web2a", len(batch))
+	}
+
+	for _, w := range []string{web2[0], web2[len(web2)/2], web2[len(web2)-1]} {
+		if !set.MatchAny(append(batch, []byte(w))) || !set.MatchAny([][]byte{[]byte(w)}) {
+			t.Errorf("Expected a match with %q", w)
+		}
+	}
+
+	if set.MatchAny(nil) {
+		t.Errorf("Expected no match for no keys")
+	}
+
+	empty, err := Build(nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty.MatchString("foo") || empty.MatchAny(batch) || empty.FalsePositiveRate() != 0 {
+		t.Errorf("Expected nothing to match the empty set %v", empty)
+	}
+}
+
+func TestSerialization(t *testing.T) {
+	set, err := BuildWithKey(keys(web2[:10000]), 12, "fnv64a", []byte("block hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := set.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set2 := &GCS{}
+	if err := set2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if set2.N() != set.N() || set2.P() != 12 || set2.HasherName() != "fnv64a" || !bytes.Equal(set2.Key(), []byte("block hash")) || !bytes.Equal(set2.Bytes(), set.Bytes()) {
+		t.Errorf("Decoded %v, expected %v", set2, set)
+	}
+
+	for _, w := range web2[:10000] {
+		if !set2.MatchString(w) {
+			t.Fatalf("Expected to find %q in the decoded set", w)
+		}
+	}
+
+	// The same keys and parameters give the same set, and another key a different one
+	same, _ := BuildWithKey(keys(web2[:10000]), 12, "fnv64a", []byte("block hash"))
+	other, _ := BuildWithKey(keys(web2[:10000]), 12, "fnv64a", []byte("other block"))
+	if !bytes.Equal(same.Bytes(), set.Bytes()) || bytes.Equal(other.Bytes(), set.Bytes()) {
+		t.Errorf("Expected the set to depend on the key only")
+	}
+
+	if err := new(GCS).UnmarshalBinary(append(data, 0)); err == nil {
+		t.Errorf("Expected an error decoding trailing data")
+	}
+	if err := new(GCS).UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Errorf("Expected an error decoding truncated data")
+	}
+
+	if _, err := bloom.Load(bytes.NewReader(data)); !errors.Is(err, bloom.ErrUnsupportedFormat) {
+		t.Errorf("Expected bloom.Load to reject a set, got %v", err)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	for _, p := range []uint{0, MaxP + 1} {
+		if _, err := Build(keys(web2[:10]), p); err != ErrInvalidP {
+			t.Errorf("p = %d: expected ErrInvalidP, got %v", p, err)
+		}
+	}
+
+	if _, err := BuildWithKey(keys(web2[:10]), 10, "nope", nil); !errors.Is(err, bloom.ErrUnknownHasher) {
+		t.Errorf("Expected bloom.ErrUnknownHasher, got %v", err)
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	set, _ := Build(keys(web2), 20)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		set.MatchString(web2[i%len(web2)])
+	}
+}
+
+func BenchmarkMatchAny(b *testing.B) {
+	set, _ := Build(keys(web2), 20)
+	batch := keys(web2a[:1000])
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		set.MatchAny(batch)
+	}
+}
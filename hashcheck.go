@@ -0,0 +1,203 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"fmt"
+	"hash"
+	"math"
+	"math/bits"
+)
+
+// HasherVerdict is the conclusion of EvaluateHasher.
+type HasherVerdict int
+
+const (
+	// HasherPass means the positions and the digests of the sample keys look random.
+	HasherPass HasherVerdict = iota
+
+	// HasherWarn means they don't, so filters using the hasher are likely to have a false
+	// positive rate above the one they were sized for. HasherReport.Warnings says why.
+	HasherWarn
+)
+
+func (this HasherVerdict) String() string {
+	switch this {
+	case HasherPass:
+		return "pass"
+	case HasherWarn:
+		return "warn"
+	}
+	return fmt.Sprintf("HasherVerdict(%d)", int(this))
+}
+
+// maxCheckBuckets is the largest number of buckets EvaluateHasher counts positions in.
+const maxCheckBuckets = 4096
+
+// checkDeviations is the number of standard deviations above its expected value at which a
+// statistic of EvaluateHasher is reported as a warning. A good hasher exceeds it about once
+// in 3 million evaluations.
+const checkDeviations = 5
+
+// HasherReport holds the statistics computed by EvaluateHasher.
+type HasherReport struct {
+	// Keys is the number of sample keys, and M and K the size of the bit array and the
+	// number of positions of each key the hasher was evaluated for.
+	Keys int
+	M, K uint
+
+	// Buckets is the number of equal ranges of [0, M) the positions of the keys were counted
+	// in, and ChiSquared the chi-squared statistic of these counts against the uniform
+	// distribution. With Buckets - 1 degrees of freedom, it is about Buckets - 1 for a good
+	// hasher, and Deviation is the number of standard deviations it is above that.
+	Buckets    int
+	ChiSquared float64
+	Deviation  float64
+
+	// DigestCollisions is the number of keys whose first 8 bytes of digest, as read by Sum64,
+	// are those of another key, which is about never for random 64-bit values, and
+	// PairCollisions the number of keys whose first two positions are those of another
+	// key. As these positions are the a and a + b of double hashing, keys sharing them
+	// share all their positions, or most with FlagEnhanced, and are each a false positive
+	// for the other. ExpectedPairCollisions is the number of such keys expected of random
+	// positions, the number of pairs of keys divided by M^2.
+	DigestCollisions       int
+	PairCollisions         int
+	ExpectedPairCollisions float64
+
+	// Verdict is HasherWarn if any of the statistics is far from the expected one, with a
+	// description of each in Warnings, and HasherPass otherwise.
+	Verdict  HasherVerdict
+	Warnings []string
+}
+
+// EvaluateHasher hashes sampleKeys with h, derives k positions in a bit array of m bits for
+// each, the way the filters do with DigestPositions and DigestFlags, or with Locate if h is a
+// Locator, and reports how far their distribution is from the one expected of a random
+// hash function. It is meant to vet a hasher before building filters with it: a hasher
+// whose values cluster yields a false positive rate far above the one the filters were
+// sized for, which otherwise only shows once they are in use.
+//
+// The positions are counted in up to 4096 equal ranges of [0, m), with about 8 positions
+// per range at least, so a few thousand keys are enough to detect gross clustering, and a
+// hundred thousand a subtle one. The collisions of the digests and of the first two
+// positions of the keys are counted as well, as they make false positives that an even
+// distribution doesn't show. The keys should be distinct and look like the real ones, as
+// the weaknesses of hashers depend on the structure of the keys.
+//
+// Only the positions of new filters are evaluated. Those of filters written without
+// DigestFlags come from the 32-bit halves of the digest without the mixing of
+// FlagFastRange, which hides some weaknesses: the last bytes of a key only change the low
+// bits of its fnv64 digest, so keys differing only there often share the high half.
+//
+// h is reset before each key. m and k must be positive.
+func EvaluateHasher(h hash.Hash, sampleKeys [][]byte, m, k uint) HasherReport {
+	r := HasherReport{
+		Keys: len(sampleKeys),
+		M:    m,
+		K:    k,
+	}
+
+	buckets := uint64(len(sampleKeys)) * uint64(k) / 8
+	buckets = min(buckets, maxCheckBuckets, uint64(m))
+	r.Buckets = int(max(buckets, 2))
+
+	var (
+		counts = make([]uint64, r.Buckets)
+		bs     = make([]uint, k)
+		sum    [64]byte
+		seen   = make(map[uint64]struct{}, len(sampleKeys))
+		pairs  = make(map[[2]uint]struct{}, len(sampleKeys))
+	)
+
+	loc, _ := h.(Locator)
+
+	for _, key := range sampleKeys {
+		h.Reset()
+		h.Write(key)
+
+		var v uint64
+		if loc != nil {
+			loc.Locate(key, bs, m)
+			v = Sum64(h, sum[:0])
+		} else {
+			v = DigestPositions(h, sum[:0], bs, m, DigestFlags)
+		}
+
+		for _, p := range bs {
+			// The bucket is p * Buckets / m, which overflows for m above 2^52
+			hi, lo := bits.Mul64(uint64(p), uint64(r.Buckets))
+			q, _ := bits.Div64(hi, lo, uint64(m))
+			counts[q]++
+		}
+
+		r.DigestCollisions += collide(seen, v)
+		if k >= 2 {
+			r.PairCollisions += collide(pairs, [2]uint{bs[0], bs[1]})
+		}
+	}
+
+	total := float64(len(sampleKeys)) * float64(k)
+	if total == 0 {
+		return r
+	}
+
+	expected := total / float64(r.Buckets)
+	for _, c := range counts {
+		d := float64(c) - expected
+		r.ChiSquared += d * d / expected
+	}
+
+	df := float64(r.Buckets - 1)
+	r.Deviation = (r.ChiSquared - df) / math.Sqrt(2*df)
+	if r.Deviation > checkDeviations {
+		r.warn("positions: chi-squared %.1f over %d buckets is %.1f standard deviations above %.0f",
+			r.ChiSquared, r.Buckets, r.Deviation, df)
+	}
+
+	n := float64(len(sampleKeys))
+	r.checkCollisions("digests", r.DigestCollisions, n*(n-1)/2/math.Pow(2, 64))
+
+	if k >= 2 {
+		r.ExpectedPairCollisions = n * (n - 1) / 2 / (float64(m) * float64(m))
+		r.checkCollisions("first two positions", r.PairCollisions, r.ExpectedPairCollisions)
+	}
+
+	return r
+}
+
+// collide adds v to seen, and returns 1 if it was there already, 0 otherwise.
+func collide[T comparable](seen map[T]struct{}, v T) int {
+	if _, ok := seen[v]; ok {
+		return 1
+	}
+	seen[v] = struct{}{}
+	return 0
+}
+
+// checkCollisions adds a warning if the number of collisions c is well above expected. The
+// number of collisions of random values is about a Poisson variable, whose standard
+// deviation is the square root of its mean, and the margin of 2 keeps a couple of
+// collisions among few keys from being reported.
+func (this *HasherReport) checkCollisions(what string, c int, expected float64) {
+	if float64(c) > expected+checkDeviations*math.Sqrt(expected)+2 {
+		this.warn("%s: %d collisions among %d keys, expected %.2f", what, c, this.Keys, expected)
+	}
+}
+
+func (this *HasherReport) warn(format string, args ...any) {
+	this.Verdict = HasherWarn
+	this.Warnings = append(this.Warnings, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,438 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strings"
+	"sync"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// Locator is implemented by hashers that derive the bit positions of a key themselves,
+// instead of leaving it to the filter. It exists to read and write filters built by other
+// libraries, which have their own way of turning hash values into positions. Filters that
+// support it use Locate in place of their own derivation when given such a hasher.
+type Locator interface {
+	hash.Hash
+
+	// Locate fills bs with the positions of item in a bit array of m bits.
+	Locate(item []byte, bs []uint, m uint)
+}
+
+// ErrUnknownHasher is returned when a hasher name is not registered in this process.
+var ErrUnknownHasher = errors.New("bloom: unknown hasher")
+
+// ErrHasherNotCloneable is returned by CloneHasher for a hasher that has no name and does
+// not implement hash.Cloner.
+var ErrHasherNotCloneable = errors.New("bloom: hasher cannot be cloned")
+
+var (
+	hashersMu sync.RWMutex
+	hashers   = map[string]func() hash.Hash{
+		DefaultHasher: func() hash.Hash { return fnv.New64() },
+		"fnv64a":      func() hash.Hash { return fnv.New64a() },
+		"crc64-ecma":  func() hash.Hash { return crc64.New(crc64.MakeTable(crc64.ECMA)) },
+		"crc64-iso":   func() hash.Hash { return crc64.New(crc64.MakeTable(crc64.ISO)) },
+		"md5":         func() hash.Hash { return md5.New() },
+		"sha1":        func() hash.Hash { return sha1.New() },
+		"murmur3-128": func() hash.Hash { return murmur3.New128() },
+	}
+
+	families = make(map[string]func(params []byte) (hash.Hash, error))
+)
+
+// RegisterHasher makes a hasher available by name to SetNamedHasher and to the decoders
+// used by Load. The filters record the name of a hasher set with SetNamedHasher when
+// serialized, and the decoders call ctor to recreate it, so a filter can only be loaded in
+// a process that registered the same name with the same hash function. The names fnv64
+// (the default), fnv64a, crc64-ecma, crc64-iso, md5, sha1 and murmur3-128 are registered
+// already.
+func RegisterHasher(name string, ctor func() hash.Hash) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	hashers[name] = ctor
+}
+
+// RegisterHasherFamily makes a family of hashers taking parameters, such as a seed or a
+// key, available by the names returned by FamilyHasherName. The parameters are part of the
+// name, so they are recorded in the header of the filters using such a hasher, and the
+// decoders call ctor with them to recreate the same hasher: a filter saved in one process
+// can be loaded in any other that registered the same family. ctor returns an error if the
+// parameters are invalid. family must not contain a colon.
+//
+// For a keyed hasher, this means the serialized filter holds the key in the clear. Anyone
+// who can read it can compute the positions of items, and pick items that are false
+// positives, which the key was meant to prevent, so the files must be kept as secret as
+// the key itself.
+func RegisterHasherFamily(family string, ctor func(params []byte) (hash.Hash, error)) {
+	hashersMu.Lock()
+	defer hashersMu.Unlock()
+	families[family] = ctor
+}
+
+// FamilyHasherName returns the name of the hasher of the family registered with
+// RegisterHasherFamily, with params: the family, a colon and params in hexadecimal. The
+// name is written in the header of serialized filters, which limits it to 255 bytes.
+func FamilyHasherName(family string, params []byte) string {
+	return family + ":" + hex.EncodeToString(params)
+}
+
+// ParseHasherName returns the family and the parameters of a name returned by
+// FamilyHasherName, and false if name isn't such a name.
+func ParseHasherName(name string) (string, []byte, bool) {
+	family, s, ok := strings.Cut(name, ":")
+	if !ok {
+		return "", nil, false
+	}
+
+	params, err := hex.DecodeString(s)
+	if err != nil {
+		return "", nil, false
+	}
+
+	return family, params, true
+}
+
+// NewHasher returns a new instance of the hasher registered as name, or of the hasher of a
+// family registered with RegisterHasherFamily if name was returned by FamilyHasherName. It
+// returns an error wrapping ErrUnknownHasher if the name or the family isn't registered, or
+// if the family rejects the parameters.
+func NewHasher(name string) (hash.Hash, error) {
+	hashersMu.RLock()
+	ctor, ok := hashers[name]
+	hashersMu.RUnlock()
+
+	if ok {
+		return ctor(), nil
+	}
+
+	family, params, ok := ParseHasherName(name)
+	if ok {
+		hashersMu.RLock()
+		fctor, ok := families[family]
+		hashersMu.RUnlock()
+
+		if ok {
+			h, err := fctor(params)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrUnknownHasher, name, err)
+			}
+			return h, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnknownHasher, name)
+}
+
+// ResolveHasher returns the hasher for a filter being decoded from a header naming the
+// hasher name. If the name is empty, the filter was built with a hasher set by SetHasher
+// that cannot be recreated, so current is returned, or fnv.New64() if current is nil.
+func ResolveHasher(name string, current hash.Hash) (hash.Hash, error) {
+	if name != "" {
+		return NewHasher(name)
+	}
+
+	if current == nil {
+		return fnv.New64(), nil
+	}
+
+	return current, nil
+}
+
+// CloneHasher returns a new hasher of the same kind as h, which doesn't share any state with
+// h. If name is not empty, it is the name h was registered with, and a new instance is
+// created with NewHasher. Otherwise h was set by SetHasher and must implement hash.Cloner.
+func CloneHasher(name string, h hash.Hash) (hash.Hash, error) {
+	if name != "" {
+		return NewHasher(name)
+	}
+
+	c, ok := h.(hash.Cloner)
+	if !ok {
+		return nil, ErrHasherNotCloneable
+	}
+
+	return c.Clone()
+}
+
+// Sum64 returns the first 8 bytes of the digest of h as a big endian integer. If h
+// implements hash.Hash64 with an 8 byte digest, its Sum64 method is used, which returns the
+// digest itself for the hashers of the standard library, so the digest isn't written out.
+// Otherwise the digest is appended to sum, which should have room for it, so Sum64 doesn't
+// allocate.
+//
+// A digest shorter than 8 bytes, such as the 4 bytes of hash/crc32 or hash/adler32, is
+// extended to 64 bits by the splitmix64 mixer, so the filters splitting the value in two
+// halves for double hashing get two values depending on the whole digest, rather than a
+// zero half. The mixer is a bijection, so it doesn't add collisions, but it can't add
+// information either: items with the same 32-bit digest still have the same positions,
+// which adds about c / 2^32 to the false positive rate of a filter holding c items, on top
+// of the weaknesses of the hash itself, such as the poor distribution of adler32 for short
+// items.
+func Sum64(h hash.Hash, sum []byte) uint64 {
+	if h64, ok := h.(hash.Hash64); ok && h.Size() == 8 {
+		return h64.Sum64()
+	}
+
+	d := h.Sum(sum[:0])
+	if len(d) >= 8 {
+		return binary.BigEndian.Uint64(d)
+	}
+
+	var v uint64
+	for _, c := range d {
+		v = v<<8 | uint64(c)
+	}
+
+	return splitmix64(v)
+}
+
+// Hash128 is implemented by 128-bit hashers returning their digest as two 64-bit values,
+// such as the murmur3 hashers of github.com/spaolacci/murmur3.
+type Hash128 interface {
+	hash.Hash
+
+	// Sum128 returns the two halves of the digest of the data written so far.
+	Sum128() (uint64, uint64)
+}
+
+// DigestFlagsOf returns the flags of DigestFlags set in flags that change the positions
+// derived from the digest of h by DigestPositions, for a bit array of m bits. The filters
+// record them when serialized, so filters written without them keep their positions.
+func DigestFlagsOf(h hash.Hash, m uint, flags uint16) uint16 {
+	f := flags & FlagFastRange
+
+	if _, ok := h.(Hash128); ok && flags&FlagSum128 != 0 {
+		return f | FlagSum128
+	}
+
+	f |= flags & FlagEnhanced
+
+	if h.Size() > 8 && flags&FlagWideDigest != 0 {
+		f |= FlagWideDigest
+	}
+
+	if uint64(m) > math.MaxUint32 && flags&FlagWideIndex != 0 {
+		f |= FlagWideIndex
+	}
+
+	return f
+}
+
+// DigestPositions fills bs with positions in [0, m) derived from the digest of h, which must
+// hold the hash of an item, and returns the first 8 bytes of the digest as read by Sum64.
+// The two halves of these 8 bytes, a and b, give position i as (a + b * i) mod m, following
+// Kirsch and Mitzenmacher, Less Hashing, Same Performance: Building a Better Bloom Filter.
+//
+// flags selects other derivations, from more of the digest:
+//
+// With FlagSum128, if h implements Hash128, the positions come from the enhanced double
+// hashing of the two 64-bit halves x and y of the digest, that is its four 32-bit words:
+// position i is x mod m, after which x is incremented by y and y by i. The positions then
+// depend on all 128 bits of the digest, rather than 64, and the increments vary, so the
+// positions of two items don't all differ by the same offset as with a and b. With a hash
+// as good as murmur3 and m below 2^32, this doesn't show in the false positive rate,
+// which is already what the theory expects, but the positions cover m above 2^32 evenly,
+// which 32-bit a and b don't.
+//
+// With FlagWideDigest, if the digest is longer than 8 bytes, as for md5 or sha1, the first
+// positions are instead taken from consecutive chunks of the digest, 4 bytes each, or 8 if m
+// doesn't fit in 32 bits, and only the positions past the end of the digest are derived from
+// a and b. The positions are then as independent as the digest allows, which the users of
+// cryptographic hashers expect.
+//
+// With FlagWideIndex, if m doesn't fit in 32 bits, a and b are 64-bit values: a is the first
+// 8 bytes of the digest, and b the next 8 bytes, or a mixed with the splitmix64 finalizer if
+// the digest is shorter. With 32-bit a and b, a + b * i is below k * 2^32, so for m much
+// larger than that the positions are concentrated in the low bits of the array, and those
+// above k * 2^32 are never set, raising the false positive rate far above the one the
+// filter was sized for.
+//
+// With FlagEnhanced, a and b are mapped to [0, m) once, and position i is then
+// (a + b * i + (i^3 - 3i^2 + 2i) / 6) mod m, the enhanced double hashing of Dillinger and
+// Manolios, Bloom Filters in Probabilistic Verification, computed with additions as for
+// FlagSum128. With a and b alone, the positions of an item repeat with a period of
+// m / gcd(b, m), which is short when b shares a large factor with m, as is often the case
+// if m is a power of two. The cubic term breaks the cycles, and the positions only cost two
+// reductions rather than k. The term is added modulo m rather than to the values before
+// their reduction, where the multiply-shift would scale it down to nothing.
+//
+// With FlagFastRange, the values are mapped to [0, m) by the multiply-shift reduction of
+// Lemire, A fast alternative to the modulo reduction, rather than by a modulo: a w-bit value
+// x maps to (x * m) >> w, which is as even as the modulo without a division. The values must
+// then cover all w bits evenly, so a + b * i is taken modulo 2^32, or 2^64 for 64-bit a and
+// b, rather than as is, and since the reduction only reads their high bits, which some
+// hashers leave poorly mixed, a and b are mixed with the splitmix64 finalizer first: the
+// last byte of an item only changes the low bits of its fnv digest, for one. FastRange
+// gives the reduction.
+//
+// If m is a power of two, the modulo is a mask of the low bits of the values, and the
+// multiply-shift a shift of their high bits, which give the same positions without a
+// division or a multiplication, so filters sized to a power of two, see PowerOfTwo, need
+// no flag to be read back.
+//
+// sum is the buffer for the digest, see Sum64.
+func DigestPositions(h hash.Hash, sum []byte, bs []uint, m uint, flags uint16) uint64 {
+	f := DigestFlagsOf(h, m, flags)
+	fast := f&FlagFastRange != 0
+
+	if f&FlagSum128 != 0 {
+		x, y := h.(Hash128).Sum128()
+		v := x
+		for i := range bs {
+			bs[i] = reduce(x, m, fast)
+			x += y
+			y += uint64(i)
+		}
+		return v
+	}
+
+	var (
+		d []byte
+		v uint64
+	)
+
+	if f&(FlagWideDigest|FlagWideIndex) != 0 && h.Size() > 8 {
+		d = h.Sum(sum[:0])
+		v = binary.BigEndian.Uint64(d)
+	} else {
+		v = Sum64(h, sum)
+	}
+
+	if f&FlagWideIndex != 0 {
+		a, b := v, splitmix64(v)
+		if len(d) >= 16 {
+			b = binary.BigEndian.Uint64(d[8:])
+		}
+		if fast {
+			a, b = splitmix64(a), splitmix64(b)
+		}
+
+		if f&FlagEnhanced != 0 {
+			enhanced(bs, reduce(a, m, fast), reduce(b, m, fast), m)
+		}
+
+		for i := range bs {
+			switch {
+			case f&FlagWideDigest != 0 && (i+1)*8 <= len(d):
+				bs[i] = reduce(binary.BigEndian.Uint64(d[i*8:]), m, fast)
+			case f&FlagEnhanced == 0:
+				bs[i] = reduce(a+b*uint64(i), m, fast)
+			}
+		}
+		return v
+	}
+
+	x := v
+	if fast {
+		x = splitmix64(v)
+	}
+	a, b := uint32(x), uint32(x>>32)
+
+	w := 4
+	if uint64(m) > math.MaxUint32 {
+		w = 8
+	}
+
+	if f&FlagEnhanced != 0 {
+		if fast {
+			enhanced(bs, reduce(uint64(a)<<32, m, fast), reduce(uint64(b)<<32, m, fast), m)
+		} else {
+			enhanced(bs, reduce(uint64(a), m, fast), reduce(uint64(b), m, fast), m)
+		}
+	}
+
+	for i := range bs {
+		chunk := f&FlagWideDigest != 0 && (i+1)*w <= len(d)
+		switch {
+		case chunk && w == 8:
+			bs[i] = reduce(binary.BigEndian.Uint64(d[i*8:]), m, fast)
+		case chunk && fast:
+			bs[i] = reduce(uint64(binary.BigEndian.Uint32(d[i*4:]))<<32, m, fast)
+		case chunk:
+			bs[i] = reduce(uint64(binary.BigEndian.Uint32(d[i*4:])), m, fast)
+		case f&FlagEnhanced != 0:
+		case fast:
+			bs[i] = reduce(uint64(a+b*uint32(i))<<32, m, fast)
+		default:
+			bs[i] = reduce(uint64(uint(a)+uint(b)*uint(i)), m, fast)
+		}
+	}
+
+	return v
+}
+
+// enhanced fills bs with the positions (a + b * i + (i^3 - 3i^2 + 2i) / 6) mod m of the
+// enhanced double hashing, for a and b in [0, m). They are computed incrementally, as x
+// and y start at a and b, and after position i, x is incremented by y and y by i, both
+// modulo m by a subtraction rather than a division.
+func enhanced(bs []uint, a, b, m uint) {
+	x, y := a, b
+	for i := range bs {
+		bs[i] = x
+
+		x = addMod(x, y, m)
+
+		inc := uint(i)
+		if inc >= m {
+			inc %= m
+		}
+		y = addMod(y, inc, m)
+	}
+}
+
+// addMod returns (x + y) mod m, for x and y in [0, m) and m up to 2^63. The comparison
+// compiles to a conditional move, as it is taken half the time.
+func addMod(x, y, m uint) uint {
+	s := uint64(x) + uint64(y)
+	if s >= uint64(m) {
+		s -= uint64(m)
+	}
+	return uint(s)
+}
+
+// reduce maps x to [0, m), by multiply-shift if fast, or modulo otherwise. If m is a power
+// of two, they are a shift and a mask.
+func reduce(x uint64, m uint, fast bool) uint {
+	switch {
+	case m&(m-1) == 0 && fast:
+		return uint(x >> (64 - bits.TrailingZeros64(uint64(m))))
+	case m&(m-1) == 0:
+		return uint(x & uint64(m-1))
+	case fast:
+		return FastRange(x, m)
+	}
+	return uint(x % uint64(m))
+}
+
+// FastRange maps x to [0, m) as (x * m) >> 64, the multiply-shift reduction of Lemire. It
+// is as even as x % m if x is uniform over the 64 bits, and doesn't divide. A 32-bit value
+// is reduced as x << 32.
+func FastRange(x uint64, m uint) uint {
+	hi, _ := bits.Mul64(x, uint64(m))
+	return uint(hi)
+}
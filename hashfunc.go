@@ -0,0 +1,187 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"hash"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// Hasher is a hash function returning two 64-bit hash values of item, from which the
+// filters derive the positions of item with Positions. Unlike a hash.Hash, it holds no
+// state, so it can be called concurrently without a hasher per goroutine, and hashing an
+// item is a single call rather than the Reset, Write and Sum calls of a hash.Hash.
+//
+// The filters taking a hash.Hash accept a Hasher through SetHashFunc, which wraps it with
+// Hash. FNV1a, Murmur3 and XXHash are built in, and registered with RegisterHasher as
+// fnv1a-func, murmur3-func and xxhash-func, so filters using them by name can be loaded.
+type Hasher func(item []byte) (uint64, uint64)
+
+// Names of the built-in Hashers, for SetNamedHasher.
+const (
+	FNV1aFunc   = "fnv1a-func"
+	Murmur3Func = "murmur3-func"
+	XXHashFunc  = "xxhash-func"
+)
+
+func init() {
+	RegisterHashFunc(FNV1aFunc, FNV1a)
+	RegisterHashFunc(Murmur3Func, Murmur3)
+	RegisterHashFunc(XXHashFunc, XXHash)
+}
+
+// RegisterHashFunc registers f as name with RegisterHasher, wrapped with Hash.
+func RegisterHashFunc(name string, f Hasher) {
+	RegisterHasher(name, f.Hash)
+}
+
+// Positions fills bs with positions in [0, m) for item. With the hash values a and b of
+// item, position i is (a + b * i) mod m, following Kirsch and Mitzenmacher.
+func (f Hasher) Positions(item []byte, bs []uint, m uint) {
+	a, b := f(item)
+	for i := range bs {
+		bs[i] = uint((a + b*uint64(i)) % uint64(m))
+	}
+}
+
+// Hash returns f as a hash.Hash, for the filters and functions taking one. The hash.Hash
+// implements Locator with Positions, so the filters supporting Locator hash an item with a
+// single call to f. The others hash the bytes written to it, which it keeps until Reset,
+// and read the first value of f as an 8 byte digest, or with Sum64.
+func (f Hasher) Hash() hash.Hash {
+	return &funcHash{f: f}
+}
+
+// HashFuncOf returns the Hasher wrapped by h if h was returned by Hasher.Hash, nil
+// otherwise.
+func HashFuncOf(h hash.Hash) Hasher {
+	if fh, ok := h.(*funcHash); ok {
+		return fh.f
+	}
+	return nil
+}
+
+// FromHash adapts h, registered as name if name is not empty, into a Hasher, for code
+// taking a Hasher. The Hasher hashes each item with a clone of h taken from a HasherPool,
+// so it can be called concurrently like the built-in ones, but it keeps the cost of a
+// hash.Hash. The first value is the digest of h as read by Sum64, the second is derived
+// from it. If h was returned by Hasher.Hash, the Hasher it wraps is returned.
+func FromHash(name string, h hash.Hash) Hasher {
+	if f := HashFuncOf(h); f != nil {
+		return f
+	}
+
+	pool := NewHasherPool(name, h)
+	return func(item []byte) (uint64, uint64) {
+		s := pool.Get()
+		s.H.Reset()
+		s.H.Write(item)
+		v := Sum64(s.H, s.Sum[:])
+		pool.Put(s)
+		return v, splitmix64(v)
+	}
+}
+
+// FNV1a hashes item with 64-bit FNV-1a. The first value is the FNV-1a hash mixed with the
+// finalizer of MurmurHash3, as the low bits of FNV-1a depend little on the last bytes of
+// item, and the second is the hash mixed with the splitmix64 finalizer.
+func FNV1a(item []byte) (uint64, uint64) {
+	v := uint64(14695981039346656037)
+	for _, c := range item {
+		v ^= uint64(c)
+		v *= 1099511628211
+	}
+
+	return Mix64(v), splitmix64(v)
+}
+
+// Murmur3 hashes item with the 128-bit MurmurHash3, returning its two halves.
+func Murmur3(item []byte) (uint64, uint64) {
+	return murmur3.Sum128(item)
+}
+
+// XXHash hashes item with XXH64 and a seed of 0. The first value is the XXH64 hash of item,
+// the second is the hash mixed with the splitmix64 finalizer.
+func XXHash(item []byte) (uint64, uint64) {
+	v := xxh64(item, 0)
+	return v, splitmix64(v)
+}
+
+// funcHash wraps a Hasher as a hash.Hash, see Hasher.Hash.
+type funcHash struct {
+	f   Hasher
+	buf []byte
+}
+
+var (
+	_ Locator     = (*funcHash)(nil)
+	_ hash.Hash64 = (*funcHash)(nil)
+	_ hash.Cloner = (*funcHash)(nil)
+)
+
+func (this *funcHash) Locate(item []byte, bs []uint, m uint) {
+	this.f.Positions(item, bs, m)
+}
+
+func (this *funcHash) Write(p []byte) (int, error) {
+	this.buf = append(this.buf, p...)
+	return len(p), nil
+}
+
+func (this *funcHash) Sum64() uint64 {
+	v, _ := this.f(this.buf)
+	return v
+}
+
+func (this *funcHash) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, this.Sum64())
+}
+
+func (this *funcHash) Reset() {
+	this.buf = this.buf[:0]
+}
+
+func (this *funcHash) Size() int {
+	return 8
+}
+
+func (this *funcHash) BlockSize() int {
+	return 1
+}
+
+func (this *funcHash) Clone() (hash.Cloner, error) {
+	return &funcHash{f: this.f}, nil
+}
+
+// Mix64 applies the 64-bit finalizer of MurmurHash3 to v, so every bit of the result
+// depends on every bit of v. The filters hashing with FNV, whose low bits depend little on
+// the last bytes of an item, mix the digest with it before deriving slots or fingerprints.
+func Mix64(v uint64) uint64 {
+	v ^= v >> 33
+	v *= 0xff51afd7ed558ccd
+	v ^= v >> 33
+	v *= 0xc4ceb9fe1a85ec53
+	return v ^ v>>33
+}
+
+// splitmix64 is the finalizer of the splitmix64 generator, applied to v.
+func splitmix64(v uint64) uint64 {
+	v += 0x9e3779b97f4a7c15
+	v = (v ^ v>>30) * 0xbf58476d1ce4e5b9
+	v = (v ^ v>>27) * 0x94d049bb133111eb
+	return v ^ v>>31
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hbase reads the bloom filter chunks stored in HBase HFiles, and answers Check
+// the way HBase does.
+//
+// HBase splits the bloom filter of an HFile into chunks, each stored in a BLMFBLK2 block
+// and holding a plain bit array. The number of hash functions and the hash type are
+// recorded in the bloom meta block of the file, and must be passed by the caller. Bit
+// positions are derived from h1 = hash(key, 0) and h2 = hash(key, h1) as
+// |(h1 + i*h2) % m| in signed 32-bit arithmetic.
+//
+// Keys are hashed as given. For ROW blooms they are the row keys, and for ROWCOL blooms
+// the caller must build the key the way HBase does.
+package hbase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// HashType is the hash function of a filter, as in org.apache.hadoop.hbase.util.Hash.
+type HashType int
+
+const (
+	JenkinsHash HashType = iota
+	MurmurHash
+	MurmurHash3
+)
+
+const (
+	// BlockMagic starts the header of the blocks holding bloom chunks.
+	BlockMagic = "BLMFBLK2"
+
+	// blockHeaderSize is the size of an HFile v2 block header with checksums.
+	blockHeaderSize = 33
+)
+
+// Filter is a read-only bloom filter chunk. It has no Add method, so it does not
+// implement bloom.Bloom.
+type Filter struct {
+	// b is the bit array, with bit i in bit i%8 of byte i/8
+	b []byte
+
+	// k is the number of hash functions
+	k int
+
+	hash func(key []byte, seed int32) int32
+}
+
+// New returns a filter over chunk, the bit array of a bloom chunk. chunk is not copied.
+func New(chunk []byte, hashCount int, hashType HashType) (*Filter, error) {
+	if len(chunk) == 0 || hashCount <= 0 {
+		return nil, fmt.Errorf("hbase: invalid parameters size = %d, k = %d", len(chunk), hashCount)
+	}
+
+	this := &Filter{b: chunk, k: hashCount}
+
+	switch hashType {
+	case JenkinsHash:
+		this.hash = jenkins
+	case MurmurHash:
+		this.hash = murmur
+	case MurmurHash3:
+		this.hash = func(key []byte, seed int32) int32 {
+			return int32(murmur3.Sum32WithSeed(key, uint32(seed)))
+		}
+	default:
+		return nil, fmt.Errorf("hbase: unknown hash type %d", hashType)
+	}
+
+	return this, nil
+}
+
+// ReadBlock returns a filter over the bloom chunk held by block, an uncompressed HFile v2
+// BLMFBLK2 block including its header. CRC32 and CRC32C checksums are verified.
+func ReadBlock(block []byte, hashCount int, hashType HashType) (*Filter, error) {
+	if len(block) < blockHeaderSize || string(block[:8]) != BlockMagic {
+		return nil, fmt.Errorf("hbase: not a %s block", BlockMagic)
+	}
+
+	onDisk := int(int32(binary.BigEndian.Uint32(block[8:12])))
+	checksumType := block[24]
+	bytesPerChecksum := int(int32(binary.BigEndian.Uint32(block[25:29])))
+	dataSize := int(int32(binary.BigEndian.Uint32(block[29:33])))
+
+	if dataSize < blockHeaderSize || onDisk+blockHeaderSize > len(block) || dataSize > onDisk+blockHeaderSize {
+		return nil, fmt.Errorf("hbase: invalid block sizes %d and %d for %d bytes", onDisk, dataSize, len(block))
+	}
+
+	var tab *crc32.Table
+	switch checksumType {
+	case 0:
+	case 1:
+		tab = crc32.IEEETable
+	case 2:
+		tab = crc32.MakeTable(crc32.Castagnoli)
+	default:
+		return nil, fmt.Errorf("hbase: unknown checksum type %d", checksumType)
+	}
+
+	if tab != nil {
+		if bytesPerChecksum <= 0 {
+			return nil, fmt.Errorf("hbase: invalid bytes per checksum %d", bytesPerChecksum)
+		}
+
+		sums := block[dataSize : onDisk+blockHeaderSize]
+		for i := 0; i < dataSize; i += bytesPerChecksum {
+			end := min(i+bytesPerChecksum, dataSize)
+			if len(sums) < 4 {
+				return nil, fmt.Errorf("hbase: missing block checksum")
+			}
+
+			if crc32.Checksum(block[i:end], tab) != binary.BigEndian.Uint32(sums) {
+				return nil, fmt.Errorf("hbase: block checksum mismatch at offset %d", i)
+			}
+			sums = sums[4:]
+		}
+	}
+
+	return New(block[blockHeaderSize:dataSize], hashCount, hashType)
+}
+
+// Check reports whether key may be in the chunk.
+func (this *Filter) Check(key []byte) bool {
+	h1 := this.hash(key, 0)
+	h2 := this.hash(key, h1)
+
+	m := int32(len(this.b) << 3)
+	h := h1
+	for i := 0; i < this.k; i++ {
+		v := h % m
+		if v < 0 {
+			v = -v
+		}
+
+		if this.b[v>>3]&(1<<(v&7)) == 0 {
+			return false
+		}
+
+		h += h2
+	}
+
+	return true
+}
+
+func (this *Filter) FillRatio() float64 {
+	return float64(this.count()) / float64(len(this.b)*8)
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *Filter) WriteStats(w io.Writer) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "m = %d, k = %d\n", len(this.b)*8, this.k)
+	c := this.count()
+	fmt.Fprintf(&buf, "Total bits set: %d (%.1f%%)\n", c, float32(c)/float32(len(this.b)*8)*100)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use WriteStats to write them elsewhere.
+func (this *Filter) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func (this *Filter) count() uint {
+	c := uint(0)
+	for _, v := range this.b {
+		for ; v != 0; v &= v - 1 {
+			c++
+		}
+	}
+	return c
+}
+
+// jenkins is org.apache.hadoop.hbase.util.JenkinsHash, Bob Jenkins' lookup3 hashlittle.
+func jenkins(key []byte, seed int32) int32 {
+	n := len(key)
+	a := 0xdeadbeef + uint32(n) + uint32(seed)
+	b, c := a, a
+
+	for ; n > 12; key, n = key[12:], n-12 {
+		a += binary.LittleEndian.Uint32(key[0:4])
+		b += binary.LittleEndian.Uint32(key[4:8])
+		c += binary.LittleEndian.Uint32(key[8:12])
+
+		a -= c
+		a ^= bits.RotateLeft32(c, 4)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 6)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 8)
+		b += a
+		a -= c
+		a ^= bits.RotateLeft32(c, 16)
+		c += b
+		b -= a
+		b ^= bits.RotateLeft32(a, 19)
+		a += c
+		c -= b
+		c ^= bits.RotateLeft32(b, 4)
+		b += a
+	}
+
+	if n == 0 {
+		return int32(c)
+	}
+
+	var tail [12]byte
+	copy(tail[:], key)
+	a += binary.LittleEndian.Uint32(tail[0:4])
+	b += binary.LittleEndian.Uint32(tail[4:8])
+	c += binary.LittleEndian.Uint32(tail[8:12])
+
+	c ^= b
+	c -= bits.RotateLeft32(b, 14)
+	a ^= c
+	a -= bits.RotateLeft32(c, 11)
+	b ^= a
+	b -= bits.RotateLeft32(a, 25)
+	c ^= b
+	c -= bits.RotateLeft32(b, 16)
+	a ^= c
+	a -= bits.RotateLeft32(c, 4)
+	b ^= a
+	b -= bits.RotateLeft32(a, 14)
+	c ^= b
+	c -= bits.RotateLeft32(b, 24)
+
+	return int32(c)
+}
+
+// murmur is org.apache.hadoop.hbase.util.MurmurHash, MurmurHash2 with the trailing bytes
+// sign extended.
+func murmur(key []byte, seed int32) int32 {
+	const (
+		m = 0x5bd1e995
+		r = 24
+	)
+
+	n := len(key)
+	h := uint32(seed) ^ uint32(n)
+
+	for ; len(key) >= 4; key = key[4:] {
+		k := binary.LittleEndian.Uint32(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h *= m
+		h ^= k
+	}
+
+	if len(key) > 0 {
+		if len(key) >= 3 {
+			h ^= uint32(int32(int8(key[2]))) << 16
+		}
+		if len(key) >= 2 {
+			h ^= uint32(int32(int8(key[1]))) << 8
+		}
+		h ^= uint32(int32(int8(key[0])))
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
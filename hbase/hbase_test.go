@@ -0,0 +1,123 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbase
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The fixtures in testdata hold 200 keys each, and the keys.txt files list the hex encoded
+// keys checked against them, prefixed with + if the filter matches them and - otherwise,
+// with keys with bytes above 0x7f to cover the sign extension of MurmurHash.
+//
+// The fixtures were not written by HBase, but by an independent model of its
+// BloomFilterChunk, JenkinsHash and MurmurHash. They check the reader against that model,
+// and TestJenkins checks the hash against the vectors of lookup3.c, but neither checks
+// compatibility with HBase itself. To do so, put the keys marked + as rows of a table with
+// BLOOMFILTER => 'ROW', flush it, copy a BLMFBLK2 block of the HFile to
+// testdata/jenkins.block, or its bit array to testdata/murmur.chunk, and record the hash
+// count and type of the bloom meta block and the HBase version here.
+func checkKeys(t *testing.T, bf *Filter, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, err := hex.DecodeString(line[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bf.Check(key) != (line[0] == '+') {
+			t.Fatalf("%s: Check(%q) = %t, want %t", path, key, !(line[0] == '+'), line[0] == '+')
+		}
+		n++
+	}
+
+	if n != 700 {
+		t.Fatalf("%s: checked %d keys, want 700", path, n)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	chunk, err := os.ReadFile("testdata/murmur.chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf, err := New(chunk, 5, MurmurHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := bf.WriteStats(&buf); err != nil || !strings.HasPrefix(buf.String(), fmt.Sprintf("m = %d, k = 5\n", len(chunk)*8)) {
+		t.Errorf("Expected the stats to start with m and k, got %q, %v", buf.String(), err)
+	}
+
+	checkKeys(t, bf, "testdata/murmur-keys.txt")
+
+	if _, err := New(chunk, 5, 3); err == nil {
+		t.Fatalf("New with unknown hash type succeeded")
+	}
+}
+
+func TestReadBlock(t *testing.T) {
+	block, err := os.ReadFile("testdata/jenkins.block")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf, err := ReadBlock(block, 5, JenkinsHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkKeys(t, bf, "testdata/jenkins-keys.txt")
+
+	block[100] ^= 1
+	if _, err := ReadBlock(block, 5, JenkinsHash); err == nil {
+		t.Fatalf("ReadBlock with corrupt data succeeded")
+	}
+
+	if _, err := ReadBlock(block[:20], 5, JenkinsHash); err == nil {
+		t.Fatalf("ReadBlock of truncated block succeeded")
+	}
+}
+
+func TestJenkins(t *testing.T) {
+	// Vectors from lookup3.c
+	s := []byte("Four score and seven years ago")
+	if h := uint32(jenkins(nil, 0)); h != 0xdeadbeef {
+		t.Fatalf("jenkins(\"\", 0) = %#x", h)
+	}
+	if h := uint32(jenkins(s, 0)); h != 0x17770551 {
+		t.Fatalf("jenkins(%q, 0) = %#x", s, h)
+	}
+	if h := uint32(jenkins(s, 1)); h != 0xcd628161 {
+		t.Fatalf("jenkins(%q, 1) = %#x", s, h)
+	}
+}
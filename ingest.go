@@ -0,0 +1,194 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Positioner is implemented by filters that can split Add in two: hashing a key into its bit
+// positions, which doesn't write to the filter and is safe to call concurrently, and setting
+// the bits at those positions. Ingest uses it to hash keys in parallel.
+type Positioner interface {
+	// Positions appends the bit positions of key to bs and returns the result. They are
+	// only meaningful to AddPositions of the same filter, as long as its parameters and
+	// hasher are unchanged.
+	Positions(key []byte, bs []uint) []uint
+
+	// AddPositions adds an item given its bit positions, as returned by Positions.
+	AddPositions(bs []uint)
+}
+
+// ingestBatch is the maximum number of keys a worker of Ingest hashes before handing their
+// positions to the writer.
+const ingestBatch = 256
+
+// batch holds the positions of up to ingestBatch keys. The positions of key i are
+// pos[ends[i-1]:ends[i]].
+type batch struct {
+	pos  []uint
+	ends []int
+}
+
+// Ingest adds the keys received from keys to bf until keys is closed or ctx is done, and
+// returns the number of keys added. If ctx is done first, it returns ctx.Err() as well.
+//
+// If bf implements Positioner, keys are hashed by workers goroutines, or GOMAXPROCS if
+// workers is less than 1, and the bits are set by a single goroutine, so bf doesn't need to
+// be safe for concurrent use. Otherwise the keys are added by a single goroutine calling
+// Add. Either way, bf must not be used by others until Ingest returns, unless it is safe for
+// concurrent use, and the keys must not be modified after being sent.
+func Ingest(ctx context.Context, bf Bloom, keys <-chan []byte, workers int) (uint64, error) {
+	p, ok := bf.(Positioner)
+	if !ok {
+		return ingest(ctx, bf, keys)
+	}
+
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		batches = make(chan *batch, workers)
+		free    = sync.Pool{New: func() interface{} { return &batch{} }}
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hashKeys(ctx, p, keys, batches, &free)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	var (
+		n   uint64
+		err error
+	)
+
+	for b := range batches {
+		if err == nil {
+			err = ctx.Err()
+		}
+
+		// After ctx is done, the remaining batches are dropped until the workers have exited.
+		if err != nil {
+			continue
+		}
+
+		start := 0
+		for _, end := range b.ends {
+			p.AddPositions(b.pos[start:end])
+			start = end
+		}
+		n += uint64(len(b.ends))
+
+		free.Put(b)
+	}
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	return n, err
+}
+
+// ingest adds the keys one at a time, for filters that don't implement Positioner.
+func ingest(ctx context.Context, bf Bloom, keys <-chan []byte) (uint64, error) {
+	var n uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+
+		case key, ok := <-keys:
+			if !ok {
+				return n, nil
+			}
+			bf.Add(key)
+			n++
+		}
+	}
+}
+
+// hashKeys hashes the keys received from keys until it's closed or ctx is done, sending
+// their positions to batches. A batch is sent once it's full, or when no key is ready, so
+// keys arriving slowly are not held back.
+func hashKeys(ctx context.Context, p Positioner, keys <-chan []byte, batches chan<- *batch, free *sync.Pool) {
+	var b *batch
+
+	send := func() bool {
+		select {
+		case batches <- b:
+			b = nil
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		var (
+			key []byte
+			ok  bool
+		)
+
+		if b == nil {
+			select {
+			case key, ok = <-keys:
+			case <-ctx.Done():
+				return
+			}
+		} else {
+			select {
+			case key, ok = <-keys:
+			case <-ctx.Done():
+				return
+			default:
+				if !send() {
+					return
+				}
+				continue
+			}
+		}
+
+		if !ok {
+			if b != nil {
+				send()
+			}
+			return
+		}
+
+		if b == nil {
+			b = free.Get().(*batch)
+			b.pos, b.ends = b.pos[:0], b.ends[:0]
+		}
+
+		b.pos = p.Positions(key, b.pos)
+		b.ends = append(b.ends, len(b.pos))
+
+		if len(b.ends) == ingestBatch && !send() {
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+	"github.com/zhenjl/bloom/scalable"
+	"github.com/zhenjl/bloom/standard"
+)
+
+func ingestKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = binary.BigEndian.AppendUint64(nil, uint64(i))
+	}
+	return keys
+}
+
+func TestIngest(t *testing.T) {
+	keys := ingestKeys(100000)
+
+	filters := map[string]bloom.Bloom{
+		"standard":    standard.New(uint(len(keys))),
+		"partitioned": partitioned.New(uint(len(keys))),
+		"scalable":    scalable.New(10000),
+	}
+
+	for name, bf := range filters {
+		ch := make(chan []byte, 100)
+		go func() {
+			for _, k := range keys {
+				ch <- k
+			}
+			close(ch)
+		}()
+
+		n, err := bloom.Ingest(context.Background(), bf, ch, 4)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if n != uint64(len(keys)) || bf.Count() != n {
+			t.Errorf("%s: Ingested %d keys, count %d, expected %d", name, n, bf.Count(), len(keys))
+		}
+
+		for _, k := range keys {
+			if !bf.Check(k) {
+				t.Fatalf("%s: Expected to find %x", name, k)
+			}
+		}
+	}
+}
+
+func TestIngestCancel(t *testing.T) {
+	keys := ingestKeys(1000)
+
+	for _, bf := range []bloom.Bloom{standard.New(1000), scalable.New(1000)} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// The channel is never closed, so only cancel stops Ingest.
+		ch := make(chan []byte)
+		go func() {
+			for _, k := range keys {
+				ch <- k
+			}
+			cancel()
+		}()
+
+		n, err := bloom.Ingest(ctx, bf, ch, 4)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+
+		if n != bf.Count() || n > uint64(len(keys)) {
+			t.Errorf("Ingested %d keys, count %d", n, bf.Count())
+		}
+	}
+}
+
+func BenchmarkIngest(b *testing.B) {
+	keys := ingestKeys(1 << 16)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			bf := standard.New(uint(b.N))
+			ch := make(chan []byte, 1024)
+
+			go func() {
+				for i := 0; i < b.N; i++ {
+					ch <- keys[i%len(keys)]
+				}
+				close(ch)
+			}()
+
+			b.ResetTimer()
+			if _, err := bloom.Ingest(context.Background(), bf, ch, workers); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
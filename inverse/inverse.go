@@ -0,0 +1,108 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inverse implements an inverse bloom filter: a filter with false negatives but no
+// false positives, answering whether an item was seen recently.
+package inverse
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+// InverseBloom remembers the last items observed in an array of slots, each item going to
+// the slot its hash selects. An item replaces the one already in its slot, so a collision
+// makes the filter forget that item: Observe may report an item as new when it was seen
+// already, but never reports an item it hasn't seen. It makes a cheap first pass at
+// dropping duplicates, in front of a bloom filter or a store catching the rest.
+//
+// The slots hold pointers to copies of the items, swapped atomically, so InverseBloom is
+// safe for concurrent use without locks. Observe allocates a copy of each new item.
+type InverseBloom struct {
+	// slots holds the last item observed in each slot, nil if none
+	slots []atomic.Pointer[[]byte]
+}
+
+// New initializes a new inverse bloom filter with capacity slots, or 1 if capacity is 0.
+// With capacity slots, two items collide with probability 1 / capacity.
+func New(capacity uint) *InverseBloom {
+	if capacity == 0 {
+		capacity = 1
+	}
+	return &InverseBloom{slots: make([]atomic.Pointer[[]byte], capacity)}
+}
+
+// Observe records item, and reports whether it was already in its slot, which is the case if
+// item was the last item observed in the slot. It never returns true for an item that wasn't
+// observed before. The filter keeps a copy of item, so it can be modified afterwards.
+func (this *InverseBloom) Observe(item []byte) bool {
+	slot := &this.slots[this.index(item)]
+
+	// A duplicate is found without copying it
+	if old := slot.Load(); old != nil && bytes.Equal(*old, item) {
+		return true
+	}
+
+	// The slot may have changed since it was loaded, so the swap reports the item another
+	// goroutine stored in the meantime, possibly item itself
+	b := bytes.Clone(item)
+	old := slot.Swap(&b)
+	return old != nil && bytes.Equal(*old, item)
+}
+
+// ObserveString is the same as Observe([]byte(s)), without copying s unless it's new.
+func (this *InverseBloom) ObserveString(s string) bool {
+	return this.Observe(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Check reports whether item is in its slot, without recording it.
+func (this *InverseBloom) Check(item []byte) bool {
+	old := this.slots[this.index(item)].Load()
+	return old != nil && bytes.Equal(*old, item)
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *InverseBloom) CheckString(s string) bool {
+	return this.Check(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Capacity returns the number of slots.
+func (this *InverseBloom) Capacity() uint {
+	return uint(len(this.slots))
+}
+
+// Reset empties the slots. Items observed concurrently may be kept.
+func (this *InverseBloom) Reset() {
+	for i := range this.slots {
+		this.slots[i].Store(nil)
+	}
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *InverseBloom) String() string {
+	return fmt.Sprintf("inverse{capacity=%d}", len(this.slots))
+}
+
+// index returns the slot of item, mapping the first hash of bloom.FNV1a to the slots by
+// multiplication rather than modulo.
+func (this *InverseBloom) index(item []byte) uint64 {
+	h, _ := bloom.FNV1a(item)
+	i, _ := bits.Mul64(h, uint64(len(this.slots)))
+	return i
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inverse
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestInverseBloom(t *testing.T) {
+	bf := New(uint(len(web2)))
+
+	for _, w := range web2 {
+		if bf.ObserveString(w) {
+			t.Fatalf("Expected %q to be new", w)
+		}
+
+		if !bf.ObserveString(w) {
+			t.Fatalf("Expected %q to be a duplicate right after observing it", w)
+		}
+	}
+
+	// Items overwritten by a collision are forgotten
+	fn := 0
+	for _, w := range web2 {
+		if !bf.CheckString(w) {
+			fn++
+		}
+	}
+
+	fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
+	if fn == 0 || fn > len(web2)/2 {
+		t.Errorf("%d items forgotten out of %d", fn, len(web2))
+	}
+
+	seen := make(map[string]bool, len(web2))
+	for _, w := range web2 {
+		seen[w] = true
+	}
+
+	for _, w := range web2a {
+		if !seen[w] && (bf.CheckString(w) || bf.ObserveString(w)) {
+			t.Fatalf("False positive for %q", w)
+		}
+	}
+
+	bf.Reset()
+	if bf.CheckString(web2a[len(web2a)-1]) {
+		t.Errorf("Expected an empty filter after Reset")
+	}
+}
+
+func TestObserveCopies(t *testing.T) {
+	bf := New(16)
+
+	item := []byte("foo")
+	bf.Observe(item)
+	item[0] = 'b'
+
+	if !bf.CheckString("foo") || bf.CheckString("boo") {
+		t.Errorf("Expected the filter to keep a copy of the item")
+	}
+}
+
+// TestConcurrent observes the same items from several goroutines. The first observer of an
+// item never sees it as a duplicate. Run it with -race.
+func TestConcurrent(t *testing.T) {
+	const (
+		workers = 8
+		items   = 10000
+	)
+
+	bf := New(1 << 12)
+	dups := make([]atomic.Int32, items)
+
+	var wg sync.WaitGroup
+	for g := 0; g < workers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			for i := 0; i < items; i++ {
+				if bf.ObserveString(strconv.Itoa(i)) {
+					dups[i].Add(1)
+				}
+
+				// Items only this goroutine observes are never duplicates
+				if bf.ObserveString(strconv.Itoa(g) + "/" + strconv.Itoa(i)) {
+					t.Errorf("False positive for %d/%d", g, i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := range dups {
+		if n := dups[i].Load(); n >= workers {
+			t.Fatalf("Item %d reported as a duplicate %d times by %d goroutines", i, n, workers)
+		}
+	}
+}
+
+func BenchmarkObserve(b *testing.B) {
+	bf := New(1 << 16)
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			bf.ObserveString(web2[i%len(web2)])
+		}
+	})
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package layered implements a layered bloom filter, which estimates how many times each
+// item was added, up to a limit.
+package layered
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// LayeredBloom is a stack of L standard filters. Add adds an item to the first layer that
+// doesn't contain it, so layer i holds the items added more than i times, and CountEstimate
+// returns the number of consecutive layers containing an item from the bottom. It answers
+// whether an item was added at least 1 to L times.
+//
+// CountEstimate never underestimates the number of times an item was added, up to L. The
+// false positives of the layers overestimate it though: an item added i times is reported
+// i+1 times or more if it is a false positive of layer i, with a probability of at most e,
+// and Add then adds it to a higher layer, so the overestimate stays. Each layer holds a
+// subset of the items of the layer below, so an item never added is reported i times with
+// a probability of at most e as well.
+//
+// An item added more than L times is in every layer, and CountEstimate returns L. Add then
+// counts it as an overflow, see Overflow.
+//
+// LayeredBloom is not safe for concurrent use.
+type LayeredBloom struct {
+	// layers holds the filter of each layer, bottom first
+	layers []*standard.StandardBloom
+
+	// overflow is the number of items added while already in every layer
+	overflow uint64
+}
+
+// New initializes a new layered bloom filter of l layers, each a standard filter for n
+// distinct items with a false positive probability of e, so CountEstimate overestimates by
+// one or more with a probability of at most e. The items added more than i times are a
+// subset of the n items, but since how many is unknown, each layer is sized for all of them.
+// l is at least 1.
+func New(n uint, e float64, l int) *LayeredBloom {
+	if l < 1 {
+		l = 1
+	}
+
+	bf := &LayeredBloom{layers: make([]*standard.StandardBloom, l)}
+	for i := range bf.layers {
+		bf.layers[i] = standard.NewWithEstimates(n, e).(*standard.StandardBloom)
+	}
+
+	return bf
+}
+
+// Layers returns the number of layers L, the highest count CountEstimate returns.
+func (this *LayeredBloom) Layers() int {
+	return len(this.layers)
+}
+
+// Layer returns the filter of layer i, which must be in [0, Layers()). It holds the items
+// added more than i times.
+func (this *LayeredBloom) Layer(i int) *standard.StandardBloom {
+	return this.layers[i]
+}
+
+// Add adds item to the first layer that doesn't contain it. If every layer contains it, it
+// counts an overflow instead.
+func (this *LayeredBloom) Add(item []byte) *LayeredBloom {
+	for _, bf := range this.layers {
+		if !bf.Check(item) {
+			bf.Add(item)
+			return this
+		}
+	}
+
+	this.overflow++
+	return this
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *LayeredBloom) AddString(s string) *LayeredBloom {
+	return this.Add(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Check returns true if item may have been added at least once.
+func (this *LayeredBloom) Check(item []byte) bool {
+	return this.layers[0].Check(item)
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *LayeredBloom) CheckString(s string) bool {
+	return this.Check(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// CountEstimate returns the number of consecutive layers containing item from the bottom,
+// an estimate of the number of times it was added, from 0 to L.
+func (this *LayeredBloom) CountEstimate(item []byte) int {
+	for i, bf := range this.layers {
+		if !bf.Check(item) {
+			return i
+		}
+	}
+	return len(this.layers)
+}
+
+// CountEstimateString is the same as CountEstimate([]byte(s)), without copying s.
+func (this *LayeredBloom) CountEstimateString(s string) int {
+	return this.CountEstimate(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Overflow returns the number of times Add was called with an item already in every layer,
+// and therefore not counted any further.
+func (this *LayeredBloom) Overflow() uint64 {
+	return this.overflow
+}
+
+// Count returns the number of items added, including the overflows.
+func (this *LayeredBloom) Count() uint64 {
+	c := this.overflow
+	for _, bf := range this.layers {
+		c += bf.Count()
+	}
+	return c
+}
+
+// LayerStats returns the statistics of each layer, bottom first.
+func (this *LayeredBloom) LayerStats() []bloom.Stats {
+	stats := make([]bloom.Stats, len(this.layers))
+	for i, bf := range this.layers {
+		stats[i] = bf.Stats()
+	}
+	return stats
+}
+
+// Clear removes all the items from every layer, and resets the overflow count.
+func (this *LayeredBloom) Clear() {
+	for _, bf := range this.layers {
+		bf.Clear()
+	}
+	this.overflow = 0
+}
+
+// Clone returns a deep copy of the filter, cloning each layer. It returns an error if the
+// hasher can't be recreated, see bloom.CloneHasher.
+func (this *LayeredBloom) Clone() (*LayeredBloom, error) {
+	bf := &LayeredBloom{
+		layers:   make([]*standard.StandardBloom, len(this.layers)),
+		overflow: this.overflow,
+	}
+
+	for i := range this.layers {
+		c, err := this.layers[i].Clone()
+		if err != nil {
+			return nil, err
+		}
+		bf.layers[i] = c.(*standard.StandardBloom)
+	}
+
+	return bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter and all its layers. The memory
+// held by the hashers is not included.
+func (this *LayeredBloom) MemoryUsage() uint64 {
+	t := uint64(unsafe.Sizeof(*this)) + uint64(cap(this.layers))*uint64(unsafe.Sizeof(this.layers[0]))
+	for _, bf := range this.layers {
+		t += bf.MemoryUsage()
+	}
+	return t
+}
+
+// String implements fmt.Stringer with a one line summary of the filter, with the count of
+// each layer.
+func (this *LayeredBloom) String() string {
+	counts := make([]uint64, len(this.layers))
+	for i, bf := range this.layers {
+		counts[i] = bf.Count()
+	}
+	return fmt.Sprintf("layered{layers=%d m=%d counts=%v overflow=%d}", len(this.layers), this.layers[0].M(), counts, this.overflow)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package layered
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"testing"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+// TestCountEstimate adds word i of web2 i%6 times to a filter of 4 layers, and checks that
+// the counts are never underestimated, rarely overestimated, and capped at 4 with the
+// extra adds counted as overflows.
+func TestCountEstimate(t *testing.T) {
+	const l, e = 4, 0.001
+
+	bf := New(uint(len(web2)), e, l)
+	for r := 1; r <= 5; r++ {
+		for i, w := range web2 {
+			if i%6 >= r {
+				bf.AddString(w)
+			}
+		}
+	}
+
+	over, overflow := 0, uint64(0)
+	for i, w := range web2 {
+		want := min(i%6, l)
+		overflow += uint64(max(i%6-l, 0))
+
+		switch c := bf.CountEstimateString(w); {
+		case c < want:
+			t.Fatalf("%q added %d times, estimated %d", w, i%6, c)
+		case c > want:
+			over++
+		}
+	}
+
+	unseen := 0
+	for _, w := range web2a {
+		if bf.CountEstimateString(w) > 0 {
+			unseen++
+		}
+	}
+
+	fmt.Printf("%v\n", bf)
+	fmt.Printf("Overestimated: %d (%.4f%%), unseen items counted: %d (%.4f%%)\n",
+		over, float64(over)/float64(len(web2))*100, unseen, float64(unseen)/float64(len(web2a))*100)
+
+	if float64(over) > 2*e*float64(len(web2)) || float64(unseen) > 2*e*float64(len(web2a)) {
+		t.Errorf("%d overestimates and %d unseen items counted, expected at most %g%%", over, unseen, e*100)
+	}
+
+	// Overestimated items may overflow earlier
+	if bf.Overflow() < overflow || bf.Overflow() > overflow+uint64(over) {
+		t.Errorf("%d overflows, expected %d", bf.Overflow(), overflow)
+	}
+
+	var added uint64
+	for i := range web2 {
+		added += uint64(i % 6)
+	}
+	if bf.Count() != added {
+		t.Errorf("Count %d, expected %d", bf.Count(), added)
+	}
+}
+
+func TestClear(t *testing.T) {
+	bf := New(1000, 0.001, 2)
+	bf.AddString("foo").AddString("foo").AddString("foo")
+
+	if c := bf.CountEstimateString("foo"); c != 2 || bf.Overflow() != 1 {
+		t.Errorf("Count estimate %d with %d overflows, expected 2 and 1", c, bf.Overflow())
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf.Clear()
+	if bf.CheckString("foo") || bf.Overflow() != 0 || bf.Count() != 0 {
+		t.Errorf("Cleared filter: %v", bf)
+	}
+
+	if c.CountEstimateString("foo") != 2 || c.Overflow() != 1 {
+		t.Errorf("Clone changed by Clear: %v", c)
+	}
+}
@@ -15,14 +15,18 @@
 package partitioned
 
 import (
+	"bytes"
 	"fmt"
 	"hash"
 	"hash/fnv"
 
 	"encoding/binary"
+	"io"
 	"math"
+	mathbits "math/bits"
+	"os"
+	"unsafe"
 
-	"github.com/willf/bitset"
 	"github.com/zhenjl/bloom"
 )
 
@@ -70,76 +74,427 @@ type PartitionedBloom struct {
 	n uint
 
 	// c is the number of items we have added to the filter
-	c uint
+	c uint64
 
 	// s is the size of the partition, or slice.
 	// s = m / k
 	s uint
 
-	// b is the set of bit array holding the bloom filters. There will be k b's.
-	b []*bitset.BitSet
+	// words holds the bits of the k partitions in a single array. Partition i is held by the
+	// w words from i*w, its s bits rounded up to a whole word, so the bits of each partition
+	// are laid out and written as if it had an array of its own.
+	words []uint64
+	w     uint
 
 	// bs holds the list of bits to be set/check based on the hash values
 	bs []uint
+
+	// sum holds the digest of the last item, so hashing doesn't allocate
+	sum [64]byte
+
+	// u64 holds the encoding of the last integer key
+	u64 [8]byte
+
+	// hn is the name of the hash function, written in the serialized header. It is empty
+	// if the hash function was set using SetHasher().
+	hn string
+
+	// hp holds the hashers used by Check and CheckMany, so they don't write to the filter.
+	hp *bloom.HasherPool
+
+	// digest holds the bloom.DigestFlags the positions are derived with, see
+	// bloom.DigestPositions. New filters use all of them, and filters read use those read,
+	// so filters written before a flag existed keep their positions.
+	digest uint16
+
+	// pow2 is set if s is rounded up to a power of two, see WithPowerOfTwoSize. Filters
+	// read with s a power of two keep rounding it on Reset.
+	pow2 bool
+
+	// pinned is set if k was set with SetHashCount, in which case Reset keeps it and
+	// derives p from it instead. Filters read with k other than bloom.K(e) keep it.
+	pinned bool
+
+	// primes is set if the partitions are sized to distinct primes, see
+	// WithPrimePartitions. ps then holds the size of each partition, the first being s.
+	primes bool
+	ps     []uint
 }
 
-var _ bloom.Bloom = (*PartitionedBloom)(nil)
+var (
+	_ bloom.Bloom        = (*PartitionedBloom)(nil)
+	_ bloom.Introspector = (*PartitionedBloom)(nil)
+	_ bloom.Positioner   = (*PartitionedBloom)(nil)
+)
+
+func init() {
+	bloom.RegisterDecoder(bloom.KindPartitioned, func(h *bloom.Header, r io.Reader) (bloom.Bloom, error) {
+		bf := &PartitionedBloom{}
+		if _, err := bf.readBody(h, r); err != nil {
+			return nil, err
+		}
+		return bf, nil
+	})
+}
 
 // New initializes a new partitioned bloom filter.
 // n is the number of items this bloom filter predicted to hold.
 func New(n uint) bloom.Bloom {
-	var (
-		p float64 = 0.5
-		e float64 = 0.001
-		k uint    = bloom.K(e)
-		m uint    = bloom.M(n, p, e)
-		s uint    = bloom.S(m, k)
-	)
-
-	return &PartitionedBloom{
-		h:  fnv.New64(),
-		n:  n,
-		p:  p,
-		e:  e,
-		k:  k,
-		m:  m,
-		s:  s,
-		b:  makePartitions(k, s),
-		bs: make([]uint, k),
-	}
-}
-
-func (this *PartitionedBloom) SetHasher(h hash.Hash) {
+	return NewWithEstimates(n, 0.001)
+}
+
+// NewFast is the same as New, with the hash function bloom.FastHasher, XXH64, rather than
+// bloom.DefaultHasher. See WithFastHasher.
+func NewFast(n uint) bloom.Bloom {
+	return NewWithOptions(n, 0.001, WithFastHasher())
+}
+
+// NewE is the same as NewWithEstimates, but returns an error instead of building a broken
+// filter if n is 0 or fpRate is not in (0, 1).
+func NewE(n uint, fpRate float64) (bloom.Bloom, error) {
+	if err := bloom.Validate(n, 0.5, fpRate); err != nil {
+		return nil, err
+	}
+	return NewWithEstimates(n, fpRate), nil
+}
+
+// NewWithEstimates initializes a new partitioned bloom filter for n items with a false
+// positive probability of fpRate. k and m are derived from fpRate with bloom.K and bloom.M.
+func NewWithEstimates(n uint, fpRate float64) bloom.Bloom {
+	return NewWithOptions(n, fpRate)
+}
+
+// Option configures a filter created by NewWithOptions.
+type Option func(*PartitionedBloom)
+
+// WithPowerOfTwoSize rounds s, the number of bits of each partition, up to a power of two,
+// see bloom.PowerOfTwo, so the positions are mapped to the bits of the partitions with a
+// mask rather than a division. m is then k * s. The filter takes up to twice the memory,
+// and its false positive rate is below fpRate, as it has more bits than needed. M, S,
+// Params and Stats report the rounded sizes, and Reset keeps rounding them.
+func WithPowerOfTwoSize() Option {
+	return func(bf *PartitionedBloom) {
+		bf.pow2 = true
+	}
+}
+
+// WithPrimePartitions sizes the k partitions to the k smallest primes not below s, and
+// reduces the hash values of an item modulo the size of each partition, see primeBits, so
+// hashers whose values share factors with s, such as those of structured keys, still
+// spread over all the bits of each partition. The partitions take a few more bits than s
+// each. S and Params report the smallest size, M their sum, and PartitionStats the size of
+// each. It takes precedence over WithPowerOfTwoSize.
+func WithPrimePartitions() Option {
+	return func(bf *PartitionedBloom) {
+		bf.primes = true
+	}
+}
+
+// WithFastHasher sets the hash function to bloom.FastHasher, XXH64, which is faster than
+// bloom.DefaultHasher on keys longer than a few bytes and mixes them better. Like the
+// hasher set by SetNamedHasher, its name is recorded when the filter is serialized.
+func WithFastHasher() Option {
+	return func(bf *PartitionedBloom) {
+		bf.setHasher(bloom.NewXXHash64(0), bloom.FastHasher)
+	}
+}
+
+// WithHashCount pins k, the number of partitions, see SetHashCount. A k out of range is
+// ignored.
+func WithHashCount(k uint) Option {
+	return func(bf *PartitionedBloom) {
+		if bloom.ValidateHashCount(k) == nil {
+			bf.k, bf.pinned = k, true
+		}
+	}
+}
+
+// WithFillRatio sets the fill ratio p, see SetFillRatio, so the filter is built for p
+// rather than rebuilt by SetFillRatio. A p out of range is ignored, and so is p if k is
+// pinned by WithHashCount, as p is then derived from k and fpRate.
+func WithFillRatio(p float64) Option {
+	return func(bf *PartitionedBloom) {
+		if bloom.ValidateFillRatio(p) == nil {
+			bf.p = p
+		}
+	}
+}
+
+// NewWithOptions is the same as NewWithEstimates, with the options applied.
+func NewWithOptions(n uint, fpRate float64, opts ...Option) bloom.Bloom {
+	bf := &PartitionedBloom{
+		n:      n,
+		p:      0.5,
+		e:      fpRate,
+		digest: bloom.DigestFlags,
+	}
+
+	bf.setHasher(fnv.New64(), bloom.DefaultHasher)
+
+	for _, opt := range opts {
+		opt(bf)
+	}
+
+	bf.Reset()
+	return bf
+}
+
+// SetHasher sets the hash function. The items already added would hash to other positions,
+// so it returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *PartitionedBloom) SetHasher(h hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.setHasher(h, "")
+	this.digest = bloom.DigestFlags
+	return nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. Unlike SetHasher, the name is recorded when the filter is
+// serialized, so bloom.Load can recreate the same hash function. Like SetHasher, it returns
+// bloom.ErrNotEmpty if the filter isn't empty.
+func (this *PartitionedBloom) SetNamedHasher(name string) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.setHasher(h, name)
+	this.digest = bloom.DigestFlags
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *PartitionedBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+// SetSeed sets the hash function to bloom.SeededHash(seed), so the positions of the items
+// depend on seed. The seed is recorded with the filter when serialized, see
+// bloom.SeededHasherName. Like SetHasher, it returns bloom.ErrNotEmpty if the filter isn't
+// empty. bloom.RandomSeed returns a random seed.
+func (this *PartitionedBloom) SetSeed(seed uint64) error {
+	return this.SetNamedHasher(bloom.SeededHasherName(seed))
+}
+
+// Seed returns the seed set by SetSeed, or false if the hash function isn't seeded.
+func (this *PartitionedBloom) Seed() (uint64, bool) {
+	return bloom.SeedOf(this.hn)
+}
+
+// setHasher sets the hash function h, registered as name if name is not empty.
+func (this *PartitionedBloom) setHasher(h hash.Hash, name string) {
 	this.h = h
+	this.hn = name
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+// resize derives k, or p if k is pinned, and the sizes of the partitions from the
+// parameters of the filter.
+func (this *PartitionedBloom) resize() {
+	if this.pinned {
+		this.p = bloom.P(this.k, this.e)
+	} else {
+		this.k = bloom.K(this.e)
+	}
+
+	this.m, this.s, this.ps = this.size()
+}
+
+// size returns the number of bits and the number of bits of each partition for n, p, e and
+// k, with the partitions rounded up to a power of two if pow2 is set. If primes is set, it
+// also returns the prime sizes of the partitions, the first of which is returned as s.
+func (this *PartitionedBloom) size() (uint, uint, []uint) {
+	m := bloom.M(this.n, this.p, this.e)
+	s := bloom.S(m, this.k)
+	switch {
+	case this.primes:
+		ps := primes(s, this.k)
+		return sumOf(ps), ps[0], ps
+	case this.pow2:
+		s = bloom.PowerOfTwo(s)
+		m = s * this.k
+	}
+	return m, s, nil
+}
+
+// primes returns the k smallest primes not below s.
+func primes(s, k uint) []uint {
+	ps := make([]uint, k)
+	for i := range ps {
+		ps[i] = bloom.NextPrime(s)
+		s = ps[i] + 1
+	}
+	return ps
+}
+
+// sumOf returns the sum of the sizes ps.
+func sumOf(ps []uint) uint {
+	var t uint
+	for _, v := range ps {
+		t += v
+	}
+	return t
+}
+
+// sizeOf returns the number of bits of partition i.
+func (this *PartitionedBloom) sizeOf(i uint) uint {
+	if this.ps != nil {
+		return this.ps[i]
+	}
+	return this.s
 }
 
 func (this *PartitionedBloom) Reset() {
-	this.k = bloom.K(this.e)
-	this.m = bloom.M(this.n, this.p, this.e)
-	this.s = bloom.S(this.m, this.k)
-	this.b = makePartitions(this.k, this.s)
+	this.resize()
+	this.words, this.w = makePartitions(this.k, this.sizeOf(this.k-1))
 	this.bs = make([]uint, this.k)
+	this.c = 0
 
 	if this.h == nil {
-		this.h = fnv.New64()
+		this.setHasher(fnv.New64(), "")
 	} else {
 		this.h.Reset()
 	}
 }
 
-func (this *PartitionedBloom) SetErrorProbability(e float64) {
+// Clear removes all the items from the filter. Unlike Reset, it keeps the parameters and
+// the partitions, which are only zeroed, so it doesn't allocate.
+func (this *PartitionedBloom) Clear() {
+	clear(this.words)
+	this.c = 0
+}
+
+// SetErrorProbability sets the error probability e, and resets the filter to recompute k
+// and m from it, or p and m if k is pinned by SetHashCount. It returns
+// bloom.ErrInvalidErrorRate if e is not in (0, 1), and bloom.ErrNotEmpty if items have been
+// added, leaving the filter unchanged.
+func (this *PartitionedBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
 	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetFillRatio sets the fill ratio p, and resets the filter to recompute m from it. A lower
+// p gives a larger m for the same n and e. With k pinned by SetHashCount, p is derived from
+// k and e, so e is set to p^k instead, the error probability reached at the fill ratio p. It
+// returns bloom.ErrInvalidFillRatio if p is not in (0, 1), and bloom.ErrNotEmpty if items
+// have been added, leaving the filter unchanged.
+func (this *PartitionedBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	if this.pinned {
+		this.e = math.Pow(p, float64(this.k))
+	}
+
+	this.Reset()
+	return nil
+}
+
+// SetHashCount pins k, the number of partitions and of hash values of each item, rather
+// than deriving it from e. The fill ratio p is then derived from k and e with bloom.P, and m
+// from p, so the filter keeps the error probability e: fewer partitions take more bits. It
+// resets the filter, and returns bloom.ErrInvalidHashCount if k is not in [1,
+// bloom.MaxHashCount], and bloom.ErrNotEmpty if items have been added, leaving the filter
+// unchanged. Params reports k as pinned.
+func (this *PartitionedBloom) SetHashCount(k uint) error {
+	if err := bloom.ValidateHashCount(k); err != nil {
+		return err
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.k, this.pinned = k, true
+	this.Reset()
+	return nil
 }
 
+// EstimatedFillRatio returns the fill ratio expected after Count items. Each item sets one
+// bit of each partition, so a bit of a partition of s bits is still clear with probability
+// (1 - 1/s)^c, rather than its approximation exp(-c/s), which is too low for small
+// partitions. With partitions sized to primes, it is the average over the partitions.
 func (this *PartitionedBloom) EstimatedFillRatio() float64 {
-	return 1 - math.Exp(-float64(this.c)/float64(this.s))
+	if this.ps == nil {
+		return estimatedFillRatio(this.c, this.s)
+	}
+
+	t := float64(0)
+	for _, s := range this.ps {
+		t += estimatedFillRatio(this.c, s)
+	}
+	return t / float64(len(this.ps))
+}
+
+// estimatedFillRatio returns 1 - (1 - 1/s)^c, the expected fill ratio of a partition of s
+// bits after c items.
+func estimatedFillRatio(c uint64, s uint) float64 {
+	return -math.Expm1(float64(c) * math.Log1p(-1/float64(s)))
+}
+
+// K returns the number of hash values of each item.
+func (this *PartitionedBloom) K() uint {
+	return this.k
+}
+
+// M returns the number of bits of the filter. The k partitions of s bits hold up to k - 1
+// bits more, as s is rounded up, which FillRatio and EstimatedFillRatio account for.
+func (this *PartitionedBloom) M() uint {
+	return this.m
+}
+
+// S returns the number of bits of each partition.
+func (this *PartitionedBloom) S() uint {
+	return this.s
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *PartitionedBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns the parameters of the filter, as computed by the last Reset.
+func (this *PartitionedBloom) Params() bloom.Params {
+	return bloom.Params{M: this.m, K: this.k, S: this.s, N: this.n, P: this.p, E: this.e, PinnedK: this.pinned}
 }
 
 func (this *PartitionedBloom) FillRatio() float64 {
 	// Since this is partitioned, we will return the average fill ratio of all partitions
 	t := float64(0)
-	for _, v := range this.b[:this.k] {
-		t += (float64(v.Count()) / float64(this.s))
+	for i := uint(0); i < this.k; i++ {
+		t += (float64(this.count(i)) / float64(this.sizeOf(i)))
 	}
 	return t / float64(this.k)
 }
@@ -147,56 +502,701 @@ func (this *PartitionedBloom) FillRatio() float64 {
 func (this *PartitionedBloom) Add(item []byte) bloom.Bloom {
 	this.bits(item)
 	for i, v := range this.bs[:this.k] {
-		this.b[i].Set(v)
+		this.set(uint(i), v)
 	}
 	this.c++
 	return this
 }
 
+// AddAll adds all the items, the same as calling Add for each of them, reusing the same
+// hash state and position buffer for the whole batch.
+func (this *PartitionedBloom) AddAll(items [][]byte) bloom.Bloom {
+	for _, item := range items {
+		this.bits(item)
+		for i, v := range this.bs[:this.k] {
+			this.set(uint(i), v)
+		}
+	}
+	this.c += uint64(len(items))
+	return this
+}
+
+// AddAllStrings is the same as AddAll for string items, without copying them.
+func (this *PartitionedBloom) AddAllStrings(items []string) bloom.Bloom {
+	for _, item := range items {
+		this.bits(unsafeBytes(item))
+		for i, v := range this.bs[:this.k] {
+			this.set(uint(i), v)
+		}
+	}
+	this.c += uint64(len(items))
+	return this
+}
+
+// Check returns true if item may have been added to the filter. It doesn't write to the
+// filter, so it is safe to call concurrently with other Checks, but not with Add.
 func (this *PartitionedBloom) Check(item []byte) bool {
-	this.bits(item)
-	for i, v := range this.bs[:this.k] {
-		if !this.b[i].Test(v) {
+	s := this.hp.Get()
+	ok := this.check(s, item)
+	this.hp.Put(s)
+	return ok
+}
+
+// Positions implements bloom.Positioner, appending the bit positions of key to bs, one per
+// partition. Like Check, it doesn't write to the filter.
+func (this *PartitionedBloom) Positions(key []byte, bs []uint) []uint {
+	s := this.hp.Get()
+	p := s.Positions(this.k)
+	bits(s.H, key, p, this.s, this.ps, s.Sum[:0], this.digest)
+	bs = append(bs, p...)
+	this.hp.Put(s)
+	return bs
+}
+
+// AddPositions implements bloom.Positioner, adding an item given its bit positions.
+func (this *PartitionedBloom) AddPositions(bs []uint) {
+	for i, v := range bs {
+		this.set(uint(i), v)
+	}
+	this.c++
+}
+
+// check is Check using the hasher and buffers of s.
+func (this *PartitionedBloom) check(s *bloom.Scratch, item []byte) bool {
+	bs := s.Positions(this.k)
+	bits(s.H, item, bs, this.s, this.ps, s.Sum[:0], this.digest)
+	for i, v := range bs {
+		if !this.test(uint(i), v) {
 			return false
 		}
 	}
 	return true
 }
 
-func (this *PartitionedBloom) Count() uint {
+// CheckMany checks all the items, setting out[i] to Check(items[i]). out is reused if it
+// can hold len(items) results, and allocated otherwise. The slice of results is returned.
+//
+// The bit positions of a batch of items are computed first, and then probed partition by
+// partition, so each partition is brought into cache once per batch rather than once per
+// item.
+func (this *PartitionedBloom) CheckMany(items [][]byte, out []bool) []bool {
+	out = bloom.Results(out, len(items))
+	k := int(this.k)
+
+	s := this.hp.Get()
+	defer this.hp.Put(s)
+	bs := s.Positions(this.k)
+
+	for lo := 0; lo < len(items); lo += checkBatch {
+		batch := items[lo:min(lo+checkBatch, len(items))]
+		res := out[lo : lo+len(batch)]
+
+		if cap(s.Pos) < len(batch)*k {
+			s.Pos = make([]uint, checkBatch*k)
+		}
+		pos := s.Pos[:len(batch)*k]
+
+		for j, item := range batch {
+			bits(s.H, item, bs, this.s, this.ps, s.Sum[:0], this.digest)
+			copy(pos[j*k:], bs)
+			res[j] = true
+		}
+
+		for i := 0; i < k; i++ {
+			b := this.partition(uint(i))
+			for j := range res {
+				if v := pos[j*k+i]; res[j] && b[v>>6]&(1<<(v&63)) == 0 {
+					res[j] = false
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+// checkBatch is the number of items whose bit positions CheckMany computes before probing
+// the partitions.
+const checkBatch = 1024
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *PartitionedBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafeBytes(s))
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *PartitionedBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// AddUint64 is the same as Add of the 8 byte big endian encoding of v, without allocating.
+func (this *PartitionedBloom) AddUint64(v uint64) bloom.Bloom {
+	binary.BigEndian.PutUint64(this.u64[:], v)
+	return this.Add(this.u64[:])
+}
+
+// CheckUint64 is the same as Check of the 8 byte big endian encoding of v, without
+// allocating.
+func (this *PartitionedBloom) CheckUint64(v uint64) bool {
+	s := this.hp.Get()
+	binary.BigEndian.PutUint64(s.U64[:], v)
+	ok := this.check(s, s.U64[:])
+	this.hp.Put(s)
+	return ok
+}
+
+func (this *PartitionedBloom) Count() uint64 {
 	return this.c
 }
 
-func (this *PartitionedBloom) PrintStats() {
-	fmt.Printf("m = %d, n = %d, k = %d, s = %d, p = %f, e = %f\n", this.m, this.n, this.k, this.s, this.p, this.e)
-	fmt.Println("Total items:", this.c)
+// Capacity returns n, the number of items the filter was built for.
+func (this *PartitionedBloom) Capacity() uint {
+	return this.n
+}
+
+// Remaining returns the number of items that can be added before reaching the capacity.
+// It is negative once more items than the capacity have been added.
+func (this *PartitionedBloom) Remaining() int64 {
+	return int64(this.n) - int64(this.c)
+}
+
+// IsOverCapacity reports whether more items than the capacity have been added, or the
+// estimated fill ratio is above p. The false positive rate is then above e.
+func (this *PartitionedBloom) IsOverCapacity() bool {
+	return this.c > uint64(this.n) || this.EstimatedFillRatio() > this.p
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the bits set rather than the configured e. An item is a false positive if its bit
+// is set in every partition, so it is the product of the fill ratios of the partitions.
+func (this *PartitionedBloom) CurrentFalsePositiveRate() float64 {
+	t := float64(1)
+	for i := uint(0); i < this.k; i++ {
+		t *= float64(this.count(i)) / float64(this.sizeOf(i))
+	}
+	return t
+}
+
+// ApproximateCardinality estimates the number of distinct items added to the filter from the
+// bits set in each partition, see estimateCount. Unlike Count, an item added more than once
+// is only counted once. If all the bits of a partition are set there is nothing to estimate
+// from, and Count is returned.
+func (this *PartitionedBloom) ApproximateCardinality() uint64 {
+	c := this.estimateCount()
+	if math.IsInf(c, 1) {
+		return this.c
+	}
+	return uint64(math.Round(c))
+}
+
+// Union adds all the items of other to the filter by ORing each partition of other into the
+// same partition of the filter. Both filters must have the same k and s, partitions sized to
+// primes or not, and the same hasher: either hashers registered with the same name, or the
+// same hash.Hash set with SetHasher. Otherwise Union returns an error wrapping
+// bloom.ErrIncompatible and leaves the filter unchanged.
+//
+// Items added to both filters would be counted twice by adding the counts, so the count is
+// estimated from the bits set instead, and is at most the sum of the counts.
+func (this *PartitionedBloom) Union(other *PartitionedBloom) error {
+	if this.k != other.k || this.s != other.s {
+		return fmt.Errorf("%w: k = %d, s = %d and k = %d, s = %d", bloom.ErrIncompatible, this.k, this.s, other.k, other.s)
+	}
+
+	if this.hn != other.hn || (this.hn == "" && this.h != other.h) {
+		return fmt.Errorf("%w: hashers %q and %q", bloom.ErrIncompatible, this.hn, other.hn)
+	}
+
+	if this.digestFlags() != other.digestFlags() {
+		return fmt.Errorf("%w: positions derived from different parts of the %q digest", bloom.ErrIncompatible, this.hn)
+	}
+
+	for i, v := range other.words {
+		this.words[i] |= v
+	}
+
+	this.c += other.c
+	if c := this.estimateCount(); c < float64(this.c) {
+		this.c = uint64(math.Round(c))
+	}
+
+	return nil
+}
+
+// estimateCount estimates the number of items added from the bits set, inverting
+// EstimatedFillRatio: with x bits of a partition of s bits set, about
+// ln(1 - x/s) / ln(1 - 1/s) items were added. The estimates of the partitions are
+// averaged, and are +Inf if all the bits of a partition are set.
+func (this *PartitionedBloom) estimateCount() float64 {
+	t := float64(0)
+	for i := uint(0); i < this.k; i++ {
+		x, s := this.count(i), this.sizeOf(i)
+		if x >= s {
+			return math.Inf(1)
+		}
+		t += math.Log1p(-float64(x)/float64(s)) / math.Log1p(-1/float64(s))
+	}
+	return t / float64(this.k)
+}
+
+// Project returns a new filter holding the first j of the k partitions of the filter, with
+// a new hasher of the same kind, as Clone. Each item sets one bit in every partition, and
+// the positions of the first j don't depend on k, so the items of the filter are still
+// found, but an item is a false positive once its j bits are set: the false positive rate
+// is the product of the fill ratios of the j partitions, about p^j rather than p^k, for j/k
+// of the memory. k is then j, m the bits of the j partitions and e is p^j, which are
+// written when the projection is serialized. It returns an error wrapping
+// bloom.ErrInvalidHashCount if j is not in [1, k], and an error if the hasher can't be
+// recreated, see bloom.CloneHasher.
+func (this *PartitionedBloom) Project(j uint) (*PartitionedBloom, error) {
+	if j == 0 || j > this.k {
+		return nil, fmt.Errorf("%w: cannot project %d of %d partitions", bloom.ErrInvalidHashCount, j, this.k)
+	}
+
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := *this
+	bf.setHasher(h, this.hn)
+	bf.k, bf.m, bf.e = j, j*this.s, math.Pow(this.p, float64(j))
+	if this.ps != nil {
+		bf.ps = make([]uint, j)
+		copy(bf.ps, this.ps)
+		bf.m = sumOf(bf.ps)
+	}
+	bf.words = make([]uint64, j*this.w)
+	copy(bf.words, this.words)
+	bf.bs = make([]uint, j)
+	bf.pinned = j != bloom.K(bf.e)
+
+	return &bf, nil
+}
+
+// Clone returns a deep copy of the filter, with a new hasher of the same kind. Changes to
+// the copy don't affect the filter, and the other way around. It returns an error if the
+// hasher can't be recreated, see bloom.CloneHasher.
+func (this *PartitionedBloom) Clone() (bloom.Bloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := *this
+	bf.setHasher(h, this.hn)
+	bf.words = make([]uint64, len(this.words))
+	copy(bf.words, this.words)
+	bf.bs = make([]uint, len(this.bs))
+
+	return &bf, nil
+}
 
-	for i, v := range this.b[:this.k] {
-		c := v.Count()
-		fmt.Printf("Bits in partition %d: %d (%.1f%%)\n", i, c, (float32(c)/float32(this.s))*100)
+// MemoryUsage returns the number of bytes held by the filter: the k partitions, each rounded
+// up to a whole number of 64-bit words, the buffers used to hash items, and the filter
+// itself. The memory held by the hasher is not included.
+func (this *PartitionedBloom) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + 8*uint64(cap(this.words)+cap(this.bs)+cap(this.ps))
+}
+
+// EstimateMemory returns the MemoryUsage of a filter created by NewWithEstimates(n, e),
+// without creating it.
+func EstimateMemory(n uint, e float64) uint64 {
+	return EstimateMemoryWithOptions(n, e)
+}
+
+// EstimateMemoryWithOptions returns the MemoryUsage of a filter created by
+// NewWithOptions(n, fpRate, opts...), without allocating its partitions.
+func EstimateMemoryWithOptions(n uint, fpRate float64, opts ...Option) uint64 {
+	bf := &PartitionedBloom{n: n, p: 0.5, e: fpRate}
+	for _, opt := range opts {
+		opt(bf)
+	}
+
+	bf.resize()
+	w := uint64(bf.sizeOf(bf.k-1)+63) / 64
+	return uint64(unsafe.Sizeof(*bf)) + 8*(uint64(bf.k)*w+uint64(bf.k)+uint64(len(bf.ps)))
+}
+
+// String implements fmt.Stringer with a one line summary of the filter. The fill ratio
+// is the estimated one, so String doesn't have to count the bits set.
+func (this *PartitionedBloom) String() string {
+	return fmt.Sprintf("partitioned{n=%d m=%d k=%d s=%d e=%g count=%d fill=%.2f}", this.n, this.m, this.k, this.s, this.e, this.c, this.EstimatedFillRatio())
+}
+
+// Stats returns the statistics of the filter.
+func (this *PartitionedBloom) Stats() bloom.Stats {
+	stats := bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.c,
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		Partitions:         this.PartitionStats(),
+		FalsePositiveRate:  1,
+	}
+
+	for _, v := range stats.Partitions {
+		stats.BitsSet += v.BitsSet
+		stats.FillRatio += v.FillRatio / float64(this.k)
+		stats.FalsePositiveRate *= v.FillRatio
+	}
+
+	return stats
+}
+
+// PartitionStats returns the statistics of each of the k partitions, the Partitions of
+// Stats, without computing the others.
+func (this *PartitionedBloom) PartitionStats() []bloom.PartitionStats {
+	ps := make([]bloom.PartitionStats, this.k)
+	for i := range ps {
+		c := this.count(uint(i))
+		s := this.sizeOf(uint(i))
+		ps[i] = bloom.PartitionStats{Index: i, Size: s, BitsSet: c, FillRatio: float64(c) / float64(s)}
+	}
+	return ps
+}
+
+// SkewRatio returns the fill ratio of the fullest partition over that of the emptiest one.
+// Each item sets one bit in every partition, so the partitions fill alike, and a ratio well
+// above 1 shows a hasher that spreads the positions of some partitions over fewer bits. It
+// is 1 if the filter is empty, and +Inf if a partition is empty while another isn't.
+func (this *PartitionedBloom) SkewRatio() float64 {
+	lo, hi := math.Inf(1), float64(0)
+	for i := uint(0); i < this.k; i++ {
+		f := float64(this.count(i)) / float64(this.sizeOf(i))
+		lo, hi = min(lo, f), max(hi, f)
+	}
+
+	if hi == 0 {
+		return 1
 	}
+	return hi / lo
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *PartitionedBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *PartitionedBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
 }
 
 func (this *PartitionedBloom) bits(item []byte) {
-	this.h.Reset()
-	this.h.Write(item)
-	s := this.h.Sum(nil)
-	a := binary.BigEndian.Uint32(s[4:8])
-	b := binary.BigEndian.Uint32(s[0:4])
+	bits(this.h, item, this.bs[:this.k], this.s, this.ps, this.sum[:0], this.digest)
+}
+
+// bits fills bs with the bit positions for item in partitions of s bits, one per partition,
+// derived by bloom.DigestPositions, or by the bloom.Hasher wrapped by h if set with
+// SetHashFunc. If ps is not nil, the partitions have the prime sizes ps instead, see
+// primeBits. sum is used as the buffer for the digest.
+func bits(h hash.Hash, item []byte, bs []uint, s uint, ps []uint, sum []byte, digest uint16) {
+	if ps != nil {
+		primeBits(h, item, bs, ps, sum)
+		return
+	}
+
+	if f := bloom.HashFuncOf(h); f != nil {
+		f.Positions(item, bs, s)
+		return
+	}
+
+	h.Reset()
+	h.Write(item)
+	bloom.DigestPositions(h, sum, bs, s, digest)
+}
+
+// primeBits fills bs with the bit positions for item in partitions of the prime sizes ps:
+// (a + b * i) modulo the size of partition i, following Kirsch and Mitzenmacher, with a the
+// 64-bit hash value of item and b mixed from a with the splitmix64 finalizer, or with the
+// values of the bloom.Hasher wrapped by h. The values are reduced by the primes as they
+// are, so values sharing a factor with s still spread over all the bits.
+func primeBits(h hash.Hash, item []byte, bs []uint, ps []uint, sum []byte) {
+	var a, b uint64
+	if f := bloom.HashFuncOf(h); f != nil {
+		a, b = f(item)
+	} else {
+		h.Reset()
+		h.Write(item)
+		a = bloom.Sum64(h, sum)
+
+		b = a + 0x9e3779b97f4a7c15
+		b = (b ^ b>>30) * 0xbf58476d1ce4e5b9
+		b = (b ^ b>>27) * 0x94d049bb133111eb
+		b ^= b >> 31
+	}
+
+	for i, p := range ps {
+		bs[i] = uint((a%uint64(p) + (b%uint64(p))*uint64(i)) % uint64(p))
+	}
+}
 
-	// Reference: Less Hashing, Same Performance: Building a Better Bloom Filter
-	// URL: http://www.eecs.harvard.edu/~kirsch/pubs/bbbf/rsa.pdf
-	for i, _ := range this.bs[:this.k] {
-		this.bs[i] = (uint(a) + uint(b)*uint(i)) % this.s
+// digestFlags returns the flags changing the positions derived from the digest of the
+// hasher, which are recorded in the header, see bloom.DigestFlagsOf, or
+// bloom.FlagPrimePartitions if the partitions are sized to primes.
+func (this *PartitionedBloom) digestFlags() uint16 {
+	if this.ps != nil {
+		return bloom.FlagPrimePartitions
 	}
+
+	if bloom.HashFuncOf(this.h) != nil {
+		return 0
+	}
+	return bloom.DigestFlagsOf(this.h, this.s, this.digest)
+}
+
+// makePartitions returns the zeroed words of k partitions of s bits, and the number of
+// words of each partition.
+func makePartitions(k, s uint) ([]uint64, uint) {
+	w := (s + 63) / 64
+	return make([]uint64, k*w), w
+}
+
+// partition returns the words of partition i.
+func (this *PartitionedBloom) partition(i uint) []uint64 {
+	return this.words[i*this.w : (i+1)*this.w]
+}
+
+// set sets bit v of partition i.
+func (this *PartitionedBloom) set(i, v uint) {
+	this.words[i*this.w+v>>6] |= 1 << (v & 63)
+}
+
+// test returns true if bit v of partition i is set.
+func (this *PartitionedBloom) test(i, v uint) bool {
+	return this.words[i*this.w+v>>6]&(1<<(v&63)) != 0
+}
+
+// count returns the number of bits set in partition i.
+func (this *PartitionedBloom) count(i uint) uint {
+	var x int
+	for _, v := range this.partition(i) {
+		x += mathbits.OnesCount64(v)
+	}
+	return uint(x)
+}
+
+// WriteTo implements io.WriterTo. It is the same as Encode with nil options.
+func (this *PartitionedBloom) WriteTo(w io.Writer) (int64, error) {
+	return this.Encode(w, nil)
+}
+
+// Encode implements bloom.Encoder. It writes a bloom.Header holding k, s, m, n, c, p, e and
+// the hasher name, followed by each of the k partitions in order. Each partition is written
+// as its length in bits followed by its bits written by bloom.WriteBits. The hash function
+// itself is not written.
+func (this *PartitionedBloom) Encode(w io.Writer, opts *bloom.WriteOptions) (int64, error) {
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindPartitioned,
+		Hasher:  this.hn,
+		M:       uint64(this.m),
+		K:       uint64(this.k),
+		S:       uint64(this.s),
+		N:       uint64(this.n),
+		C:       this.c,
+		P:       this.p,
+		E:       this.e,
+	}
+
+	h.Flags = opts.Flags(this.FillRatio())
+	h.Flags |= this.digestFlags()
+	if this.pow2 {
+		h.Flags |= bloom.FlagPowerOfTwo
+	}
+	if this.pinned {
+		h.Flags |= bloom.FlagPinnedHashCount
+	}
+	sparse := h.Flags&bloom.FlagSparse != 0
+
+	total, err := h.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+
+	bw := bloom.NewBodyWriter(w, h.Flags)
+	for i := uint(0); i < this.k; i++ {
+		if err := binary.Write(bw, binary.BigEndian, uint64(this.sizeOf(i))); err != nil {
+			n, _ := bw.Finish()
+			return total + n, err
+		}
+
+		if _, err := bloom.WriteBits(bw, this.partition(i), this.sizeOf(i), sparse); err != nil {
+			n, _ := bw.Finish()
+			return total + n, err
+		}
+	}
+
+	n, err := bw.Finish()
+	return total + n, err
+}
+
+// ReadFrom implements io.ReaderFrom. It restores a filter written by WriteTo, rebuilding
+// all k partitions. If the filter was written with a hasher set by SetNamedHasher, that
+// hasher is recreated. Otherwise the current hasher is kept, or fnv.New64() is used if none
+// is set.
+func (this *PartitionedBloom) ReadFrom(r io.Reader) (int64, error) {
+	h := &bloom.Header{}
+	total, err := h.ReadFrom(r)
+	if err != nil {
+		return total, err
+	}
+
+	if h.Kind != bloom.KindPartitioned {
+		return total, fmt.Errorf("partitioned: cannot read %s filter", h.Kind)
+	}
+
+	n, err := this.readBody(h, r)
+	return total + n, err
+}
+
+func (this *PartitionedBloom) readBody(h *bloom.Header, r io.Reader) (int64, error) {
+	k, s, m := uint(h.K), uint(h.S), uint(h.M)
+	sparse := h.Flags&bloom.FlagSparse != 0
+	if h.K == 0 || h.K > bloom.MaxHashCount || h.S == 0 || h.S > h.M || h.M > math.MaxUint {
+		return 0, fmt.Errorf("partitioned: invalid parameters k = %d, s = %d, m = %d", h.K, h.S, h.M)
+	}
+
+	// Partitions sized to primes take precedence over rounding them up to a power of two
+	prime, pow2 := h.Flags&bloom.FlagPrimePartitions != 0, h.Flags&bloom.FlagPowerOfTwo != 0
+	if !prime && (s != bloom.S(m, k) || pow2 && s&(s-1) != 0) {
+		return 0, fmt.Errorf("partitioned: invalid parameters k = %d, s = %d, m = %d", k, s, m)
+	}
+
+	hf, err := bloom.ResolveHasher(h.Hasher, this.h)
+	if err != nil {
+		return 0, err
+	}
+
+	br, err := bloom.NewBodyReader(r, h.Flags)
+	if err != nil {
+		return 0, err
+	}
+
+	// length reads the length of partition i, which must be want bits
+	length := func(i, want uint) error {
+		var l uint64
+		if err := binary.Read(br, binary.BigEndian, &l); err != nil {
+			return fmt.Errorf("partitioned: header says %d partitions, only %d found: %v", k, i, err)
+		}
+
+		if l != uint64(want) {
+			return fmt.Errorf("partitioned: partition %d has %d bits, expected %d", i, l, want)
+		}
+		return nil
+	}
+
+	// The partitions hold at least m bits, so m is bounded by the data before the primes
+	// are computed and the partitions allocated
+	if err := bloom.CheckBits(br, m, sparse); err != nil {
+		return 0, fmt.Errorf("partitioned: %v", err)
+	}
+
+	// The partitions of filters sized to primes take the k primes from s, which is prime
+	var ps []uint
+	if prime {
+		if ps = primes(s, k); ps[0] != s || sumOf(ps) != m {
+			return 0, fmt.Errorf("partitioned: invalid prime partitions k = %d, s = %d, m = %d", k, s, m)
+		}
+	}
+
+	size := func(i uint) uint {
+		if ps != nil {
+			return ps[i]
+		}
+		return s
+	}
+
+	words, w := makePartitions(k, size(k-1))
+	for i := uint(0); i < k; i++ {
+		if err := length(i, size(i)); err != nil {
+			n, _ := br.Finish()
+			return n, err
+		}
+
+		if _, err := bloom.ReadBits(br, words[i*w:(i+1)*w], size(i), sparse); err != nil {
+			n, _ := br.Finish()
+			return n, fmt.Errorf("partitioned: reading partition %d: %v", i, err)
+		}
+	}
+
+	total, err := br.Finish()
+	if err != nil {
+		return total, err
+	}
+
+	this.k, this.s, this.m, this.n, this.c, this.p, this.e = k, s, m, uint(h.N), h.C, h.P, h.E
+	this.words, this.w = words, w
+	this.bs = make([]uint, k)
+	this.setHasher(hf, h.Hasher)
+	this.digest = h.Flags & bloom.DigestFlags
+	this.pow2 = pow2
+	this.pinned = h.Flags&bloom.FlagPinnedHashCount != 0
+	this.primes, this.ps = ps != nil, ps
+
+	return total, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the WriteTo encoding.
+func (this *PartitionedBloom) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := this.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using the ReadFrom encoding.
+func (this *PartitionedBloom) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := this.ReadFrom(r); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("partitioned: %d trailing bytes after last partition", r.Len())
+	}
+
+	return nil
 }
 
-func makePartitions(k, s uint) []*bitset.BitSet {
-	b := make([]*bitset.BitSet, k)
+// MarshalText implements encoding.TextMarshaler. See bloom.MarshalText for the format.
+func (this *PartitionedBloom) MarshalText() ([]byte, error) {
+	data, err := this.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return bloom.MarshalText(data)
+}
 
-	for i, _ := range b {
-		b[i] = bitset.New(s)
+// UnmarshalText implements encoding.TextUnmarshaler. It rejects text that isn't the text form
+// of a partitioned filter.
+func (this *PartitionedBloom) UnmarshalText(text []byte) error {
+	data, err := bloom.UnmarshalText(text, bloom.KindPartitioned)
+	if err != nil {
+		return err
 	}
+	return this.UnmarshalBinary(data)
+}
+
+// GobEncode implements gob.GobEncoder using the MarshalBinary encoding. Only the name of
+// a hasher set by SetNamedHasher is encoded. For a hasher set by SetHasher, call SetHasher
+// with the same hasher on the value being decoded into before decoding, as the hasher
+// already set on it is kept. Otherwise the decoded filter falls back to fnv.New64().
+func (this *PartitionedBloom) GobEncode() ([]byte, error) {
+	return this.MarshalBinary()
+}
+
+// GobDecode implements gob.GobDecoder using the UnmarshalBinary encoding.
+func (this *PartitionedBloom) GobDecode(data []byte) error {
+	return this.UnmarshalBinary(data)
+}
 
-	return b
+// unsafeBytes returns the bytes of s without copying them. Hash functions don't modify or
+// retain the data written to them, so it is safe to pass the result to bits.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
 }
@@ -16,13 +16,21 @@ package partitioned
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc64"
 	"hash/fnv"
+	"math"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/spaolacci/murmur3"
@@ -66,7 +74,7 @@ func init() {
 	}
 }
 
-func testBloomFilter(t *testing.T, bf bloom.Bloom) {
+func testBloomFilter(t *testing.T, bf bloom.Bloom) int {
 	fn, fp := 0, 0
 
 	for l := range web2 {
@@ -86,23 +94,1371 @@ func testBloomFilter(t *testing.T, bf bloom.Bloom) {
 
 	fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
 	fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+	return fp
 }
 
+// TestBloomFilter also compares the false positives of the enhanced double hashing with
+// those of the plain one, for each hasher, which the enhanced one must not exceed by more
+// than the noise.
 func TestBloomFilter(t *testing.T) {
 	l := []uint{uint(len(web2)), 200000, 100000, 50000}
 	h := []hash.Hash{fnv.New64(), crc64.New(crc64.MakeTable(crc64.ECMA)), murmur3.New64(), cityhash.New64(), md5.New(), sha1.New()}
 	n := []string{"fnv.New64()", "crc64.New()", "murmur3.New64()", "cityhash.New64()", "md5.New()", "sha1.New()"}
 
+	fps := make([][2]int, len(h))
 	for i := range l {
 		for j := range h {
 			fmt.Printf("\n\nTesting %s with size %d\n", n[j], l[i])
 			bf := New(l[i])
 			bf.SetHasher(h[j])
-			testBloomFilter(t, bf)
+			fps[j][1] += testBloomFilter(t, bf)
+
+			fmt.Printf("\n\nTesting %s with size %d without enhanced double hashing\n", n[j], l[i])
+			bf = New(l[i])
+			bf.SetHasher(h[j])
+			bf.(*PartitionedBloom).digest &^= bloom.FlagEnhanced
+			fps[j][0] += testBloomFilter(t, bf)
+		}
+	}
+
+	for j := range h {
+		fmt.Printf("%s: %d false positives with enhanced double hashing, %d without\n", n[j], fps[j][1], fps[j][0])
+		if float64(fps[j][1]) > 1.05*float64(fps[j][0])+10 {
+			t.Errorf("%s: %d false positives with enhanced double hashing, more than %d without", n[j], fps[j][1], fps[j][0])
+		}
+	}
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	var buf bytes.Buffer
+	n, err := bf.(*PartitionedBloom).WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	data := buf.Bytes()
+
+	bf2 := &PartitionedBloom{}
+	if n, err = bf2.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != int64(len(data)) {
+		t.Errorf("ReadFrom reported %d bytes, expected %d", n, len(data))
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !bf2.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives after ReadFrom, got %d", fn)
+	}
+
+	for l := range web2a {
+		if bf.Check([]byte(web2a[l])) != bf2.Check([]byte(web2a[l])) {
+			t.Fatalf("Check mismatch after ReadFrom for %q", web2a[l])
+		}
+	}
+
+	// Drop the last partition so the header no longer matches the data
+	last := len(data) - 8 - int(bf2.w)*8
+	if _, err := new(PartitionedBloom).ReadFrom(bytes.NewReader(data[:last])); err == nil {
+		t.Error("Expected error reading filter with a missing partition")
+	}
+
+	bf3, err := bloom.Load(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := bf3.(*PartitionedBloom); !ok {
+		t.Fatalf("Expected bloom.Load to return *PartitionedBloom, got %T", bf3)
+	}
+}
+
+func TestGob(t *testing.T) {
+	type snapshot struct {
+		Name   string
+		Filter *PartitionedBloom
+	}
+
+	bf := New(uint(len(web2)))
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot{"web2", bf.(*PartitionedBloom)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var s snapshot
+	if err := gob.NewDecoder(&buf).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Filter.Count() != bf.Count() {
+		t.Errorf("Expected count %d, got %d", bf.Count(), s.Filter.Count())
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !s.Filter.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives after gob decoding, got %d", fn)
+	}
+}
+
+func TestSparseEncoding(t *testing.T) {
+	// 700000 items gives a filter of roughly 10M bits
+	bf := New(700000).(*PartitionedBloom)
+	for i := 0; i < 200; i++ {
+		bf.Add([]byte(web2[i]))
+	}
+
+	var sparse, dense bytes.Buffer
+	if _, err := bf.WriteTo(&sparse); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bf.Encode(&dense, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("m = %d, fill ratio = %f, sparse = %d bytes, dense = %d bytes\n", bf.m, bf.FillRatio(), sparse.Len(), dense.Len())
+
+	if sparse.Len() > 8192 {
+		t.Errorf("Expected sparse encoding of at most 8192 bytes, got %d", sparse.Len())
+	}
+
+	for _, buf := range []*bytes.Buffer{&sparse, &dense} {
+		bf2 := &PartitionedBloom{}
+		if err := bf2.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		for l := range web2 {
+			if bf.Check([]byte(web2[l])) != bf2.Check([]byte(web2[l])) {
+				t.Fatalf("Check mismatch after decoding for %q", web2[l])
+			}
+		}
+	}
+}
+
+func TestAddString(t *testing.T) {
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	bf2 := New(uint(len(web2))).(*PartitionedBloom)
+
+	for l := range web2 {
+		if l%2 == 0 {
+			bf.AddString(web2[l])
+		} else {
+			bf.Add([]byte(web2[l]))
+		}
+		bf2.Add([]byte(web2[l]))
+	}
+
+	for l := range web2a {
+		if bf.CheckString(web2a[l]) != bf2.Check([]byte(web2a[l])) {
+			t.Fatalf("CheckString mismatch for %q", web2a[l])
+		}
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		bf.AddString(web2[0])
+		bf.CheckString(web2a[0])
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per AddString and CheckString, got %f", allocs)
+	}
+}
+
+func TestAddUint64(t *testing.T) {
+	bf := New(100000).(*PartitionedBloom)
+	for v := uint64(0); v < 100000; v++ {
+		bf.AddUint64(v * 0x9e3779b97f4a7c15)
+	}
+
+	var key [8]byte
+	fn := 0
+	for v := uint64(0); v < 100000; v++ {
+		binary.BigEndian.PutUint64(key[:], v*0x9e3779b97f4a7c15)
+		if !bf.Check(key[:]) || !bf.CheckUint64(v*0x9e3779b97f4a7c15) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives, got %d", fn)
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		bf.AddUint64(1)
+		bf.CheckUint64(2)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per AddUint64 and CheckUint64, got %f", allocs)
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	bf.AddAll(items[:len(items)/2])
+	bf.AddAllStrings(web2[len(web2)/2:])
+
+	bf2 := New(uint(len(web2))).(*PartitionedBloom)
+	for _, item := range items {
+		bf2.Add(item)
+	}
+
+	if bf.Count() != bf2.Count() {
+		t.Errorf("Expected count %d, got %d", bf2.Count(), bf.Count())
+	}
+
+	for i := uint(0); i < bf.k; i++ {
+		if !slices.Equal(bf.partition(i), bf2.partition(i)) {
+			t.Fatalf("Expected AddAll to set the same bits as Add in partition %d", i)
+		}
+	}
+}
+
+func TestCheckMany(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < len(web2); l += 2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	items := make([][]byte, 0, len(web2)+len(web2a))
+	for _, w := range append(append([]string(nil), web2...), web2a...) {
+		items = append(items, []byte(w))
+	}
+
+	out := bf.(*PartitionedBloom).CheckMany(items, nil)
+	if len(out) != len(items) {
+		t.Fatalf("Expected %d results, got %d", len(items), len(out))
+	}
+
+	for i, item := range items {
+		if out[i] != bf.Check(item) {
+			t.Fatalf("CheckMany mismatch for %q", item)
+		}
+	}
+
+	buf := make([]bool, 10, 2000)
+	out = bf.(*PartitionedBloom).CheckMany(items[:2000], buf)
+	if &out[0] != &buf[0] {
+		t.Errorf("Expected CheckMany to reuse the result slice")
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		bf.(*PartitionedBloom).CheckMany(items[:2000], buf)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per CheckMany, got %f", allocs)
+	}
+}
+
+func TestNewWithEstimates(t *testing.T) {
+	seen := make(map[string]bool, len(web2))
+	for _, w := range web2 {
+		seen[w] = true
+	}
+
+	for _, rate := range []float64{0.01, 0.001} {
+		bf := NewWithEstimates(uint(len(web2)), rate)
+		for l := range web2 {
+			bf.Add([]byte(web2[l]))
+		}
+
+		fp, total := 0, 0
+		for l := range web2a {
+			if seen[web2a[l]] {
+				continue
+			}
+			total++
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		measured := float64(fp) / float64(total)
+		fmt.Printf("Requested false positive rate %.4f, measured %.4f\n", rate, measured)
+
+		if measured > rate*1.5 || measured < rate/4 {
+			t.Errorf("Measured false positive rate %.4f is not near the requested %.4f", measured, rate)
+		}
+	}
+}
+
+func TestNewE(t *testing.T) {
+	if _, err := NewE(0, 0.01); err != bloom.ErrInvalidCapacity {
+		t.Errorf("Expected ErrInvalidCapacity, got %v", err)
+	}
+
+	for _, e := range []float64{0, 1, -0.5, 2} {
+		if _, err := NewE(1000, e); err != bloom.ErrInvalidErrorRate {
+			t.Errorf("Expected ErrInvalidErrorRate for %v, got %v", e, err)
+		}
+	}
+
+	bf, err := NewE(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf.SetErrorProbability(0); err != bloom.ErrInvalidErrorRate {
+		t.Errorf("Expected ErrInvalidErrorRate, got %v", err)
+	}
+
+	if bf.(*PartitionedBloom).e != 0.01 {
+		t.Errorf("Expected an invalid error probability to be ignored, got %v", bf.(*PartitionedBloom).e)
+	}
+
+	if !bf.Add([]byte("hello")).Check([]byte("hello")) {
+		t.Errorf("Expected to find hello")
+	}
+}
+
+func TestParams(t *testing.T) {
+	bf := New(1000)
+	m, k := bloom.M(1000, 0.5, 0.001), bloom.K(0.001)
+	want := bloom.Params{M: m, K: k, S: bloom.S(m, k), N: 1000, P: 0.5, E: 0.001}
+	if got := bf.Params(); got != want {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	}
+
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Fatal(err)
+	}
+	bf.Reset()
+
+	m, k = bloom.M(1000, 0.5, 0.01), bloom.K(0.01)
+	want = bloom.Params{M: m, K: k, S: bloom.S(m, k), N: 1000, P: 0.5, E: 0.01}
+	if got := bf.Params(); got != want {
+		t.Fatalf("Expected %+v after Reset, got %+v", want, got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < 1000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	stats := bf.Stats()
+	if stats.Count != 1000 || stats.Params != bf.Params() || uint(len(stats.Partitions)) != stats.Params.K {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	if math.Abs(stats.FillRatio-bf.FillRatio()) > 1e-12 {
+		t.Errorf("Expected a fill ratio of %f, got %f", bf.FillRatio(), stats.FillRatio)
+	}
+
+	var c uint
+	for _, v := range stats.Partitions {
+		c += v.BitsSet
+	}
+
+	if c != stats.BitsSet {
+		t.Errorf("Expected %d bits set, got %d", c, stats.BitsSet)
+	}
+
+	var buf bytes.Buffer
+	if err := bf.WriteStats(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(buf.String(), "Bits in partition"); uint(n) != stats.Params.K {
+		t.Errorf("Expected %d partitions in %q", stats.Params.K, buf.String())
+	}
+}
+
+// TestHashCount checks that a pinned k keeps the error probability with more bits, and that
+// it is reported and kept when the filter is read back.
+func TestHashCount(t *testing.T) {
+	bf := New(1000).(*PartitionedBloom)
+	for _, k := range []uint{0, bloom.MaxHashCount + 1} {
+		if err := bf.SetHashCount(k); err != bloom.ErrInvalidHashCount {
+			t.Errorf("k = %d: expected ErrInvalidHashCount, got %v", k, err)
+		}
+	}
+
+	if bf.Params().PinnedK {
+		t.Errorf("Expected k to be derived")
+	}
+
+	n, e := uint(len(web2)), 0.01
+	bf = NewWithOptions(n, e, WithHashCount(4)).(*PartitionedBloom)
+	def := NewWithEstimates(n, e).(*PartitionedBloom)
+
+	params := bf.Params()
+	if params.K != 4 || !params.PinnedK || params.P != bloom.P(4, e) || params.E != e {
+		t.Fatalf("Unexpected parameters %+v", params)
+	}
+
+	if params.M != bloom.M(n, bloom.P(4, e), e) || params.M <= def.Params().M {
+		t.Errorf("Expected more bits than %d with fewer hash values, got %d", def.Params().M, params.M)
+	}
+
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	fp := 0
+	for _, w := range web2a {
+		if bf.CheckString(w) {
+			fp++
+		}
+	}
+
+	if rate := float64(fp) / float64(len(web2a)); rate > 1.5*e {
+		t.Errorf("Expected a false positive rate of about %f, got %f", e, rate)
+	}
+
+	if err := bf.SetHashCount(8); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	bf.WriteStats(&buf)
+	if !strings.Contains(buf.String(), "k is pinned") {
+		t.Errorf("Expected k to be reported as pinned in %q", buf.String())
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf2 := &PartitionedBloom{}
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Params() != params {
+		t.Errorf("Expected %+v after reading the filter, got %+v", params, bf2.Params())
+	}
+
+	bf2.Reset()
+	if bf2.Params() != params {
+		t.Errorf("Expected %+v after Reset, got %+v", params, bf2.Params())
+	}
+
+	// With k pinned, the fill ratio sets the error probability
+	bf2.Clear()
+	if err := bf2.SetFillRatio(0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := bf2.Params(); p.K != 4 || p.E != 0.0625 || p.P != 0.5 {
+		t.Errorf("Expected e = 0.0625 for p = 0.5 and k = 4, got %+v", p)
+	}
+
+	// A k pinned to the one derived from e is recorded in the header, and read back pinned
+	bf = NewWithOptions(n, e, WithHashCount(bloom.K(e))).(*PartitionedBloom)
+	if data, err = bf.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bf2.Params().PinnedK {
+		t.Errorf("Expected k = %d to be read back pinned", bloom.K(e))
+	}
+}
+
+func TestSkewRatio(t *testing.T) {
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	if r := bf.SkewRatio(); r != 1 {
+		t.Errorf("Expected a skew of 1 for an empty filter, got %f", r)
+	}
+
+	for l := 0; l < 10000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	ps := bf.PartitionStats()
+	if len(ps) != int(bf.k) {
+		t.Fatalf("Expected %d partitions, got %d", bf.k, len(ps))
+	}
+
+	for i, v := range ps {
+		if v.Index != i || v.Size != bf.s || v.BitsSet != bf.count(uint(i)) || v.FillRatio != float64(v.BitsSet)/float64(bf.s) {
+			t.Errorf("Unexpected statistics of partition %d: %+v", i, v)
+		}
+	}
+
+	if r := bf.SkewRatio(); r < 1 || r > 1.05 {
+		t.Errorf("Expected a skew of about 1, got %f", r)
+	}
+
+	// The first position only takes 16 values, so the first partition has at most 16 bits set
+	skewed := New(uint(len(web2))).(*PartitionedBloom)
+	skewed.SetHashFunc(func(item []byte) (uint64, uint64) {
+		a, b := bloom.XXHash(item)
+		return a % 16, b
+	})
+
+	for l := 0; l < 10000; l++ {
+		skewed.Add([]byte(web2[l]))
+	}
+
+	if ps := skewed.PartitionStats(); ps[0].BitsSet > 16 {
+		t.Errorf("Expected at most 16 bits set in the first partition, got %d", ps[0].BitsSet)
+	}
+
+	if r := skewed.SkewRatio(); r < 100 {
+		t.Errorf("Expected the skew to be detected, got %f", r)
+	}
+}
+
+func TestString(t *testing.T) {
+	bf := New(1000)
+	bf.Add([]byte("hello")).Add([]byte("world"))
+
+	if got := fmt.Sprint(bf); got != "partitioned{n=1000 m=14378 k=10 s=1438 e=0.001 count=2 fill=0.00}" {
+		t.Errorf("Unexpected summary %q", got)
+	}
+}
+
+func TestClone(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < len(web2)/2; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.(*PartitionedBloom).h == bf.(*PartitionedBloom).h {
+		t.Fatalf("Expected the clone to have its own hasher")
+	}
+
+	if c.Count() != bf.Count() || c.FillRatio() != bf.FillRatio() {
+		t.Fatalf("Expected the clone to match the filter, got %v and %v", c, bf)
+	}
+
+	fill := bf.FillRatio()
+	for l := len(web2) / 2; l < len(web2); l++ {
+		bf.Add([]byte(web2[l]))
+	}
+	for l := range web2a {
+		c.Add([]byte(web2a[l]))
+	}
+
+	if c.Count() != uint64(len(web2)/2+len(web2a)) || bf.Count() != uint64(len(web2)) {
+		t.Errorf("Expected the counts to change independently, got %d and %d", c.Count(), bf.Count())
+	}
+
+	if c.FillRatio() == fill {
+		t.Errorf("Expected the fill ratio of the clone to change")
+	}
+
+	ref := New(uint(len(web2)))
+	for l := range web2 {
+		ref.Add([]byte(web2[l]))
+	}
+
+	if bf.FillRatio() != ref.FillRatio() {
+		t.Errorf("Expected the filter not to be changed by the clone")
+	}
+
+	for l := range web2a {
+		if !c.Check([]byte(web2a[l])) {
+			t.Fatalf("Expected the clone to have %q", web2a[l])
+		}
+	}
+
+	bf = New(1000)
+	bf.SetHasher(struct{ hash.Hash }{fnv.New64()})
+	if _, err := bf.Clone(); err != bloom.ErrHasherNotCloneable {
+		t.Errorf("Expected ErrHasherNotCloneable, got %v", err)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	a := New(uint(len(web2))).(*PartitionedBloom)
+	b := New(uint(len(web2))).(*PartitionedBloom)
+
+	half := len(web2) / 2
+	for l := 0; l < half; l++ {
+		a.Add([]byte(web2[l]))
+	}
+	for l := half; l < len(web2); l++ {
+		b.Add([]byte(web2[l]))
+	}
+
+	if err := a.Union(b); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !a.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	fmt.Printf("Union: %d false negatives, estimated count %d of %d\n", fn, a.Count(), len(web2))
+
+	if fn != 0 {
+		t.Errorf("Expected no false negatives, got %d", fn)
+	}
+
+	if d := math.Abs(float64(a.Count())-float64(len(web2))) / float64(len(web2)); d > 0.01 {
+		t.Errorf("Expected the count to be near %d, got %d", len(web2), a.Count())
+	}
+
+	// A union with a copy of itself must not double the count.
+	c := a.Count()
+	self, _ := a.Clone()
+	if err := a.Union(self.(*PartitionedBloom)); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Count() > c+c/100 {
+		t.Errorf("Expected the count to stay near %d, got %d", c, a.Count())
+	}
+
+	if err := a.Union(New(1000).(*PartitionedBloom)); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different size, got %v", err)
+	}
+
+	other := New(uint(len(web2))).(*PartitionedBloom)
+	other.SetNamedHasher("fnv64a")
+	if err := a.Union(other); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different hasher, got %v", err)
+	}
+}
+
+func TestProject(t *testing.T) {
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	for _, j := range []uint{0, bf.k + 1} {
+		if _, err := bf.Project(j); !errors.Is(err, bloom.ErrInvalidHashCount) {
+			t.Errorf("j = %d: expected ErrInvalidHashCount, got %v", j, err)
+		}
+	}
+
+	for _, j := range []uint{1, 4, bf.k} {
+		p, err := bf.Project(j)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if p.K() != j || p.M() != j*bf.s || p.S() != bf.s || p.Count() != bf.Count() || p.MemoryUsage() >= bf.MemoryUsage() && j < bf.k {
+			t.Fatalf("j = %d: unexpected projection %v of %v", j, p, bf)
+		}
+
+		for l := range web2 {
+			if !p.Check([]byte(web2[l])) {
+				t.Fatalf("j = %d: expected to find %q", j, web2[l])
+			}
+		}
+
+		fp := 0
+		for l := range web2a {
+			if p.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		// The rate is the product of the fill ratios of the j partitions kept
+		want := p.CurrentFalsePositiveRate()
+		rate := float64(fp) / float64(len(web2a))
+		fmt.Printf("Project(%d): %d false positives (%.4f%%), expected %.4f%%\n", j, fp, rate*100, want*100)
+
+		if sigma := math.Sqrt(want * (1 - want) / float64(len(web2a))); math.Abs(rate-want) > 4*sigma+0.0005 {
+			t.Errorf("j = %d: expected a false positive rate of about %f, got %f", j, want, rate)
+		}
+
+		if d := want - math.Pow(bf.FillRatio(), float64(j)); math.Abs(d) > 0.01*want {
+			t.Errorf("j = %d: expected the rate to be the fill ratio to the power of %d, got %f", j, j, want)
+		}
+
+		data, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p2 := &PartitionedBloom{}
+		if err := p2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		if p2.Params() != p.Params() || p2.K() != j || !slices.Equal(p2.words, p.words) || !p2.Check([]byte(web2[0])) {
+			t.Errorf("j = %d: expected the projection after reading it, got %v", j, p2)
+		}
+	}
+
+	// The projection doesn't share the bits of the filter
+	p, _ := bf.Project(1)
+	p.Clear()
+	if !bf.Check([]byte(web2[0])) {
+		t.Errorf("Expected the filter not to be changed by its projection")
+	}
+
+	pb := NewWithOptions(1000, 0.001, WithPrimePartitions()).(*PartitionedBloom)
+	for l := 0; l < 1000; l++ {
+		pb.Add([]byte(web2[l]))
+	}
+
+	p, err := pb.Project(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := &PartitionedBloom{}
+	if err := p2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(p2.ps, pb.ps[:3]) || p2.M() != sumOf(pb.ps[:3]) {
+		t.Errorf("Expected the first 3 prime partitions, got %v", p2.ps)
+	}
+
+	for l := 0; l < 1000; l++ {
+		if !p2.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q", web2[l])
+		}
+	}
+}
+
+func TestApproximateCardinality(t *testing.T) {
+	bf := New(100000)
+
+	// Each of the 50000 distinct items is added 20 times.
+	for r := 0; r < 20; r++ {
+		for l := 0; l < 50000; l++ {
+			bf.Add([]byte(web2[l]))
+		}
+	}
+
+	c := bf.ApproximateCardinality()
+	fmt.Printf("Added %d items, %d distinct, estimated %d\n", bf.Count(), 50000, c)
+
+	if math.Abs(float64(c)-50000)/50000 > 0.02 {
+		t.Errorf("Expected about 50000 distinct items, got %d", c)
+	}
+}
+
+// TestTinyFillRatio checks the fill ratios of filters small enough that s = ceil(m/k) adds
+// a few percent to m, and that exp(-c/s) is a poor approximation of (1 - 1/s)^c.
+func TestTinyFillRatio(t *testing.T) {
+	for _, tt := range []struct{ n, m, s uint }{{10, 144, 15}, {100, 1438, 144}} {
+		bf := New(tt.n).(*PartitionedBloom)
+		if p := bf.Params(); p.M != tt.m || p.S != tt.s || p.K != 10 {
+			t.Fatalf("n = %d: expected m = %d and s = %d, got %+v", tt.n, tt.m, tt.s, p)
+		}
+
+		var set uint
+		for l := uint(0); l < tt.n; l++ {
+			bf.Add([]byte(web2[l]))
+		}
+		for i := uint(0); i < bf.k; i++ {
+			set += bf.count(i)
+		}
+
+		// The fill ratio is over the k * s bits of the partitions, not m
+		if f, want := bf.FillRatio(), float64(set)/float64(bf.k*tt.s); math.Abs(f-want) > 1e-12 {
+			t.Errorf("n = %d: expected a fill ratio of %f, got %f", tt.n, want, f)
+		}
+
+		want := 1 - math.Pow(1-1/float64(tt.s), float64(tt.n))
+		if f := bf.EstimatedFillRatio(); math.Abs(f-want) > 1e-12 {
+			t.Errorf("n = %d: expected an estimated fill ratio of %f, got %f", tt.n, want, f)
+		}
+
+		if approx := 1 - math.Exp(-float64(tt.n)/float64(tt.s)); want-approx < 0.001 {
+			t.Errorf("n = %d: expected exp(-c/s) to be off, got %f and %f", tt.n, approx, want)
+		}
+
+		// The estimate inverts the expected fill ratio, so its own bits give back n
+		for i := uint(0); i < bf.k; i++ {
+			clear(bf.partition(i))
+			for v := uint(0); v < uint(math.Round(want*float64(tt.s))); v++ {
+				bf.set(i, v)
+			}
+		}
+
+		if c := bf.estimateCount(); math.Abs(c-float64(tt.n)) > float64(tt.n)/10 {
+			t.Errorf("n = %d: expected about %d items from the bits set, got %f", tt.n, tt.n, c)
+		}
+	}
+}
+
+func TestCurrentFalsePositiveRate(t *testing.T) {
+	bf := New(uint(len(web2) / 2))
+	if r := bf.CurrentFalsePositiveRate(); r != 0 {
+		t.Errorf("Expected 0 for an empty filter, got %f", r)
+	}
+
+	for l := 0; l < len(web2)/2; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	r := bf.CurrentFalsePositiveRate()
+	if r != bf.Stats().FalsePositiveRate {
+		t.Errorf("Expected Stats to report %f, got %f", r, bf.Stats().FalsePositiveRate)
+	}
+
+	// At its design point, the filter measures about its configured error probability.
+	fp := 0
+	for l := range web2a {
+		if bf.Check([]byte(web2a[l])) {
+			fp++
+		}
+	}
+
+	measured := float64(fp) / float64(len(web2a))
+	fmt.Printf("Current false positive rate %f, measured %f\n", r, measured)
+
+	if r > 0.002 || measured > r*2 || measured < r/2 {
+		t.Errorf("Expected about 0.001, got %f and measured %f", r, measured)
+	}
+
+	// Filled with twice as many items, it is well past it.
+	for l := len(web2) / 2; l < len(web2); l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	fmt.Printf("Current false positive rate when overfilled %f\n", bf.CurrentFalsePositiveRate())
+
+	if bf.CurrentFalsePositiveRate() < 0.01 {
+		t.Errorf("Expected the false positive rate to grow, got %f", bf.CurrentFalsePositiveRate())
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	bf := New(10000).(*PartitionedBloom)
+	if bf.Capacity() != 10000 || bf.Remaining() != 10000 || bf.IsOverCapacity() {
+		t.Fatalf("Expected an empty filter with a capacity of 10000, got %d remaining", bf.Remaining())
+	}
+
+	for l := 0; l < 9900; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.Remaining() != 100 || bf.IsOverCapacity() {
+		t.Errorf("Expected 100 remaining, got %d, over capacity %t", bf.Remaining(), bf.IsOverCapacity())
+	}
+
+	for l := 9900; l < 10100; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.Remaining() != -100 || !bf.IsOverCapacity() {
+		t.Errorf("Expected -100 remaining, got %d, over capacity %t", bf.Remaining(), bf.IsOverCapacity())
+	}
+}
+
+func TestClear(t *testing.T) {
+	bf := New(10000)
+	for l := 0; l < 20000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	params := bf.Params()
+	if err := bf.SetErrorProbability(0.1); err != bloom.ErrNotEmpty {
+		t.Fatalf("Expected ErrNotEmpty, got %v", err)
+	}
+	bf.Clear()
+
+	p := bf.Params()
+	if p.M != params.M || p.K != params.K || p.S != params.S || bf.Count() != 0 || bf.FillRatio() != 0 {
+		t.Fatalf("Expected an empty filter with the same parameters, got %v", bf)
+	}
+
+	allocs := testing.AllocsPerRun(100, bf.Clear)
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per Clear, got %f", allocs)
+	}
+
+	for l := 0; l < 1000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	for l := 0; l < 1000; l++ {
+		if !bf.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q after Clear", web2[l])
+		}
+	}
+}
+
+func TestSetFillRatio(t *testing.T) {
+	bf := New(10000)
+	m := bf.Params().M
+
+	for _, p := range []float64{0, 1, -0.5} {
+		if err := bf.SetFillRatio(p); err != bloom.ErrInvalidFillRatio {
+			t.Errorf("Expected ErrInvalidFillRatio for %v, got %v", p, err)
+		}
+	}
+
+	if err := bf.SetFillRatio(0.25); err != nil {
+		t.Fatal(err)
+	}
+	bf.Reset()
+
+	if p := bf.Params(); p.P != 0.25 || p.M <= m {
+		t.Errorf("Expected p = 0.25 to give more than %d bits, got %d", m, p.M)
+	}
+
+	// The option builds the same filter
+	if got, want := NewWithOptions(10000, 0.001, WithFillRatio(0.25)).Params(), bf.Params(); got != want {
+		t.Errorf("Expected WithFillRatio to give %+v, got %+v", want, got)
+	}
+
+	if p := NewWithOptions(10000, 0.001, WithFillRatio(1)).Params().P; p != 0.5 {
+		t.Errorf("Expected an invalid fill ratio to be ignored, got p = %g", p)
+	}
+}
+
+func TestSetErrorProbability(t *testing.T) {
+	bf := New(10000)
+	if err := bf.SetErrorProbability(1e-5); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parameters are recomputed right away, without a Reset.
+	if p := bf.Params(); p.E != 1e-5 || p.K != bloom.K(1e-5) || p.M != bloom.M(10000, 0.5, 1e-5) {
+		t.Errorf("Expected the parameters for e = 1e-5, got %+v", p)
+	}
+
+	bf.Add([]byte("hello"))
+	params := bf.Params()
+
+	if err := bf.SetErrorProbability(0.01); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	if err := bf.SetFillRatio(0.25); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	if bf.Params() != params || !bf.Check([]byte("hello")) {
+		t.Errorf("Expected the filter to be unchanged")
+	}
+}
+
+func TestSetHasherNotEmpty(t *testing.T) {
+	bf := New(1000)
+	if err := bf.SetHasher(murmur3.New64()); err != nil {
+		t.Fatalf("Expected SetHasher to succeed on an empty filter, got %v", err)
+	}
+
+	bf.Add([]byte("hello"))
+
+	if err := bf.SetHasher(fnv.New64a()); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty from SetHasher, got %v", err)
+	}
+
+	if err := bf.(*PartitionedBloom).SetNamedHasher("fnv64a"); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty from SetNamedHasher, got %v", err)
+	}
+
+	if !bf.Check([]byte("hello")) {
+		t.Errorf("Expected the hasher to be unchanged")
+	}
+
+	// Reset empties the filter, so the hasher and parameters can be set again
+	bf.Reset()
+	if bf.Count() != 0 || bf.Check([]byte("hello")) {
+		t.Errorf("Expected an empty filter after Reset, got a count of %d", bf.Count())
+	}
+
+	if err := bf.SetHasher(fnv.New64a()); err != nil {
+		t.Errorf("Expected SetHasher to succeed after Reset, got %v", err)
+	}
+
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Errorf("Expected SetErrorProbability to succeed after Reset, got %v", err)
+	}
+}
+
+// With murmur3-128, each partition gets one position of the enhanced double hashing of the
+// two halves of the digest. The false positives are compared to those of filters written
+// without bloom.FlagSum128, which derive the positions from the 4 chunks of the digest and
+// its first 8 bytes.
+func TestSum128(t *testing.T) {
+	var fps [2]int
+	for i, digest := range []uint16{bloom.FlagWideDigest, bloom.FlagWideDigest | bloom.FlagSum128} {
+		for _, e := range []float64{0.001, 0.0001, 0.00001} {
+			bf := NewWithEstimates(uint(len(web2)), e).(*PartitionedBloom)
+			bf.SetNamedHasher("murmur3-128")
+			bf.digest = digest
+
+			for _, w := range web2 {
+				bf.Add([]byte(w))
+			}
+
+			for _, w := range web2a {
+				if bf.Check([]byte(w)) {
+					fps[i]++
+				}
+			}
+		}
+	}
+
+	fmt.Printf("murmur3-128: %d false positives from sum128, %d from chunks\n", fps[1], fps[0])
+
+	if float64(fps[1]) > 1.1*float64(fps[0]) {
+		t.Errorf("%d false positives from sum128, more than %d from chunks", fps[1], fps[0])
+	}
+
+	bf := New(1000).(*PartitionedBloom)
+	bf.SetNamedHasher("murmur3-128")
+	bf.AddString("hello")
+
+	h := murmur3.New128()
+	h.Write([]byte("hello"))
+	x, y := h.Sum128()
+	for i := uint(0); i < bf.k; i++ {
+		if p := bloom.FastRange(x, bf.s); !bf.test(i, p) {
+			t.Errorf("Expected bit %d of partition %d to be set", p, i)
+		}
+		x += y
+		y += uint64(i)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	bf1, bf2 := New(1000).(*PartitionedBloom), New(1000).(*PartitionedBloom)
+	bf1.SetSeed(1)
+	bf2.SetSeed(2)
+
+	for _, w := range web2[:1000] {
+		bf1.AddString(w)
+		bf2.AddString(w)
+	}
+
+	for _, w := range web2[:1000] {
+		if !bf1.CheckString(w) || !bf2.CheckString(w) {
+			t.Fatalf("False negative %q", w)
+		}
+	}
+
+	// The partitions differ, since the items are at other positions
+	for i := uint(0); i < bf1.k; i++ {
+		if slices.Equal(bf1.partition(i), bf2.partition(i)) {
+			t.Errorf("Partition %d is the same with seeds 1 and 2", i)
+		}
+	}
+
+	data, err := bf2.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf3 := &PartitionedBloom{}
+	if err := bf3.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if seed, ok := bf3.Seed(); !ok || seed != 2 {
+		t.Errorf("Seed() = %d, %t, expected 2", seed, ok)
+	}
+}
+
+func TestHashFunc(t *testing.T) {
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	if err := bf.SetNamedHasher(bloom.XXHashFunc); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, w := range web2 {
+		bf.Add([]byte(w))
+	}
+
+	// Each partition gets one position from the Hasher
+	bs := make([]uint, bf.k)
+	bloom.Hasher(bloom.XXHash).Positions([]byte(web2[0]), bs, bf.s)
+	for i, b := range bs {
+		if !bf.test(uint(i), b) {
+			t.Errorf("Expected bit %d of partition %d to be set", b, i)
+		}
+	}
+
+	fp := 0
+	for _, w := range web2a {
+		if bf.Check([]byte(w)) {
+			fp++
+		}
+	}
+
+	rate := float64(fp) / float64(len(web2a))
+	fmt.Printf("xxhash-func: %d false positives (%.4f%%)\n", fp, rate*100)
+
+	if limit := 2 * bf.Params().E; rate > limit {
+		t.Errorf("False positive rate %.4f%%, expected at most %.4f%%", rate*100, limit*100)
+	}
+}
+
+func TestIntrospector(t *testing.T) {
+	bf := New(1000)
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Fatal(err)
+	}
+
+	i, ok := bf.(bloom.Introspector)
+	if !ok {
+		t.Fatalf("Expected %T to implement bloom.Introspector", bf)
+	}
+
+	p := bf.Params()
+	if i.K() != p.K || i.M() != p.M || i.S() != p.S || i.HasherName() != bloom.DefaultHasher {
+		t.Errorf("Expected %+v with hasher %q, got k = %d, m = %d, s = %d, hasher %q", p, bloom.DefaultHasher, i.K(), i.M(), i.S(), i.HasherName())
+	}
+
+	bf.SetHasher(murmur3.New64())
+	if i.HasherName() != "" {
+		t.Errorf("Expected no hasher name, got %q", i.HasherName())
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	for _, n := range []uint{1000, 100000, 1000000} {
+		for _, e := range []float64{0.01, 0.001} {
+			bf := NewWithEstimates(n, e)
+			for l := uint64(0); l < uint64(n/2); l++ {
+				bf.(*PartitionedBloom).AddUint64(l)
+			}
+
+			used, est := bf.MemoryUsage(), EstimateMemory(n, e)
+			if m := uint64(bf.Params().M / 8); used < m {
+				t.Errorf("n = %d, e = %f: Expected at least %d bytes for the bits, got %d", n, e, m, used)
+			}
+
+			if d := math.Abs(float64(used)-float64(est)) / float64(used); d > 0.02 {
+				t.Errorf("n = %d, e = %f: Estimated %d bytes, used %d", n, e, est, used)
+			}
+		}
+	}
+
+	// The estimate of a new filter is exact, whatever its options
+	for i, opts := range [][]Option{nil, {WithFillRatio(0.25)}, {WithPowerOfTwoSize()}, {WithPrimePartitions()}, {WithHashCount(4)}} {
+		used, est := NewWithOptions(10000, 0.01, opts...).MemoryUsage(), EstimateMemoryWithOptions(10000, 0.01, opts...)
+		if used != est {
+			t.Errorf("Options %d: Estimated %d bytes, used %d", i, est, used)
+		}
+	}
+}
+
+// TestContiguousLayout checks that the partitions held in a single array set and write the
+// same bits as separate bit arrays did. testdata/partitioned.bloom was written with a
+// bitset.BitSet per partition, after adding the first 1000 words of web2 to New(1000), whose
+// partitions of 1438 bits don't end on a word.
+func TestContiguousLayout(t *testing.T) {
+	data, err := os.ReadFile("testdata/partitioned.bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf := New(1000).(*PartitionedBloom)
+	for _, w := range web2[:1000] {
+		bf.AddString(w)
+	}
+
+	if bf.s%64 == 0 {
+		t.Fatalf("Expected partitions that don't end on a word, got s = %d", bf.s)
+	}
+
+	data2, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, data2) {
+		t.Fatal("Expected the same encoding as separate bit arrays")
+	}
+
+	bf2 := &PartitionedBloom{}
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(bf.words, bf2.words) {
+		t.Error("Expected the same bits after reading the filter")
+	}
+
+	stats := bf2.Stats()
+	for i, p := range stats.Partitions {
+		want := 0
+		for v := uint(0); v < bf2.s; v++ {
+			if bf2.test(uint(i), v) {
+				want++
+			}
+		}
+
+		if p.BitsSet != uint(want) || p.FillRatio != float64(want)/float64(bf2.s) {
+			t.Errorf("Partition %d: %d bits set, fill ratio %f, expected %d", i, p.BitsSet, p.FillRatio, want)
+		}
+	}
+
+	if n := testing.AllocsPerRun(10, func() { makePartitions(bf.k, bf.s) }); n != 1 {
+		t.Errorf("Expected 1 allocation for the partitions, got %v", n)
+	}
+}
+
+// TestCraftedHeader reads filters whose header doesn't match the data, which must fail
+// without allocating what the header claims.
+func TestCraftedHeader(t *testing.T) {
+	for _, h := range []bloom.Header{
+		{M: 1 << 62, K: 4, S: 1 << 60},
+		{M: 1 << 40, K: 4, S: 1 << 38, Flags: bloom.FlagSparse},
+		{M: 1 << 62, K: 4, S: 1 << 60, Flags: bloom.FlagPrimePartitions},
+		{M: 1 << 50, K: 1 << 40, S: 1 << 10},
+		{M: 1 << 10, K: 0, S: 1 << 10},
+	} {
+		h.Version, h.Kind, h.N, h.P, h.E = bloom.Version, bloom.KindPartitioned, 1000, 0.5, 0.001
+
+		var buf bytes.Buffer
+		h.WriteTo(&buf)
+		binary.Write(&buf, binary.BigEndian, h.S)
+		buf.Write(make([]byte, 200))
+
+		if _, err := bloom.Load(bytes.NewReader(buf.Bytes())); err == nil {
+			t.Errorf("Expected Load to fail for %+v", h)
+		}
+
+		if err := new(PartitionedBloom).UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("Expected UnmarshalBinary to fail for %+v", h)
 		}
 	}
 }
 
+func TestCountOverflow(t *testing.T) {
+	bf := New(1000).(*PartitionedBloom)
+
+	// Set the counter past 2^32 rather than adding that many items.
+	bf.c = 1<<32 + 10
+	bf.Add([]byte("hello")).Add([]byte("world"))
+
+	if bf.Count() != 1<<32+12 || bf.Stats().Count != 1<<32+12 {
+		t.Fatalf("Expected a count of %d, got %d", uint64(1<<32+12), bf.Count())
+	}
+
+	if f := bf.EstimatedFillRatio(); math.IsNaN(f) || f < 0.99 || f > 1 {
+		t.Errorf("Expected an estimated fill ratio of about 1, got %f", f)
+	}
+
+	if !bf.IsOverCapacity() || bf.Remaining() != 1000-(1<<32+12) {
+		t.Errorf("Expected the filter to be over capacity, got %d remaining", bf.Remaining())
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Count() != 1<<32+12 {
+		t.Errorf("Expected the count to be serialized, got %d", bf2.Count())
+	}
+}
+
+// TestConcurrentCheck checks items from many goroutines at once, expecting the same results
+// as checking them one at a time. Run it with -race.
+func TestConcurrentCheck(t *testing.T) {
+	n := len(web2) / 10
+
+	bf := New(uint(n)).(*PartitionedBloom)
+	for l := 0; l < n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	// Half of the keys were added.
+	keys := web2[n-5000 : n+5000]
+	items := make([][]byte, len(keys))
+	want, wantU64 := make([]bool, len(keys)), make([]bool, len(keys))
+	for i, k := range keys {
+		items[i] = []byte(k)
+		want[i] = bf.Check(items[i])
+		wantU64[i] = bf.CheckUint64(uint64(i))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			if w%4 == 3 {
+				for i, got := range bf.CheckMany(items, nil) {
+					if got != want[i] {
+						t.Errorf("CheckMany(%q) = %t, expected %t", keys[i], got, want[i])
+						return
+					}
+				}
+				return
+			}
+
+			for i, k := range keys {
+				var got bool
+				switch w % 4 {
+				case 0:
+					got = bf.Check(items[i])
+				case 1:
+					got = bf.CheckString(k)
+				case 2:
+					if bf.CheckUint64(uint64(i)) != wantU64[i] {
+						t.Errorf("CheckUint64(%d) = %t, expected %t", i, !wantU64[i], wantU64[i])
+						return
+					}
+					continue
+				}
+
+				if got != want[i] {
+					t.Errorf("Check(%q) = %t, expected %t", k, got, want[i])
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
 func BenchmarkBloomFNV64(b *testing.B) {
 	var lines []string
 	lines = append(lines, web2...)
@@ -233,3 +1589,464 @@ func BenchmarkBloomSha1(b *testing.B) {
 
 	b.StopTimer()
 }
+
+func BenchmarkAddString(b *testing.B) {
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddString(web2[i%len(web2)])
+	}
+}
+
+func BenchmarkCheckString(b *testing.B) {
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.CheckString(web2[i%len(web2)])
+	}
+}
+
+// BenchmarkNew measures the allocations of a new filter, whose partitions share one array.
+func BenchmarkNew(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		New(uint(len(web2)))
+	}
+}
+
+func BenchmarkAddEach(b *testing.B) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			bf.Add(item)
+		}
+	}
+}
+
+func BenchmarkAddAll(b *testing.B) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2))).(*PartitionedBloom)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddAll(items)
+	}
+}
+
+func BenchmarkCheckEach(b *testing.B) {
+	bf := New(uint(len(web2)))
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+		bf.Add(items[l])
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			bf.Check(item)
+		}
+	}
+}
+
+func BenchmarkCheckMany(b *testing.B) {
+	bf := New(uint(len(web2)))
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+		bf.Add(items[l])
+	}
+	out := make([]bool, len(items))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.(*PartitionedBloom).CheckMany(items, out)
+	}
+}
+
+// TestWideIndex checks the positions of a filter with partitions of 2^34 bits, whose bits
+// are not allocated, are spread over the whole partitions with FlagWideIndex.
+func TestWideIndex(t *testing.T) {
+	s := ^uint(0)>>30 + 1
+	if uint64(s) <= math.MaxUint32 {
+		t.Skip("uint has 32 bits")
+	}
+
+	bf := &PartitionedBloom{s: s, k: 10, digest: bloom.DigestFlags}
+	bf.setHasher(fnv.New64(), "")
+	if bf.digestFlags()&bloom.FlagWideIndex == 0 {
+		t.Fatalf("digestFlags = %#x, expected FlagWideIndex", bf.digestFlags())
+	}
+
+	// Positions per 2^32 bits of the partitions
+	var buckets [4]int
+	var bs []uint
+	for _, w := range web2[:10000] {
+		bs = bf.Positions([]byte(w), bs[:0])
+		for _, p := range bs {
+			if p >= s {
+				t.Fatalf("Position %d of %q is past %d bits", p, w, s)
+			}
+			buckets[uint64(p)>>32]++
+		}
+	}
+
+	fmt.Printf("partitions of 2^34 bits: positions per 2^32 bits %v\n", buckets)
+	for i, c := range buckets {
+		if c < 10000*10/4/2 {
+			t.Errorf("%d positions in bits %d << 32, expected about %d", c, i, 10000*10/4)
+		}
+	}
+}
+
+// TestFastRange compares the false positives of filters mapping their positions by
+// multiply-shift with those mapping them by modulo, checked against 400000 more absent keys
+// than web2a, so the difference isn't lost in the noise.
+func TestFastRange(t *testing.T) {
+	absent := append([]string(nil), web2a...)
+	for i := 0; i < 400000; i++ {
+		absent = append(absent, fmt.Sprintf("absent-key-%d", i))
+	}
+
+	for _, hasher := range []string{bloom.DefaultHasher, "murmur3-128", "md5"} {
+		var fps [2]int
+		for i, digest := range []uint16{bloom.DigestFlags &^ bloom.FlagFastRange, bloom.DigestFlags} {
+			for _, e := range []float64{0.001, 0.0001} {
+				bf := NewWithEstimates(uint(len(web2)), e).(*PartitionedBloom)
+				bf.SetNamedHasher(hasher)
+				bf.digest = digest
+
+				for _, w := range web2 {
+					bf.Add([]byte(w))
+				}
+
+				for _, w := range absent {
+					if bf.Check([]byte(w)) {
+						fps[i]++
+					}
+				}
+			}
+		}
+
+		fmt.Printf("%s: %d false positives with multiply-shift, %d with modulo\n", hasher, fps[1], fps[0])
+
+		if float64(fps[1]) > 1.2*float64(fps[0])+10 {
+			t.Errorf("%s: %d false positives with multiply-shift, more than %d with modulo", hasher, fps[1], fps[0])
+		}
+	}
+}
+
+func BenchmarkFastRange(b *testing.B) {
+	for _, mode := range []struct {
+		name   string
+		digest uint16
+	}{
+		{"modulo", bloom.DigestFlags &^ bloom.FlagFastRange},
+		{"fastrange", bloom.DigestFlags},
+	} {
+		bf := New(uint(len(web2))).(*PartitionedBloom)
+		bf.digest = mode.digest
+
+		b.Run(mode.name+"/Add", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Add([]byte(web2[i%len(web2)]))
+			}
+		})
+
+		b.Run(mode.name+"/Check", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Check([]byte(web2a[i%len(web2a)]))
+			}
+		})
+	}
+}
+
+// TestPrimePartitions adds integer keys that are multiples of 1024 with a hash function
+// returning them as is. Modulo a power of two they would take a handful of positions, while
+// modulo the prime sizes they take as many as a good hash function would. Such a hash
+// function keeps the false positives of the keys that follow high though, so the false
+// positive rate is checked with the default one.
+func TestPrimePartitions(t *testing.T) {
+	const n = 10000
+	identity := func(item []byte) (uint64, uint64) {
+		return binary.BigEndian.Uint64(item), 1
+	}
+
+	bf := NewWithOptions(n, 0.001, WithPrimePartitions(), WithPowerOfTwoSize()).(*PartitionedBloom)
+	bf.SetHashFunc(identity)
+
+	s := bloom.S(bloom.M(n, 0.5, 0.001), bf.k)
+	if p := bf.Params(); p.S != bf.ps[0] || p.M != sumOf(bf.ps) || p.S < s {
+		t.Errorf("Unexpected parameters %+v for partitions of %v", p, bf.ps)
+	}
+
+	for i, p := range bf.ps {
+		if bloom.NextPrime(p) != p || (i > 0 && p <= bf.ps[i-1]) || (i == 0 && p != bloom.NextPrime(s)) {
+			t.Fatalf("Expected the %d primes from %d, got %v", bf.k, s, bf.ps)
+		}
+	}
+
+	for i := uint64(0); i < n; i++ {
+		bf.AddUint64(i << 10)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		if !bf.CheckUint64(i << 10) {
+			t.Fatalf("Expected to find %d", i<<10)
+		}
+	}
+
+	// The keys are distinct modulo each prime, and take 16 values modulo a power of two
+	for i, ps := range bf.PartitionStats() {
+		if ps.Size != bf.ps[i] || ps.BitsSet != n {
+			t.Errorf("Partition %d: expected %d bits set of %d, got %+v", i, n, bf.ps[i], ps)
+		}
+	}
+
+	pow2 := make(map[uint64]bool)
+	for i := uint64(0); i < n; i++ {
+		pow2[(i<<10)%uint64(bloom.PowerOfTwo(s))] = true
+	}
+	if len(pow2) != 16 {
+		t.Errorf("Expected 16 positions modulo %d, got %d", bloom.PowerOfTwo(s), len(pow2))
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf2 := &PartitionedBloom{}
+	bf2.SetHashFunc(identity)
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Params() != bf.Params() || !slices.Equal(bf2.ps, bf.ps) || !bf2.CheckUint64(1<<10) {
+		t.Errorf("Expected the prime partitions after reading the filter, got %v", bf2.ps)
+	}
+
+	bf2.Reset()
+	if !slices.Equal(bf2.ps, bf.ps) {
+		t.Errorf("Expected Reset to keep the prime partitions, got %v", bf2.ps)
+	}
+
+	// The positions of the other filters don't match
+	if err := New(n).(*PartitionedBloom).Union(bf); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible, got %v", err)
+	}
+
+	// The hash function set the false positive rate, which is kept with the default one
+	bf = NewWithOptions(n, 0.001, WithPrimePartitions()).(*PartitionedBloom)
+	for i := uint64(0); i < n; i++ {
+		bf.AddUint64(i << 10)
+	}
+
+	fp := 0
+	for i := uint64(n); i < 101*n; i++ {
+		if bf.CheckUint64(i << 10) {
+			fp++
+		}
+	}
+
+	if rate := float64(fp) / (100 * n); rate > 0.0015 {
+		t.Errorf("Expected a false positive rate of about 0.001, got %f", rate)
+	}
+}
+
+// TestPowerOfTwoSize checks that WithPowerOfTwoSize rounds s up, reports it, and keeps the
+// false positive rate at most the one the theory gives for the rounded partitions.
+func TestPowerOfTwoSize(t *testing.T) {
+	absent := append([]string(nil), web2a...)
+	for i := 0; i < 400000; i++ {
+		absent = append(absent, fmt.Sprintf("absent-key-%d", i))
+	}
+
+	for _, e := range []float64{0.1, 0.02} {
+		bf := NewWithOptions(uint(len(web2)), e, WithPowerOfTwoSize()).(*PartitionedBloom)
+
+		s := bloom.S(bloom.M(uint(len(web2)), 0.5, e), bf.k)
+		if bf.s != bloom.PowerOfTwo(s) || bf.m != bf.s*bf.k {
+			t.Fatalf("s = %d, m = %d, expected %d rounded up to a power of two", bf.s, bf.m, s)
+		}
+
+		for _, w := range web2 {
+			bf.Add([]byte(w))
+		}
+
+		fp := 0
+		for _, w := range absent {
+			if bf.Check([]byte(w)) {
+				fp++
+			}
+		}
+
+		// Each partition holds one bit of each item
+		rate := float64(fp) / float64(len(absent))
+		expected := math.Pow(1-math.Exp(-float64(len(web2))/float64(bf.s)), float64(bf.k))
+		stats := bf.Stats()
+		fmt.Printf("e = %g, s = %d rounded to %d: false positive rate %.5f, expected %.5f, estimated %.5f\n", e, s, bf.s, rate, expected, stats.FalsePositiveRate)
+
+		if stats.Params.M != bf.m || stats.Params.S != bf.s {
+			t.Errorf("Stats reports m = %d, s = %d, expected %d and %d", stats.Params.M, stats.Params.S, bf.m, bf.s)
+		}
+
+		if rate > 1.1*expected {
+			t.Errorf("e = %g: false positive rate %.5f, expected at most %.5f", e, rate, expected)
+		}
+	}
+
+	// The rounded sizes are read back, and kept by Reset
+	bf := NewWithOptions(1000, 0.001, WithPowerOfTwoSize()).(*PartitionedBloom)
+	bf.AddString("hello")
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2 := &PartitionedBloom{}
+	if _, err := bf2.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.s != bf.s || bf2.m != bf.m || !bf2.CheckString("hello") {
+		t.Errorf("Read s = %d, m = %d, expected %d and %d", bf2.s, bf2.m, bf.s, bf.m)
+	}
+
+	bf2.Reset()
+	if bf2.s != bf.s || bf2.m != bf.m {
+		t.Errorf("s = %d, m = %d after Reset, expected %d and %d", bf2.s, bf2.m, bf.s, bf.m)
+	}
+
+	// The option is recorded in the header, so a filter whose s happens to be a power of
+	// two without it is not rounded up by Reset
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &bloom.Header{}
+	hl, err := h.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Flags&bloom.FlagPowerOfTwo == 0 {
+		t.Errorf("Expected FlagPowerOfTwo in flags %#x", h.Flags)
+	}
+
+	h.Flags &^= bloom.FlagPowerOfTwo
+	buf.Reset()
+	h.WriteTo(&buf)
+	buf.Write(data[hl:])
+
+	bf3 := &PartitionedBloom{}
+	if _, err := bf3.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf3.pow2 {
+		t.Errorf("Expected s = %d without FlagPowerOfTwo not to be rounded", bf3.s)
+	}
+
+	// The option is kept along with WithPrimePartitions, which takes precedence
+	bf = NewWithOptions(1000, 0.001, WithPrimePartitions(), WithPowerOfTwoSize()).(*PartitionedBloom)
+	if data, err = bf.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf3.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bf3.pow2 || !bf3.primes || bf3.s != bf.s {
+		t.Errorf("Expected prime partitions of %d bits and pow2 set, got %d bits, pow2 = %t", bf.s, bf3.s, bf3.pow2)
+	}
+}
+
+func BenchmarkPowerOfTwoSize(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		opts []Option
+	}{
+		{"fastrange", nil},
+		{"shift", []Option{WithPowerOfTwoSize()}},
+	} {
+		bf := NewWithOptions(uint(len(web2)), 0.001, mode.opts...)
+
+		b.Run(mode.name+"/Add", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Add([]byte(web2[i%len(web2)]))
+			}
+		})
+
+		b.Run(mode.name+"/Check", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Check([]byte(web2a[i%len(web2a)]))
+			}
+		})
+	}
+}
+
+// TestNewFast checks that NewFast uses bloom.FastHasher, keeps the requested false positive
+// rate, and that its filters are loaded with the same hasher.
+func TestNewFast(t *testing.T) {
+	bf := NewFast(uint(len(web2))).(*PartitionedBloom)
+	if bf.HasherName() != bloom.FastHasher {
+		t.Fatalf("HasherName = %q, expected %q", bf.HasherName(), bloom.FastHasher)
+	}
+
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	fp := 0
+	for _, w := range web2a {
+		if bf.CheckString(w) {
+			fp++
+		}
+	}
+
+	rate := float64(fp) / float64(len(web2a))
+	fmt.Printf("%s: false positive rate %.5f, expected 0.001\n", bloom.FastHasher, rate)
+	if rate > 0.0015 {
+		t.Errorf("False positive rate %.5f, expected about 0.001", rate)
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := bf2.(*PartitionedBloom).HasherName(); name != bloom.FastHasher {
+		t.Errorf("Loaded HasherName = %q, expected %q", name, bloom.FastHasher)
+	}
+
+	for _, w := range web2 {
+		if !bf2.Check([]byte(w)) {
+			t.Fatalf("%q not found after Load", w)
+		}
+	}
+}
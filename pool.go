@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"hash"
+	"sync"
+)
+
+// Scratch holds what a filter needs to hash one item without writing to the filter: a
+// hasher of its own and buffers for the hash sum and the bit positions.
+type Scratch struct {
+	H   hash.Hash
+	Loc Locator
+	Sum [64]byte
+	U64 [8]byte
+
+	// Bs holds the positions of an item, see Positions. Pos is left to the filter.
+	Bs  []uint
+	Pos []uint
+}
+
+// Positions returns Bs resized to k positions, allocating it if it's too small.
+func (this *Scratch) Positions(k uint) []uint {
+	if uint(cap(this.Bs)) < k {
+		this.Bs = make([]uint, k)
+	}
+	return this.Bs[:k]
+}
+
+// HasherPool hands out Scratch values with hashers of the same kind as the filter's, so
+// Check can run concurrently with other Checks. The hashers are created with CloneHasher.
+// If the filter's hasher can't be cloned, there is a single Scratch using that hasher, and
+// Get blocks until it's returned with Put, so concurrent Checks of the filter are
+// serialized. Filters sharing such a hasher must not be checked concurrently.
+type HasherPool struct {
+	pool sync.Pool
+
+	mu     sync.Mutex
+	shared *Scratch
+}
+
+// NewHasherPool returns a pool for a filter using the hasher h, registered as name if name
+// is not empty.
+func NewHasherPool(name string, h hash.Hash) *HasherPool {
+	this := &HasherPool{}
+
+	if _, err := CloneHasher(name, h); err != nil {
+		this.shared = newScratch(h)
+		return this
+	}
+
+	this.pool.New = func() interface{} {
+		c, _ := CloneHasher(name, h)
+		return newScratch(c)
+	}
+
+	return this
+}
+
+func newScratch(h hash.Hash) *Scratch {
+	loc, _ := h.(Locator)
+	return &Scratch{H: h, Loc: loc}
+}
+
+// Get returns a Scratch for the caller's exclusive use until it's returned with Put.
+func (this *HasherPool) Get() *Scratch {
+	if this.shared != nil {
+		this.mu.Lock()
+		return this.shared
+	}
+
+	return this.pool.Get().(*Scratch)
+}
+
+// Put returns s, which must have been returned by Get, to the pool.
+func (this *HasherPool) Put(s *Scratch) {
+	if s == this.shared {
+		this.mu.Unlock()
+		return
+	}
+
+	this.pool.Put(s)
+}
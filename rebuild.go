@@ -0,0 +1,108 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Source calls add for each of the keys a filter is rebuilt from, such as the keys held in
+// a database or a write-ahead log, and stops early if add returns false. It returns any
+// error reading the keys.
+type Source func(add func(key []byte) bool) error
+
+// Rebuilder serves a filter that can be replaced, e.g. by a larger one once it's full,
+// without blocking Check. The filters must be safe for concurrent use, such as the filters
+// returned by Safe or standard.ConcurrentBloom, as Check and Add run concurrently.
+type Rebuilder struct {
+	// cur is the filter in use.
+	cur atomic.Pointer[Bloom]
+
+	// mu guards next, the filter being rebuilt, so Add adds to both filters while Rebuild
+	// runs, and not to the old filter only once Rebuild has swapped them.
+	mu   sync.Mutex
+	next Bloom
+
+	// rebuilding serializes Rebuild.
+	rebuilding sync.Mutex
+}
+
+// NewRebuilder returns a Rebuilder serving bf.
+func NewRebuilder(bf Bloom) *Rebuilder {
+	this := &Rebuilder{}
+	this.cur.Store(&bf)
+	return this
+}
+
+// Filter returns the filter in use.
+func (this *Rebuilder) Filter() Bloom {
+	return *this.cur.Load()
+}
+
+// Check checks key in the filter in use. During Rebuild it's the old filter.
+func (this *Rebuilder) Check(key []byte) bool {
+	return (*this.cur.Load()).Check(key)
+}
+
+// Add adds key to the filter in use, and during Rebuild to the new filter as well, so keys
+// added while it runs are not lost.
+func (this *Rebuilder) Add(key []byte) *Rebuilder {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	(*this.cur.Load()).Add(key)
+	if this.next != nil {
+		this.next.Add(key)
+	}
+	return this
+}
+
+// Rebuild adds the keys of source to next, typically an empty filter built with new
+// parameters, and then replaces the filter in use with it. Check keeps using the old filter
+// until then, and Add adds keys to both. If source fails or ctx is done first, the filter in
+// use is kept, and the error or ctx.Err() is returned. Calls to Rebuild run one at a time.
+func (this *Rebuilder) Rebuild(ctx context.Context, next Bloom, source Source) error {
+	this.rebuilding.Lock()
+	defer this.rebuilding.Unlock()
+
+	this.mu.Lock()
+	this.next = next
+	this.mu.Unlock()
+
+	err := source(func(key []byte) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		next.Add(key)
+		return true
+	})
+
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.next = nil
+	if err != nil {
+		return err
+	}
+
+	this.cur.Store(&next)
+	return nil
+}
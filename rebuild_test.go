@@ -0,0 +1,201 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// TestRebuild rebuilds a filter at a larger size while other goroutines add and check
+// items. Run it with -race.
+func TestRebuild(t *testing.T) {
+	const n = 10000
+
+	var (
+		mu   sync.Mutex
+		keys [][]byte
+	)
+
+	// source holds every key added, like a write-ahead log.
+	source := func(add func(key []byte) bool) error {
+		mu.Lock()
+		snapshot := keys[:len(keys):len(keys)]
+		mu.Unlock()
+
+		for _, k := range snapshot {
+			if !add(k) {
+				break
+			}
+		}
+		return nil
+	}
+
+	rb := bloom.NewRebuilder(bloom.Safe(standard.New(n)))
+	add := func(i int) {
+		k := binary.BigEndian.AppendUint64(nil, uint64(i))
+		mu.Lock()
+		keys = append(keys, k)
+		mu.Unlock()
+		rb.Add(k)
+	}
+
+	for i := 0; i < n; i++ {
+		add(i)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := n; i < 2*n; i++ {
+			add(i)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i = (i + 1) % n {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if !rb.Check(binary.BigEndian.AppendUint64(nil, uint64(i))) {
+				t.Errorf("Expected to find %d during Rebuild", i)
+				return
+			}
+		}
+	}()
+
+	next := bloom.Safe(standard.New(4 * n))
+	if err := rb.Rebuild(context.Background(), next, source); err != nil {
+		t.Fatal(err)
+	}
+
+	close(done)
+	wg.Wait()
+
+	if rb.Filter() != next {
+		t.Fatalf("Expected the rebuilt filter to be in use")
+	}
+
+	for i := 0; i < 2*n; i++ {
+		if !rb.Check(binary.BigEndian.AppendUint64(nil, uint64(i))) {
+			t.Fatalf("Expected to find %d after Rebuild", i)
+		}
+	}
+}
+
+func TestRebuildError(t *testing.T) {
+	bf := bloom.Safe(standard.New(1000))
+	rb := bloom.NewRebuilder(bf)
+
+	errSource := errors.New("source failed")
+	if err := rb.Rebuild(context.Background(), bloom.Safe(standard.New(2000)), func(add func([]byte) bool) error {
+		add([]byte("foo"))
+		return errSource
+	}); err != errSource {
+		t.Errorf("Expected the error of the source, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := rb.Rebuild(ctx, bloom.Safe(standard.New(2000)), func(add func([]byte) bool) error {
+		for i := 0; add([]byte{byte(i)}); i++ {
+			if i == 10 {
+				cancel()
+			}
+		}
+		return nil
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	if rb.Filter() != bf {
+		t.Errorf("Expected the filter to be kept after a failed Rebuild")
+	}
+
+	// Add no longer adds to the filters of the failed rebuilds.
+	rb.Add([]byte("bar"))
+	if !bf.Check([]byte("bar")) {
+		t.Errorf("Expected to find bar")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	const n = 1000
+
+	k1, k2 := bloom.NewSipHashKey(), bloom.NewSipHashKey()
+
+	bf := standard.New(n).(*standard.StandardBloom)
+	if err := bf.SetNamedHasher(bloom.SipHashName(k1)); err != nil {
+		t.Fatal(err)
+	}
+
+	source := func(add func(key []byte) bool) error {
+		for i := 0; i < n; i++ {
+			if !add(binary.BigEndian.AppendUint64(nil, uint64(i))) {
+				break
+			}
+		}
+		return nil
+	}
+
+	source(func(key []byte) bool {
+		bf.Add(key)
+		return true
+	})
+
+	// The key of a populated filter can't be changed in place
+	if err := bf.SetNamedHasher(bloom.SipHashName(k2)); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected bloom.ErrNotEmpty, got %v", err)
+	}
+
+	rb := bloom.NewRebuilder(bf)
+	if err := rb.RotateKey(context.Background(), k2, source); err != nil {
+		t.Fatal(err)
+	}
+
+	next := rb.Filter().(*standard.StandardBloom)
+	if next == bf || next.HasherName() != bloom.SipHashName(k2) || next.Count() != n {
+		t.Fatalf("Expected a new filter keyed with k2 holding %d items, got %q with %d", n, next.HasherName(), next.Count())
+	}
+
+	for i := 0; i < n; i++ {
+		if !rb.Check(binary.BigEndian.AppendUint64(nil, uint64(i))) {
+			t.Fatalf("Expected to find %d after RotateKey", i)
+		}
+	}
+
+	// The filter is kept untouched
+	if bf.HasherName() != bloom.SipHashName(k1) || bf.Count() != n {
+		t.Errorf("Expected the old filter to be unchanged")
+	}
+
+	if err := bloom.NewRebuilder(bloom.Safe(standard.New(n))).RotateKey(context.Background(), k2, source); !errors.Is(err, bloom.ErrNoNamedHasher) {
+		t.Errorf("Expected ErrNoNamedHasher, got %v", err)
+	}
+}
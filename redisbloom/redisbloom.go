@@ -0,0 +1,569 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redisbloom converts filters to and from the chunks produced by RedisBloom's
+// BF.SCANDUMP command and consumed by its BF.LOADCHUNK command.
+//
+// RedisBloom filters are chains of sub-filters, or links. The first chunk holds a header
+// describing every link, and the following chunks hold the bit arrays of the links, in
+// order. The header is a packed little endian struct:
+//
+//	size     uint64  total number of items added
+//	nfilters uint32  number of links
+//	options  uint32  BLOOM_OPT_* flags
+//	growth   uint32  capacity growth factor between links
+//
+// followed by nfilters links:
+//
+//	bytes   uint64   size of the bit array in bytes
+//	bits    uint64   size of the bit array in bits
+//	size    uint64   number of items added to the link
+//	error   float64  error rate of the link
+//	bpe     float64  bits per entry
+//	hashes  uint32   number of hash values, k
+//	entries uint64   capacity of the link, n
+//	n2      uint8    log2 of bits if bits is a power of two, or 0
+//
+// Bit positions are derived from two MurmurHash64A values of the key, a with the seed
+// 0xc6a4a7935bd1e995 and b with the seed a, as (a + i*b) % bits. Only filters using this
+// 64-bit hashing (BLOOM_OPT_FORCE64, the default for filters created by BF.RESERVE and
+// BF.ADD) are supported.
+//
+// Filters created with New, or loaded with Load, use the Hasher hash function and can be
+// written back with Dump. Filters using any other hash function or sizing cannot, and Dump
+// returns ErrIncompatible for them rather than producing a filter that misses keys.
+package redisbloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/scalable"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// Hasher is the name of the hash function registered by this package with
+// bloom.RegisterHasher. It implements bloom.Locator, deriving bit positions the way
+// RedisBloom does.
+const Hasher = "redisbloom-murmur64a"
+
+// Options recorded in the RedisBloom header.
+const (
+	OptNoRound    = 1
+	OptEntsIsBits = 2
+	OptForce64    = 4
+	OptNoScaling  = 8
+)
+
+const (
+	// TighteningRatio is the ratio applied by RedisBloom to the error rate of each new link.
+	TighteningRatio = 0.5
+
+	// DefaultChunkSize is the largest chunk of bit array written by Dump if no size is given.
+	DefaultChunkSize = 10 * 1024 * 1024
+
+	// seed is the seed of the first MurmurHash64A value.
+	seed = 0xc6a4a7935bd1e995
+
+	headerSize = 20
+	linkSize   = 53
+)
+
+// ErrIncompatible is returned when a filter cannot be represented in the other system
+// without changing which keys it reports as present.
+var ErrIncompatible = errors.New("redisbloom: incompatible filter")
+
+func init() {
+	bloom.RegisterHasher(Hasher, func() hash.Hash { return &murmur64a{} })
+}
+
+// Chunk is one reply of BF.SCANDUMP, or the arguments of one BF.LOADCHUNK call.
+type Chunk struct {
+	Iter int64
+	Data []byte
+}
+
+// Params returns the number of bits and hash values RedisBloom uses for a link with the
+// given capacity and error rate, when created without rounding to a power of two.
+func Params(entries uint, errorRate float64) (bits uint64, hashes uint) {
+	bpe := bitsPerEntry(errorRate)
+	bits = uint64(float64(entries) * bpe)
+	if bits%64 != 0 {
+		bits = (bits/64 + 1) * 64
+	}
+	return bits, uint(math.Ceil(math.Ln2 * bpe))
+}
+
+// New returns an empty filter sized like a RedisBloom filter reserved with the same
+// capacity and error rate, and using Hasher, so it can be written with Dump.
+func New(entries uint, errorRate float64) (*standard.StandardBloom, error) {
+	bits, hashes := Params(entries, errorRate)
+	if entries == 0 || hashes == 0 {
+		return nil, fmt.Errorf("redisbloom: invalid capacity %d or error rate %f", entries, errorRate)
+	}
+
+	return newStandard(&link{entries: uint64(entries), error: errorRate, bits: bits, hashes: uint32(hashes)})
+}
+
+// Dump returns the chunks BF.SCANDUMP would return for bf, in order, each at most
+// maxChunk bytes long if maxChunk is positive. The first chunk holds the header. Passing
+// each chunk to BF.LOADCHUNK with its Iter recreates the filter in RedisBloom.
+//
+// bf must be a *standard.StandardBloom, written as a non-scaling RedisBloom filter, or a
+// *scalable.ScalableBloom whose layers are all *standard.StandardBloom. Every filter must
+// use Hasher and have a bit array that is a whole number of 64-bit words. Filters created
+// with New or Load satisfy this, but layers added by ScalableBloom itself don't, so Dump
+// returns ErrIncompatible for such filters.
+func Dump(bf bloom.Bloom, maxChunk int) ([]Chunk, error) {
+	if maxChunk <= 0 {
+		maxChunk = DefaultChunkSize
+	}
+
+	enc, ok := bf.(bloom.Encoder)
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot dump filter of type %T", ErrIncompatible, bf)
+	}
+
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		return nil, err
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	h := &bloom.Header{}
+	if _, err := h.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	var (
+		links   []*link
+		options uint32 = OptNoRound | OptForce64
+		growth  uint32 = 2
+	)
+
+	switch h.Kind {
+	case bloom.KindStandard:
+		l, err := readLink(h, r)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+		options |= OptNoScaling
+
+	case bloom.KindScalable:
+		if h.Hasher != Hasher {
+			return nil, fmt.Errorf("%w: hasher is %q, not %q", ErrIncompatible, h.Hasher, Hasher)
+		}
+
+		// The growth settings following r and the number of layers are taken from the
+		// layers instead
+		sh := make([]byte, 16, 32)
+		if h.Flags&bloom.FlagScalableGrowth != 0 {
+			sh = sh[:32]
+		}
+		if _, err := r.Read(sh); err != nil {
+			return nil, err
+		}
+
+		for i := binary.BigEndian.Uint64(sh[8:16]); i > 0; i-- {
+			lh := &bloom.Header{}
+			if _, err := lh.ReadFrom(r); err != nil {
+				return nil, err
+			}
+
+			if lh.Kind != bloom.KindStandard {
+				return nil, fmt.Errorf("%w: layer %d is a %s filter", ErrIncompatible, len(links), lh.Kind)
+			}
+
+			// Layers get the hasher of the scalable filter, so their own name is empty.
+			lh.Hasher = h.Hasher
+
+			l, err := readLink(lh, r)
+			if err != nil {
+				return nil, err
+			}
+			links = append(links, l)
+		}
+
+		if len(links) > 1 && links[0].entries > 0 {
+			growth = uint32(links[1].entries / links[0].entries)
+		}
+
+	default:
+		return nil, fmt.Errorf("%w: cannot dump %s filter", ErrIncompatible, h.Kind)
+	}
+
+	hdr := make([]byte, headerSize, headerSize+len(links)*linkSize)
+	binary.LittleEndian.PutUint64(hdr[0:8], h.C)
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(links)))
+	binary.LittleEndian.PutUint32(hdr[12:16], options)
+	binary.LittleEndian.PutUint32(hdr[16:20], growth)
+	for _, l := range links {
+		hdr = l.appendHeader(hdr)
+	}
+
+	chunks := []Chunk{{Iter: 1, Data: hdr}}
+
+	off := int64(0)
+	for _, l := range links {
+		for p := 0; p < len(l.data); p += maxChunk {
+			end := p + maxChunk
+			if end > len(l.data) {
+				end = len(l.data)
+			}
+
+			off += int64(end - p)
+			chunks = append(chunks, Chunk{Iter: off + 1, Data: l.data[p:end]})
+		}
+	}
+
+	return chunks, nil
+}
+
+// Load rebuilds a filter from the chunks returned by BF.SCANDUMP. The chunk with Iter 1
+// must hold the header. The other chunks may come in any order. A non-scaling filter with
+// a single link is returned as a *standard.StandardBloom, and any other filter as a
+// *scalable.ScalableBloom with one layer per link, using TighteningRatio for layers added
+// later.
+func Load(chunks []Chunk) (bloom.Bloom, error) {
+	var hdr []byte
+	for _, c := range chunks {
+		if c.Iter == 1 {
+			hdr = c.Data
+			break
+		}
+	}
+
+	if len(hdr) < headerSize {
+		return nil, fmt.Errorf("redisbloom: missing or truncated header chunk")
+	}
+
+	size := binary.LittleEndian.Uint64(hdr[0:8])
+	nfilters := binary.LittleEndian.Uint32(hdr[8:12])
+	options := binary.LittleEndian.Uint32(hdr[12:16])
+
+	if options&OptForce64 == 0 || options&OptEntsIsBits != 0 {
+		return nil, fmt.Errorf("%w: options %#x, only 64-bit hashing of entries is supported", ErrIncompatible, options)
+	}
+
+	if nfilters == 0 || len(hdr) != headerSize+int(nfilters)*linkSize {
+		return nil, fmt.Errorf("redisbloom: header of %d bytes doesn't hold %d links", len(hdr), nfilters)
+	}
+
+	var (
+		links []*link
+		total int64
+	)
+
+	for i := 0; i < int(nfilters); i++ {
+		l, err := parseLink(hdr[headerSize+i*linkSize:])
+		if err != nil {
+			return nil, fmt.Errorf("redisbloom: link %d: %v", i, err)
+		}
+
+		l.data = make([]byte, l.bytes)
+		links = append(links, l)
+		total += int64(l.bytes)
+	}
+
+	for _, c := range chunks {
+		if c.Iter == 1 {
+			continue
+		}
+
+		start := c.Iter - int64(len(c.Data)) - 1
+		if start < 0 || c.Iter-1 > total {
+			return nil, fmt.Errorf("redisbloom: chunk at iter %d of %d bytes is out of range", c.Iter, len(c.Data))
+		}
+
+		for _, l := range links {
+			if start < int64(len(l.data)) {
+				if start+int64(len(c.Data)) > int64(len(l.data)) {
+					return nil, fmt.Errorf("redisbloom: chunk at iter %d crosses a link boundary", c.Iter)
+				}
+				copy(l.data[start:], c.Data)
+				break
+			}
+			start -= int64(len(l.data))
+		}
+	}
+
+	if nfilters == 1 && options&OptNoScaling != 0 {
+		return newStandard(links[0])
+	}
+
+	var buf bytes.Buffer
+	sh := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindScalable,
+		Hasher:  Hasher,
+		N:       links[0].entries,
+		C:       size,
+		P:       0.5,
+		E:       links[0].error / TighteningRatio,
+	}
+
+	if _, err := sh.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[0:8], math.Float64bits(TighteningRatio))
+	binary.BigEndian.PutUint64(b[8:16], uint64(len(links)))
+	buf.Write(b[:])
+
+	for _, l := range links {
+		if err := l.writeTo(&buf); err != nil {
+			return nil, err
+		}
+	}
+
+	bf := &scalable.ScalableBloom{}
+	if err := bf.UnmarshalBinary(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// link is one sub-filter of a RedisBloom chain.
+type link struct {
+	bytes, bits, size, entries uint64
+	error                      float64
+	hashes                     uint32
+	n2                         uint8
+
+	// data is the bit array in RedisBloom's layout, where bit i is bit i%8 of byte i/8.
+	data []byte
+}
+
+func parseLink(b []byte) (*link, error) {
+	l := &link{
+		bytes:   binary.LittleEndian.Uint64(b[0:8]),
+		bits:    binary.LittleEndian.Uint64(b[8:16]),
+		size:    binary.LittleEndian.Uint64(b[16:24]),
+		error:   math.Float64frombits(binary.LittleEndian.Uint64(b[24:32])),
+		hashes:  binary.LittleEndian.Uint32(b[40:44]),
+		entries: binary.LittleEndian.Uint64(b[44:52]),
+		n2:      b[52],
+	}
+
+	if l.hashes == 0 || l.bits == 0 || l.bits > l.bytes*8 || l.bytes%8 != 0 {
+		return nil, fmt.Errorf("invalid parameters bytes = %d, bits = %d, hashes = %d", l.bytes, l.bits, l.hashes)
+	}
+
+	if l.n2 != 0 && l.bits != 1<<l.n2 {
+		return nil, fmt.Errorf("bits = %d is not 2^%d", l.bits, l.n2)
+	}
+
+	return l, nil
+}
+
+func (this *link) appendHeader(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint64(b, this.bytes)
+	b = binary.LittleEndian.AppendUint64(b, this.bits)
+	b = binary.LittleEndian.AppendUint64(b, this.size)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(this.error))
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(bitsPerEntry(this.error)))
+	b = binary.LittleEndian.AppendUint32(b, this.hashes)
+	b = binary.LittleEndian.AppendUint64(b, this.entries)
+	return append(b, this.n2)
+}
+
+// readLink reads the body of a dense serialized standard filter with header h.
+func readLink(h *bloom.Header, r *bytes.Reader) (*link, error) {
+	if h.Hasher != Hasher {
+		return nil, fmt.Errorf("%w: hasher is %q, not %q", ErrIncompatible, h.Hasher, Hasher)
+	}
+
+	if h.M%64 != 0 {
+		return nil, fmt.Errorf("%w: m = %d is not a multiple of 64", ErrIncompatible, h.M)
+	}
+
+	l := &link{
+		bytes:   h.M / 8,
+		bits:    h.M,
+		size:    h.C,
+		entries: h.N,
+		error:   h.E,
+		hashes:  uint32(h.K),
+		data:    make([]byte, h.M/8),
+	}
+
+	if h.M&(h.M-1) == 0 {
+		l.n2 = uint8(math.Log2(float64(h.M)))
+	}
+
+	words := make([]byte, h.M/8)
+	if _, err := r.Read(words); err != nil && len(words) > 0 {
+		return nil, err
+	}
+
+	for i := 0; i < len(words); i += 8 {
+		binary.LittleEndian.PutUint64(l.data[i:], binary.BigEndian.Uint64(words[i:]))
+	}
+
+	return l, nil
+}
+
+// writeTo writes the link as a dense serialized standard filter.
+func (this *link) writeTo(buf *bytes.Buffer) error {
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindStandard,
+		Hasher:  Hasher,
+		M:       this.bits,
+		K:       uint64(this.hashes),
+		N:       this.entries,
+		C:       this.size,
+		P:       0.5,
+		E:       this.error,
+	}
+
+	if _, err := h.WriteTo(buf); err != nil {
+		return err
+	}
+
+	nw := (this.bits + 63) / 64
+	for i := uint64(0); i < nw; i++ {
+		var w uint64
+		if (i+1)*8 <= uint64(len(this.data)) {
+			w = binary.LittleEndian.Uint64(this.data[i*8:])
+		}
+		binary.Write(buf, binary.BigEndian, w)
+	}
+
+	return nil
+}
+
+func newStandard(l *link) (*standard.StandardBloom, error) {
+	if l.data == nil {
+		l.data = make([]byte, l.bits/8)
+	}
+
+	var buf bytes.Buffer
+	if err := l.writeTo(&buf); err != nil {
+		return nil, err
+	}
+
+	bf := &standard.StandardBloom{}
+	if err := bf.UnmarshalBinary(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// bitsPerEntry returns the bits per entry RedisBloom uses for the error rate e.
+func bitsPerEntry(e float64) float64 {
+	return -math.Log(e) / (math.Ln2 * math.Ln2)
+}
+
+// murmur64a is MurmurHash64A as used by RedisBloom. It buffers the data written to it,
+// since the hash is computed over the whole key at once.
+type murmur64a struct {
+	buf []byte
+}
+
+var _ bloom.Locator = (*murmur64a)(nil)
+
+func (this *murmur64a) Write(p []byte) (int, error) {
+	this.buf = append(this.buf, p...)
+	return len(p), nil
+}
+
+func (this *murmur64a) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, this.Sum64())
+}
+
+func (this *murmur64a) Sum64() uint64 {
+	return murmurHash64A(this.buf, seed)
+}
+
+func (this *murmur64a) Reset() {
+	this.buf = this.buf[:0]
+}
+
+func (this *murmur64a) Size() int {
+	return 8
+}
+
+func (this *murmur64a) BlockSize() int {
+	return 8
+}
+
+// Locate fills bs with the bit positions for item in a filter of m bits, the way
+// RedisBloom does.
+func (this *murmur64a) Locate(item []byte, bs []uint, m uint) {
+	a := murmurHash64A(item, seed)
+	b := murmurHash64A(item, a)
+
+	for i := range bs {
+		bs[i] = uint((a + uint64(i)*b) % uint64(m))
+	}
+}
+
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const (
+		m = 0xc6a4a7935bd1e995
+		r = 47
+	)
+
+	h := seed ^ (uint64(len(data)) * m)
+
+	for ; len(data) >= 8; data = data[8:] {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+	}
+
+	switch len(data) {
+	case 7:
+		h ^= uint64(data[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(data[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(data[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(data[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(data[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisbloom
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/zhenjl/bloom/scalable"
+	"github.com/zhenjl/bloom/standard"
+)
+
+var (
+	web2 []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+}
+
+func TestParams(t *testing.T) {
+	bits, hashes := Params(1000, 0.01)
+	if bits != 9600 || hashes != 7 {
+		t.Fatalf("Params(1000, 0.01) = %d, %d, want 9600, 7", bits, hashes)
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	l := len(web2) / 2
+
+	bf, err := New(uint(l), 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < l; i++ {
+		bf.Add([]byte(web2[i]))
+	}
+
+	chunks, err := Dump(bf, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks[0].Iter != 1 {
+		t.Fatalf("first chunk has iter %d, want 1", chunks[0].Iter)
+	}
+
+	off := int64(0)
+	for _, c := range chunks[1:] {
+		if len(c.Data) > 4096 {
+			t.Fatalf("chunk at iter %d has %d bytes", c.Iter, len(c.Data))
+		}
+
+		off += int64(len(c.Data))
+		if c.Iter != off+1 {
+			t.Fatalf("chunk ending at offset %d has iter %d", off, c.Iter)
+		}
+	}
+
+	// Chunks other than the header can be loaded in any order.
+	rev := []Chunk{chunks[0]}
+	for i := len(chunks) - 1; i > 0; i-- {
+		rev = append(rev, chunks[i])
+	}
+
+	lbf, err := Load(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sbf, ok := lbf.(*standard.StandardBloom)
+	if !ok {
+		t.Fatalf("Load returned %T, want *standard.StandardBloom", lbf)
+	}
+
+	if sbf.Count() != bf.Count() {
+		t.Fatalf("count is %d, want %d", sbf.Count(), bf.Count())
+	}
+
+	for _, w := range web2 {
+		if sbf.Check([]byte(w)) != bf.Check([]byte(w)) {
+			t.Fatalf("Check(%q) differs after Load", w)
+		}
+	}
+
+	chunks2, err := Dump(sbf, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chunks2) != len(chunks) {
+		t.Fatalf("got %d chunks after Load, want %d", len(chunks2), len(chunks))
+	}
+
+	for i := range chunks {
+		if chunks2[i].Iter != chunks[i].Iter || !bytes.Equal(chunks2[i].Data, chunks[i].Data) {
+			t.Fatalf("chunk %d differs after Load", i)
+		}
+	}
+}
+
+func TestDumpLoadChain(t *testing.T) {
+	l := len(web2) / 4
+
+	var (
+		hdr    []byte
+		data   []Chunk
+		off    int64
+		checks []*standard.StandardBloom
+	)
+
+	for i, n := range []int{l, 2 * l} {
+		bf, err := New(uint(n), 0.01/float64(int(1)<<i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, w := range web2[i*l : i*l+n/2] {
+			bf.Add([]byte(w))
+		}
+		checks = append(checks, bf)
+
+		chunks, err := Dump(bf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hdr == nil {
+			hdr = append(hdr, chunks[0].Data[:headerSize]...)
+		}
+		hdr = append(hdr, chunks[0].Data[headerSize:]...)
+
+		for _, c := range chunks[1:] {
+			off += int64(len(c.Data))
+			data = append(data, Chunk{Iter: off + 1, Data: c.Data})
+		}
+	}
+
+	binary.LittleEndian.PutUint64(hdr[0:8], uint64(checks[0].Count()+checks[1].Count()))
+	binary.LittleEndian.PutUint32(hdr[8:12], 2)
+	binary.LittleEndian.PutUint32(hdr[12:16], OptNoRound|OptForce64)
+
+	lbf, err := Load(append([]Chunk{{Iter: 1, Data: hdr}}, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sbf, ok := lbf.(*scalable.ScalableBloom)
+	if !ok {
+		t.Fatalf("Load returned %T, want *scalable.ScalableBloom", lbf)
+	}
+
+	for _, w := range web2 {
+		want := checks[0].Check([]byte(w)) || checks[1].Check([]byte(w))
+		if sbf.Check([]byte(w)) != want {
+			t.Fatalf("Check(%q) = %t, want %t", w, !want, want)
+		}
+	}
+
+	chunks, err := Dump(sbf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(chunks[0].Data, hdr) {
+		t.Fatalf("header differs after Load")
+	}
+
+	for i, c := range chunks[1:] {
+		if c.Iter != data[i].Iter || !bytes.Equal(c.Data, data[i].Data) {
+			t.Fatalf("chunk %d differs after Load", i+1)
+		}
+	}
+}
+
+func TestIncompatible(t *testing.T) {
+	bf := standard.New(uint(len(web2)))
+	if _, err := Dump(bf, 0); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Dump with default hasher returned %v, want ErrIncompatible", err)
+	}
+
+	if _, err := Dump(scalable.New(uint(len(web2))), 0); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Dump of scalable filter with default hasher returned %v, want ErrIncompatible", err)
+	}
+
+	rbf, err := New(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := Dump(rbf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := append([]byte(nil), chunks[0].Data...)
+	binary.LittleEndian.PutUint32(hdr[12:16], OptNoRound|OptNoScaling)
+	if _, err := Load([]Chunk{{Iter: 1, Data: hdr}, chunks[1]}); !errors.Is(err, ErrIncompatible) {
+		t.Fatalf("Load without FORCE64 returned %v, want ErrIncompatible", err)
+	}
+
+	if _, err := Load(chunks[1:]); err == nil {
+		t.Fatalf("Load without header chunk succeeded")
+	}
+
+	if _, err := Load([]Chunk{chunks[0], {Iter: chunks[1].Iter + 8, Data: chunks[1].Data}}); err == nil {
+		t.Fatalf("Load with chunk out of range succeeded")
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redisstore holds the bits of a bloom.Stored filter in a Redis string, so the
+// filter can be shared by processes that keep no state of their own.
+//
+// Bit i of the filter is bit i of the string as read by GETBIT, set with SETBIT. The k
+// commands of one Add or Check are pipelined: they are written at once, and their replies
+// read back, so an operation takes a single round trip. With a TTL, the expiry of the key
+// is set by a PEXPIRE sent in the same pipeline as the SETBITs of every Add, so the key
+// expires once no item has been added for the TTL.
+//
+// The store speaks the Redis protocol itself, over connections made by net.Dialer, or by
+// the dialer set with WithDialer, for instance to connect with TLS. Connections are kept
+// for reuse, and closed on any network error.
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/zhenjl/bloom"
+)
+
+// Error is an error reply of the Redis server, such as WRONGTYPE if the key holds other
+// than a string.
+type Error string
+
+func (this Error) Error() string {
+	return "redisstore: " + string(this)
+}
+
+// ErrProtocol is returned when the server replies with other than what the command
+// returns.
+var ErrProtocol = errors.New("redisstore: unexpected reply")
+
+// Store is a bloom.BitStore holding the bits in the Redis string at a key. It is safe for
+// concurrent use.
+type Store struct {
+	addr, key string
+	ttl       time.Duration
+
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// idle holds the connections kept for reuse
+	idle chan *conn
+}
+
+var _ bloom.BitStore = (*Store)(nil)
+
+// conn is a connection to the server, with its buffers.
+type conn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Option configures a store created by New.
+type Option func(*Store)
+
+// WithTTL sets the expiry of the key to ttl after each Add. A ttl of 0, the default,
+// leaves the expiry of the key alone.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Store) {
+		if ttl >= 0 {
+			s.ttl = ttl
+		}
+	}
+}
+
+// WithDialer sets the function making the connections to the server, which is
+// net.Dialer.DialContext by default.
+func WithDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(s *Store) {
+		if dial != nil {
+			s.dial = dial
+		}
+	}
+}
+
+// WithMaxIdle sets the number of connections kept for reuse, 8 by default. More
+// concurrent operations than that make new connections, which are closed after use.
+func WithMaxIdle(n int) Option {
+	return func(s *Store) {
+		if n >= 0 {
+			s.idle = make(chan *conn, n)
+		}
+	}
+}
+
+// New returns a store holding the bits in the string at key on the Redis server at addr,
+// a host:port. No connection is made until the store is used.
+func New(addr, key string, opts ...Option) *Store {
+	this := &Store{
+		addr: addr,
+		key:  key,
+		dial: (&net.Dialer{}).DialContext,
+		idle: make(chan *conn, 8),
+	}
+
+	for _, opt := range opts {
+		opt(this)
+	}
+
+	return this
+}
+
+// Key returns the key holding the bits.
+func (this *Store) Key() string {
+	return this.key
+}
+
+// Set implements bloom.BitStore with a SETBIT for each position, followed by a PEXPIRE if
+// a TTL is set, in a single pipeline.
+func (this *Store) Set(ctx context.Context, bs []uint) error {
+	cmds := make([][]string, 0, len(bs)+1)
+	for _, v := range bs {
+		cmds = append(cmds, []string{"SETBIT", this.key, strconv.FormatUint(uint64(v), 10), "1"})
+	}
+	if this.ttl > 0 {
+		cmds = append(cmds, []string{"PEXPIRE", this.key, strconv.FormatInt(this.ttl.Milliseconds(), 10)})
+	}
+
+	_, err := this.do(ctx, cmds)
+	return err
+}
+
+// Test implements bloom.BitStore with a GETBIT for each position, in a single pipeline.
+func (this *Store) Test(ctx context.Context, bs []uint) (bool, error) {
+	cmds := make([][]string, len(bs))
+	for i, v := range bs {
+		cmds[i] = []string{"GETBIT", this.key, strconv.FormatUint(uint64(v), 10)}
+	}
+
+	replies, err := this.do(ctx, cmds)
+	if err != nil {
+		return false, err
+	}
+
+	for _, v := range replies {
+		if v == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// TTL returns the time left before the key expires, read with PTTL. Like PTTL, it returns
+// -1 if the key has no expiry, and -2 if the key doesn't exist.
+func (this *Store) TTL(ctx context.Context) (time.Duration, error) {
+	replies, err := this.do(ctx, [][]string{{"PTTL", this.key}})
+	if err != nil {
+		return 0, err
+	}
+
+	if replies[0] < 0 {
+		return time.Duration(replies[0]), nil
+	}
+	return time.Duration(replies[0]) * time.Millisecond, nil
+}
+
+// Expire sets the expiry of the key to ttl from now, with PEXPIRE, whether or not a TTL
+// is set with WithTTL.
+func (this *Store) Expire(ctx context.Context, ttl time.Duration) error {
+	_, err := this.do(ctx, [][]string{{"PEXPIRE", this.key, strconv.FormatInt(ttl.Milliseconds(), 10)}})
+	return err
+}
+
+// Clear deletes the key, removing all the items of every filter sharing it.
+func (this *Store) Clear(ctx context.Context) error {
+	_, err := this.do(ctx, [][]string{{"DEL", this.key}})
+	return err
+}
+
+// Close closes the connections kept for reuse. The store can still be used, making new
+// connections.
+func (this *Store) Close() error {
+	for {
+		select {
+		case c := <-this.idle:
+			c.c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the commands in a single pipeline and returns their integer replies. A simple
+// string reply, such as OK, is returned as 0. Error replies are read to the end of the
+// pipeline, and the first one is returned, keeping the connection. Any other error closes
+// the connection, and is the error of ctx if it is done.
+func (this *Store) do(ctx context.Context, cmds [][]string) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, err := this.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Canceling ctx interrupts the pending reads and writes
+	d, hasDeadline := ctx.Deadline()
+	c.c.SetDeadline(d)
+	stop := context.AfterFunc(ctx, func() {
+		c.c.SetDeadline(time.Unix(1, 0))
+	})
+
+	replies, err := c.pipeline(cmds)
+
+	if !stop() || (err != nil && !errors.As(err, new(Error))) {
+		c.c.Close()
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case hasDeadline && !time.Now().Before(d):
+			// The deadline of the connection may pass before ctx is done
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+
+	this.put(c)
+	return replies, err
+}
+
+// get returns an idle connection, or a new one.
+func (this *Store) get(ctx context.Context) (*conn, error) {
+	select {
+	case c := <-this.idle:
+		return c, nil
+	default:
+	}
+
+	c, err := this.dial(ctx, "tcp", this.addr)
+	if err != nil {
+		return nil, fmt.Errorf("redisstore: %w", err)
+	}
+	return &conn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}, nil
+}
+
+// put keeps c for reuse, or closes it if enough connections are kept.
+func (this *Store) put(c *conn) {
+	select {
+	case this.idle <- c:
+	default:
+		c.c.Close()
+	}
+}
+
+// pipeline writes the commands in one go, and then reads their replies.
+func (this *conn) pipeline(cmds [][]string) ([]int64, error) {
+	for _, cmd := range cmds {
+		fmt.Fprintf(this.w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(this.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+
+	if err := this.w.Flush(); err != nil {
+		return nil, fmt.Errorf("redisstore: %w", err)
+	}
+
+	var first error
+	replies := make([]int64, len(cmds))
+	for i := range cmds {
+		v, err := this.reply()
+		if err != nil && !errors.As(err, new(Error)) {
+			return nil, err
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+		replies[i] = v
+	}
+
+	return replies, first
+}
+
+// reply reads an integer, simple string or error reply.
+func (this *conn) reply() (int64, error) {
+	line, err := this.r.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("redisstore: %w", err)
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return 0, ErrProtocol
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case ':':
+		v, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return 0, ErrProtocol
+		}
+		return v, nil
+	case '+':
+		return 0, nil
+	case '-':
+		return 0, Error(line[1:])
+	}
+
+	return 0, fmt.Errorf("%w %q", ErrProtocol, line)
+}
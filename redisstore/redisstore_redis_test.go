@@ -0,0 +1,84 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build redis
+
+package redisstore
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zhenjl/bloom"
+)
+
+// TestRedis runs against the Redis server at $REDIS_ADDR, localhost:6379 by default, with
+// go test -tags redis. It writes to the key redisstore-test.
+func TestRedis(t *testing.T) {
+	const n = 10000
+	ctx := context.Background()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	store := New(addr, "redisstore-test", WithTTL(time.Minute))
+	defer store.Close()
+
+	if err := store.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Clear(ctx)
+
+	bf, err := bloom.NewStored(store, n, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := make([]byte, 8)
+	for i := uint64(0); i < n; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if err := bf.Add(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fp := 0
+	for i := uint64(0); i < 2*n; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		ok, err := bf.Check(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i < n && !ok {
+			t.Fatalf("Expected to find %d", i)
+		}
+		if i >= n && ok {
+			fp++
+		}
+	}
+
+	if rate := float64(fp) / n; rate > 0.015 {
+		t.Errorf("Expected a false positive rate of about 0.01, got %f", rate)
+	}
+
+	if ttl, err := store.TTL(ctx); ttl <= 0 || ttl > time.Minute || err != nil {
+		t.Errorf("Expected a TTL of up to a minute, got %v, %v", ttl, err)
+	}
+}
@@ -0,0 +1,435 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redisstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhenjl/bloom"
+)
+
+// server is a Redis server for the commands of Store, holding strings as bit arrays.
+type server struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	keys    map[string][]byte
+	expiry  map[string]time.Time
+	wrong   map[string]bool
+	reads   int
+	replies int
+}
+
+func newServer(t *testing.T) *server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	this := &server{ln: ln, keys: make(map[string][]byte), expiry: make(map[string]time.Time), wrong: make(map[string]bool)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go this.serve(c)
+		}
+	}()
+
+	t.Cleanup(func() { ln.Close() })
+	return this
+}
+
+func (this *server) serve(c net.Conn) {
+	defer c.Close()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		this.mu.Lock()
+		w.WriteString(this.exec(cmd))
+		this.replies++
+		if r.Buffered() == 0 {
+			this.reads++
+		}
+		this.mu.Unlock()
+
+		// Reply once the commands pipelined so far are executed
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ = strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	cmd := make([]string, n)
+	for i := range cmd {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return cmd, nil
+}
+
+func (this *server) exec(cmd []string) string {
+	key := cmd[1]
+	if d, ok := this.expiry[key]; ok && time.Now().After(d) {
+		delete(this.keys, key)
+		delete(this.expiry, key)
+	}
+
+	if this.wrong[key] && (cmd[0] == "SETBIT" || cmd[0] == "GETBIT") {
+		return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	}
+
+	b := this.keys[key]
+	switch cmd[0] {
+	case "SETBIT":
+		v, _ := strconv.Atoi(cmd[2])
+		for len(b) <= v/8 {
+			b = append(b, 0)
+		}
+		old := b[v/8] >> (7 - v%8) & 1
+		b[v/8] |= 1 << (7 - v%8)
+		this.keys[key] = b
+		return ":" + strconv.Itoa(int(old)) + "\r\n"
+
+	case "GETBIT":
+		v, _ := strconv.Atoi(cmd[2])
+		if v/8 >= len(b) {
+			return ":0\r\n"
+		}
+		return ":" + strconv.Itoa(int(b[v/8]>>(7-v%8)&1)) + "\r\n"
+
+	case "PEXPIRE":
+		if b == nil {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(cmd[2])
+		this.expiry[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+
+	case "PTTL":
+		d, ok := this.expiry[key]
+		switch {
+		case b == nil:
+			return ":-2\r\n"
+		case !ok:
+			return ":-1\r\n"
+		}
+		return ":" + strconv.FormatInt(time.Until(d).Milliseconds(), 10) + "\r\n"
+
+	case "DEL":
+		delete(this.keys, key)
+		delete(this.expiry, key)
+		if b == nil {
+			return ":0\r\n"
+		}
+		return ":1\r\n"
+	}
+
+	return "-ERR unknown command '" + cmd[0] + "'\r\n"
+}
+
+// counted returns the number of replies and of pipelines read since the last call.
+func (this *server) counted() (int, int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	replies, reads := this.replies, this.reads
+	this.replies, this.reads = 0, 0
+	return replies, reads
+}
+
+// countingDialer counts the connections made and the writes to them.
+type countingDialer struct {
+	dials, writes atomic.Int64
+}
+
+func (this *countingDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	this.dials.Add(1)
+	return &countingConn{Conn: c, d: this}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	d *countingDialer
+}
+
+func (this *countingConn) Write(p []byte) (int, error) {
+	this.d.writes.Add(1)
+	return this.Conn.Write(p)
+}
+
+func TestAddCheck(t *testing.T) {
+	const n = 2000
+	ctx := context.Background()
+	srv := newServer(t)
+
+	d := &countingDialer{}
+	store := New(srv.ln.Addr().String(), "filter", WithDialer(d.dial))
+	defer store.Close()
+
+	bf, err := bloom.NewStored(store, n, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := int(bf.Params().K)
+
+	key := make([]byte, 8)
+	for i := uint64(0); i < n; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if err := bf.Add(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each Add is one write of its k commands, read by the server at once
+	if replies, reads := srv.counted(); replies != n*k || reads != n || d.writes.Load() != n {
+		t.Errorf("Expected %d pipelines of %d commands, got %d replies to %d reads and %d writes", n, k, replies, reads, d.writes.Load())
+	}
+
+	fp := 0
+	for i := uint64(0); i < 2*n; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		ok, err := bf.Check(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i < n && !ok {
+			t.Fatalf("Expected to find %d", i)
+		}
+		if i >= n && ok {
+			fp++
+		}
+	}
+
+	if rate := float64(fp) / n; rate > 0.02 {
+		t.Errorf("Expected a false positive rate of about 0.01, got %f", rate)
+	}
+
+	if _, reads := srv.counted(); reads != 2*n {
+		t.Errorf("Expected a pipeline per Check, got %d", reads)
+	}
+
+	if d.dials.Load() != 1 {
+		t.Errorf("Expected the connection to be reused, got %d", d.dials.Load())
+	}
+
+	// A filter sharing the key finds the items
+	other, _ := bloom.NewStored(New(srv.ln.Addr().String(), "filter"), n, 0.01)
+	binary.BigEndian.PutUint64(key, 1)
+	if ok, err := other.Check(ctx, key); !ok || err != nil {
+		t.Errorf("Expected the other filter to find 1, got %t, %v", ok, err)
+	}
+
+	if err := store.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := other.Check(ctx, key); ok || err != nil {
+		t.Errorf("Expected the key to be deleted, got %t, %v", ok, err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+
+	store := New(srv.ln.Addr().String(), "filter", WithMaxIdle(2))
+	defer store.Close()
+	bf, _ := bloom.NewStored(store, 10000, 0.01)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := make([]byte, 8)
+			for i := 0; i < 100; i++ {
+				binary.BigEndian.PutUint64(key, uint64(w*100+i))
+				if err := bf.Add(ctx, key); err != nil {
+					errs <- err
+					return
+				}
+				if ok, err := bf.Check(ctx, key); !ok || err != nil {
+					errs <- errors.Join(errors.New("item not found"), err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+
+	store := New(srv.ln.Addr().String(), "ttl", WithTTL(time.Minute))
+	defer store.Close()
+
+	if ttl, err := store.TTL(ctx); ttl != -2 || err != nil {
+		t.Errorf("Expected -2 for a missing key, got %v, %v", ttl, err)
+	}
+
+	if err := store.Set(ctx, []uint{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl, err := store.TTL(ctx); ttl <= 59*time.Second || ttl > time.Minute || err != nil {
+		t.Errorf("Expected a TTL of a minute, got %v, %v", ttl, err)
+	}
+
+	// The expiry is sent in the same pipeline as the bits
+	srv.counted()
+	store.Set(ctx, []uint{4})
+	if replies, reads := srv.counted(); replies != 2 || reads != 1 {
+		t.Errorf("Expected SETBIT and PEXPIRE in one pipeline, got %d replies to %d reads", replies, reads)
+	}
+
+	if err := store.Expire(ctx, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if ok, err := store.Test(ctx, []uint{1}); ok || err != nil {
+		t.Errorf("Expected the key to have expired, got %t, %v", ok, err)
+	}
+
+	// Without a TTL, the expiry is left alone
+	plain := New(srv.ln.Addr().String(), "plain")
+	defer plain.Close()
+	plain.Set(ctx, []uint{1})
+	if ttl, err := plain.TTL(ctx); ttl != -1 || err != nil {
+		t.Errorf("Expected -1 for a key without expiry, got %v, %v", ttl, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	srv := newServer(t)
+
+	// Error replies are returned, and the connection is kept in sync
+	srv.wrong["list"] = true
+	store := New(srv.ln.Addr().String(), "list")
+	defer store.Close()
+
+	var rerr Error
+	if err := store.Set(ctx, []uint{1, 2}); !errors.As(err, &rerr) || !strings.HasPrefix(string(rerr), "WRONGTYPE") {
+		t.Errorf("Expected WRONGTYPE, got %v", err)
+	}
+	if ttl, err := store.TTL(ctx); ttl != -2 || err != nil {
+		t.Errorf("Expected the connection to be usable after an error reply, got %v, %v", ttl, err)
+	}
+
+	// Network errors are returned rather than a result
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	down := New(addr, "filter")
+	if err := down.Set(ctx, []uint{1}); err == nil {
+		t.Errorf("Expected an error from a server that is down")
+	}
+	if ok, err := down.Test(ctx, []uint{1}); ok || err == nil {
+		t.Errorf("Expected an error from a server that is down, got %t, %v", ok, err)
+	}
+
+	// A server that closes the connection mid pipeline
+	hangup, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer hangup.Close()
+	go func() {
+		for {
+			c, err := hangup.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(c, make([]byte, 4))
+			c.Close()
+		}
+	}()
+
+	if ok, err := New(hangup.Addr().String(), "filter").Test(ctx, []uint{1, 2}); ok || err == nil {
+		t.Errorf("Expected an error from a server hanging up, got %t, %v", ok, err)
+	}
+
+	// A server that doesn't reply is cut short by the context
+	silent, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer silent.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			c, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := New(silent.Addr().String(), "filter").Set(tctx, []uint{1}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := New(silent.Addr().String(), "filter").Test(cctx, []uint{1}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,500 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rotating implements a generational bloom filter, which forgets the items added
+// before the last few rotations. It dedupes over a time window when rotated periodically.
+package rotating
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// RotatingBloom keeps up to g generations of inner filters. Add adds items to the current
+// generation, and Check checks all of them. Rotate starts a new current generation, dropping
+// the oldest one once there are g, so an item stops matching g rotations after it was added.
+// Rotating every d, the filter remembers the items added in the last (g-1)*d to g*d.
+//
+// Each generation is built for n items with the error probability e, so the false positive
+// probability of the filter is up to g times e once all the generations are full.
+//
+// Add, Check, Count, Rotate, Generations and Stats, and their variants, are safe for
+// concurrent use. The other methods are not.
+type RotatingBloom struct {
+	// h is the hash function of the generations, fnv.New64() by default
+	h hash.Hash
+
+	// hn is the name of the hash function, empty if it was set using SetHasher()
+	hn string
+
+	// p is the fill ratio of the generations, 0.5 by default
+	p float64
+
+	// e is the error probability of each generation, 0.001 by default
+	e float64
+
+	// n is the number of items each generation is built for
+	n uint
+
+	// g is the maximum number of generations
+	g int
+
+	// bfs holds the live generations, oldest first. The last one is the current generation.
+	bfs []bloom.Bloom
+
+	// bfc is the bloom filter constructor (New()) that returns the generations
+	bfc func(uint) bloom.Bloom
+
+	// mu guards the generations, so items can be added and checked while rotating.
+	mu sync.RWMutex
+}
+
+var _ bloom.Bloom = (*RotatingBloom)(nil)
+
+// New initializes a new rotating bloom filter of up to generations generations, each built
+// by ctor for n items, or by standard.New if ctor is nil. It starts with one generation.
+// generations is at least 1.
+func New(n uint, generations int, ctor func(uint) bloom.Bloom) bloom.Bloom {
+	if generations < 1 {
+		generations = 1
+	}
+
+	bf := &RotatingBloom{
+		h:   fnv.New64(),
+		hn:  bloom.DefaultHasher,
+		n:   n,
+		g:   generations,
+		p:   0.5,
+		e:   0.001,
+		bfc: ctor,
+	}
+
+	bf.addBloomFilter()
+
+	return bf
+}
+
+// Rotate starts a new empty generation. If the filter already has the maximum number of
+// generations, the oldest one is dropped, and its items no longer match. The oldest
+// generation is cleared and reused as the new one, so Rotate doesn't allocate then.
+func (this *RotatingBloom) Rotate() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(this.bfs) < this.g {
+		this.addBloomFilter()
+		return
+	}
+
+	bf := this.bfs[0]
+	bf.Clear()
+	copy(this.bfs, this.bfs[1:])
+	this.bfs[len(this.bfs)-1] = bf
+}
+
+// RotateEvery calls Rotate every d in a new goroutine, until stop is called. stop waits for
+// a Rotate in progress to return, and can be called more than once.
+func (this *RotatingBloom) RotateEvery(d time.Duration) (stop func()) {
+	var (
+		t    = time.NewTicker(d)
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-t.C:
+				this.Rotate()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() {
+			t.Stop()
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// Generations returns the number of live generations, from 1 to the maximum set by New.
+func (this *RotatingBloom) Generations() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return len(this.bfs)
+}
+
+// MaxGenerations returns the maximum number of generations set by New.
+func (this *RotatingBloom) MaxGenerations() int {
+	return this.g
+}
+
+// GenerationStats returns the statistics of each live generation, oldest first.
+func (this *RotatingBloom) GenerationStats() []bloom.Stats {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	stats := make([]bloom.Stats, len(this.bfs))
+	for i := range this.bfs {
+		stats[i] = this.bfs[i].Stats()
+	}
+	return stats
+}
+
+// SetHasher sets the hash function of the filter and all its generations. The items already
+// added would hash to other positions, so it returns bloom.ErrNotEmpty if the filter isn't
+// empty.
+func (this *RotatingBloom) SetHasher(h hash.Hash) error {
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.h = h
+	this.hn = ""
+	return this.setGenerationHashers()
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. Like SetHasher, it sets the hash function of all the
+// generations, and returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *RotatingBloom) SetNamedHasher(name string) error {
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.h = h
+	this.hn = name
+	return this.setGenerationHashers()
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *RotatingBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+func (this *RotatingBloom) setGenerationHashers() error {
+	for i := range this.bfs {
+		if err := this.setGenerationHasher(this.bfs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setGenerationHasher sets the hash function of an empty generation, by name if it was set
+// by SetNamedHasher and the generation supports it. Otherwise the generation is given a
+// clone of the hash function of the filter, or shares it if it can't be cloned.
+func (this *RotatingBloom) setGenerationHasher(bf bloom.Bloom) error {
+	if this.hn != "" {
+		if nh, ok := bf.(interface{ SetNamedHasher(string) error }); ok {
+			return nh.SetNamedHasher(this.hn)
+		}
+	}
+
+	if h, err := bloom.CloneHasher("", this.h); err == nil {
+		return bf.SetHasher(h)
+	}
+	return bf.SetHasher(this.h)
+}
+
+// Reset drops all the generations, and starts again with a single new one.
+func (this *RotatingBloom) Reset() {
+	if this.h == nil {
+		this.h = fnv.New64()
+	} else {
+		this.h.Reset()
+	}
+
+	this.bfs = []bloom.Bloom{}
+	this.addBloomFilter()
+}
+
+// Clear removes all the items from the filter. Unlike Reset, it keeps the current
+// generation, which is cleared, and drops the others, so it doesn't allocate.
+func (this *RotatingBloom) Clear() {
+	i := len(this.bfs) - 1
+	this.bfs[i].Clear()
+	copy(this.bfs, this.bfs[i:])
+	clear(this.bfs[1:])
+	this.bfs = this.bfs[:1]
+}
+
+// SetErrorProbability sets the error probability e of each generation, and resets the filter
+// to rebuild them. It returns bloom.ErrInvalidErrorRate if e is not in (0, 1), and
+// bloom.ErrNotEmpty if items have been added, leaving the filter unchanged.
+func (this *RotatingBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetFillRatio sets the fill ratio p of each generation, and resets the filter to rebuild
+// them. It returns bloom.ErrInvalidFillRatio if p is not in (0, 1), and bloom.ErrNotEmpty
+// if items have been added, leaving the filter unchanged.
+func (this *RotatingBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.Count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	this.Reset()
+	return nil
+}
+
+// EstimatedFillRatio returns the estimated fill ratio of the current generation.
+func (this *RotatingBloom) EstimatedFillRatio() float64 {
+	return this.bfs[len(this.bfs)-1].EstimatedFillRatio()
+}
+
+// FillRatio returns the average fill ratio of the generations.
+func (this *RotatingBloom) FillRatio() float64 {
+	t := float64(0)
+	for i := range this.bfs {
+		t += this.bfs[i].FillRatio()
+	}
+	return t / float64(len(this.bfs))
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *RotatingBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns n, p and e of each generation, with M set to the total number of bits of
+// the live generations. K and S are those of the current generation.
+func (this *RotatingBloom) Params() bloom.Params {
+	params := this.bfs[len(this.bfs)-1].Params()
+	params.M = 0
+	for i := range this.bfs {
+		params.M += this.bfs[i].Params().M
+	}
+	return params
+}
+
+// Add adds item to the current generation. It is safe to call concurrently with other Adds
+// and Checks, and with Rotate.
+func (this *RotatingBloom) Add(item []byte) bloom.Bloom {
+	this.mu.Lock()
+	this.bfs[len(this.bfs)-1].Add(item)
+	this.mu.Unlock()
+	return this
+}
+
+// Check returns true if item may have been added to any of the live generations. It is safe
+// to call concurrently with other Checks and Adds, and with Rotate.
+func (this *RotatingBloom) Check(item []byte) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for i := len(this.bfs) - 1; i >= 0; i-- {
+		if this.bfs[i].Check(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *RotatingBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *RotatingBloom) CheckString(s string) bool {
+	return this.Check(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// Count returns the number of items added to the live generations.
+func (this *RotatingBloom) Count() uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.count()
+}
+
+func (this *RotatingBloom) count() uint64 {
+	c := uint64(0)
+	for i := range this.bfs {
+		c += this.bfs[i].Count()
+	}
+	return c
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the bits set, the compound 1 - (1-p0) * (1-p1) * ... of the current false positive
+// probability pi of each generation.
+func (this *RotatingBloom) CurrentFalsePositiveRate() float64 {
+	t := float64(1)
+	for i := range this.bfs {
+		t *= 1 - this.bfs[i].CurrentFalsePositiveRate()
+	}
+	return 1 - t
+}
+
+// ApproximateCardinality estimates the number of distinct items added to the filter as the
+// sum of the estimates of its generations. An item added in more than one generation is
+// counted once in each.
+func (this *RotatingBloom) ApproximateCardinality() uint64 {
+	c := uint64(0)
+	for i := range this.bfs {
+		c += this.bfs[i].ApproximateCardinality()
+	}
+	return c
+}
+
+// Clone returns a deep copy of the filter, cloning each generation. It returns an error if
+// the hasher can't be recreated, see bloom.CloneHasher.
+func (this *RotatingBloom) Clone() (bloom.Bloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	bf := &RotatingBloom{
+		h:   h,
+		hn:  this.hn,
+		p:   this.p,
+		e:   this.e,
+		n:   this.n,
+		g:   this.g,
+		bfc: this.bfc,
+		bfs: make([]bloom.Bloom, len(this.bfs), this.g),
+	}
+
+	for i := range this.bfs {
+		if bf.bfs[i], err = this.bfs[i].Clone(); err != nil {
+			return nil, err
+		}
+	}
+
+	return bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter and its live generations. The
+// memory held by the hasher is not included.
+func (this *RotatingBloom) MemoryUsage() uint64 {
+	t := uint64(unsafe.Sizeof(*this)) + uint64(cap(this.bfs))*uint64(unsafe.Sizeof(this.bfs[0]))
+	for i := range this.bfs {
+		t += this.bfs[i].MemoryUsage()
+	}
+	return t
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *RotatingBloom) String() string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return fmt.Sprintf("rotating{n=%d e=%g generations=%d/%d count=%d}", this.n, this.e, len(this.bfs), this.g, this.count())
+}
+
+// Stats returns the statistics of the filter, with those of each live generation in
+// Generations, oldest first.
+func (this *RotatingBloom) Stats() bloom.Stats {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	stats := bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.count(),
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		Generations:        make([]bloom.Stats, len(this.bfs)),
+	}
+
+	// Like FillRatio, the fill ratio is the average of the generations
+	t := float64(1)
+	for i := range this.bfs {
+		stats.Generations[i] = this.bfs[i].Stats()
+		stats.BitsSet += stats.Generations[i].BitsSet
+		stats.FillRatio += stats.Generations[i].FillRatio / float64(len(this.bfs))
+		t *= 1 - stats.Generations[i].FalsePositiveRate
+	}
+	stats.FalsePositiveRate = 1 - t
+
+	return stats
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *RotatingBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *RotatingBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func (this *RotatingBloom) addBloomFilter() {
+	var bf bloom.Bloom
+	if this.bfc == nil {
+		bf = standard.New(this.n)
+	} else {
+		bf = this.bfc(this.n)
+	}
+
+	// The generation is empty, so the setters rebuild it with the new parameters
+	this.setGenerationHasher(bf)
+	bf.SetErrorProbability(this.e)
+	bf.SetFillRatio(this.p)
+
+	this.bfs = append(this.bfs, bf)
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rotating
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	l := []uint{uint(len(web2)), 200000, 100000, 50000}
+	for _, s := range l {
+		fmt.Printf("\n\nTesting rotating filter with size %d\n", s)
+		bf := New(s, 3, nil)
+
+		fn, fp := 0, 0
+		for l := range web2 {
+			if !(bf.Add([]byte(web2[l])).Check([]byte(web2[l]))) {
+				fn++
+			}
+		}
+
+		for l := range web2a {
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
+		fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+		bf.PrintStats()
+
+		if fn > 0 {
+			t.Errorf("%d false negatives", fn)
+		}
+	}
+}
+
+// TestRotation adds a batch of items per generation, and checks that after each rotation
+// the batches of the last g generations still match, while the older ones don't.
+func TestRotation(t *testing.T) {
+	const n, g, rotations = 10000, 3, 10
+
+	for name, ctor := range map[string]func(uint) bloom.Bloom{"standard": nil, "partitioned": partitioned.New} {
+		bf := New(n, g, ctor).(*RotatingBloom)
+
+		for r := 0; r < rotations; r++ {
+			if r > 0 {
+				bf.Rotate()
+			}
+
+			for i := 0; i < n; i++ {
+				bf.AddString(strconv.Itoa(r) + "-" + strconv.Itoa(i))
+			}
+
+			if gens := bf.Generations(); gens != min(r+1, g) {
+				t.Fatalf("%s: %d generations after %d rotations", name, gens, r)
+			}
+
+			for b := 0; b <= r; b++ {
+				found := 0
+				for i := 0; i < n; i++ {
+					if bf.CheckString(strconv.Itoa(b) + "-" + strconv.Itoa(i)) {
+						found++
+					}
+				}
+
+				// Batches older than g rotations only match as false positives, at a rate
+				// of up to g * e
+				if b > r-g && found != n {
+					t.Fatalf("%s: %d of batch %d found after %d rotations, expected all", name, found, b, r)
+				} else if b <= r-g && found > n*g/100 {
+					t.Fatalf("%s: %d of batch %d found after %d rotations, expected none", name, found, b, r)
+				}
+			}
+		}
+
+		stats := bf.Stats()
+		if len(stats.Generations) != g || stats.Count != n*g {
+			t.Errorf("%s: %d generations, %d items, expected %d and %d", name, len(stats.Generations), stats.Count, g, n*g)
+		}
+
+		for i, s := range bf.GenerationStats() {
+			if s.Count != n {
+				t.Errorf("%s: generation %d has %d items, expected %d", name, i, s.Count, n)
+			}
+		}
+	}
+}
+
+func TestClear(t *testing.T) {
+	bf := New(1000, 3, nil).(*RotatingBloom)
+	bf.AddString("foo")
+	bf.Rotate()
+	bf.AddString("bar")
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf.Clear()
+	if bf.Generations() != 1 || bf.Count() != 0 || bf.CheckString("foo") || bf.CheckString("bar") {
+		t.Errorf("Cleared filter: %v", bf)
+	}
+
+	if !c.(*RotatingBloom).CheckString("foo") || !c.(*RotatingBloom).CheckString("bar") {
+		t.Errorf("Clone changed by Clear: %v", c)
+	}
+
+	if err := c.SetErrorProbability(0.01); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected bloom.ErrNotEmpty, got %v", err)
+	}
+}
+
+// TestRotateEvery adds and checks items while the filter rotates on a ticker. Run it with
+// -race.
+func TestRotateEvery(t *testing.T) {
+	bf := New(1000, 2, nil).(*RotatingBloom)
+	stop := bf.RotateEvery(time.Millisecond)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				bf.AddString(strconv.Itoa(w*2000 + i))
+				bf.CheckString(strconv.Itoa(i))
+				if i%100 == 0 {
+					bf.Stats()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stop()
+	stop()
+
+	if bf.Generations() != 2 {
+		t.Errorf("%d generations, expected 2", bf.Generations())
+	}
+
+	// The filter no longer rotates, so the items added now stay
+	bf.AddString("foo")
+	time.Sleep(5 * time.Millisecond)
+	if !bf.CheckString("foo") {
+		t.Errorf("Expected to find foo after stop")
+	}
+}
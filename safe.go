@@ -0,0 +1,155 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"hash"
+	"io"
+	"sync"
+)
+
+// Safe returns a Bloom that wraps bf and is safe for concurrent use. Add and the other
+// methods changing the filter hold a lock while calling bf, and Check and the other methods
+// reading it hold a read lock, so they run concurrently. This relies on the read methods of
+// bf not writing to it, which holds for the filters in this module. bf must not be used
+// directly afterwards. Add returns the wrapper, and Clone returns a
+// wrapped copy. Wrapping a filter returned by Safe returns it unchanged.
+func Safe(bf Bloom) Bloom {
+	if s, ok := bf.(*safeBloom); ok {
+		return s
+	}
+	return &safeBloom{bf: bf}
+}
+
+type safeBloom struct {
+	mu sync.RWMutex
+	bf Bloom
+}
+
+var _ Bloom = (*safeBloom)(nil)
+
+func (this *safeBloom) Add(key []byte) Bloom {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.bf.Add(key)
+	return this
+}
+
+func (this *safeBloom) Check(key []byte) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.Check(key)
+}
+
+func (this *safeBloom) Count() uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.Count()
+}
+
+func (this *safeBloom) PrintStats() {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	this.bf.PrintStats()
+}
+
+func (this *safeBloom) Stats() Stats {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.Stats()
+}
+
+func (this *safeBloom) WriteStats(w io.Writer) error {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.WriteStats(w)
+}
+
+func (this *safeBloom) SetHasher(h hash.Hash) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.SetHasher(h)
+}
+
+func (this *safeBloom) Reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.bf.Reset()
+}
+
+func (this *safeBloom) Clear() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.bf.Clear()
+}
+
+func (this *safeBloom) FillRatio() float64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.FillRatio()
+}
+
+func (this *safeBloom) EstimatedFillRatio() float64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.EstimatedFillRatio()
+}
+
+func (this *safeBloom) SetErrorProbability(e float64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.SetErrorProbability(e)
+}
+
+func (this *safeBloom) SetFillRatio(p float64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.SetFillRatio(p)
+}
+
+func (this *safeBloom) Params() Params {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.Params()
+}
+
+func (this *safeBloom) Clone() (Bloom, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	bf, err := this.bf.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return Safe(bf), nil
+}
+
+func (this *safeBloom) ApproximateCardinality() uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.ApproximateCardinality()
+}
+
+func (this *safeBloom) CurrentFalsePositiveRate() float64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.CurrentFalsePositiveRate()
+}
+
+func (this *safeBloom) MemoryUsage() uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.bf.MemoryUsage()
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom_test
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+	"github.com/zhenjl/bloom/scalable"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// TestSafe adds and checks items from many goroutines at once. Run it with -race.
+func TestSafe(t *testing.T) {
+	filters := map[string]bloom.Bloom{
+		"standard":    bloom.Safe(standard.New(10000)),
+		"partitioned": bloom.Safe(partitioned.New(10000)),
+		"scalable":    bloom.Safe(scalable.New(1000)),
+	}
+
+	const (
+		workers = 32
+		items   = 1000
+	)
+
+	for name, bf := range filters {
+		if bloom.Safe(bf) != bf {
+			t.Errorf("%s: Expected Safe to return a wrapped filter unchanged", name)
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				var key [8]byte
+				for i := 0; i < items; i++ {
+					binary.BigEndian.PutUint64(key[:], uint64(w*items+i))
+					if !bf.Add(key[:]).Check(key[:]) {
+						t.Errorf("%s: Expected to find item %d", name, w*items+i)
+						return
+					}
+
+					// Check an item added by another goroutine, which may or may not be there yet
+					binary.BigEndian.PutUint64(key[:], uint64(((w+1)%workers)*items+i))
+					bf.Check(key[:])
+					bf.Count()
+					bf.EstimatedFillRatio()
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		if bf.Count() != workers*items {
+			t.Errorf("%s: Expected %d items, got %d", name, workers*items, bf.Count())
+		}
+
+		var key [8]byte
+		for i := 0; i < workers*items; i++ {
+			binary.BigEndian.PutUint64(key[:], uint64(i))
+			if !bf.Check(key[:]) {
+				t.Fatalf("%s: Expected to find item %d", name, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scalable
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/counting"
+)
+
+// ErrNotRemovable is returned by Remove when the layer holding the item doesn't support
+// removing items, such as the partitioned layers of filters created by New.
+var ErrNotRemovable = errors.New("scalable: layer doesn't support Remove")
+
+// remover is implemented by layers items can be removed from, such as counting filters.
+type remover interface {
+	Remove(item []byte) error
+}
+
+// NewCounting initializes a new scalable bloom filter whose layers are counting filters, so
+// that items can be removed as well as added, for n items with a compound false positive
+// probability of fpRate. Like NewWithEstimates, layer i is given an error probability of
+// e * r^i with e = fpRate * (1 - r), and new layers are added once the newest one is full.
+//
+// The counting layers can't be serialized, so Encode returns an error.
+func NewCounting(n uint, fpRate float64) bloom.Bloom {
+	return newScalable(n, fpRate*(1-0.9), counting.New)
+}
+
+// Remove removes an item added with Add from the newest layer that contains it, and
+// decrements the count. It returns counting.ErrNotAdded if no layer contains item, and
+// ErrNotRemovable if the layer doesn't support Remove, leaving the filter unchanged.
+//
+// Add only adds items to the newest layer, so an item added again after new layers were
+// added is in several layers, and removing it from the newest one first undoes the adds
+// in reverse order. An item may also be in a newer layer as a false positive of that layer,
+// with a probability of its error rate. If the layer detects it, returning
+// counting.ErrNotAdded, Remove goes on with the older layers. Otherwise the item stays in
+// its own layer, and the k counters decremented in the newer one belong to other items,
+// which may then no longer be found, nor removed. It happens with a probability of at most
+// the compound error probability, but each time up to k items may be lost: removing half of
+// 235886 items from a filter with a compound error probability of 1% leaves about 1.2% of
+// the others unfound.
+//
+// Removed items leave room in the newest layer only, so the filter doesn't shrink. The
+// error probabilities of the layers, and so ErrorProbability, don't change, while
+// CurrentFalsePositiveRate drops as the counters are decremented.
+func (this *ScalableBloom) Remove(item []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i := len(this.bfs) - 1; i >= 0; i-- {
+		if !this.bfs[i].Check(item) {
+			continue
+		}
+
+		r, ok := this.bfs[i].(remover)
+		if !ok {
+			return ErrNotRemovable
+		}
+
+		// The layer detected a false positive, and is unchanged, so the item may be in an
+		// older layer
+		if err := r.Remove(item); errors.Is(err, counting.ErrNotAdded) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if this.c > 0 {
+			this.c--
+		}
+		return nil
+	}
+
+	return counting.ErrNotAdded
+}
+
+// RemoveString is the same as Remove([]byte(s)), without copying s.
+func (this *ScalableBloom) RemoveString(s string) error {
+	return this.Remove(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scalable
+
+import (
+	"math"
+	"time"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+)
+
+// rateSample is the number of items added between two samples of the time by the tracker
+// set by SetAddRateWindow.
+const rateSample = 64
+
+// Forecast is the prediction of the next layer of a filter, as returned by Forecast.
+type Forecast struct {
+	// Grows is false if the filter can't add a layer, as it has the maximum number of
+	// layers set by SetMaxLayers, or its capacity is exhausted. The other fields are then 0.
+	Grows bool
+
+	// Adds is the number of items the newest layer takes before it is full: the next Add
+	// after them adds the new layer. It is an estimate with GrowOnActualFill.
+	Adds uint64
+
+	// Rate is the number of items added per second, measured over the window set by
+	// SetAddRateWindow, or the one set by SetAddRateHint, and Until the time until the new
+	// layer is added at that rate. Both are 0 if the rate is unknown.
+	Rate  float64
+	Until time.Duration
+
+	// Layer holds the parameters of the new layer, and LayerBytes the number of bytes of its
+	// bits. Its MemoryUsage is a little more, by the bookkeeping of the layer, which only
+	// matters for small layers.
+	Layer      bloom.Params
+	LayerBytes uint64
+}
+
+// addTracker samples the time every rateSample items added, and keeps the last samples in
+// a ring buffer, to measure the rate at which items are added.
+type addTracker struct {
+	adds, next uint64
+
+	// t and c hold the time and the number of items added of each sample, and i the index
+	// of the next one. n is the number of samples held.
+	t    []time.Time
+	c    []uint64
+	i, n int
+
+	now func() time.Time
+}
+
+func newAddTracker(window int) *addTracker {
+	return &addTracker{
+		t:   make([]time.Time, window),
+		c:   make([]uint64, window),
+		now: time.Now,
+	}
+}
+
+// add counts n items added, sampling the time if rateSample items were added since the
+// last sample.
+func (this *addTracker) add(n uint64) {
+	this.adds += n
+	if this.adds < this.next {
+		return
+	}
+
+	this.t[this.i], this.c[this.i] = this.now(), this.adds
+	this.i = (this.i + 1) % len(this.t)
+	this.n = min(this.n+1, len(this.t))
+	this.next = this.adds + rateSample
+}
+
+// rate returns the number of items added per second between the oldest and the newest
+// samples, or 0 if there aren't two of them.
+func (this *addTracker) rate() float64 {
+	if this.n < 2 {
+		return 0
+	}
+
+	l := len(this.t)
+	first, last := (this.i-this.n+l)%l, (this.i-1+l)%l
+
+	d := this.t[last].Sub(this.t[first]).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(this.c[last]-this.c[first]) / d
+}
+
+// SetAddRateWindow measures the rate at which items are added over the last window
+// samples of the time, taken every 64 items added, for Forecast. It costs a branch per Add
+// and a call to time.Now every 64. It is off by default, and a window of 0 turns it off,
+// so Forecast uses the rate set by SetAddRateHint. A window of 1 can't measure a rate.
+func (this *ScalableBloom) SetAddRateWindow(window int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.rt = nil
+	if window > 0 {
+		this.rt = newAddTracker(window)
+	}
+}
+
+// SetAddRateHint sets the number of items added per second Forecast assumes while the rate
+// can't be measured, see SetAddRateWindow. 0, the default, leaves the rate unknown.
+func (this *ScalableBloom) SetAddRateHint(rate float64) {
+	this.rh = rate
+}
+
+// track counts n items added for the tracker set by SetAddRateWindow, if any.
+func (this *ScalableBloom) track(n uint64) {
+	if this.rt != nil {
+		this.rt.add(n)
+	}
+}
+
+// Forecast predicts when the filter adds its next layer: the number of items the newest
+// layer takes before it is full under the growth policy, the time that takes at the rate
+// items are added, and the size of the new layer. The layer may still not be added if it
+// would exceed the memory budget set by SetMemoryBudget. It is safe to call concurrently
+// with Add.
+func (this *ScalableBloom) Forecast() Forecast {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.forecast()
+}
+
+func (this *ScalableBloom) forecast() Forecast {
+	l := len(this.bfs)
+	evict := this.ml > 0 && l >= this.ml
+	if this.exhausted || (evict && this.ev == NoEviction) {
+		return Forecast{}
+	}
+
+	bf := this.bfs[l-1]
+	f := Forecast{
+		Grows: true,
+		Adds:  this.adds(bf),
+		Rate:  this.rh,
+	}
+
+	if this.rt != nil {
+		if r := this.rt.rate(); r > 0 {
+			f.Rate = r
+		}
+	}
+
+	if f.Rate > 0 {
+		f.Until = time.Duration(float64(f.Adds) / f.Rate * float64(time.Second))
+	}
+
+	// The layer is built as addBloomFilter does, once the oldest ones are evicted
+	i, e := l, bf.Params().E
+	if evict {
+		i = this.ml - 1
+	}
+	if this.evicted == 0 && !evict {
+		e *= this.r
+	}
+
+	n := this.layerCapacity(i)
+	f.Layer = bloom.Params{N: n, P: this.p, E: e, K: bloom.K(e), M: bloom.M(n, this.p, e)}
+	if _, ok := bf.(*partitioned.PartitionedBloom); ok {
+		f.Layer.S = bloom.S(f.Layer.M, f.Layer.K)
+	}
+	f.LayerBytes = uint64(f.Layer.M+7) / 8
+
+	return f
+}
+
+// adds returns the number of items the newest layer bf takes before it is full, see full.
+func (this *ScalableBloom) adds(bf bloom.Bloom) uint64 {
+	params, c := bf.Params(), bf.Count()
+
+	// The estimated fill ratio is 1 - q^c, with q the probability that an item leaves a bit
+	// clear: 1 - 1/s for the s bits of each partition of a partitioned layer, and about
+	// exp(-k/m) otherwise. It exceeds p once c > ln(1-p) / ln(q)
+	lnq := -float64(params.K) / float64(params.M)
+	if params.S > 0 {
+		lnq = math.Log1p(-1 / float64(params.S))
+	}
+	limit := math.Log(1-this.p) / lnq
+
+	switch this.g {
+	case GrowOnCount:
+		if c < uint64(params.N) {
+			return uint64(params.N) - c
+		}
+		return 0
+
+	case GrowOnActualFill:
+		// The items that would set the bits already set, then the next count of the bits
+		f := bf.FillRatio()
+		if f > this.p {
+			return uint64(this.fillInterval(bf) - min(this.fc, this.fillInterval(bf)))
+		}
+
+		left := uint64(math.Floor(limit - math.Log(1-f)/lnq))
+		i := uint64(this.fillInterval(bf))
+		return (uint64(this.fc)+left)/i*i + i - uint64(this.fc)
+	}
+
+	// The layer is full once c > limit, after it took the items up to floor(limit)
+	if float64(c) > limit {
+		return 0
+	}
+	return uint64(math.Floor(limit)) - c + 1
+}
@@ -15,18 +15,30 @@
 package scalable
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/fnv"
+	"io"
 	"math"
+	"os"
+	"slices"
+	"sync"
+	"unsafe"
 
 	"github.com/zhenjl/bloom"
 	"github.com/zhenjl/bloom/partitioned"
+	"github.com/zhenjl/bloom/standard"
 )
 
 // ScalableBloom is an implementation of the Scalable Bloom Filter that "addresses the problem of having
 // to choose an a priori maximum size for the set, and allows an arbitrary growth of the set being presented."
 // Reference #2: Scalable Bloom Filters (http://gsd.di.uminho.pt/members/cbm/ps/dbloom.pdf)
+//
+// Add, Check and Count, and their variants, are safe for concurrent use. The other methods
+// are not.
 type ScalableBloom struct {
 	// h is the hash function used to get the list of h1..hk values
 	// By default we use hash/fnv.New64(). User can also set their own using SetHasher()
@@ -50,38 +62,255 @@ type ScalableBloom struct {
 	n uint
 
 	// c is the number of items we have added to the filter
-	c uint
+	c uint64
+
+	// s is the growth factor: layer i is built for n * s^i items, so the number of layers
+	// grows with the logarithm of the number of items rather than linearly, and Check,
+	// which checks every layer, stays fast. By default we use s = 2, as in the paper.
+	// Filters read from files written before s was recorded have s = 1, every layer built
+	// for n items.
+	s uint
 
 	// r is the error tightening ratio with 0 < r < 1.
 	// By default we use 0.9 as it result in better average space usage for wide ranges of growth.
-	// See Scalable Bloom Filter paper for reference
-	r float32
+	// See Scalable Bloom Filter paper for reference, and SetTighteningRatio to change it
+	r float64
 
 	// bfs is an array of bloom filters used by the scalable bloom filter
 	bfs []bloom.Bloom
 
+	// g is the growth policy, which decides when the newest layer is full, and fc the
+	// number of items added to the newest layer since its fill ratio was last counted, for
+	// GrowOnActualFill.
+	g  GrowthPolicy
+	fc uint
+
+	// dedup is set by SetDedupOnAdd, so items already found by Check aren't added.
+	dedup bool
+
+	// ml is the maximum number of layers set by SetMaxLayers, or 0 if there is none. Once
+	// the newest layer is full and there are ml layers, exhausted is set, and oe, set by
+	// SetOnCapacityExhausted, is called.
+	ml        int
+	exhausted bool
+	oe        func()
+
+	// mb is the memory budget set by SetMemoryBudget, or 0 if there is none. Once a new
+	// layer would take the filter over it, exhausted and overBudget are set, and ob, set by
+	// SetOnBudgetExhausted, is called.
+	mb         uint64
+	overBudget bool
+	ob         func()
+
+	// og is the function set by SetOnGrow, and grown the layers added since the filter was
+	// locked, for which it is called once the filter is unlocked.
+	og    func(i int, p bloom.Params)
+	grown []grownLayer
+
+	// store holds the layers older than the newest hot ones, under keys starting with
+	// prefix, see SetSpill, and spillErr is the last error writing one. ns is the number of
+	// layers spilled, which numbers the keys.
+	store    BlobStore
+	prefix   string
+	hot      int
+	spillErr error
+	ns       uint64
+
+	// ev is the eviction policy set by SetEvictionPolicy, and evicted and forgotten the
+	// number of layers it evicted and the estimated number of distinct items they held.
+	ev        EvictionPolicy
+	evicted   int
+	forgotten uint64
+
+	// rt measures the rate at which items are added, see SetAddRateWindow, and rh is the
+	// rate set by SetAddRateHint.
+	rt *addTracker
+	rh float64
+
 	// bfc is the bloom filter constructor (New()) that returns the bloom filter to use
 	bfc func(uint) bloom.Bloom
+
+	// hn is the name of the hash function, written in the serialized header. It is empty
+	// if the hash function was set using SetHasher().
+	hn string
+
+	// hf returns a new hash function for a layer, so the layers don't share the state of
+	// one. It is set by SetHasherFactory, or by SetHasher from the hash function given. It
+	// is nil for a hash function set by name, which is recreated by name.
+	hf func() hash.Hash
+
+	// u64 holds the encoding of the last integer key
+	u64 [8]byte
+
+	// mu guards the layers and the count, so items can be added and checked concurrently.
+	mu sync.RWMutex
+}
+
+var (
+	_ bloom.Bloom        = (*ScalableBloom)(nil)
+	_ bloom.Introspector = (*ScalableBloom)(nil)
+)
+
+var (
+	// ErrInvalidGrowthFactor is returned by SetGrowthFactor for a growth factor of 0.
+	ErrInvalidGrowthFactor = errors.New("scalable: growth factor must be at least 1")
+
+	// ErrInvalidTighteningRatio is returned by SetTighteningRatio for a ratio not in (0, 1).
+	ErrInvalidTighteningRatio = errors.New("scalable: tightening ratio must be between 0 and 1")
+
+	// ErrInvalidGrowthPolicy is returned by SetGrowthPolicy for an unknown policy.
+	ErrInvalidGrowthPolicy = errors.New("scalable: unknown growth policy")
+
+	// ErrInvalidMaxLayers is returned by SetMaxLayers for a negative number of layers.
+	ErrInvalidMaxLayers = errors.New("scalable: maximum number of layers must not be negative")
+
+	// ErrInvalidEvictionPolicy is returned by SetEvictionPolicy for an unknown policy.
+	ErrInvalidEvictionPolicy = errors.New("scalable: unknown eviction policy")
+
+	// ErrCapacityExhausted is returned by TryAdd when the newest layer is full and the
+	// filter has the maximum number of layers set by SetMaxLayers, or a new layer would
+	// exceed the memory budget set by SetMemoryBudget.
+	ErrCapacityExhausted = errors.New("scalable: capacity exhausted")
+)
+
+// GrowthPolicy decides when the newest layer of a filter is full, so that Add adds a new
+// layer for the next item. See SetGrowthPolicy.
+type GrowthPolicy uint8
+
+const (
+	// GrowOnEstimate adds a layer once the estimated fill ratio of the newest one, computed
+	// from the number of items added to it, is above p. It is the default.
+	GrowOnEstimate GrowthPolicy = iota
+
+	// GrowOnCount adds a layer once as many items were added to the newest one as it was
+	// built for.
+	GrowOnCount
+
+	// GrowOnActualFill adds a layer once the fraction of bits set of the newest one is
+	// above p. The bits are counted every 1/64 of the capacity of the layer.
+	GrowOnActualFill
+)
+
+// fillChecks is the number of times GrowOnActualFill counts the bits of a layer while
+// adding as many items as it was built for.
+const fillChecks = 64
+
+func (this GrowthPolicy) String() string {
+	switch this {
+	case GrowOnEstimate:
+		return "estimate"
+	case GrowOnCount:
+		return "count"
+	case GrowOnActualFill:
+		return "actual-fill"
+	}
+	return fmt.Sprintf("GrowthPolicy(%d)", uint8(this))
 }
 
-var _ bloom.Bloom = (*ScalableBloom)(nil)
+// EvictionPolicy decides what happens when the newest layer of a filter with the maximum
+// number of layers set by SetMaxLayers is full. See SetEvictionPolicy.
+type EvictionPolicy uint8
+
+const (
+	// NoEviction keeps all the layers, so the capacity of the filter is exhausted. It is
+	// the default.
+	NoEviction EvictionPolicy = iota
+
+	// EvictOldest drops the oldest layer to make room for a new one, so the items only in
+	// that layer are forgotten.
+	EvictOldest
+)
+
+func (this EvictionPolicy) String() string {
+	switch this {
+	case NoEviction:
+		return "none"
+	case EvictOldest:
+		return "oldest"
+	}
+	return fmt.Sprintf("EvictionPolicy(%d)", uint8(this))
+}
+
+func init() {
+	bloom.RegisterDecoder(bloom.KindScalable, func(h *bloom.Header, r io.Reader) (bloom.Bloom, error) {
+		bf := &ScalableBloom{}
+		if _, err := bf.readBody(h, r); err != nil {
+			return nil, err
+		}
+		return bf, nil
+	})
+}
 
 // New initializes a new partitioned bloom filter.
 // n is the number of items this bloom filter predicted to hold.
 func New(n uint) bloom.Bloom {
+	return newScalable(n, 0.001, nil)
+}
+
+// Option configures a filter created by NewWithOptions.
+type Option func(*ScalableBloom)
+
+// WithMemoryBudget bounds the memory of the filter to bytes, see SetMemoryBudget.
+func WithMemoryBudget(bytes uint64) Option {
+	return func(bf *ScalableBloom) {
+		bf.SetMemoryBudget(bytes)
+	}
+}
+
+// WithEviction sets the eviction policy of the filter, see SetEvictionPolicy. An unknown
+// policy is ignored.
+func WithEviction(policy EvictionPolicy) Option {
+	return func(bf *ScalableBloom) {
+		bf.SetEvictionPolicy(policy)
+	}
+}
+
+// NewWithOptions is the same as NewWithEstimates, with the options applied.
+func NewWithOptions(n uint, fpRate float64, opts ...Option) bloom.Bloom {
+	bf := NewWithEstimates(n, fpRate).(*ScalableBloom)
+	for _, opt := range opts {
+		opt(bf)
+	}
+	return bf
+}
+
+// NewE is the same as NewWithEstimates, but returns an error instead of building a broken
+// filter if n is 0 or fpRate is not in (0, 1).
+func NewE(n uint, fpRate float64) (bloom.Bloom, error) {
+	if err := bloom.Validate(n, 0.5, fpRate); err != nil {
+		return nil, err
+	}
+	return NewWithEstimates(n, fpRate), nil
+}
+
+// NewWithEstimates initializes a new scalable bloom filter for n items with a compound
+// false positive probability of fpRate. Layer i is given an error probability of
+// e * r^i, so the compound error across all layers is at most e / (1 - r). e is
+// therefore set to fpRate * (1 - r), and the first layer is sized for n items, each
+// following layer for twice as many as the previous one, see SetGrowthFactor.
+func NewWithEstimates(n uint, fpRate float64) bloom.Bloom {
+	return newScalable(n, fpRate*(1-0.9), nil)
+}
+
+// newScalable returns a new filter whose layers are built by bfc, or are partitioned filters
+// if bfc is nil.
+func newScalable(n uint, e float64, bfc func(uint) bloom.Bloom) bloom.Bloom {
 	var (
 		p float64   = 0.5
-		e float64   = 0.001
-		r float32   = 0.9
+		r float64   = 0.9
+		s uint      = 2
 		h hash.Hash = fnv.New64()
 	)
 
 	bf := &ScalableBloom{
-		h: h,
-		n: n,
-		p: p,
-		e: e,
-		r: r,
+		h:   h,
+		hn:  bloom.DefaultHasher,
+		n:   n,
+		p:   p,
+		e:   e,
+		s:   s,
+		r:   r,
+		bfc: bfc,
 	}
 
 	bf.addBloomFilter()
@@ -93,8 +322,151 @@ func (this *ScalableBloom) SetBloomFilter(f func(uint) bloom.Bloom) {
 	this.bfc = f
 }
 
-func (this *ScalableBloom) SetHasher(h hash.Hash) {
+// SetHasher sets the hash function of the filter and all its layers. The items already
+// added would hash to other positions, so it returns bloom.ErrNotEmpty if the filter isn't
+// empty.
+//
+// Each layer hashes items with a hash.Hash of its own, as a hash.Hash holds the state of
+// the item being hashed. If h implements hash.Cloner, as the hashers of the standard
+// library do, the filter keeps a clone of h, and gives a clone of that to each layer, so
+// h can still be used elsewhere. Otherwise the layers share h, which must then not be
+// used by anything else, and the layers can't be checked in parallel. SetHasherFactory
+// avoids this for such hashers.
+func (this *ScalableBloom) SetHasher(h hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.h = h
+	this.hn = ""
+	this.hf = hasherFactory(h)
+	return this.setLayerHashers()
+}
+
+// SetHasherFactory sets the hash function of the filter and all its layers to the ones
+// returned by f, which must return a new instance of the same hash function on each call:
+// each layer is given its own. Like SetHasher, it returns bloom.ErrNotEmpty if the filter
+// isn't empty, and the hash function can't be recreated when the filter is loaded, so
+// ReadFrom keeps f if it is given a filter written with a hash function set this way.
+func (this *ScalableBloom) SetHasherFactory(f func() hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.h = f()
+	this.hn = ""
+	this.hf = f
+	return this.setLayerHashers()
+}
+
+// hasherFactory returns a function returning clones of a clone of h taken now, so the
+// state of h when they are called doesn't matter. It returns nil if h can't be cloned.
+func hasherFactory(h hash.Hash) func() hash.Hash {
+	c, err := bloom.CloneHasher("", h)
+	if err != nil {
+		return nil
+	}
+	return func() hash.Hash { return layerHasher(c) }
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. Unlike SetHasher, the name is recorded when the filter is
+// serialized, so bloom.Load can recreate the same hash function. Like SetHasher, it sets
+// the hash function of all the layers, and returns bloom.ErrNotEmpty if the filter isn't
+// empty.
+func (this *ScalableBloom) SetNamedHasher(name string) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
 	this.h = h
+	this.hn = name
+	this.hf = nil
+	return this.setLayerHashers()
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *ScalableBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+// SetSeed sets the hash function to bloom.SeededHash, with a seed of its own for each layer
+// derived from seed and the index of the layer. The layers then hash an item to unrelated
+// positions, as the analysis of scalable bloom filters assumes, rather than to positions
+// all derived from the same hash value. Each layer records its seed when serialized, and
+// the filter records seed, so layers added after loading the filter get the seeds they
+// would have had. Like SetHasher, it returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *ScalableBloom) SetSeed(seed uint64) error {
+	return this.SetNamedHasher(bloom.SeededHasherName(seed))
+}
+
+// Seed returns the seed set by SetSeed, or false if the hash function isn't seeded.
+func (this *ScalableBloom) Seed() (uint64, bool) {
+	return bloom.SeedOf(this.hn)
+}
+
+func (this *ScalableBloom) setLayerHashers() error {
+	for i := range this.bfs {
+		if err := this.setLayerHasher(this.bfs[i], i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLayerHasher sets the hash function of an empty layer at index i. A hasher set by
+// SetNamedHasher is set by name if the layer supports it, so that the layer records the
+// name as well, and a seeded hasher is set with the seed of the layer, see SetSeed.
+// Otherwise the layer is given a new hash function, see newHasher.
+func (this *ScalableBloom) setLayerHasher(bf bloom.Bloom, i int) error {
+	if this.hn != "" {
+		name := this.hn
+		if seed, ok := bloom.SeedOf(name); ok {
+			name = bloom.SeededHasherName(layerSeed(seed, i))
+		}
+
+		if nh, ok := bf.(interface{ SetNamedHasher(string) error }); ok {
+			return nh.SetNamedHasher(name)
+		}
+
+		if h, err := bloom.NewHasher(name); err == nil {
+			return bf.SetHasher(h)
+		}
+	}
+	return bf.SetHasher(this.newHasher())
+}
+
+// newHasher returns a new hash function for a layer, returned by the factory set by
+// SetHasher or SetHasherFactory, or a clone of the hash function of the filter.
+func (this *ScalableBloom) newHasher() hash.Hash {
+	if this.hf != nil {
+		return this.hf()
+	}
+	return layerHasher(this.h)
+}
+
+// layerSeed returns the seed of layer i of a filter seeded with seed, mixing both with the
+// splitmix64 finalizer so the seeds of consecutive layers are unrelated.
+func layerSeed(seed uint64, i int) uint64 {
+	v := seed + uint64(i+1)*0x9e3779b97f4a7c15
+	v = (v ^ v>>30) * 0xbf58476d1ce4e5b9
+	v = (v ^ v>>27) * 0x94d049bb133111eb
+	return v ^ v>>31
+}
+
+// layerHasher returns a clone of h for a layer, so layers don't share hasher state. If h
+// can't be cloned, the layers share it.
+func layerHasher(h hash.Hash) hash.Hash {
+	if c, err := bloom.CloneHasher("", h); err == nil {
+		return c
+	}
+	return h
 }
 
 func (this *ScalableBloom) Reset() {
@@ -104,81 +476,1473 @@ func (this *ScalableBloom) Reset() {
 		this.h.Reset()
 	}
 
+	dropSpilled(this.bfs)
+
 	this.bfs = []bloom.Bloom{}
 	this.c = 0
+	this.exhausted, this.overBudget = false, false
+	this.evicted, this.forgotten = 0, 0
 	this.addBloomFilter()
+
+	grown := this.grown
+	this.grown = nil
+	this.notifyGrown(grown)
+}
+
+// Clear removes all the items from the filter. Unlike Reset, it keeps the first layer,
+// which is cleared, and drops the others, so it doesn't allocate, unless the first layer
+// was spilled, see SetSpill: it is then loaded back, or rebuilt by Reset if it can't be.
+func (this *ScalableBloom) Clear() {
+	if c, ok := this.bfs[0].(*coldLayer); ok {
+		bf, err := c.load()
+		if err != nil {
+			this.spillErr = err
+			this.Reset()
+			return
+		}
+
+		this.bfs[0] = bf
+		c.store.Delete(c.key)
+	}
+
+	dropSpilled(this.bfs[1:])
+	this.bfs[0].Clear()
+	clear(this.bfs[1:])
+	this.bfs = this.bfs[:1]
+	this.c = 0
+	this.fc = 0
+	this.exhausted, this.overBudget = false, false
+	this.evicted, this.forgotten = 0, 0
 }
 
-func (this *ScalableBloom) SetErrorProbability(e float64) {
+// SetErrorProbability sets the error probability e of the first layer, from which the
+// error probabilities of the other layers are derived, and resets the filter to rebuild the
+// first layer. It returns bloom.ErrInvalidErrorRate if e is not in (0, 1), and
+// bloom.ErrNotEmpty if items have been added, leaving the filter unchanged.
+func (this *ScalableBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
 	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetGrowthFactor sets the growth factor s of the layers: layer i is built for n * s^i
+// items. With the default of 2, a filter holding 100 times more items than n has 7 layers,
+// while with s = 1 every layer is built for n items, so it has 100, and Check, which checks
+// every layer, is 100 times slower. A larger s adds fewer layers, but the newest one may
+// be mostly empty. s only applies to the layers added afterwards, so it can be set at any
+// time. It returns ErrInvalidGrowthFactor if s is 0, leaving the filter unchanged.
+func (this *ScalableBloom) SetGrowthFactor(s uint) error {
+	if s == 0 {
+		return ErrInvalidGrowthFactor
+	}
+
+	this.s = s
+	return nil
+}
+
+// GrowthFactor returns the growth factor s set by SetGrowthFactor.
+func (this *ScalableBloom) GrowthFactor() uint {
+	return this.s
+}
+
+// SetGrowthPolicy sets the policy deciding when the newest layer is full, so that a new
+// layer is added. By default, with GrowOnEstimate, it is once its fill ratio estimated from
+// the number of items added to it is above p. The estimate assumes the items are distinct:
+// each item added again counts, while it sets no new bit, so a workload adding the same
+// items over and over adds layers that are mostly empty. GrowOnActualFill counts the bits
+// set instead, which costs a pass over the layer, so it is only done every 1/64 of the
+// capacity of the layer, and the layer may end up that many items above p. GrowOnCount
+// adds a layer once as many items were added as the layer was built for, which is about
+// the same as GrowOnEstimate, without computing the estimate.
+//
+// The policy applies to the newest layer, so it can be set at any time, and it is
+// recorded when the filter is serialized. It returns ErrInvalidGrowthPolicy for an
+// unknown policy, leaving the filter unchanged.
+func (this *ScalableBloom) SetGrowthPolicy(g GrowthPolicy) error {
+	if g > GrowOnActualFill {
+		return ErrInvalidGrowthPolicy
+	}
+
+	this.g = g
+	this.fc = 0
+	return nil
+}
+
+// GrowthPolicy returns the policy set by SetGrowthPolicy.
+func (this *ScalableBloom) GrowthPolicy() GrowthPolicy {
+	return this.g
+}
+
+// SetDedupOnAdd sets whether Add, and the other methods adding items, first checks all the
+// layers for the item, and skips it if it is found, without counting it. By default items
+// are always added to the newest layer and counted, so a stream adding the same items over
+// and over fills the layers as if they were distinct, adding layers, and each item added
+// again after a new layer was added takes bits in that layer too. With dedup, Count is
+// about the number of distinct items, and the layers only fill with new ones.
+//
+// It costs a Check of all the layers for each item added, and a new item that is a false
+// positive of the filter isn't added either, with a probability of the compound false
+// positive rate, see CurrentFalsePositiveRate. This doesn't change what Check returns for
+// that item, which is already true, but Count misses it, and with counting layers, Remove
+// may then remove the item it collided with. AddAll no longer adds the items in batches.
+// The setting is recorded when the filter is serialized.
+func (this *ScalableBloom) SetDedupOnAdd(dedup bool) {
+	this.dedup = dedup
+}
+
+// DedupOnAdd returns the setting of SetDedupOnAdd.
+func (this *ScalableBloom) DedupOnAdd() bool {
+	return this.dedup
+}
+
+// SetMaxLayers sets the maximum number of layers of the filter, so its memory is bounded,
+// or removes the limit if n is 0, the default. Once the newest layer is full and the
+// filter has n layers, the capacity of the filter is exhausted: Add, which can't report
+// it, keeps adding items to the newest layer, whose false positive rate then grows past
+// its error probability, while TryAdd returns ErrCapacityExhausted without adding the
+// item. Either way, the function set by SetOnCapacityExhausted is called, once, and
+// Stats reports CapacityExhausted. With SetEvictionPolicy, the oldest layer is dropped
+// instead.
+//
+// The filter stays exhausted until it is cleared, or n is raised above its number of
+// layers. Merge appends layers regardless of n. Like the function, n is not serialized.
+// It returns ErrInvalidMaxLayers if n is negative, leaving the filter unchanged.
+func (this *ScalableBloom) SetMaxLayers(n int) error {
+	if n < 0 {
+		return ErrInvalidMaxLayers
+	}
+
+	this.ml = n
+	if !this.overBudget && (n == 0 || n > len(this.bfs)) {
+		this.exhausted = false
+	}
+	return nil
+}
+
+// MaxLayers returns the maximum number of layers set by SetMaxLayers, 0 if there is none.
+func (this *ScalableBloom) MaxLayers() int {
+	return this.ml
+}
+
+// SetOnCapacityExhausted sets the function called when the capacity of the filter is
+// exhausted, see SetMaxLayers. It is called once, by the Add, TryAdd or AddAll that found
+// the newest layer full, after the filter is unlocked, so it may call the methods of the
+// filter. It is called again only if the filter is exhausted again after being cleared.
+func (this *ScalableBloom) SetOnCapacityExhausted(f func()) {
+	this.oe = f
+}
+
+// SetEvictionPolicy sets what happens when the newest layer is full and the filter has the
+// maximum number of layers set by SetMaxLayers. By default, with NoEviction, the capacity
+// of the filter is exhausted. With EvictOldest, the oldest layer is dropped, with all its
+// items, and a new layer is added, so the filter holds the items added recently in
+// bounded memory forever, for workloads whose old items stop mattering. This gives up the
+// guarantee of Bloom filters that Check finds every item added: an item added only while
+// the evicted layer was the newest one is no longer found, except as a false positive of
+// the other layers. Count drops by the number of items added to the layer, and Stats
+// reports the number of layers evicted and an estimate of the number of distinct items
+// they held.
+//
+// Once layers are evicted, the new ones are built for as many items as the newest one,
+// with the same error probability rather than a tighter one, so the layers stop growing.
+// Like the maximum number of layers, the policy is not serialized. It returns
+// ErrInvalidEvictionPolicy for an unknown policy, leaving the filter unchanged.
+func (this *ScalableBloom) SetEvictionPolicy(policy EvictionPolicy) error {
+	if policy > EvictOldest {
+		return ErrInvalidEvictionPolicy
+	}
+
+	this.ev = policy
+	if policy == EvictOldest && !this.overBudget {
+		this.exhausted = false
+	}
+	return nil
+}
+
+// EvictionPolicy returns the policy set by SetEvictionPolicy.
+func (this *ScalableBloom) EvictionPolicy() EvictionPolicy {
+	return this.ev
+}
+
+// SetMemoryBudget bounds the memory of the filter, as returned by MemoryUsage, to bytes, or
+// removes the bound if bytes is 0, the default. Once the newest layer is full and a new
+// layer would take MemoryUsage above bytes, the filter stops growing: like with
+// SetMaxLayers, its capacity is exhausted, Add keeps adding items to the newest layer,
+// whose false positive rate grows past its error probability, as CompoundErrorRate,
+// CurrentFalsePositiveRate and Stats report, and TryAdd returns ErrCapacityExhausted. The
+// function set by SetOnBudgetExhausted is called, once, and Stats reports
+// BudgetExhausted.
+//
+// The new layer is measured before it is built, from its capacity, e and p, so a rejected
+// layer is never allocated. Layers built by the constructor set with SetBloomFilter are
+// measured by the size of their bits. The first layer is always built, whatever its size.
+// The filter stays exhausted until it is cleared, or the budget is raised or removed. Merge
+// appends layers regardless of the budget. Like the function, the budget is not
+// serialized.
+func (this *ScalableBloom) SetMemoryBudget(bytes uint64) {
+	if this.overBudget && (bytes == 0 || bytes > this.mb) {
+		this.exhausted, this.overBudget = false, false
+	}
+	this.mb = bytes
+}
+
+// MemoryBudget returns the memory budget set by SetMemoryBudget, 0 if there is none.
+func (this *ScalableBloom) MemoryBudget() uint64 {
+	return this.mb
+}
+
+// SetOnBudgetExhausted sets the function called when a new layer would exceed the memory
+// budget, see SetMemoryBudget. Like the function set by SetOnCapacityExhausted, which
+// isn't called then, it is called once, after the filter is unlocked.
+func (this *ScalableBloom) SetOnBudgetExhausted(f func()) {
+	this.ob = f
+}
+
+// SetOnGrow sets the function called with the index and parameters of each new layer. It
+// is first called for the layers the filter already has, including the one created by New,
+// then for each layer added by Add, TryAdd or AddAll, and for the layer created by Reset,
+// with index 0. It runs on the goroutine of the Add that added the layer, before that Add
+// returns, once the filter is unlocked, so it may call the methods of the filter, but it
+// delays the Add, and it must be fast. It isn't called for the layers appended by Merge
+// or read by ReadFrom.
+func (this *ScalableBloom) SetOnGrow(f func(i int, p bloom.Params)) {
+	this.og = f
+	if f == nil {
+		return
+	}
+
+	for i, bf := range this.bfs {
+		f(i, bf.Params())
+	}
+}
+
+// grownLayer is a layer added while the filter was locked, for the function set by
+// SetOnGrow.
+type grownLayer struct {
+	i int
+	p bloom.Params
+}
+
+// SetTighteningRatio sets the tightening ratio r of the error probabilities of the layers:
+// each new layer is given the error probability of the newest one times r, so with the
+// same r throughout, layer i has e * r^i and the compound error probability of all the
+// layers is at most e / (1 - r). A smaller r keeps the compound error probability lower
+// as layers are added, at the cost of larger layers, as each one needs more bits per item:
+// the paper finds 0.8 to 0.9 the best trade-off, and the default is 0.9.
+//
+// r only applies to the layers added afterwards, so it can be set at any time: the error
+// probabilities of the existing layers don't change, and the next layer is given the one
+// of the newest layer times the new r. e doesn't change either, so the bound e / (1 - r)
+// of a filter built by NewWithEstimates for a compound fpRate changes with r, unless e is
+// set to fpRate * (1 - r) with SetErrorProbability. It returns ErrInvalidTighteningRatio
+// if r is not in (0, 1), leaving the filter unchanged.
+func (this *ScalableBloom) SetTighteningRatio(r float64) error {
+	if !(r > 0 && r < 1) {
+		return ErrInvalidTighteningRatio
+	}
+
+	this.r = r
+	return nil
+}
+
+// TighteningRatio returns the tightening ratio r set by SetTighteningRatio.
+func (this *ScalableBloom) TighteningRatio() float64 {
+	return this.r
+}
+
+// SetFillRatio sets the fill ratio p of the layers, and resets the filter to rebuild the
+// first layer. Add adds a new layer once the estimated fill ratio of the newest layer is
+// above p, so a lower p adds layers earlier, while the layers are larger. It returns
+// bloom.ErrInvalidFillRatio if p is not in (0, 1), and bloom.ErrNotEmpty if items have
+// been added, leaving the filter unchanged.
+func (this *ScalableBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	this.Reset()
+	return nil
 }
 
 func (this *ScalableBloom) EstimatedFillRatio() float64 {
 	return this.bfs[len(this.bfs)-1].EstimatedFillRatio()
 }
 
+// K returns 0, as it differs between layers. See LayerParams.
+func (this *ScalableBloom) K() uint {
+	return 0
+}
+
+// M returns the total number of bits of all the layers.
+func (this *ScalableBloom) M() uint {
+	return this.Params().M
+}
+
+// S returns 0, as it differs between layers. See LayerParams.
+func (this *ScalableBloom) S() uint {
+	return 0
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *ScalableBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns n, p and e of the filter, with M set to the total number of bits of all
+// its layers. K and S differ between layers and are 0. The parameters of each layer are
+// returned by LayerParams.
+func (this *ScalableBloom) Params() bloom.Params {
+	params := bloom.Params{N: this.n, P: this.p, E: this.e}
+	for i := range this.bfs {
+		params.M += this.bfs[i].Params().M
+	}
+	return params
+}
+
+// LayerParams returns the parameters of each layer, oldest first.
+func (this *ScalableBloom) LayerParams() []bloom.Params {
+	params := make([]bloom.Params, len(this.bfs))
+	for i := range this.bfs {
+		params[i] = this.bfs[i].Params()
+	}
+	return params
+}
+
+// LayerStats holds the state of one layer of a scalable filter, as returned by LayerStats:
+// the parameters it was built with, n, m, k and its error probability e, the number of
+// items added to it, the fraction of its bits set, and its false positive probability
+// computed from them, as returned by its CurrentFalsePositiveRate method.
+type LayerStats struct {
+	bloom.Params
+
+	Count             uint64
+	FillRatio         float64
+	FalsePositiveRate float64
+}
+
+// NumLayers returns the number of layers of the filter. It is safe to call concurrently
+// with Add.
+func (this *ScalableBloom) NumLayers() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return len(this.bfs)
+}
+
+// LayerStats returns the state of layer i, oldest first, which must be in
+// [0, NumLayers()). Unlike Stats, it only counts the bits set of that layer. It is safe to
+// call concurrently with Add.
+func (this *ScalableBloom) LayerStats(i int) LayerStats {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	bf := this.bfs[i]
+	return LayerStats{
+		Params:            bf.Params(),
+		Count:             bf.Count(),
+		FillRatio:         bf.FillRatio(),
+		FalsePositiveRate: bf.CurrentFalsePositiveRate(),
+	}
+}
+
+// FillRatio returns the fill ratio of the layers, each weighted by its number of bits m,
+// which is about the fraction of all their bits that are set. The layers grow, so their
+// plain average would give as much weight to a small full layer as to a large empty one.
+// See LayerStats for the fill ratio of each layer.
 func (this *ScalableBloom) FillRatio() float64 {
-	// Since this has multiple bloom filters, we will return the average
-	t := float64(0)
+	return this.fill(func(i int) float64 { return this.bfs[i].FillRatio() })
+}
+
+// fill returns the fill ratio of all the layers, from the fill ratio f(i) of each layer i,
+// weighted by its number of bits. FillRatio and Stats both aggregate the layers with it.
+func (this *ScalableBloom) fill(f func(i int) float64) float64 {
+	var set, m float64
+	for i := range this.bfs {
+		mi := float64(this.bfs[i].Params().M)
+		set += f(i) * mi
+		m += mi
+	}
+
+	if m == 0 {
+		return 0
+	}
+	return set / m
+}
+
+// compound returns the compound probability 1 - (1-p0) * (1-p1) * ... that an item is a
+// false positive of any layer, from the probability p(i) for each layer i. Unlike the fill
+// ratio, it isn't weighted by the size of the layers, as an item is checked against each.
+// CurrentFalsePositiveRate, CompoundErrorRate, ErrorProbability and Stats all aggregate
+// the layers with it.
+func (this *ScalableBloom) compound(p func(i int) float64) float64 {
+	t := float64(1)
 	for i := range this.bfs {
-		t += this.bfs[i].FillRatio()
+		t *= 1 - p(i)
 	}
-	return t / float64(len(this.bfs))
+	return 1 - t
 }
 
+// Add adds item to the newest layer, adding a new layer first if the newest one is full,
+// by default once its estimated fill ratio is above p, see SetGrowthPolicy. With
+// SetDedupOnAdd, an item found by Check isn't added. It is safe to call concurrently with
+// other Adds and Checks.
+//
+// If the filter has the maximum number of layers set by SetMaxLayers, the item is added to
+// the newest layer even if it is full. See TryAdd to detect it.
 func (this *ScalableBloom) Add(item []byte) bloom.Bloom {
-	i := len(this.bfs) - 1
+	this.mu.Lock()
+	notify := this.add(item)
+	this.unlock(notify)
+	return this
+}
+
+// TryAdd is the same as Add, except that if the newest layer is full and the filter has the
+// maximum number of layers set by SetMaxLayers, it returns ErrCapacityExhausted and doesn't
+// add the item.
+func (this *ScalableBloom) TryAdd(item []byte) error {
+	this.mu.Lock()
+
+	if this.dedup && this.check(item) {
+		this.mu.Unlock()
+		return nil
+	}
 
-	if this.bfs[i].EstimatedFillRatio() > this.p {
-		this.addBloomFilter()
-		i++
+	i, exhausted, notify := this.layer()
+	if !exhausted {
+		this.insert(i, item)
 	}
+	this.unlock(notify)
 
+	if exhausted {
+		return ErrCapacityExhausted
+	}
+	return nil
+}
+
+// add adds item to the newest layer, adding a new layer first if needed, and reports
+// whether it exhausted the capacity of the filter, see layer.
+func (this *ScalableBloom) add(item []byte) bool {
+	if this.dedup && this.check(item) {
+		return false
+	}
+
+	i, _, notify := this.layer()
+	this.insert(i, item)
+	return notify
+}
+
+func (this *ScalableBloom) insert(i int, item []byte) {
 	this.bfs[i].Add(item)
 	this.c++
-	return this
+	this.fc++
+	this.track(1)
 }
 
-func (this *ScalableBloom) Check(item []byte) bool {
-	l := len(this.bfs)
-	for i := l - 1; i >= 0; i-- {
-		//fmt.Println("checking level ", i)
-		if this.bfs[i].Check(item) {
-			return true
-		}
+// layer returns the index of the layer to add items to: the newest one, after adding a new
+// one if it is full, and evicting the oldest ones first with EvictOldest. If it is full and
+// there can be no new layer, layer also returns true, and true again if the filter wasn't
+// exhausted before, so the function set by SetOnCapacityExhausted or SetOnBudgetExhausted
+// has to be called.
+func (this *ScalableBloom) layer() (int, bool, bool) {
+	i := len(this.bfs) - 1
+
+	switch {
+	case this.exhausted:
+		return i, true, false
+	case !this.full(this.bfs[i]):
+		return i, false, false
+	case this.ml > 0 && len(this.bfs) >= this.ml && this.ev == NoEviction:
+		this.exhausted = true
+		return i, true, true
 	}
-	return false
+
+	// With EvictOldest, the oldest layers make room for the new one
+	for this.ml > 0 && len(this.bfs) >= this.ml {
+		this.evictOldest()
+	}
+
+	if !this.addBloomFilter() {
+		this.exhausted, this.overBudget = true, true
+		return len(this.bfs) - 1, true, true
+	}
+	return len(this.bfs) - 1, false, false
 }
 
-func (this *ScalableBloom) Count() uint {
-	return this.c
+// evictOldest drops the oldest layer, see SetEvictionPolicy.
+func (this *ScalableBloom) evictOldest() {
+	bf := this.bfs[0]
+	this.evicted++
+	this.forgotten += bf.ApproximateCardinality()
+	this.c -= min(this.c, bf.Count())
+	dropSpilled(this.bfs[:1])
+
+	copy(this.bfs, this.bfs[1:])
+	this.bfs[len(this.bfs)-1] = nil
+	this.bfs = this.bfs[:len(this.bfs)-1]
 }
 
-func (this *ScalableBloom) PrintStats() {
-	fmt.Printf("n = %d, p = %f, e = %f\n", this.n, this.p, this.e)
-	fmt.Println("Total items:", this.c)
+// unlock unlocks the filter, then calls the function set by SetOnGrow for the layers added
+// while it was locked, and if notify is set, the one set by SetOnBudgetExhausted if the
+// filter is over its memory budget, or the one set by SetOnCapacityExhausted otherwise.
+func (this *ScalableBloom) unlock(notify bool) {
+	grown := this.grown
+	this.grown = nil
 
-	for i := range this.bfs {
-		fmt.Printf("Scalable Bloom Filter #%d\n", i)
-		fmt.Printf("-------------------------\n")
-		this.bfs[i].PrintStats()
+	f := this.oe
+	if this.overBudget {
+		f = this.ob
 	}
-}
+	this.mu.Unlock()
 
-func (this *ScalableBloom) addBloomFilter() {
-	var bf bloom.Bloom
-	if this.bfc == nil {
-		bf = partitioned.New(this.n)
-	} else {
-		bf = this.bfc(this.n)
+	this.notifyGrown(grown)
+	if notify && f != nil {
+		f()
 	}
+}
 
-	e := this.e * math.Pow(float64(this.r), float64(len(this.bfs)))
+// notifyGrown calls the function set by SetOnGrow for each of the layers grown. It must
+// be called with the filter unlocked.
+func (this *ScalableBloom) notifyGrown(grown []grownLayer) {
+	if this.og == nil {
+		return
+	}
 
-	bf.SetHasher(this.h)
-	bf.SetErrorProbability(e)
-	bf.Reset()
+	for _, g := range grown {
+		this.og(g.i, g.p)
+	}
+}
+
+// full reports whether the newest layer bf is full under the growth policy, so the next
+// item goes to a new layer.
+func (this *ScalableBloom) full(bf bloom.Bloom) bool {
+	switch this.g {
+	case GrowOnCount:
+		return bf.Count() >= uint64(bf.Params().N)
+
+	case GrowOnActualFill:
+		if this.fc < this.fillInterval(bf) {
+			return false
+		}
+		this.fc = 0
+		return bf.FillRatio() > this.p
+	}
+
+	return bf.EstimatedFillRatio() > this.p
+}
+
+// fillInterval returns the number of items added to the layer bf between two counts of its
+// bits with GrowOnActualFill.
+func (this *ScalableBloom) fillInterval(bf bloom.Bloom) uint {
+	return max(bf.Params().N/fillChecks, 1)
+}
+
+// room returns the number of items, from 1 to n, that can be added to the newest layer bf,
+// which isn't full, before full has to be asked again.
+func (this *ScalableBloom) room(bf bloom.Bloom, n int) int {
+	switch this.g {
+	case GrowOnCount:
+		if c, l := bf.Count(), uint64(bf.Params().N); c < l {
+			return int(min(l-c, uint64(n)))
+		}
+
+	case GrowOnActualFill:
+		if i := this.fillInterval(bf); this.fc < i {
+			return int(min(i-this.fc, uint(n)))
+		}
+
+	default:
+		// The estimated fill ratio is 1 - q^c, for the probability q that an item leaves a
+		// bit clear, so the layer exceeds p once it holds c * ln(1-p) / ln(1-f) items. Add
+		// still adds the item that crosses p.
+		if c, f := bf.Count(), bf.EstimatedFillRatio(); c > 0 && f > 0 && f < 1 {
+			limit := float64(c) * math.Log(1-this.p) / math.Log(1-f)
+			if room := limit - float64(c) + 1; room > 1 {
+				return int(math.Min(room, float64(n)))
+			}
+		}
+	}
+
+	return 1
+}
+
+// AddAll adds all the items. Rather than checking whether the newest layer is full before
+// each item like Add, it computes how many items the layer can take before it has to be
+// checked again, by default before its estimated fill ratio exceeds p, adds them to the
+// layer in one batch, and only then adds a new layer if needed. Like Add, it adds the items
+// to the newest layer once the capacity of the filter is exhausted, see SetMaxLayers.
+func (this *ScalableBloom) AddAll(items [][]byte) bloom.Bloom {
+	item := func(i int) []byte { return items[i] }
+	this.addAll(len(items), item, func(bf bloom.Bloom, lo, hi int) {
+		if a, ok := bf.(interface{ AddAll([][]byte) bloom.Bloom }); ok {
+			a.AddAll(items[lo:hi])
+			return
+		}
+
+		for _, item := range items[lo:hi] {
+			bf.Add(item)
+		}
+	})
+	return this
+}
+
+// AddAllStrings is the same as AddAll for string items, without copying them.
+func (this *ScalableBloom) AddAllStrings(items []string) bloom.Bloom {
+	item := func(i int) []byte { return unsafe.Slice(unsafe.StringData(items[i]), len(items[i])) }
+	this.addAll(len(items), item, func(bf bloom.Bloom, lo, hi int) {
+		if a, ok := bf.(interface{ AddAllStrings([]string) bloom.Bloom }); ok {
+			a.AddAllStrings(items[lo:hi])
+			return
+		}
+
+		for _, item := range items[lo:hi] {
+			bf.Add(unsafe.Slice(unsafe.StringData(item), len(item)))
+		}
+	})
+	return this
+}
+
+// addAll adds n items in batches, calling add to add items lo to hi to the layer bf. With
+// SetDedupOnAdd, each item has to be checked first, so they are added one by one, as
+// returned by item. The functions set by SetOnGrow and SetOnCapacityExhausted are called
+// once the filter is unlocked.
+func (this *ScalableBloom) addAll(n int, item func(i int) []byte, add func(bf bloom.Bloom, lo, hi int)) {
+	var notify bool
+
+	this.mu.Lock()
+	defer func() { this.unlock(notify) }()
+
+	if this.dedup {
+		for i := 0; i < n; i++ {
+			notify = this.add(item(i)) || notify
+		}
+		return
+	}
+
+	for lo := 0; lo < n; {
+		i, exhausted, first := this.layer()
+		notify = notify || first
+
+		// An exhausted filter takes all the items in its newest layer
+		bf := this.bfs[i]
+		hi := n
+		if !exhausted {
+			hi = lo + this.room(bf, n-lo)
+		}
+
+		add(bf, lo, hi)
+		this.c += uint64(hi - lo)
+		this.track(uint64(hi - lo))
+		this.fc += uint(hi - lo)
+		lo = hi
+	}
+}
+
+// Check returns true if item may have been added to the filter. It is safe to call
+// concurrently with other Checks and Adds.
+func (this *ScalableBloom) Check(item []byte) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.check(item)
+}
+
+func (this *ScalableBloom) check(item []byte) bool {
+	l := len(this.bfs)
+	for i := l - 1; i >= 0; i-- {
+		//fmt.Println("checking level ", i)
+		if this.bfs[i].Check(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *ScalableBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *ScalableBloom) CheckString(s string) bool {
+	return this.Check(unsafe.Slice(unsafe.StringData(s), len(s)))
+}
+
+// CheckMany checks all the items, setting out[i] to Check(items[i]). out is reused if it
+// can hold len(items) results, and allocated otherwise. The slice of results is returned.
+func (this *ScalableBloom) CheckMany(items [][]byte, out []bool) []bool {
+	out = bloom.Results(out, len(items))
+
+	for i, item := range items {
+		out[i] = this.Check(item)
+	}
+
+	return out
+}
+
+// AddUint64 is the same as Add of the 8 byte big endian encoding of v, without allocating.
+func (this *ScalableBloom) AddUint64(v uint64) bloom.Bloom {
+	this.mu.Lock()
+	binary.BigEndian.PutUint64(this.u64[:], v)
+	notify := this.add(this.u64[:])
+	this.unlock(notify)
+	return this
+}
+
+// CheckUint64 is the same as Check of the 8 byte big endian encoding of v, without
+// allocating.
+func (this *ScalableBloom) CheckUint64(v uint64) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for i := len(this.bfs) - 1; i >= 0; i-- {
+		if this.bfs[i].(uint64Checker).CheckUint64(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// uint64Checker is implemented by both kinds of layers.
+type uint64Checker interface {
+	CheckUint64(v uint64) bool
+}
+
+func (this *ScalableBloom) Count() uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.c
+}
+
+// Capacity returns the number of items the newest layer was built for. Once it is over
+// capacity, the next Add adds a new layer. See TotalCapacity for all the layers.
+func (this *ScalableBloom) Capacity() uint {
+	return this.bfs[len(this.bfs)-1].Params().N
+}
+
+// Remaining returns the number of items that can be added to the newest layer before
+// reaching its capacity. It is negative once more items have been added to it.
+func (this *ScalableBloom) Remaining() int64 {
+	bf := this.bfs[len(this.bfs)-1]
+	return int64(bf.Params().N) - int64(bf.Count())
+}
+
+// IsOverCapacity reports whether more items than its capacity have been added to the
+// newest layer, or its estimated fill ratio is above p.
+func (this *ScalableBloom) IsOverCapacity() bool {
+	bf := this.bfs[len(this.bfs)-1]
+	return bf.Count() > uint64(bf.Params().N) || bf.EstimatedFillRatio() > this.p
+}
+
+// TotalCapacity returns the total number of items the layers were built for.
+func (this *ScalableBloom) TotalCapacity() uint {
+	c := uint(0)
+	for i := range this.bfs {
+		c += this.bfs[i].Params().N
+	}
+	return c
+}
+
+// TotalRemaining returns the number of items that can be added before reaching the total
+// capacity of the layers, without adding a new layer. It is negative if more items have
+// been added.
+func (this *ScalableBloom) TotalRemaining() int64 {
+	return int64(this.TotalCapacity()) - int64(this.c)
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the bits set rather than the configured error probabilities. It is the compound
+// 1 - (1-p0) * (1-p1) * ... of the current false positive probability pi of each layer.
+// See ErrorProbability for the one computed from the configured error probabilities.
+func (this *ScalableBloom) CurrentFalsePositiveRate() float64 {
+	return this.compound(func(i int) float64 { return this.bfs[i].CurrentFalsePositiveRate() })
+}
+
+// ApproximateCardinality estimates the number of distinct items added to the filter as the
+// sum of the estimates of its layers. Unlike Count, an item added more than once to a layer
+// is only counted once. Add doesn't check the older layers though, so an item added again
+// after a new layer was added is counted once in each layer it was added to.
+func (this *ScalableBloom) ApproximateCardinality() uint64 {
+	c := uint64(0)
+	for i := range this.bfs {
+		c += this.bfs[i].ApproximateCardinality()
+	}
+	return c
+}
+
+// Merge adds all the items of other to the filter. Since the layers of the two filters
+// generally have different error rates, their bits can't simply be ORed. Instead, each
+// layer of other is copied to the filter: it is unioned into the layer at the same index if
+// both are partitioned filters with the same parameters and their combined count still fits
+// the fill ratio p, and appended as a new layer otherwise. The count is the sum of both.
+//
+// The filters may have been created with a different r or e. The copied layers keep their
+// own error rates, while new layers are created with the r and e of the filter, so the
+// compound error rate changes accordingly. It is returned by ErrorProbability.
+//
+// Both filters must use the same hasher: either hashers registered with the same name, or
+// the same hash.Hash set with SetHasher. Otherwise Merge returns an error wrapping
+// bloom.ErrIncompatible and leaves the filter unchanged.
+func (this *ScalableBloom) Merge(other *ScalableBloom) error {
+	if this.hn != other.hn || (this.hn == "" && this.h != other.h) {
+		return fmt.Errorf("%w: hashers %q and %q", bloom.ErrIncompatible, this.hn, other.hn)
+	}
+
+	layers := make([]bloom.Bloom, len(other.bfs))
+	for i := range other.bfs {
+		bf, err := other.bfs[i].Clone()
+		if err != nil {
+			return err
+		}
+		layers[i] = bf
+	}
+
+	n := len(this.bfs)
+	for i, bf := range layers {
+		if i < n && this.union(this.bfs[i], bf) {
+			continue
+		}
+		this.bfs = append(this.bfs, bf)
+	}
+
+	this.c += other.c
+	this.spillCold()
+	return nil
+}
+
+// union unions b into a if both are partitioned filters with the same parameters, and
+// their combined count keeps the estimated fill ratio at or below p. It reports whether
+// b was unioned.
+func (this *ScalableBloom) union(a, b bloom.Bloom) bool {
+	pa, ok := a.(*partitioned.PartitionedBloom)
+	if !ok {
+		return false
+	}
+
+	pb, ok := b.(*partitioned.PartitionedBloom)
+	if !ok || pa.Params() != pb.Params() {
+		return false
+	}
+
+	// The estimated fill ratio is 1 - (1 - 1/s)^c, which is at most p for c up to
+	// ln(1-p) / ln(1 - 1/s)
+	s := float64(pa.Params().S)
+	if float64(pa.Count()+pb.Count()) > math.Log(1-this.p)/math.Log1p(-1/s) {
+		return false
+	}
+
+	return pa.Union(pb) == nil
+}
+
+// CompoundErrorRate returns the expected false positive probability of the filter as it
+// is, 1 - (1-p0) * (1-p1) * ... for the expected false positive probability pi = fi^ki of
+// each layer, from its fill ratio fi and number of hash functions ki. Unlike
+// ErrorProbability, it grows as the layers fill, and can be compared with
+// DesignErrorBound to tell how close the filter is to the error rate it was designed for.
+// It is safe to call concurrently with Add.
+func (this *ScalableBloom) CompoundErrorRate() float64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.compoundErrorRate()
+}
+
+func (this *ScalableBloom) compoundErrorRate() float64 {
+	return this.compound(func(i int) float64 {
+		return math.Pow(this.bfs[i].FillRatio(), float64(this.bfs[i].Params().K))
+	})
+}
+
+// DesignErrorBound returns e / (1 - r), the bound of the compound error probability of
+// the layers the filter may add with its error probability e and tightening ratio r,
+// however many they are. ErrorProbability stays below it for layers created by the
+// filter itself.
+func (this *ScalableBloom) DesignErrorBound() float64 {
+	return this.e / (1 - this.r)
+}
+
+// ErrorProbability returns the compound error probability of the layers of the filter,
+// 1 - (1-e0) * (1-e1) * ... for the error probability ei each layer was built with. It is
+// less than DesignErrorBound when all the layers were created by the filter itself with
+// the same r. See CompoundErrorRate and CurrentFalsePositiveRate for the ones computed
+// from the bits set. It is safe to call concurrently with Add.
+func (this *ScalableBloom) ErrorProbability() float64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.compound(func(i int) float64 { return this.bfs[i].Params().E })
+}
+
+// Clone returns a deep copy of the filter, cloning each layer with a new hasher of the same
+// kind. Changes to the copy don't affect the filter, and the other way around. It returns
+// an error if the hasher can't be recreated, see bloom.CloneHasher, unless it was set by
+// SetHasherFactory.
+func (this *ScalableBloom) Clone() (bloom.Bloom, error) {
+	var (
+		h   hash.Hash
+		err error
+	)
+
+	if this.hn == "" && this.hf != nil {
+		h = this.hf()
+	} else if h, err = bloom.CloneHasher(this.hn, this.h); err != nil {
+		return nil, err
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	bf := &ScalableBloom{
+		h:          h,
+		hn:         this.hn,
+		hf:         this.hf,
+		p:          this.p,
+		e:          this.e,
+		n:          this.n,
+		c:          this.c,
+		s:          this.s,
+		r:          this.r,
+		g:          this.g,
+		fc:         this.fc,
+		dedup:      this.dedup,
+		ml:         this.ml,
+		oe:         this.oe,
+		og:         this.og,
+		exhausted:  this.exhausted,
+		mb:         this.mb,
+		overBudget: this.overBudget,
+		ob:         this.ob,
+		ev:         this.ev,
+		evicted:    this.evicted,
+		forgotten:  this.forgotten,
+		rh:         this.rh,
+		bfc:        this.bfc,
+		bfs:        make([]bloom.Bloom, len(this.bfs)),
+	}
+
+	for i := range this.bfs {
+		if bf.bfs[i], err = this.cloneLayer(this.bfs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// The copy measures its own rate
+	if this.rt != nil {
+		bf.rt = newAddTracker(len(this.rt.t))
+	}
+
+	return bf, nil
+}
+
+// cloneLayer returns a deep copy of the layer bf. A layer whose hash function came from a
+// factory that returns hash functions which can't be cloned is copied through its encoding,
+// with a new hash function from the factory.
+func (this *ScalableBloom) cloneLayer(bf bloom.Bloom) (bloom.Bloom, error) {
+	c, err := bf.Clone()
+	if err == nil || this.hn != "" || this.hf == nil {
+		return c, err
+	}
+
+	enc, ok := bf.(bloom.Encoder)
+	if !ok {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, nil); err != nil {
+		return nil, err
+	}
+
+	lh := &bloom.Header{}
+	if _, err := lh.ReadFrom(&buf); err != nil {
+		return nil, err
+	}
+
+	return decodeLayer(lh, &buf, this.hf())
+}
+
+// MemoryUsage returns the number of bytes held by the filter and all its layers. The memory
+// held by the hasher is not included.
+func (this *ScalableBloom) MemoryUsage() uint64 {
+	t := uint64(unsafe.Sizeof(*this)) + uint64(cap(this.bfs))*uint64(unsafe.Sizeof(this.bfs[0]))
+	for i := range this.bfs {
+		t += this.bfs[i].MemoryUsage()
+	}
+	return t
+}
 
-	this.bfs = append(this.bfs, bf)
+// EstimateMemory returns the MemoryUsage of a filter created by NewWithEstimates(n, e),
+// without creating it. It has a single layer until more than n items are added.
+func EstimateMemory(n uint, e float64) uint64 {
+	return uint64(unsafe.Sizeof(ScalableBloom{})+unsafe.Sizeof(bloom.Bloom(nil))) +
+		partitioned.EstimateMemory(n, e*(1-0.9))
+}
+
+// String implements fmt.Stringer with a one line summary of the filter. The fill ratio
+// is the estimated one of the newest layer, so String doesn't have to count the bits set.
+func (this *ScalableBloom) String() string {
+	return fmt.Sprintf("scalable{n=%d e=%g layers=%d count=%d fill=%.2f}", this.n, this.e, len(this.bfs), this.c, this.EstimatedFillRatio())
+}
+
+// Stats returns the statistics of the filter.
+func (this *ScalableBloom) Stats() bloom.Stats {
+	stats := bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.c,
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		Layers:             make([]bloom.Stats, len(this.bfs)),
+		TighteningRatio:    this.r,
+		GrowthPolicy:       this.g.String(),
+		CapacityExhausted:  this.exhausted,
+		MemoryBudget:       this.mb,
+		BudgetExhausted:    this.overBudget,
+		EvictedLayers:      this.evicted,
+		ForgottenItems:     this.forgotten,
+		CompoundErrorRate:  this.compoundErrorRate(),
+		DesignErrorBound:   this.DesignErrorBound(),
+	}
+
+	if f := this.forecast(); f.Grows {
+		stats.NextLayerAdds, stats.NextLayerIn, stats.NextLayerBytes = f.Adds, f.Until, f.LayerBytes
+	}
+
+	for i := range this.bfs {
+		stats.Layers[i] = this.bfs[i].Stats()
+		stats.BitsSet += stats.Layers[i].BitsSet
+	}
+
+	// Like FillRatio, the fill ratio is weighted by the bits of the layers
+	stats.FillRatio = this.fill(func(i int) float64 { return stats.Layers[i].FillRatio })
+	stats.FalsePositiveRate = this.compound(func(i int) float64 { return stats.Layers[i].FalsePositiveRate })
+
+	return stats
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *ScalableBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *ScalableBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+// addBloomFilter adds a new layer, unless it would take the filter over its memory
+// budget, see SetMemoryBudget. It reports whether the layer was added.
+func (this *ScalableBloom) addBloomFilter() bool {
+	n := this.layerCapacity(len(this.bfs))
+
+	// Each layer tightens the error probability of the previous one, so a new r only
+	// applies from the next layer on. Once layers are evicted, it is kept, see
+	// SetEvictionPolicy.
+	e := this.e
+	if l := len(this.bfs); l > 0 {
+		e = this.bfs[l-1].Params().E
+		if this.evicted == 0 {
+			e *= this.r
+		}
+	}
+
+	// The layers grow with the slice, which is counted by MemoryUsage as well
+	bfs := this.bfs
+	if len(bfs) == cap(bfs) {
+		bfs = slices.Grow(bfs, 1)
+	}
+
+	// The layer is measured before it is built, so it is never built over the budget
+	if this.mb > 0 && len(this.bfs) > 0 {
+		size := uint64(unsafe.Sizeof(bloom.Bloom(nil)))
+		if this.MemoryUsage()+uint64(cap(bfs)-cap(this.bfs))*size+this.layerMemory(n, e) > this.mb {
+			return false
+		}
+	}
+
+	var bf bloom.Bloom
+	if this.bfc == nil {
+		bf = partitioned.NewWithOptions(n, e, partitioned.WithFillRatio(this.p))
+	} else {
+		// The layer is empty, so the setters rebuild it with the new parameters
+		bf = this.bfc(n)
+		bf.SetErrorProbability(e)
+		bf.SetFillRatio(this.p)
+	}
+	this.setLayerHasher(bf, len(this.bfs))
+
+	this.bfs = append(bfs, bf)
+	this.fc = 0
+
+	if this.og != nil {
+		this.grown = append(this.grown, grownLayer{len(this.bfs) - 1, bf.Params()})
+	}
+
+	this.spillCold()
 	//fmt.Println("Added new bloom filter")
+	return true
+}
+
+// layerMemory returns the MemoryUsage of a new layer for n items with the error
+// probability e, without building it. Layers built by the constructor set with
+// SetBloomFilter are estimated by the size of their bits.
+func (this *ScalableBloom) layerMemory(n uint, e float64) uint64 {
+	if this.bfc == nil {
+		return partitioned.EstimateMemoryWithOptions(n, e, partitioned.WithFillRatio(this.p))
+	}
+	return uint64(bloom.M(n, this.p, e)+63) / 64 * 8
+}
+
+// layerCapacity returns the number of items layer i is built for, n * s^i, or the largest
+// uint if it overflows.
+func (this *ScalableBloom) layerCapacity(i int) uint {
+	n := this.n
+	for ; i > 0 && this.s > 1; i-- {
+		if n > math.MaxUint/this.s {
+			return math.MaxUint
+		}
+		n *= this.s
+	}
+	return n
+}
+
+// WriteTo implements io.WriterTo. It is the same as Encode with nil options.
+func (this *ScalableBloom) WriteTo(w io.Writer) (int64, error) {
+	return this.Encode(w, nil)
+}
+
+// Encode implements bloom.Encoder. It writes a bloom.Header holding n, c, p, e and the
+// hasher name, with bloom.FlagScalableGrowth set, followed by r, the number of layers and
+// the growth factor, the growth policy and the SetDedupOnAdd setting, padded to 32 bytes,
+// and then each layer as a complete serialized filter with its own header. Each layer therefore keeps its own parameters,
+// including its tightened error rate, and its kind. The options are passed on to each
+// layer, so with bloom.EncodingAuto each layer picks its own encoding. Only layers that
+// implement bloom.Encoder can be written.
+func (this *ScalableBloom) Encode(w io.Writer, opts *bloom.WriteOptions) (int64, error) {
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindScalable,
+		Flags:   bloom.FlagScalableGrowth,
+		Hasher:  this.hn,
+		N:       uint64(this.n),
+		C:       this.c,
+		P:       this.p,
+		E:       this.e,
+	}
+
+	total, err := h.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+
+	var buf [32]byte
+	binary.BigEndian.PutUint64(buf[0:8], math.Float64bits(this.r))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(len(this.bfs)))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(this.s))
+	buf[24] = byte(this.g)
+	if this.dedup {
+		buf[25] = 1
+	}
+
+	n, err := w.Write(buf[:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for i, bf := range this.bfs {
+		enc, ok := bf.(bloom.Encoder)
+		if !ok {
+			return total, fmt.Errorf("scalable: cannot serialize layer %d of type %T", i, bf)
+		}
+
+		nn, err := enc.Encode(w, opts)
+		total += nn
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// ReadFrom implements io.ReaderFrom. It rebuilds all the layers written by WriteTo. New
+// layers added after loading use the constructor of the same kind as the last serialized
+// layer. If the filter was written with a hasher set by SetNamedHasher, that hasher is
+// recreated. Otherwise the current hasher is kept, or fnv.New64() is used if none is set.
+// Each layer is given its own instance of the hasher, see SetHasher.
+func (this *ScalableBloom) ReadFrom(r io.Reader) (int64, error) {
+	h := &bloom.Header{}
+	total, err := h.ReadFrom(r)
+	if err != nil {
+		return total, err
+	}
+
+	if h.Kind != bloom.KindScalable {
+		return total, fmt.Errorf("scalable: cannot read %s filter", h.Kind)
+	}
+
+	n, err := this.readBody(h, r)
+	return total + n, err
+}
+
+func (this *ScalableBloom) readBody(h *bloom.Header, r io.Reader) (int64, error) {
+	// Files written before the growth settings hold only r and the number of layers
+	buf := make([]byte, 16, 32)
+	if h.Flags&bloom.FlagScalableGrowth != 0 {
+		buf = buf[:32]
+	}
+
+	n, err := io.ReadFull(r, buf)
+	total := int64(n)
+	if err != nil {
+		return total, fmt.Errorf("scalable: reading header: %v", err)
+	}
+
+	rr := math.Float64frombits(binary.BigEndian.Uint64(buf[0:8]))
+	l := binary.BigEndian.Uint64(buf[8:16])
+
+	if l == 0 {
+		return total, fmt.Errorf("scalable: no layers found")
+	}
+
+	// New layers are sized from these, so they have to be valid before any are built
+	if !(rr > 0 && rr < 1) {
+		return total, fmt.Errorf("%w, got %v", ErrInvalidTighteningRatio, rr)
+	}
+
+	if h.N == 0 || h.N > math.MaxUint {
+		return total, fmt.Errorf("scalable: invalid capacity %d", h.N)
+	}
+
+	if err := bloom.ValidateFillRatio(h.P); err != nil {
+		return total, err
+	}
+
+	if err := bloom.ValidateErrorRate(h.E); err != nil {
+		return total, err
+	}
+
+	// Those files have layers of n items, grown on the estimated fill ratio
+	s, g, dedup := uint64(1), GrowOnEstimate, false
+	if len(buf) == 32 {
+		s, g, dedup = binary.BigEndian.Uint64(buf[16:24]), GrowthPolicy(buf[24]), buf[25] == 1
+		if s == 0 || s > math.MaxUint {
+			return total, fmt.Errorf("scalable: invalid growth factor %d", s)
+		}
+
+		if g > GrowOnActualFill {
+			return total, fmt.Errorf("%w %d", ErrInvalidGrowthPolicy, g)
+		}
+
+		if buf[25] > 1 || binary.BigEndian.Uint64(buf[24:32])&(1<<48-1) != 0 {
+			return total, fmt.Errorf("scalable: invalid growth settings %x", buf[24:32])
+		}
+	}
+
+	hf, err := bloom.ResolveHasher(h.Hasher, this.h)
+	if err != nil {
+		return total, err
+	}
+
+	// A hash function without a name is the current one, whose factory gives each layer
+	// its own
+	factory := this.hf
+	if h.Hasher != "" || factory == nil {
+		factory = func() hash.Hash { return layerHasher(hf) }
+	}
+
+	var (
+		bfs []bloom.Bloom
+		bfc = this.bfc
+	)
+
+	for i := uint64(0); i < l; i++ {
+		lh := &bloom.Header{}
+		n, err := lh.ReadFrom(r)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("scalable: header says %d layers, only %d found: %v", l, i, err)
+		}
+
+		cr := &countingReader{r: r}
+		bf, err := decodeLayer(lh, cr, factory())
+		total += cr.n
+		if err != nil {
+			return total, fmt.Errorf("scalable: reading layer %d: %v", i, err)
+		}
+
+		switch bf.(type) {
+		case *standard.StandardBloom:
+			bfc = standard.New
+		case *partitioned.PartitionedBloom:
+			bfc = nil
+		}
+
+		bfs = append(bfs, bf)
+	}
+
+	this.n, this.c, this.p, this.e, this.r = uint(h.N), h.C, h.P, h.E, rr
+
+	this.s, this.g, this.fc, this.dedup = uint(s), g, 0, dedup
+	dropSpilled(this.bfs)
+	this.bfs = bfs
+	this.bfc = bfc
+	this.h = hf
+	this.hn = h.Hasher
+	if this.hn != "" {
+		this.hf = nil
+	}
+
+	this.spillCold()
+	return total, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the WriteTo encoding.
+func (this *ScalableBloom) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := this.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using the ReadFrom encoding.
+func (this *ScalableBloom) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := this.ReadFrom(r); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("scalable: %d trailing bytes after last layer", r.Len())
+	}
+
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler. See bloom.MarshalText for the format.
+func (this *ScalableBloom) MarshalText() ([]byte, error) {
+	data, err := this.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return bloom.MarshalText(data)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It rejects text that isn't the text form
+// of a scalable filter.
+func (this *ScalableBloom) UnmarshalText(text []byte) error {
+	data, err := bloom.UnmarshalText(text, bloom.KindScalable)
+	if err != nil {
+		return err
+	}
+	return this.UnmarshalBinary(data)
+}
+
+// GobEncode implements gob.GobEncoder using the MarshalBinary encoding. Only the name of
+// a hasher set by SetNamedHasher is encoded. For a hasher set by SetHasher, call SetHasher
+// with the same hasher on the value being decoded into before decoding, as the layers are
+// given instances of the hasher already set on it. Otherwise the decoded filter falls back to
+// fnv.New64().
+func (this *ScalableBloom) GobEncode() ([]byte, error) {
+	return this.MarshalBinary()
+}
+
+// GobDecode implements gob.GobDecoder using the UnmarshalBinary encoding.
+func (this *ScalableBloom) GobDecode(data []byte) error {
+	return this.UnmarshalBinary(data)
+}
+
+// decodeLayer decodes a layer following its header lh. A layer written with a named hasher
+// recreates it. Otherwise it is given hf, which must be set before its items are read, so
+// standard and partitioned layers are read into a filter that already has it.
+func decodeLayer(lh *bloom.Header, r io.Reader, hf hash.Hash) (bloom.Bloom, error) {
+	if lh.Hasher != "" {
+		return bloom.Decode(lh, r)
+	}
+
+	var bf interface {
+		bloom.Bloom
+		io.ReaderFrom
+	}
+
+	switch lh.Kind {
+	case bloom.KindStandard:
+		bf = &standard.StandardBloom{}
+	case bloom.KindPartitioned:
+		bf = &partitioned.PartitionedBloom{}
+	default:
+		bf, err := bloom.Decode(lh, r)
+		if err != nil {
+			return nil, err
+		}
+		return bf, bf.SetHasher(hf)
+	}
+
+	bf.SetHasher(hf)
+
+	// ReadFrom reads the header again
+	var hb bytes.Buffer
+	if _, err := lh.WriteTo(&hb); err != nil {
+		return nil, err
+	}
+
+	if _, err := bf.ReadFrom(io.MultiReader(&hb, r)); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
+
+// countingReader counts the bytes read through it, so the bytes consumed by a layer
+// decoded with bloom.Decode can be added to the total returned by ReadFrom.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += int64(n)
+	return n, err
+}
+
+// ReadByte lets compressed layers be decoded without reading past their end, one byte at a
+// time from the underlying reader.
+func (this *countingReader) ReadByte() (byte, error) {
+	var (
+		b   [1]byte
+		err error
+	)
+
+	if br, ok := this.r.(io.ByteReader); ok {
+		b[0], err = br.ReadByte()
+	} else {
+		_, err = io.ReadFull(this.r, b[:])
+	}
+
+	if err == nil {
+		this.n++
+	}
+	return b[0], err
 }
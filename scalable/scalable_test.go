@@ -16,17 +16,29 @@ package scalable
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc64"
 	"hash/fnv"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/spaolacci/murmur3"
 	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/counting"
 	"github.com/zhenjl/bloom/partitioned"
 	"github.com/zhenjl/bloom/standard"
 	"github.com/zhenjl/cityhash"
@@ -111,6 +123,2368 @@ func TestBloomFilter(t *testing.T) {
 	}
 }
 
+func TestWriteToReadFrom(t *testing.T) {
+	b := []func(uint) bloom.Bloom{standard.New, partitioned.New}
+	bn := []string{"standard", "partitioned"}
+
+	for k := range b {
+		bf := New(10000)
+		bf.(*ScalableBloom).SetBloomFilter(b[k])
+		bf.Reset()
+
+		for l := range web2 {
+			bf.Add([]byte(web2[l]))
+		}
+
+		var buf bytes.Buffer
+		n, err := bf.(*ScalableBloom).WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		if n != int64(len(data)) {
+			t.Errorf("%s: WriteTo reported %d bytes, wrote %d", bn[k], n, len(data))
+		}
+
+		bf2 := &ScalableBloom{}
+		if n, err = bf2.ReadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int64(len(data)) {
+			t.Errorf("%s: ReadFrom reported %d bytes, expected %d", bn[k], n, len(data))
+		}
+
+		if bf3, err := bloom.Load(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		} else if _, ok := bf3.(*ScalableBloom); !ok {
+			t.Fatalf("Expected bloom.Load to return *ScalableBloom, got %T", bf3)
+		}
+
+		if len(bf2.bfs) != len(bf.(*ScalableBloom).bfs) {
+			t.Errorf("%s: expected %d layers, got %d", bn[k], len(bf.(*ScalableBloom).bfs), len(bf2.bfs))
+		}
+
+		if bf2.Count() != bf.Count() {
+			t.Errorf("%s: expected count %d, got %d", bn[k], bf.Count(), bf2.Count())
+		}
+
+		fn := 0
+		for l := range web2 {
+			if !bf2.Check([]byte(web2[l])) {
+				fn++
+			}
+		}
+
+		if fn != 0 {
+			t.Errorf("%s: expected 0 false negatives after ReadFrom, got %d", bn[k], fn)
+		}
+
+		for l := range web2a {
+			if bf.Check([]byte(web2a[l])) != bf2.Check([]byte(web2a[l])) {
+				t.Fatalf("%s: Check mismatch after ReadFrom for %q", bn[k], web2a[l])
+			}
+		}
+
+		// Items added after loading must still grow the filter with the same layer kind
+		bf2.Add([]byte("after load"))
+		if !bf2.Check([]byte("after load")) {
+			t.Errorf("%s: expected item added after ReadFrom to be found", bn[k])
+		}
+
+		fmt.Printf("%s: %d layers, %d items\n", bn[k], len(bf2.bfs), bf2.Count())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	b := []func(uint) bloom.Bloom{standard.New, partitioned.New}
+
+	for k := range b {
+		bf := New(10000).(*ScalableBloom)
+		bf.SetBloomFilter(b[k])
+		bf.Reset()
+
+		for l := 0; l < len(web2)/10; l++ {
+			bf.Add([]byte(web2[l]))
+		}
+
+		var buf bytes.Buffer
+		if _, err := bf.Encode(&buf, &bloom.WriteOptions{Encoding: bloom.EncodingDense, Compression: bloom.CompressionGzip}); err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		for _, r := range []io.Reader{bytes.NewReader(data), io.MultiReader(bytes.NewReader(data))} {
+			bf2 := &ScalableBloom{}
+			n, err := bf2.ReadFrom(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != int64(len(data)) {
+				t.Errorf("ReadFrom reported %d bytes, expected %d", n, len(data))
+			}
+
+			for l := range web2 {
+				if bf.Check([]byte(web2[l])) != bf2.Check([]byte(web2[l])) {
+					t.Fatalf("Check mismatch after decoding for %q", web2[l])
+				}
+			}
+		}
+	}
+}
+
+func TestGob(t *testing.T) {
+	type snapshot struct {
+		Name   string
+		Filter *ScalableBloom
+	}
+
+	bf := New(10000)
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot{"web2", bf.(*ScalableBloom)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var s snapshot
+	if err := gob.NewDecoder(&buf).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Filter.Count() != bf.Count() {
+		t.Errorf("Expected count %d, got %d", bf.Count(), s.Filter.Count())
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !s.Filter.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives after gob decoding, got %d", fn)
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	bf := New(1000).(*ScalableBloom)
+	for i := 0; i < 5000; i++ {
+		bf.Add([]byte(web2[i]))
+	}
+
+	data, err := json.Marshal(map[string]*ScalableBloom{"seen": bf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]*ScalableBloom
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5000; i++ {
+		if !m["seen"].Check([]byte(web2[i])) {
+			t.Fatalf("False negative for %q after JSON round trip", web2[i])
+		}
+	}
+
+	if err := new(ScalableBloom).UnmarshalText([]byte("bloom1:standard:fnv64:QkxNRg==")); err == nil {
+		t.Error("Expected error unmarshaling standard filter text into ScalableBloom")
+	}
+}
+
+func TestNamedHasher(t *testing.T) {
+	bf := New(10000).(*ScalableBloom)
+	if err := bf.SetNamedHasher("md5"); err != nil {
+		t.Fatal(err)
+	}
+	bf.Reset()
+
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !bf2.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives with recreated md5 hasher, got %d", fn)
+	}
+}
+
+// With SetSeed, each layer hashes with a seed of its own. The compound false positive rate
+// is compared to that of layers all using the same hash function, on enough items to add a
+// dozen layers, and the seeds are kept through serialization, so layers added after loading
+// the filter get the seed they would have had.
+func TestSeed(t *testing.T) {
+	n := uint(len(web2) / 12)
+
+	shared := New(n).(*ScalableBloom)
+	shared.SetNamedHasher(bloom.XXHashFunc)
+
+	seeded := New(n).(*ScalableBloom)
+	if err := seeded.SetSeed(42); err != nil {
+		t.Fatal(err)
+	}
+
+	var fps [2]int
+	for i, bf := range []*ScalableBloom{shared, seeded} {
+		for _, w := range web2 {
+			bf.Add([]byte(w))
+		}
+
+		for _, w := range web2a {
+			if bf.Check([]byte(w)) {
+				fps[i]++
+			}
+		}
+	}
+
+	fmt.Printf("%d layers: %d false positives with a seed per layer, %d with the same hash function\n",
+		len(seeded.bfs), fps[1], fps[0])
+
+	if float64(fps[1]) > 1.1*float64(fps[0]) {
+		t.Errorf("%d false positives with a seed per layer, more than %d with the same hash function", fps[1], fps[0])
+	}
+
+	if limit := seeded.ErrorProbability() * float64(len(web2a)); float64(fps[1]) > 2*limit {
+		t.Errorf("%d false positives, expected at most %.0f", fps[1], 2*limit)
+	}
+
+	// The layers have different seeds
+	names := make(map[string]bool)
+	for i, bf := range seeded.bfs {
+		name := bf.(bloom.Introspector).HasherName()
+		if s, ok := bloom.SeedOf(name); !ok || s != layerSeed(42, i) || names[name] {
+			t.Fatalf("Layer %d has hasher %q", i, name)
+		}
+		names[name] = true
+	}
+
+	data, err := seeded.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := bloom.Load(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf := loaded.(*ScalableBloom)
+	if seed, ok := bf.Seed(); !ok || seed != 42 {
+		t.Fatalf("Seed() = %d, %t after loading, expected 42", seed, ok)
+	}
+
+	for _, w := range web2 {
+		if !bf.Check([]byte(w)) {
+			t.Fatalf("False negative %q after loading", w)
+		}
+	}
+
+	for _, w := range web2a {
+		bf.Add([]byte(w))
+	}
+
+	for i := len(seeded.bfs); i < len(bf.bfs); i++ {
+		if seed, _ := bloom.SeedOf(bf.bfs[i].(bloom.Introspector).HasherName()); seed != layerSeed(42, i) {
+			t.Errorf("Layer %d added after loading has seed %#x, expected %#x", i, seed, layerSeed(42, i))
+		}
+	}
+}
+
+func TestAddString(t *testing.T) {
+	bf := New(uint(len(web2))).(*ScalableBloom)
+	bf2 := New(uint(len(web2))).(*ScalableBloom)
+
+	for l := range web2 {
+		if l%2 == 0 {
+			bf.AddString(web2[l])
+		} else {
+			bf.Add([]byte(web2[l]))
+		}
+		bf2.Add([]byte(web2[l]))
+	}
+
+	for l := range web2a {
+		if bf.CheckString(web2a[l]) != bf2.Check([]byte(web2a[l])) {
+			t.Fatalf("CheckString mismatch for %q", web2a[l])
+		}
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		bf.AddString(web2[0])
+		bf.CheckString(web2a[0])
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per AddString and CheckString, got %f", allocs)
+	}
+}
+
+func TestAddUint64(t *testing.T) {
+	bf := New(10000).(*ScalableBloom)
+	for v := uint64(0); v < 100000; v++ {
+		bf.AddUint64(v * 0x9e3779b97f4a7c15)
+	}
+
+	var key [8]byte
+	fn := 0
+	for v := uint64(0); v < 100000; v++ {
+		binary.BigEndian.PutUint64(key[:], v*0x9e3779b97f4a7c15)
+		if !bf.Check(key[:]) || !bf.CheckUint64(v*0x9e3779b97f4a7c15) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives, got %d", fn)
+	}
+
+	if len(bf.bfs) < 2 {
+		t.Errorf("Expected the filter to grow, got %d layers", len(bf.bfs))
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		bf.AddUint64(1)
+		bf.CheckUint64(2)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per AddUint64 and CheckUint64, got %f", allocs)
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(10000).(*ScalableBloom)
+	bf.AddAll(items[:len(items)/2])
+	bf.AddAllStrings(web2[len(web2)/2:])
+
+	bf2 := New(10000).(*ScalableBloom)
+	for _, item := range items {
+		bf2.Add(item)
+	}
+
+	if bf.Count() != bf2.Count() {
+		t.Errorf("Expected count %d, got %d", bf2.Count(), bf.Count())
+	}
+
+	// Layers are added at the same points as with Add, give or take one item.
+	if len(bf.bfs) != len(bf2.bfs) {
+		t.Fatalf("Expected %d layers, got %d", len(bf2.bfs), len(bf.bfs))
+	}
+
+	for i := range bf.bfs {
+		if c, c2 := bf.bfs[i].Count(), bf2.bfs[i].Count(); c+1 < c2 || c > c2+1 {
+			t.Errorf("Expected layer %d to hold %d items, got %d", i, c2, c)
+		}
+	}
+
+	for l := range web2 {
+		if !bf.Check([]byte(web2[l])) {
+			t.Fatalf("%q not found after AddAll", web2[l])
+		}
+	}
+}
+
+func TestCheckMany(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < len(web2); l += 2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	items := make([][]byte, 0, len(web2)+len(web2a))
+	for _, w := range append(append([]string(nil), web2...), web2a...) {
+		items = append(items, []byte(w))
+	}
+
+	out := bf.(*ScalableBloom).CheckMany(items, nil)
+	if len(out) != len(items) {
+		t.Fatalf("Expected %d results, got %d", len(items), len(out))
+	}
+
+	for i, item := range items {
+		if out[i] != bf.Check(item) {
+			t.Fatalf("CheckMany mismatch for %q", item)
+		}
+	}
+
+	buf := make([]bool, 10, 2000)
+	out = bf.(*ScalableBloom).CheckMany(items[:2000], buf)
+	if &out[0] != &buf[0] {
+		t.Errorf("Expected CheckMany to reuse the result slice")
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		bf.(*ScalableBloom).CheckMany(items[:2000], buf)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per CheckMany, got %f", allocs)
+	}
+}
+
+func TestNewWithEstimates(t *testing.T) {
+	seen := make(map[string]bool, len(web2))
+	for _, w := range web2 {
+		seen[w] = true
+	}
+
+	for _, rate := range []float64{0.01, 0.001} {
+		// Size the first layer for a fraction of the items so that the filter has to
+		// add layers, and check the compound error of all of them.
+		bf := NewWithEstimates(uint(len(web2)/8), rate)
+		for l := range web2 {
+			bf.Add([]byte(web2[l]))
+		}
+
+		fp, total := 0, 0
+		for l := range web2a {
+			if seen[web2a[l]] {
+				continue
+			}
+			total++
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		measured := float64(fp) / float64(total)
+		fmt.Printf("Requested false positive rate %.4f, measured %.4f with %d layers\n", rate, measured, len(bf.(*ScalableBloom).bfs))
+
+		if measured > rate {
+			t.Errorf("Measured false positive rate %.4f is not under the requested %.4f", measured, rate)
+		}
+	}
+}
+
+func TestNewE(t *testing.T) {
+	if _, err := NewE(0, 0.01); err != bloom.ErrInvalidCapacity {
+		t.Errorf("Expected ErrInvalidCapacity, got %v", err)
+	}
+
+	for _, e := range []float64{0, 1, -0.5, 2} {
+		if _, err := NewE(1000, e); err != bloom.ErrInvalidErrorRate {
+			t.Errorf("Expected ErrInvalidErrorRate for %v, got %v", e, err)
+		}
+	}
+
+	bf, err := NewE(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf.SetErrorProbability(0); err != bloom.ErrInvalidErrorRate {
+		t.Errorf("Expected ErrInvalidErrorRate, got %v", err)
+	}
+
+	if bf.(*ScalableBloom).e != 0.01*(1-0.9) {
+		t.Errorf("Expected an invalid error probability to be ignored, got %v", bf.(*ScalableBloom).e)
+	}
+
+	if !bf.Add([]byte("hello")).Check([]byte("hello")) {
+		t.Errorf("Expected to find hello")
+	}
+}
+
+func TestParams(t *testing.T) {
+	bf := New(1000).(*ScalableBloom)
+	want := bloom.Params{M: bf.bfs[0].Params().M, N: 1000, P: 0.5, E: 0.001}
+	if got := bf.Params(); got != want {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	}
+
+	for l := 0; l < 5000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	layers := bf.LayerParams()
+	if len(layers) < 2 {
+		t.Fatalf("Expected more than one layer, got %d", len(layers))
+	}
+
+	var m uint
+	for i, p := range layers {
+		m += p.M
+		if i > 0 && p.E >= layers[i-1].E {
+			t.Errorf("Expected layer %d to have a lower error probability than layer %d", i, i-1)
+		}
+	}
+
+	if got := bf.Params().M; got != m {
+		t.Errorf("Expected M to be the total of the layers, %d, got %d", m, got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	bf := New(1000)
+	for l := 0; l < 5000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	stats := bf.Stats()
+	if stats.Count != 5000 || stats.Params != bf.Params() || len(stats.Layers) < 2 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	var c uint
+	var n uint64
+	for _, v := range stats.Layers {
+		c += v.BitsSet
+		n += v.Count
+		if len(v.Partitions) == 0 {
+			t.Errorf("Expected the stats of each partition of the layer")
+		}
+	}
+
+	if c != stats.BitsSet || n != stats.Count {
+		t.Errorf("Expected %d bits set and %d items, got %d and %d", c, n, stats.BitsSet, stats.Count)
+	}
+
+	var buf bytes.Buffer
+	if err := bf.WriteStats(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(buf.String(), "Scalable Bloom Filter #"); n != len(stats.Layers) {
+		t.Errorf("Expected %d layers in %q", len(stats.Layers), buf.String())
+	}
+}
+
+func TestString(t *testing.T) {
+	bf := New(1000)
+	bf.Add([]byte("hello")).Add([]byte("world"))
+
+	if got := fmt.Sprint(bf); got != "scalable{n=1000 e=0.001 layers=1 count=2 fill=0.00}" {
+		t.Errorf("Unexpected summary %q", got)
+	}
+}
+
+func TestClone(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < len(web2)/2; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.(*ScalableBloom).h == bf.(*ScalableBloom).h {
+		t.Fatalf("Expected the clone to have its own hasher")
+	}
+
+	if c.Count() != bf.Count() || c.FillRatio() != bf.FillRatio() {
+		t.Fatalf("Expected the clone to match the filter, got %v and %v", c, bf)
+	}
+
+	fill := bf.FillRatio()
+	for l := len(web2) / 2; l < len(web2); l++ {
+		bf.Add([]byte(web2[l]))
+	}
+	for l := range web2a {
+		c.Add([]byte(web2a[l]))
+	}
+
+	if c.Count() != uint64(len(web2)/2+len(web2a)) || bf.Count() != uint64(len(web2)) {
+		t.Errorf("Expected the counts to change independently, got %d and %d", c.Count(), bf.Count())
+	}
+
+	if c.FillRatio() == fill {
+		t.Errorf("Expected the fill ratio of the clone to change")
+	}
+
+	ref := New(uint(len(web2)))
+	for l := range web2 {
+		ref.Add([]byte(web2[l]))
+	}
+
+	if bf.FillRatio() != ref.FillRatio() {
+		t.Errorf("Expected the filter not to be changed by the clone")
+	}
+
+	for l := range web2a {
+		if !c.Check([]byte(web2a[l])) {
+			t.Fatalf("Expected the clone to have %q", web2a[l])
+		}
+	}
+
+	bf = New(1000)
+	bf.SetHasher(struct{ hash.Hash }{fnv.New64()})
+	if _, err := bf.Clone(); err != bloom.ErrHasherNotCloneable {
+		t.Errorf("Expected ErrHasherNotCloneable, got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := New(10000).(*ScalableBloom)
+	b := New(10000).(*ScalableBloom)
+
+	half := len(web2) / 2
+	for l := 0; l < half; l++ {
+		a.Add([]byte(web2[l]))
+	}
+	for l := half; l < len(web2); l++ {
+		b.Add([]byte(web2[l]))
+	}
+
+	la, lb, e := len(a.bfs), len(b.bfs), a.ErrorProbability()
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("Merged %d and %d layers into %d, error probability %f -> %f\n", la, lb, len(a.bfs), e, a.ErrorProbability())
+
+	for l := range web2 {
+		if !a.Check([]byte(web2[l])) {
+			t.Fatalf("Expected the merged filter to have %q", web2[l])
+		}
+	}
+
+	if a.Count() != uint64(len(web2)) {
+		t.Errorf("Expected a count of %d, got %d", len(web2), a.Count())
+	}
+
+	// The full layers are appended. The newest layers may be unioned if they have room.
+	if len(a.bfs) < la+lb-1 || len(a.bfs) > la+lb || a.ErrorProbability() <= e {
+		t.Errorf("Expected the full layers to be appended, got %d layers with error probability %f", len(a.bfs), a.ErrorProbability())
+	}
+
+	// The merged layers are copies, so b doesn't see items added to a.
+	c := b.Count()
+	a.Add([]byte("merged"))
+	if b.Count() != c || b.bfs[0] == a.bfs[la] {
+		t.Errorf("Expected the layers of b not to be shared")
+	}
+}
+
+func TestMergeUnion(t *testing.T) {
+	a := New(1000).(*ScalableBloom)
+	b := New(1000).(*ScalableBloom)
+
+	for l := 0; l < 100; l++ {
+		a.Add([]byte(web2[l]))
+		b.Add([]byte(web2a[l]))
+	}
+
+	e := a.ErrorProbability()
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both first layers have the same parameters and room for 200 items, so they are
+	// unioned and the error probability doesn't change.
+	if len(a.bfs) != 1 || a.ErrorProbability() != e || a.Count() != 200 {
+		t.Errorf("Expected a single layer with 200 items, got %d layers with %d items", len(a.bfs), a.Count())
+	}
+
+	for l := 0; l < 100; l++ {
+		if !a.Check([]byte(web2[l])) || !a.Check([]byte(web2a[l])) {
+			t.Fatalf("Expected the merged filter to have %q and %q", web2[l], web2a[l])
+		}
+	}
+}
+
+func TestMergeDifferentParams(t *testing.T) {
+	a := New(1000).(*ScalableBloom)
+	b := NewWithEstimates(1000, 0.05).(*ScalableBloom)
+
+	for l := 0; l < 100; l++ {
+		a.Add([]byte(web2[l]))
+		b.Add([]byte(web2a[l]))
+	}
+
+	ea, eb := a.ErrorProbability(), b.ErrorProbability()
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// The layer of b has a different error rate, so it is appended and keeps it. The
+	// merged filter keeps e and r of a for the layers it adds.
+	if len(a.bfs) != 2 || a.Params().E != 0.001 {
+		t.Errorf("Expected 2 layers and e = 0.001, got %d layers and e = %f", len(a.bfs), a.Params().E)
+	}
+
+	if want := 1 - (1-ea)*(1-eb); math.Abs(a.ErrorProbability()-want) > 1e-12 {
+		t.Errorf("Expected an error probability of %f, got %f", want, a.ErrorProbability())
+	}
+
+	for l := 0; l < 100; l++ {
+		if !a.Check([]byte(web2[l])) || !a.Check([]byte(web2a[l])) {
+			t.Fatalf("Expected the merged filter to have %q and %q", web2[l], web2a[l])
+		}
+	}
+
+	c := New(1000).(*ScalableBloom)
+	c.SetNamedHasher("fnv64a")
+	if err := a.Merge(c); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different hasher, got %v", err)
+	}
+}
+
+func TestApproximateCardinality(t *testing.T) {
+	// Each of the 50000 distinct items is added 20 times. The duplicates count towards
+	// the fill ratio of a layer, so the filter is sized for all the adds to keep them in
+	// a single layer.
+	bf := New(2000000)
+	for r := 0; r < 20; r++ {
+		for l := 0; l < 50000; l++ {
+			bf.Add([]byte(web2[l]))
+		}
+	}
+
+	c := bf.ApproximateCardinality()
+	fmt.Printf("Added %d items, %d distinct, estimated %d\n", bf.Count(), 50000, c)
+
+	if math.Abs(float64(c)-50000)/50000 > 0.02 {
+		t.Errorf("Expected about 50000 distinct items, got %d", c)
+	}
+
+	// Distinct items spread over several layers are summed.
+	bf = New(10000)
+	for l := 0; l < 50000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	c = bf.ApproximateCardinality()
+	fmt.Printf("Added %d distinct items to %d layers, estimated %d\n", bf.Count(), len(bf.(*ScalableBloom).bfs), c)
+
+	if math.Abs(float64(c)-50000)/50000 > 0.02 {
+		t.Errorf("Expected about 50000 distinct items, got %d", c)
+	}
+}
+
+func TestCurrentFalsePositiveRate(t *testing.T) {
+	bf := New(10000).(*ScalableBloom)
+	for l := 0; l < len(web2)/2; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	r := bf.CurrentFalsePositiveRate()
+	if r != bf.Stats().FalsePositiveRate {
+		t.Errorf("Expected Stats to report %f, got %f", r, bf.Stats().FalsePositiveRate)
+	}
+
+	fp := 0
+	for l := range web2a {
+		if bf.Check([]byte(web2a[l])) {
+			fp++
+		}
+	}
+
+	measured := float64(fp) / float64(len(web2a))
+	fmt.Printf("Current false positive rate %f with %d layers, measured %f, configured %f\n", r, len(bf.bfs), measured, bf.ErrorProbability())
+
+	if r > bf.ErrorProbability() || measured > r*2 || measured < r/2 {
+		t.Errorf("Expected about %f, got %f and measured %f", bf.ErrorProbability(), r, measured)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	bf := New(10000).(*ScalableBloom)
+	for l := 0; l < 9900; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.Capacity() != 10000 || bf.Remaining() != 100 || bf.IsOverCapacity() {
+		t.Errorf("Expected 100 remaining, got %d, over capacity %t", bf.Remaining(), bf.IsOverCapacity())
+	}
+
+	for l := 9900; l < 10100; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	// The newest layer went over capacity, so a new layer was added for the last items.
+	if len(bf.bfs) != 2 || bf.IsOverCapacity() {
+		t.Fatalf("Expected a new layer, got %d layers, over capacity %t", len(bf.bfs), bf.IsOverCapacity())
+	}
+
+	// The second layer is built for twice as many items as the first
+	c := int64(bf.bfs[1].Count())
+	if bf.Capacity() != 20000 || bf.Remaining() != 20000-c || bf.TotalCapacity() != 30000 || bf.TotalRemaining() != 30000-10100 {
+		t.Errorf("Expected %d remaining of 30000, got %d and %d of %d", 20000-c, bf.Remaining(), bf.TotalRemaining(), bf.TotalCapacity())
+	}
+}
+
+// TestGrowthFactor adds 20 times more items than the first layer was built for, which adds
+// a handful of layers with the default growth factor, and about 20 with a factor of 1.
+// Check checks every layer, so its cost grows with their number.
+func TestGrowthFactor(t *testing.T) {
+	const n = 5000
+
+	grown := New(n).(*ScalableBloom)
+	flat := New(n).(*ScalableBloom)
+
+	if err := flat.SetGrowthFactor(0); err != ErrInvalidGrowthFactor {
+		t.Errorf("Expected ErrInvalidGrowthFactor, got %v", err)
+	}
+	if err := flat.SetGrowthFactor(1); err != nil {
+		t.Fatal(err)
+	}
+
+	for l := 0; l < 20*n; l++ {
+		grown.Add([]byte(web2[l]))
+		flat.Add([]byte(web2[l]))
+	}
+
+	fmt.Printf("%d items: %d layers with a growth factor of 2, %d with 1\n", 20*n, len(grown.bfs), len(flat.bfs))
+
+	// 5000 * (1 + 2 + 4 + 8 + 16) is more than 20 * 5000
+	if len(grown.bfs) > 5 || len(flat.bfs) < 19 {
+		t.Errorf("Expected at most 5 and at least 19 layers, got %d and %d", len(grown.bfs), len(flat.bfs))
+	}
+
+	for i, p := range grown.LayerParams() {
+		if p.N != n<<i {
+			t.Errorf("Expected layer %d to be built for %d items, got %d", i, n<<i, p.N)
+		}
+	}
+
+	// The growth factor is kept through serialization and cloning, so layers added later
+	// keep growing
+	var buf bytes.Buffer
+	if _, err := grown.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bf := range []*ScalableBloom{bf.(*ScalableBloom), c.(*ScalableBloom)} {
+		if bf.GrowthFactor() != 2 {
+			t.Errorf("Expected a growth factor of 2, got %d", bf.GrowthFactor())
+		}
+
+		bf.addBloomFilter()
+		l := len(bf.bfs) - 1
+		if p := bf.bfs[l].Params(); p.N != n<<l {
+			t.Errorf("Expected layer %d to be built for %d items, got %d", l, n<<l, p.N)
+		}
+	}
+
+	for l := 0; l < 20*n; l++ {
+		if !grown.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q", web2[l])
+		}
+	}
+}
+
+// TestTighteningRatio adds enough items to fill 30 layers of the same size, and checks that
+// a smaller r keeps the compound error probability, and the measured false positive rate,
+// lower. Changing r only applies to the layers added afterwards.
+func TestTighteningRatio(t *testing.T) {
+	const n = 2000
+
+	var (
+		bfs = make([]*ScalableBloom, 2)
+		fps = make([]int, 2)
+	)
+
+	for i, r := range []float64{0.9, 0.5} {
+		bf := New(n).(*ScalableBloom)
+		if err := bf.SetTighteningRatio(r); err != nil {
+			t.Fatal(err)
+		}
+		bf.SetGrowthFactor(1)
+
+		for l := 0; l < 30*n; l++ {
+			bf.Add([]byte(web2[l]))
+		}
+
+		for _, w := range web2a {
+			if bf.Check([]byte(w)) {
+				fps[i]++
+			}
+		}
+
+		params := bf.LayerParams()
+		for l := 1; l < len(params); l++ {
+			if e := params[l-1].E * r; math.Abs(params[l].E-e) > e*1e-9 {
+				t.Errorf("r = %.1f: Expected e = %g for layer %d, got %g", r, e, l, params[l].E)
+			}
+		}
+
+		bfs[i] = bf
+	}
+
+	a, b := bfs[0], bfs[1]
+	fmt.Printf("%d and %d layers: error probability %f and %f, %d and %d false positives\n",
+		len(a.bfs), len(b.bfs), a.ErrorProbability(), b.ErrorProbability(), fps[0], fps[1])
+
+	if b.ErrorProbability() >= a.ErrorProbability() || b.ErrorProbability() > b.e/(1-0.5) || fps[1] >= fps[0] {
+		t.Errorf("Expected r = 0.5 to give a lower error probability and fewer false positives")
+	}
+
+	for _, r := range []float64{0, 1, -0.5, math.NaN()} {
+		if err := a.SetTighteningRatio(r); err != ErrInvalidTighteningRatio {
+			t.Errorf("r = %f: Expected ErrInvalidTighteningRatio, got %v", r, err)
+		}
+	}
+
+	// The existing layers keep their error probability, and the next one tightens the newest
+	before := a.LayerParams()
+	if err := a.SetTighteningRatio(0.5); err != nil {
+		t.Fatal(err)
+	}
+	a.addBloomFilter()
+
+	after := a.LayerParams()
+	for l := range before {
+		if after[l] != before[l] {
+			t.Errorf("Expected layer %d to be unchanged, got %+v", l, after[l])
+		}
+	}
+
+	if l := len(before); after[l].E != before[l-1].E*0.5 {
+		t.Errorf("Expected e = %g for the new layer, got %g", before[l-1].E*0.5, after[l].E)
+	}
+
+	// r is kept through serialization and cloning, and reported by Stats
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := b.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bf := range []bloom.Bloom{bf, c} {
+		if r := bf.(*ScalableBloom).TighteningRatio(); r != 0.5 {
+			t.Errorf("Expected r = 0.5, got %f", r)
+		}
+		if r := bf.Stats().TighteningRatio; r != 0.5 {
+			t.Errorf("Expected r = 0.5 in the stats, got %f", r)
+		}
+	}
+
+	buf.Reset()
+	b.WriteStats(&buf)
+	if e := fmt.Sprintf("#%d, e = %g\n", len(b.bfs)-1, b.bfs[len(b.bfs)-1].Params().E); !strings.Contains(buf.String(), e) {
+		t.Errorf("Expected %q in the stats", e)
+	}
+}
+
+func TestLayerStats(t *testing.T) {
+	const n = 1000
+
+	bf := New(n).(*ScalableBloom)
+	for l := 0; l < 10*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	// 1000 * (1 + 2 + 4) is less than 10 * 1000, and 1000 * (1 + 2 + 4 + 8) more
+	if bf.NumLayers() != 4 {
+		t.Fatalf("Expected 4 layers, got %d", bf.NumLayers())
+	}
+
+	var (
+		c uint64
+		e = float64(1)
+	)
+
+	for i := 0; i < bf.NumLayers(); i++ {
+		ls := bf.LayerStats(i)
+		if ls.Params != bf.bfs[i].Params() || ls.N != n<<i || ls.Count != bf.bfs[i].Count() {
+			t.Errorf("Layer %d: unexpected stats %+v", i, ls)
+		}
+
+		if i > 0 && ls.E != bf.LayerStats(i-1).E*bf.TighteningRatio() {
+			t.Errorf("Layer %d: expected e = %g, got %g", i, bf.LayerStats(i-1).E*bf.TighteningRatio(), ls.E)
+		}
+
+		// New layers are added once the estimated fill ratio goes above p, which the actual
+		// one may exceed slightly
+		if ls.FillRatio <= 0 || ls.FillRatio > bf.p+0.05 || ls.FalsePositiveRate <= 0 || ls.FalsePositiveRate > ls.E*2 {
+			t.Errorf("Layer %d: fill ratio %f and false positive rate %g out of range", i, ls.FillRatio, ls.FalsePositiveRate)
+		}
+
+		c += ls.Count
+		e *= 1 - ls.E
+	}
+
+	if c != bf.Count() {
+		t.Errorf("Expected the layers to hold %d items, got %d", bf.Count(), c)
+	}
+
+	if r := bf.ErrorProbability(); math.Abs(r-(1-e)) > 1e-12 {
+		t.Errorf("Expected a compound error probability of %g, got %g", 1-e, r)
+	}
+}
+
+func TestCompoundErrorRate(t *testing.T) {
+	bf := NewWithEstimates(1000, 0.01).(*ScalableBloom)
+	for l := 0; l < 1500; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.NumLayers() != 2 {
+		t.Fatalf("Expected 2 layers, got %d", bf.NumLayers())
+	}
+
+	// 1 - (1 - f0^k0) * (1 - f1^k1)
+	l0, l1 := bf.LayerStats(0), bf.LayerStats(1)
+	p0 := math.Pow(l0.FillRatio, float64(l0.K))
+	p1 := math.Pow(l1.FillRatio, float64(l1.K))
+	want := 1 - (1-p0)*(1-p1)
+
+	if r := bf.CompoundErrorRate(); math.Abs(r-want) > 1e-12 {
+		t.Errorf("Expected a compound error rate of %g, got %g", want, r)
+	}
+
+	// e is 0.01 * (1 - 0.9), and the bound e / (1 - 0.9)
+	if b := bf.DesignErrorBound(); math.Abs(b-0.01) > 1e-12 {
+		t.Errorf("Expected a design error bound of 0.01, got %g", b)
+	}
+
+	if bf.CompoundErrorRate() >= bf.DesignErrorBound() {
+		t.Errorf("Expected a compound error rate below the bound, got %g", bf.CompoundErrorRate())
+	}
+
+	stats := bf.Stats()
+	if stats.CompoundErrorRate != bf.CompoundErrorRate() || stats.DesignErrorBound != bf.DesignErrorBound() {
+		t.Errorf("Expected the stats to hold %g and %g, got %g and %g", bf.CompoundErrorRate(),
+			bf.DesignErrorBound(), stats.CompoundErrorRate, stats.DesignErrorBound)
+	}
+
+	var buf bytes.Buffer
+	stats.WriteTo(&buf)
+	if !strings.Contains(buf.String(), fmt.Sprintf("Compound error rate: %g, design bound: %g", stats.CompoundErrorRate, stats.DesignErrorBound)) {
+		t.Errorf("Expected the stats to print the error rates, got %q", buf.String())
+	}
+
+	// A filter that can't grow goes past its bound
+	bf = NewWithEstimates(1000, 0.01).(*ScalableBloom)
+	bf.SetMaxLayers(1)
+	for l := 0; l < 5000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.CompoundErrorRate() <= bf.DesignErrorBound() {
+		t.Errorf("Expected a compound error rate above the bound, got %g", bf.CompoundErrorRate())
+	}
+}
+
+// TestGrowthPolicy adds the same 500 items over and over to filters built for 1000, which
+// only fills the first layer halfway, but adds layers when growth is decided by the count
+// of items added.
+func TestGrowthPolicy(t *testing.T) {
+	const n = 1000
+
+	policies := []GrowthPolicy{GrowOnEstimate, GrowOnCount, GrowOnActualFill}
+
+	for _, g := range policies {
+		bf := New(n).(*ScalableBloom)
+		if err := bf.SetGrowthPolicy(g); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 40; i++ {
+			for l := 0; l < n/2; l++ {
+				bf.Add([]byte(web2[l]))
+			}
+		}
+
+		fmt.Printf("%s: %d layers for %d duplicates of %d items\n", g, bf.NumLayers(), bf.Count(), n/2)
+
+		if g == GrowOnActualFill && bf.NumLayers() != 1 {
+			t.Errorf("%s: expected a single layer, got %d", g, bf.NumLayers())
+		} else if g != GrowOnActualFill && bf.NumLayers() < 4 {
+			t.Errorf("%s: expected spurious layers, got %d", g, bf.NumLayers())
+		}
+
+		if s := bf.Stats(); s.GrowthPolicy != g.String() {
+			t.Errorf("Expected growth policy %q in the stats, got %q", g, s.GrowthPolicy)
+		}
+	}
+
+	// With distinct items, Add and AddAll add the same layers, and the full layers hold as
+	// many items as they were built for with GrowOnCount, or have about p of their bits
+	// set with GrowOnActualFill
+	items := make([][]byte, 10*n)
+	for l := range items {
+		items[l] = []byte(web2[l])
+	}
+
+	for _, g := range policies {
+		a := New(n).(*ScalableBloom)
+		b := New(n).(*ScalableBloom)
+		a.SetGrowthPolicy(g)
+		b.SetGrowthPolicy(g)
+
+		for _, item := range items {
+			a.Add(item)
+		}
+		b.AddAll(items)
+
+		if a.NumLayers() != b.NumLayers() || a.NumLayers() != 4 {
+			t.Errorf("%s: expected 4 layers with Add and AddAll, got %d and %d", g, a.NumLayers(), b.NumLayers())
+			continue
+		}
+
+		for i := 0; i < a.NumLayers()-1; i++ {
+			la, lb := a.LayerStats(i), b.LayerStats(i)
+			if d := int64(la.Count) - int64(lb.Count); d < -1 || d > 1 {
+				t.Errorf("%s: layer %d holds %d items with Add and %d with AddAll", g, i, la.Count, lb.Count)
+			}
+
+			switch g {
+			case GrowOnCount:
+				if la.Count != uint64(la.N) {
+					t.Errorf("%s: expected %d items in layer %d, got %d", g, la.N, i, la.Count)
+				}
+			case GrowOnActualFill:
+				if la.FillRatio <= a.p || la.FillRatio > a.p+0.01 {
+					t.Errorf("%s: expected a fill ratio just above %f for layer %d, got %f", g, a.p, i, la.FillRatio)
+				}
+			}
+		}
+
+		for _, item := range items {
+			if !a.Check(item) || !b.Check(item) {
+				t.Fatalf("%s: expected to find %q", g, item)
+			}
+		}
+	}
+
+	bf := New(n).(*ScalableBloom)
+	if err := bf.SetGrowthPolicy(GrowOnActualFill + 1); err != ErrInvalidGrowthPolicy {
+		t.Errorf("Expected ErrInvalidGrowthPolicy, got %v", err)
+	}
+
+	// The policy is kept through serialization and cloning
+	bf.SetGrowthPolicy(GrowOnActualFill)
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bf := range []bloom.Bloom{bf2, c} {
+		if g := bf.(*ScalableBloom).GrowthPolicy(); g != GrowOnActualFill {
+			t.Errorf("Expected %s, got %s", GrowOnActualFill, g)
+		}
+	}
+
+	// The settings are written in the body, as K and S of the header are the hash count and
+	// the partition size to its other readers
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &bloom.Header{}
+	hl, err := h.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.K != 0 || h.S != 0 || h.Flags&bloom.FlagScalableGrowth == 0 {
+		t.Errorf("Expected the growth settings out of the header, got %+v", h)
+	}
+
+	bad := bytes.Clone(data)
+	bad[hl+24] = byte(GrowOnActualFill + 1)
+	if _, err := bloom.Load(bytes.NewReader(bad)); !errors.Is(err, ErrInvalidGrowthPolicy) {
+		t.Errorf("Expected ErrInvalidGrowthPolicy, got %v", err)
+	}
+
+	// Files written before the settings were recorded have layers of n items, grown on the
+	// estimated fill ratio
+	h.Flags &^= bloom.FlagScalableGrowth
+
+	var old bytes.Buffer
+	h.WriteTo(&old)
+	old.Write(data[hl : hl+16])
+	old.Write(data[hl+32:])
+
+	bf3, err := bloom.Load(&old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb := bf3.(*ScalableBloom); sb.GrowthPolicy() != GrowOnEstimate || sb.GrowthFactor() != 1 {
+		t.Errorf("Expected %s and a growth factor of 1, got %s and %d", GrowOnEstimate, sb.GrowthPolicy(), sb.GrowthFactor())
+	}
+}
+
+// TestReadBadSettings checks that a filter whose serialized r, n, p or e is out of range is
+// rejected, as the layers added later are sized from them.
+func TestReadBadSettings(t *testing.T) {
+	bf := New(1000).(*ScalableBloom)
+	bf.Add([]byte("a"))
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &bloom.Header{}
+	hl, err := h.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		edit func(h *bloom.Header, body []byte)
+		want error
+	}{
+		{"r NaN", func(h *bloom.Header, body []byte) {
+			binary.BigEndian.PutUint64(body, math.Float64bits(math.NaN()))
+		}, ErrInvalidTighteningRatio},
+		{"r 0", func(h *bloom.Header, body []byte) { binary.BigEndian.PutUint64(body, 0) }, ErrInvalidTighteningRatio},
+		{"r 1", func(h *bloom.Header, body []byte) {
+			binary.BigEndian.PutUint64(body, math.Float64bits(1))
+		}, ErrInvalidTighteningRatio},
+		{"n 0", func(h *bloom.Header, body []byte) { h.N = 0 }, nil},
+		{"p 0", func(h *bloom.Header, body []byte) { h.P = 0 }, bloom.ErrInvalidFillRatio},
+		{"p NaN", func(h *bloom.Header, body []byte) { h.P = math.NaN() }, bloom.ErrInvalidFillRatio},
+		{"e 1", func(h *bloom.Header, body []byte) { h.E = 1 }, bloom.ErrInvalidErrorRate},
+		{"e -1", func(h *bloom.Header, body []byte) { h.E = -1 }, bloom.ErrInvalidErrorRate},
+	}
+
+	for _, tt := range tests {
+		bh := *h
+		body := bytes.Clone(data[hl:])
+		tt.edit(&bh, body)
+
+		var buf bytes.Buffer
+		bh.WriteTo(&buf)
+		buf.Write(body)
+
+		_, err := bloom.Load(&buf)
+		if err == nil || tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: Expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+// TestDedupOnAdd adds the same 500 items over and over, which adds layers as if they were
+// distinct unless the items already found are skipped.
+func TestDedupOnAdd(t *testing.T) {
+	const n = 1000
+
+	items := make([][]byte, n/2)
+	for l := range items {
+		items[l] = []byte(web2[l])
+	}
+
+	for _, dedup := range []bool{false, true} {
+		a := New(n).(*ScalableBloom)
+		b := New(n).(*ScalableBloom)
+		a.SetDedupOnAdd(dedup)
+		b.SetDedupOnAdd(dedup)
+
+		for i := 0; i < 40; i++ {
+			for _, item := range items {
+				a.Add(item)
+			}
+			b.AddAll(items)
+		}
+
+		fmt.Printf("dedup %t: %d layers and a count of %d for %d duplicates of %d items\n",
+			dedup, a.NumLayers(), a.Count(), 40*len(items), len(items))
+
+		for _, bf := range []*ScalableBloom{a, b} {
+			switch {
+			case dedup && (bf.NumLayers() != 1 || bf.Count() > uint64(len(items)) || bf.Count() < uint64(len(items))-5):
+				t.Errorf("Expected a single layer and a count of about %d, got %d and %d", len(items), bf.NumLayers(), bf.Count())
+			case !dedup && (bf.NumLayers() < 4 || bf.Count() != 40*uint64(len(items))):
+				t.Errorf("Expected spurious layers and a count of %d, got %d and %d", 40*len(items), bf.NumLayers(), bf.Count())
+			}
+		}
+	}
+
+	// The items of the older layers aren't added again to the newer ones
+	bf := New(n).(*ScalableBloom)
+	bf.SetDedupOnAdd(true)
+	for l := 0; l < 2*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	before := bf.LayerStats(bf.NumLayers() - 1)
+	for l := 0; l < 2*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if after := bf.LayerStats(bf.NumLayers() - 1); after != before {
+		t.Errorf("Expected the newest layer to be unchanged, got %+v, expected %+v", after, before)
+	}
+
+	// The setting is kept through serialization and cloning
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bf := range []bloom.Bloom{bf2, c} {
+		if !bf.(*ScalableBloom).DedupOnAdd() || bf.(*ScalableBloom).GrowthPolicy() != GrowOnEstimate {
+			t.Errorf("Expected dedup with %s", GrowOnEstimate)
+		}
+	}
+}
+
+func TestMaxLayers(t *testing.T) {
+	const n = 1000
+
+	var (
+		bf    = New(n).(*ScalableBloom)
+		calls int
+	)
+
+	if err := bf.SetMaxLayers(-1); err != ErrInvalidMaxLayers {
+		t.Errorf("Expected ErrInvalidMaxLayers, got %v", err)
+	}
+	if err := bf.SetMaxLayers(3); err != nil {
+		t.Fatal(err)
+	}
+
+	// The function is called with the filter unlocked, so it can look at it
+	bf.SetOnCapacityExhausted(func() {
+		calls++
+		if !bf.Stats().CapacityExhausted {
+			t.Errorf("Expected the filter to be exhausted")
+		}
+	})
+
+	for l := 0; l < 20*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.NumLayers() != 3 || calls != 1 || bf.Count() != 20*n || !bf.Stats().CapacityExhausted {
+		t.Fatalf("Expected 3 layers, 1 call and %d items, got %d, %d and %d", 20*n, bf.NumLayers(), calls, bf.Count())
+	}
+
+	for l := 0; l < 20*n; l++ {
+		if !bf.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q", web2[l])
+		}
+	}
+
+	var buf bytes.Buffer
+	bf.WriteStats(&buf)
+	if !strings.Contains(buf.String(), "Capacity exhausted at 3 layers") {
+		t.Errorf("Expected the exhaustion in the stats, got %q", buf.String())
+	}
+
+	// TryAdd rejects the items once the filter is exhausted, and AddAll adds them to the
+	// newest layer like Add
+	bf.Clear()
+	if bf.Stats().CapacityExhausted {
+		t.Fatalf("Expected Clear to reset the exhaustion")
+	}
+
+	added := 0
+	for l := 0; l < 20*n; l++ {
+		err := bf.TryAdd([]byte(web2[l]))
+		if err == nil {
+			added++
+		} else if err != ErrCapacityExhausted {
+			t.Fatal(err)
+		}
+	}
+
+	if bf.NumLayers() != 3 || calls != 2 || bf.Count() != uint64(added) || added >= 8*n || added < 6*n {
+		t.Fatalf("Expected 3 layers, 2 calls and about %d items, got %d, %d and %d", 7*n, bf.NumLayers(), calls, bf.Count())
+	}
+
+	items := make([][]byte, n)
+	for l := range items {
+		items[l] = []byte(web2[20*n+l])
+	}
+
+	bf.AddAll(items)
+	if bf.NumLayers() != 3 || calls != 2 || bf.Count() != uint64(added+n) {
+		t.Errorf("Expected 3 layers, 2 calls and %d items, got %d, %d and %d", added+n, bf.NumLayers(), calls, bf.Count())
+	}
+
+	// Raising the maximum lets the filter grow again
+	bf.SetMaxLayers(4)
+	if err := bf.TryAdd([]byte(web2a[0])); err != nil || bf.NumLayers() != 4 || bf.Stats().CapacityExhausted {
+		t.Errorf("Expected a new layer, got %v and %d layers", err, bf.NumLayers())
+	}
+
+	bf = New(n).(*ScalableBloom)
+	bf.SetMaxLayers(2)
+	bf.SetOnCapacityExhausted(func() { calls++ })
+
+	// The items are counted again each time, so the first layer is full after one batch
+	for i := 0; i < 10; i++ {
+		bf.AddAll(items)
+	}
+
+	if bf.NumLayers() != 2 || calls != 3 {
+		t.Errorf("Expected 2 layers and 3 calls, got %d and %d", bf.NumLayers(), calls)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	const n = 1000
+
+	// Room for two layers, and not for a third one
+	ref := NewWithEstimates(n, 0.01).(*ScalableBloom)
+	for l := 0; ref.NumLayers() < 2; l++ {
+		ref.Add([]byte(web2[l]))
+	}
+	budget := ref.MemoryUsage() + 64
+
+	var (
+		bf            = NewWithOptions(n, 0.01, WithMemoryBudget(budget)).(*ScalableBloom)
+		calls, others int
+	)
+
+	bf.SetOnBudgetExhausted(func() {
+		calls++
+		if !bf.Stats().BudgetExhausted {
+			t.Errorf("Expected the budget to be exhausted")
+		}
+	})
+	bf.SetOnCapacityExhausted(func() { others++ })
+
+	for l := 0; l < 2*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+	before := bf.CurrentFalsePositiveRate()
+
+	for l := 2 * n; l < 20*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.NumLayers() != 2 || calls != 1 || others != 0 || bf.Count() != 20*n {
+		t.Fatalf("Expected 2 layers, 1 call and %d items, got %d, %d, %d and %d", 20*n, bf.NumLayers(), calls, others, bf.Count())
+	}
+
+	if bf.MemoryUsage() > budget {
+		t.Errorf("Expected at most %d bytes, got %d", budget, bf.MemoryUsage())
+	}
+
+	if after := bf.CurrentFalsePositiveRate(); after <= before || bf.CompoundErrorRate() <= bf.DesignErrorBound() {
+		t.Errorf("Expected the false positive rate to climb past %g, got %g then %g", bf.DesignErrorBound(), before, after)
+	}
+
+	stats := bf.Stats()
+	if !stats.BudgetExhausted || !stats.CapacityExhausted || stats.MemoryBudget != budget {
+		t.Errorf("Expected the exhausted budget in the stats, got %+v", stats)
+	}
+
+	var buf bytes.Buffer
+	stats.WriteTo(&buf)
+	if !strings.Contains(buf.String(), fmt.Sprintf("Memory budget of %d bytes exhausted at 2 layers", budget)) {
+		t.Errorf("Expected the exhausted budget in the stats, got %q", buf.String())
+	}
+
+	if err := bf.TryAdd([]byte("another")); err != ErrCapacityExhausted {
+		t.Errorf("Expected ErrCapacityExhausted, got %v", err)
+	}
+
+	for l := 0; l < 20*n; l++ {
+		if !bf.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q", web2[l])
+		}
+	}
+
+	// A larger budget lets the filter grow again
+	bf.SetMemoryBudget(0)
+	bf.Add([]byte("another"))
+	if bf.NumLayers() != 3 || bf.Stats().BudgetExhausted || calls != 1 {
+		t.Errorf("Expected the filter to grow, got %d layers", bf.NumLayers())
+	}
+
+	// The layer rejected before was measured exactly, without building it
+	if got, want := bf.bfs[2].MemoryUsage(), bf.layerMemory(bf.layerCapacity(2), bf.bfs[2].Params().E); got != want {
+		t.Errorf("Expected the new layer to take the %d bytes measured, got %d", want, got)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	const n = 1000
+
+	bf := NewWithOptions(n, 0.01, WithEviction(EvictOldest)).(*ScalableBloom)
+	if err := bf.SetEvictionPolicy(EvictOldest + 1); err != ErrInvalidEvictionPolicy {
+		t.Errorf("Expected ErrInvalidEvictionPolicy, got %v", err)
+	}
+	if err := bf.SetMaxLayers(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf.EvictionPolicy() != EvictOldest || EvictOldest.String() != "oldest" || NoEviction.String() != "none" {
+		t.Errorf("Expected the eviction policy to be set, got %s", bf.EvictionPolicy())
+	}
+
+	var mem uint64
+	for l := 0; l < 50*n; l++ {
+		bf.Add([]byte(web2[l]))
+
+		if bf.NumLayers() > 3 {
+			t.Fatalf("Expected at most 3 layers, got %d", bf.NumLayers())
+		}
+
+		if l%(n/2) != 0 || l < n {
+			continue
+		}
+
+		// The recent items are always found
+		for r := l - n; r <= l; r++ {
+			if !bf.Check([]byte(web2[r])) {
+				t.Fatalf("Expected to find %q after adding %d items", web2[r], l+1)
+			}
+		}
+
+		// Once the 3 layers have the same size
+		if bf.Stats().EvictedLayers >= 3 && mem == 0 {
+			mem = bf.MemoryUsage()
+		}
+	}
+
+	// The layers stop growing once the first ones are evicted
+	if mem == 0 || bf.MemoryUsage() > mem*11/10 {
+		t.Errorf("Expected the memory to stay about %d bytes, got %d", mem, bf.MemoryUsage())
+	}
+
+	// The items only in the evicted layers are forgotten
+	missed := 0
+	for l := 0; l < n; l++ {
+		if !bf.Check([]byte(web2[l])) {
+			missed++
+		}
+	}
+	if missed < n*9/10 {
+		t.Errorf("Expected most of the first %d items to be forgotten, %d were", n, missed)
+	}
+
+	stats := bf.Stats()
+	if stats.EvictedLayers == 0 || stats.CapacityExhausted {
+		t.Errorf("Expected layers to be evicted, got %+v", stats)
+	}
+
+	if held := float64(stats.ForgottenItems + bf.Count()); math.Abs(held-50*n) > 50*n/10 {
+		t.Errorf("Expected about %d items forgotten or held, got %d and %d", 50*n, stats.ForgottenItems, bf.Count())
+	}
+
+	var buf bytes.Buffer
+	stats.WriteTo(&buf)
+	if !strings.Contains(buf.String(), fmt.Sprintf("Evicted layers: %d", stats.EvictedLayers)) {
+		t.Errorf("Expected the evicted layers in the stats, got %q", buf.String())
+	}
+
+	bf.Clear()
+	if s := bf.Stats(); s.EvictedLayers != 0 || s.ForgottenItems != 0 {
+		t.Errorf("Expected Clear to reset the evicted layers, got %d", s.EvictedLayers)
+	}
+}
+
+// TestForecast adds items at a simulated constant rate of 1000 per second, and checks the
+// forecast against the actual growth.
+func TestForecast(t *testing.T) {
+	const n = 1000
+
+	for _, g := range []GrowthPolicy{GrowOnEstimate, GrowOnCount} {
+		bf := New(n).(*ScalableBloom)
+		bf.SetGrowthPolicy(g)
+		bf.SetAddRateWindow(16)
+
+		now := time.Unix(0, 0)
+		bf.rt.now = func() time.Time { return now }
+
+		l := 0
+		add := func() {
+			bf.Add([]byte(web2[l]))
+			l++
+			now = now.Add(time.Millisecond)
+		}
+
+		for l < 300 {
+			add()
+		}
+
+		f := bf.Forecast()
+		if !f.Grows || math.Abs(f.Rate-1000) > 1e-6 {
+			t.Fatalf("%s: expected a rate of 1000, got %+v", g, f)
+		}
+
+		if want := time.Duration(f.Adds) * time.Millisecond; f.Until-want > time.Microsecond || want-f.Until > time.Microsecond {
+			t.Errorf("%s: expected the layer in %s, got %s", g, want, f.Until)
+		}
+
+		if g == GrowOnCount && f.Adds != n-300 {
+			t.Errorf("%s: expected %d adds, got %d", g, n-300, f.Adds)
+		}
+
+		stats := bf.Stats()
+		if stats.NextLayerAdds != f.Adds || stats.NextLayerIn != f.Until || stats.NextLayerBytes != f.LayerBytes {
+			t.Errorf("%s: expected the forecast in the stats, got %+v", g, stats)
+		}
+
+		// The Add after the forecast ones adds the layer
+		for i := uint64(0); i < f.Adds; i++ {
+			add()
+		}
+		if bf.NumLayers() != 1 {
+			t.Fatalf("%s: expected no new layer after %d adds", g, f.Adds)
+		}
+
+		add()
+		if bf.NumLayers() != 2 {
+			t.Fatalf("%s: expected a new layer after %d adds", g, f.Adds+1)
+		}
+
+		if ls := bf.LayerStats(1); ls.Params != f.Layer {
+			t.Errorf("%s: expected a layer with %+v, got %+v", g, f.Layer, ls.Params)
+		}
+
+		if m := bf.bfs[1].MemoryUsage(); f.LayerBytes != uint64(f.Layer.M+7)/8 || f.LayerBytes > m {
+			t.Errorf("%s: expected %d bytes, below %d, got %d", g, (f.Layer.M+7)/8, m, f.LayerBytes)
+		}
+	}
+
+	// Without measuring the rate
+	bf := New(n).(*ScalableBloom)
+	bf.SetAddRateHint(500)
+	if f := bf.Forecast(); f.Rate != 500 || f.Until != time.Duration(f.Adds)*2*time.Millisecond {
+		t.Errorf("Expected the rate hint to be used, got %+v", f)
+	}
+
+	bf.SetMaxLayers(1)
+	if f := bf.Forecast(); f.Grows || bf.Stats().NextLayerBytes != 0 {
+		t.Errorf("Expected no growth at the maximum number of layers, got %+v", f)
+	}
+}
+
+// TestTinyLayers checks that tiny layers grow, by Add and AddAll, once their estimated fill
+// ratio exceeds p, as forecast.
+func TestTinyLayers(t *testing.T) {
+	for _, n := range []uint{10, 100} {
+		bf, all := New(n).(*ScalableBloom), New(n).(*ScalableBloom)
+
+		f := bf.Forecast()
+		items := make([][]byte, f.Adds+1)
+		for l := range items {
+			items[l] = []byte(web2[l])
+		}
+
+		for _, item := range items[:f.Adds] {
+			bf.Add(item)
+		}
+		if layer := bf.bfs[0]; bf.NumLayers() != 1 || layer.EstimatedFillRatio() <= bf.p {
+			t.Fatalf("n = %d: expected the layer to be full after %d items, got %d layers and %f", n, f.Adds, bf.NumLayers(), layer.EstimatedFillRatio())
+		}
+
+		// One item less doesn't fill it
+		if s := float64(bf.LayerStats(0).Params.S); 1-math.Pow(1-1/s, float64(f.Adds-1)) > bf.p {
+			t.Errorf("n = %d: expected the layer not to be full after %d items", n, f.Adds-1)
+		}
+
+		bf.Add(items[f.Adds])
+		all.AddAll(items)
+		if bf.NumLayers() != 2 || all.NumLayers() != 2 || all.bfs[0].Count() != f.Adds {
+			t.Errorf("n = %d: expected a second layer after %d items, got %d and %d", n, f.Adds, bf.NumLayers(), all.NumLayers())
+		}
+	}
+}
+
+func TestOnGrow(t *testing.T) {
+	const n = 1000
+
+	type grown struct {
+		i int
+		p bloom.Params
+	}
+
+	var (
+		bf  = New(n).(*ScalableBloom)
+		got []grown
+	)
+
+	// The function is called with the filter unlocked, so it can look at it
+	bf.SetOnGrow(func(i int, p bloom.Params) {
+		got = append(got, grown{i, p})
+		if bf.NumLayers() != i+1 {
+			t.Errorf("Expected layer %d to be the newest, got %d layers", i, bf.NumLayers())
+		}
+	})
+
+	if len(got) != 1 || got[0] != (grown{0, bf.bfs[0].Params()}) {
+		t.Fatalf("Expected the first layer to be reported, got %+v", got)
+	}
+
+	for l := 0; l < 5*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+	items := make([][]byte, 0, 5*n)
+	for l := 5 * n; l < 10*n; l++ {
+		items = append(items, []byte(web2[l]))
+	}
+	bf.AddAll(items)
+
+	if bf.NumLayers() != 4 || len(got) != 4 {
+		t.Fatalf("Expected 4 layers reported, got %d layers and %+v", bf.NumLayers(), got)
+	}
+
+	for i := range got {
+		if want := (grown{i, bf.bfs[i].Params()}); got[i] != want {
+			t.Errorf("Expected %+v, got %+v", want, got[i])
+		}
+		if got[i].p.N != n<<i {
+			t.Errorf("Expected layer %d to be built for %d items, got %d", i, n<<i, got[i].p.N)
+		}
+	}
+
+	got = nil
+	bf.Reset()
+	if len(got) != 1 || got[0] != (grown{0, bf.bfs[0].Params()}) {
+		t.Errorf("Expected the first layer to be reported after Reset, got %+v", got)
+	}
+}
+
+// TestWeightedFillRatio builds a small first layer, which fills up, and a second one 64
+// times larger, which holds as many items, so the average of their fill ratios is about
+// half of p, while few of all the bits are set.
+func TestWeightedFillRatio(t *testing.T) {
+	bf := New(100).(*ScalableBloom)
+	bf.SetGrowthFactor(64)
+	for l := 0; l < 200; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.NumLayers() != 2 {
+		t.Fatalf("Expected 2 layers, got %d", bf.NumLayers())
+	}
+
+	stats := bf.Stats()
+	l0, l1 := stats.Layers[0], stats.Layers[1]
+
+	m0, m1 := float64(l0.Params.M), float64(l1.Params.M)
+	expected := (l0.FillRatio*m0 + l1.FillRatio*m1) / (m0 + m1)
+	average := (l0.FillRatio + l1.FillRatio) / 2
+
+	fmt.Printf("Layers of %d and %d bits: fill ratios %f and %f, weighted %f, average %f\n",
+		l0.Params.M, l1.Params.M, l0.FillRatio, l1.FillRatio, expected, average)
+
+	if math.Abs(bf.FillRatio()-expected) > 1e-12 || math.Abs(stats.FillRatio-expected) > 1e-12 {
+		t.Errorf("Expected a fill ratio of %f, got %f and %f in the stats", expected, bf.FillRatio(), stats.FillRatio)
+	}
+
+	if stats.BitsSet != l0.BitsSet+l1.BitsSet || stats.Params.M != l0.Params.M+l1.Params.M {
+		t.Errorf("Expected %d of %d bits set, got %d of %d", l0.BitsSet+l1.BitsSet, l0.Params.M+l1.Params.M, stats.BitsSet, stats.Params.M)
+	}
+
+	if expected > 0.05 || average < 0.2 {
+		t.Errorf("Expected the weighted fill ratio %f to be far below the average %f", expected, average)
+	}
+
+	if fp := 1 - (1-l0.FalsePositiveRate)*(1-l1.FalsePositiveRate); math.Abs(stats.FalsePositiveRate-fp) > 1e-15 || math.Abs(bf.CurrentFalsePositiveRate()-fp) > 1e-15 {
+		t.Errorf("Expected a false positive rate of %g, got %g and %g in the stats", fp, bf.CurrentFalsePositiveRate(), stats.FalsePositiveRate)
+	}
+}
+
+// BenchmarkCheckGrowth checks items that weren't added to filters holding 20 times more
+// items than their first layer was built for, with growth factors of 2 and 1.
+func BenchmarkCheckGrowth(b *testing.B) {
+	const n = 5000
+
+	for _, s := range []uint{2, 1} {
+		bf := New(n).(*ScalableBloom)
+		bf.SetGrowthFactor(s)
+		for l := 0; l < 20*n; l++ {
+			bf.Add([]byte(web2[l]))
+		}
+
+		b.Run(fmt.Sprintf("s=%d/layers=%d", s, len(bf.bfs)), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Check([]byte(web2a[i%len(web2a)]))
+			}
+		})
+	}
+}
+
+func TestClear(t *testing.T) {
+	bf := New(10000)
+	for l := 0; l < 20000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	// After Clear only the first layer is left.
+	params := bf.(*ScalableBloom).bfs[0].Params()
+	if err := bf.SetErrorProbability(0.1); err != bloom.ErrNotEmpty {
+		t.Fatalf("Expected ErrNotEmpty, got %v", err)
+	}
+	first := bf.(*ScalableBloom).bfs[0]
+	if len(bf.(*ScalableBloom).bfs) < 2 {
+		t.Fatalf("Expected more than one layer")
+	}
+	bf.Clear()
+
+	p := bf.(*ScalableBloom).bfs[0].Params()
+	if p.M != params.M || p.K != params.K || p.S != params.S || bf.Count() != 0 || bf.FillRatio() != 0 {
+		t.Fatalf("Expected an empty filter with the same parameters, got %v", bf)
+	}
+
+	if layers := bf.(*ScalableBloom).bfs; len(layers) != 1 || layers[0] != first {
+		t.Fatalf("Expected the first layer to be kept, got %d layers", len(layers))
+	}
+
+	allocs := testing.AllocsPerRun(100, bf.Clear)
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per Clear, got %f", allocs)
+	}
+
+	for l := 0; l < 1000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	for l := 0; l < 1000; l++ {
+		if !bf.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q after Clear", web2[l])
+		}
+	}
+}
+
+func TestSetFillRatio(t *testing.T) {
+	a := New(10000).(*ScalableBloom)
+	b := New(10000).(*ScalableBloom)
+
+	if err := b.SetFillRatio(0); err != bloom.ErrInvalidFillRatio {
+		t.Errorf("Expected ErrInvalidFillRatio, got %v", err)
+	}
+
+	if err := b.SetFillRatio(0.25); err != nil {
+		t.Fatal(err)
+	}
+	b.Reset()
+
+	if b.bfs[0].Params().M <= a.bfs[0].Params().M {
+		t.Errorf("Expected p = 0.25 to give larger layers, got %d and %d bits", b.bfs[0].Params().M, a.bfs[0].Params().M)
+	}
+
+	for l := 0; l < 6000; l++ {
+		a.Add([]byte(web2[l]))
+		b.Add([]byte(web2[l]))
+	}
+
+	// The first layer is sized for 10000 items, but with p = 0.25 its estimated fill ratio
+	// goes over p before that.
+	if len(a.bfs) != 1 || len(b.bfs) != 2 {
+		t.Errorf("Expected a new layer with p = 0.25 only, got %d and %d layers", len(a.bfs), len(b.bfs))
+	}
+}
+
+func TestSetErrorProbability(t *testing.T) {
+	bf := New(10000)
+	if err := bf.SetErrorProbability(1e-5); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parameters are recomputed right away, without a Reset.
+	if p := bf.(*ScalableBloom).bfs[0].Params(); p.E != 1e-5 || p.K != bloom.K(1e-5) || p.M != bloom.M(10000, 0.5, 1e-5) {
+		t.Errorf("Expected the parameters for e = 1e-5, got %+v", p)
+	}
+
+	bf.Add([]byte("hello"))
+	params := bf.(*ScalableBloom).bfs[0].Params()
+
+	if err := bf.SetErrorProbability(0.01); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	if err := bf.SetFillRatio(0.25); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	if bf.(*ScalableBloom).bfs[0].Params() != params || !bf.Check([]byte("hello")) {
+		t.Errorf("Expected the filter to be unchanged")
+	}
+}
+
+func TestSetHasherNotEmpty(t *testing.T) {
+	bf := New(1000)
+	if err := bf.SetHasher(murmur3.New64()); err != nil {
+		t.Fatalf("Expected SetHasher to succeed on an empty filter, got %v", err)
+	}
+
+	bf.Add([]byte("hello"))
+
+	if err := bf.SetHasher(fnv.New64a()); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty from SetHasher, got %v", err)
+	}
+
+	if err := bf.(*ScalableBloom).SetNamedHasher("fnv64a"); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty from SetNamedHasher, got %v", err)
+	}
+
+	if !bf.Check([]byte("hello")) {
+		t.Errorf("Expected the hasher to be unchanged")
+	}
+
+	// The hasher of an empty filter is set on its layers as well.
+	sb := New(1000).(*ScalableBloom)
+	if err := sb.SetNamedHasher("fnv64a"); err != nil {
+		t.Fatal(err)
+	}
+	sb.Add([]byte("hello"))
+
+	var buf bytes.Buffer
+	if _, err := sb.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lb, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lb.(*ScalableBloom).hn != "fnv64a" || !lb.Check([]byte("hello")) {
+		t.Errorf("Expected the named hasher to be set on the layers")
+	}
+}
+
+// unclonedHash is a hash.Hash that doesn't implement hash.Cloner.
+type unclonedHash struct {
+	hash.Hash64
+}
+
+func TestSetHasherOwnInstance(t *testing.T) {
+	// Using the hasher given to SetHasher doesn't affect the layers, which hash with clones.
+	h := fnv.New64()
+	bf := New(100).(*ScalableBloom)
+	if err := bf.SetHasher(h); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		h.Write([]byte("interleaved"))
+		bf.Add([]byte(fmt.Sprintf("item-%d", i)))
+		h.Write([]byte("interleaved"))
+	}
+
+	if bf.NumLayers() < 2 {
+		t.Fatalf("Expected the filter to grow, got %d layers", bf.NumLayers())
+	}
+
+	for i := 0; i < 1000; i++ {
+		h.Write([]byte("interleaved"))
+		if !bf.Check([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Fatalf("Expected item-%d to be found", i)
+		}
+	}
+}
+
+func TestSetHasherFactory(t *testing.T) {
+	calls := 0
+	f := func() hash.Hash {
+		calls++
+		return unclonedHash{fnv.New64a()}
+	}
+
+	bf := New(100).(*ScalableBloom)
+	if err := bf.SetHasherFactory(f); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		bf.Add([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	// One for the filter and one for each layer, each of which has its own
+	if calls != bf.NumLayers()+1 {
+		t.Errorf("Expected %d calls to the factory, got %d", bf.NumLayers()+1, calls)
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := New(100).(*ScalableBloom)
+	if err := lb.SetHasherFactory(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !lb.Check([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Fatalf("Expected item-%d to be found after loading", i)
+		}
+	}
+
+	cb, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cb.Check([]byte("item-0")) {
+		t.Errorf("Expected the clone to find item-0")
+	}
+
+	if err := bf.SetHasherFactory(f); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty from SetHasherFactory, got %v", err)
+	}
+}
+
+func TestIntrospector(t *testing.T) {
+	bf := New(1000)
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Fatal(err)
+	}
+
+	i, ok := bf.(bloom.Introspector)
+	if !ok {
+		t.Fatalf("Expected %T to implement bloom.Introspector", bf)
+	}
+
+	p := bf.Params()
+	if i.K() != p.K || i.M() != p.M || i.S() != p.S || i.HasherName() != bloom.DefaultHasher {
+		t.Errorf("Expected %+v with hasher %q, got k = %d, m = %d, s = %d, hasher %q", p, bloom.DefaultHasher, i.K(), i.M(), i.S(), i.HasherName())
+	}
+
+	bf.SetHasher(murmur3.New64())
+	if i.HasherName() != "" {
+		t.Errorf("Expected no hasher name, got %q", i.HasherName())
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	for _, n := range []uint{1000, 100000, 1000000} {
+		for _, e := range []float64{0.01, 0.001} {
+			bf := NewWithEstimates(n, e)
+			for l := uint64(0); l < uint64(n/2); l++ {
+				bf.(*ScalableBloom).AddUint64(l)
+			}
+
+			used, est := bf.MemoryUsage(), EstimateMemory(n, e)
+			if m := uint64(bf.Params().M / 8); used < m {
+				t.Errorf("n = %d, e = %f: Expected at least %d bytes for the bits, got %d", n, e, m, used)
+			}
+
+			if d := math.Abs(float64(used)-float64(est)) / float64(used); d > 0.02 {
+				t.Errorf("n = %d, e = %f: Estimated %d bytes, used %d", n, e, est, used)
+			}
+		}
+	}
+}
+
+func TestCountOverflow(t *testing.T) {
+	bf := New(1000).(*ScalableBloom)
+
+	// Set the counter past 2^32 rather than adding that many items.
+	bf.c = 1<<32 + 10
+	bf.Add([]byte("hello")).Add([]byte("world"))
+
+	if bf.Count() != 1<<32+12 || bf.Stats().Count != 1<<32+12 {
+		t.Fatalf("Expected a count of %d, got %d", uint64(1<<32+12), bf.Count())
+	}
+
+	// The layers keep their own counts, so only the total is past 2^32.
+	if bf.TotalRemaining() != 1000-(1<<32+12) || len(bf.bfs) != 1 {
+		t.Errorf("Expected %d remaining in 1 layer, got %d in %d layers", 1000-(1<<32+12), bf.TotalRemaining(), len(bf.bfs))
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Count() != 1<<32+12 {
+		t.Errorf("Expected the count to be serialized, got %d", bf2.Count())
+	}
+}
+
+// TestConcurrentCheck checks items from many goroutines at once, expecting the same results
+// as checking them one at a time. Run it with -race.
+func TestConcurrentCheck(t *testing.T) {
+	n := len(web2) / 10
+
+	bf := New(uint(n) / 4).(*ScalableBloom)
+	for l := 0; l < n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	// Half of the keys were added.
+	keys := web2[n-5000 : n+5000]
+	items := make([][]byte, len(keys))
+	want, wantU64 := make([]bool, len(keys)), make([]bool, len(keys))
+	for i, k := range keys {
+		items[i] = []byte(k)
+		want[i] = bf.Check(items[i])
+		wantU64[i] = bf.CheckUint64(uint64(i))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			if w%4 == 3 {
+				for i, got := range bf.CheckMany(items, nil) {
+					if got != want[i] {
+						t.Errorf("CheckMany(%q) = %t, expected %t", keys[i], got, want[i])
+						return
+					}
+				}
+				return
+			}
+
+			for i, k := range keys {
+				var got bool
+				switch w % 4 {
+				case 0:
+					got = bf.Check(items[i])
+				case 1:
+					got = bf.CheckString(k)
+				case 2:
+					if bf.CheckUint64(uint64(i)) != wantU64[i] {
+						t.Errorf("CheckUint64(%d) = %t, expected %t", i, !wantU64[i], wantU64[i])
+						return
+					}
+					continue
+				}
+
+				if got != want[i] {
+					t.Errorf("Check(%q) = %t, expected %t", k, got, want[i])
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// TestConcurrentAdd adds items from many goroutines at once to a filter that grows several
+// layers while they run. Run it with -race.
+func TestConcurrentAdd(t *testing.T) {
+	const (
+		workers = 16
+		items   = 2000
+	)
+
+	for _, named := range []bool{true, false} {
+		bf := New(1000).(*ScalableBloom)
+		if !named {
+			bf.SetHasher(fnv.New64())
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				for i := 0; i < items; i++ {
+					v := uint64(w*items + i)
+					switch i % 3 {
+					case 0:
+						bf.AddUint64(v)
+					case 1:
+						bf.AddString(strconv.FormatUint(v, 10))
+					case 2:
+						bf.AddAllStrings([]string{strconv.FormatUint(v, 10)})
+					}
+
+					bf.CheckUint64(v)
+					bf.Count()
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		if bf.Count() != workers*items {
+			t.Errorf("Expected %d items, got %d", workers*items, bf.Count())
+		}
+
+		if len(bf.bfs) < 4 {
+			t.Errorf("Expected several layers, got %d", len(bf.bfs))
+		}
+
+		for v := uint64(0); v < workers*items; v++ {
+			var ok bool
+			if v%items%3 == 0 {
+				ok = bf.CheckUint64(v)
+			} else {
+				ok = bf.CheckString(strconv.FormatUint(v, 10))
+			}
+
+			if !ok {
+				t.Fatalf("Expected to find item %d", v)
+			}
+		}
+	}
+}
+
+// TestCountingRemove adds all the words to a counting filter sized for a tenth of them, and
+// removes half of them. The compound error probability stays within fpRate. Removing a word
+// from a newer layer it is a false positive of leaves it found, and decrements the counters
+// of up to k other words, which may then no longer be found nor removed.
+func TestCountingRemove(t *testing.T) {
+	const fpRate = 0.01
+
+	bf := NewCounting(uint(len(web2))/10, fpRate).(*ScalableBloom)
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	before := bf.CurrentFalsePositiveRate()
+	if e := bf.ErrorProbability(); e > fpRate || len(bf.bfs) < 3 {
+		t.Fatalf("Compound error probability %f with %d layers, expected at most %f", e, len(bf.bfs), fpRate)
+	}
+
+	// A word whose counters were decremented by removing a false positive may no longer be
+	// found, and can't be removed
+	half, failed := len(web2)/2, 0
+	for _, w := range web2[:half] {
+		if err := bf.RemoveString(w); err == counting.ErrNotAdded {
+			failed++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fn, removed, fp := 0, 0, 0
+	for _, w := range web2[half:] {
+		if !bf.CheckString(w) {
+			fn++
+		}
+	}
+	for _, w := range web2[:half] {
+		if bf.CheckString(w) {
+			removed++
+		}
+	}
+	for _, w := range web2a {
+		if bf.CheckString(w) {
+			fp++
+		}
+	}
+
+	fmt.Printf("%d layers, compound e %f, current rate %f then %f\n", len(bf.bfs), bf.ErrorProbability(), before, bf.CurrentFalsePositiveRate())
+	fmt.Printf("Failed removals: %d, false negatives: %d, removed found: %d, false positives: %d (%.4f%%)\n", failed, fn, removed, fp, float64(fp)/float64(len(web2a))*100)
+
+	if bf.Count() != uint64(len(web2)-half+failed) {
+		t.Errorf("Count %d, expected %d", bf.Count(), len(web2)-half+failed)
+	}
+
+	if float64(removed) > bf.ErrorProbability()*float64(half) || float64(fp) > fpRate*float64(len(web2a)) {
+		t.Errorf("%d removed found, %d false positives, expected at most %g%%", removed, fp, bf.ErrorProbability()*100)
+	}
+
+	if k := bf.bfs[len(bf.bfs)-1].Params().K; failed+fn > int(k)*removed {
+		t.Errorf("%d failed removals and %d false negatives, expected at most k = %d per removed word found", failed, fn, k)
+	}
+
+	if bf.CurrentFalsePositiveRate() >= before || bf.ErrorProbability() > fpRate {
+		t.Errorf("Current rate %f, was %f, compound e %f", bf.CurrentFalsePositiveRate(), before, bf.ErrorProbability())
+	}
+}
+
+// TestRemoveNewestLayer adds an item to the first layer and again to a newer one. Remove
+// decrements the newest layer first, then the oldest, and then fails.
+func TestRemoveNewestLayer(t *testing.T) {
+	bf := NewCounting(1000, 0.001).(*ScalableBloom)
+	bf.AddString("foo")
+	for i := 0; len(bf.bfs) < 3; i++ {
+		bf.AddString(strconv.Itoa(i))
+	}
+	bf.AddString("foo")
+
+	last := len(bf.bfs) - 1
+	if !bf.bfs[0].Check([]byte("foo")) || !bf.bfs[last].Check([]byte("foo")) {
+		t.Fatalf("Expected foo in the first and last layers")
+	}
+
+	if err := bf.RemoveString("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if !bf.bfs[0].Check([]byte("foo")) || bf.bfs[last].Check([]byte("foo")) {
+		t.Errorf("Expected foo removed from the last layer only")
+	}
+
+	if err := bf.RemoveString("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if bf.CheckString("foo") {
+		t.Errorf("Expected foo removed from all the layers")
+	}
+
+	if err := bf.RemoveString("foo"); err != counting.ErrNotAdded {
+		t.Errorf("Expected counting.ErrNotAdded, got %v", err)
+	}
+
+	if _, err := bf.Encode(io.Discard, nil); err == nil {
+		t.Errorf("Expected an error encoding counting layers")
+	}
+
+	p := New(1000).(*ScalableBloom)
+	p.AddString("foo")
+	if err := p.RemoveString("foo"); err != ErrNotRemovable || !p.CheckString("foo") {
+		t.Errorf("Expected ErrNotRemovable, got %v", err)
+	}
+}
+
 func BenchmarkBloomFNV64(b *testing.B) {
 	var lines []string
 	lines = append(lines, web2...)
@@ -246,3 +2620,300 @@ func BenchmarkBloomSha1(b *testing.B) {
 
 	b.StopTimer()
 }
+
+func BenchmarkAddString(b *testing.B) {
+	bf := New(uint(len(web2))).(*ScalableBloom)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddString(web2[i%len(web2)])
+	}
+}
+
+func BenchmarkCheckString(b *testing.B) {
+	bf := New(uint(len(web2))).(*ScalableBloom)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.CheckString(web2[i%len(web2)])
+	}
+}
+
+func BenchmarkAddEach(b *testing.B) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			bf.Add(item)
+		}
+	}
+}
+
+func BenchmarkAddAll(b *testing.B) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2))).(*ScalableBloom)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddAll(items)
+	}
+}
+
+func BenchmarkCheckEach(b *testing.B) {
+	bf := New(uint(len(web2)))
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+		bf.Add(items[l])
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			bf.Check(item)
+		}
+	}
+}
+
+func BenchmarkCheckMany(b *testing.B) {
+	bf := New(uint(len(web2)))
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+		bf.Add(items[l])
+	}
+	out := make([]bool, len(items))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.(*ScalableBloom).CheckMany(items, out)
+	}
+}
+
+// memStore is a BlobStore in memory, whose Get fails once failing is set.
+type memStore struct {
+	mu      sync.Mutex
+	blobs   map[string][]byte
+	gets    int
+	failing bool
+}
+
+func (this *memStore) Put(key string, data []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (this *memStore) Get(key string) ([]byte, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.gets++
+	if this.failing {
+		return nil, errors.New("unavailable")
+	}
+
+	data, ok := this.blobs[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (this *memStore) Delete(key string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	delete(this.blobs, key)
+	return nil
+}
+
+func TestSpill(t *testing.T) {
+	const n = 1000
+
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf, ref := New(n).(*ScalableBloom), New(n).(*ScalableBloom)
+	if err := bf.SetSpill(store, "a-", 0); err != ErrInvalidHotLayers {
+		t.Errorf("Expected ErrInvalidHotLayers, got %v", err)
+	}
+	if err := bf.SetSpill(store, "a-", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for l := 0; l < 10*n; l++ {
+		bf.Add([]byte(web2[l]))
+		ref.Add([]byte(web2[l]))
+	}
+
+	if bf.NumLayers() != 4 || bf.SpillError() != nil {
+		t.Fatalf("Expected 4 layers and no error, got %d and %v", bf.NumLayers(), bf.SpillError())
+	}
+
+	// The 3 older layers are in the store, and their statistics in memory
+	for i := 0; i < 3; i++ {
+		if _, err := store.Get("a-" + strconv.Itoa(i)); err != nil {
+			t.Errorf("Expected layer %d in the store, got %v", i, err)
+		}
+	}
+
+	// The bits of the cold layers are saved, less the proxies left in their place
+	var cold uint64
+	for i := 0; i < 3; i++ {
+		cold += uint64(bf.LayerStats(i).M/8) - bf.bfs[i].MemoryUsage()
+	}
+	if bf.MemoryUsage()+cold > ref.MemoryUsage() {
+		t.Errorf("Expected the spilled filter to use %d bytes less, got %d and %d", cold, bf.MemoryUsage(), ref.MemoryUsage())
+	}
+
+	if bf.CompoundErrorRate() != ref.CompoundErrorRate() || bf.ApproximateCardinality() != ref.ApproximateCardinality() {
+		t.Errorf("Expected the statistics of the layers to be kept")
+	}
+
+	stats := bf.Stats()
+	for i, ls := range stats.Layers {
+		if ls.Cold != (i < 3) || ls.Resident {
+			t.Errorf("Layer %d: expected cold %t and not resident, got %t and %t", i, i < 3, ls.Cold, ls.Resident)
+		}
+	}
+
+	var buf bytes.Buffer
+	stats.WriteTo(&buf)
+	if strings.Count(buf.String(), "(spilled)") != 3 {
+		t.Errorf("Expected 3 layers spilled in the stats, got %q", buf.String())
+	}
+
+	// The filter is serialized as if it had all its layers in memory
+	var a, b bytes.Buffer
+	if _, err := bf.WriteTo(&a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ref.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Errorf("Expected the same encoding as the filter in memory")
+	}
+
+	for l := 0; l < 10*n; l++ {
+		if !bf.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q", web2[l])
+		}
+	}
+
+	for l := range web2a {
+		if bf.Check([]byte(web2a[l])) != ref.Check([]byte(web2a[l])) {
+			t.Fatalf("Expected the same result for %q", web2a[l])
+		}
+	}
+
+	for i, ls := range bf.Stats().Layers[:3] {
+		if !ls.Resident {
+			t.Errorf("Layer %d: expected to be loaded back", i)
+		}
+	}
+
+	if err := bf.EvictColdLayers(); err != nil {
+		t.Fatal(err)
+	}
+	if bf.Stats().Layers[0].Resident {
+		t.Errorf("Expected the layers to be evicted")
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Check([]byte(web2[0])) || c.MemoryUsage() != ref.MemoryUsage() {
+		t.Errorf("Expected the clone to hold all its layers in memory")
+	}
+
+	// The spilled layers are dropped with the others
+	bf.Reset()
+	if _, err := store.Get("a-0"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the spilled layers to be deleted, got %v", err)
+	}
+
+	// Loading all the layers back
+	bf = New(n).(*ScalableBloom)
+	bf.SetSpill(store, "b-", 2)
+	for l := 0; l < 10*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+	if bf.Stats().Layers[1].Cold == false || bf.Stats().Layers[2].Cold {
+		t.Errorf("Expected the 2 newest layers in memory")
+	}
+
+	if err := bf.SetSpill(nil, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if bf.MemoryUsage() != ref.MemoryUsage() || bf.Stats().Layers[0].Cold {
+		t.Errorf("Expected all the layers in memory")
+	}
+	if _, err := store.Get("b-0"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the spilled layers to be deleted, got %v", err)
+	}
+}
+
+func TestSpillUnavailable(t *testing.T) {
+	const n = 1000
+
+	store := &memStore{blobs: map[string][]byte{}}
+	bf := New(n).(*ScalableBloom)
+	bf.SetSpill(store, "", 1)
+	for l := 0; l < 3*n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	// A layer that can't be loaded may hold any item
+	store.failing = true
+	if !bf.Check([]byte(web2[0])) || !bf.Check([]byte("not added")) || bf.SpillError() == nil {
+		t.Errorf("Expected the items to be found, and the error to be reported")
+	}
+
+	store.failing = false
+	if !bf.Check([]byte(web2[0])) || bf.SpillError() != nil {
+		t.Errorf("Expected the layer to be loaded once the store is available")
+	}
+
+	// Concurrent Checks load each layer once
+	bf.EvictColdLayers()
+	store.gets = 0
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range web2a[:1000] {
+				bf.Check([]byte(web2a[l]))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if store.gets != bf.NumLayers()-1 {
+		t.Errorf("Expected %d layers loaded, got %d", bf.NumLayers()-1, store.gets)
+	}
+
+	// The first layer is loaded back to be cleared
+	bf.Clear()
+	if bf.NumLayers() != 1 || bf.Stats().Layers[0].Cold || len(store.blobs) != 0 || bf.Check([]byte(web2[0])) {
+		t.Errorf("Expected a single empty layer in memory, and no layer in the store")
+	}
+}
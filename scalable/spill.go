@@ -0,0 +1,549 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scalable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+)
+
+// ErrInvalidHotLayers is returned by SetSpill for fewer than 1 hot layer.
+var ErrInvalidHotLayers = errors.New("scalable: at least 1 layer must stay in memory")
+
+// BlobStore holds the layers spilled by a scalable filter, see SetSpill. Its methods may be
+// called concurrently, by Checks loading different layers.
+type BlobStore interface {
+	// Put stores data under key, replacing the data stored under it if any.
+	Put(key string, data []byte) error
+
+	// Get returns the data stored under key.
+	Get(key string) ([]byte, error)
+
+	// Delete removes the data stored under key. It isn't an error if there is none.
+	Delete(key string) error
+}
+
+// DirStore is a BlobStore keeping each blob in a file of a directory, named after its key.
+type DirStore struct {
+	dir string
+}
+
+var _ BlobStore = (*DirStore)(nil)
+
+// NewDirStore returns a DirStore keeping its files in dir, which is created if needed.
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// Put writes data to a temporary file of the directory and renames it to key, so the file
+// holds either the previous data or the new data, never a part of it.
+func (this *DirStore) Put(key string, data []byte) (err error) {
+	path, err := this.path(key)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(this.dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Get reads the file named key.
+func (this *DirStore) Get(key string) ([]byte, error) {
+	path, err := this.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// Delete removes the file named key.
+func (this *DirStore) Delete(key string) error {
+	path, err := this.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (this *DirStore) path(key string) (string, error) {
+	if key == "" || filepath.Base(key) != key {
+		return "", fmt.Errorf("scalable: invalid key %q", key)
+	}
+	return filepath.Join(this.dir, key), nil
+}
+
+// SetSpill moves the layers of the filter older than the newest hot ones to store, and
+// from then on each layer as it becomes one of them, under the keys prefix followed by
+// the number of layers spilled before it. Only the newest layer receives items, so the older ones don't
+// change, and they hold most of the bits of a filter with many layers. In memory, each
+// of them is replaced by a proxy keeping its statistics, which loads it back when a Check
+// doesn't find the item in the newer layers. The layer then stays in memory until
+// EvictColdLayers, so Check gives the same results, only slower for the items not in the
+// hot layers. A layer that can't be loaded back is reported by SpillError, and Check then
+// finds every item in it, as it can't tell: the filter may have false positives, but no
+// false negatives.
+//
+// Layers are written as they are added, by the Add that adds them, with the filter
+// locked. A layer that can't be written stays in memory, and the error is returned by
+// SpillError. The layers must implement bloom.Encoder, so the layers of NewCounting can't
+// be spilled.
+//
+// A nil store loads all the layers back, and deletes them from the store. SetSpill returns
+// ErrInvalidHotLayers if hot is less than 1 with a store, and the last error writing or
+// loading a layer otherwise. Several filters may share a store with different prefixes.
+// Clone returns a filter holding all its layers in memory, and the layers deleted by
+// Reset, Clear or ReadFrom are deleted from the store.
+func (this *ScalableBloom) SetSpill(store BlobStore, prefix string, hot int) error {
+	if store != nil && hot < 1 {
+		return ErrInvalidHotLayers
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err := this.thawAll(); err != nil {
+		return err
+	}
+
+	this.store, this.prefix, this.hot = store, prefix, hot
+	this.spillErr = nil
+	return this.spillCold()
+}
+
+// EvictColdLayers drops from memory the spilled layers loaded back by Check. It returns
+// the last error writing a layer changed since it was loaded, which then stays in memory.
+func (this *ScalableBloom) EvictColdLayers() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var err error
+	for _, bf := range this.bfs {
+		if c, ok := bf.(*coldLayer); ok {
+			if e := c.evict(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// SpillError returns the last error writing a layer to the store set by SetSpill, or the
+// error of a spilled layer that couldn't be loaded back, nil if there is none.
+func (this *ScalableBloom) SpillError() error {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	for _, bf := range this.bfs {
+		if c, ok := bf.(*coldLayer); ok {
+			if err := c.loadErr(); err != nil {
+				return err
+			}
+		}
+	}
+	return this.spillErr
+}
+
+// spillCold moves the layers older than the hot ones to the store, if there is one. It
+// returns the last error, which SpillError returns as well.
+func (this *ScalableBloom) spillCold() error {
+	if this.store == nil {
+		return nil
+	}
+
+	var err error
+	for i := 0; i < len(this.bfs)-this.hot; i++ {
+		if _, ok := this.bfs[i].(*coldLayer); ok {
+			continue
+		}
+
+		c, e := this.spill(i, this.bfs[i])
+		if e != nil {
+			err = e
+			this.spillErr = e
+			continue
+		}
+		this.bfs[i] = c
+	}
+	return err
+}
+
+// spill writes layer i, bf, to the store, and returns the proxy replacing it.
+func (this *ScalableBloom) spill(i int, bf bloom.Bloom) (*coldLayer, error) {
+	c := &coldLayer{
+		key:    this.prefix + strconv.FormatUint(this.ns, 10),
+		store:  this.store,
+		decode: this.decodeSpilled,
+	}
+
+	if err := c.write(bf); err != nil {
+		return nil, fmt.Errorf("scalable: spilling layer %d: %w", i, err)
+	}
+
+	this.ns++
+	return c, nil
+}
+
+// decodeSpilled decodes a layer written by spill, with its header, and gives it a new
+// hash function like ReadFrom does.
+func (this *ScalableBloom) decodeSpilled(data []byte) (bloom.Bloom, error) {
+	r := bytes.NewReader(data)
+
+	lh := &bloom.Header{}
+	if _, err := lh.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return decodeLayer(lh, r, this.newHasher())
+}
+
+// thawAll loads the spilled layers back in memory, and deletes them from the store. A
+// layer that can't be loaded stays spilled, and the error is returned.
+func (this *ScalableBloom) thawAll() error {
+	for i, bf := range this.bfs {
+		c, ok := bf.(*coldLayer)
+		if !ok {
+			continue
+		}
+
+		bf, err := c.load()
+		if err != nil {
+			return fmt.Errorf("scalable: loading layer %d: %w", i, err)
+		}
+
+		this.bfs[i] = bf
+		c.store.Delete(c.key)
+	}
+	return nil
+}
+
+// dropSpilled deletes the spilled layers of bfs from the store, as they are dropped from
+// the filter.
+func dropSpilled(bfs []bloom.Bloom) {
+	for _, bf := range bfs {
+		if c, ok := bf.(*coldLayer); ok {
+			c.store.Delete(c.key)
+		}
+	}
+}
+
+// coldLayer stands for a layer written to a BlobStore. It keeps the statistics of the
+// layer, which doesn't receive items anymore, and loads it back to check items. Its
+// methods may be called concurrently, so mu guards the layer loaded.
+type coldLayer struct {
+	key    string
+	store  BlobStore
+	decode func(data []byte) (bloom.Bloom, error)
+
+	// stats and card are those of the layer when it was written.
+	stats bloom.Stats
+	card  uint64
+
+	mu sync.Mutex
+
+	// bf is the layer once loaded, or nil, and err the last error loading it. dirty is set
+	// if bf was changed since it was written, so it isn't dropped until written again.
+	bf    bloom.Bloom
+	err   error
+	dirty bool
+}
+
+var (
+	_ bloom.Bloom   = (*coldLayer)(nil)
+	_ bloom.Encoder = (*coldLayer)(nil)
+)
+
+// write writes bf to the store, and keeps its statistics.
+func (this *coldLayer) write(bf bloom.Bloom) error {
+	enc, ok := bf.(bloom.Encoder)
+	if !ok {
+		return fmt.Errorf("cannot serialize layer of type %T", bf)
+	}
+
+	var buf bytes.Buffer
+	if _, err := enc.Encode(&buf, nil); err != nil {
+		return err
+	}
+
+	if err := this.store.Put(this.key, buf.Bytes()); err != nil {
+		return err
+	}
+
+	this.stats = bf.Stats()
+	this.card = bf.ApproximateCardinality()
+	return nil
+}
+
+// load returns the layer, reading it from the store first if it isn't loaded.
+func (this *coldLayer) load() (bloom.Bloom, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.bf != nil {
+		return this.bf, nil
+	}
+
+	bf, err := this.read()
+	if err != nil {
+		this.err = err
+		return nil, err
+	}
+
+	this.bf, this.err = bf, nil
+	return bf, nil
+}
+
+// read reads the layer from the store.
+func (this *coldLayer) read() (bloom.Bloom, error) {
+	data, err := this.store.Get(this.key)
+	if err != nil {
+		return nil, err
+	}
+	return this.decode(data)
+}
+
+// loaded returns the layer if it is loaded, and nil otherwise.
+func (this *coldLayer) loaded() bloom.Bloom {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf
+}
+
+// change loads the layer to change it, after which it stays loaded until written again by
+// evict. It returns nil if the layer can't be loaded.
+func (this *coldLayer) change() bloom.Bloom {
+	bf, err := this.load()
+	if err != nil {
+		return nil
+	}
+
+	this.mu.Lock()
+	this.dirty = true
+	this.mu.Unlock()
+	return bf
+}
+
+// evict drops the layer loaded, writing it first if it was changed.
+func (this *coldLayer) evict() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.dirty {
+		if err := this.write(this.bf); err != nil {
+			return err
+		}
+		this.dirty = false
+	}
+
+	this.bf = nil
+	return nil
+}
+
+func (this *coldLayer) loadErr() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.err
+}
+
+func (this *coldLayer) Add(key []byte) bloom.Bloom {
+	if bf := this.change(); bf != nil {
+		bf.Add(key)
+	}
+	return this
+}
+
+// Check loads the layer to check key. If the layer can't be loaded, it returns true, as
+// key may be in it.
+func (this *coldLayer) Check(key []byte) bool {
+	bf, err := this.load()
+	if err != nil {
+		return true
+	}
+	return bf.Check(key)
+}
+
+func (this *coldLayer) CheckUint64(v uint64) bool {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return this.Check(b[:])
+}
+
+func (this *coldLayer) Count() uint64 {
+	if bf := this.loaded(); bf != nil {
+		return bf.Count()
+	}
+	return this.stats.Count
+}
+
+func (this *coldLayer) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+// Stats returns the statistics of the layer, with Cold set, and Resident if it is loaded.
+func (this *coldLayer) Stats() bloom.Stats {
+	stats := this.stats
+	if bf := this.loaded(); bf != nil {
+		stats = bf.Stats()
+		stats.Resident = true
+	}
+
+	stats.Cold = true
+	return stats
+}
+
+func (this *coldLayer) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// SetHasher returns bloom.ErrNotEmpty, as only layers holding items are spilled.
+func (this *coldLayer) SetHasher(h hash.Hash) error {
+	return bloom.ErrNotEmpty
+}
+
+func (this *coldLayer) Reset() {
+	if bf := this.change(); bf != nil {
+		bf.Reset()
+	}
+}
+
+func (this *coldLayer) Clear() {
+	if bf := this.change(); bf != nil {
+		bf.Clear()
+	}
+}
+
+func (this *coldLayer) FillRatio() float64 {
+	if bf := this.loaded(); bf != nil {
+		return bf.FillRatio()
+	}
+	return this.stats.FillRatio
+}
+
+func (this *coldLayer) EstimatedFillRatio() float64 {
+	if bf := this.loaded(); bf != nil {
+		return bf.EstimatedFillRatio()
+	}
+	return this.stats.EstimatedFillRatio
+}
+
+// SetErrorProbability returns bloom.ErrNotEmpty, as only layers holding items are spilled.
+func (this *coldLayer) SetErrorProbability(e float64) error {
+	return bloom.ErrNotEmpty
+}
+
+// SetFillRatio returns bloom.ErrNotEmpty, as only layers holding items are spilled.
+func (this *coldLayer) SetFillRatio(p float64) error {
+	return bloom.ErrNotEmpty
+}
+
+func (this *coldLayer) Params() bloom.Params {
+	return this.stats.Params
+}
+
+// Clone returns a copy of the layer read from the store, or a clone of the layer loaded.
+func (this *coldLayer) Clone() (bloom.Bloom, error) {
+	if bf := this.loaded(); bf != nil {
+		return bf.Clone()
+	}
+	return this.read()
+}
+
+func (this *coldLayer) ApproximateCardinality() uint64 {
+	if bf := this.loaded(); bf != nil {
+		return bf.ApproximateCardinality()
+	}
+	return this.card
+}
+
+func (this *coldLayer) CurrentFalsePositiveRate() float64 {
+	if bf := this.loaded(); bf != nil {
+		return bf.CurrentFalsePositiveRate()
+	}
+	return this.stats.FalsePositiveRate
+}
+
+// MemoryUsage returns the memory held by the proxy, and by the layer if it is loaded.
+func (this *coldLayer) MemoryUsage() uint64 {
+	t := uint64(unsafe.Sizeof(*this)) + uint64(len(this.key))
+	if bf := this.loaded(); bf != nil {
+		t += bf.MemoryUsage()
+	}
+	return t
+}
+
+// Encode writes the layer as it was written to the store, or encodes the layer loaded, or
+// read from the store for other options.
+func (this *coldLayer) Encode(w io.Writer, opts *bloom.WriteOptions) (int64, error) {
+	bf := this.loaded()
+	if bf == nil && opts == nil {
+		data, err := this.store.Get(this.key)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := w.Write(data)
+		return int64(n), err
+	}
+
+	if bf == nil {
+		var err error
+		if bf, err = this.read(); err != nil {
+			return 0, err
+		}
+	}
+
+	enc, ok := bf.(bloom.Encoder)
+	if !ok {
+		return 0, fmt.Errorf("scalable: cannot serialize layer of type %T", bf)
+	}
+	return enc.Encode(w, opts)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/maphash"
+	"math/rand/v2"
+)
+
+// SeededHasherFamily is the family of the hashers returned by SeededHasherName, see
+// RegisterHasherFamily. The parameter is the seed, as 8 big endian bytes.
+const SeededHasherFamily = "xxhash-seed"
+
+func init() {
+	RegisterHasherFamily(SeededHasherFamily, func(params []byte) (hash.Hash, error) {
+		if len(params) != 8 {
+			return nil, errors.New("the seed must be 8 bytes")
+		}
+		return SeededHash(binary.BigEndian.Uint64(params)).Hash(), nil
+	})
+}
+
+// SeededHash returns XXHash with seed: the first value is the XXH64 hash of the item with
+// seed, and the second the hash mixed with the splitmix64 finalizer. Filters using different
+// seeds set different bits for the same item, so the positions of an item can't be
+// predicted without the seed.
+func SeededHash(seed uint64) Hasher {
+	return func(item []byte) (uint64, uint64) {
+		v := xxh64(item, seed)
+		return v, splitmix64(v)
+	}
+}
+
+// SeededHasherName returns the name of the hasher hashing with SeededHash(seed), for
+// SetNamedHasher. The seed is part of the name, so it is recorded with the filter when
+// serialized, and the decoders recreate the same hasher.
+func SeededHasherName(seed uint64) string {
+	return FamilyHasherName(SeededHasherFamily, binary.BigEndian.AppendUint64(nil, seed))
+}
+
+// SeedOf returns the seed of the hasher named name, and whether name was returned by
+// SeededHasherName.
+func SeedOf(name string) (uint64, bool) {
+	family, params, ok := ParseHasherName(name)
+	if !ok || family != SeededHasherFamily || len(params) != 8 {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(params), true
+}
+
+// RandomSeed returns a random seed for SeededHash, different in every call and process.
+func RandomSeed() uint64 {
+	return rand.Uint64()
+}
+
+// Maphash returns a Hasher hashing with hash/maphash and seed. The first value is the
+// maphash of the item, and the second the hash mixed with the splitmix64 finalizer.
+//
+// A maphash.Seed can't be read or recreated, so a filter using Maphash can't be loaded in
+// another process: it records no hasher name, and the decoders fall back to the current
+// hasher, as for any hasher set with SetHasher. Filters that are serialized should use
+// SeededHasherName instead.
+func Maphash(seed maphash.Seed) Hasher {
+	return func(item []byte) (uint64, uint64) {
+		v := maphash.Bytes(seed, item)
+		return v, splitmix64(v)
+	}
+}
@@ -0,0 +1,747 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+	"github.com/zhenjl/bloom/scalable"
+)
+
+// ShardedBloom is a filter for concurrent use made of independent filters, the shards. Each
+// key is routed by its hash to one shard, which has its own lock, so goroutines adding or
+// checking keys only contend when their keys go to the same shard. Check only consults the
+// shard the key was routed to, so the false positive rate is that of a single shard, and
+// the memory used is the sum of the shards.
+//
+// The key is routed using the top bits of a 64-bit FNV-1a hash, independent of the hashers
+// of the shards, so the keys of a shard are still spread over all of its bits.
+type ShardedBloom struct {
+	// n is the number of elements the filter is predicted to hold. Each shard is sized for
+	// n / len(shards) of them.
+	n uint
+
+	// shards holds the filters the keys are routed to
+	shards []shard
+}
+
+// shard is one of the filters of a ShardedBloom, with the lock guarding it.
+type shard struct {
+	mu sync.RWMutex
+	bf bloom.Bloom
+}
+
+var (
+	_ bloom.Bloom        = (*ShardedBloom)(nil)
+	_ bloom.Introspector = (*ShardedBloom)(nil)
+)
+
+func init() {
+	bloom.RegisterDecoder(bloom.KindSharded, func(h *bloom.Header, r io.Reader) (bloom.Bloom, error) {
+		bf := &ShardedBloom{}
+		if _, err := bf.readBody(h, r); err != nil {
+			return nil, err
+		}
+		return bf, nil
+	})
+}
+
+// New initializes a new sharded bloom filter for n items with the given number of shards,
+// each created by ctor for n / shards items, rounded up. ctor defaults to partitioned.New
+// if nil, and shards to 1 if less than 1. All the shards must be created with the same
+// parameters.
+func New(n uint, shards int, ctor func(uint) bloom.Bloom) bloom.Bloom {
+	if ctor == nil {
+		ctor = partitioned.New
+	}
+
+	if shards < 1 {
+		shards = 1
+	}
+
+	bf := &ShardedBloom{
+		n:      n,
+		shards: make([]shard, shards),
+	}
+
+	sn := (n + uint(shards) - 1) / uint(shards)
+	for i := range bf.shards {
+		bf.shards[i].bf = ctor(sn)
+	}
+
+	return bf
+}
+
+// Shards returns the number of shards.
+func (this *ShardedBloom) Shards() int {
+	return len(this.shards)
+}
+
+// shard returns the shard key is routed to.
+func (this *ShardedBloom) shard(key []byte) *shard {
+	return &this.shards[this.index(key)]
+}
+
+// index returns the index of the shard key is routed to, from the top bits of the first
+// hash of bloom.FNV1a.
+func (this *ShardedBloom) index(key []byte) int {
+	h, _ := bloom.FNV1a(key)
+	i, _ := bits.Mul64(h, uint64(len(this.shards)))
+	return int(i)
+}
+
+// lock locks all the shards, in order.
+func (this *ShardedBloom) lock() {
+	for i := range this.shards {
+		this.shards[i].mu.Lock()
+	}
+}
+
+func (this *ShardedBloom) unlock() {
+	for i := range this.shards {
+		this.shards[i].mu.Unlock()
+	}
+}
+
+func (this *ShardedBloom) rlock() {
+	for i := range this.shards {
+		this.shards[i].mu.RLock()
+	}
+}
+
+func (this *ShardedBloom) runlock() {
+	for i := range this.shards {
+		this.shards[i].mu.RUnlock()
+	}
+}
+
+func (this *ShardedBloom) Add(item []byte) bloom.Bloom {
+	s := this.shard(item)
+	s.mu.Lock()
+	s.bf.Add(item)
+	s.mu.Unlock()
+	return this
+}
+
+// AddAll adds all the items, the same as calling Add for each of them. The items are
+// grouped by shard, and each group is added by its own goroutine holding the lock of the
+// shard once.
+func (this *ShardedBloom) AddAll(items [][]byte) bloom.Bloom {
+	groups := make([][][]byte, len(this.shards))
+	for _, item := range items {
+		i := this.index(item)
+		groups[i] = append(groups[i], item)
+	}
+
+	var wg sync.WaitGroup
+	for i := range groups {
+		if len(groups[i]) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(s *shard, items [][]byte) {
+			defer wg.Done()
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if a, ok := s.bf.(interface{ AddAll([][]byte) bloom.Bloom }); ok {
+				a.AddAll(items)
+				return
+			}
+
+			for _, item := range items {
+				s.bf.Add(item)
+			}
+		}(&this.shards[i], groups[i])
+	}
+	wg.Wait()
+
+	return this
+}
+
+// Check returns true if item may have been added to the filter. Only the shard item is
+// routed to is checked.
+func (this *ShardedBloom) Check(item []byte) bool {
+	s := this.shard(item)
+	s.mu.RLock()
+	ok := s.bf.Check(item)
+	s.mu.RUnlock()
+	return ok
+}
+
+// CheckMany checks all the items, setting out[i] to Check(items[i]). out is reused if it
+// can hold len(items) results, and allocated otherwise. The slice of results is returned.
+func (this *ShardedBloom) CheckMany(items [][]byte, out []bool) []bool {
+	out = bloom.Results(out, len(items))
+	for i, item := range items {
+		out[i] = this.Check(item)
+	}
+	return out
+}
+
+// Count returns the sum of the counts of the shards.
+func (this *ShardedBloom) Count() uint64 {
+	var c uint64
+	for i := range this.shards {
+		s := &this.shards[i]
+		s.mu.RLock()
+		c += s.bf.Count()
+		s.mu.RUnlock()
+	}
+	return c
+}
+
+// SetHasher sets the hash function of the shards. Each shard needs its own hasher, so the
+// first shard is given h and the others a clone of it, see bloom.CloneHasher. It returns
+// bloom.ErrNotEmpty if the filter isn't empty.
+func (this *ShardedBloom) SetHasher(h hash.Hash) error {
+	this.lock()
+	defer this.unlock()
+
+	if this.count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	hs := make([]hash.Hash, len(this.shards))
+	hs[0] = h
+	for i := 1; i < len(hs); i++ {
+		c, err := bloom.CloneHasher("", h)
+		if err != nil {
+			return err
+		}
+		hs[i] = c
+	}
+
+	for i := range this.shards {
+		if err := this.shards[i].bf.SetHasher(hs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetNamedHasher sets the hash function of every shard to a new instance of the hasher
+// registered with bloom.RegisterHasher as name. Like SetHasher, it returns bloom.ErrNotEmpty
+// if the filter isn't empty.
+func (this *ShardedBloom) SetNamedHasher(name string) error {
+	this.lock()
+	defer this.unlock()
+
+	if this.count() > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	for i := range this.shards {
+		s, ok := this.shards[i].bf.(interface{ SetNamedHasher(string) error })
+		if !ok {
+			return fmt.Errorf("sharded: shard of type %T has no SetNamedHasher", this.shards[i].bf)
+		}
+
+		if err := s.SetNamedHasher(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *ShardedBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+// count returns the sum of the counts of the shards, which must be locked.
+func (this *ShardedBloom) count() uint64 {
+	var c uint64
+	for i := range this.shards {
+		c += this.shards[i].bf.Count()
+	}
+	return c
+}
+
+func (this *ShardedBloom) Reset() {
+	this.lock()
+	defer this.unlock()
+
+	for i := range this.shards {
+		this.shards[i].bf.Reset()
+	}
+}
+
+// Clear removes all the items from every shard, keeping the parameters.
+func (this *ShardedBloom) Clear() {
+	this.lock()
+	defer this.unlock()
+
+	for i := range this.shards {
+		this.shards[i].bf.Clear()
+	}
+}
+
+// SetErrorProbability sets the error probability of every shard. Like the filters of the
+// shards, it returns bloom.ErrNotEmpty if the filter isn't empty and e is not the error
+// probability already in use.
+func (this *ShardedBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	return this.set(func(bf bloom.Bloom) error {
+		return bf.SetErrorProbability(e)
+	})
+}
+
+// SetFillRatio sets the fill ratio of every shard. Like SetErrorProbability, it returns
+// bloom.ErrNotEmpty if the filter isn't empty and p is not the fill ratio already in use.
+func (this *ShardedBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	return this.set(func(bf bloom.Bloom) error {
+		return bf.SetFillRatio(p)
+	})
+}
+
+// set calls f for every shard. If a shard isn't empty, f is only called for that shard, which
+// either leaves it unchanged or returns an error, so the shards keep the same parameters.
+func (this *ShardedBloom) set(f func(bf bloom.Bloom) error) error {
+	this.lock()
+	defer this.unlock()
+
+	for i := range this.shards {
+		if this.shards[i].bf.Count() > 0 {
+			return f(this.shards[i].bf)
+		}
+	}
+
+	for i := range this.shards {
+		if err := f(this.shards[i].bf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FillRatio returns the average fill ratio of the shards, which are all the same size.
+func (this *ShardedBloom) FillRatio() float64 {
+	this.rlock()
+	defer this.runlock()
+
+	var t float64
+	for i := range this.shards {
+		t += this.shards[i].bf.FillRatio()
+	}
+	return t / float64(len(this.shards))
+}
+
+// EstimatedFillRatio returns the average estimated fill ratio of the shards.
+func (this *ShardedBloom) EstimatedFillRatio() float64 {
+	this.rlock()
+	defer this.runlock()
+
+	var t float64
+	for i := range this.shards {
+		t += this.shards[i].bf.EstimatedFillRatio()
+	}
+	return t / float64(len(this.shards))
+}
+
+// Params returns the parameters of the shards, with M the total number of bits and N the
+// number of items the whole filter was built for.
+func (this *ShardedBloom) Params() bloom.Params {
+	this.rlock()
+	defer this.runlock()
+	return this.params()
+}
+
+func (this *ShardedBloom) params() bloom.Params {
+	p := this.shards[0].bf.Params()
+	p.N = this.n
+	for i := 1; i < len(this.shards); i++ {
+		p.M += this.shards[i].bf.Params().M
+	}
+	return p
+}
+
+func (this *ShardedBloom) K() uint {
+	return this.Params().K
+}
+
+func (this *ShardedBloom) M() uint {
+	return this.Params().M
+}
+
+func (this *ShardedBloom) S() uint {
+	return this.Params().S
+}
+
+// HasherName returns the name of the hasher of the shards, or an empty string if it was set
+// with SetHasher.
+func (this *ShardedBloom) HasherName() string {
+	s := &this.shards[0]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i, ok := s.bf.(bloom.Introspector); ok {
+		return i.HasherName()
+	}
+	return ""
+}
+
+// Clone returns a deep copy of the filter, cloning every shard. It returns an error if a
+// shard can't be cloned.
+func (this *ShardedBloom) Clone() (bloom.Bloom, error) {
+	this.rlock()
+	defer this.runlock()
+
+	bf := &ShardedBloom{
+		n:      this.n,
+		shards: make([]shard, len(this.shards)),
+	}
+
+	for i := range this.shards {
+		c, err := this.shards[i].bf.Clone()
+		if err != nil {
+			return nil, err
+		}
+		bf.shards[i].bf = c
+	}
+
+	return bf, nil
+}
+
+// Union adds all the items of other to the filter by combining each shard of other with the
+// same shard of the filter, using the Union method of partitioned shards and the Merge method
+// of scalable shards. Both filters must have the same number of shards, of the same kind and
+// with the same parameters and hashers. Otherwise Union returns an error wrapping
+// bloom.ErrIncompatible and leaves the filter unchanged. Since every shard has a hasher of
+// its own, only filters with named hashers can be combined. Both filters are locked, so
+// a.Union(b) must not run concurrently with b.Union(a).
+func (this *ShardedBloom) Union(other *ShardedBloom) error {
+	if this == other {
+		return nil
+	}
+
+	if len(this.shards) != len(other.shards) {
+		return fmt.Errorf("%w: %d and %d shards", bloom.ErrIncompatible, len(this.shards), len(other.shards))
+	}
+
+	this.lock()
+	defer this.unlock()
+	other.rlock()
+	defer other.runlock()
+
+	for i := range this.shards {
+		a, b := this.shards[i].bf, other.shards[i].bf
+
+		var ok bool
+		switch a.(type) {
+		case *partitioned.PartitionedBloom:
+			_, ok = b.(*partitioned.PartitionedBloom)
+			ok = ok && a.Params() == b.Params()
+		case *scalable.ScalableBloom:
+			_, ok = b.(*scalable.ScalableBloom)
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: shard %d of type %T and %T", bloom.ErrIncompatible, i, a, b)
+		}
+
+		ia, _ := a.(bloom.Introspector)
+		ib, _ := b.(bloom.Introspector)
+		if ia.HasherName() == "" || ia.HasherName() != ib.HasherName() {
+			return fmt.Errorf("%w: hashers %q and %q", bloom.ErrIncompatible, ia.HasherName(), ib.HasherName())
+		}
+	}
+
+	for i := range this.shards {
+		var err error
+		switch a := this.shards[i].bf.(type) {
+		case *partitioned.PartitionedBloom:
+			err = a.Union(other.shards[i].bf.(*partitioned.PartitionedBloom))
+		case *scalable.ScalableBloom:
+			err = a.Merge(other.shards[i].bf.(*scalable.ScalableBloom))
+		}
+
+		if err != nil {
+			return fmt.Errorf("sharded: shard %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// ApproximateCardinality returns the sum of the approximate cardinalities of the shards.
+// A key is only ever added to one shard, so there's no overlap between them.
+func (this *ShardedBloom) ApproximateCardinality() uint64 {
+	this.rlock()
+	defer this.runlock()
+
+	var c uint64
+	for i := range this.shards {
+		c += this.shards[i].bf.ApproximateCardinality()
+	}
+	return c
+}
+
+// CurrentFalsePositiveRate returns the average of the false positive rates of the shards,
+// as a key not in the filter is equally likely to be routed to any of them.
+func (this *ShardedBloom) CurrentFalsePositiveRate() float64 {
+	this.rlock()
+	defer this.runlock()
+
+	var t float64
+	for i := range this.shards {
+		t += this.shards[i].bf.CurrentFalsePositiveRate()
+	}
+	return t / float64(len(this.shards))
+}
+
+// MemoryUsage returns the number of bytes held by the filter: the MemoryUsage of the shards
+// and the filter itself.
+func (this *ShardedBloom) MemoryUsage() uint64 {
+	this.rlock()
+	defer this.runlock()
+
+	t := uint64(unsafe.Sizeof(*this)) + uint64(cap(this.shards))*uint64(unsafe.Sizeof(shard{}))
+	for i := range this.shards {
+		t += this.shards[i].bf.MemoryUsage()
+	}
+	return t
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *ShardedBloom) String() string {
+	return fmt.Sprintf("sharded{n=%d shards=%d count=%d fill=%.2f}", this.n, len(this.shards), this.Count(), this.EstimatedFillRatio())
+}
+
+// Stats returns the statistics of the filter, aggregated from the statistics of the shards
+// as in Params, FillRatio and CurrentFalsePositiveRate. Those of each shard are in Shards.
+func (this *ShardedBloom) Stats() bloom.Stats {
+	this.rlock()
+	defer this.runlock()
+
+	stats := bloom.Stats{
+		Params: this.params(),
+		Shards: make([]bloom.Stats, len(this.shards)),
+	}
+
+	l := float64(len(this.shards))
+	for i := range this.shards {
+		s := this.shards[i].bf.Stats()
+		stats.Shards[i] = s
+		stats.Count += s.Count
+		stats.BitsSet += s.BitsSet
+		stats.FillRatio += s.FillRatio / l
+		stats.EstimatedFillRatio += s.EstimatedFillRatio / l
+		stats.FalsePositiveRate += s.FalsePositiveRate / l
+	}
+
+	return stats
+}
+
+// WriteStats writes the statistics returned by Stats to w in a human readable form.
+func (this *ShardedBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *ShardedBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+// WriteTo implements io.WriterTo. The header is followed by the number of shards as a big
+// endian uint64, and the shards, each written by its own Encode method.
+func (this *ShardedBloom) WriteTo(w io.Writer) (int64, error) {
+	return this.Encode(w, nil)
+}
+
+// Encode is the same as WriteTo, with the shards written using opts.
+func (this *ShardedBloom) Encode(w io.Writer, opts *bloom.WriteOptions) (int64, error) {
+	this.rlock()
+	defer this.runlock()
+
+	p := this.params()
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindSharded,
+		N:       uint64(this.n),
+		C:       this.count(),
+		P:       p.P,
+		E:       p.E,
+	}
+
+	total, err := h.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(len(this.shards)))
+
+	n, err := w.Write(buf[:])
+	total += int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for i := range this.shards {
+		enc, ok := this.shards[i].bf.(bloom.Encoder)
+		if !ok {
+			return total, fmt.Errorf("sharded: cannot serialize shard %d of type %T", i, this.shards[i].bf)
+		}
+
+		nn, err := enc.Encode(w, opts)
+		total += nn
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// ReadFrom implements io.ReaderFrom. The shards are decoded with bloom.Decode, so the packages
+// of their kinds must be imported. Shards written with a hasher set by SetHasher are given
+// fnv.New64(), see bloom.ResolveHasher.
+func (this *ShardedBloom) ReadFrom(r io.Reader) (int64, error) {
+	h := &bloom.Header{}
+	total, err := h.ReadFrom(r)
+	if err != nil {
+		return total, err
+	}
+
+	if h.Kind != bloom.KindSharded {
+		return total, fmt.Errorf("sharded: cannot read %s filter", h.Kind)
+	}
+
+	n, err := this.readBody(h, r)
+	return total + n, err
+}
+
+// readBody reads the shards following the header h.
+func (this *ShardedBloom) readBody(h *bloom.Header, r io.Reader) (int64, error) {
+	var buf [8]byte
+	n, err := io.ReadFull(r, buf[:])
+	total := int64(n)
+	if err != nil {
+		return total, fmt.Errorf("sharded: reading header: %v", err)
+	}
+
+	l := binary.BigEndian.Uint64(buf[:])
+	if l == 0 {
+		return total, fmt.Errorf("sharded: no shards found")
+	}
+
+	var shards []shard
+	for i := uint64(0); i < l; i++ {
+		sh := &bloom.Header{}
+		n, err := sh.ReadFrom(r)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("sharded: header says %d shards, only %d found: %v", l, i, err)
+		}
+
+		cr := &countingReader{r: r}
+		bf, err := bloom.Decode(sh, cr)
+		total += cr.n
+		if err != nil {
+			return total, fmt.Errorf("sharded: reading shard %d: %v", i, err)
+		}
+
+		shards = append(shards, shard{bf: bf})
+	}
+
+	this.n = uint(h.N)
+	this.shards = shards
+
+	return total, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the WriteTo encoding.
+func (this *ShardedBloom) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := this.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using the ReadFrom encoding.
+func (this *ShardedBloom) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := this.ReadFrom(r); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("sharded: %d trailing bytes after last shard", r.Len())
+	}
+
+	return nil
+}
+
+// countingReader counts the bytes read through it, so the bytes consumed by a shard decoded
+// with bloom.Decode can be added to the total returned by ReadFrom.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.n += int64(n)
+	return n, err
+}
+
+// ReadByte lets compressed shards be decoded without reading past their end, one byte at a
+// time from the underlying reader.
+func (this *countingReader) ReadByte() (byte, error) {
+	var (
+		b   [1]byte
+		err error
+	)
+
+	if br, ok := this.r.(io.ByteReader); ok {
+		b[0], err = br.ReadByte()
+	} else {
+		_, err = io.ReadFull(this.r, b[:])
+	}
+
+	if err == nil {
+		this.n++
+	}
+	return b[0], err
+}
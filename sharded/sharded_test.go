@@ -0,0 +1,422 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/partitioned"
+	"github.com/zhenjl/bloom/scalable"
+	"github.com/zhenjl/bloom/standard"
+)
+
+var (
+	web2, web2a []string
+)
+
+func init() {
+	file, err := os.Open("/usr/share/dict/web2")
+	if err != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2 - " + err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		web2 = append(web2, scanner.Text())
+	}
+
+	if err = scanner.Err(); err != nil {
+		fmt.Println("Error reading file - " + err.Error())
+	}
+
+	file2, err2 := os.Open("/usr/share/dict/web2a")
+	if err2 != nil {
+		fmt.Println("Cannot open /usr/share/dict/web2a - " + err2.Error())
+	}
+	defer file2.Close()
+
+	scanner = bufio.NewScanner(file2)
+	for scanner.Scan() {
+		web2a = append(web2a, scanner.Text())
+	}
+
+	if err2 = scanner.Err(); err2 != nil {
+		fmt.Println("Error reading file - " + err2.Error())
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	ctors := map[string]func(uint) bloom.Bloom{
+		"standard":    standard.New,
+		"partitioned": partitioned.New,
+		"scalable":    scalable.New,
+	}
+
+	for name, ctor := range ctors {
+		fmt.Printf("\n\nTesting %s shards with size %d\n", name, len(web2))
+		bf := New(uint(len(web2)), 8, ctor)
+
+		fn, fp := 0, 0
+		for l := range web2 {
+			if !(bf.Add([]byte(web2[l])).Check([]byte(web2[l]))) {
+				fn++
+			}
+		}
+
+		for l := range web2a {
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
+		fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+
+		if fn > 0 {
+			t.Errorf("%s: %d false negatives", name, fn)
+		}
+
+		// Each shard is built for 0.1%, the filter can't do much worse.
+		if rate := float64(fp) / float64(len(web2a)); rate > 0.005 {
+			t.Errorf("%s: false positive rate %f, expected about 0.001", name, rate)
+		}
+
+		if bf.Count() != uint64(len(web2)) {
+			t.Errorf("%s: Count = %d, expected %d", name, bf.Count(), len(web2))
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	bf := New(uint(len(web2)), 16, nil).(*ShardedBloom)
+	if bf.Shards() != 16 {
+		t.Fatalf("Expected 16 shards, got %d", bf.Shards())
+	}
+
+	for _, w := range web2 {
+		bf.Add([]byte(w))
+	}
+
+	// Every key is in its own shard only, and the shards are evenly loaded.
+	for _, w := range web2[:1000] {
+		i := bf.index([]byte(w))
+		if !bf.shards[i].bf.Check([]byte(w)) {
+			t.Fatalf("Expected to find %q in shard %d", w, i)
+		}
+	}
+
+	for i := range bf.shards {
+		c := bf.shards[i].bf.Count()
+		if want := uint64(len(web2) / 16); c < want*9/10 || c > want*11/10 {
+			t.Errorf("Shard %d holds %d items, expected about %d", i, c, want)
+		}
+
+		if p := bf.shards[i].bf.Params(); p.N != uint(len(web2)+15)/16 {
+			t.Errorf("Shard %d built for %d items, expected %d", i, p.N, (len(web2)+15)/16)
+		}
+	}
+
+	if New(100, 0, nil).(*ShardedBloom).Shards() != 1 {
+		t.Errorf("Expected 1 shard for 0 shards")
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	items := make([][]byte, len(web2))
+	for i, w := range web2 {
+		items[i] = []byte(w)
+	}
+
+	a := New(uint(len(web2)), 8, nil)
+	b := New(uint(len(web2)), 8, nil)
+
+	a.(*ShardedBloom).AddAll(items)
+	for _, item := range items {
+		b.Add(item)
+	}
+
+	if a.Count() != b.Count() {
+		t.Errorf("AddAll: Count = %d, expected %d", a.Count(), b.Count())
+	}
+
+	var ba, bb bytes.Buffer
+	a.(*ShardedBloom).WriteTo(&ba)
+	b.(*ShardedBloom).WriteTo(&bb)
+	if !bytes.Equal(ba.Bytes(), bb.Bytes()) {
+		t.Errorf("AddAll and Add built different filters")
+	}
+}
+
+// TestConcurrent adds and checks items from many goroutines at once. Run it with -race.
+func TestConcurrent(t *testing.T) {
+	const (
+		workers = 32
+		items   = 1000
+	)
+
+	bf := New(workers*items, 8, nil)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			var key [8]byte
+			for i := 0; i < items; i++ {
+				binary.BigEndian.PutUint64(key[:], uint64(w*items+i))
+				if !bf.Add(key[:]).Check(key[:]) {
+					t.Errorf("Expected to find item %d", w*items+i)
+					return
+				}
+
+				binary.BigEndian.PutUint64(key[:], uint64(((w+1)%workers)*items+i))
+				bf.Check(key[:])
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if bf.Count() != workers*items {
+		t.Errorf("Expected %d items, got %d", workers*items, bf.Count())
+	}
+}
+
+func TestStats(t *testing.T) {
+	bf := New(uint(len(web2)), 4, nil)
+	for _, w := range web2 {
+		bf.Add([]byte(w))
+	}
+
+	s := bf.Stats()
+	if len(s.Shards) != 4 {
+		t.Fatalf("Expected stats of 4 shards, got %d", len(s.Shards))
+	}
+
+	var (
+		c  uint64
+		m  uint
+		fr float64
+	)
+	for _, v := range s.Shards {
+		c += v.Count
+		m += v.Params.M
+		fr += v.FillRatio / 4
+	}
+
+	if s.Count != c || s.Count != bf.Count() {
+		t.Errorf("Stats.Count = %d, expected %d", s.Count, c)
+	}
+
+	if s.Params.M != m || s.Params.N != uint(len(web2)) || s.Params.K != s.Shards[0].Params.K {
+		t.Errorf("Stats.Params = %+v, expected M = %d, N = %d", s.Params, m, len(web2))
+	}
+
+	// FillRatio divides the sum rather than each term, so it may differ in the last bits
+	if s.FillRatio != fr || math.Abs(bf.FillRatio()-fr) > 1e-12 {
+		t.Errorf("Stats.FillRatio = %f, expected %f", s.FillRatio, fr)
+	}
+
+	var buf bytes.Buffer
+	if err := bf.WriteStats(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "Shard #3") {
+		t.Errorf("WriteStats doesn't list the shards:\n%s", buf.String())
+	}
+}
+
+func TestSerialization(t *testing.T) {
+	bf := New(uint(len(web2)/10), 4, standard.New)
+	for l := 0; l < len(web2)/10; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.(*ShardedBloom).Encode(&buf, &bloom.WriteOptions{Compression: bloom.CompressionGzip}); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailing")
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.String() != "trailing" {
+		t.Errorf("Load read past the end of the filter, %q left", buf.String())
+	}
+
+	if bf2.Count() != bf.Count() || bf2.Params() != bf.Params() {
+		t.Errorf("Loaded %v, expected %v", bf2, bf)
+	}
+
+	for l := 0; l < len(web2)/10; l++ {
+		if !bf2.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q after loading", web2[l])
+		}
+	}
+
+	data, err := bf.(*ShardedBloom).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf3 := &ShardedBloom{}
+	if err := bf3.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf3.String() != bf.(*ShardedBloom).String() {
+		t.Errorf("Unmarshaled %v, expected %v", bf3, bf)
+	}
+
+	if err := bf3.UnmarshalBinary(append(data, 0)); err == nil {
+		t.Errorf("Expected an error for trailing bytes")
+	}
+}
+
+func TestUnion(t *testing.T) {
+	for name, ctor := range map[string]func(uint) bloom.Bloom{"partitioned": partitioned.New, "scalable": scalable.New} {
+		n := len(web2) / 10
+		a, b := New(uint(2*n), 4, ctor).(*ShardedBloom), New(uint(2*n), 4, ctor).(*ShardedBloom)
+		for l := 0; l < n; l++ {
+			a.Add([]byte(web2[l]))
+			b.Add([]byte(web2[n+l]))
+		}
+
+		if err := a.Union(b); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for l := 0; l < 2*n; l++ {
+			if !a.Check([]byte(web2[l])) {
+				t.Fatalf("%s: Expected to find %q after Union", name, web2[l])
+			}
+		}
+	}
+
+	a := New(1000, 4, nil).(*ShardedBloom)
+	for name, b := range map[string]bloom.Bloom{
+		"shards":   New(1000, 2, nil),
+		"kind":     New(1000, 4, standard.New),
+		"params":   New(100000, 4, nil),
+		"standard": New(1000, 4, standard.New),
+	} {
+		c := a
+		if name == "standard" {
+			c = New(1000, 4, standard.New).(*ShardedBloom)
+		}
+
+		if err := c.Union(b.(*ShardedBloom)); !errors.Is(err, bloom.ErrIncompatible) {
+			t.Errorf("%s: Expected ErrIncompatible, got %v", name, err)
+		}
+	}
+
+	unnamed, other := New(1000, 4, nil).(*ShardedBloom), New(1000, 4, nil).(*ShardedBloom)
+	unnamed.SetHasher(fnv.New64())
+	other.SetHasher(fnv.New64())
+	if err := unnamed.Union(other); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for hashers set by SetHasher, got %v", err)
+	}
+}
+
+func TestSetters(t *testing.T) {
+	bf := New(1000, 4, nil).(*ShardedBloom)
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range bf.shards {
+		if e := bf.shards[i].bf.Params().E; e != 0.01 {
+			t.Errorf("Shard %d has e = %f, expected 0.01", i, e)
+		}
+	}
+
+	if err := bf.SetNamedHasher("md5"); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf.HasherName() != "md5" {
+		t.Errorf("HasherName = %q, expected md5", bf.HasherName())
+	}
+
+	bf.Add([]byte("hello"))
+
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Errorf("Setting the same error probability: %v", err)
+	}
+
+	for _, err := range []error{bf.SetErrorProbability(0.02), bf.SetFillRatio(0.4), bf.SetHasher(fnv.New64())} {
+		if !errors.Is(err, bloom.ErrNotEmpty) {
+			t.Errorf("Expected ErrNotEmpty, got %v", err)
+		}
+	}
+
+	if err := bf.SetErrorProbability(2); !errors.Is(err, bloom.ErrInvalidErrorRate) {
+		t.Errorf("Expected ErrInvalidErrorRate, got %v", err)
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf.Clear()
+	if bf.Count() != 0 || bf.Check([]byte("hello")) {
+		t.Errorf("Expected an empty filter after Clear")
+	}
+
+	if c.Count() != 1 || !c.Check([]byte("hello")) {
+		t.Errorf("Clear changed the clone")
+	}
+}
+
+func BenchmarkParallelCheck(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			bf := New(uint(len(web2)), shards, nil)
+			for _, w := range web2 {
+				bf.Add([]byte(w))
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var key [8]byte
+				for i := uint64(0); pb.Next(); i++ {
+					binary.BigEndian.PutUint64(key[:], i)
+					if i%4 == 0 {
+						bf.Add(key[:])
+					} else {
+						bf.Check(key[:])
+					}
+				}
+			})
+		})
+	}
+}
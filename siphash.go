@@ -0,0 +1,163 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/bits"
+)
+
+// SipHashFamily is the family of the hashers returned by SipHashName, see
+// RegisterHasherFamily. The parameter is the 16 byte key.
+const SipHashFamily = "siphash-2-4"
+
+func init() {
+	RegisterHasherFamily(SipHashFamily, func(params []byte) (hash.Hash, error) {
+		if len(params) != 16 {
+			return nil, errors.New("the key must be 16 bytes")
+		}
+		return SipHash([16]byte(params)).Hash(), nil
+	})
+}
+
+// SipHash returns a Hasher keyed by key, hashing with SipHash-2-4. The first value is the
+// SipHash of the item, the second the hash mixed with the splitmix64 finalizer.
+//
+// It protects filters holding items chosen by an adversary. With a known hash function,
+// such as the default fnv64, anyone can compute the positions of an item, and so pick items
+// whose bits are all set in a filter: they can check them offline against a copy of the
+// filter, or pick the items they add so that the bits of other items get set. A filter
+// flooded with such items answers true for them, up to a false positive rate of 100% for
+// the items of the adversary. SipHash is a pseudorandom function: without the key, the
+// positions of an item can't be predicted from those of other items, so the adversary can
+// do no better than guessing, and gets the false positive rate of the filter.
+//
+// The key must be kept secret, random, and different for each deployment, see
+// NewSipHashKey. A filter using a key set with SipHashName records the key in its header
+// when serialized, see RegisterHasherFamily, so its files must be as secret as the key. The
+// protection doesn't hide the answers of Check: an adversary who can query the filter
+// repeatedly can still look for items it answers true for, only not faster than by trying
+// items at random. A leaked key is replaced with Rebuilder.RotateKey.
+func SipHash(key [16]byte) Hasher {
+	k0 := binary.LittleEndian.Uint64(key[0:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+
+	return func(item []byte) (uint64, uint64) {
+		v := sipHash(k0, k1, item)
+		return v, splitmix64(v)
+	}
+}
+
+// SipHashName returns the name of the hasher hashing with SipHash(key), for
+// SetNamedHasher.
+func SipHashName(key [16]byte) string {
+	return FamilyHasherName(SipHashFamily, key[:])
+}
+
+// NewSipHashKey returns a random key for SipHash from crypto/rand.
+func NewSipHashKey() [16]byte {
+	var key [16]byte
+	rand.Read(key[:])
+	return key
+}
+
+// ErrNoNamedHasher is returned by RotateKey for a filter whose hasher can't be set by name.
+var ErrNoNamedHasher = errors.New("bloom: filter has no SetNamedHasher")
+
+// RotateKey replaces the filter in use with a filter keyed with SipHash(key), holding the
+// keys of source. Changing the key of a filter moves all its items to other positions, so
+// the filters refuse it once items have been added, returning ErrNotEmpty, and the items
+// must be added again. The new filter is a clone of the filter in use emptied by Clear,
+// keyed with SetNamedHasher(SipHashName(key)) so the key is recorded when the filter is
+// serialized. It is then filled by Rebuild, so Check keeps answering with the old key in
+// the meantime. It returns an error wrapping ErrNoNamedHasher if the filter has no
+// SetNamedHasher method, as for filters returned by Safe.
+func (this *Rebuilder) RotateKey(ctx context.Context, key [16]byte, source Source) error {
+	next, err := this.Filter().Clone()
+	if err != nil {
+		return err
+	}
+
+	next.Clear()
+
+	nh, ok := next.(interface{ SetNamedHasher(string) error })
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNoNamedHasher, next)
+	}
+
+	if err := nh.SetNamedHasher(SipHashName(key)); err != nil {
+		return err
+	}
+
+	return this.Rebuild(ctx, next, source)
+}
+
+// sipHash returns the SipHash-2-4 of b with the key k0, k1.
+func sipHash(k0, k1 uint64, b []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	n := len(b)
+	for ; len(b) >= 8; b = b[8:] {
+		m := binary.LittleEndian.Uint64(b)
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+	}
+
+	// The last block holds the remaining bytes and the length in its top byte
+	m := uint64(n) << 56
+	for i, c := range b {
+		m |= uint64(c) << (8 * i)
+	}
+
+	v3 ^= m
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= m
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}
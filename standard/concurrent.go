@@ -0,0 +1,317 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standard
+
+import (
+	"encoding/binary"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zhenjl/bloom"
+)
+
+// ConcurrentBloom is a StandardBloom for concurrent use tuned for workloads that mostly
+// check items. Check takes no lock: the bits are read and set with atomic operations, and
+// the methods that rebuild the filter, such as Reset and SetHasher, build a new filter and
+// swap it in. Add and the other methods hold a lock, so only one of them runs at a time.
+//
+// Check also counts the checks returning true and false, reported by Stats as Hits and
+// Misses.
+type ConcurrentBloom struct {
+	// mu serializes Add and the methods other than Check and Count.
+	mu sync.Mutex
+
+	// bf is the filter. Its bit array and count are only accessed atomically, except while
+	// holding mu.
+	bf atomic.Pointer[StandardBloom]
+
+	// hits and misses count the checks returning true and false.
+	hits, misses atomic.Uint64
+}
+
+var _ bloom.Bloom = (*ConcurrentBloom)(nil)
+
+// NewConcurrent returns a ConcurrentBloom holding bf, which must not be used directly
+// afterwards.
+func NewConcurrent(bf *StandardBloom) *ConcurrentBloom {
+	this := &ConcurrentBloom{}
+	this.bf.Store(bf)
+	return this
+}
+
+func (this *ConcurrentBloom) Add(item []byte) bloom.Bloom {
+	this.mu.Lock()
+	this.add(item)
+	this.mu.Unlock()
+	return this
+}
+
+// add sets the bits of item atomically, so Check can read them concurrently.
+func (this *ConcurrentBloom) add(item []byte) {
+	bf := this.bf.Load()
+	words := bf.b.Bytes()
+
+	bf.bits(item)
+	for _, v := range bf.bs[:bf.k] {
+		atomic.OrUint64(&words[v>>6], 1<<(v&63))
+	}
+	atomic.AddUint64(&bf.c, 1)
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *ConcurrentBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafeBytes(s))
+}
+
+// AddUint64 is the same as Add of the 8 byte big endian encoding of v, without allocating.
+func (this *ConcurrentBloom) AddUint64(v uint64) bloom.Bloom {
+	this.mu.Lock()
+	bf := this.bf.Load()
+	binary.BigEndian.PutUint64(bf.u64[:], v)
+	this.add(bf.u64[:])
+	this.mu.Unlock()
+	return this
+}
+
+// Check returns true if item may have been added to the filter. It takes no lock, and runs
+// concurrently with all the other methods.
+func (this *ConcurrentBloom) Check(item []byte) bool {
+	bf := this.bf.Load()
+	s := bf.hp.Get()
+	ok := this.check(bf, s, item)
+	bf.hp.Put(s)
+	return ok
+}
+
+func (this *ConcurrentBloom) check(bf *StandardBloom, s *bloom.Scratch, item []byte) bool {
+	words := bf.b.Bytes()
+	bs := s.Positions(bf.k)
+
+	bits(s.H, s.Loc, item, bs, bf.m, s.Sum[:0], bf.digest)
+	for _, v := range bs {
+		if atomic.LoadUint64(&words[v>>6])&(1<<(v&63)) == 0 {
+			this.misses.Add(1)
+			return false
+		}
+	}
+
+	this.hits.Add(1)
+	return true
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *ConcurrentBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// CheckUint64 is the same as Check of the 8 byte big endian encoding of v, without
+// allocating.
+func (this *ConcurrentBloom) CheckUint64(v uint64) bool {
+	bf := this.bf.Load()
+	s := bf.hp.Get()
+	binary.BigEndian.PutUint64(s.U64[:], v)
+	ok := this.check(bf, s, s.U64[:])
+	bf.hp.Put(s)
+	return ok
+}
+
+// Count returns the number of items added. Like Check, it takes no lock.
+func (this *ConcurrentBloom) Count() uint64 {
+	return atomic.LoadUint64(&this.bf.Load().c)
+}
+
+// Hits returns the number of checks that returned true, and Misses those that returned
+// false.
+func (this *ConcurrentBloom) Hits() uint64 {
+	return this.hits.Load()
+}
+
+func (this *ConcurrentBloom) Misses() uint64 {
+	return this.misses.Load()
+}
+
+// rebuild calls f with an empty copy of the filter, using a clone of its hasher, and swaps
+// it in if f succeeds. Unlike changing the filter in place, this doesn't race with Check.
+func (this *ConcurrentBloom) rebuild(f func(bf *StandardBloom) error) error {
+	bf := this.bf.Load()
+
+	h, err := bloom.CloneHasher(bf.hn, bf.h)
+	if err != nil {
+		return err
+	}
+
+	nb := &StandardBloom{n: bf.n, p: bf.p, e: bf.e, k: bf.k, pinned: bf.pinned, pow2: bf.pow2, digest: bloom.DigestFlags}
+	nb.setHasher(h, bf.hn)
+	nb.Reset()
+
+	if err := f(nb); err != nil {
+		return err
+	}
+
+	this.bf.Store(nb)
+	return nil
+}
+
+// SetHasher sets the hash function, see StandardBloom.SetHasher.
+func (this *ConcurrentBloom) SetHasher(h hash.Hash) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.bf.Load().c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	return this.rebuild(func(bf *StandardBloom) error {
+		return bf.SetHasher(h)
+	})
+}
+
+// SetHashFunc sets the hash function to f, see StandardBloom.SetHashFunc.
+func (this *ConcurrentBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+// Reset replaces the filter with an empty one, recomputing k and m.
+func (this *ConcurrentBloom) Reset() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err := this.rebuild(func(*StandardBloom) error { return nil }); err != nil {
+		// The hasher can't be cloned, clear the bits instead
+		this.clear()
+	}
+}
+
+// Clear removes all the items from the filter, keeping the parameters and the bit array.
+func (this *ConcurrentBloom) Clear() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	this.clear()
+}
+
+func (this *ConcurrentBloom) clear() {
+	bf := this.bf.Load()
+	words := bf.b.Bytes()
+	for i := range words {
+		atomic.StoreUint64(&words[i], 0)
+	}
+	atomic.StoreUint64(&bf.c, 0)
+}
+
+// SetErrorProbability sets the error probability, see StandardBloom.SetErrorProbability.
+func (this *ConcurrentBloom) SetErrorProbability(e float64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// Unless the filter is empty and e changes, this doesn't write to the filter
+	bf := this.bf.Load()
+	if err := bloom.ValidateErrorRate(e); err != nil || bf.c > 0 || e == bf.e {
+		return bf.SetErrorProbability(e)
+	}
+
+	return this.rebuild(func(bf *StandardBloom) error {
+		return bf.SetErrorProbability(e)
+	})
+}
+
+// SetFillRatio sets the fill ratio, see StandardBloom.SetFillRatio.
+func (this *ConcurrentBloom) SetFillRatio(p float64) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	bf := this.bf.Load()
+	if err := bloom.ValidateFillRatio(p); err != nil || bf.c > 0 || p == bf.p {
+		return bf.SetFillRatio(p)
+	}
+
+	return this.rebuild(func(bf *StandardBloom) error {
+		return bf.SetFillRatio(p)
+	})
+}
+
+func (this *ConcurrentBloom) FillRatio() float64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.Load().FillRatio()
+}
+
+func (this *ConcurrentBloom) EstimatedFillRatio() float64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.Load().EstimatedFillRatio()
+}
+
+func (this *ConcurrentBloom) Params() bloom.Params {
+	return this.bf.Load().Params()
+}
+
+// Clone returns a ConcurrentBloom holding a deep copy of the filter, see StandardBloom.Clone.
+// The counts of hits and misses start from 0.
+func (this *ConcurrentBloom) Clone() (bloom.Bloom, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	bf, err := this.bf.Load().Clone()
+	if err != nil {
+		return nil, err
+	}
+	return NewConcurrent(bf.(*StandardBloom)), nil
+}
+
+func (this *ConcurrentBloom) ApproximateCardinality() uint64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.Load().ApproximateCardinality()
+}
+
+func (this *ConcurrentBloom) CurrentFalsePositiveRate() float64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.Load().CurrentFalsePositiveRate()
+}
+
+func (this *ConcurrentBloom) MemoryUsage() uint64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.bf.Load().MemoryUsage()
+}
+
+// Stats returns the statistics of the filter, including the counts of Check calls.
+func (this *ConcurrentBloom) Stats() bloom.Stats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	stats := this.bf.Load().Stats()
+	stats.Hits, stats.Misses = this.hits.Load(), this.misses.Load()
+	stats.Checks = stats.Hits + stats.Misses
+	return stats
+}
+
+// WriteStats writes the statistics returned by Stats to w in a human readable form.
+func (this *ConcurrentBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *ConcurrentBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standard
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/zhenjl/bloom"
+)
+
+const (
+	// DeltaMagic is written at the start of every delta.
+	DeltaMagic = "BLMD"
+
+	// DeltaVersion is the current version of the delta format.
+	DeltaVersion = 1
+)
+
+var (
+	// ErrDeltaGap is returned by ApplyDelta for a delta that doesn't follow the last one
+	// applied, meaning the deltas in between were missed.
+	ErrDeltaGap = errors.New("standard: delta out of sequence")
+
+	// ErrDeltaMismatch is returned by ApplyDelta for a delta written by a filter of a
+	// different size, or that isn't a delta at all.
+	ErrDeltaMismatch = errors.New("standard: delta doesn't match filter")
+)
+
+// Checkpoint writes to w a delta holding the positions of the bits set since the previous
+// checkpoint, numbered with the next sequence number. The first call starts tracking the
+// bits set by Add, and writes every bit set so far, so that an empty filter with the same
+// parameters can apply it. If writing fails, the bits are kept for the next checkpoint.
+//
+// A delta is written as DeltaMagic, DeltaVersion, and m, the sequence number and the count
+// of items as big endian uint64, followed by the number of bit positions and their gaps as
+// uvarints, in increasing order.
+//
+// Reset clears bits, which deltas cannot carry, so readers need a full copy after it.
+func (this *StandardBloom) Checkpoint(w io.Writer) (int64, error) {
+	var pos []uint
+
+	if this.tracking {
+		sort.Slice(this.pending, func(i, j int) bool { return this.pending[i] < this.pending[j] })
+		pos = this.pending
+	} else {
+		for i, ok := this.b.NextSet(0); ok; i, ok = this.b.NextSet(i + 1) {
+			pos = append(pos, i)
+		}
+	}
+
+	buf := make([]byte, 0, 29+len(pos)*3)
+	buf = append(buf, DeltaMagic...)
+	buf = append(buf, DeltaVersion)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(this.m))
+	buf = binary.BigEndian.AppendUint64(buf, this.seq+1)
+	buf = binary.BigEndian.AppendUint64(buf, this.c)
+	buf = binary.AppendUvarint(buf, uint64(len(pos)))
+
+	prev := uint(0)
+	for _, v := range pos {
+		buf = binary.AppendUvarint(buf, uint64(v-prev))
+		prev = v
+	}
+
+	n, err := w.Write(buf)
+	if err != nil {
+		return int64(n), err
+	}
+
+	this.seq++
+	this.tracking = true
+	this.pending = this.pending[:0]
+
+	return int64(n), nil
+}
+
+// ApplyDelta reads a delta written by Checkpoint from r and sets its bits. Applying a delta
+// is idempotent, so deltas already applied are accepted again. A delta whose sequence
+// number skips one or more deltas isn't applied, and ErrDeltaGap is returned. The filter
+// must then be replaced by a full copy of the writer, followed by SetDeltaSeq with the
+// writer's DeltaSeq at the time of the copy, after which later deltas apply again.
+//
+// ApplyDelta consumes exactly the bytes of one delta from r, even when it returns
+// ErrDeltaGap.
+func (this *StandardBloom) ApplyDelta(r io.Reader) error {
+	// An uncompressed body reader reads bytes without reading past the end of the delta.
+	br, err := bloom.NewBodyReader(r, 0)
+	if err != nil {
+		return err
+	}
+
+	var hdr [29]byte
+	for i := range hdr {
+		b, err := br.ReadByte()
+		if err != nil {
+			return fmt.Errorf("standard: reading delta header: %w", err)
+		}
+		hdr[i] = b
+	}
+
+	if string(hdr[:4]) != DeltaMagic || hdr[4] != DeltaVersion {
+		return fmt.Errorf("%w: bad magic %q or version %d", ErrDeltaMismatch, hdr[:4], hdr[4])
+	}
+
+	m := binary.BigEndian.Uint64(hdr[5:13])
+	seq := binary.BigEndian.Uint64(hdr[13:21])
+	c := binary.BigEndian.Uint64(hdr[21:29])
+
+	if m != uint64(this.m) {
+		return fmt.Errorf("%w: delta for m = %d, filter has m = %d", ErrDeltaMismatch, m, this.m)
+	}
+
+	cnt, err := binary.ReadUvarint(br)
+	if err != nil {
+		return fmt.Errorf("standard: reading delta: %w", err)
+	}
+
+	if cnt > m {
+		return fmt.Errorf("standard: %d positions in a delta for m = %d", cnt, m)
+	}
+
+	pos := make([]uint, cnt)
+	prev := uint64(0)
+	for i := range pos {
+		d, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("standard: reading delta position %d of %d: %w", i, cnt, err)
+		}
+
+		prev += d
+		if prev >= m {
+			return fmt.Errorf("standard: delta position %d out of range for m = %d", prev, m)
+		}
+		pos[i] = uint(prev)
+	}
+
+	if seq > this.seq+1 {
+		return fmt.Errorf("%w: got delta %d after delta %d", ErrDeltaGap, seq, this.seq)
+	}
+
+	for _, v := range pos {
+		this.set(v)
+	}
+
+	if seq > this.seq {
+		this.seq, this.c = seq, c
+	}
+
+	return nil
+}
+
+// DeltaSeq returns the sequence number of the last delta written by Checkpoint or applied
+// by ApplyDelta, or set by SetDeltaSeq.
+func (this *StandardBloom) DeltaSeq() uint64 {
+	return this.seq
+}
+
+// SetDeltaSeq sets the sequence number of the last delta applied. It is called after
+// replacing a reader's bits with a full copy of the writer, passing the writer's DeltaSeq
+// at the time of the copy.
+func (this *StandardBloom) SetDeltaSeq(seq uint64) {
+	this.seq = seq
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standard
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/willf/bitset"
+	"github.com/zhenjl/bloom"
+)
+
+// FingerprintBloom is a standard filter paired with a table of n 8-bit fingerprints, one
+// slot per expected item. Each item is hashed to a slot and a non-zero fingerprint, and Check
+// only returns true if the item passes the bloom test and its slot holds its fingerprint.
+// An item whose slot already holds another fingerprint marks the slot as collided, and items
+// of collided slots only take the bloom test, so an item added is always found.
+//
+// The reduction of the false positive rate depends on the load of the table. A false
+// positive of the bloom filter is only kept if its slot is collided, or holds the same
+// fingerprint, so with c items in n slots the rate is multiplied by about
+// 1 - e^(-c/n) * (1 + c/n) + e^(-c/n) * c/n / 255: 1/11000 for c = n/100, as most slots are
+// empty, 1/200 for c = n/10, 1/11 for c = n/2 and only 1/4 for c = n, as a quarter of the
+// slots are collided. Stats reports the collisions, and the resulting rate. The 8 bits per
+// item the table costs would divide the rate by about 50 at capacity if spent on the bit
+// array instead, for e = 0.01, so the table is worth it for filters used well below their
+// capacity.
+//
+// FingerprintBloom has no serialization. Like StandardBloom, it is not safe for concurrent
+// use, except for Check.
+type FingerprintBloom struct {
+	// bf is the bloom filter, sharing its hasher with the fingerprints
+	bf *StandardBloom
+
+	// fps holds the fingerprint of each slot, 0 if it is empty
+	fps []uint8
+
+	// collided marks the slots of items with different fingerprints
+	collided *bitset.BitSet
+
+	// used is the number of slots not empty, and collisions the number of collided slots
+	used, collisions uint
+}
+
+var (
+	_ bloom.Bloom        = (*FingerprintBloom)(nil)
+	_ bloom.Introspector = (*FingerprintBloom)(nil)
+)
+
+// NewWithFingerprints initializes a new standard bloom filter for n items with a false
+// positive probability of e, with a table of n fingerprints further reducing it.
+func NewWithFingerprints(n uint, e float64) bloom.Bloom {
+	slots := max(n, 1)
+	return &FingerprintBloom{
+		bf:       NewWithEstimates(n, e).(*StandardBloom),
+		fps:      make([]uint8, slots),
+		collided: bitset.New(slots),
+	}
+}
+
+// SetHasher sets the hash function of the filter and of the fingerprints. It returns
+// bloom.ErrNotEmpty if the filter isn't empty.
+func (this *FingerprintBloom) SetHasher(h hash.Hash) error {
+	return this.bf.SetHasher(h)
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. It returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *FingerprintBloom) SetNamedHasher(name string) error {
+	return this.bf.SetNamedHasher(name)
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *FingerprintBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+func (this *FingerprintBloom) Reset() {
+	this.bf.Reset()
+	this.clearTable()
+}
+
+// Clear removes all the items from the filter, zeroing the bit array and the fingerprints.
+func (this *FingerprintBloom) Clear() {
+	this.bf.Clear()
+	this.clearTable()
+}
+
+func (this *FingerprintBloom) clearTable() {
+	clear(this.fps)
+	this.collided.ClearAll()
+	this.used, this.collisions = 0, 0
+}
+
+// SetErrorProbability sets the error probability e of the bloom filter, see
+// StandardBloom.SetErrorProbability.
+func (this *FingerprintBloom) SetErrorProbability(e float64) error {
+	return this.bf.SetErrorProbability(e)
+}
+
+// SetFillRatio sets the fill ratio p of the bloom filter, see StandardBloom.SetFillRatio.
+func (this *FingerprintBloom) SetFillRatio(p float64) error {
+	return this.bf.SetFillRatio(p)
+}
+
+// K returns the number of hash values of each item.
+func (this *FingerprintBloom) K() uint {
+	return this.bf.k
+}
+
+// M returns the number of bits of the bloom filter.
+func (this *FingerprintBloom) M() uint {
+	return this.bf.m
+}
+
+// S returns 0, as the standard filter has no partitions.
+func (this *FingerprintBloom) S() uint {
+	return 0
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *FingerprintBloom) HasherName() string {
+	return this.bf.hn
+}
+
+// Params returns the parameters of the bloom filter.
+func (this *FingerprintBloom) Params() bloom.Params {
+	return this.bf.Params()
+}
+
+// Slots returns the number of slots of the fingerprint table.
+func (this *FingerprintBloom) Slots() uint {
+	return uint(len(this.fps))
+}
+
+// Collisions returns the number of slots holding items with different fingerprints, whose
+// items only take the bloom test.
+func (this *FingerprintBloom) Collisions() uint {
+	return this.collisions
+}
+
+func (this *FingerprintBloom) Add(item []byte) bloom.Bloom {
+	v := this.bf.bits(item)
+	for _, i := range this.bf.bs[:this.bf.k] {
+		this.bf.set(i)
+	}
+	this.bf.c++
+
+	slot, fp := this.fingerprint(this.bf.h, this.bf.loc, item, v, this.bf.sum[:])
+	switch v := this.fps[slot]; {
+	case v == 0:
+		this.fps[slot] = fp
+		this.used++
+	case v != fp && !this.collided.Test(slot):
+		this.collided.Set(slot)
+		this.collisions++
+	}
+
+	return this
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *FingerprintBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafeBytes(s))
+}
+
+// Check returns true if item may have been added to the filter: it must pass the bloom test,
+// and its slot must hold its fingerprint or be collided. It doesn't write to the filter, so
+// it is safe to call concurrently with other Checks, but not with Add.
+func (this *FingerprintBloom) Check(item []byte) bool {
+	s := this.bf.hp.Get()
+	defer this.bf.hp.Put(s)
+
+	bs := s.Positions(this.bf.k)
+	v := bits(s.H, s.Loc, item, bs, this.bf.m, s.Sum[:0], this.bf.digest)
+	for _, i := range bs {
+		if !this.bf.b.Test(i) {
+			return false
+		}
+	}
+
+	slot, fp := this.fingerprint(s.H, s.Loc, item, v, s.Sum[:])
+	return this.fps[slot] == fp || this.collided.Test(slot)
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *FingerprintBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// fingerprint returns the slot and the fingerprint of item from its hash v, returned by
+// bits. If loc is set, the bit positions weren't derived from the hash, so item is hashed
+// with h, using sum as the buffer for the digest. The hash is mixed with a constant and
+// bloom.Mix64, so the slot and the fingerprint don't depend on the bit positions.
+func (this *FingerprintBloom) fingerprint(h hash.Hash, loc bloom.Locator, item []byte, v uint64, sum []byte) (uint, uint8) {
+	if loc != nil {
+		h.Reset()
+		h.Write(item)
+		v = bloom.Sum64(h, sum)
+	}
+
+	x := bloom.Mix64(v ^ 0x9e3779b97f4a7c15)
+
+	return uint(x % uint64(len(this.fps))), uint8(x>>56%255) + 1
+}
+
+func (this *FingerprintBloom) Count() uint64 {
+	return this.bf.c
+}
+
+func (this *FingerprintBloom) FillRatio() float64 {
+	return this.bf.FillRatio()
+}
+
+func (this *FingerprintBloom) EstimatedFillRatio() float64 {
+	return this.bf.EstimatedFillRatio()
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the bloom filter,
+// computed from the fraction of bits set, times the probability of an item not added
+// passing the fingerprint test: its slot is collided, or holds the same fingerprint.
+func (this *FingerprintBloom) CurrentFalsePositiveRate() float64 {
+	return this.bf.CurrentFalsePositiveRate() * this.pass()
+}
+
+// pass returns the probability of an item not added passing the fingerprint test.
+func (this *FingerprintBloom) pass() float64 {
+	return (float64(this.collisions) + float64(this.used-this.collisions)/255) / float64(len(this.fps))
+}
+
+// ApproximateCardinality estimates the number of distinct items added from the bits set,
+// see StandardBloom.ApproximateCardinality.
+func (this *FingerprintBloom) ApproximateCardinality() uint64 {
+	return this.bf.ApproximateCardinality()
+}
+
+// Clone returns a deep copy of the filter, with a new hasher of the same kind. It returns
+// an error if the hasher can't be recreated, see bloom.CloneHasher.
+func (this *FingerprintBloom) Clone() (bloom.Bloom, error) {
+	bf, err := this.bf.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	c := *this
+	c.bf = bf.(*StandardBloom)
+	c.fps = append([]uint8(nil), this.fps...)
+	c.collided = this.collided.Clone()
+
+	return &c, nil
+}
+
+// tableMemory returns the number of bytes held by the fingerprint table.
+func (this *FingerprintBloom) tableMemory() uint64 {
+	return uint64(cap(this.fps)) + uint64(unsafe.Sizeof(*this.collided)) + 8*uint64(len(this.collided.Bytes()))
+}
+
+// MemoryUsage returns the number of bytes held by the filter: those of the bloom filter,
+// see StandardBloom.MemoryUsage, and the fingerprint table.
+func (this *FingerprintBloom) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)) + this.bf.MemoryUsage() + this.tableMemory()
+}
+
+// String implements fmt.Stringer with a one line summary of the filter.
+func (this *FingerprintBloom) String() string {
+	return fmt.Sprintf("fingerprint{n=%d m=%d k=%d e=%g count=%d slots=%d collisions=%d}", this.bf.n, this.bf.m, this.bf.k, this.bf.e, this.bf.c, len(this.fps), this.collisions)
+}
+
+// Stats returns the statistics of the filter: those of the bloom filter, with the memory
+// held by the fingerprint table and its collisions, and the false positive rate reduced by
+// the fingerprints.
+func (this *FingerprintBloom) Stats() bloom.Stats {
+	stats := this.bf.Stats()
+	stats.FalsePositiveRate *= this.pass()
+	stats.FingerprintBytes = this.tableMemory()
+	stats.FingerprintCollisions = this.collisions
+	return stats
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *FingerprintBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *FingerprintBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+
+	"github.com/zhenjl/bloom"
+)
+
+// ReadOnlyBloom is a StandardBloom that answers Check directly against a serialized bit
+// array, such as a memory mapped file, without copying it into a bitset.BitSet. Its Add
+// method returns an error, so it does not implement bloom.Bloom.
+type ReadOnlyBloom struct {
+	// h is the hash function used to get the list of h1..hk values
+	// By default we use hash/fnv.New64(). User can also set their own using SetHasher()
+	h hash.Hash
+
+	// m, k, n, c, p and e are the parameters of the serialized filter. See StandardBloom.
+	m, k, n uint
+	c       uint64
+	p, e    float64
+
+	// b is the bit array as written by StandardBloom.WriteTo, i.e. 64-bit words in big
+	// endian order.
+	b []byte
+
+	// mm is the memory mapped region holding b, or nil if b is not mapped.
+	mm []byte
+
+	// hp holds the hashers used by Check. See StandardBloom.
+	hp *bloom.HasherPool
+
+	// digest holds the bloom.DigestFlags the filter was written with, see StandardBloom.
+	digest uint16
+}
+
+// OpenMmap memory maps the file at path, which must hold a StandardBloom written by
+// Encode with bloom.EncodingDense and no compression, or by WriteTo or bloom.SaveToFile for
+// filters above bloom.SparseFillRatio, and returns a read-only filter serving Check directly
+// from the mapped pages. The file is never written to. Close must be called to unmap it.
+// On platforms without mmap support, the file is read into memory instead.
+func OpenMmap(path string) (*ReadOnlyBloom, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	mm, err := mmap(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	bf, err := newReadOnly(mm)
+	if err != nil {
+		munmap(mm)
+		return nil, err
+	}
+
+	bf.mm = mm
+	return bf, nil
+}
+
+// ErrReadOnly is returned by ReadOnlyBloom.Add.
+var ErrReadOnly = errors.New("standard: filter is read-only")
+
+// UnsafeFromBytes returns a read-only filter whose bit array aliases b, which must start
+// with a StandardBloom written as for OpenMmap. Nothing is copied, so the caller must keep
+// b alive and unmodified for as long as the filter is used. b need not be aligned, and any
+// bytes after the bit array are ignored. UnmarshalBinary is the copying equivalent.
+func UnsafeFromBytes(b []byte) (*ReadOnlyBloom, error) {
+	return newReadOnly(b)
+}
+
+// newReadOnly returns a read-only filter whose bit array aliases data, which must start
+// with a StandardBloom serialized by WriteTo. Any bytes after the bit array are ignored.
+func newReadOnly(data []byte) (*ReadOnlyBloom, error) {
+	r := bytes.NewReader(data)
+
+	h := &bloom.Header{}
+	if _, err := h.ReadFrom(r); err != nil {
+		return nil, err
+	}
+
+	if h.Kind != bloom.KindStandard {
+		return nil, fmt.Errorf("standard: cannot read %s filter", h.Kind)
+	}
+
+	if h.Flags&(bloom.FlagSparse|bloom.FlagGzip) != 0 {
+		return nil, fmt.Errorf("standard: sparse encoded or compressed filters cannot be read in place")
+	}
+
+	if h.M == 0 || h.K == 0 || h.K > bloom.MaxHashCount {
+		return nil, fmt.Errorf("standard: invalid parameters m = %d, k = %d", h.M, h.K)
+	}
+
+	hf, err := bloom.ResolveHasher(h.Hasher, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	off := len(data) - r.Len()
+	if h.M > uint64(r.Len())*8 {
+		return nil, fmt.Errorf("standard: bit array too short for m = %d, got %d bytes", h.M, r.Len())
+	}
+
+	l := wordsNeeded(uint(h.M)) * 8
+	if r.Len() < l {
+		return nil, fmt.Errorf("standard: bit array too short, need %d bytes for m = %d, got %d", l, h.M, r.Len())
+	}
+
+	return &ReadOnlyBloom{
+		h:      hf,
+		hp:     bloom.NewHasherPool(h.Hasher, hf),
+		m:      uint(h.M),
+		k:      uint(h.K),
+		n:      uint(h.N),
+		c:      h.C,
+		p:      h.P,
+		e:      h.E,
+		b:      data[off : off+l],
+		digest: h.Flags & bloom.DigestFlags,
+	}, nil
+}
+
+// Close releases the memory mapped file, if any. The filter must not be used afterwards.
+func (this *ReadOnlyBloom) Close() error {
+	mm := this.mm
+	this.mm, this.b = nil, nil
+
+	if mm == nil {
+		return nil
+	}
+
+	return munmap(mm)
+}
+
+func (this *ReadOnlyBloom) SetHasher(h hash.Hash) {
+	this.h = h
+	this.hp = bloom.NewHasherPool("", h)
+}
+
+// SetHashFunc is the same as SetHasher(f.Hash()).
+func (this *ReadOnlyBloom) SetHashFunc(f bloom.Hasher) {
+	this.SetHasher(f.Hash())
+}
+
+// Add always returns ErrReadOnly, since the bit array of the filter can't be modified.
+func (this *ReadOnlyBloom) Add(item []byte) error {
+	return ErrReadOnly
+}
+
+// Params returns the parameters of the serialized filter.
+func (this *ReadOnlyBloom) Params() bloom.Params {
+	return bloom.Params{M: this.m, K: this.k, N: this.n, P: this.p, E: this.e, PinnedK: this.k != bloom.K(this.e)}
+}
+
+// Check returns true if item may have been added to the filter. It is safe to call
+// concurrently.
+func (this *ReadOnlyBloom) Check(item []byte) bool {
+	s := this.hp.Get()
+	ok := this.check(s, item)
+	this.hp.Put(s)
+	return ok
+}
+
+// check is Check using the hasher and buffers of s.
+func (this *ReadOnlyBloom) check(s *bloom.Scratch, item []byte) bool {
+	bs := s.Positions(this.k)
+	bits(s.H, s.Loc, item, bs, this.m, s.Sum[:0], this.digest)
+	for _, v := range bs {
+		if !this.test(v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *ReadOnlyBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// CheckUint64 is the same as Check of the 8 byte big endian encoding of v, without
+// allocating.
+func (this *ReadOnlyBloom) CheckUint64(v uint64) bool {
+	s := this.hp.Get()
+	binary.BigEndian.PutUint64(s.U64[:], v)
+	ok := this.check(s, s.U64[:])
+	this.hp.Put(s)
+	return ok
+}
+
+func (this *ReadOnlyBloom) Count() uint64 {
+	return this.c
+}
+
+func (this *ReadOnlyBloom) EstimatedFillRatio() float64 {
+	return 1 - math.Exp((-float64(this.c)*float64(this.k))/float64(this.m))
+}
+
+func (this *ReadOnlyBloom) FillRatio() float64 {
+	return float64(this.count()) / float64(this.m)
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the fraction of bits set, see StandardBloom.
+func (this *ReadOnlyBloom) CurrentFalsePositiveRate() float64 {
+	return math.Pow(this.FillRatio(), float64(this.k))
+}
+
+// Stats returns the statistics of the filter.
+func (this *ReadOnlyBloom) Stats() bloom.Stats {
+	c := this.count()
+
+	return bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.c,
+		BitsSet:            c,
+		FillRatio:          float64(c) / float64(this.m),
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		FalsePositiveRate:  math.Pow(float64(c)/float64(this.m), float64(this.k)),
+	}
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *ReadOnlyBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *ReadOnlyBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+// test reports whether bit i is set. Bit i lives in word i/64, and since words are stored
+// in big endian order, bit i%64 of the word is in the (7 - i%64/8)th byte of the word.
+func (this *ReadOnlyBloom) test(i uint) bool {
+	return this.b[(i>>6)<<3+7-(i&63)>>3]&(1<<(i&7)) != 0
+}
+
+func (this *ReadOnlyBloom) count() uint {
+	c := uint(0)
+	for _, v := range this.b {
+		for ; v != 0; v &= v - 1 {
+			c++
+		}
+	}
+	return c
+}
@@ -15,12 +15,16 @@
 package standard
 
 import (
+	"bytes"
 	"fmt"
 	"hash"
 	"hash/fnv"
 
 	"encoding/binary"
+	"io"
 	"math"
+	"os"
+	"unsafe"
 
 	"github.com/willf/bitset"
 	"github.com/zhenjl/bloom"
@@ -73,61 +77,339 @@ type StandardBloom struct {
 	b *bitset.BitSet
 
 	// c is the number of items we have added to the filter
-	c uint
+	c uint64
 
 	// bs holds the list of bits to be set/check based on the hash values
 	bs []uint
+
+	// sum holds the digest of the last item, so hashing doesn't allocate
+	sum [64]byte
+
+	// u64 holds the encoding of the last integer key
+	u64 [8]byte
+
+	// hn is the name of the hash function, written in the serialized header. It is empty
+	// if the hash function was set using SetHasher().
+	hn string
+
+	// loc is set if the hash function implements bloom.Locator, in which case it is used
+	// to derive the bit positions instead of bits().
+	loc bloom.Locator
+
+	// hp holds the hashers used by Check, so it doesn't write to the filter.
+	hp *bloom.HasherPool
+
+	// digest holds the bloom.DigestFlags the positions are derived with, see
+	// bloom.DigestPositions. New filters use all of them, and filters read use those read,
+	// so filters written before a flag existed keep their positions.
+	digest uint16
+
+	// pow2 is set if m is rounded up to a power of two, see WithPowerOfTwoSize. Filters
+	// read with m a power of two keep rounding it on Reset.
+	pow2 bool
+
+	// tracking is set once Checkpoint has been called. pending then holds the positions of
+	// the bits set since the last checkpoint. seq is the sequence number of the last delta
+	// written by Checkpoint or applied by ApplyDelta.
+	tracking bool
+	pending  []uint
+	seq      uint64
+
+	// pinned is set if k was set with SetHashCount, in which case Reset keeps it and
+	// derives p from it instead. Filters read with k other than bloom.K(e) keep it.
+	pinned bool
 }
 
-var _ bloom.Bloom = (*StandardBloom)(nil)
+var (
+	_ bloom.Bloom        = (*StandardBloom)(nil)
+	_ bloom.Introspector = (*StandardBloom)(nil)
+	_ bloom.Positioner   = (*StandardBloom)(nil)
+)
+
+func init() {
+	bloom.RegisterDecoder(bloom.KindStandard, func(h *bloom.Header, r io.Reader) (bloom.Bloom, error) {
+		bf := &StandardBloom{}
+		if _, err := bf.readBody(h, r); err != nil {
+			return nil, err
+		}
+		return bf, nil
+	})
+}
 
 // New initializes a new partitioned bloom filter.
 // n is the number of items this bloom filter predicted to hold.
 func New(n uint) bloom.Bloom {
-	var (
-		p float64 = 0.5
-		e float64 = 0.001
-		k uint    = bloom.K(e)
-		m uint    = bloom.M(n, p, e)
-	)
-
-	return &StandardBloom{
-		h:  fnv.New64(),
-		n:  n,
-		p:  p,
-		e:  e,
-		k:  k,
-		m:  m,
-		b:  bitset.New(m),
-		bs: make([]uint, k),
-	}
-}
-
-func (this *StandardBloom) SetHasher(h hash.Hash) {
+	return NewWithEstimates(n, 0.001)
+}
+
+// NewFast is the same as New, with the hash function bloom.FastHasher, XXH64, rather than
+// bloom.DefaultHasher. See WithFastHasher.
+func NewFast(n uint) bloom.Bloom {
+	return NewWithOptions(n, 0.001, WithFastHasher())
+}
+
+// NewE is the same as NewWithEstimates, but returns an error instead of building a broken
+// filter if n is 0 or fpRate is not in (0, 1).
+func NewE(n uint, fpRate float64) (bloom.Bloom, error) {
+	if err := bloom.Validate(n, 0.5, fpRate); err != nil {
+		return nil, err
+	}
+	return NewWithEstimates(n, fpRate), nil
+}
+
+// NewWithEstimates initializes a new standard bloom filter for n items with a false
+// positive probability of fpRate. k and m are derived from fpRate with bloom.K and bloom.M.
+func NewWithEstimates(n uint, fpRate float64) bloom.Bloom {
+	return NewWithOptions(n, fpRate)
+}
+
+// Option configures a filter created by NewWithOptions.
+type Option func(*StandardBloom)
+
+// WithPowerOfTwoSize rounds m up to a power of two, see bloom.PowerOfTwo, so the positions
+// are mapped to the bits with a mask rather than a division. The filter takes up to twice
+// the memory, and its false positive rate is below fpRate, as it has more bits than needed.
+// M, Params and Stats report the rounded m, and Reset keeps rounding it.
+func WithPowerOfTwoSize() Option {
+	return func(bf *StandardBloom) {
+		bf.pow2 = true
+	}
+}
+
+// WithFastHasher sets the hash function to bloom.FastHasher, XXH64, which is faster than
+// bloom.DefaultHasher on keys longer than a few bytes and mixes them better. Like the
+// hasher set by SetNamedHasher, its name is recorded when the filter is serialized.
+func WithFastHasher() Option {
+	return func(bf *StandardBloom) {
+		bf.setHasher(bloom.NewXXHash64(0), bloom.FastHasher)
+	}
+}
+
+// WithHashCount pins k, the number of hash values of each item, see SetHashCount. A k out
+// of range is ignored.
+func WithHashCount(k uint) Option {
+	return func(bf *StandardBloom) {
+		if bloom.ValidateHashCount(k) == nil {
+			bf.k, bf.pinned = k, true
+		}
+	}
+}
+
+// NewWithOptions is the same as NewWithEstimates, with the options applied.
+func NewWithOptions(n uint, fpRate float64, opts ...Option) bloom.Bloom {
+	bf := &StandardBloom{
+		n:      n,
+		p:      0.5,
+		e:      fpRate,
+		digest: bloom.DigestFlags,
+	}
+
+	bf.setHasher(fnv.New64(), bloom.DefaultHasher)
+
+	for _, opt := range opts {
+		opt(bf)
+	}
+
+	bf.Reset()
+	return bf
+}
+
+// SetHasher sets the hash function. If it implements bloom.Locator, its Locate method is
+// used to derive the bit positions of each key. The items already added would hash to
+// other positions, so it returns bloom.ErrNotEmpty if the filter isn't empty.
+func (this *StandardBloom) SetHasher(h hash.Hash) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.setHasher(h, "")
+	this.digest = bloom.DigestFlags
+	return nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// bloom.RegisterHasher as name. Unlike SetHasher, the name is recorded when the filter is
+// serialized, so bloom.Load can recreate the same hash function. Like SetHasher, it returns
+// bloom.ErrNotEmpty if the filter isn't empty.
+func (this *StandardBloom) SetNamedHasher(name string) error {
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	h, err := bloom.NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.setHasher(h, name)
+	this.digest = bloom.DigestFlags
+	return nil
+}
+
+// SetHashFunc sets the hash function to f, which holds no state, see bloom.Hasher. It is
+// the same as SetHasher(f.Hash()).
+func (this *StandardBloom) SetHashFunc(f bloom.Hasher) error {
+	return this.SetHasher(f.Hash())
+}
+
+// SetSeed sets the hash function to bloom.SeededHash(seed), so the positions of the items
+// depend on seed. The seed is recorded with the filter when serialized, see
+// bloom.SeededHasherName. Like SetHasher, it returns bloom.ErrNotEmpty if the filter isn't
+// empty. bloom.RandomSeed returns a random seed.
+func (this *StandardBloom) SetSeed(seed uint64) error {
+	return this.SetNamedHasher(bloom.SeededHasherName(seed))
+}
+
+// Seed returns the seed set by SetSeed, or false if the hash function isn't seeded.
+func (this *StandardBloom) Seed() (uint64, bool) {
+	return bloom.SeedOf(this.hn)
+}
+
+// setHasher sets the hash function h, registered as name if name is not empty.
+func (this *StandardBloom) setHasher(h hash.Hash, name string) {
 	this.h = h
+	this.hn = name
+	this.loc, _ = h.(bloom.Locator)
+	this.hp = bloom.NewHasherPool(name, h)
+}
+
+// size returns the number of bits for n, p and e, rounded up to a power of two if pow2 is
+// set.
+func (this *StandardBloom) size() uint {
+	m := bloom.M(this.n, this.p, this.e)
+	if this.pow2 {
+		m = bloom.PowerOfTwo(m)
+	}
+	return m
 }
 
 func (this *StandardBloom) Reset() {
-	this.k = bloom.K(this.e)
-	this.m = bloom.M(this.n, this.p, this.e)
+	if this.pinned {
+		this.p = bloom.P(this.k, this.e)
+	} else {
+		this.k = bloom.K(this.e)
+	}
+
+	this.m = this.size()
 	this.b = bitset.New(this.m)
 	this.bs = make([]uint, this.k)
+	this.c = 0
+	this.pending = this.pending[:0]
 
 	if this.h == nil {
-		this.h = fnv.New64()
+		this.setHasher(fnv.New64(), "")
 	} else {
 		this.h.Reset()
 	}
 }
 
-func (this *StandardBloom) SetErrorProbability(e float64) {
+// Clear removes all the items from the filter. Unlike Reset, it keeps the parameters and
+// the bit array, which is only zeroed, so it doesn't allocate.
+func (this *StandardBloom) Clear() {
+	this.b.ClearAll()
+	this.c = 0
+	this.pending = this.pending[:0]
+}
+
+// SetErrorProbability sets the error probability e, and resets the filter to recompute k
+// and m from it, or p and m if k is pinned by SetHashCount. It returns
+// bloom.ErrInvalidErrorRate if e is not in (0, 1), and bloom.ErrNotEmpty if items have been
+// added, leaving the filter unchanged.
+func (this *StandardBloom) SetErrorProbability(e float64) error {
+	if err := bloom.ValidateErrorRate(e); err != nil {
+		return err
+	}
+
+	if e == this.e {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
 	this.e = e
+	this.Reset()
+	return nil
+}
+
+// SetFillRatio sets the fill ratio p, and resets the filter to recompute m from it. A lower
+// p gives a larger m for the same n and e. With k pinned by SetHashCount, p is derived from
+// k and e, so e is set to p^k instead, the error probability reached at the fill ratio p. It
+// returns bloom.ErrInvalidFillRatio if p is not in (0, 1), and bloom.ErrNotEmpty if items
+// have been added, leaving the filter unchanged.
+func (this *StandardBloom) SetFillRatio(p float64) error {
+	if err := bloom.ValidateFillRatio(p); err != nil {
+		return err
+	}
+
+	if p == this.p {
+		return nil
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.p = p
+	if this.pinned {
+		this.e = math.Pow(p, float64(this.k))
+	}
+
+	this.Reset()
+	return nil
+}
+
+// SetHashCount pins k, the number of hash values of each item, rather than deriving it from
+// e. The fill ratio p is then derived from k and e with bloom.P, and m from p, so the filter
+// keeps the error probability e: fewer hash values take more bits. It resets the filter,
+// and returns bloom.ErrInvalidHashCount if k is not in [1, bloom.MaxHashCount], and
+// bloom.ErrNotEmpty if items have been added, leaving the filter unchanged. Params reports
+// k as pinned.
+func (this *StandardBloom) SetHashCount(k uint) error {
+	if err := bloom.ValidateHashCount(k); err != nil {
+		return err
+	}
+
+	if this.c > 0 {
+		return bloom.ErrNotEmpty
+	}
+
+	this.k, this.pinned = k, true
+	this.Reset()
+	return nil
 }
 
 func (this *StandardBloom) EstimatedFillRatio() float64 {
 	return 1 - math.Exp((-float64(this.c)*float64(this.k))/float64(this.m))
 }
 
+// K returns the number of hash values of each item.
+func (this *StandardBloom) K() uint {
+	return this.k
+}
+
+// M returns the number of bits of the filter.
+func (this *StandardBloom) M() uint {
+	return this.m
+}
+
+// S returns 0, as the standard filter has no partitions.
+func (this *StandardBloom) S() uint {
+	return 0
+}
+
+// HasherName returns the name of the hasher set with SetNamedHasher, or an empty string if
+// it was set with SetHasher.
+func (this *StandardBloom) HasherName() string {
+	return this.hn
+}
+
+// Params returns the parameters of the filter, as computed by the last Reset.
+func (this *StandardBloom) Params() bloom.Params {
+	return bloom.Params{M: this.m, K: this.k, N: this.n, P: this.p, E: this.e, PinnedK: this.pinned}
+}
+
 func (this *StandardBloom) FillRatio() float64 {
 	return float64(this.b.Count()) / float64(this.m)
 }
@@ -135,15 +417,78 @@ func (this *StandardBloom) FillRatio() float64 {
 func (this *StandardBloom) Add(item []byte) bloom.Bloom {
 	this.bits(item)
 	for _, v := range this.bs[:this.k] {
-		this.b.Set(v)
+		this.set(v)
 	}
 	this.c++
 	return this
 }
 
+// AddAll adds all the items, the same as calling Add for each of them, reusing the same
+// hash state and position buffer for the whole batch.
+func (this *StandardBloom) AddAll(items [][]byte) bloom.Bloom {
+	for _, item := range items {
+		this.bits(item)
+		for _, v := range this.bs[:this.k] {
+			this.set(v)
+		}
+	}
+	this.c += uint64(len(items))
+	return this
+}
+
+// AddAllStrings is the same as AddAll for string items, without copying them.
+func (this *StandardBloom) AddAllStrings(items []string) bloom.Bloom {
+	for _, item := range items {
+		this.bits(unsafeBytes(item))
+		for _, v := range this.bs[:this.k] {
+			this.set(v)
+		}
+	}
+	this.c += uint64(len(items))
+	return this
+}
+
+// set sets bit i, recording it for the next delta if it wasn't set and deltas are tracked.
+func (this *StandardBloom) set(i uint) {
+	if this.tracking && !this.b.Test(i) {
+		this.pending = append(this.pending, i)
+	}
+	this.b.Set(i)
+}
+
+// Check returns true if item may have been added to the filter. It doesn't write to the
+// filter, so it is safe to call concurrently with other Checks, but not with Add.
 func (this *StandardBloom) Check(item []byte) bool {
-	this.bits(item)
-	for _, v := range this.bs[:this.k] {
+	s := this.hp.Get()
+	ok := this.check(s, item)
+	this.hp.Put(s)
+	return ok
+}
+
+// Positions implements bloom.Positioner, appending the k bit positions of key to bs. Like
+// Check, it doesn't write to the filter.
+func (this *StandardBloom) Positions(key []byte, bs []uint) []uint {
+	s := this.hp.Get()
+	p := s.Positions(this.k)
+	bits(s.H, s.Loc, key, p, this.m, s.Sum[:0], this.digest)
+	bs = append(bs, p...)
+	this.hp.Put(s)
+	return bs
+}
+
+// AddPositions implements bloom.Positioner, adding an item given its bit positions.
+func (this *StandardBloom) AddPositions(bs []uint) {
+	for _, v := range bs {
+		this.set(v)
+	}
+	this.c++
+}
+
+// check is Check using the hasher and buffers of s.
+func (this *StandardBloom) check(s *bloom.Scratch, item []byte) bool {
+	bs := s.Positions(this.k)
+	bits(s.H, s.Loc, item, bs, this.m, s.Sum[:0], this.digest)
+	for _, v := range bs {
 		if !this.b.Test(v) {
 			return false
 		}
@@ -152,27 +497,399 @@ func (this *StandardBloom) Check(item []byte) bool {
 	return true
 }
 
-func (this *StandardBloom) Count() uint {
+// CheckMany checks all the items, setting out[i] to Check(items[i]). out is reused if it
+// can hold len(items) results, and allocated otherwise. The slice of results is returned.
+func (this *StandardBloom) CheckMany(items [][]byte, out []bool) []bool {
+	out = bloom.Results(out, len(items))
+	for i, item := range items {
+		out[i] = this.Check(item)
+	}
+	return out
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *StandardBloom) AddString(s string) bloom.Bloom {
+	return this.Add(unsafeBytes(s))
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *StandardBloom) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// AddUint64 is the same as Add of the 8 byte big endian encoding of v, without allocating.
+func (this *StandardBloom) AddUint64(v uint64) bloom.Bloom {
+	binary.BigEndian.PutUint64(this.u64[:], v)
+	return this.Add(this.u64[:])
+}
+
+// CheckUint64 is the same as Check of the 8 byte big endian encoding of v, without
+// allocating.
+func (this *StandardBloom) CheckUint64(v uint64) bool {
+	s := this.hp.Get()
+	binary.BigEndian.PutUint64(s.U64[:], v)
+	ok := this.check(s, s.U64[:])
+	this.hp.Put(s)
+	return ok
+}
+
+func (this *StandardBloom) Count() uint64 {
 	return this.c
 }
 
-func (this *StandardBloom) PrintStats() {
-	fmt.Printf("m = %d, n = %d, k = %d, s = %d, p = %f, e = %f\n", this.m, this.n, this.k, this.s, this.p, this.e)
-	fmt.Println("Total items:", this.c)
+// Capacity returns n, the number of items the filter was built for.
+func (this *StandardBloom) Capacity() uint {
+	return this.n
+}
+
+// Remaining returns the number of items that can be added before reaching the capacity.
+// It is negative once more items than the capacity have been added.
+func (this *StandardBloom) Remaining() int64 {
+	return int64(this.n) - int64(this.c)
+}
+
+// IsOverCapacity reports whether more items than the capacity have been added, or the
+// estimated fill ratio is above p. The false positive rate is then above e.
+func (this *StandardBloom) IsOverCapacity() bool {
+	return this.c > uint64(this.n) || this.EstimatedFillRatio() > this.p
+}
+
+// CurrentFalsePositiveRate returns the false positive probability of the filter computed
+// from the fraction of bits set, (x/m)^k, rather than the configured e. It grows past e
+// once more than n items have been added.
+func (this *StandardBloom) CurrentFalsePositiveRate() float64 {
+	return math.Pow(this.FillRatio(), float64(this.k))
+}
+
+// ApproximateCardinality estimates the number of distinct items added to the filter from the
+// number of bits set x, as -(m/k) * ln(1 - x/m). Unlike Count, an item added more than once
+// is only counted once. If all the bits are set there is nothing to estimate from, and
+// Count is returned.
+func (this *StandardBloom) ApproximateCardinality() uint64 {
+	x := this.b.Count()
+	if x >= this.m {
+		return this.c
+	}
+	return uint64(math.Round(-float64(this.m) / float64(this.k) * math.Log(1-float64(x)/float64(this.m))))
+}
+
+// Compatible returns nil if the items of other can be added to the filter by Union: both
+// filters must have the same m and k, and the same hasher, either hashers registered with
+// the same name, or the same hash.Hash set with SetHasher. Otherwise it returns an error
+// wrapping bloom.ErrIncompatible.
+func (this *StandardBloom) Compatible(other *StandardBloom) error {
+	if this.m != other.m || this.k != other.k {
+		return fmt.Errorf("%w: m = %d, k = %d and m = %d, k = %d", bloom.ErrIncompatible, this.m, this.k, other.m, other.k)
+	}
+
+	if this.hn != other.hn || (this.hn == "" && this.h != other.h) {
+		return fmt.Errorf("%w: hashers %q and %q", bloom.ErrIncompatible, this.hn, other.hn)
+	}
+
+	if this.digestFlags() != other.digestFlags() {
+		return fmt.Errorf("%w: positions derived from different parts of the %q digest", bloom.ErrIncompatible, this.hn)
+	}
+
+	return nil
+}
+
+// Union adds all the items of other to the filter by ORing the bit array of other into the
+// filter. If the filters aren't Compatible, it returns the error and leaves the filter
+// unchanged. The bits newly set are recorded in the next delta if deltas are tracked.
+//
+// Items added to both filters would be counted twice by adding the counts, so the count is
+// estimated from the bits set instead, and is at most the sum of the counts.
+func (this *StandardBloom) Union(other *StandardBloom) error {
+	if err := this.Compatible(other); err != nil {
+		return err
+	}
+
+	if this.tracking {
+		for i, ok := other.b.NextSet(0); ok; i, ok = other.b.NextSet(i + 1) {
+			this.set(i)
+		}
+	} else {
+		this.b.InPlaceUnion(other.b)
+	}
+
+	this.c += other.c
+	if x := this.b.Count(); x < this.m {
+		if c := -float64(this.m) / float64(this.k) * math.Log(1-float64(x)/float64(this.m)); c < float64(this.c) {
+			this.c = uint64(math.Round(c))
+		}
+	}
+
+	return nil
+}
+
+// Clone returns a deep copy of the filter, with a new hasher of the same kind. Changes to
+// the copy don't affect the filter, and the other way around. It returns an error if the
+// hasher can't be recreated, see bloom.CloneHasher.
+func (this *StandardBloom) Clone() (bloom.Bloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	bf := *this
+	bf.setHasher(h, this.hn)
+	bf.b = this.b.Clone()
+	bf.bs = make([]uint, len(this.bs))
+	bf.pending = append([]uint(nil), this.pending...)
+
+	return &bf, nil
+}
+
+// MemoryUsage returns the number of bytes held by the filter: the bit array, the buffers
+// used to hash items, and the filter itself. The memory held by the hasher is not included.
+func (this *StandardBloom) MemoryUsage() uint64 {
+	return uint64(unsafe.Sizeof(*this)+unsafe.Sizeof(*this.b)) +
+		8*uint64(cap(this.b.Bytes())+cap(this.bs)+cap(this.pending))
+}
+
+// EstimateMemory returns the MemoryUsage of a filter created by NewWithEstimates(n, e),
+// without creating it.
+func EstimateMemory(n uint, e float64) uint64 {
+	m, k := bloom.M(n, 0.5, e), bloom.K(e)
+	return uint64(unsafe.Sizeof(StandardBloom{})+unsafe.Sizeof(bitset.BitSet{})) +
+		8*uint64((m+63)/64+k)
+}
+
+// String implements fmt.Stringer with a one line summary of the filter. The fill ratio
+// is the estimated one, so String doesn't have to count the bits set.
+func (this *StandardBloom) String() string {
+	return fmt.Sprintf("standard{n=%d m=%d k=%d e=%g count=%d fill=%.2f}", this.n, this.m, this.k, this.e, this.c, this.EstimatedFillRatio())
+}
+
+// Stats returns the statistics of the filter.
+func (this *StandardBloom) Stats() bloom.Stats {
 	c := this.b.Count()
-	fmt.Printf("Total bits set: %d (%.1f%%)\n", c, float32(c)/float32(this.m)*100)
+
+	return bloom.Stats{
+		Params:             this.Params(),
+		Count:              this.c,
+		BitsSet:            c,
+		FillRatio:          float64(c) / float64(this.m),
+		EstimatedFillRatio: this.EstimatedFillRatio(),
+		FalsePositiveRate:  math.Pow(float64(c)/float64(this.m), float64(this.k)),
+	}
+}
+
+// WriteStats writes the statistics of the filter to w in a human readable form.
+func (this *StandardBloom) WriteStats(w io.Writer) error {
+	stats := this.Stats()
+	_, err := stats.WriteTo(w)
+	return err
+}
+
+// PrintStats writes the statistics of the filter to stdout.
+//
+// Deprecated: Use Stats, or WriteStats to write them elsewhere.
+func (this *StandardBloom) PrintStats() {
+	this.WriteStats(os.Stdout)
+}
+
+func (this *StandardBloom) bits(item []byte) uint64 {
+	return bits(this.h, this.loc, item, this.bs[:this.k], this.m, this.sum[:0], this.digest)
 }
 
-func (this *StandardBloom) bits(item []byte) {
-	this.h.Reset()
-	this.h.Write(item)
-	s := this.h.Sum(nil)
-	a := binary.BigEndian.Uint32(s[4:8])
-	b := binary.BigEndian.Uint32(s[0:4])
+// bits fills bs with the bit positions for item in a filter of m bits, using loc if it is
+// not nil. It is shared by StandardBloom and ReadOnlyBloom so both always agree on the
+// positions of a key. The positions are derived by bloom.DigestPositions, using sum as the
+// buffer for the digest, and the first 8 bytes of the digest are returned, or 0 if loc is
+// used.
+func bits(h hash.Hash, loc bloom.Locator, item []byte, bs []uint, m uint, sum []byte, digest uint16) uint64 {
+	if loc != nil {
+		loc.Locate(item, bs, m)
+		return 0
+	}
+
+	h.Reset()
+	h.Write(item)
+	return bloom.DigestPositions(h, sum, bs, m, digest)
+}
+
+// digestFlags returns the flags changing the positions derived from the digest of the
+// hasher, which are recorded in the header, see bloom.DigestFlagsOf.
+func (this *StandardBloom) digestFlags() uint16 {
+	if this.loc != nil {
+		return 0
+	}
+	return bloom.DigestFlagsOf(this.h, this.m, this.digest)
+}
+
+// WriteTo implements io.WriterTo. It is the same as Encode with nil options.
+func (this *StandardBloom) WriteTo(w io.Writer) (int64, error) {
+	return this.Encode(w, nil)
+}
 
-	// Reference: Less Hashing, Same Performance: Building a Better Bloom Filter
-	// URL: http://www.eecs.harvard.edu/~kirsch/pubs/bbbf/rsa.pdf
-	for i, _ := range this.bs[:this.k] {
-		this.bs[i] = (uint(a) + uint(b)*uint(i)) % this.m
+// Encode implements bloom.Encoder. It writes a bloom.Header holding m, k, n, c, p, e and the
+// hasher name, followed by the bit array written by bloom.WriteBits. The hash function itself
+// is not written.
+func (this *StandardBloom) Encode(w io.Writer, opts *bloom.WriteOptions) (int64, error) {
+	h := &bloom.Header{
+		Version: bloom.Version,
+		Kind:    bloom.KindStandard,
+		Hasher:  this.hn,
+		M:       uint64(this.m),
+		K:       uint64(this.k),
+		N:       uint64(this.n),
+		C:       this.c,
+		P:       this.p,
+		E:       this.e,
 	}
+
+	h.Flags = opts.Flags(this.FillRatio())
+	h.Flags |= this.digestFlags()
+	if this.pow2 {
+		h.Flags |= bloom.FlagPowerOfTwo
+	}
+	if this.pinned {
+		h.Flags |= bloom.FlagPinnedHashCount
+	}
+
+	total, err := h.WriteTo(w)
+	if err != nil {
+		return total, err
+	}
+
+	bw := bloom.NewBodyWriter(w, h.Flags)
+	if _, err := bloom.WriteBits(bw, this.b.Bytes(), this.m, h.Flags&bloom.FlagSparse != 0); err != nil {
+		n, _ := bw.Finish()
+		return total + n, err
+	}
+
+	n, err := bw.Finish()
+	return total + n, err
+}
+
+// ReadFrom implements io.ReaderFrom. It reads a filter written by WriteTo, consuming exactly
+// the bytes of one encoded filter from r. If the filter was written with a hasher set by
+// SetNamedHasher, that hasher is recreated. Otherwise the current hasher is kept, or
+// fnv.New64() is used if none is set.
+func (this *StandardBloom) ReadFrom(r io.Reader) (int64, error) {
+	h := &bloom.Header{}
+	total, err := h.ReadFrom(r)
+	if err != nil {
+		return total, err
+	}
+
+	if h.Kind != bloom.KindStandard {
+		return total, fmt.Errorf("standard: cannot read %s filter", h.Kind)
+	}
+
+	n, err := this.readBody(h, r)
+	return total + n, err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler using the WriteTo encoding.
+func (this *StandardBloom) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := this.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler using the ReadFrom encoding. It
+// rejects truncated input, and input with trailing bytes after the bit array.
+func (this *StandardBloom) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	if _, err := this.ReadFrom(r); err != nil {
+		return err
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("standard: %d trailing bytes after bit array", r.Len())
+	}
+
+	return nil
+}
+
+func (this *StandardBloom) readBody(h *bloom.Header, r io.Reader) (int64, error) {
+	pow2 := h.Flags&bloom.FlagPowerOfTwo != 0
+	if h.M == 0 || h.M > math.MaxUint || h.K == 0 || h.K > bloom.MaxHashCount || pow2 && h.M&(h.M-1) != 0 {
+		return 0, fmt.Errorf("standard: invalid parameters m = %d, k = %d", h.M, h.K)
+	}
+
+	hf, err := bloom.ResolveHasher(h.Hasher, this.h)
+	if err != nil {
+		return 0, err
+	}
+
+	br, err := bloom.NewBodyReader(r, h.Flags)
+	if err != nil {
+		return 0, err
+	}
+
+	m := uint(h.M)
+	sparse := h.Flags&bloom.FlagSparse != 0
+	if err := bloom.CheckBits(br, m, sparse); err != nil {
+		return 0, err
+	}
+
+	b := bitset.New(m)
+	if _, err := bloom.ReadBits(br, b.Bytes(), m, sparse); err != nil {
+		n, _ := br.Finish()
+		return n, err
+	}
+
+	n, err := br.Finish()
+	if err != nil {
+		return n, err
+	}
+
+	this.m, this.k, this.n, this.c, this.p, this.e = m, uint(h.K), uint(h.N), h.C, h.P, h.E
+	this.b = b
+	this.bs = make([]uint, this.k)
+	this.setHasher(hf, h.Hasher)
+	this.digest = h.Flags & bloom.DigestFlags
+	this.pow2 = pow2
+	this.pinned = h.Flags&bloom.FlagPinnedHashCount != 0
+	this.tracking, this.pending = false, nil
+
+	return n, nil
+}
+
+// MarshalText implements encoding.TextMarshaler. See bloom.MarshalText for the format.
+func (this *StandardBloom) MarshalText() ([]byte, error) {
+	data, err := this.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return bloom.MarshalText(data)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It rejects text that isn't the text form
+// of a standard filter.
+func (this *StandardBloom) UnmarshalText(text []byte) error {
+	data, err := bloom.UnmarshalText(text, bloom.KindStandard)
+	if err != nil {
+		return err
+	}
+	return this.UnmarshalBinary(data)
+}
+
+// GobEncode implements gob.GobEncoder using the MarshalBinary encoding. Only the name of
+// a hasher set by SetNamedHasher is encoded. For a hasher set by SetHasher, call SetHasher
+// with the same hasher on the value being decoded into before decoding, as the hasher
+// already set on it is kept. Otherwise the decoded filter falls back to fnv.New64().
+func (this *StandardBloom) GobEncode() ([]byte, error) {
+	return this.MarshalBinary()
+}
+
+// GobDecode implements gob.GobDecoder using the UnmarshalBinary encoding.
+func (this *StandardBloom) GobDecode(data []byte) error {
+	return this.UnmarshalBinary(data)
+}
+
+// wordsNeeded returns the number of 64-bit words required to hold m bits.
+func wordsNeeded(m uint) int {
+	return int((m + 63) / 64)
+}
+
+// unsafeBytes returns the bytes of s without copying them. Hash functions don't modify or
+// retain the data written to them, so it is safe to pass the result to bits.
+func unsafeBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
 }
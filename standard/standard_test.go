@@ -16,13 +16,31 @@ package standard
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
+	"hash/adler32"
+	"hash/crc32"
 	"hash/crc64"
 	"hash/fnv"
+	"hash/maphash"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/spaolacci/murmur3"
@@ -66,7 +84,7 @@ func init() {
 	}
 }
 
-func testBloomFilter(t *testing.T, bf bloom.Bloom) {
+func testBloomFilter(t *testing.T, bf bloom.Bloom) int {
 	fn, fp := 0, 0
 
 	for l := range web2 {
@@ -86,23 +104,2214 @@ func testBloomFilter(t *testing.T, bf bloom.Bloom) {
 
 	fmt.Printf("Total false negatives: %d (%.4f%%)\n", fn, (float32(fn) / float32(len(web2)) * 100))
 	fmt.Printf("Total false positives: %d (%.4f%%)\n", fp, (float32(fp) / float32(len(web2a)) * 100))
+	return fp
 }
 
+// TestBloomFilter also compares the false positives of the enhanced double hashing with
+// those of the plain one, for each hasher, which the enhanced one must not exceed by more
+// than the noise.
 func TestBloomFilter(t *testing.T) {
 	l := []uint{uint(len(web2)), 200000, 100000, 50000}
 	h := []hash.Hash{fnv.New64(), crc64.New(crc64.MakeTable(crc64.ECMA)), murmur3.New64(), cityhash.New64(), md5.New(), sha1.New()}
 	n := []string{"fnv.New64()", "crc64.New()", "murmur3.New64()", "cityhash.New64()", "md5.New()", "sha1.New()"}
 
+	fps := make([][2]int, len(h))
 	for i := range l {
 		for j := range h {
 			fmt.Printf("\n\nTesting %s with size %d\n", n[j], l[i])
 			bf := New(l[i])
 			bf.SetHasher(h[j])
-			testBloomFilter(t, bf)
+			fps[j][1] += testBloomFilter(t, bf)
+
+			fmt.Printf("\n\nTesting %s with size %d without enhanced double hashing\n", n[j], l[i])
+			bf = New(l[i])
+			bf.SetHasher(h[j])
+			bf.(*StandardBloom).digest &^= bloom.FlagEnhanced
+			fps[j][0] += testBloomFilter(t, bf)
+		}
+	}
+
+	for j := range h {
+		fmt.Printf("%s: %d false positives with enhanced double hashing, %d without\n", n[j], fps[j][1], fps[j][0])
+		if float64(fps[j][1]) > 1.05*float64(fps[j][0])+10 {
+			t.Errorf("%s: %d false positives with enhanced double hashing, more than %d without", n[j], fps[j][1], fps[j][0])
+		}
+	}
+}
+
+// Hashers with a 32-bit digest are extended to 64 bits by bloom.Sum64, so they don't panic
+// and still give a false positive rate close to e. Adler32 gives the same digest to many
+// short words, which no mixing can separate, so its rate is only required to stay sane.
+func TestHash32(t *testing.T) {
+	hashers := map[string]hash.Hash{
+		"crc32":            crc32.NewIEEE(),
+		"crc32-castagnoli": crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		"fnv32a":           fnv.New32a(),
+		"adler32":          adler32.New(),
+	}
+
+	limits := map[string]float64{"adler32": 0.05}
+
+	for name, h := range hashers {
+		bf := New(uint(len(web2)))
+		if err := bf.SetHasher(h); err != nil {
+			t.Fatal(err)
+		}
+
+		fn, fp := 0, 0
+		for _, w := range web2 {
+			if !bf.Add([]byte(w)).Check([]byte(w)) {
+				fn++
+			}
+		}
+
+		for _, w := range web2a {
+			if bf.Check([]byte(w)) {
+				fp++
+			}
+		}
+
+		rate := float64(fp) / float64(len(web2a))
+		fmt.Printf("%s: %d false negatives, %d false positives (%.4f%%)\n", name, fn, fp, rate*100)
+
+		if fn > 0 {
+			t.Errorf("%s: %d false negatives", name, fn)
+		}
+
+		limit, ok := limits[name]
+		if !ok {
+			limit = 2 * bf.Params().E
+		}
+
+		if rate > limit {
+			t.Errorf("%s: false positive rate %.4f%%, expected at most %.4f%%", name, rate*100, limit*100)
+		}
+	}
+}
+
+// With the Hashers of the bloom package, a filter hashes an item in a single call, and
+// saves the name of the Hasher like any named hasher.
+func TestHashFunc(t *testing.T) {
+	for _, name := range []string{bloom.FNV1aFunc, bloom.Murmur3Func, bloom.XXHashFunc} {
+		bf := New(uint(len(web2))).(*StandardBloom)
+		if err := bf.SetNamedHasher(name); err != nil {
+			t.Fatal(err)
+		}
+
+		fn, fp := 0, 0
+		for _, w := range web2 {
+			if !bf.Add([]byte(w)).Check([]byte(w)) {
+				fn++
+			}
+		}
+
+		for _, w := range web2a {
+			if bf.Check([]byte(w)) {
+				fp++
+			}
+		}
+
+		rate := float64(fp) / float64(len(web2a))
+		fmt.Printf("%s: %d false negatives, %d false positives (%.4f%%)\n", name, fn, fp, rate*100)
+
+		if fn > 0 {
+			t.Errorf("%s: %d false negatives", name, fn)
+		}
+
+		if limit := 2 * bf.Params().E; rate > limit {
+			t.Errorf("%s: false positive rate %.4f%%, expected at most %.4f%%", name, rate*100, limit*100)
+		}
+
+		var buf bytes.Buffer
+		if _, err := bf.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		bf2, err := bloom.Load(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, w := range web2 {
+			if !bf2.Check([]byte(w)) {
+				t.Fatalf("%s: %q not found after loading", name, w)
+			}
+		}
+
+		if allocs := testing.AllocsPerRun(100, func() { bf.CheckString("hello") }); allocs != 0 {
+			t.Errorf("%s: %f allocations per Check, expected 0", name, allocs)
+		}
+	}
+
+	// SetHashFunc is refused once items are added, like SetHasher
+	bf := New(100).(*StandardBloom)
+	if err := bf.SetHashFunc(bloom.XXHash); err != nil {
+		t.Fatal(err)
+	}
+	bf.AddString("hello")
+	if err := bf.SetHashFunc(bloom.FNV1a); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected bloom.ErrNotEmpty, got %v", err)
+	}
+}
+
+// Filters with different seeds set different bits for the same items, and keep their seed
+// when saved and loaded.
+func TestSeed(t *testing.T) {
+	seeds := []uint64{bloom.RandomSeed(), bloom.RandomSeed()}
+	filters := make([]*StandardBloom, len(seeds))
+
+	for i, seed := range seeds {
+		bf := New(uint(len(web2))).(*StandardBloom)
+		if err := bf.SetSeed(seed); err != nil {
+			t.Fatal(err)
+		}
+
+		if s, ok := bf.Seed(); !ok || s != seed {
+			t.Fatalf("Seed() = %#x, %t, expected %#x", s, ok, seed)
+		}
+
+		for _, w := range web2 {
+			bf.AddString(w)
+		}
+
+		var buf bytes.Buffer
+		if _, err := bf.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := bloom.Load(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bf2 := loaded.(*StandardBloom)
+		if s, ok := bf2.Seed(); !ok || s != seed {
+			t.Fatalf("Seed() = %#x, %t after loading, expected %#x", s, ok, seed)
+		}
+
+		for _, w := range web2 {
+			if !bf.CheckString(w) || !bf2.CheckString(w) {
+				t.Fatalf("Seed %#x: false negative %q", seed, w)
+			}
+		}
+
+		filters[i] = bf
+	}
+
+	same := 0
+	for _, w := range web2[:1000] {
+		p0, p1 := filters[0].Positions([]byte(w), nil), filters[1].Positions([]byte(w), nil)
+		if slices.Equal(p0, p1) {
+			same++
+		}
+	}
+
+	if same > 0 {
+		t.Errorf("%d items of 1000 have the same positions with seeds %#x and %#x", same, seeds[0], seeds[1])
+	}
+
+	if _, ok := New(100).(*StandardBloom).Seed(); ok {
+		t.Errorf("Expected no seed for the default hasher")
+	}
+
+	// maphash can be used too, for filters that aren't loaded elsewhere
+	bf := New(uint(len(web2))).(*StandardBloom)
+	bf.SetHashFunc(bloom.Maphash(maphash.MakeSeed()))
+	for _, w := range web2 {
+		if !bf.AddString(w).Check([]byte(w)) {
+			t.Fatalf("maphash: false negative %q", w)
+		}
+	}
+
+	if err := bf.SetSeed(1); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected bloom.ErrNotEmpty, got %v", err)
+	}
+}
+
+// An adversary who knows the hash function can pick items that are false positives in a
+// filter, and they are false positives in every filter holding the same items. With
+// SipHash, the items picked with one key are false positives under another key no more
+// often than random items are.
+func TestSipHash(t *testing.T) {
+	k1, k2 := bloom.NewSipHashKey(), bloom.NewSipHashKey()
+
+	build := func(name string) *StandardBloom {
+		bf := NewWithEstimates(1000, 0.01).(*StandardBloom)
+		if err := bf.SetNamedHasher(name); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			bf.AddString(fmt.Sprintf("item-%d", i))
+		}
+		return bf
+	}
+
+	// attack returns up to 500 items that are false positives in bf
+	attack := func(bf *StandardBloom) []string {
+		var fps []string
+		for i := 0; len(fps) < 500; i++ {
+			if s := fmt.Sprintf("probe-%d", i); bf.CheckString(s) {
+				fps = append(fps, s)
+			}
+		}
+		return fps
+	}
+
+	// transferred returns how many of the items are false positives in bf
+	transferred := func(bf *StandardBloom, items []string) int {
+		n := 0
+		for _, s := range items {
+			if bf.CheckString(s) {
+				n++
+			}
+		}
+		return n
+	}
+
+	fps := attack(build(bloom.SipHashName(k1)))
+	keyed := transferred(build(bloom.SipHashName(k2)), fps)
+	same := transferred(build(bloom.SipHashName(k1)), fps)
+	unkeyed := transferred(build(bloom.DefaultHasher), attack(build(bloom.DefaultHasher)))
+
+	fmt.Printf("siphash: %d of %d items picked under one key are false positives under another, %d under the same key, %d with fnv64\n",
+		keyed, len(fps), same, unkeyed)
+
+	if same != len(fps) || unkeyed != len(fps) {
+		t.Errorf("Expected all the picked items to be false positives with the same hash function, got %d and %d", same, unkeyed)
+	}
+
+	if keyed > len(fps)/10 {
+		t.Errorf("%d of %d items picked under one key are false positives under another", keyed, len(fps))
+	}
+}
+
+// With md5 and sha1, the positions are taken from the whole digest. This must not give more
+// false positives than deriving them all from the first 8 bytes, as filters written before
+// FlagWideDigest existed still do.
+func TestWideDigest(t *testing.T) {
+	for _, name := range []string{"md5", "sha1"} {
+		var fps [2]int
+		for i, wide := range []bool{false, true} {
+			for _, e := range []float64{0.01, 0.001, 0.0001} {
+				bf := NewWithEstimates(uint(len(web2)), e).(*StandardBloom)
+				bf.SetNamedHasher(name)
+				if !wide {
+					bf.digest = 0
+				}
+
+				for _, w := range web2 {
+					bf.AddString(w)
+				}
+
+				for _, w := range web2 {
+					if !bf.CheckString(w) {
+						t.Fatalf("%s, wide = %t: false negative %q", name, wide, w)
+					}
+				}
+
+				for _, w := range web2a {
+					if bf.CheckString(w) {
+						fps[i]++
+					}
+				}
+			}
+		}
+
+		fmt.Printf("%s: %d false positives from the whole digest, %d from 8 bytes\n", name, fps[1], fps[0])
+
+		if float64(fps[1]) > 1.1*float64(fps[0]) {
+			t.Errorf("%s: %d false positives from the whole digest, more than %d from 8 bytes", name, fps[1], fps[0])
+		}
+	}
+}
+
+// With murmur3-128, the positions are derived from both halves of the digest by enhanced
+// double hashing, rather than from the first 8 bytes, or from the 4 chunks of 4 bytes of
+// the digest followed by the first 8 bytes, as filters written without FlagSum128 are. For
+// k from 10 to 17 and bit arrays of less than 2^32 bits, the false positives on the
+// dictionary are the same to within noise, as murmur3 is good enough for double hashing of
+// 32-bit values to reach the expected rate. The test checks there are no more of them.
+func TestSum128(t *testing.T) {
+	modes := []struct {
+		name   string
+		digest uint16
+	}{
+		{"8 bytes", 0},
+		{"chunks", bloom.FlagWideDigest},
+		{"sum128", bloom.DigestFlags},
+	}
+
+	var fps [3]int
+	for _, e := range []float64{0.001, 0.0001, 0.00001} {
+		for i, mode := range modes {
+			bf := NewWithEstimates(uint(len(web2)/2), e).(*StandardBloom)
+			bf.SetNamedHasher("murmur3-128")
+			bf.digest = mode.digest
+
+			for _, w := range web2[:len(web2)/2] {
+				bf.AddString(w)
+			}
+
+			fp := 0
+			for _, w := range web2[len(web2)/2:] {
+				if bf.CheckString(w) {
+					fp++
+				}
+			}
+			for _, w := range web2a {
+				if bf.CheckString(w) {
+					fp++
+				}
+			}
+
+			fmt.Printf("murmur3-128, k = %d, %s: %d false positives\n", bf.k, mode.name, fp)
+			fps[i] += fp
+		}
+	}
+
+	fmt.Printf("murmur3-128: %d false positives from sum128, %d from chunks, %d from 8 bytes\n", fps[2], fps[1], fps[0])
+
+	if float64(fps[2]) > 1.1*float64(fps[0]) {
+		t.Errorf("%d false positives from sum128, more than %d from 8 bytes", fps[2], fps[0])
+	}
+
+	// The flag is recorded, and filters read without it keep their positions
+	for _, mode := range modes {
+		bf := New(10000).(*StandardBloom)
+		bf.SetNamedHasher("murmur3-128")
+		bf.digest = mode.digest
+		for _, w := range web2[:10000] {
+			bf.AddString(w)
+		}
+
+		data, err := bf.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := &bloom.Header{}
+		h.ReadFrom(bytes.NewReader(data))
+		if flags := h.Flags & bloom.DigestFlags; flags != bloom.DigestFlagsOf(bf.h, bf.m, mode.digest) {
+			t.Fatalf("%s: header flags %#x", mode.name, h.Flags)
+		}
+
+		bf2 := &StandardBloom{}
+		if err := bf2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		ro, err := UnsafeFromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, w := range web2[:10000] {
+			if !bf2.CheckString(w) || !ro.CheckString(w) {
+				t.Fatalf("%s: %q not found after reading the filter", mode.name, w)
+			}
+		}
+	}
+}
+
+// Filters written without FlagWideDigest keep deriving their positions from the first 8
+// bytes of the digest once read, and can't be merged with filters using the whole digest.
+func TestWideDigestCompat(t *testing.T) {
+	for _, wide := range []bool{false, true} {
+		bf := New(10000).(*StandardBloom)
+		bf.SetNamedHasher("sha1")
+		if !wide {
+			bf.digest = 0
+		}
+		for _, w := range web2[:10000] {
+			bf.AddString(w)
+		}
+
+		data, err := bf.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := &bloom.Header{}
+		h.ReadFrom(bytes.NewReader(data))
+		if (h.Flags&bloom.FlagWideDigest != 0) != wide {
+			t.Fatalf("wide = %t: header flags %#x", wide, h.Flags)
+		}
+
+		bf2 := &StandardBloom{}
+		if err := bf2.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+
+		ro, err := UnsafeFromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, w := range web2[:10000] {
+			if !bf2.CheckString(w) || !ro.CheckString(w) {
+				t.Fatalf("wide = %t: %q not found after reading the filter", wide, w)
+			}
+		}
+
+		other := New(10000).(*StandardBloom)
+		other.SetNamedHasher("sha1")
+		if err := bf2.Union(other); (err == nil) != wide {
+			t.Errorf("wide = %t: Union with a new filter returned %v", wide, err)
+		}
+	}
+
+	// The flag isn't written for hashers of 8 bytes, so older versions can read the filters
+	var buf bytes.Buffer
+	New(1000).(*StandardBloom).WriteTo(&buf)
+	h := &bloom.Header{}
+	h.ReadFrom(&buf)
+	if h.Flags&bloom.FlagWideDigest != 0 {
+		t.Errorf("FlagWideDigest set for the default hasher")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	data, err := bf.(*StandardBloom).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf2 := &StandardBloom{}
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Count() != bf.Count() {
+		t.Errorf("Expected count %d, got %d", bf.Count(), bf2.Count())
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !bf2.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives after unmarshal, got %d", fn)
+	}
+
+	for l := range web2a {
+		if bf.Check([]byte(web2a[l])) != bf2.Check([]byte(web2a[l])) {
+			t.Fatalf("Check mismatch after unmarshal for %q", web2a[l])
+		}
+	}
+
+	for _, n := range []int{0, 8, 40, len(data) - 1} {
+		if err := new(StandardBloom).UnmarshalBinary(data[:n]); err == nil {
+			t.Errorf("Expected error unmarshaling %d of %d bytes", n, len(data))
+		}
+	}
+
+	bf3, err := bloom.Load(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := bf3.(*StandardBloom); !ok {
+		t.Fatalf("Expected bloom.Load to return *StandardBloom, got %T", bf3)
+	}
+}
+
+func TestGob(t *testing.T) {
+	type snapshot struct {
+		Name   string
+		Filter *StandardBloom
+	}
+
+	bf := New(uint(len(web2)))
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot{"web2", bf.(*StandardBloom)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var s snapshot
+	if err := gob.NewDecoder(&buf).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Filter.Count() != bf.Count() {
+		t.Errorf("Expected count %d, got %d", bf.Count(), s.Filter.Count())
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !s.Filter.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives after gob decoding, got %d", fn)
+	}
+}
+
+func TestOpenMmap(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	path := filepath.Join(t.TempDir(), "web2.bloom")
+	if err := bloom.SaveToFile(bf, path); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := OpenMmap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+
+	if ro.Count() != bf.Count() {
+		t.Errorf("Expected count %d, got %d", bf.Count(), ro.Count())
+	}
+
+	if ro.FillRatio() != bf.FillRatio() {
+		t.Errorf("Expected fill ratio %f, got %f", bf.FillRatio(), ro.FillRatio())
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !ro.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives from mapped filter, got %d", fn)
+	}
+
+	for l := range web2a {
+		if bf.Check([]byte(web2a[l])) != ro.Check([]byte(web2a[l])) {
+			t.Fatalf("Check mismatch in mapped filter for %q", web2a[l])
+		}
+	}
+
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsafeFromBytes(t *testing.T) {
+	bf := New(uint(len(web2) / 10)).(*StandardBloom)
+	for l := 0; l < len(web2)/10; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.Encode(&buf, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter at every offset from 0 to 7 bytes, followed by unrelated bytes.
+	for off := 0; off < 8; off++ {
+		data := make([]byte, off, off+buf.Len()+3)
+		data = append(data, buf.Bytes()...)
+		data = append(data, 1, 2, 3)
+
+		ro, err := UnsafeFromBytes(data[off:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for l := range web2 {
+			if bf.Check([]byte(web2[l])) != ro.Check([]byte(web2[l])) {
+				t.Fatalf("offset %d: Check mismatch for %q", off, web2[l])
+			}
+		}
+
+		if err := ro.Add([]byte("foo")); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("offset %d: Add returned %v, want ErrReadOnly", off, err)
+		}
+
+		// The bit array aliases data.
+		for i := len(data) - 3 - 8*len(bf.b.Bytes()); i < len(data)-3; i++ {
+			data[i] = 0
+		}
+		if ro.Check([]byte(web2[0])) {
+			t.Fatalf("offset %d: Check found %q after clearing the bit array", off, web2[0])
+		}
+	}
+
+	if _, err := UnsafeFromBytes(buf.Bytes()[:buf.Len()-1]); err == nil {
+		t.Fatalf("UnsafeFromBytes of truncated filter succeeded")
+	}
+
+	for _, h := range []bloom.Header{{M: 0, K: 7}, {M: 64, K: bloom.MaxHashCount + 1}, {M: 1 << 62, K: 7}} {
+		h.Version, h.Kind = bloom.Version, bloom.KindStandard
+
+		var bad bytes.Buffer
+		h.WriteTo(&bad)
+		bad.Write(make([]byte, 64))
+		if _, err := UnsafeFromBytes(bad.Bytes()); err == nil {
+			t.Errorf("Expected UnsafeFromBytes to fail for m = %d, k = %d", h.M, h.K)
+		}
+	}
+}
+
+func TestSparseEncoding(t *testing.T) {
+	// 700000 items gives a filter of roughly 10M bits
+	bf := New(700000).(*StandardBloom)
+	for i := 0; i < 200; i++ {
+		bf.Add([]byte(web2[i]))
+	}
+
+	var sparse, dense bytes.Buffer
+	if _, err := bf.WriteTo(&sparse); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bf.Encode(&dense, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("m = %d, fill ratio = %f, sparse = %d bytes, dense = %d bytes\n", bf.m, bf.FillRatio(), sparse.Len(), dense.Len())
+
+	if sparse.Len() > 8192 {
+		t.Errorf("Expected sparse encoding of at most 8192 bytes, got %d", sparse.Len())
+	}
+
+	for _, buf := range []*bytes.Buffer{&sparse, &dense} {
+		bf2 := &StandardBloom{}
+		if err := bf2.UnmarshalBinary(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		for l := range web2 {
+			if bf.Check([]byte(web2[l])) != bf2.Check([]byte(web2[l])) {
+				t.Fatalf("Check mismatch after decoding for %q", web2[l])
+			}
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	bf := New(uint(len(web2))).(*StandardBloom)
+	for i := 0; i < len(web2)/20; i++ {
+		bf.Add([]byte(web2[i]))
+	}
+
+	var plain, gz bytes.Buffer
+	if _, err := bf.Encode(&plain, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := bf.Encode(&gz, &bloom.WriteOptions{Encoding: bloom.EncodingDense, Compression: bloom.CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("fill ratio = %f, dense = %d bytes, gzip = %d bytes\n", bf.FillRatio(), plain.Len(), gz.Len())
+
+	if n != int64(gz.Len()) {
+		t.Fatalf("Encode returned %d, wrote %d bytes", n, gz.Len())
+	}
+
+	if gz.Len() >= plain.Len()/2 {
+		t.Errorf("Expected gzip encoding of less than %d bytes, got %d", plain.Len()/2, gz.Len())
+	}
+
+	// The header can be read without decompressing.
+	h := &bloom.Header{}
+	if _, err := h.ReadFrom(bytes.NewReader(gz.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Flags&bloom.FlagGzip == 0 || h.M != uint64(bf.m) || h.C != uint64(bf.c) {
+		t.Fatalf("Unexpected header %+v", h)
+	}
+
+	// Two filters read one after the other from a reader that isn't an io.ByteReader.
+	data := append(append([]byte(nil), gz.Bytes()...), gz.Bytes()...)
+	r := io.MultiReader(bytes.NewReader(data))
+	for i := 0; i < 2; i++ {
+		bf2 := &StandardBloom{}
+		n, err := bf2.ReadFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != int64(gz.Len()) {
+			t.Fatalf("ReadFrom returned %d, want %d", n, gz.Len())
+		}
+
+		for l := range web2 {
+			if bf.Check([]byte(web2[l])) != bf2.Check([]byte(web2[l])) {
+				t.Fatalf("Check mismatch after decoding for %q", web2[l])
+			}
+		}
+	}
+
+	bad := append([]byte(nil), gz.Bytes()...)
+	bad[len(bad)-5] ^= 1
+	if err := (&StandardBloom{}).UnmarshalBinary(bad); err == nil {
+		t.Fatalf("UnmarshalBinary of corrupt compressed filter succeeded")
+	}
+
+	if _, err := newReadOnly(gz.Bytes()); err == nil {
+		t.Fatalf("newReadOnly of compressed filter succeeded")
+	}
+}
+
+func TestDelta(t *testing.T) {
+	w := New(uint(len(web2))).(*StandardBloom)
+	r := New(uint(len(web2))).(*StandardBloom)
+
+	for i := 0; i < 1000; i++ {
+		w.Add([]byte(web2[i]))
+	}
+
+	// Deltas 1 to 4, each after adding 1000 more items. The first holds everything.
+	var deltas [][]byte
+	for d := 0; d < 4; d++ {
+		var buf bytes.Buffer
+		if _, err := w.Checkpoint(&buf); err != nil {
+			t.Fatal(err)
+		}
+		deltas = append(deltas, buf.Bytes())
+
+		for i := (d + 1) * 1000; i < (d+2)*1000; i++ {
+			w.Add([]byte(web2[i]))
+		}
+	}
+
+	full, err := w.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("full = %d bytes, dense = %d bytes, delta = %d bytes\n", len(full), w.m/8, len(deltas[1]))
+
+	if len(deltas[1]) > int(w.m/8)/10 {
+		t.Errorf("Expected delta of at most %d bytes, got %d", w.m/8/10, len(deltas[1]))
+	}
+
+	// Deltas 1 and 2, twice, from a single reader that isn't an io.ByteReader.
+	stream := io.MultiReader(bytes.NewReader(bytes.Join([][]byte{deltas[0], deltas[1], deltas[0], deltas[1]}, nil)))
+	for i := 0; i < 4; i++ {
+		if err := r.ApplyDelta(stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if r.DeltaSeq() != 2 || r.Count() != 2000 {
+		t.Fatalf("Expected seq 2 and count 2000, got %d and %d", r.DeltaSeq(), r.Count())
+	}
+
+	for i := 0; i < 2000; i++ {
+		if !r.Check([]byte(web2[i])) {
+			t.Fatalf("%q not found after applying deltas", web2[i])
+		}
+	}
+
+	// Delta 3 is missed.
+	if err := r.ApplyDelta(bytes.NewReader(deltas[3])); !errors.Is(err, ErrDeltaGap) {
+		t.Fatalf("Expected ErrDeltaGap, got %v", err)
+	}
+
+	// A full copy, then delta 4 again and the pending bits in a new delta 5.
+	if err := r.UnmarshalBinary(full); err != nil {
+		t.Fatal(err)
+	}
+	r.SetDeltaSeq(w.DeltaSeq())
+
+	var buf bytes.Buffer
+	if _, err := w.Checkpoint(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range [][]byte{deltas[3], buf.Bytes()} {
+		if err := r.ApplyDelta(bytes.NewReader(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !r.b.Equal(w.b) || r.DeltaSeq() != 5 || r.Count() != w.Count() {
+		t.Fatalf("Reader differs from writer after full copy and deltas")
+	}
+
+	if err := New(1000).(*StandardBloom).ApplyDelta(bytes.NewReader(deltas[0])); !errors.Is(err, ErrDeltaMismatch) {
+		t.Fatalf("Expected ErrDeltaMismatch, got %v", err)
+	}
+
+	if err := r.ApplyDelta(bytes.NewReader(full)); !errors.Is(err, ErrDeltaMismatch) {
+		t.Fatalf("Expected ErrDeltaMismatch, got %v", err)
+	}
+}
+
+func TestMarshalText(t *testing.T) {
+	type config struct {
+		Allow *StandardBloom `json:"allow"`
+	}
+
+	bf := New(1000).(*StandardBloom)
+	for i := 0; i < 1000; i++ {
+		bf.Add([]byte(web2[i]))
+	}
+
+	data, err := json.Marshal(config{bf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(data), `{"allow":"bloom1:standard:fnv64:`) {
+		t.Errorf("Unexpected JSON encoding %.60s...", data)
+	}
+
+	var c config
+	if err := json.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !c.Allow.Check([]byte(web2[i])) {
+			t.Fatalf("False negative for %q after JSON round trip", web2[i])
+		}
+	}
+
+	text, err := bf.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := []string{
+		"",
+		"bloom1:standard:fnv64",
+		"blum1:standard:fnv64:" + string(text[len("bloom1:standard:fnv64:"):]),
+		"bloomx:standard:fnv64:" + string(text[len("bloom1:standard:fnv64:"):]),
+		"bloom1:partitioned:fnv64:" + string(text[len("bloom1:standard:fnv64:"):]),
+		"bloom1:standard:md5:" + string(text[len("bloom1:standard:fnv64:"):]),
+		"bloom1:standard:fnv64:!!!",
+		string(text[:len(text)-12]),
+	}
+
+	for _, b := range bad {
+		if err := new(StandardBloom).UnmarshalText([]byte(b)); err == nil {
+			t.Errorf("Expected error unmarshaling %.40q", b)
+		}
+	}
+}
+
+func TestNamedHasher(t *testing.T) {
+	bloom.RegisterHasher("murmur3-64", func() hash.Hash { return murmur3.New64() })
+
+	bf := New(uint(len(web2))).(*StandardBloom)
+	if err := bf.SetNamedHasher("murmur3-64"); err != nil {
+		t.Fatal(err)
+	}
+
+	for l := range web2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !bf2.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives with recreated murmur3 hasher, got %d", fn)
+	}
+
+	if err := New(1000).(*StandardBloom).SetNamedHasher("no-such-hasher"); !errors.Is(err, bloom.ErrUnknownHasher) {
+		t.Errorf("Expected ErrUnknownHasher from SetNamedHasher, got %v", err)
+	}
+
+	data = bytes.Replace(data, []byte("murmur3-64"), []byte("murmur3-xx"), 1)
+	if _, err := bloom.Load(bytes.NewReader(data)); !errors.Is(err, bloom.ErrUnknownHasher) {
+		t.Errorf("Expected ErrUnknownHasher from Load, got %v", err)
+	}
+}
+
+func TestFromWillf(t *testing.T) {
+	// testdata/willf.bloom was written by github.com/willf/bloom v2.0.3 after adding
+	// fixture-key-0 to fixture-key-999 to NewWithEstimates(1000, 0.01). willf_fp.txt lists
+	// the keys among absent-key-0 to absent-key-9999 for which its Test returned true.
+	data, err := os.ReadFile("testdata/willf.bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpdata, err := os.ReadFile("testdata/willf_fp.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fps := make(map[string]bool)
+	for _, k := range strings.Fields(string(fpdata)) {
+		fps[k] = true
+	}
+
+	bf, err := FromWillf(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := bloom.Load(bytes.NewReader(saved))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []bloom.Bloom{bf, loaded} {
+		for i := 0; i < 1000; i++ {
+			if k := fmt.Sprintf("fixture-key-%d", i); !f.Check([]byte(k)) {
+				t.Fatalf("False negative for %s", k)
+			}
+		}
+
+		for i := 0; i < 10000; i++ {
+			if k := fmt.Sprintf("absent-key-%d", i); f.Check([]byte(k)) != fps[k] {
+				t.Fatalf("Expected Check(%s) = %t as in willf/bloom", k, fps[k])
+			}
+		}
+	}
+
+	bad := append([]byte(nil), data...)
+	bad[7]++
+	if _, err := FromWillf(bytes.NewReader(bad)); err == nil {
+		t.Error("Expected error when m doesn't match the bit array length")
+	}
+
+	if _, err := FromWillf(bytes.NewReader(data[:len(data)-8])); err == nil {
+		t.Error("Expected error for truncated willf filter")
+	}
+
+	// A header claiming more bits than there are fails rather than allocating them
+	for _, v := range [][3]uint64{{1 << 40, 7, 1 << 40}, {1 << 20, 1 << 40, 1 << 20}} {
+		bad := binary.BigEndian.AppendUint64(nil, v[0])
+		bad = binary.BigEndian.AppendUint64(bad, v[1])
+		bad = binary.BigEndian.AppendUint64(bad, v[2])
+		bad = append(bad, make([]byte, 200)...)
+		if _, err := FromWillf(bytes.NewReader(bad)); err == nil {
+			t.Errorf("Expected error for m = %d, k = %d in 200 bytes", v[0], v[1])
+		}
+	}
+}
+
+// TestCraftedHeader reads filters whose header doesn't match the data, which must fail
+// without allocating what the header claims.
+func TestCraftedHeader(t *testing.T) {
+	for _, h := range []bloom.Header{
+		{M: 1 << 40, K: 7, N: 1000, P: 0.5, E: 0.01},
+		{M: 1 << 40, K: 7, N: 1000, P: 0.5, E: 0.01, Flags: bloom.FlagSparse},
+		{M: 9600, K: 1 << 40, N: 1000, P: 0.5, E: 0.01},
+		{M: 9600, K: 1 << 50, N: 1000, P: 0.5, E: 0.01},
+		{M: 0, K: 7, N: 1000, P: 0.5, E: 0.01},
+	} {
+		h.Version, h.Kind = bloom.Version, bloom.KindStandard
+
+		var buf bytes.Buffer
+		h.WriteTo(&buf)
+		buf.Write(make([]byte, 200))
+
+		if _, err := bloom.Load(bytes.NewReader(buf.Bytes())); err == nil {
+			t.Errorf("Expected Load to fail for m = %d, k = %d", h.M, h.K)
+		}
+
+		if err := new(StandardBloom).UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("Expected UnmarshalBinary to fail for m = %d, k = %d", h.M, h.K)
+		}
+	}
+}
+
+// The hashers of a family, a seeded or a keyed one, are recreated from the parameters held
+// in the hasher name of the header. testdata/seeded.bloom and testdata/keyed.bloom were
+// written after adding fixture-key-0 to fixture-key-999 to NewWithEstimates(1000, 0.01),
+// with bloom.SeededHasherName(0x0123456789abcdef) and with the hmac-sha256 family below and
+// the key 0123456789abcdef. The _fp.txt files list the keys among absent-key-0 to
+// absent-key-9999 for which Check returned true, which it must still do when the filters
+// are loaded elsewhere.
+func TestHasherFamilyFixtures(t *testing.T) {
+	bloom.RegisterHasherFamily("hmac-sha256", func(key []byte) (hash.Hash, error) {
+		return hmac.New(sha256.New, key), nil
+	})
+
+	for _, name := range []string{"seeded", "keyed"} {
+		data, err := os.ReadFile("testdata/" + name + ".bloom")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fpdata, err := os.ReadFile("testdata/" + name + "_fp.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fps := make(map[string]bool)
+		for _, k := range strings.Fields(string(fpdata)) {
+			fps[k] = true
+		}
+
+		bf, err := bloom.Load(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ro, err := UnsafeFromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range []interface{ Check([]byte) bool }{bf, ro} {
+			for i := 0; i < 1000; i++ {
+				if k := fmt.Sprintf("fixture-key-%d", i); !f.Check([]byte(k)) {
+					t.Fatalf("%s, %T: %q not found", name, f, k)
+				}
+			}
+
+			for i := 0; i < 10000; i++ {
+				if k := fmt.Sprintf("absent-key-%d", i); f.Check([]byte(k)) != fps[k] {
+					t.Fatalf("%s, %T: Check(%q) = %t, expected %t", name, f, k, !fps[k], fps[k])
+				}
+			}
+		}
+
+		// The filter writes the same bytes again
+		if saved, err := bf.(*StandardBloom).MarshalBinary(); err != nil || !bytes.Equal(saved, data) {
+			t.Errorf("%s: MarshalBinary returned %d bytes, %v, expected the %d bytes read", name, len(saved), err, len(data))
+		}
+	}
+
+	// The key must match for the filter to be usable, and unknown families can't be loaded
+	data, _ := os.ReadFile("testdata/keyed.bloom")
+	h := &bloom.Header{}
+	h.ReadFrom(bytes.NewReader(data))
+	if family, key, ok := bloom.ParseHasherName(h.Hasher); !ok || family != "hmac-sha256" || string(key) != "0123456789abcdef" {
+		t.Errorf("Hasher %q, expected the hmac-sha256 family with the key", h.Hasher)
+	}
+
+	bf := New(10).(*StandardBloom)
+	bf.SetNamedHasher(bloom.FamilyHasherName("hmac-sha256", []byte("key")))
+	data, _ = bf.MarshalBinary()
+	data = bytes.Replace(data, []byte("hmac-sha256"), []byte("hmac-sha512"), 1)
+	if _, err := bloom.Load(bytes.NewReader(data)); !errors.Is(err, bloom.ErrUnknownHasher) {
+		t.Errorf("Expected ErrUnknownHasher for an unknown family, got %v", err)
+	}
+}
+
+func TestAddString(t *testing.T) {
+	bf := New(uint(len(web2))).(*StandardBloom)
+	bf2 := New(uint(len(web2))).(*StandardBloom)
+
+	for l := range web2 {
+		if l%2 == 0 {
+			bf.AddString(web2[l])
+		} else {
+			bf.Add([]byte(web2[l]))
+		}
+		bf2.Add([]byte(web2[l]))
+	}
+
+	for l := range web2a {
+		if bf.CheckString(web2a[l]) != bf2.Check([]byte(web2a[l])) {
+			t.Fatalf("CheckString mismatch for %q", web2a[l])
+		}
+	}
+
+	data, err := bf2.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := UnsafeFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for l := range web2a {
+		if ro.CheckString(web2a[l]) != bf2.Check([]byte(web2a[l])) {
+			t.Fatalf("ReadOnlyBloom CheckString mismatch for %q", web2a[l])
+		}
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		bf.AddString(web2[0])
+		bf.CheckString(web2a[0])
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per AddString and CheckString, got %f", allocs)
+	}
+}
+
+// Hashers implementing hash.Hash64 are read with Sum64, and the others through the digest
+// buffer of the filter, so neither allocates.
+func TestHasherAllocs(t *testing.T) {
+	for _, name := range []string{"fnv64a", "crc64-ecma", "md5", "sha1"} {
+		bf := New(1000).(*StandardBloom)
+		if err := bf.SetNamedHasher(name); err != nil {
+			t.Fatal(err)
+		}
+
+		allocs := testing.AllocsPerRun(1000, func() {
+			bf.AddString("hello")
+			bf.CheckString("world")
+		})
+
+		if allocs != 0 {
+			t.Errorf("%s: %f allocations per AddString and CheckString, expected 0", name, allocs)
+		}
+	}
+}
+
+func TestAddUint64(t *testing.T) {
+	bf := New(100000).(*StandardBloom)
+	for v := uint64(0); v < 100000; v++ {
+		bf.AddUint64(v * 0x9e3779b97f4a7c15)
+	}
+
+	var key [8]byte
+	fn := 0
+	for v := uint64(0); v < 100000; v++ {
+		binary.BigEndian.PutUint64(key[:], v*0x9e3779b97f4a7c15)
+		if !bf.Check(key[:]) || !bf.CheckUint64(v*0x9e3779b97f4a7c15) {
+			fn++
+		}
+	}
+
+	if fn != 0 {
+		t.Errorf("Expected 0 false negatives, got %d", fn)
+	}
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		bf.AddUint64(1)
+		bf.CheckUint64(2)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per AddUint64 and CheckUint64, got %f", allocs)
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2))).(*StandardBloom)
+	bf.AddAll(items[:len(items)/2])
+	bf.AddAllStrings(web2[len(web2)/2:])
+
+	bf2 := New(uint(len(web2))).(*StandardBloom)
+	for _, item := range items {
+		bf2.Add(item)
+	}
+
+	if bf.Count() != bf2.Count() {
+		t.Errorf("Expected count %d, got %d", bf2.Count(), bf.Count())
+	}
+
+	if !bf.b.Equal(bf2.b) {
+		t.Errorf("Expected AddAll to set the same bits as Add")
+	}
+}
+
+func TestCheckMany(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < len(web2); l += 2 {
+		bf.Add([]byte(web2[l]))
+	}
+
+	items := make([][]byte, 0, len(web2)+len(web2a))
+	for _, w := range append(append([]string(nil), web2...), web2a...) {
+		items = append(items, []byte(w))
+	}
+
+	out := bf.(*StandardBloom).CheckMany(items, nil)
+	if len(out) != len(items) {
+		t.Fatalf("Expected %d results, got %d", len(items), len(out))
+	}
+
+	for i, item := range items {
+		if out[i] != bf.Check(item) {
+			t.Fatalf("CheckMany mismatch for %q", item)
+		}
+	}
+
+	buf := make([]bool, 10, 2000)
+	out = bf.(*StandardBloom).CheckMany(items[:2000], buf)
+	if &out[0] != &buf[0] {
+		t.Errorf("Expected CheckMany to reuse the result slice")
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		bf.(*StandardBloom).CheckMany(items[:2000], buf)
+	})
+
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per CheckMany, got %f", allocs)
+	}
+}
+
+func TestNewWithEstimates(t *testing.T) {
+	seen := make(map[string]bool, len(web2))
+	for _, w := range web2 {
+		seen[w] = true
+	}
+
+	for _, rate := range []float64{0.01, 0.001} {
+		bf := NewWithEstimates(uint(len(web2)), rate)
+		for l := range web2 {
+			bf.Add([]byte(web2[l]))
+		}
+
+		fp, total := 0, 0
+		for l := range web2a {
+			if seen[web2a[l]] {
+				continue
+			}
+			total++
+			if bf.Check([]byte(web2a[l])) {
+				fp++
+			}
+		}
+
+		measured := float64(fp) / float64(total)
+		fmt.Printf("Requested false positive rate %.4f, measured %.4f\n", rate, measured)
+
+		if measured > rate*1.5 || measured < rate/4 {
+			t.Errorf("Measured false positive rate %.4f is not near the requested %.4f", measured, rate)
+		}
+	}
+}
+
+func TestNewE(t *testing.T) {
+	if _, err := NewE(0, 0.01); err != bloom.ErrInvalidCapacity {
+		t.Errorf("Expected ErrInvalidCapacity, got %v", err)
+	}
+
+	for _, e := range []float64{0, 1, -0.5, 2} {
+		if _, err := NewE(1000, e); err != bloom.ErrInvalidErrorRate {
+			t.Errorf("Expected ErrInvalidErrorRate for %v, got %v", e, err)
+		}
+	}
+
+	bf, err := NewE(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf.SetErrorProbability(0); err != bloom.ErrInvalidErrorRate {
+		t.Errorf("Expected ErrInvalidErrorRate, got %v", err)
+	}
+
+	if bf.(*StandardBloom).e != 0.01 {
+		t.Errorf("Expected an invalid error probability to be ignored, got %v", bf.(*StandardBloom).e)
+	}
+
+	if !bf.Add([]byte("hello")).Check([]byte("hello")) {
+		t.Errorf("Expected to find hello")
+	}
+}
+
+func TestParams(t *testing.T) {
+	bf := New(1000)
+	want := bloom.Params{M: bloom.M(1000, 0.5, 0.001), K: bloom.K(0.001), N: 1000, P: 0.5, E: 0.001}
+	if got := bf.Params(); got != want {
+		t.Fatalf("Expected %+v, got %+v", want, got)
+	}
+
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Fatal(err)
+	}
+	bf.Reset()
+
+	want = bloom.Params{M: bloom.M(1000, 0.5, 0.01), K: bloom.K(0.01), N: 1000, P: 0.5, E: 0.01}
+	if got := bf.Params(); got != want {
+		t.Fatalf("Expected %+v after Reset, got %+v", want, got)
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.(*StandardBloom).Encode(&buf, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := UnsafeFromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ro.Params(); got != want {
+		t.Fatalf("Expected %+v from the read-only filter, got %+v", want, got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < 1000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	stats := bf.Stats()
+	if stats.Count != 1000 || stats.Params != bf.Params() {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	if stats.FillRatio != bf.FillRatio() || stats.BitsSet != bf.(*StandardBloom).b.Count() {
+		t.Errorf("Expected a fill ratio of %f, got %f with %d bits set", bf.FillRatio(), stats.FillRatio, stats.BitsSet)
+	}
+
+	var buf bytes.Buffer
+	if err := bf.WriteStats(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("m = %d, n = %d, k = %d, s = 0, p = 0.500000, e = 0.001000\nTotal items: 1000\nTotal bits set: %d (%.1f%%)\n",
+		stats.Params.M, len(web2), stats.Params.K, stats.BitsSet, stats.FillRatio*100)
+	if buf.String() != want {
+		t.Errorf("Expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestString(t *testing.T) {
+	bf := New(1000)
+	bf.Add([]byte("hello")).Add([]byte("world"))
+
+	if got := fmt.Sprint(bf); got != "standard{n=1000 m=14378 k=10 e=0.001 count=2 fill=0.00}" {
+		t.Errorf("Unexpected summary %q", got)
+	}
+}
+
+func TestClone(t *testing.T) {
+	bf := New(uint(len(web2)))
+	for l := 0; l < len(web2)/2; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	c, err := bf.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.(*StandardBloom).h == bf.(*StandardBloom).h {
+		t.Fatalf("Expected the clone to have its own hasher")
+	}
+
+	if c.Count() != bf.Count() || c.FillRatio() != bf.FillRatio() {
+		t.Fatalf("Expected the clone to match the filter, got %v and %v", c, bf)
+	}
+
+	fill := bf.FillRatio()
+	for l := len(web2) / 2; l < len(web2); l++ {
+		bf.Add([]byte(web2[l]))
+	}
+	for l := range web2a {
+		c.Add([]byte(web2a[l]))
+	}
+
+	if c.Count() != uint64(len(web2)/2+len(web2a)) || bf.Count() != uint64(len(web2)) {
+		t.Errorf("Expected the counts to change independently, got %d and %d", c.Count(), bf.Count())
+	}
+
+	if c.FillRatio() == fill {
+		t.Errorf("Expected the fill ratio of the clone to change")
+	}
+
+	ref := New(uint(len(web2)))
+	for l := range web2 {
+		ref.Add([]byte(web2[l]))
+	}
+
+	if bf.FillRatio() != ref.FillRatio() {
+		t.Errorf("Expected the filter not to be changed by the clone")
+	}
+
+	for l := range web2a {
+		if !c.Check([]byte(web2a[l])) {
+			t.Fatalf("Expected the clone to have %q", web2a[l])
+		}
+	}
+
+	bf = New(1000)
+	bf.SetHasher(struct{ hash.Hash }{fnv.New64()})
+	if _, err := bf.Clone(); err != bloom.ErrHasherNotCloneable {
+		t.Errorf("Expected ErrHasherNotCloneable, got %v", err)
+	}
+}
+
+func TestApproximateCardinality(t *testing.T) {
+	bf := New(100000)
+
+	// Each of the 50000 distinct items is added 20 times.
+	for r := 0; r < 20; r++ {
+		for l := 0; l < 50000; l++ {
+			bf.Add([]byte(web2[l]))
+		}
+	}
+
+	c := bf.ApproximateCardinality()
+	fmt.Printf("Added %d items, %d distinct, estimated %d\n", bf.Count(), 50000, c)
+
+	if math.Abs(float64(c)-50000)/50000 > 0.02 {
+		t.Errorf("Expected about 50000 distinct items, got %d", c)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	a := New(uint(len(web2))).(*StandardBloom)
+	b := New(uint(len(web2))).(*StandardBloom)
+
+	half := len(web2) / 2
+	for l := 0; l < half; l++ {
+		a.Add([]byte(web2[l]))
+	}
+	for l := half; l < len(web2); l++ {
+		b.Add([]byte(web2[l]))
+	}
+
+	// The bits set by Union are carried by the next delta
+	if _, err := a.Checkpoint(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Union(b); err != nil {
+		t.Fatal(err)
+	}
+
+	var delta bytes.Buffer
+	if _, err := a.Checkpoint(&delta); err != nil {
+		t.Fatal(err)
+	}
+
+	replica := New(uint(len(web2))).(*StandardBloom)
+	for l := 0; l < half; l++ {
+		replica.Add([]byte(web2[l]))
+	}
+	replica.SetDeltaSeq(1)
+	if err := replica.ApplyDelta(&delta); err != nil {
+		t.Fatal(err)
+	}
+
+	fn := 0
+	for l := range web2 {
+		if !a.Check([]byte(web2[l])) || !replica.Check([]byte(web2[l])) {
+			fn++
+		}
+	}
+
+	fmt.Printf("Union: %d false negatives, estimated count %d of %d\n", fn, a.Count(), len(web2))
+
+	if fn != 0 {
+		t.Errorf("Expected no false negatives, got %d", fn)
+	}
+
+	if d := math.Abs(float64(a.Count())-float64(len(web2))) / float64(len(web2)); d > 0.01 {
+		t.Errorf("Expected the count to be near %d, got %d", len(web2), a.Count())
+	}
+
+	// A union with a copy of itself must not double the count.
+	c := a.Count()
+	self, _ := a.Clone()
+	if err := a.Union(self.(*StandardBloom)); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Count() > c+c/100 {
+		t.Errorf("Expected the count to stay near %d, got %d", c, a.Count())
+	}
+
+	if err := a.Union(New(1000).(*StandardBloom)); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different size, got %v", err)
+	}
+
+	other := New(uint(len(web2))).(*StandardBloom)
+	other.SetNamedHasher("fnv64a")
+	if err := a.Union(other); !errors.Is(err, bloom.ErrIncompatible) {
+		t.Errorf("Expected ErrIncompatible for a different hasher, got %v", err)
+	}
+}
+
+func TestCurrentFalsePositiveRate(t *testing.T) {
+	bf := New(uint(len(web2) / 2))
+	if r := bf.CurrentFalsePositiveRate(); r != 0 {
+		t.Errorf("Expected 0 for an empty filter, got %f", r)
+	}
+
+	for l := 0; l < len(web2)/2; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	r := bf.CurrentFalsePositiveRate()
+	if r != bf.Stats().FalsePositiveRate {
+		t.Errorf("Expected Stats to report %f, got %f", r, bf.Stats().FalsePositiveRate)
+	}
+
+	// At its design point, the filter measures about its configured error probability.
+	fp := 0
+	for l := range web2a {
+		if bf.Check([]byte(web2a[l])) {
+			fp++
+		}
+	}
+
+	measured := float64(fp) / float64(len(web2a))
+	fmt.Printf("Current false positive rate %f, measured %f\n", r, measured)
+
+	if r > 0.002 || measured > r*2 || measured < r/2 {
+		t.Errorf("Expected about 0.001, got %f and measured %f", r, measured)
+	}
+
+	// Filled with twice as many items, it is well past it.
+	for l := len(web2) / 2; l < len(web2); l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	fmt.Printf("Current false positive rate when overfilled %f\n", bf.CurrentFalsePositiveRate())
+
+	if bf.CurrentFalsePositiveRate() < 0.01 {
+		t.Errorf("Expected the false positive rate to grow, got %f", bf.CurrentFalsePositiveRate())
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	bf := New(10000).(*StandardBloom)
+	if bf.Capacity() != 10000 || bf.Remaining() != 10000 || bf.IsOverCapacity() {
+		t.Fatalf("Expected an empty filter with a capacity of 10000, got %d remaining", bf.Remaining())
+	}
+
+	for l := 0; l < 9900; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.Remaining() != 100 || bf.IsOverCapacity() {
+		t.Errorf("Expected 100 remaining, got %d, over capacity %t", bf.Remaining(), bf.IsOverCapacity())
+	}
+
+	for l := 9900; l < 10100; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	if bf.Remaining() != -100 || !bf.IsOverCapacity() {
+		t.Errorf("Expected -100 remaining, got %d, over capacity %t", bf.Remaining(), bf.IsOverCapacity())
+	}
+}
+
+func TestClear(t *testing.T) {
+	bf := New(10000)
+	for l := 0; l < 20000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	params := bf.Params()
+	if err := bf.SetErrorProbability(0.1); err != bloom.ErrNotEmpty {
+		t.Fatalf("Expected ErrNotEmpty, got %v", err)
+	}
+	bf.Clear()
+
+	p := bf.Params()
+	if p.M != params.M || p.K != params.K || p.S != params.S || bf.Count() != 0 || bf.FillRatio() != 0 {
+		t.Fatalf("Expected an empty filter with the same parameters, got %v", bf)
+	}
+
+	allocs := testing.AllocsPerRun(100, bf.Clear)
+	if allocs != 0 {
+		t.Errorf("Expected 0 allocations per Clear, got %f", allocs)
+	}
+
+	for l := 0; l < 1000; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	for l := 0; l < 1000; l++ {
+		if !bf.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q after Clear", web2[l])
+		}
+	}
+}
+
+func TestSetFillRatio(t *testing.T) {
+	bf := New(10000)
+	m := bf.Params().M
+
+	for _, p := range []float64{0, 1, -0.5} {
+		if err := bf.SetFillRatio(p); err != bloom.ErrInvalidFillRatio {
+			t.Errorf("Expected ErrInvalidFillRatio for %v, got %v", p, err)
+		}
+	}
+
+	if err := bf.SetFillRatio(0.25); err != nil {
+		t.Fatal(err)
+	}
+	bf.Reset()
+
+	if p := bf.Params(); p.P != 0.25 || p.M <= m {
+		t.Errorf("Expected p = 0.25 to give more than %d bits, got %d", m, p.M)
+	}
+}
+
+func TestSetErrorProbability(t *testing.T) {
+	bf := New(10000)
+	if err := bf.SetErrorProbability(1e-5); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parameters are recomputed right away, without a Reset.
+	if p := bf.Params(); p.E != 1e-5 || p.K != bloom.K(1e-5) || p.M != bloom.M(10000, 0.5, 1e-5) {
+		t.Errorf("Expected the parameters for e = 1e-5, got %+v", p)
+	}
+
+	bf.Add([]byte("hello"))
+	params := bf.Params()
+
+	if err := bf.SetErrorProbability(0.01); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	if err := bf.SetFillRatio(0.25); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	if bf.Params() != params || !bf.Check([]byte("hello")) {
+		t.Errorf("Expected the filter to be unchanged")
+	}
+}
+
+func TestSetHasherNotEmpty(t *testing.T) {
+	bf := New(1000)
+	if err := bf.SetHasher(murmur3.New64()); err != nil {
+		t.Fatalf("Expected SetHasher to succeed on an empty filter, got %v", err)
+	}
+
+	bf.Add([]byte("hello"))
+
+	if err := bf.SetHasher(fnv.New64a()); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty from SetHasher, got %v", err)
+	}
+
+	if err := bf.(*StandardBloom).SetNamedHasher("fnv64a"); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty from SetNamedHasher, got %v", err)
+	}
+
+	if !bf.Check([]byte("hello")) {
+		t.Errorf("Expected the hasher to be unchanged")
+	}
+
+	// Reset empties the filter, so the hasher and parameters can be set again
+	bf.Reset()
+	if bf.Count() != 0 || bf.Check([]byte("hello")) {
+		t.Errorf("Expected an empty filter after Reset, got a count of %d", bf.Count())
+	}
+
+	if err := bf.SetHasher(fnv.New64a()); err != nil {
+		t.Errorf("Expected SetHasher to succeed after Reset, got %v", err)
+	}
+
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Errorf("Expected SetErrorProbability to succeed after Reset, got %v", err)
+	}
+}
+
+func TestIntrospector(t *testing.T) {
+	bf := New(1000)
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Fatal(err)
+	}
+
+	i, ok := bf.(bloom.Introspector)
+	if !ok {
+		t.Fatalf("Expected %T to implement bloom.Introspector", bf)
+	}
+
+	p := bf.Params()
+	if i.K() != p.K || i.M() != p.M || i.S() != p.S || i.HasherName() != bloom.DefaultHasher {
+		t.Errorf("Expected %+v with hasher %q, got k = %d, m = %d, s = %d, hasher %q", p, bloom.DefaultHasher, i.K(), i.M(), i.S(), i.HasherName())
+	}
+
+	bf.SetHasher(murmur3.New64())
+	if i.HasherName() != "" {
+		t.Errorf("Expected no hasher name, got %q", i.HasherName())
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	for _, n := range []uint{1000, 100000, 1000000} {
+		for _, e := range []float64{0.01, 0.001} {
+			bf := NewWithEstimates(n, e)
+			for l := uint64(0); l < uint64(n/2); l++ {
+				bf.(*StandardBloom).AddUint64(l)
+			}
+
+			used, est := bf.MemoryUsage(), EstimateMemory(n, e)
+			if m := uint64(bf.Params().M / 8); used < m {
+				t.Errorf("n = %d, e = %f: Expected at least %d bytes for the bits, got %d", n, e, m, used)
+			}
+
+			if d := math.Abs(float64(used)-float64(est)) / float64(used); d > 0.02 {
+				t.Errorf("n = %d, e = %f: Estimated %d bytes, used %d", n, e, est, used)
+			}
+		}
+	}
+}
+
+func TestCountOverflow(t *testing.T) {
+	bf := New(1000).(*StandardBloom)
+
+	// Set the counter past 2^32 rather than adding that many items.
+	bf.c = 1<<32 + 10
+	bf.Add([]byte("hello")).Add([]byte("world"))
+
+	if bf.Count() != 1<<32+12 || bf.Stats().Count != 1<<32+12 {
+		t.Fatalf("Expected a count of %d, got %d", uint64(1<<32+12), bf.Count())
+	}
+
+	if f := bf.EstimatedFillRatio(); math.IsNaN(f) || f < 0.99 || f > 1 {
+		t.Errorf("Expected an estimated fill ratio of about 1, got %f", f)
+	}
+
+	if !bf.IsOverCapacity() || bf.Remaining() != 1000-(1<<32+12) {
+		t.Errorf("Expected the filter to be over capacity, got %d remaining", bf.Remaining())
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Count() != 1<<32+12 {
+		t.Errorf("Expected the count to be serialized, got %d", bf2.Count())
+	}
+}
+
+// TestConcurrentCheck checks items from many goroutines at once, expecting the same results
+// as checking them one at a time. Run it with -race.
+func TestConcurrentCheck(t *testing.T) {
+	n := len(web2) / 10
+
+	bf := New(uint(n)).(*StandardBloom)
+
+	// Not a hash.Cloner, so the Checks take turns using it.
+	shared := New(uint(n)).(*StandardBloom)
+	shared.SetHasher(struct{ hash.Hash64 }{fnv.New64()})
+
+	for l := 0; l < n; l++ {
+		bf.Add([]byte(web2[l]))
+		shared.Add([]byte(web2[l]))
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.Encode(&buf, &bloom.WriteOptions{Encoding: bloom.EncodingDense}); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := UnsafeFromBytes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters := map[string]interface {
+		Check(item []byte) bool
+		CheckString(s string) bool
+		CheckUint64(v uint64) bool
+	}{
+		"standard": bf,
+		"shared":   shared,
+		"readonly": ro,
+	}
+
+	// Half of the keys were added.
+	keys := web2[n-5000 : n+5000]
+
+	for name, f := range filters {
+		want, wantU64 := make([]bool, len(keys)), make([]bool, len(keys))
+		for i, k := range keys {
+			want[i] = f.Check([]byte(k))
+			wantU64[i] = f.CheckUint64(uint64(i))
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 16; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				for i, k := range keys {
+					var got bool
+					switch w % 3 {
+					case 0:
+						got = f.Check([]byte(k))
+					case 1:
+						got = f.CheckString(k)
+					case 2:
+						if f.CheckUint64(uint64(i)) != wantU64[i] {
+							t.Errorf("%s: CheckUint64(%d) = %t, expected %t", name, i, !wantU64[i], wantU64[i])
+							return
+						}
+						continue
+					}
+
+					if got != want[i] {
+						t.Errorf("%s: Check(%q) = %t, expected %t", name, k, got, want[i])
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	n := len(web2) / 10
+
+	bf := New(uint(2 * n)).(*StandardBloom)
+	for l := 0; l < n; l++ {
+		bf.Add([]byte(web2[l]))
+	}
+
+	v, err := NewVersioned(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s1 := v.Snapshot()
+	if s1.Count() != uint64(n) || s1.Params() != bf.Params() {
+		t.Fatalf("Snapshot has count %d and %+v, expected %d and %+v", s1.Count(), s1.Params(), n, bf.Params())
+	}
+
+	// A single item writes to at most k of the pages.
+	const added = 1
+	for i := 0; i < added; i++ {
+		v.Add([]byte(web2[n+i]))
+	}
+
+	missing := 0
+	for i := 0; i < added; i++ {
+		if !v.Check([]byte(web2[n+i])) {
+			t.Fatalf("Expected to find %q before Commit", web2[n+i])
+		}
+		if !v.Snapshot().Check([]byte(web2[n+i])) {
+			missing++
+		}
+	}
+
+	if missing == 0 || v.Snapshot() != s1 {
+		t.Fatalf("Expected the items added after the snapshot not to be found before Commit")
+	}
+
+	s2 := v.Commit()
+	if v.Snapshot() != s2 || s2.Count() != uint64(n+added) || s1.Count() != uint64(n) {
+		t.Fatalf("Commit didn't publish a new snapshot")
+	}
+
+	for l := 0; l < n+added; l++ {
+		if !s2.CheckString(web2[l]) {
+			t.Fatalf("Expected to find %q after Commit", web2[l])
+		}
+	}
+
+	// The pages not written to since the first snapshot are shared.
+	shared := 0
+	for i := range s1.pages {
+		if &s1.pages[i][0] == &s2.pages[i][0] {
+			shared++
+		}
+	}
+
+	if shared == 0 || shared == len(s1.pages) {
+		t.Errorf("%d of %d pages shared, expected only the pages written to be copied", shared, len(s1.pages))
+	}
+
+	bf2, err := s2.Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Count() != s2.Count() || bf2.Params() != s2.Params() {
+		t.Errorf("Filter returned %v", bf2)
+	}
+
+	for l := 0; l < n+added; l++ {
+		if !bf2.Check([]byte(web2[l])) {
+			t.Fatalf("Expected to find %q in the filter of the snapshot", web2[l])
+		}
+		if bf.Check([]byte(web2[l])) != s1.Check([]byte(web2[l])) {
+			t.Fatalf("The first snapshot doesn't match the original filter for %q", web2[l])
+		}
+	}
+
+	v.Add([]byte("foo"))
+	if bf2.Check([]byte("foo")) || s2.Check([]byte("foo")) || bf.Check([]byte("foo")) {
+		t.Errorf("Add changed the original filter or an earlier snapshot")
+	}
+}
+
+// TestVersionedConcurrent checks items in the published snapshot while a writer adds items
+// and commits. Run it with -race.
+func TestVersionedConcurrent(t *testing.T) {
+	n := len(web2) / 10
+
+	v, err := NewVersioned(New(uint(n)).(*StandardBloom))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Every item counted by the snapshot must be found.
+				s := v.Snapshot()
+				for l := 0; l < int(s.Count()); l++ {
+					if !s.CheckUint64(uint64(l)) {
+						t.Errorf("Expected to find %d in a snapshot of %d items", l, s.Count())
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var key [8]byte
+	for l := 0; l < n; l++ {
+		binary.BigEndian.PutUint64(key[:], uint64(l))
+		v.Add(key[:])
+		if l%1000 == 0 {
+			v.Commit()
+		}
+	}
+	v.Commit()
+
+	close(done)
+	wg.Wait()
+}
+
+// TestConcurrentBloom adds and checks items from many goroutines at once. Run it with -race.
+func TestConcurrentBloom(t *testing.T) {
+	n := len(web2) / 10
+	bf := NewConcurrent(New(uint(n)).(*StandardBloom))
+
+	const workers = 8
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for l := w; l < n; l += workers {
+				bf.AddString(web2[l])
+				if !bf.CheckString(web2[l]) {
+					t.Errorf("Expected to find %q", web2[l])
+					return
+				}
+
+				// Items added by others, which may or may not be there yet
+				bf.Check([]byte(web2[(l+1)%n]))
+				bf.Count()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if bf.Count() != uint64(n) {
+		t.Errorf("Expected %d items, got %d", n, bf.Count())
+	}
+
+	s := bf.Stats()
+	if s.Checks != 2*uint64(n) || s.Hits+s.Misses != s.Checks || s.Hits < uint64(n) {
+		t.Errorf("Stats counted %d checks, %d hits and %d misses for %d items", s.Checks, s.Hits, s.Misses, n)
+	}
+
+	if s.Count != uint64(n) || s.Params != bf.Params() {
+		t.Errorf("Stats = %+v", s)
+	}
+
+	var buf bytes.Buffer
+	bf.WriteStats(&buf)
+	if !strings.Contains(buf.String(), "Checks: ") {
+		t.Errorf("WriteStats doesn't include the checks:\n%s", buf.String())
+	}
+
+	hits := bf.Hits()
+	for l := n; l < n+1000; l++ {
+		bf.Check([]byte(web2[l]))
+	}
+	if bf.Hits()+bf.Misses() != s.Checks+1000 || bf.Hits()-hits > 100 {
+		t.Errorf("Expected 1000 more checks with few hits, got %d hits and %d misses", bf.Hits(), bf.Misses())
+	}
+
+	if err := bf.SetErrorProbability(0.01); !errors.Is(err, bloom.ErrNotEmpty) {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	// Rebuilding the filter while others check it.
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				bf.CheckString(web2[0])
+			}
+		}
+	}()
+
+	bf.Clear()
+	if bf.Count() != 0 || bf.CheckString(web2[0]) {
+		t.Errorf("Expected an empty filter after Clear")
+	}
+
+	if err := bf.SetErrorProbability(0.01); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := bf.Params(); p.E != 0.01 || p.K != bloom.K(0.01) {
+		t.Errorf("Expected the filter rebuilt for e = 0.01, got %+v", p)
+	}
+
+	if err := bf.SetHasher(murmur3.New64()); err != nil {
+		t.Fatal(err)
+	}
+
+	bf.AddString(web2[0])
+	bf.Reset()
+	if bf.Count() != 0 || bf.CheckString(web2[0]) {
+		t.Errorf("Expected an empty filter after Reset")
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestFingerprints(t *testing.T) {
+	// With e = 0.5 the bloom filter has many false positives, so the reduction can be
+	// measured at a tenth of the capacity too
+	for _, load := range []uint{1, 10} {
+		for _, hasher := range []string{bloom.DefaultHasher, WillfHasher} {
+			n := uint(len(web2)) * load
+			bf := NewWithEstimates(n, 0.5)
+			fb := NewWithFingerprints(n, 0.5).(*FingerprintBloom)
+			bf.(*StandardBloom).SetNamedHasher(hasher)
+			if err := fb.SetNamedHasher(hasher); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, w := range web2 {
+				bf.Add([]byte(w))
+				fb.AddString(w)
+			}
+
+			for _, w := range web2 {
+				if !fb.CheckString(w) {
+					t.Fatalf("%s, n = %d: false negative %q", hasher, n, w)
+				}
+			}
+
+			bfp, ffp := 0, 0
+			for _, w := range web2a {
+				if bf.Check([]byte(w)) {
+					bfp++
+				}
+				if fb.CheckString(w) {
+					ffp++
+				}
+			}
+
+			rate := float64(ffp) / float64(len(web2a))
+			stats := fb.Stats()
+			fmt.Printf("%s, n = %d: %d false positives, %d without fingerprints, rate %.5f, estimated %.5f\n", hasher, n, ffp, bfp, rate, stats.FalsePositiveRate)
+			fb.PrintStats()
+
+			// The rate is divided by about 3.8 at capacity, and 200 at a tenth of it
+			if div := []int{0, 3, 100}[min(load, 2)]; ffp*div > bfp {
+				t.Errorf("%s, n = %d: %d false positives, expected at most 1/%d of %d", hasher, n, ffp, div, bfp)
+			}
+
+			if math.Abs(rate-stats.FalsePositiveRate) > 0.3*stats.FalsePositiveRate {
+				t.Errorf("%s, n = %d: false positive rate %.5f, estimated %.5f", hasher, n, rate, stats.FalsePositiveRate)
+			}
+
+			if stats.FingerprintBytes < uint64(n) || stats.FingerprintCollisions != fb.Collisions() {
+				t.Errorf("%s, n = %d: Stats reports %d bytes and %d collisions", hasher, n, stats.FingerprintBytes, stats.FingerprintCollisions)
+			}
 		}
 	}
 }
 
+func TestFingerprintsClone(t *testing.T) {
+	fb := NewWithFingerprints(1000, 0.01)
+	fb.Add([]byte("hello"))
+
+	c, err := fb.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Add([]byte("world"))
+	if fb.Check([]byte("world")) && fb.(*FingerprintBloom).Collisions() == 0 {
+		t.Error("Clone shares its fingerprints with the filter")
+	}
+
+	if !c.Check([]byte("hello")) || !c.Check([]byte("world")) {
+		t.Error("Expected to find both items in the clone")
+	}
+
+	if err := fb.SetHasher(fnv.New64a()); err != bloom.ErrNotEmpty {
+		t.Errorf("SetHasher returned %v, expected ErrNotEmpty", err)
+	}
+
+	fb.Clear()
+	if fb.Check([]byte("hello")) || fb.Count() != 0 {
+		t.Error("Expected an empty filter after Clear")
+	}
+
+	if fb.MemoryUsage() <= EstimateMemory(1000, 0.01)+1000 {
+		t.Errorf("MemoryUsage = %d, expected more than the bloom filter and the table", fb.MemoryUsage())
+	}
+}
+
 func BenchmarkBloomFNV64(b *testing.B) {
 	var lines []string
 	lines = append(lines, web2...)
@@ -233,3 +2442,703 @@ func BenchmarkBloomSha1(b *testing.B) {
 
 	b.StopTimer()
 }
+
+func BenchmarkEncode(b *testing.B) {
+	for _, fill := range []float64{0.01, 0.05, 0.2, 0.5} {
+		bf := New(uint(len(web2))).(*StandardBloom)
+		for i := 0; bf.FillRatio() < fill; i++ {
+			bf.Add([]byte(web2[i%len(web2)] + strconv.Itoa(i)))
+		}
+
+		for _, c := range []bloom.Compression{bloom.CompressionNone, bloom.CompressionGzip} {
+			opts := &bloom.WriteOptions{Encoding: bloom.EncodingDense, Compression: c}
+
+			var buf bytes.Buffer
+			if _, err := bf.Encode(&buf, opts); err != nil {
+				b.Fatal(err)
+			}
+			data := buf.Bytes()
+
+			name := fmt.Sprintf("fill=%.2f/gzip=%t", fill, c == bloom.CompressionGzip)
+
+			b.Run(name+"/encode", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if _, err := bf.Encode(io.Discard, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "bytes")
+			})
+
+			b.Run(name+"/decode", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := (&StandardBloom{}).UnmarshalBinary(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(data)), "bytes")
+			})
+		}
+	}
+}
+
+// BenchmarkSaveLoadMemory reports the bytes allocated to save and load a filter of about
+// 36 MB, relative to the size of its bit array. Saving allocates a 1 MiB buffer, and
+// loading allocates the bit array itself and a 1 MiB buffer.
+func BenchmarkSaveLoadMemory(b *testing.B) {
+	bf := New(20000000).(*StandardBloom)
+	for i := 0; i < 1000000; i++ {
+		bf.Add([]byte(strconv.Itoa(i)))
+	}
+
+	path := filepath.Join(b.TempDir(), "bloom")
+	size := float64(wordsNeeded(bf.m) * 8)
+	opts := &bloom.WriteOptions{Encoding: bloom.EncodingDense}
+
+	var before, after runtime.MemStats
+
+	b.Run("save", func(b *testing.B) {
+		var alloc uint64
+		for i := 0; i < b.N; i++ {
+			f, err := os.Create(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			runtime.ReadMemStats(&before)
+			if _, err := bf.Encode(f, opts); err != nil {
+				b.Fatal(err)
+			}
+			runtime.ReadMemStats(&after)
+			alloc += after.TotalAlloc - before.TotalAlloc
+
+			f.Close()
+		}
+		b.ReportMetric(float64(alloc)/float64(b.N)/size, "alloc/filter")
+	})
+
+	b.Run("load", func(b *testing.B) {
+		var alloc uint64
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			runtime.ReadMemStats(&before)
+			if _, err := (&StandardBloom{}).ReadFrom(f); err != nil {
+				b.Fatal(err)
+			}
+			runtime.ReadMemStats(&after)
+			alloc += after.TotalAlloc - before.TotalAlloc
+
+			f.Close()
+		}
+		b.ReportMetric(float64(alloc)/float64(b.N)/size, "alloc/filter")
+	})
+}
+
+func BenchmarkAddString(b *testing.B) {
+	bf := New(uint(len(web2))).(*StandardBloom)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddString(web2[i%len(web2)])
+	}
+}
+
+func BenchmarkCheckString(b *testing.B) {
+	bf := New(uint(len(web2))).(*StandardBloom)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.CheckString(web2[i%len(web2)])
+	}
+}
+
+func BenchmarkAddEach(b *testing.B) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			bf.Add(item)
+		}
+	}
+}
+
+func BenchmarkAddAll(b *testing.B) {
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+	}
+
+	bf := New(uint(len(web2))).(*StandardBloom)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.AddAll(items)
+	}
+}
+
+func BenchmarkCheckEach(b *testing.B) {
+	bf := New(uint(len(web2)))
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+		bf.Add(items[l])
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for _, item := range items {
+			bf.Check(item)
+		}
+	}
+}
+
+func BenchmarkCheckMany(b *testing.B) {
+	bf := New(uint(len(web2)))
+	items := make([][]byte, len(web2))
+	for l := range web2 {
+		items[l] = []byte(web2[l])
+		bf.Add(items[l])
+	}
+	out := make([]bool, len(items))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		bf.(*StandardBloom).CheckMany(items, out)
+	}
+}
+
+// BenchmarkParallelCheck compares checking items from many goroutines, mostly, in a
+// StandardBloom, in the same filter wrapped by bloom.Safe and in a ConcurrentBloom. The
+// mixed benchmarks add an item for every 100 checks, which the StandardBloom can't do
+// concurrently.
+func BenchmarkParallelCheck(b *testing.B) {
+	filters := []struct {
+		name  string
+		bf    bloom.Bloom
+		mixed bool
+	}{
+		{"standard", New(uint(len(web2))), false},
+		{"safe", bloom.Safe(New(uint(len(web2)))), false},
+		{"safe/mixed", bloom.Safe(New(uint(len(web2)))), true},
+		{"concurrent", NewConcurrent(New(uint(len(web2))).(*StandardBloom)), false},
+		{"concurrent/mixed", NewConcurrent(New(uint(len(web2))).(*StandardBloom)), true},
+	}
+
+	for _, f := range filters {
+		for _, w := range web2 {
+			f.bf.Add([]byte(w))
+		}
+
+		b.Run(f.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if f.mixed && i%100 == 0 {
+						f.bf.Add([]byte(web2a[i%len(web2a)]))
+						continue
+					}
+					f.bf.Check([]byte(web2[i%len(web2)]))
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkCheckHasher compares checking items with hash.Hash hashers and with the Hashers
+// of the bloom package, which are called once per item instead of through Reset, Write
+// and Sum64.
+func BenchmarkCheckHasher(b *testing.B) {
+	hashers := []struct {
+		name string
+		h    hash.Hash
+	}{
+		{"fnv64a", fnv.New64a()},
+		{"murmur3", murmur3.New64()},
+		{"func/fnv1a", bloom.Hasher(bloom.FNV1a).Hash()},
+		{"func/murmur3", bloom.Hasher(bloom.Murmur3).Hash()},
+		{"func/xxhash", bloom.Hasher(bloom.XXHash).Hash()},
+	}
+
+	for _, h := range hashers {
+		bf := New(uint(len(web2))).(*StandardBloom)
+		bf.SetHasher(h.h)
+		for _, w := range web2 {
+			bf.AddString(w)
+		}
+
+		b.Run(h.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bf.CheckString(web2[i%len(web2)])
+			}
+		})
+	}
+}
+
+// TestWideIndex checks the positions of a filter of 2^36 bits, whose bits are not
+// allocated, are spread over the whole array with FlagWideIndex, and stay below k * 2^32
+// without it.
+func TestWideIndex(t *testing.T) {
+	m := ^uint(0)>>28 + 1
+	if uint64(m) <= math.MaxUint32 {
+		t.Skip("uint has 32 bits")
+	}
+
+	for _, digest := range []uint16{bloom.DigestFlags, bloom.FlagWideDigest | bloom.FlagSum128} {
+		bf := &StandardBloom{m: m, k: 10, digest: digest}
+		bf.setHasher(fnv.New64(), "")
+
+		// Positions per 2^32 bits of the array
+		var buckets [16]int
+		var bs []uint
+		for _, w := range web2[:10000] {
+			bs = bf.Positions([]byte(w), bs[:0])
+			for _, p := range bs {
+				if p >= m {
+					t.Fatalf("Position %d of %q is past %d bits", p, w, m)
+				}
+				buckets[uint64(p)>>32]++
+			}
+		}
+
+		wide := bf.digestFlags()&bloom.FlagWideIndex != 0
+		fmt.Printf("2^36 bits, wide index %t: positions per 2^32 bits %v\n", wide, buckets)
+
+		for i, c := range buckets {
+			switch {
+			case wide && c < 10000*10/16/2:
+				t.Errorf("%d positions in bits %d << 32, expected about %d", c, i, 10000*10/16)
+			case !wide && i >= int(bf.k) && c != 0:
+				t.Errorf("%d positions in bits %d << 32 without wide index, expected none", c, i)
+			}
+		}
+	}
+
+	// Filters that fit in 32 bits don't record the flag
+	bf := New(1000)
+	if flags := bf.(*StandardBloom).digestFlags(); flags&bloom.FlagWideIndex != 0 {
+		t.Errorf("digestFlags = %#x for %d bits, expected no FlagWideIndex", flags, bf.(*StandardBloom).m)
+	}
+}
+
+// TestFastRange compares the false positives of filters mapping their positions by
+// multiply-shift with those mapping them by modulo, for words and for sequential numbers,
+// whose fnv digests only differ in their low bits. The words are checked against 400000
+// more absent keys than web2a, so the difference isn't lost in the noise.
+func TestFastRange(t *testing.T) {
+	var nums []string
+	for i := 0; i < len(web2); i++ {
+		nums = append(nums, strconv.Itoa(i))
+	}
+
+	absent := append([]string(nil), web2a...)
+	for i := 0; i < 400000; i++ {
+		absent = append(absent, fmt.Sprintf("absent-key-%d", i))
+	}
+
+	sets := []struct {
+		name        string
+		keys, tests []string
+	}{
+		{"words", web2, absent},
+		{"numbers", nums[:len(nums)/2], nums[len(nums)/2:]},
+	}
+
+	for _, set := range sets {
+		for _, hasher := range []string{bloom.DefaultHasher, "murmur3-128", "md5"} {
+			var fps [2]int
+			for i, digest := range []uint16{bloom.DigestFlags &^ bloom.FlagFastRange, bloom.DigestFlags} {
+				for _, e := range []float64{0.001, 0.0001} {
+					bf := NewWithEstimates(uint(len(set.keys)), e).(*StandardBloom)
+					bf.SetNamedHasher(hasher)
+					bf.digest = digest
+
+					for _, w := range set.keys {
+						bf.AddString(w)
+					}
+
+					for _, w := range set.tests {
+						if bf.CheckString(w) {
+							fps[i]++
+						}
+					}
+				}
+			}
+
+			fmt.Printf("%s, %s: %d false positives with multiply-shift, %d with modulo\n", hasher, set.name, fps[1], fps[0])
+
+			if float64(fps[1]) > 1.2*float64(fps[0])+10 {
+				t.Errorf("%s, %s: %d false positives with multiply-shift, more than %d with modulo", hasher, set.name, fps[1], fps[0])
+			}
+		}
+	}
+
+	// The flag is recorded, and filters read without it keep their positions
+	for _, digest := range []uint16{0, bloom.FlagFastRange} {
+		bf := New(1000).(*StandardBloom)
+		bf.digest = digest
+		bf.AddString("hello")
+
+		var buf bytes.Buffer
+		if _, err := bf.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		bf2 := &StandardBloom{}
+		if _, err := bf2.ReadFrom(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if bf2.digest != digest || !bf2.CheckString("hello") {
+			t.Errorf("Read digest flags %#x, expected %#x", bf2.digest, digest)
+		}
+	}
+}
+
+func BenchmarkFastRange(b *testing.B) {
+	for _, mode := range []struct {
+		name   string
+		digest uint16
+	}{
+		{"modulo", bloom.DigestFlags &^ bloom.FlagFastRange},
+		{"fastrange", bloom.DigestFlags},
+	} {
+		bf := New(uint(len(web2))).(*StandardBloom)
+		bf.digest = mode.digest
+
+		b.Run(mode.name+"/Add", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Add([]byte(web2[i%len(web2)]))
+			}
+		})
+
+		b.Run(mode.name+"/Check", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Check([]byte(web2a[i%len(web2a)]))
+			}
+		})
+	}
+}
+
+// TestHashCount checks that a pinned k keeps the error probability with more bits, and that
+// it is reported and kept when the filter is read back.
+func TestHashCount(t *testing.T) {
+	bf := New(1000).(*StandardBloom)
+	for _, k := range []uint{0, bloom.MaxHashCount + 1} {
+		if err := bf.SetHashCount(k); err != bloom.ErrInvalidHashCount {
+			t.Errorf("k = %d: expected ErrInvalidHashCount, got %v", k, err)
+		}
+	}
+
+	if bf.Params().PinnedK {
+		t.Errorf("Expected k to be derived")
+	}
+
+	n, e := uint(len(web2)), 0.01
+	bf = NewWithOptions(n, e, WithHashCount(4)).(*StandardBloom)
+	def := NewWithEstimates(n, e).(*StandardBloom)
+
+	params := bf.Params()
+	if params.K != 4 || !params.PinnedK || params.P != bloom.P(4, e) || params.E != e {
+		t.Fatalf("Unexpected parameters %+v", params)
+	}
+
+	if params.M != bloom.M(n, bloom.P(4, e), e) || params.M <= def.Params().M {
+		t.Errorf("Expected more bits than %d with fewer hash values, got %d", def.Params().M, params.M)
+	}
+
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	fp := 0
+	for _, w := range web2a {
+		if bf.CheckString(w) {
+			fp++
+		}
+	}
+
+	if rate := float64(fp) / float64(len(web2a)); rate > 1.5*e {
+		t.Errorf("Expected a false positive rate of about %f, got %f", e, rate)
+	}
+
+	if err := bf.SetHashCount(8); err != bloom.ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	bf.WriteStats(&buf)
+	if !strings.Contains(buf.String(), "k is pinned") {
+		t.Errorf("Expected k to be reported as pinned in %q", buf.String())
+	}
+
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bf2 := &StandardBloom{}
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.Params() != params {
+		t.Errorf("Expected %+v after reading the filter, got %+v", params, bf2.Params())
+	}
+
+	bf2.Reset()
+	if bf2.Params() != params {
+		t.Errorf("Expected %+v after Reset, got %+v", params, bf2.Params())
+	}
+
+	// With k pinned, the fill ratio sets the error probability
+	bf2.Clear()
+	if err := bf2.SetFillRatio(0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := bf2.Params(); p.K != 4 || p.E != 0.0625 || p.P != 0.5 {
+		t.Errorf("Expected e = 0.0625 for p = 0.5 and k = 4, got %+v", p)
+	}
+
+	// A k pinned to the one derived from e is recorded in the header, and read back pinned
+	bf = NewWithOptions(n, e, WithHashCount(bloom.K(e))).(*StandardBloom)
+	if data, err = bf.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bf2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bf2.Params().PinnedK {
+		t.Errorf("Expected k = %d to be read back pinned", bloom.K(e))
+	}
+}
+
+// TestHashCountWrappers checks that the filters wrapping a StandardBloom keep a pinned k
+// when they rebuild or copy it.
+func TestHashCountWrappers(t *testing.T) {
+	bf := NewWithOptions(1000, 0.01, WithHashCount(3)).(*StandardBloom)
+	params := bf.Params()
+
+	cb := NewConcurrent(bf)
+	cb.Reset()
+	if p := cb.Params(); p != params {
+		t.Errorf("Expected %+v after Reset of the concurrent filter, got %+v", params, p)
+	}
+
+	v, err := NewVersioned(bf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p := v.Snapshot().Params(); p != params {
+		t.Errorf("Expected %+v for the snapshot, got %+v", params, p)
+	}
+
+	c, err := v.Snapshot().Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Reset()
+	if p := c.Params(); p != params {
+		t.Errorf("Expected %+v after Reset of the snapshot's filter, got %+v", params, p)
+	}
+}
+
+// TestPowerOfTwoSize checks that WithPowerOfTwoSize rounds m up, reports it, and keeps
+// the false positive rate at most the one the theory gives for the rounded m.
+func TestPowerOfTwoSize(t *testing.T) {
+	absent := append([]string(nil), web2a...)
+	for i := 0; i < 400000; i++ {
+		absent = append(absent, fmt.Sprintf("absent-key-%d", i))
+	}
+
+	for _, e := range []float64{0.1, 0.02} {
+		for _, digest := range []uint16{bloom.DigestFlags &^ bloom.FlagFastRange, bloom.DigestFlags} {
+			bf := NewWithOptions(uint(len(web2)), e, WithPowerOfTwoSize()).(*StandardBloom)
+			bf.digest = digest
+
+			m := bloom.M(uint(len(web2)), 0.5, e)
+			if bf.m != bloom.PowerOfTwo(m) || bf.m&(bf.m-1) != 0 || bf.m < m {
+				t.Fatalf("m = %d, expected %d rounded up to a power of two", bf.m, m)
+			}
+
+			for _, w := range web2 {
+				bf.AddString(w)
+			}
+
+			fp := 0
+			for _, w := range absent {
+				if bf.CheckString(w) {
+					fp++
+				}
+			}
+
+			rate := float64(fp) / float64(len(absent))
+			expected := math.Pow(1-math.Exp(-float64(bf.k)*float64(len(web2))/float64(bf.m)), float64(bf.k))
+			stats := bf.Stats()
+			fmt.Printf("e = %g, m = %d rounded to %d, flags %#x: false positive rate %.5f, expected %.5f, estimated %.5f\n", e, m, bf.m, digest, rate, expected, stats.FalsePositiveRate)
+
+			if stats.Params.M != bf.m || bf.Params().M != bf.m {
+				t.Errorf("Stats reports m = %d, expected %d", stats.Params.M, bf.m)
+			}
+
+			if rate > 1.1*expected {
+				t.Errorf("e = %g: false positive rate %.5f, expected at most %.5f", e, rate, expected)
+			}
+		}
+	}
+
+	// The rounded m is read back, and kept by Reset
+	bf := NewWithOptions(1000, 0.001, WithPowerOfTwoSize()).(*StandardBloom)
+	bf.AddString("hello")
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2 := &StandardBloom{}
+	if _, err := bf2.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf2.m != bf.m || !bf2.CheckString("hello") {
+		t.Errorf("Read m = %d, expected %d", bf2.m, bf.m)
+	}
+
+	bf2.Reset()
+	if bf2.m != bf.m {
+		t.Errorf("m = %d after Reset, expected %d", bf2.m, bf.m)
+	}
+
+	// The option is recorded in the header, so a filter whose m happens to be a power of
+	// two without it is not rounded up by Reset
+	data, err := bf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &bloom.Header{}
+	hl, err := h.ReadFrom(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Flags&bloom.FlagPowerOfTwo == 0 {
+		t.Errorf("Expected FlagPowerOfTwo in flags %#x", h.Flags)
+	}
+
+	h.Flags &^= bloom.FlagPowerOfTwo
+	buf.Reset()
+	h.WriteTo(&buf)
+	buf.Write(data[hl:])
+
+	bf3 := &StandardBloom{}
+	if _, err := bf3.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if bf3.pow2 {
+		t.Errorf("Expected m = %d without FlagPowerOfTwo not to be rounded", bf3.m)
+	}
+
+	// m must be a power of two with the flag
+	h.Flags |= bloom.FlagPowerOfTwo
+	h.M--
+	buf.Reset()
+	h.WriteTo(&buf)
+	buf.Write(data[hl:])
+
+	if _, err := bf3.ReadFrom(&buf); err == nil {
+		t.Errorf("Expected an error reading m = %d with FlagPowerOfTwo", h.M)
+	}
+}
+
+func BenchmarkPowerOfTwoSize(b *testing.B) {
+	for _, mode := range []struct {
+		name   string
+		digest uint16
+		opts   []Option
+	}{
+		{"modulo", bloom.DigestFlags &^ bloom.FlagFastRange, nil},
+		{"mask", bloom.DigestFlags &^ bloom.FlagFastRange, []Option{WithPowerOfTwoSize()}},
+		{"fastrange", bloom.DigestFlags, nil},
+		{"shift", bloom.DigestFlags, []Option{WithPowerOfTwoSize()}},
+	} {
+		bf := NewWithOptions(uint(len(web2)), 0.001, mode.opts...).(*StandardBloom)
+		bf.digest = mode.digest
+
+		b.Run(mode.name+"/Add", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Add([]byte(web2[i%len(web2)]))
+			}
+		})
+
+		b.Run(mode.name+"/Check", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bf.Check([]byte(web2a[i%len(web2a)]))
+			}
+		})
+	}
+}
+
+// TestNewFast checks that NewFast uses bloom.FastHasher, keeps the requested false positive
+// rate, and that its filters are loaded with the same hasher.
+func TestNewFast(t *testing.T) {
+	bf := NewFast(uint(len(web2))).(*StandardBloom)
+	if bf.HasherName() != bloom.FastHasher {
+		t.Fatalf("HasherName = %q, expected %q", bf.HasherName(), bloom.FastHasher)
+	}
+
+	for _, w := range web2 {
+		bf.AddString(w)
+	}
+
+	fp := 0
+	for _, w := range web2a {
+		if bf.CheckString(w) {
+			fp++
+		}
+	}
+
+	rate := float64(fp) / float64(len(web2a))
+	fmt.Printf("%s: false positive rate %.5f, expected 0.001\n", bloom.FastHasher, rate)
+	if rate > 0.0015 {
+		t.Errorf("False positive rate %.5f, expected about 0.001", rate)
+	}
+
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	bf2, err := bloom.Load(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := bf2.(*StandardBloom).HasherName(); name != bloom.FastHasher {
+		t.Errorf("Loaded HasherName = %q, expected %q", name, bloom.FastHasher)
+	}
+
+	for _, w := range web2 {
+		if !bf2.Check([]byte(w)) {
+			t.Fatalf("%q not found after Load", w)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standard
+
+import (
+	"encoding/binary"
+	"hash"
+	"sync"
+	"sync/atomic"
+
+	"github.com/willf/bitset"
+	"github.com/zhenjl/bloom"
+)
+
+// pageWords is the number of 64-bit words in a page of a Versioned filter, 4 KiB.
+const pageWords = 512
+
+// Versioned is a StandardBloom for one writer and any number of readers, where the readers
+// see the state published by the last Commit while the writer keeps adding items. The bit
+// array is split into pages shared by the published Snapshot and the writer. The first Add
+// to a page after a Commit copies it, so a Commit only costs copying the pages written since
+// the previous one, and readers are never blocked, not even during Commit.
+type Versioned struct {
+	// mu serializes Add, Check and Commit, which use the hasher and buffers below.
+	mu sync.Mutex
+
+	// cur is the last Snapshot published by Commit.
+	cur atomic.Pointer[Snapshot]
+
+	// pages holds the bit array of the writer. owned[i] is set if pages[i] was copied since
+	// the last Commit, and may be written to.
+	pages [][]uint64
+	owned []bool
+
+	m, k, n uint
+	c       uint64
+	p, e    float64
+
+	// pinned is set if k was pinned in the filter, see StandardBloom.
+	pinned bool
+
+	// h, hn and loc are the hash function, see StandardBloom. bs and sum are the buffers
+	// used by Add.
+	h   hash.Hash
+	hn  string
+	loc bloom.Locator
+	bs  []uint
+	sum [64]byte
+
+	// hp holds the hashers used by the Check methods of the snapshots. They are cloned from
+	// rh, a hasher of the same kind as h that is never written to, as h is used by Add.
+	hp *bloom.HasherPool
+	rh hash.Hash
+
+	// digest holds the bloom.DigestFlags of the positions, see StandardBloom.
+	digest uint16
+}
+
+// Snapshot is a read-only view of a Versioned filter as of a Commit. It never changes, and
+// Check is safe to call concurrently.
+type Snapshot struct {
+	pages   [][]uint64
+	m, k, n uint
+	c       uint64
+	p, e    float64
+	pinned  bool
+	hn      string
+	h       hash.Hash
+	hp      *bloom.HasherPool
+	digest  uint16
+}
+
+// NewVersioned returns a Versioned filter holding the items of bf, which is not changed.
+// The hasher of bf is cloned, see bloom.CloneHasher. The initial state is published, so
+// Snapshot returns it until the first Commit.
+func NewVersioned(bf *StandardBloom) (*Versioned, error) {
+	h, err := bloom.CloneHasher(bf.hn, bf.h)
+	if err != nil {
+		return nil, err
+	}
+
+	rh, err := bloom.CloneHasher(bf.hn, bf.h)
+	if err != nil {
+		return nil, err
+	}
+
+	words := bf.b.Bytes()
+	pages := make([][]uint64, (len(words)+pageWords-1)/pageWords)
+	for i := range pages {
+		pages[i] = append([]uint64(nil), words[i*pageWords:min((i+1)*pageWords, len(words))]...)
+	}
+
+	this := &Versioned{
+		pages:  pages,
+		owned:  make([]bool, len(pages)),
+		m:      bf.m,
+		k:      bf.k,
+		n:      bf.n,
+		c:      bf.c,
+		p:      bf.p,
+		e:      bf.e,
+		pinned: bf.pinned,
+		h:      h,
+		hn:     bf.hn,
+		bs:     make([]uint, bf.k),
+		hp:     bloom.NewHasherPool(bf.hn, rh),
+		rh:     rh,
+		digest: bf.digest,
+	}
+	this.loc, _ = h.(bloom.Locator)
+	this.commit()
+
+	return this, nil
+}
+
+// Add adds item to the filter. It isn't visible to the snapshots until Commit.
+func (this *Versioned) Add(item []byte) *Versioned {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	bits(this.h, this.loc, item, this.bs, this.m, this.sum[:0], this.digest)
+	for _, v := range this.bs {
+		p, w := v/64/pageWords, v/64%pageWords
+		if !this.owned[p] {
+			this.pages[p] = append([]uint64(nil), this.pages[p]...)
+			this.owned[p] = true
+		}
+		this.pages[p][w] |= 1 << (v % 64)
+	}
+	this.c++
+
+	return this
+}
+
+// AddString is the same as Add([]byte(s)), without copying s.
+func (this *Versioned) AddString(s string) *Versioned {
+	return this.Add(unsafeBytes(s))
+}
+
+// Check returns true if item may have been added to the filter, including the items added
+// since the last Commit. Readers should use the Check method of Snapshot instead, which
+// doesn't wait for Add.
+func (this *Versioned) Check(item []byte) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	bits(this.h, this.loc, item, this.bs, this.m, this.sum[:0], this.digest)
+	return test(this.pages, this.bs)
+}
+
+// Count returns the number of items added, including those added since the last Commit.
+func (this *Versioned) Count() uint64 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.c
+}
+
+// Commit publishes the items added so far, so Snapshot returns them from now on, and returns
+// the new snapshot. The snapshots returned before are unchanged.
+func (this *Versioned) Commit() *Snapshot {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.commit()
+}
+
+func (this *Versioned) commit() *Snapshot {
+	s := &Snapshot{
+		pages:  append([][]uint64(nil), this.pages...),
+		m:      this.m,
+		k:      this.k,
+		n:      this.n,
+		c:      this.c,
+		p:      this.p,
+		e:      this.e,
+		pinned: this.pinned,
+		hn:     this.hn,
+		h:      this.rh,
+		hp:     this.hp,
+		digest: this.digest,
+	}
+
+	// The pages are now shared with s, and must be copied before being written to again.
+	for i := range this.owned {
+		this.owned[i] = false
+	}
+
+	this.cur.Store(s)
+	return s
+}
+
+// Snapshot returns the state published by the last Commit. It doesn't block, and is safe to
+// call concurrently with Add and Commit.
+func (this *Versioned) Snapshot() *Snapshot {
+	return this.cur.Load()
+}
+
+// Check returns true if item may have been added to the filter before the snapshot was taken.
+func (this *Snapshot) Check(item []byte) bool {
+	s := this.hp.Get()
+	bs := s.Positions(this.k)
+	bits(s.H, s.Loc, item, bs, this.m, s.Sum[:0], this.digest)
+	ok := test(this.pages, bs)
+	this.hp.Put(s)
+	return ok
+}
+
+// CheckString is the same as Check([]byte(s)), without copying s.
+func (this *Snapshot) CheckString(s string) bool {
+	return this.Check(unsafeBytes(s))
+}
+
+// CheckUint64 is the same as Check of the 8 byte big endian encoding of v, without
+// allocating.
+func (this *Snapshot) CheckUint64(v uint64) bool {
+	s := this.hp.Get()
+	binary.BigEndian.PutUint64(s.U64[:], v)
+	bs := s.Positions(this.k)
+	bits(s.H, s.Loc, s.U64[:], bs, this.m, s.Sum[:0], this.digest)
+	ok := test(this.pages, bs)
+	this.hp.Put(s)
+	return ok
+}
+
+// Count returns the number of items added before the snapshot was taken.
+func (this *Snapshot) Count() uint64 {
+	return this.c
+}
+
+// Params returns the parameters of the filter.
+func (this *Snapshot) Params() bloom.Params {
+	return bloom.Params{M: this.m, K: this.k, N: this.n, P: this.p, E: this.e, PinnedK: this.pinned}
+}
+
+// Filter returns a StandardBloom holding a copy of the snapshot, e.g. to serialize it. Its
+// hasher is a clone of the hasher of the snapshot.
+func (this *Snapshot) Filter() (*StandardBloom, error) {
+	h, err := bloom.CloneHasher(this.hn, this.h)
+	if err != nil {
+		return nil, err
+	}
+
+	b := bitset.New(this.m)
+	words := b.Bytes()[:0]
+	for _, p := range this.pages {
+		words = append(words, p...)
+	}
+
+	bf := &StandardBloom{
+		n:      this.n,
+		p:      this.p,
+		e:      this.e,
+		k:      this.k,
+		m:      this.m,
+		c:      this.c,
+		b:      b,
+		bs:     make([]uint, this.k),
+		digest: this.digest,
+		pow2:   this.m&(this.m-1) == 0,
+		pinned: this.pinned,
+	}
+	bf.setHasher(h, this.hn)
+
+	return bf, nil
+}
+
+// test reports whether all the bits at positions bs are set in pages.
+func test(pages [][]uint64, bs []uint) bool {
+	for _, v := range bs {
+		if pages[v/64/pageWords][v/64%pageWords]&(1<<(v%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package standard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+
+	"github.com/spaolacci/murmur3"
+	"github.com/willf/bitset"
+	"github.com/zhenjl/bloom"
+)
+
+// WillfHasher is the hasher name recorded for filters imported by FromWillf. The hasher
+// is a murmur3 128-bit hash implementing bloom.Locator, which derives bit positions the way
+// github.com/willf/bloom does, so such filters keep answering Check like the original filter
+// after being saved and loaded again.
+const WillfHasher = "willf-murmur3"
+
+// willfExtra is appended to the key to get the second pair of murmur3 hash values.
+var willfExtra = []byte{1}
+
+func init() {
+	bloom.RegisterHasher(WillfHasher, func() hash.Hash { return &willfHasher{murmur3.New128()} })
+}
+
+// willfHasher is a murmur3 128-bit hash that locates bit positions like willf/bloom.
+type willfHasher struct {
+	murmur3.Hash128
+}
+
+var _ bloom.Locator = (*willfHasher)(nil)
+
+// Locate fills bs with the bit positions for item in a filter of m bits, the way
+// github.com/willf/bloom does.
+func (this *willfHasher) Locate(item []byte, bs []uint, m uint) {
+	this.Reset()
+	this.Write(item)
+	v1, v2 := this.Sum128()
+	this.Write(willfExtra)
+	v3, v4 := this.Sum128()
+
+	v := [4]uint64{v1, v2, v3, v4}
+	for i := range bs {
+		ii := uint64(i)
+		bs[i] = uint((v[ii%2] + ii*v[2+(((ii+(ii%2))%4)/2)]) % uint64(m))
+	}
+}
+
+// FromWillf reads a filter written by the WriteTo method of github.com/willf/bloom, i.e.
+// m and k as big endian uint64 values followed by a github.com/willf/bitset written by its
+// WriteTo method: the length in bits and the words, also in big endian order.
+//
+// The returned filter uses the murmur3 128-bit hash and the index derivation of willf/bloom,
+// so Check answers exactly as willf/bloom's Test did for the same keys, and keys added
+// afterwards are set the same way willf/bloom would. The hasher is recorded as WillfHasher
+// when the filter is serialized. Calling SetHasher or SetNamedHasher with another hasher
+// breaks the filter.
+//
+// willf/bloom does not record n, p or e. They are derived from m and k assuming the filter
+// was sized with willf/bloom's EstimateParameters, and the count of items is unknown and
+// set to 0.
+func FromWillf(r io.Reader) (*StandardBloom, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("standard: reading willf header: %v", err)
+	}
+
+	m := binary.BigEndian.Uint64(hdr[0:8])
+	k := binary.BigEndian.Uint64(hdr[8:16])
+	l := binary.BigEndian.Uint64(hdr[16:24])
+
+	if m == 0 || m > math.MaxUint || k == 0 || k > bloom.MaxHashCount || k > m {
+		return nil, fmt.Errorf("standard: invalid willf parameters m = %d, k = %d", m, k)
+	}
+
+	if l != m {
+		return nil, fmt.Errorf("standard: willf bit array has %d bits, expected m = %d", l, m)
+	}
+
+	if err := bloom.CheckBits(r, uint(m), false); err != nil {
+		return nil, err
+	}
+
+	b := bitset.New(uint(m))
+	if _, err := bloom.ReadBits(r, b.Bytes(), uint(m), false); err != nil {
+		return nil, err
+	}
+
+	bf := &StandardBloom{
+		n:  uint(math.Ceil(math.Ln2 * float64(m) / float64(k))),
+		p:  0.5,
+		e:  math.Pow(0.5, float64(k)),
+		k:  uint(k),
+		m:  uint(m),
+		b:  b,
+		bs: make([]uint, k),
+	}
+
+	if err := bf.SetNamedHasher(WillfHasher); err != nil {
+		return nil, err
+	}
+
+	return bf, nil
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Stats holds the statistics of a filter, as returned by its Stats method.
+type Stats struct {
+	Params Params
+
+	// Count is the number of items added to the filter.
+	Count uint64
+
+	// BitsSet is the number of bits set, and FillRatio the fraction of the M bits set.
+	// EstimatedFillRatio is the fill ratio estimated from Count.
+	BitsSet            uint
+	FillRatio          float64
+	EstimatedFillRatio float64
+
+	// FalsePositiveRate is the false positive probability computed from the bits set, as
+	// returned by the CurrentFalsePositiveRate methods of the filters.
+	FalsePositiveRate float64
+
+	// Checks is the number of items checked, of which Hits were found and Misses weren't,
+	// for filters that count them, such as standard.ConcurrentBloom. They are 0 otherwise.
+	Checks, Hits, Misses uint64
+
+	// Saturated is the number of counters of a counting filter that reached their maximum
+	// value, and are no longer incremented nor decremented. It is 0 for other filters.
+	Saturated uint
+
+	// Spilled is the number of items of a d-left filter stored outside of its table, as all
+	// their buckets were full. It is 0 for other filters.
+	Spilled uint
+
+	// FingerprintBytes is the memory held by the fingerprint table of a filter built by
+	// standard.NewWithFingerprints, in addition to its bit array, and FingerprintCollisions
+	// the number of slots of the table holding items with different fingerprints. Both are
+	// 0 for other filters. FalsePositiveRate then accounts for the fingerprints.
+	FingerprintBytes      uint64
+	FingerprintCollisions uint
+
+	// Partitions holds the statistics of each partition of a partitioned filter.
+	Partitions []PartitionStats
+
+	// Layers holds the statistics of each layer of a scalable filter, oldest first, and
+	// TighteningRatio the ratio r of the error probability of each new layer to that of the
+	// previous one. Layers[i].Params.E is the error probability of layer i.
+	Layers          []Stats
+	TighteningRatio float64
+
+	// GrowthPolicy is the name of the policy by which a scalable filter adds layers, see
+	// scalable.GrowthPolicy. It is empty for other filters.
+	GrowthPolicy string
+
+	// CapacityExhausted is set for a scalable filter whose newest layer is full while it has
+	// the maximum number of layers it was allowed, so items are added to a full layer, or
+	// rejected. It is false for other filters.
+	CapacityExhausted bool
+
+	// MemoryBudget is the bound of the memory of a scalable filter, 0 if there is none, and
+	// BudgetExhausted is set once a new layer would have exceeded it, so the filter stopped
+	// growing. CapacityExhausted is then set as well. Both are 0 for other filters.
+	MemoryBudget    uint64
+	BudgetExhausted bool
+
+	// EvictedLayers is the number of layers a scalable filter evicted to make room for new
+	// ones, see scalable.EvictOldest, and ForgottenItems an estimate of the number of
+	// distinct items they held. Both are 0 for other filters.
+	EvictedLayers  int
+	ForgottenItems uint64
+
+	// NextLayerAdds is the number of items a scalable filter takes before adding its next
+	// layer, NextLayerIn the time that takes at the rate items are added, 0 if unknown, and
+	// NextLayerBytes the size of the bits of that layer. See scalable.ScalableBloom.Forecast.
+	// They are 0 for other filters, and scalable filters that can't grow.
+	NextLayerAdds  uint64
+	NextLayerIn    time.Duration
+	NextLayerBytes uint64
+
+	// CompoundErrorRate is the expected false positive probability of a scalable filter from
+	// the fill ratios of its layers, and DesignErrorBound the bound e / (1 - r) it was
+	// designed for, see scalable.ScalableBloom.CompoundErrorRate. Both are 0 for other
+	// filters.
+	CompoundErrorRate float64
+	DesignErrorBound  float64
+
+	// Cold is set for a layer of a scalable filter written to a BlobStore, see
+	// scalable.ScalableBloom.SetSpill, and Resident if it is loaded in memory as well, after
+	// a Check needed it. Both are false for other filters and layers.
+	Cold, Resident bool
+
+	// Shards holds the statistics of each shard of a sharded filter.
+	Shards []Stats
+
+	// Generations holds the statistics of each live generation of a rotating filter, or of
+	// the standby and active filters of an aging filter, oldest first.
+	Generations []Stats
+}
+
+// PartitionStats holds the statistics of one partition of a partitioned filter: its index,
+// its number of bits s, the number of those set, and the fraction of them set.
+type PartitionStats struct {
+	Index     int
+	Size      uint
+	BitsSet   uint
+	FillRatio float64
+}
+
+// WriteTo implements io.WriterTo. It writes the statistics in the human readable form
+// printed by the PrintStats methods of the filters.
+func (this *Stats) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	this.format(&buf)
+	return buf.WriteTo(w)
+}
+
+func (this *Stats) format(buf *bytes.Buffer) {
+	p := this.Params
+
+	if this.Shards != nil {
+		fmt.Fprintf(buf, "n = %d, shards = %d, p = %f, e = %f\n", p.N, len(this.Shards), p.P, p.E)
+		fmt.Fprintln(buf, "Total items:", this.Count)
+
+		for i := range this.Shards {
+			fmt.Fprintf(buf, "Shard #%d\n", i)
+			fmt.Fprintf(buf, "--------\n")
+			this.Shards[i].format(buf)
+		}
+		return
+	}
+
+	if this.Generations != nil {
+		fmt.Fprintf(buf, "n = %d, generations = %d, p = %f, e = %f\n", p.N, len(this.Generations), p.P, p.E)
+		fmt.Fprintln(buf, "Total items:", this.Count)
+
+		for i := range this.Generations {
+			fmt.Fprintf(buf, "Generation #%d\n", i)
+			fmt.Fprintf(buf, "-------------\n")
+			this.Generations[i].format(buf)
+		}
+		return
+	}
+
+	if this.Layers != nil {
+		fmt.Fprintf(buf, "n = %d, p = %f, e = %f, r = %f, growth = %s\n", p.N, p.P, p.E, this.TighteningRatio, this.GrowthPolicy)
+		fmt.Fprintln(buf, "Total items:", this.Count)
+
+		if this.BudgetExhausted {
+			fmt.Fprintf(buf, "Memory budget of %d bytes exhausted at %d layers\n", this.MemoryBudget, len(this.Layers))
+		} else if this.CapacityExhausted {
+			fmt.Fprintf(buf, "Capacity exhausted at %d layers\n", len(this.Layers))
+		}
+
+		if this.NextLayerBytes > 0 {
+			fmt.Fprintf(buf, "Next layer: %d bytes after %d items", this.NextLayerBytes, this.NextLayerAdds)
+			if this.NextLayerIn > 0 {
+				fmt.Fprintf(buf, ", in about %s", this.NextLayerIn.Round(time.Second))
+			}
+			fmt.Fprintln(buf)
+		}
+
+		if this.EvictedLayers > 0 {
+			fmt.Fprintf(buf, "Evicted layers: %d, about %d items forgotten\n", this.EvictedLayers, this.ForgottenItems)
+		}
+
+		fmt.Fprintf(buf, "Compound error rate: %g, design bound: %g\n", this.CompoundErrorRate, this.DesignErrorBound)
+
+		// The error probabilities of the layers shrink geometrically, below the precision of
+		// the parameter line
+		for i := range this.Layers {
+			fmt.Fprintf(buf, "Scalable Bloom Filter #%d, e = %g%s\n", i, this.Layers[i].Params.E, this.Layers[i].residency())
+			fmt.Fprintf(buf, "-------------------------\n")
+			this.Layers[i].format(buf)
+		}
+		return
+	}
+
+	fmt.Fprintf(buf, "m = %d, n = %d, k = %d, s = %d, p = %f, e = %f\n", p.M, p.N, p.K, p.S, p.P, p.E)
+	if p.PinnedK {
+		fmt.Fprintln(buf, "k is pinned, p is derived from k and e")
+	}
+	fmt.Fprintln(buf, "Total items:", this.Count)
+
+	if this.Partitions != nil {
+		for i, v := range this.Partitions {
+			fmt.Fprintf(buf, "Bits in partition %d: %d (%.1f%%)\n", i, v.BitsSet, v.FillRatio*100)
+		}
+		return
+	}
+
+	fmt.Fprintf(buf, "Total bits set: %d (%.1f%%)\n", this.BitsSet, this.FillRatio*100)
+
+	if this.Saturated > 0 {
+		fmt.Fprintf(buf, "Saturated counters: %d\n", this.Saturated)
+	}
+
+	if this.Spilled > 0 {
+		fmt.Fprintf(buf, "Spilled items: %d\n", this.Spilled)
+	}
+
+	if this.FingerprintBytes > 0 {
+		fmt.Fprintf(buf, "Fingerprint table: %d bytes, %d collisions\n", this.FingerprintBytes, this.FingerprintCollisions)
+	}
+
+	if this.Checks > 0 {
+		fmt.Fprintf(buf, "Checks: %d, hits: %d (%.1f%%), misses: %d\n", this.Checks, this.Hits, float64(this.Hits)/float64(this.Checks)*100, this.Misses)
+	}
+}
+
+// residency returns how a layer of a scalable filter is held, if it was spilled.
+func (this *Stats) residency() string {
+	switch {
+	case this.Resident:
+		return " (cold, resident)"
+	case this.Cold:
+		return " (spilled)"
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"context"
+	"hash"
+	"hash/fnv"
+)
+
+// BitStore holds the bit array of a filter outside of the process, such as in a database
+// shared by several processes, see Stored. Each call takes the k positions of one item, so
+// a store on the network can set or test them in a single round trip.
+type BitStore interface {
+	// Set sets the bits at the positions bs.
+	Set(ctx context.Context, bs []uint) error
+
+	// Test returns true if the bits at the positions bs are all set.
+	Test(ctx context.Context, bs []uint) (bool, error)
+}
+
+// Stored is a standard bloom filter whose bits are held by a BitStore. It holds no bits
+// of its own and doesn't count the items added, as the other processes sharing the store
+// add to it too, so unlike the other filters it doesn't implement Bloom. Its methods
+// return the errors of the store rather than a result it can't vouch for. Filters sharing
+// a store must be created with the same n, e and hasher, so they derive the same
+// positions. It is safe for concurrent use if the store is.
+type Stored struct {
+	store BitStore
+
+	// n, m, k and e are the parameters of a standard filter, with a fill ratio of 0.5
+	n, m, k uint
+	e       float64
+
+	hn string
+	hp *HasherPool
+}
+
+// NewStored returns a filter for n items with a false positive probability of e, whose m
+// bits are held by store, hashing the items with DefaultHasher. k and m are derived from
+// e with K and M. It returns the error of Validate for invalid n and e.
+func NewStored(store BitStore, n uint, e float64) (*Stored, error) {
+	if err := Validate(n, 0.5, e); err != nil {
+		return nil, err
+	}
+
+	this := &Stored{store: store, n: n, m: M(n, 0.5, e), k: K(e), e: e}
+	this.setHasher(fnv.New64(), DefaultHasher)
+	return this, nil
+}
+
+// SetNamedHasher sets the hash function to a new instance of the hasher registered with
+// RegisterHasher as name. The items already in the store would no longer be found, and
+// the filter can't tell, so it must be set before any item is added.
+func (this *Stored) SetNamedHasher(name string) error {
+	h, err := NewHasher(name)
+	if err != nil {
+		return err
+	}
+
+	this.setHasher(h, name)
+	return nil
+}
+
+func (this *Stored) setHasher(h hash.Hash, name string) {
+	this.hn = name
+	this.hp = NewHasherPool(name, h)
+}
+
+// Add sets the bits of key in the store.
+func (this *Stored) Add(ctx context.Context, key []byte) error {
+	return this.store.Set(ctx, this.Positions(key, make([]uint, 0, this.k)))
+}
+
+// Check returns true if key may have been added to the store. If the store fails, it
+// returns false and the error, as the bits couldn't be tested.
+func (this *Stored) Check(ctx context.Context, key []byte) (bool, error) {
+	return this.store.Test(ctx, this.Positions(key, make([]uint, 0, this.k)))
+}
+
+// Positions appends the k bit positions of key to bs, the positions Add sets and Check
+// tests, in [0, m).
+func (this *Stored) Positions(key []byte, bs []uint) []uint {
+	s := this.hp.Get()
+	defer this.hp.Put(s)
+
+	p := s.Positions(this.k)
+	if s.Loc != nil {
+		s.Loc.Locate(key, p, this.m)
+	} else {
+		s.H.Reset()
+		s.H.Write(key)
+		DigestPositions(s.H, s.Sum[:0], p, this.m, DigestFlags)
+	}
+
+	return append(bs, p...)
+}
+
+// Store returns the store holding the bits of the filter.
+func (this *Stored) Store() BitStore {
+	return this.store
+}
+
+// HasherName returns the name of the hash function.
+func (this *Stored) HasherName() string {
+	return this.hn
+}
+
+// Params returns the parameters of the filter.
+func (this *Stored) Params() Params {
+	return Params{M: this.m, K: this.k, N: this.n, P: 0.5, E: this.e}
+}
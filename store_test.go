@@ -0,0 +1,131 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/zhenjl/bloom"
+	"github.com/zhenjl/bloom/standard"
+)
+
+// memStore is a BitStore holding its bits in memory, failing with err if set.
+type memStore struct {
+	mu   sync.Mutex
+	bits map[uint]bool
+	err  error
+}
+
+func (this *memStore) Set(ctx context.Context, bs []uint) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.err != nil {
+		return this.err
+	}
+	for _, v := range bs {
+		this.bits[v] = true
+	}
+	return nil
+}
+
+func (this *memStore) Test(ctx context.Context, bs []uint) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.err != nil {
+		return false, this.err
+	}
+	for _, v := range bs {
+		if !this.bits[v] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func TestStored(t *testing.T) {
+	const n = 10000
+	ctx := context.Background()
+
+	if _, err := bloom.NewStored(&memStore{}, 0, 0.01); err != bloom.ErrInvalidCapacity {
+		t.Errorf("Expected ErrInvalidCapacity, got %v", err)
+	}
+
+	store := &memStore{bits: make(map[uint]bool)}
+	bf, err := bloom.NewStored(store, n, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The positions are those of a standard filter with the same parameters
+	ref := standard.NewWithEstimates(n, 0.01).(*standard.StandardBloom)
+	if p := bf.Params(); p != ref.Params() {
+		t.Errorf("Expected the parameters %+v, got %+v", ref.Params(), p)
+	}
+
+	key := make([]byte, 8)
+	for i := uint64(0); i < n; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		if !slices.Equal(bf.Positions(key, nil), ref.Positions(key, nil)) {
+			t.Fatalf("Expected the positions of %d to match the standard filter", i)
+		}
+
+		if err := bf.Add(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fp := 0
+	for i := uint64(0); i < 2*n; i++ {
+		binary.BigEndian.PutUint64(key, i)
+		ok, err := bf.Check(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i < n && !ok {
+			t.Fatalf("Expected to find %d", i)
+		}
+		if i >= n && ok {
+			fp++
+		}
+	}
+
+	if rate := float64(fp) / n; rate > 0.015 {
+		t.Errorf("Expected a false positive rate of about 0.01, got %f", rate)
+	}
+
+	// The errors of the store are returned rather than a result
+	store.err = errors.New("unreachable")
+	if err := bf.Add(ctx, key); err != store.err {
+		t.Errorf("Expected the error of the store, got %v", err)
+	}
+	if ok, err := bf.Check(ctx, key); ok || err != store.err {
+		t.Errorf("Expected the error of the store, got %t, %v", ok, err)
+	}
+
+	if err := bf.SetNamedHasher("unknown"); !errors.Is(err, bloom.ErrUnknownHasher) {
+		t.Errorf("Expected ErrUnknownHasher, got %v", err)
+	}
+	if err := bf.SetNamedHasher("fnv64a"); err != nil || bf.HasherName() != "fnv64a" {
+		t.Errorf("Expected the hasher fnv64a, got %q, %v", bf.HasherName(), err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+)
+
+// MarshalText returns the text form of a serialized filter, as used by the MarshalText
+// methods of the filters. It has the form
+//
+//	bloom<version>:<kind>:<hasher>:<base64 of the serialized filter>
+//
+// e.g. "bloom1:standard:fnv64:QkxNRgEB...". The kind and hasher are read from the header
+// of data, which must be a complete serialized filter.
+func MarshalText(data []byte) ([]byte, error) {
+	h := &Header{}
+	if _, err := h.ReadFrom(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("bloom%d:%s:%s:", h.Version, h.Kind, h.Hasher)
+	text := make([]byte, len(prefix)+base64.StdEncoding.EncodedLen(len(data)))
+	copy(text, prefix)
+	base64.StdEncoding.Encode(text[len(prefix):], data)
+
+	return text, nil
+}
+
+// UnmarshalText parses text produced by MarshalText and returns the serialized filter
+// it holds. It returns an error if the prefix is malformed, if the kind isn't kind, or if
+// the version, kind or hasher in the prefix don't match the header of the filter.
+func UnmarshalText(text []byte, kind Kind) ([]byte, error) {
+	parts := bytes.SplitN(text, []byte(":"), 4)
+	if len(parts) != 4 || !bytes.HasPrefix(parts[0], []byte("bloom")) {
+		return nil, fmt.Errorf("bloom: malformed text, expected bloom<version>:<kind>:<hasher>:<data>")
+	}
+
+	v, err := strconv.ParseUint(string(parts[0][len("bloom"):]), 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("bloom: malformed version %q", parts[0])
+	}
+
+	if string(parts[1]) != kind.String() {
+		return nil, fmt.Errorf("bloom: expected %s filter, got %q", kind, parts[1])
+	}
+
+	data := make([]byte, base64.StdEncoding.DecodedLen(len(parts[3])))
+	n, err := base64.StdEncoding.Decode(data, parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("bloom: malformed data: %v", err)
+	}
+	data = data[:n]
+
+	h := &Header{}
+	if _, err := h.ReadFrom(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	if uint64(h.Version) != v || h.Kind != kind || h.Hasher != string(parts[2]) {
+		return nil, fmt.Errorf("bloom: prefix %s:%s:%s doesn't match filter header bloom%d:%s:%s", parts[0], parts[1], parts[2], h.Version, h.Kind, h.Hasher)
+	}
+
+	return data, nil
+}
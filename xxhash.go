@@ -0,0 +1,207 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bloom
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// FastHasher is the name of XXH64, the hasher of the filters created by the NewFast
+// constructors, registered with RegisterHasher. DefaultHasher, fnv64, hashes a byte at a
+// time, so it is slow on long keys, and the last bytes of a key only change the low bits
+// of its digest, which multiply-shift ignores. XXH64 hashes 32 bytes at a time and mixes
+// all the bits of its digest. BenchmarkHashers measures them on keys of 8, 64 and 1024
+// bytes: on amd64, the hashers all take 12 to 18ns on 8 bytes, where the calls dominate,
+// while on 64 bytes XXH64 is about 2.5 times as fast as fnv64, close to murmur3, and on
+// 1024 bytes 13 times as fast as fnv64 and twice as fast as murmur3.
+const FastHasher = "xxhash64"
+
+func init() {
+	RegisterHasher(FastHasher, func() hash.Hash { return NewXXHash64(0) })
+}
+
+// xxHash64 computes XXH64 of the bytes written, 32 bytes at a time, see NewXXHash64.
+type xxHash64 struct {
+	seed           uint64
+	v1, v2, v3, v4 uint64
+	total          uint64
+
+	// mem holds the n bytes written past the last 32-byte stripe
+	mem [32]byte
+	n   int
+}
+
+var (
+	_ hash.Hash64 = (*xxHash64)(nil)
+	_ hash.Cloner = (*xxHash64)(nil)
+)
+
+// NewXXHash64 returns a hash.Hash64 computing the XXH64 hash of the bytes written with
+// seed, the same as the first value of XXHash for a seed of 0, and of SeededHash(seed)
+// otherwise. Sum appends the hash in big endian order.
+func NewXXHash64(seed uint64) hash.Hash64 {
+	this := &xxHash64{seed: seed}
+	this.Reset()
+	return this
+}
+
+func (this *xxHash64) Write(p []byte) (int, error) {
+	l := len(p)
+	this.total += uint64(l)
+
+	if this.n > 0 {
+		c := copy(this.mem[this.n:], p)
+		this.n += c
+		p = p[c:]
+		if this.n < len(this.mem) {
+			return l, nil
+		}
+		this.v1, this.v2, this.v3, this.v4, _ = xxStripes(this.v1, this.v2, this.v3, this.v4, this.mem[:])
+		this.n = 0
+	}
+
+	this.v1, this.v2, this.v3, this.v4, p = xxStripes(this.v1, this.v2, this.v3, this.v4, p)
+	this.n = copy(this.mem[:], p)
+	return l, nil
+}
+
+func (this *xxHash64) Sum64() uint64 {
+	var h uint64
+	if this.total >= 32 {
+		h = xxConverge(this.v1, this.v2, this.v3, this.v4)
+	} else {
+		h = this.seed + xxPrime5
+	}
+
+	return xxFinish(h+this.total, this.mem[:this.n])
+}
+
+func (this *xxHash64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, this.Sum64())
+}
+
+func (this *xxHash64) Reset() {
+	this.v1, this.v2, this.v3, this.v4 = xxInit(this.seed)
+	this.total, this.n = 0, 0
+}
+
+func (this *xxHash64) Size() int {
+	return 8
+}
+
+func (this *xxHash64) BlockSize() int {
+	return 32
+}
+
+// Clone implements hash.Cloner, returning a hasher with the same state.
+func (this *xxHash64) Clone() (hash.Cloner, error) {
+	c := *this
+	return &c, nil
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 returns the XXH64 hash of b with seed.
+func xxh64(b []byte, seed uint64) uint64 {
+	n := len(b)
+
+	var h uint64
+	if n >= 32 {
+		v1, v2, v3, v4 := xxInit(seed)
+		v1, v2, v3, v4, b = xxStripes(v1, v2, v3, v4, b)
+		h = xxConverge(v1, v2, v3, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+
+	return xxFinish(h+uint64(n), b)
+}
+
+// xxInit returns the lanes of XXH64 for seed.
+func xxInit(seed uint64) (uint64, uint64, uint64, uint64) {
+	// The lanes start at seed + prime1 + prime2, seed + prime2, seed and seed - prime1,
+	// which overflow, so they are computed at run time
+	v1, v4 := seed+xxPrime1, seed
+	v1 += xxPrime2
+	v4 -= xxPrime1
+	return v1, seed + xxPrime2, seed, v4
+}
+
+// xxStripes consumes the 32-byte stripes of b into the lanes, and returns them with the
+// rest of b.
+func xxStripes(v1, v2, v3, v4 uint64, b []byte) (uint64, uint64, uint64, uint64, []byte) {
+	for len(b) >= 32 {
+		v1 = xxRound(v1, binary.LittleEndian.Uint64(b[0:]))
+		v2 = xxRound(v2, binary.LittleEndian.Uint64(b[8:]))
+		v3 = xxRound(v3, binary.LittleEndian.Uint64(b[16:]))
+		v4 = xxRound(v4, binary.LittleEndian.Uint64(b[24:]))
+		b = b[32:]
+	}
+	return v1, v2, v3, v4, b
+}
+
+// xxConverge merges the lanes into a hash.
+func xxConverge(v1, v2, v3, v4 uint64) uint64 {
+	h := bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+		bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+	h = xxMerge(h, v1)
+	h = xxMerge(h, v2)
+	h = xxMerge(h, v3)
+	return xxMerge(h, v4)
+}
+
+// xxFinish mixes the last bytes b, less than 32, into h, which includes the length of the
+// input, and returns the final hash.
+func xxFinish(h uint64, b []byte) uint64 {
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	return h ^ h>>32
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}